@@ -49,6 +49,7 @@ type AccountDatabase interface {
 // Finds local user or an application service user.
 // Note: For an AS user, AS dummy device is returned.
 // On failure returns an JSON error response which can be sent to the client.
+// If the account is locked then the device is returned along with the error.
 func VerifyUserFromRequest(
 	req *http.Request, userAPI api.UserInternalAPI,
 ) (*api.Device, *util.JSONResponse) {
@@ -78,12 +79,34 @@ func VerifyUserFromRequest(
 			}
 		}
 	}
+	if res.SoftLogout {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.ExpiredToken("Access token has expired"),
+		}
+	}
 	if res.Device == nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
 			JSON: jsonerror.UnknownToken("Unknown token"),
 		}
 	}
+	if res.Locked {
+		// The device is given along with the error, for the endpoints which
+		// locked users can still use.
+		return res.Device, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UserLocked("This account has been locked"),
+		}
+	}
+	if res.Expired {
+		// As with locked users, the users of expired accounts can still log
+		// out.
+		return res.Device, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.AccountExpired(res.AdminContact),
+		}
+	}
 	return res.Device, nil
 }
 
@@ -10,4 +10,11 @@ const (
 	LoginTypeSharedSecret       = "org.matrix.login.shared_secret"
 	LoginTypeRecaptcha          = "m.login.recaptcha"
 	LoginTypeApplicationService = "m.login.application_service"
+	LoginTypeEmail              = "m.login.email.identity"
+	LoginTypeMSISDN             = "m.login.msisdn"
+	LoginTypeRegistrationToken  = "m.login.registration_token"
+	LoginTypeSSO                = "m.login.sso"
+	LoginTypeToken              = "m.login.token"
+	LoginTypeCAS                = "m.login.cas"
+	LoginTypeTerms              = "m.login.terms"
 )
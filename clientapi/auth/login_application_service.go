@@ -0,0 +1,98 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type GetAccountByLocalpart func(ctx context.Context, localpart string) (*api.Account, error)
+
+// LoginTypeApplicationService implements https://spec.matrix.org/v1.2/client-server-api/#appservice-login
+// Application services log in as one of their users with their as_token,
+// which is given as the access token of the login request, instead of a
+// password.
+type LoginTypeApplicationService struct {
+	Config                *config.ClientAPI
+	Token                 string
+	GetAccountByLocalpart GetAccountByLocalpart
+}
+
+func (t *LoginTypeApplicationService) Name() string {
+	return authtypes.LoginTypeApplicationService
+}
+
+func (t *LoginTypeApplicationService) Request() interface{} {
+	return &Login{}
+}
+
+func (t *LoginTypeApplicationService) Login(ctx context.Context, req interface{}) (*Login, *util.JSONResponse) {
+	r := req.(*Login)
+	var appservice *config.ApplicationService
+	for i := range t.Config.Derived.ApplicationServices {
+		if t.Config.Derived.ApplicationServices[i].ASToken == t.Token {
+			appservice = &t.Config.Derived.ApplicationServices[i]
+			break
+		}
+	}
+	if appservice == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Supplied access_token does not match any known application service"),
+		}
+	}
+	username := r.Username()
+	if username == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("A username must be supplied."),
+		}
+	}
+	localpart, err := userutil.ParseUsernameParam(username, &t.Config.Matrix.ServerName)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidUsername(err.Error()),
+		}
+	}
+	userID := userutil.MakeUserID(localpart, t.Config.Matrix.ServerName)
+	if localpart != appservice.SenderLocalpart && !appservice.IsInterestedInUserID(userID) {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.ASExclusive("Supplied username is not within the namespaces of application service " + appservice.ID),
+		}
+	}
+	if _, err = t.GetAccountByLocalpart(ctx, localpart); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("The account does not exist."),
+			}
+		}
+		util.GetLogger(ctx).WithError(err).Error("t.GetAccountByLocalpart failed")
+		res := jsonerror.InternalServerError()
+		return nil, &res
+	}
+	return r, nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestLoginTypeApplicationService(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: serverName,
+		},
+		Derived: &config.Derived{
+			ApplicationServices: []config.ApplicationService{{
+				ID:              "bridge",
+				ASToken:         "as_token",
+				SenderLocalpart: "bridgebot",
+				NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+					"users": {{Exclusive: true, Regex: "@bridge_.*:example.com", RegexpObject: regexp.MustCompile("@bridge_.*:example.com")}},
+				},
+			}},
+		},
+	}
+	accounts := map[string]bool{"bridgebot": true, "bridge_alice": true, "alice": true}
+	getAccountByLocalpart := func(ctx context.Context, localpart string) (*api.Account, error) {
+		if !accounts[localpart] {
+			return nil, sql.ErrNoRows
+		}
+		return &api.Account{Localpart: localpart}, nil
+	}
+
+	tsts := []struct {
+		Name     string
+		Token    string
+		User     string
+		WantCode int
+	}{
+		{"namespacedUser", "as_token", "bridge_alice", 0},
+		{"userID", "as_token", "@bridge_alice:example.com", 0},
+		{"sender", "as_token", "bridgebot", 0},
+		{"unknownToken", "other_token", "bridge_alice", http.StatusUnauthorized},
+		{"outsideNamespace", "as_token", "alice", http.StatusForbidden},
+		{"otherServer", "as_token", "@bridge_alice:other.com", http.StatusBadRequest},
+		{"noAccount", "as_token", "bridge_bob", http.StatusForbidden},
+		{"noUser", "as_token", "", http.StatusBadRequest},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			typ := &LoginTypeApplicationService{
+				Config:                cfg,
+				Token:                 tst.Token,
+				GetAccountByLocalpart: getAccountByLocalpart,
+			}
+			req := typ.Request().(*Login)
+			req.Identifier = LoginIdentifier{Type: "m.id.user", User: tst.User}
+			login, errRes := typ.Login(ctx, req)
+			if tst.WantCode != 0 {
+				if errRes == nil || errRes.Code != tst.WantCode {
+					t.Errorf("got %+v, want HTTP %d", errRes, tst.WantCode)
+				}
+				return
+			}
+			if errRes != nil {
+				t.Fatalf("Login failed: %+v", errRes)
+			}
+			if login.Username() != tst.User {
+				t.Errorf("got login for %q, want %q", login.Username(), tst.User)
+			}
+		})
+	}
+}
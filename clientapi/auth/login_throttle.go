@@ -0,0 +1,85 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// LoginThrottleAPI is the part of the user API which counts failed password
+// logins, so that clients have to wait after getting the password wrong too
+// often.
+type LoginThrottleAPI interface {
+	PerformLoginAttempt(ctx context.Context, req *api.PerformLoginAttemptRequest, res *api.PerformLoginAttemptResponse) error
+	PerformLoginResult(ctx context.Context, req *api.PerformLoginResultRequest, res *api.PerformLoginResultResponse) error
+}
+
+type clientIPContextKey struct{}
+
+// ContextWithClientIP returns a copy of the context which remembers the IP
+// address of the client. Failed password logins made with it are counted
+// against the IP address as well as the account.
+func ContextWithClientIP(ctx context.Context, ip net.IP) context.Context {
+	if ip == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientIPContextKey{}, ip.String())
+}
+
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPContextKey{}).(string)
+	return ip
+}
+
+// startLoginAttempt returns an error response if the client has to wait
+// before it can try to log in to the account again, because of earlier
+// failed logins. Otherwise the attempt is counted as a failure until
+// finishLoginAttempt says whether it succeeded.
+func startLoginAttempt(ctx context.Context, userAPI LoginThrottleAPI, localpart string) *util.JSONResponse {
+	var res api.PerformLoginAttemptResponse
+	if err := userAPI.PerformLoginAttempt(ctx, &api.PerformLoginAttemptRequest{
+		Localpart:  localpart,
+		RemoteAddr: clientIPFromContext(ctx),
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformLoginAttempt failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if res.RetryAfterMS == 0 {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: jsonerror.LimitExceeded("Too many failed logins, please try again later.", res.RetryAfterMS),
+	}
+}
+
+// finishLoginAttempt tells the user API whether a password login succeeded.
+// Failing to do so isn't fatal, as the login itself has been dealt with.
+func finishLoginAttempt(ctx context.Context, userAPI LoginThrottleAPI, localpart string, success bool) {
+	if err := userAPI.PerformLoginResult(ctx, &api.PerformLoginResultRequest{
+		Localpart:  localpart,
+		RemoteAddr: clientIPFromContext(ctx),
+		Success:    success,
+	}, &api.PerformLoginResultResponse{}); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformLoginResult failed")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
+)
+
+// loginTokenByteLength is how many random bytes are in a login token.
+const loginTokenByteLength = 32
+
+// LoginTokens keeps track of the m.login.token tokens which are issued after
+// single sign-on. Each token can be used to log in once, within
+// config.LoginTokenLifetime of being issued. If a JetStream key-value bucket
+// is given then tokens are stored there, so that a token which was issued by
+// one instance of the client API can be used with any other. Otherwise they
+// are kept in memory, which is only suitable when running a single instance.
+type LoginTokens struct {
+	kv    nats.KeyValue
+	mutex sync.Mutex
+	local map[string]localLoginToken
+}
+
+// localLoginToken is a token which is kept in memory, along with when to
+// forget about it, like the key-value bucket does.
+type localLoginToken struct {
+	userID  string
+	expires time.Time
+}
+
+// NewLoginTokens returns a login token store backed by the given key-value
+// bucket, or an in-memory store if kv is nil.
+func NewLoginTokens(kv nats.KeyValue) *LoginTokens {
+	return &LoginTokens{
+		kv:    kv,
+		local: make(map[string]localLoginToken),
+	}
+}
+
+// Create issues a new login token for the user.
+func (t *LoginTokens) Create(userID string) (string, error) {
+	b := make([]byte, loginTokenByteLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if t.kv == nil {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		now := time.Now()
+		for existing, local := range t.local {
+			if now.After(local.expires) {
+				delete(t.local, existing)
+			}
+		}
+		t.local[token] = localLoginToken{
+			userID:  userID,
+			expires: now.Add(config.LoginTokenLifetime),
+		}
+		return token, nil
+	}
+	if _, err := t.kv.Put(token, []byte(userID)); err != nil {
+		return "", fmt.Errorf("t.kv.Put: %w", err)
+	}
+	return token, nil
+}
+
+// Consume returns the user ID which the token was issued for and stops the
+// token from being used again. An empty string is returned if the token is
+// unknown, has expired or has already been used.
+func (t *LoginTokens) Consume(token string) (string, error) {
+	if t.kv == nil {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		local, ok := t.local[token]
+		delete(t.local, token)
+		if !ok || time.Now().After(local.expires) {
+			return "", nil
+		}
+		return local.userID, nil
+	}
+	// Tokens come from clients, so check that it is one of ours before
+	// using it as a key.
+	if b, err := base64.RawURLEncoding.DecodeString(token); err != nil || len(b) != loginTokenByteLength {
+		return "", nil
+	}
+	entry, err := t.kv.Get(token)
+	switch err {
+	case nil:
+	case nats.ErrKeyNotFound, nats.ErrKeyDeleted:
+		return "", nil
+	default:
+		return "", fmt.Errorf("t.kv.Get: %w", err)
+	}
+	if len(entry.Value()) == 0 {
+		// The token has already been used.
+		return "", nil
+	}
+	// Emptying the token only succeeds if nobody else has done so since we
+	// read it, so it can't be used twice by logging in at the same time.
+	if _, err = t.kv.Update(token, []byte{}, entry.Revision()); err != nil {
+		return "", fmt.Errorf("t.kv.Update: %w", err)
+	}
+	return string(entry.Value()), nil
+}
+
+type LoginTokenRequest struct {
+	Login
+	Token string `json:"token"`
+}
+
+// LoginTypeToken implements https://matrix.org/docs/spec/client_server/r0.6.1#token-based
+type LoginTypeToken struct {
+	LoginTokens *LoginTokens
+}
+
+func (t *LoginTypeToken) Name() string {
+	return authtypes.LoginTypeToken
+}
+
+func (t *LoginTypeToken) Request() interface{} {
+	return &LoginTokenRequest{}
+}
+
+func (t *LoginTypeToken) Login(ctx context.Context, req interface{}) (*Login, *util.JSONResponse) {
+	r := req.(*LoginTokenRequest)
+	userID, err := t.LoginTokens.Consume(r.Token)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("t.LoginTokens.Consume failed")
+		res := jsonerror.InternalServerError()
+		return nil, &res
+	}
+	if userID == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The login token is invalid or has expired."),
+		}
+	}
+	// The user is whoever the token was issued for, regardless of who the
+	// request says it is for.
+	r.Login.Identifier = LoginIdentifier{Type: "m.id.user", User: userID}
+	return &r.Login, nil
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLoginTokens(t *testing.T) {
+	tokens := NewLoginTokens(nil)
+	token, err := tokens.Create("@alice:example.com")
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	other, err := tokens.Create("@alice:example.com")
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	if token == other {
+		t.Errorf("got the same token twice, want different tokens")
+	}
+
+	if userID, _ := tokens.Consume("unknown"); userID != "" {
+		t.Errorf("Consume: got %q for an unknown token, want none", userID)
+	}
+	if userID, _ := tokens.Consume(token); userID != "@alice:example.com" {
+		t.Errorf("Consume: got %q, want @alice:example.com", userID)
+	}
+	// Tokens can only be used once.
+	if userID, _ := tokens.Consume(token); userID != "" {
+		t.Errorf("Consume: got %q for a used token, want none", userID)
+	}
+}
+
+func TestLoginTypeToken(t *testing.T) {
+	tokens := NewLoginTokens(nil)
+	token, err := tokens.Create("@alice:example.com")
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	typ := &LoginTypeToken{LoginTokens: tokens}
+
+	req := typ.Request().(*LoginTokenRequest)
+	req.Token = token
+	// The user in the request is ignored.
+	req.Identifier = LoginIdentifier{Type: "m.id.user", User: "bob"}
+	deviceID := "ALICEDEVICE"
+	req.DeviceID = &deviceID
+	login, errRes := typ.Login(ctx, req)
+	if errRes != nil {
+		t.Fatalf("Login failed: %+v", errRes)
+	}
+	if login.Username() != "@alice:example.com" || login.DeviceID != &deviceID {
+		t.Errorf("got login %+v, want @alice:example.com on ALICEDEVICE", login)
+	}
+
+	req = typ.Request().(*LoginTokenRequest)
+	req.Token = token
+	if _, errRes = typ.Login(ctx, req); errRes == nil || errRes.Code != http.StatusForbidden {
+		t.Errorf("Login: got %+v for a used token, want HTTP 403", errRes)
+	}
+}
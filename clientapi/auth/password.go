@@ -38,6 +38,9 @@ type PasswordRequest struct {
 type LoginTypePassword struct {
 	GetAccountByPassword GetAccountByPassword
 	Config               *config.ClientAPI
+	// If set, clients have to wait after getting the password wrong too
+	// often, to slow down guessing passwords.
+	UserAPI LoginThrottleAPI
 }
 
 func (t *LoginTypePassword) Name() string {
@@ -64,8 +67,21 @@ func (t *LoginTypePassword) Login(ctx context.Context, req interface{}) (*Login,
 			JSON: jsonerror.InvalidUsername(err.Error()),
 		}
 	}
+	if t.UserAPI != nil {
+		throttled := strings.ToLower(localpart)
+		if resErr := startLoginAttempt(ctx, t.UserAPI, throttled); resErr != nil {
+			return nil, resErr
+		}
+		login, resErr := t.login(ctx, r, localpart)
+		finishLoginAttempt(ctx, t.UserAPI, throttled, resErr == nil)
+		return login, resErr
+	}
+	return t.login(ctx, r, localpart)
+}
+
+func (t *LoginTypePassword) login(ctx context.Context, r *PasswordRequest, localpart string) (*Login, *util.JSONResponse) {
 	// Squash username to all lowercase letters
-	_, err = t.GetAccountByPassword(ctx, strings.ToLower(localpart), r.Password)
+	_, err := t.GetAccountByPassword(ctx, strings.ToLower(localpart), r.Password)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			_, err = t.GetAccountByPassword(ctx, localpart, r.Password)
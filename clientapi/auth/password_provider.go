@@ -0,0 +1,199 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// defaultPasswordProviderTimeout is how long password providers have to
+// answer if their timeout isn't configured.
+const defaultPasswordProviderTimeout = 10 * time.Second
+
+// PasswordProvider checks the passwords of users somewhere other than the
+// account database, e.g. in an LDAP directory.
+type PasswordProvider interface {
+	// CheckPassword returns true if the password is right for the user.
+	// Otherwise the password is checked by the next provider, or against
+	// the account database.
+	CheckPassword(ctx context.Context, localpart, password string) (bool, error)
+}
+
+// PasswordAccountDatabase is the part of the account database which is
+// needed to log in users whose passwords are checked by providers.
+type PasswordAccountDatabase interface {
+	GetAccountByPassword(ctx context.Context, localpart, password string) (*api.Account, error)
+	GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
+	IsAccountDeactivated(ctx context.Context, localpart string) (bool, error)
+}
+
+// WithPasswordProviders returns a GetAccountByPassword which asks the password
+// providers whether the password is right before checking it against the
+// password hash in the account database. Users whose password a provider
+// accepts still need an account which hasn't been deactivated.
+func WithPasswordProviders(providers []PasswordProvider, accountDB PasswordAccountDatabase) GetAccountByPassword {
+	if len(providers) == 0 {
+		return accountDB.GetAccountByPassword
+	}
+	return func(ctx context.Context, localpart, password string) (*api.Account, error) {
+		for i, provider := range providers {
+			valid, err := provider.CheckPassword(ctx, localpart, password)
+			if err != nil {
+				// The account database may still know the password, e.g.
+				// if the provider is down.
+				util.GetLogger(ctx).WithError(err).WithField("provider", i).Warn("Failed to check password with provider")
+				continue
+			}
+			if !valid {
+				continue
+			}
+			deactivated, err := accountDB.IsAccountDeactivated(ctx, localpart)
+			if err != nil {
+				return nil, err
+			}
+			if deactivated {
+				// The same as for deactivated accounts whose password is
+				// checked against the account database.
+				return nil, sql.ErrNoRows
+			}
+			return accountDB.GetAccountByLocalpart(ctx, localpart)
+		}
+		return accountDB.GetAccountByPassword(ctx, localpart, password)
+	}
+}
+
+// NewPasswordProviders returns the password providers which are configured
+// for the client API.
+func NewPasswordProviders(cfg *config.ClientAPI) []PasswordProvider {
+	providers := make([]PasswordProvider, 0, len(cfg.PasswordProviders))
+	for _, p := range cfg.PasswordProviders {
+		timeout := p.Timeout
+		if timeout == 0 {
+			timeout = defaultPasswordProviderTimeout
+		}
+		switch p.Type {
+		case config.PasswordProviderTypeHTTP:
+			providers = append(providers, &httpPasswordProvider{
+				url:        p.URL,
+				serverName: cfg.Matrix.ServerName,
+				client:     &http.Client{Timeout: timeout},
+			})
+		case config.PasswordProviderTypeExec:
+			providers = append(providers, &execPasswordProvider{
+				command:    p.Command,
+				serverName: cfg.Matrix.ServerName,
+				timeout:    timeout,
+			})
+		}
+	}
+	return providers
+}
+
+// passwordProviderRequest is what password providers are given to check.
+type passwordProviderRequest struct {
+	UserID    string `json:"user_id"`
+	Localpart string `json:"localpart"`
+	Password  string `json:"password"`
+}
+
+func newPasswordProviderRequest(serverName gomatrixserverlib.ServerName, localpart, password string) ([]byte, error) {
+	return json.Marshal(passwordProviderRequest{
+		UserID:    userutil.MakeUserID(localpart, serverName),
+		Localpart: localpart,
+		Password:  password,
+	})
+}
+
+// httpPasswordProvider POSTs the user ID and password to a URL, which answers
+// whether the password is valid.
+type httpPasswordProvider struct {
+	url        string
+	serverName gomatrixserverlib.ServerName
+	client     *http.Client
+}
+
+func (p *httpPasswordProvider) CheckPassword(ctx context.Context, localpart, password string) (bool, error) {
+	body, err := newPasswordProviderRequest(p.serverName, localpart, password)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("password provider returned HTTP %d", res.StatusCode)
+	}
+	var r struct {
+		Valid bool `json:"valid"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return false, fmt.Errorf("json.Decode: %w", err)
+	}
+	return r.Valid, nil
+}
+
+// execPasswordProvider runs a command which is given the user ID and password
+// on its standard input, and exits successfully if the password is valid.
+type execPasswordProvider struct {
+	command    []string
+	serverName gomatrixserverlib.ServerName
+	timeout    time.Duration
+}
+
+func (p *execPasswordProvider) CheckPassword(ctx context.Context, localpart, password string) (bool, error) {
+	input, err := newPasswordProviderRequest(p.serverName, localpart, password)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	// The password is never passed as an argument, since other users of the
+	// machine can see those.
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case ctx.Err() != nil:
+		return false, ctx.Err()
+	case errors.As(err, &exitErr):
+		return false, nil
+	default:
+		return false, err
+	}
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+type mockPasswordProvider struct {
+	passwords map[string]string
+	err       error
+}
+
+func (p *mockPasswordProvider) CheckPassword(ctx context.Context, localpart, password string) (bool, error) {
+	return p.passwords[localpart] == password, p.err
+}
+
+type mockPasswordAccountDatabase struct {
+	passwords   map[string]string
+	deactivated map[string]bool
+}
+
+func (d *mockPasswordAccountDatabase) GetAccountByPassword(ctx context.Context, localpart, password string) (*api.Account, error) {
+	hash, ok := d.passwords[localpart]
+	if !ok || d.deactivated[localpart] {
+		return nil, sql.ErrNoRows
+	}
+	if hash != password {
+		return nil, errors.New("wrong password")
+	}
+	return &api.Account{Localpart: localpart}, nil
+}
+
+func (d *mockPasswordAccountDatabase) GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error) {
+	if _, ok := d.passwords[localpart]; !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &api.Account{Localpart: localpart}, nil
+}
+
+func (d *mockPasswordAccountDatabase) IsAccountDeactivated(ctx context.Context, localpart string) (bool, error) {
+	if _, ok := d.passwords[localpart]; !ok {
+		return false, sql.ErrNoRows
+	}
+	return d.deactivated[localpart], nil
+}
+
+func TestWithPasswordProviders(t *testing.T) {
+	accountDB := &mockPasswordAccountDatabase{
+		passwords:   map[string]string{"alice": "local", "bob": "local", "charlie": "local"},
+		deactivated: map[string]bool{"charlie": true},
+	}
+	getAccountByPassword := WithPasswordProviders([]PasswordProvider{
+		&mockPasswordProvider{err: errors.New("provider is down")},
+		&mockPasswordProvider{passwords: map[string]string{"alice": "ldap", "charlie": "ldap", "dave": "ldap"}},
+	}, accountDB)
+
+	tsts := []struct {
+		Name      string
+		Localpart string
+		Password  string
+		WantOK    bool
+	}{
+		{"provider", "alice", "ldap", true},
+		{"local", "alice", "local", true},
+		{"localOnly", "bob", "local", true},
+		{"wrongPassword", "bob", "ldap", false},
+		{"deactivated", "charlie", "ldap", false},
+		{"noAccount", "dave", "ldap", false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			acc, err := getAccountByPassword(context.Background(), tst.Localpart, tst.Password)
+			if tst.WantOK {
+				if err != nil || acc.Localpart != tst.Localpart {
+					t.Errorf("got %+v, %v, want account %s", acc, err, tst.Localpart)
+				}
+			} else if err == nil {
+				t.Errorf("got %+v, want an error", acc)
+			}
+		})
+	}
+}
+
+func TestHTTPPasswordProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var r passwordProviderRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.UserID != "@alice:"+string(serverName) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]bool{"valid": r.Password == "right"})
+	}))
+	defer srv.Close()
+
+	providers := NewPasswordProviders(&config.ClientAPI{
+		Matrix:            &config.Global{ServerName: serverName},
+		PasswordProviders: []config.PasswordProvider{{Type: config.PasswordProviderTypeHTTP, URL: srv.URL}},
+	})
+	for password, want := range map[string]bool{"right": true, "wrong": false} {
+		valid, err := providers[0].CheckPassword(context.Background(), "alice", password)
+		if err != nil {
+			t.Fatalf("CheckPassword failed: %s", err)
+		}
+		if valid != want {
+			t.Errorf("got %v, want %v for password %q", valid, want, password)
+		}
+	}
+	if _, err := providers[0].CheckPassword(context.Background(), "bob", "right"); err == nil {
+		t.Errorf("got no error, want one for an HTTP error")
+	}
+}
+
+func TestExecPasswordProvider(t *testing.T) {
+	providers := NewPasswordProviders(&config.ClientAPI{
+		Matrix: &config.Global{ServerName: serverName},
+		PasswordProviders: []config.PasswordProvider{{
+			Type:    config.PasswordProviderTypeExec,
+			Command: []string{"grep", "-q", `"password":"right"`},
+		}},
+	})
+	for password, want := range map[string]bool{"right": true, "wrong": false} {
+		valid, err := providers[0].CheckPassword(context.Background(), "alice", password)
+		if err != nil {
+			t.Fatalf("CheckPassword failed: %s", err)
+		}
+		if valid != want {
+			t.Errorf("got %v, want %v for password %q", valid, want, password)
+		}
+	}
+}
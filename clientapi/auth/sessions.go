@@ -0,0 +1,173 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// maxSessionUpdateAttempts is how many times we'll retry adding a stage to a
+// session if another instance updates the same session at the same time.
+const maxSessionUpdateAttempts = 5
+
+// Sessions keeps track of user-interactive auth sessions and the stages that
+// have been completed for each of them. If a JetStream key-value bucket is
+// given then sessions are stored there, so that a client can complete stages
+// against any instance of the client API. Otherwise they are kept in memory,
+// which is only suitable when running a single instance.
+type Sessions struct {
+	kv    nats.KeyValue
+	mutex sync.Mutex
+	local map[string][]string
+}
+
+// NewSessions returns a session store backed by the given key-value bucket,
+// or an in-memory store if kv is nil.
+func NewSessions(kv nats.KeyValue) *Sessions {
+	return &Sessions{
+		kv:    kv,
+		local: make(map[string][]string),
+	}
+}
+
+// sessionKey encodes a session ID so that it is always a valid key, since
+// clients can send us arbitrary session IDs.
+func sessionKey(sessionID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sessionID))
+}
+
+// Create starts a new session with no completed stages.
+func (s *Sessions) Create(sessionID string) error {
+	if s.kv == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.local[sessionID] = []string{}
+		return nil
+	}
+	if _, err := s.kv.Put(sessionKey(sessionID), []byte("[]")); err != nil {
+		return fmt.Errorf("s.kv.Put: %w", err)
+	}
+	return nil
+}
+
+// Exists returns true if the session was created and hasn't been deleted or
+// expired since.
+func (s *Sessions) Exists(sessionID string) (bool, error) {
+	if sessionID == "" {
+		return false, nil
+	}
+	_, _, ok, err := s.get(sessionID)
+	return ok, err
+}
+
+// CompletedStages returns the stages which have been completed for the session.
+// An empty slice is returned for unknown sessions.
+func (s *Sessions) CompletedStages(sessionID string) ([]string, error) {
+	stages, _, _, err := s.get(sessionID)
+	return stages, err
+}
+
+// AddCompletedStage records that a stage has been completed for the session,
+// creating the session if it doesn't exist yet.
+func (s *Sessions) AddCompletedStage(sessionID, stage string) error {
+	if sessionID == "" {
+		return nil
+	}
+	if s.kv == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for _, completed := range s.local[sessionID] {
+			if completed == stage {
+				return nil
+			}
+		}
+		s.local[sessionID] = append(s.local[sessionID], stage)
+		return nil
+	}
+	// Another instance may update the session between us reading and writing
+	// it, in which case the update fails and we need to try again.
+	var err error
+	for attempt := 0; attempt < maxSessionUpdateAttempts; attempt++ {
+		stages, revision, ok, gerr := s.get(sessionID)
+		if gerr != nil {
+			return gerr
+		}
+		for _, completed := range stages {
+			if completed == stage {
+				return nil
+			}
+		}
+		value, merr := json.Marshal(append(stages, stage))
+		if merr != nil {
+			return fmt.Errorf("json.Marshal: %w", merr)
+		}
+		if ok {
+			_, err = s.kv.Update(sessionKey(sessionID), value, revision)
+		} else {
+			_, err = s.kv.Create(sessionKey(sessionID), value)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to update session: %w", err)
+}
+
+// Delete forgets about the session.
+func (s *Sessions) Delete(sessionID string) error {
+	if sessionID == "" {
+		return nil
+	}
+	if s.kv == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.local, sessionID)
+		return nil
+	}
+	if err := s.kv.Delete(sessionKey(sessionID)); err != nil && err != nats.ErrKeyNotFound {
+		return fmt.Errorf("s.kv.Delete: %w", err)
+	}
+	return nil
+}
+
+// get returns the completed stages and revision of the session, and whether
+// the session exists.
+func (s *Sessions) get(sessionID string) ([]string, uint64, bool, error) {
+	if s.kv == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		stages, ok := s.local[sessionID]
+		// Copy the stages so that callers can't modify our copy.
+		return append([]string{}, stages...), 0, ok, nil
+	}
+	entry, err := s.kv.Get(sessionKey(sessionID))
+	switch err {
+	case nil:
+	case nats.ErrKeyNotFound, nats.ErrKeyDeleted:
+		return []string{}, 0, false, nil
+	default:
+		return nil, 0, false, fmt.Errorf("s.kv.Get: %w", err)
+	}
+	stages := []string{}
+	if err = json.Unmarshal(entry.Value(), &stages); err != nil {
+		return nil, 0, false, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return stages, entry.Revision(), true, nil
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+)
+
+func testSessions(t *testing.T, sessions *Sessions) {
+	if exists, err := sessions.Exists("unknown"); err != nil || exists {
+		t.Fatalf("Exists returned %v, %v for an unknown session", exists, err)
+	}
+	if err := sessions.Create("session"); err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	if exists, err := sessions.Exists("session"); err != nil || !exists {
+		t.Fatalf("Exists returned %v, %v for a new session", exists, err)
+	}
+	for _, stage := range []string{"m.login.dummy", "m.login.recaptcha", "m.login.dummy"} {
+		if err := sessions.AddCompletedStage("session", stage); err != nil {
+			t.Fatalf("AddCompletedStage failed: %s", err)
+		}
+	}
+	stages, err := sessions.CompletedStages("session")
+	if err != nil {
+		t.Fatalf("CompletedStages failed: %s", err)
+	}
+	if want := []string{"m.login.dummy", "m.login.recaptcha"}; !reflect.DeepEqual(stages, want) {
+		t.Fatalf("got stages %v want %v", stages, want)
+	}
+	if err = sessions.Delete("session"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if exists, err := sessions.Exists("session"); err != nil || exists {
+		t.Fatalf("Exists returned %v, %v for a deleted session", exists, err)
+	}
+	// Stages can be added to sessions which we haven't seen before, or which
+	// have been deleted, and session IDs can contain any characters.
+	if err = sessions.AddCompletedStage("session with spaces/and.dots", "m.login.dummy"); err != nil {
+		t.Fatalf("AddCompletedStage failed: %s", err)
+	}
+	if err = sessions.AddCompletedStage("session", "m.login.dummy"); err != nil {
+		t.Fatalf("AddCompletedStage failed: %s", err)
+	}
+	stages, err = sessions.CompletedStages("session")
+	if err != nil {
+		t.Fatalf("CompletedStages failed: %s", err)
+	}
+	if want := []string{"m.login.dummy"}; !reflect.DeepEqual(stages, want) {
+		t.Fatalf("got stages %v want %v", stages, want)
+	}
+	if stages, err = sessions.CompletedStages("unknown"); err != nil || stages == nil || len(stages) != 0 {
+		t.Fatalf("CompletedStages returned %v, %v for an unknown session", stages, err)
+	}
+}
+
+func TestSessionsInMemory(t *testing.T) {
+	testSessions(t, NewSessions(nil))
+}
+
+func TestSessionsJetStream(t *testing.T) {
+	cfg := &config.JetStream{
+		InMemory:    true,
+		TopicPrefix: "AuthTest",
+		StoragePath: config.Path(t.TempDir()),
+	}
+	js := jetstream.Prepare(cfg)
+	kv, err := js.KeyValue(cfg.TopicFor(jetstream.ClientAPISessions))
+	if err != nil {
+		t.Fatalf("failed to get key-value bucket: %s", err)
+	}
+	testSessions(t, NewSessions(kv))
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// maxCASResponseSize is the most that we read from the CAS server in a
+// response.
+const maxCASResponseSize = 1024 * 1024
+
+// casProvider logs users in with the CAS protocol. Users are sent to the CAS
+// server's login page, which sends them back to the callback with a service
+// ticket that we validate with the CAS 3.0 service validation endpoint.
+type casProvider struct {
+	cfg    *config.IdentityProvider
+	client *http.Client
+}
+
+// casServiceResponse is the response of the CAS server to a service ticket
+// validation.
+type casServiceResponse struct {
+	XMLName xml.Name `xml:"http://www.yale.edu/tp/cas serviceResponse"`
+	Success *struct {
+		User       string `xml:"user"`
+		Attributes struct {
+			Values []casAttribute `xml:",any"`
+		} `xml:"attributes"`
+	} `xml:"authenticationSuccess"`
+	Failure *struct {
+		Code    string `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"authenticationFailure"`
+}
+
+type casAttribute struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+func newCASProvider(cfg *config.IdentityProvider, client *http.Client) *casProvider {
+	return &casProvider{
+		cfg:    cfg,
+		client: client,
+	}
+}
+
+// serviceURL returns the URL which the CAS server sends the user back to with
+// a ticket. CAS has no state parameter, so the state is part of the URL, and
+// the CAS server only validates tickets for the URL which they were issued
+// for.
+func (p *casProvider) serviceURL(callbackURL, state string) (string, error) {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return "", fmt.Errorf("url.Parse: %w", err)
+	}
+	q := u.Query()
+	q.Set("state", state)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// endpoint returns the URL of one of the CAS server's endpoints.
+func (p *casProvider) endpoint(path string, query url.Values) string {
+	return strings.TrimSuffix(p.cfg.ServerURL, "/") + path + "?" + query.Encode()
+}
+
+func (p *casProvider) authorizationURL(ctx context.Context, callbackURL, state, codeChallenge string) (string, error) {
+	service, err := p.serviceURL(callbackURL, state)
+	if err != nil {
+		return "", err
+	}
+	return p.endpoint("/login", url.Values{"service": {service}}), nil
+}
+
+func (p *casProvider) processCallback(req *http.Request, callbackURL, state, codeVerifier string) (*UserInfo, error) {
+	query := req.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		return nil, ErrInvalidState
+	}
+	ticket := query.Get("ticket")
+	if ticket == "" {
+		return nil, fmt.Errorf("%w: no ticket", ErrLoginRefused)
+	}
+	service, err := p.serviceURL(callbackURL, state)
+	if err != nil {
+		return nil, err
+	}
+
+	validateReq, err := http.NewRequestWithContext(
+		req.Context(), http.MethodGet,
+		p.endpoint("/p3/serviceValidate", url.Values{"service": {service}, "ticket": {ticket}}), nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	res, err := p.client.Do(validateReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate ticket: %w", err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCASResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate ticket: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to validate ticket: CAS server returned HTTP %d: %s", res.StatusCode, body)
+	}
+	var response casServiceResponse
+	if err = xml.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse ticket validation response: %w", err)
+	}
+	if response.Failure != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrLoginRefused, response.Failure.Code, strings.TrimSpace(response.Failure.Message))
+	}
+	if response.Success == nil || response.Success.User == "" {
+		return nil, errors.New("the ticket validation response has no user")
+	}
+
+	attributes := map[string]string{}
+	for _, attribute := range response.Success.Attributes.Values {
+		// Attributes with more than one value are repeated, so the first
+		// value is used.
+		if _, ok := attributes[attribute.XMLName.Local]; !ok {
+			attributes[attribute.XMLName.Local] = attribute.Value
+		}
+	}
+	mapping := p.cfg.AttributeMapping
+	info := &UserInfo{
+		Subject:            response.Success.User,
+		SuggestedLocalpart: response.Success.User,
+	}
+	if mapping.Subject != "" {
+		info.Subject = attributes[mapping.Subject]
+		if info.Subject == "" {
+			return nil, fmt.Errorf("the ticket validation response has no %q attribute", mapping.Subject)
+		}
+	}
+	if mapping.Localpart != "" {
+		info.SuggestedLocalpart = attributes[mapping.Localpart]
+	}
+	displayNameAttribute := mapping.DisplayName
+	if displayNameAttribute == "" {
+		displayNameAttribute = "displayName"
+	}
+	info.DisplayName = attributes[displayNameAttribute]
+	return info, nil
+}
@@ -0,0 +1,146 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// newTestCASServer returns a CAS server which issues the ticket "ST-1234" to
+// Alice for the service that she logged in to.
+func newTestCASServer(t *testing.T) *httptest.Server {
+	var service string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cas/login", func(w http.ResponseWriter, req *http.Request) {
+		service = req.URL.Query().Get("service")
+		http.Redirect(w, req, service+"&ticket=ST-1234", http.StatusFound)
+	})
+	mux.HandleFunc("/cas/p3/serviceValidate", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		if req.URL.Query().Get("ticket") != "ST-1234" || req.URL.Query().Get("service") != service {
+			fmt.Fprintf(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:authenticationFailure code="INVALID_TICKET">Ticket %s not recognized</cas:authenticationFailure>
+</cas:serviceResponse>`, req.URL.Query().Get("ticket"))
+			return
+		}
+		_, _ = w.Write([]byte(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:authenticationSuccess>
+		<cas:user>alice</cas:user>
+		<cas:attributes>
+			<cas:displayName>Alice Smith</cas:displayName>
+			<cas:employeeNumber>1234</cas:employeeNumber>
+			<cas:mail>alice@example.com</cas:mail>
+			<cas:mail>asmith@example.com</cas:mail>
+		</cas:attributes>
+	</cas:authenticationSuccess>
+</cas:serviceResponse>`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCASProvider(t *testing.T) {
+	srv := newTestCASServer(t)
+	cfg := &config.SSO{
+		Enabled: true,
+		Providers: []config.IdentityProvider{{
+			ID:        "cas",
+			Name:      "CAS",
+			Type:      config.IdentityProviderTypeCAS,
+			ServerURL: srv.URL + "/cas/",
+		}, {
+			ID:        "mapped",
+			Name:      "Mapped",
+			Type:      config.IdentityProviderTypeCAS,
+			ServerURL: srv.URL + "/cas",
+			AttributeMapping: config.SSOAttributeMapping{
+				Subject:   "employeeNumber",
+				Localpart: "mail",
+			},
+		}},
+	}
+	a, err := NewAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("NewAuthenticator failed: %s", err)
+	}
+	if a.CASProvider() != "cas" {
+		t.Errorf("got CAS provider %q, want cas", a.CASProvider())
+	}
+	callbackURL := "https://matrix.example.com/callback"
+
+	// login sends the user to the CAS server and returns the request which
+	// the CAS server sends them back to the callback with.
+	login := func(t *testing.T, providerID, state string) *http.Request {
+		authURL, err := a.AuthorizationURL(context.Background(), providerID, callbackURL, state, "")
+		if err != nil {
+			t.Fatalf("AuthorizationURL failed: %s", err)
+		}
+		u, err := url.Parse(authURL)
+		if err != nil {
+			t.Fatalf("url.Parse failed: %s", err)
+		}
+		if want := callbackURL + "?state=" + state; u.Path != "/cas/login" || u.Query().Get("service") != want {
+			t.Fatalf("got authorization URL %q, want the login page with the service %q", authURL, want)
+		}
+		client := srv.Client()
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		res, err := client.Get(authURL)
+		if err != nil {
+			t.Fatalf("failed to log in at the CAS server: %s", err)
+		}
+		_ = res.Body.Close()
+		return httptest.NewRequest(http.MethodGet, res.Header.Get("Location"), nil)
+	}
+
+	tsts := []struct {
+		Name       string
+		ProviderID string
+		Want       UserInfo
+	}{
+		{"default", "cas", UserInfo{Subject: "alice", SuggestedLocalpart: "alice", DisplayName: "Alice Smith"}},
+		{"mapped", "mapped", UserInfo{Subject: "1234", SuggestedLocalpart: "alice@example.com", DisplayName: "Alice Smith"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := login(t, tst.ProviderID, "state")
+			info, err := a.ProcessCallback(req, tst.ProviderID, callbackURL, "state", "")
+			if err != nil {
+				t.Fatalf("ProcessCallback failed: %s", err)
+			}
+			if *info != tst.Want {
+				t.Errorf("got %+v, want %+v", *info, tst.Want)
+			}
+		})
+	}
+
+	t.Run("wrongState", func(t *testing.T) {
+		req := login(t, "cas", "state")
+		if _, err := a.ProcessCallback(req, "cas", callbackURL, "other", ""); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("ProcessCallback: got %v, want ErrInvalidState", err)
+		}
+	})
+	t.Run("otherLoginAttempt", func(t *testing.T) {
+		// The ticket was issued for a different login attempt, even though
+		// the state has been changed to match this one.
+		login(t, "cas", "state")
+		req := httptest.NewRequest(http.MethodGet, callbackURL+"?state=other&ticket=ST-1234", nil)
+		if _, err := a.ProcessCallback(req, "cas", callbackURL, "other", ""); !errors.Is(err, ErrLoginRefused) {
+			t.Errorf("ProcessCallback: got %v, want ErrLoginRefused", err)
+		}
+	})
+	t.Run("noTicket", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, callbackURL+"?state=state", nil)
+		if _, err := a.ProcessCallback(req, "cas", callbackURL, "state", ""); !errors.Is(err, ErrLoginRefused) {
+			t.Errorf("ProcessCallback: got %v, want ErrLoginRefused", err)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// maxOIDCResponseSize is the most that we read from the identity provider
+// in a response.
+const maxOIDCResponseSize = 1024 * 1024
+
+// oidcProvider logs users in with the OpenID Connect authorization code flow.
+// We learn who the user is from the userinfo endpoint, using the access token
+// that we get from the token endpoint over TLS, so the ID token doesn't need
+// to be verified.
+type oidcProvider struct {
+	cfg    *config.IdentityProvider
+	client *http.Client
+
+	mutex     sync.Mutex
+	discovery *oidcDiscovery
+}
+
+// oidcDiscovery is the part of the provider's discovery document that we use.
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+func newOIDCProvider(cfg *config.IdentityProvider, client *http.Client) *oidcProvider {
+	return &oidcProvider{
+		cfg:    cfg,
+		client: client,
+	}
+}
+
+// discover returns the provider's discovery document. It is fetched the first
+// time it is needed and then kept, unless fetching it fails.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.DiscoveryURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	var discovery oidcDiscovery
+	if err = p.doJSON(req, &discovery); err != nil {
+		return nil, fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("discovery document %s is missing endpoints", p.cfg.DiscoveryURL)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) authorizationURL(ctx context.Context, callbackURL, state, codeChallenge string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("url.Parse: %w", err)
+	}
+	scopes := p.cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", callbackURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (p *oidcProvider) processCallback(req *http.Request, callbackURL, state, codeVerifier string) (*UserInfo, error) {
+	query := req.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		return nil, ErrInvalidState
+	}
+	if query.Get("error") != "" {
+		return nil, fmt.Errorf("%w: %s: %s", ErrLoginRefused, query.Get("error"), query.Get("error_description"))
+	}
+	ctx := req.Context()
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Exchange the code for an access token.
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {callbackURL},
+		"code_verifier": {codeVerifier},
+	}
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	var token oidcTokenResponse
+	if err = p.doJSON(tokenReq, &token); err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	if token.AccessToken == "" || !strings.EqualFold(token.TokenType, "Bearer") {
+		return nil, fmt.Errorf("token endpoint returned a %q token, want a bearer token", token.TokenType)
+	}
+
+	// Find out who the access token belongs to.
+	userinfoReq, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	userinfoReq.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var claims map[string]interface{}
+	if err = p.doJSON(userinfoReq, &claims); err != nil {
+		return nil, fmt.Errorf("failed to fetch userinfo: %w", err)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("userinfo has no subject")
+	}
+	localpartClaim := p.cfg.AttributeMapping.Localpart
+	if localpartClaim == "" {
+		localpartClaim = "preferred_username"
+	}
+	displayNameClaim := p.cfg.AttributeMapping.DisplayName
+	if displayNameClaim == "" {
+		displayNameClaim = "name"
+	}
+	info := &UserInfo{Subject: subject}
+	info.SuggestedLocalpart, _ = claims[localpartClaim].(string)
+	info.DisplayName, _ = claims[displayNameClaim].(string)
+	return info, nil
+}
+
+// doJSON sends the request and decodes the JSON response into v.
+func (p *oidcProvider) doJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxOIDCResponseSize))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d: %s", req.URL.Redacted(), res.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
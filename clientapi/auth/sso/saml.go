@@ -0,0 +1,292 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/crewjam/saml"
+	"github.com/matrix-org/dendrite/setup/config"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// maxSAMLMetadataSize is the most that we read of the identity provider's
+// metadata.
+const maxSAMLMetadataSize = 10 * 1024 * 1024
+
+// samlProvider logs users in with SAML 2.0 web browser single sign-on. Users
+// are sent to the identity provider with a signed request using the
+// HTTP-Redirect binding, and it sends them back to the callback with a
+// signed assertion using the HTTP-POST or HTTP-Artifact binding.
+type samlProvider struct {
+	cfg         *config.IdentityProvider
+	client      *http.Client
+	key         *rsa.PrivateKey
+	certificate *x509.Certificate
+
+	mutex       sync.Mutex
+	idpMetadata *saml.EntityDescriptor
+}
+
+func newSAMLProvider(cfg *config.IdentityProvider, client *http.Client) (*samlProvider, error) {
+	keyPair, err := tls.LoadX509KeyPair(string(cfg.CertificatePath), string(cfg.PrivateKeyPath))
+	if err != nil {
+		return nil, fmt.Errorf("tls.LoadX509KeyPair: %w", err)
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key must be an RSA key")
+	}
+	certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("x509.ParseCertificate: %w", err)
+	}
+	return &samlProvider{
+		cfg:         cfg,
+		client:      client,
+		key:         key,
+		certificate: certificate,
+	}, nil
+}
+
+// fetchMetadata returns the identity provider's metadata. It is fetched the
+// first time it is needed and then kept, unless fetching it fails.
+func (p *samlProvider) fetchMetadata(ctx context.Context) (*saml.EntityDescriptor, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.idpMetadata != nil {
+		return p.idpMetadata, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.MetadataURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata: %w", err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch metadata: %s returned HTTP %d", req.URL.Redacted(), res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSAMLMetadataSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata: %w", err)
+	}
+	metadata, err := parseSAMLMetadata(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata %s: %w", req.URL.Redacted(), err)
+	}
+	p.idpMetadata = metadata
+	return p.idpMetadata, nil
+}
+
+// parseSAMLMetadata parses the metadata of an identity provider. The metadata
+// is either an EntityDescriptor, or an EntitiesDescriptor which contains the
+// identity provider's EntityDescriptor.
+func parseSAMLMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.NewDecoder(bytes.NewReader(data)).Decode(&root); err != nil {
+		return nil, err
+	}
+	var entities []saml.EntityDescriptor
+	switch root.XMLName.Local {
+	case "EntityDescriptor":
+		var entity saml.EntityDescriptor
+		if err := xml.Unmarshal(data, &entity); err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	case "EntitiesDescriptor":
+		var descriptor saml.EntitiesDescriptor
+		if err := xml.Unmarshal(data, &descriptor); err != nil {
+			return nil, err
+		}
+		entities = descriptor.EntityDescriptors
+	default:
+		return nil, fmt.Errorf("unexpected element <%s>", root.XMLName.Local)
+	}
+	for i := range entities {
+		if len(entities[i].IDPSSODescriptors) > 0 {
+			return &entities[i], nil
+		}
+	}
+	return nil, errors.New("no identity provider in metadata")
+}
+
+// serviceProvider returns Dendrite as a service provider of the identity
+// provider, with assertions consumed at the callback URL. The identity
+// provider's metadata is only needed for making requests and consuming
+// assertions, so it can be nil.
+func (p *samlProvider) serviceProvider(callbackURL string, idpMetadata *saml.EntityDescriptor) (*saml.ServiceProvider, error) {
+	acsURL, err := url.Parse(callbackURL)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	// The metadata is served next to the callback, at
+	// .../login/sso/saml/metadata/{id}.
+	metadataURL := *acsURL
+	metadataURL.Path = metadataURL.Path[:strings.LastIndex(metadataURL.Path, "/")+1] + "saml/metadata/" + p.cfg.ID
+	metadataURL.RawPath = ""
+	metadataURL.RawQuery = ""
+	nameIDFormat := saml.PersistentNameIDFormat
+	if p.cfg.AttributeMapping.Subject != "" {
+		nameIDFormat = saml.UnspecifiedNameIDFormat
+	}
+	return &saml.ServiceProvider{
+		EntityID:          p.cfg.EntityID,
+		Key:               p.key,
+		Certificate:       p.certificate,
+		HTTPClient:        p.client,
+		MetadataURL:       metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: nameIDFormat,
+		SignatureMethod:   dsig.RSASHA256SignatureMethod,
+	}, nil
+}
+
+// samlRequestID returns the ID of the authentication request for the state,
+// so that we can check that an assertion was issued for the login attempt
+// without having to remember the ID.
+func samlRequestID(state string) string {
+	return "id-" + state
+}
+
+func (p *samlProvider) metadata(callbackURL string) ([]byte, error) {
+	sp, err := p.serviceProvider(callbackURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("xml.MarshalIndent: %w", err)
+	}
+	return metadata, nil
+}
+
+func (p *samlProvider) authorizationURL(ctx context.Context, callbackURL, state, codeChallenge string) (string, error) {
+	idpMetadata, err := p.fetchMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	sp, err := p.serviceProvider(callbackURL, idpMetadata)
+	if err != nil {
+		return "", err
+	}
+	ssoURL := sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if ssoURL == "" {
+		return "", errors.New("the identity provider doesn't support the HTTP-Redirect binding")
+	}
+	req, err := sp.MakeAuthenticationRequest(ssoURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", fmt.Errorf("sp.MakeAuthenticationRequest: %w", err)
+	}
+	req.ID = samlRequestID(state)
+	u, err := req.Redirect(url.QueryEscape(state), sp)
+	if err != nil {
+		return "", fmt.Errorf("req.Redirect: %w", err)
+	}
+	return u.String(), nil
+}
+
+func (p *samlProvider) processCallback(req *http.Request, callbackURL, state, codeVerifier string) (*UserInfo, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, fmt.Errorf("req.ParseForm: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Form.Get("RelayState")), []byte(state)) != 1 {
+		return nil, ErrInvalidState
+	}
+	idpMetadata, err := p.fetchMetadata(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	sp, err := p.serviceProvider(callbackURL, idpMetadata)
+	if err != nil {
+		return nil, err
+	}
+	// The signature, audience, destination and validity of the assertion
+	// are checked, along with that it is a response to our request.
+	assertion, err := sp.ParseResponse(req, []string{samlRequestID(state)})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if !errors.As(err, &invalid) {
+			return nil, err
+		}
+		var status saml.ErrBadStatus
+		if errors.As(invalid.PrivateErr, &status) {
+			return nil, fmt.Errorf("%w: %s", ErrLoginRefused, status.Status)
+		}
+		return nil, fmt.Errorf("invalid SAML response: %w", invalid.PrivateErr)
+	}
+
+	mapping := p.cfg.AttributeMapping
+	var subject string
+	if mapping.Subject != "" {
+		subject = samlAttribute(assertion, mapping.Subject)
+	} else if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		// Transient subjects change every time that the user logs in, so
+		// they can't be used to find the user's account.
+		if assertion.Subject.NameID.Format == string(saml.TransientNameIDFormat) {
+			return nil, errors.New("the assertion has a transient subject, so attribute_mapping.subject must be set")
+		}
+		subject = assertion.Subject.NameID.Value
+	}
+	if subject == "" {
+		return nil, errors.New("the assertion has no subject")
+	}
+	localpartAttribute := mapping.Localpart
+	if localpartAttribute == "" {
+		localpartAttribute = "uid"
+	}
+	displayNameAttribute := mapping.DisplayName
+	if displayNameAttribute == "" {
+		displayNameAttribute = "displayName"
+	}
+	return &UserInfo{
+		Subject:            subject,
+		SuggestedLocalpart: samlAttribute(assertion, localpartAttribute),
+		DisplayName:        samlAttribute(assertion, displayNameAttribute),
+	}, nil
+}
+
+// samlAttribute returns the first value of the attribute in the assertion
+// with the given name or friendly name, or an empty string if there is none.
+func samlAttribute(assertion *saml.Assertion, name string) string {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if (attribute.Name == name || attribute.FriendlyName == name) && len(attribute.Values) > 0 {
+				return attribute.Values[0].Value
+			}
+		}
+	}
+	return ""
+}
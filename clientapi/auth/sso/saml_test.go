@@ -0,0 +1,258 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"html"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// newTestKeyPair makes an RSA key and a self-signed certificate for it, and
+// writes them to PEM files in the directory.
+func newTestKeyPair(t *testing.T, dir, name string) (*rsa.PrivateKey, *x509.Certificate, config.Path, config.Path) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey failed: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate failed: %s", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate failed: %s", err)
+	}
+	keyPath := filepath.Join(dir, name+".key")
+	certificatePath := filepath.Join(dir, name+".crt")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("os.WriteFile failed: %s", err)
+	}
+	if err = os.WriteFile(certificatePath, certificatePEM, 0600); err != nil {
+		t.Fatalf("os.WriteFile failed: %s", err)
+	}
+	return key, certificate, config.Path(keyPath), config.Path(certificatePath)
+}
+
+type testServiceProviders func(serviceProviderID string) (*saml.EntityDescriptor, error)
+
+func (f testServiceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	return f(serviceProviderID)
+}
+
+type testSession saml.Session
+
+func (s *testSession) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	session := saml.Session(*s)
+	return &session
+}
+
+var samlFormValueRegexp = regexp.MustCompile(`name="(SAMLResponse|RelayState)" value="([^"]*)"`)
+
+func TestSAMLProvider(t *testing.T) {
+	dir := t.TempDir()
+	idpKey, idpCertificate, _, _ := newTestKeyPair(t, dir, "idp")
+	_, _, spKeyPath, spCertificatePath := newTestKeyPair(t, dir, "sp")
+	callbackURL := "https://matrix.example.com/_matrix/client/r0/login/sso/callback"
+	session := &testSession{
+		ID:             "session",
+		CreateTime:     time.Now(),
+		ExpireTime:     time.Now().Add(time.Hour),
+		NameID:         "alice-persistent-id",
+		NameIDFormat:   string(saml.PersistentNameIDFormat),
+		UserName:       "Alice",
+		UserCommonName: "Alice",
+		CustomAttributes: []saml.Attribute{{
+			Name:   "displayName",
+			Values: []saml.AttributeValue{{Type: "xs:string", Value: "Alice Smith"}},
+		}, {
+			FriendlyName: "employeeNumber",
+			Name:         "urn:oid:2.16.840.1.113730.3.1.3",
+			Values:       []saml.AttributeValue{{Type: "xs:string", Value: "1234"}},
+		}},
+	}
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	metadataURL, _ := url.Parse(srv.URL + "/metadata")
+	ssoURL, _ := url.Parse(srv.URL + "/sso")
+	var a *Authenticator
+	idp := &saml.IdentityProvider{
+		Key:         idpKey,
+		Certificate: idpCertificate,
+		Logger:      logger.DefaultLogger,
+		MetadataURL: *metadataURL,
+		SSOURL:      *ssoURL,
+		ServiceProviderProvider: testServiceProviders(func(serviceProviderID string) (*saml.EntityDescriptor, error) {
+			for _, providerID := range []string{"saml", "mapped"} {
+				metadata, err := a.SAMLMetadata(providerID, callbackURL)
+				if err != nil {
+					return nil, err
+				}
+				var entity saml.EntityDescriptor
+				if err = xml.Unmarshal(metadata, &entity); err != nil {
+					return nil, err
+				}
+				if entity.EntityID == serviceProviderID {
+					return &entity, nil
+				}
+			}
+			return nil, os.ErrNotExist
+		}),
+		SessionProvider: session,
+	}
+	mux.Handle("/", idp.Handler())
+
+	cfg := &config.SSO{
+		Enabled: true,
+		Providers: []config.IdentityProvider{{
+			ID:              "saml",
+			Name:            "SAML",
+			Type:            config.IdentityProviderTypeSAML,
+			MetadataURL:     metadataURL.String(),
+			PrivateKeyPath:  spKeyPath,
+			CertificatePath: spCertificatePath,
+		}, {
+			ID:              "mapped",
+			Name:            "Mapped",
+			Type:            config.IdentityProviderTypeSAML,
+			MetadataURL:     metadataURL.String(),
+			PrivateKeyPath:  spKeyPath,
+			CertificatePath: spCertificatePath,
+			EntityID:        "urn:example:dendrite",
+			AttributeMapping: config.SSOAttributeMapping{
+				Subject:     "employeeNumber",
+				Localpart:   "urn:oid:0.9.2342.19200300.100.1.1",
+				DisplayName: "cn",
+			},
+		}},
+	}
+	var err error
+	if a, err = NewAuthenticator(cfg); err != nil {
+		t.Fatalf("NewAuthenticator failed: %s", err)
+	}
+
+	metadata, err := a.SAMLMetadata("saml", callbackURL)
+	if err != nil {
+		t.Fatalf("SAMLMetadata failed: %s", err)
+	}
+	var entity saml.EntityDescriptor
+	if err = xml.Unmarshal(metadata, &entity); err != nil {
+		t.Fatalf("xml.Unmarshal failed: %s", err)
+	}
+	if want := "https://matrix.example.com/_matrix/client/r0/login/sso/saml/metadata/saml"; entity.EntityID != want {
+		t.Errorf("got entity ID %q, want %q", entity.EntityID, want)
+	}
+	if len(entity.SPSSODescriptors) != 1 || entity.SPSSODescriptors[0].AssertionConsumerServices[0].Location != callbackURL {
+		t.Errorf("got service provider %+v, want one with the callback as its assertion consumer service", entity.SPSSODescriptors)
+	}
+	if _, err = a.SAMLMetadata("unknown", callbackURL); err != ErrUnknownProvider {
+		t.Errorf("SAMLMetadata: got %v, want ErrUnknownProvider", err)
+	}
+
+	// login sends the user to the identity provider and returns the request
+	// which the identity provider sends them back to the callback with.
+	login := func(t *testing.T, providerID, state string) *http.Request {
+		authURL, err := a.AuthorizationURL(context.Background(), providerID, callbackURL, state, "")
+		if err != nil {
+			t.Fatalf("AuthorizationURL failed: %s", err)
+		}
+		if !strings.HasPrefix(authURL, ssoURL.String()+"?") {
+			t.Fatalf("got authorization URL %q, want the identity provider's SSO URL", authURL)
+		}
+		res, err := srv.Client().Get(authURL)
+		if err != nil {
+			t.Fatalf("failed to log in at the identity provider: %s", err)
+		}
+		defer res.Body.Close() // nolint: errcheck
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("identity provider returned HTTP %d: %s", res.StatusCode, body)
+		}
+		form := url.Values{}
+		for _, m := range samlFormValueRegexp.FindAllStringSubmatch(string(body), -1) {
+			form.Set(m[1], html.UnescapeString(m[2]))
+		}
+		if form.Get("SAMLResponse") == "" || form.Get("RelayState") != state {
+			t.Fatalf("got form %v, want a SAML response with the state", form)
+		}
+		req := httptest.NewRequest(http.MethodPost, callbackURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	tsts := []struct {
+		Name       string
+		ProviderID string
+		Want       UserInfo
+	}{
+		{"default", "saml", UserInfo{Subject: "alice-persistent-id", SuggestedLocalpart: "Alice", DisplayName: "Alice Smith"}},
+		{"mapped", "mapped", UserInfo{Subject: "1234", SuggestedLocalpart: "Alice", DisplayName: "Alice"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := login(t, tst.ProviderID, "state")
+			info, err := a.ProcessCallback(req, tst.ProviderID, callbackURL, "state", "")
+			if err != nil {
+				t.Fatalf("ProcessCallback failed: %s", err)
+			}
+			if *info != tst.Want {
+				t.Errorf("got %+v, want %+v", *info, tst.Want)
+			}
+		})
+	}
+
+	t.Run("wrongState", func(t *testing.T) {
+		req := login(t, "saml", "state")
+		if _, err := a.ProcessCallback(req, "saml", callbackURL, "other", ""); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("ProcessCallback: got %v, want ErrInvalidState", err)
+		}
+	})
+	t.Run("otherLoginAttempt", func(t *testing.T) {
+		// The assertion is for a different login attempt, even though the
+		// relay state has been changed to match this one.
+		req := login(t, "saml", "state")
+		_ = req.ParseForm()
+		req.Form.Set("RelayState", "other")
+		req.PostForm.Set("RelayState", "other")
+		if _, err := a.ProcessCallback(req, "saml", callbackURL, "other", ""); err == nil {
+			t.Errorf("ProcessCallback: got nil, want an error for an assertion for a different request")
+		}
+	})
+	t.Run("transientSubject", func(t *testing.T) {
+		session.NameIDFormat = string(saml.TransientNameIDFormat)
+		defer func() { session.NameIDFormat = string(saml.PersistentNameIDFormat) }()
+		req := login(t, "saml", "state")
+		if _, err := a.ProcessCallback(req, "saml", callbackURL, "state", ""); err == nil {
+			t.Errorf("ProcessCallback: got nil, want an error for a transient subject")
+		}
+	})
+}
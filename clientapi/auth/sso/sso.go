@@ -0,0 +1,171 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sso implements logging in with single sign-on, by sending users to
+// an OpenID Connect, SAML 2.0 or CAS identity provider and finding out who
+// they are when it sends them back.
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+var (
+	// ErrUnknownProvider is returned for identity providers which aren't
+	// configured.
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	// ErrInvalidState is returned if the identity provider sends the user
+	// back with a different state from the one that they were sent with,
+	// because the callback wasn't for the login attempt that the user made.
+	ErrInvalidState = errors.New("the callback is for a different login attempt")
+	// ErrLoginRefused is returned if the identity provider says that the
+	// user didn't log in.
+	ErrLoginRefused = errors.New("the identity provider refused the login")
+)
+
+// UserInfo is what a provider told us about the user who logged in.
+type UserInfo struct {
+	// The ID of the user at the provider, which never changes
+	Subject string
+	// What the localpart of the user's ID should be, if they need an
+	// account, before it has been made into a valid localpart
+	SuggestedLocalpart string
+	// What the display name of the user should be, if they need an account
+	DisplayName string
+}
+
+// identityProvider is an identity provider which users can be sent to.
+type identityProvider interface {
+	authorizationURL(ctx context.Context, callbackURL, state, codeChallenge string) (string, error)
+	processCallback(req *http.Request, callbackURL, state, codeVerifier string) (*UserInfo, error)
+}
+
+// Authenticator sends users to the configured identity providers to log in.
+type Authenticator struct {
+	providers       map[string]identityProvider
+	defaultProvider string
+	casProvider     string
+}
+
+// NewAuthenticator returns an Authenticator for the configured identity
+// providers. An error is returned if the keys of a SAML provider can't be
+// loaded.
+func NewAuthenticator(cfg *config.SSO) (*Authenticator, error) {
+	a := &Authenticator{
+		providers: make(map[string]identityProvider, len(cfg.Providers)),
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	for i := range cfg.Providers {
+		p := &cfg.Providers[i]
+		switch p.Type {
+		case config.IdentityProviderTypeSAML:
+			provider, err := newSAMLProvider(p, client)
+			if err != nil {
+				return nil, fmt.Errorf("identity provider %q: %w", p.ID, err)
+			}
+			a.providers[p.ID] = provider
+		case config.IdentityProviderTypeCAS:
+			a.providers[p.ID] = newCASProvider(p, client)
+			if a.casProvider == "" {
+				a.casProvider = p.ID
+			}
+		default:
+			a.providers[p.ID] = newOIDCProvider(p, client)
+		}
+	}
+	if len(cfg.Providers) > 0 {
+		a.defaultProvider = cfg.Providers[0].ID
+	}
+	return a, nil
+}
+
+// DefaultProvider returns the ID of the identity provider to use when the
+// client doesn't say which one.
+func (a *Authenticator) DefaultProvider() string {
+	return a.defaultProvider
+}
+
+// CASProvider returns the ID of the identity provider to use for the legacy
+// CAS login endpoints, which is the first CAS provider, or an empty string if
+// there are no CAS providers.
+func (a *Authenticator) CASProvider() string {
+	return a.casProvider
+}
+
+// AuthorizationURL returns the URL to send the user to in order to log in
+// with the identity provider. The provider sends the user back to the
+// callback URL along with the state, which ProcessCallback checks. The code
+// challenge is the PKCE code challenge (RFC 7636) of the code verifier
+// which is given to ProcessCallback, and is only used by OpenID Connect.
+func (a *Authenticator) AuthorizationURL(ctx context.Context, providerID, callbackURL, state, codeChallenge string) (string, error) {
+	p, ok := a.providers[providerID]
+	if !ok {
+		return "", ErrUnknownProvider
+	}
+	return p.authorizationURL(ctx, callbackURL, state, codeChallenge)
+}
+
+// ProcessCallback finds out who the user is from the request which the
+// identity provider sent them back to the callback with. The state and code
+// verifier must be the ones which were given to AuthorizationURL.
+func (a *Authenticator) ProcessCallback(req *http.Request, providerID, callbackURL, state, codeVerifier string) (*UserInfo, error) {
+	p, ok := a.providers[providerID]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p.processCallback(req, callbackURL, state, codeVerifier)
+}
+
+// SAMLMetadata returns the metadata of Dendrite as a service provider for
+// the SAML identity provider, which the identity provider's administrator
+// needs in order to set Dendrite up.
+func (a *Authenticator) SAMLMetadata(providerID, callbackURL string) ([]byte, error) {
+	p, ok := a.providers[providerID].(*samlProvider)
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p.metadata(callbackURL)
+}
+
+// MapLocalpart turns a suggested localpart into one which is valid in user
+// IDs. Upper case letters are lowered and other characters which can't be in
+// user IDs are escaped as "=" followed by their hex value, so that different
+// suggestions don't map to the same localpart.
+func MapLocalpart(suggestion string) (string, error) {
+	suggestion = strings.ToLower(suggestion)
+	var localpart strings.Builder
+	for i := 0; i < len(suggestion); i++ {
+		c := suggestion[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.', c == '/':
+			localpart.WriteByte(c)
+		case c == '_' && i > 0:
+			// Localparts can't start with an underscore.
+			localpart.WriteByte(c)
+		default:
+			fmt.Fprintf(&localpart, "=%02x", c)
+		}
+	}
+	if localpart.Len() == 0 {
+		return "", errors.New("the identity provider didn't suggest a username")
+	}
+	return localpart.String(), nil
+}
@@ -0,0 +1,174 @@
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestMapLocalpart(t *testing.T) {
+	tsts := []struct {
+		Suggestion string
+		Want       string
+	}{
+		{"alice", "alice"},
+		{"Alice.Smith", "alice.smith"},
+		{"alice_smith", "alice_smith"},
+		{"_alice", "=5falice"},
+		{"alice smith", "alice=20smith"},
+		{"alice=20smith", "alice=3d20smith"},
+		{"alice@example.com", "alice=40example.com"},
+		{"élise", "=c3=a9lise"},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Suggestion, func(t *testing.T) {
+			got, err := MapLocalpart(tst.Suggestion)
+			if err != nil {
+				t.Fatalf("MapLocalpart failed: %s", err)
+			}
+			if got != tst.Want {
+				t.Errorf("got %q, want %q", got, tst.Want)
+			}
+		})
+	}
+	if _, err := MapLocalpart(""); err == nil {
+		t.Errorf("MapLocalpart: got nil, want an error for an empty suggestion")
+	}
+}
+
+// newTestProvider returns an OpenID Connect provider which issues the code
+// "code" for the code verifier "verifier", and says that the user is Alice.
+func newTestProvider(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": srv.URL + "/authorize?tenant=test",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		clientID, clientSecret, _ := req.BasicAuth()
+		if req.Method != http.MethodPost || clientID != "dendrite" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.PostFormValue("code") != "code" || req.PostFormValue("code_verifier") != "verifier" ||
+			req.PostFormValue("redirect_uri") != "https://matrix.example.com/callback" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token": "access", "token_type": "bearer"}`))
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"sub": "1234", "preferred_username": "alice", "name": "Alice", "nickname": "ally"}`))
+	})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAuthenticator(t *testing.T) {
+	srv := newTestProvider(t)
+	cfg := &config.SSO{
+		Enabled: true,
+		Providers: []config.IdentityProvider{{
+			ID:           "test",
+			Name:         "Test",
+			DiscoveryURL: srv.URL + "/.well-known/openid-configuration",
+			ClientID:     "dendrite",
+			ClientSecret: "secret",
+		}, {
+			ID:           "mapped",
+			Name:         "Mapped",
+			DiscoveryURL: srv.URL + "/.well-known/openid-configuration",
+			ClientID:     "dendrite",
+			ClientSecret: "secret",
+			Scopes:       []string{"openid"},
+			AttributeMapping: config.SSOAttributeMapping{
+				Localpart: "nickname",
+			},
+		}},
+	}
+	a, err := NewAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("NewAuthenticator failed: %s", err)
+	}
+	ctx := context.Background()
+	callbackURL := "https://matrix.example.com/callback"
+	if a.DefaultProvider() != "test" {
+		t.Errorf("got default provider %q, want test", a.DefaultProvider())
+	}
+
+	authURL, err := a.AuthorizationURL(ctx, "test", callbackURL, "state", "challenge")
+	if err != nil {
+		t.Fatalf("AuthorizationURL failed: %s", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("url.Parse failed: %s", err)
+	}
+	want := url.Values{
+		"tenant":                {"test"},
+		"response_type":         {"code"},
+		"client_id":             {"dendrite"},
+		"redirect_uri":          {callbackURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {"state"},
+		"code_challenge":        {"challenge"},
+		"code_challenge_method": {"S256"},
+	}
+	if u.Path != "/authorize" || u.Query().Encode() != want.Encode() {
+		t.Errorf("got authorization URL %q, want %s/authorize?%s", authURL, srv.URL, want.Encode())
+	}
+
+	tsts := []struct {
+		Name       string
+		ProviderID string
+		Want       UserInfo
+	}{
+		{"default", "test", UserInfo{Subject: "1234", SuggestedLocalpart: "alice", DisplayName: "Alice"}},
+		{"mapped", "mapped", UserInfo{Subject: "1234", SuggestedLocalpart: "ally", DisplayName: "Alice"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, callbackURL+"?code=code&state=state", nil)
+			info, err := a.ProcessCallback(req, tst.ProviderID, callbackURL, "state", "verifier")
+			if err != nil {
+				t.Fatalf("ProcessCallback failed: %s", err)
+			}
+			if *info != tst.Want {
+				t.Errorf("got %+v, want %+v", *info, tst.Want)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callbackURL+"?code=code&state=state", nil)
+	if _, err = a.ProcessCallback(req, "test", callbackURL, "state", "wrong"); err == nil {
+		t.Errorf("ProcessCallback: got nil, want an error for the wrong code verifier")
+	}
+	if _, err = a.ProcessCallback(req, "test", callbackURL, "other", "verifier"); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("ProcessCallback: got %v for the wrong state, want ErrInvalidState", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, callbackURL+"?error=access_denied&state=state", nil)
+	if _, err = a.ProcessCallback(req, "test", callbackURL, "state", "verifier"); !errors.Is(err, ErrLoginRefused) {
+		t.Errorf("ProcessCallback: got %v for an error, want ErrLoginRefused", err)
+	}
+	if _, err = a.AuthorizationURL(ctx, "unknown", callbackURL, "state", "challenge"); err != ErrUnknownProvider {
+		t.Errorf("AuthorizationURL: got %v, want ErrUnknownProvider", err)
+	}
+	if _, err = a.ProcessCallback(req, "unknown", callbackURL, "state", "verifier"); err != ErrUnknownProvider {
+		t.Errorf("ProcessCallback: got %v, want ErrUnknownProvider", err)
+	}
+}
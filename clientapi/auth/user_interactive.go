@@ -71,6 +71,8 @@ type Login struct {
 	// Thus a pointer is needed to differentiate between the two
 	InitialDisplayName *string `json:"initial_device_display_name"`
 	DeviceID           *string `json:"device_id"`
+	// Whether the client supports refresh tokens, see MSC2918
+	RefreshToken bool `json:"refresh_token"`
 }
 
 // Username returns the user localpart/user_id in this request, if it exists.
@@ -103,22 +105,21 @@ type userInteractiveFlow struct {
 // the user already has a valid access token, but we want to double-check
 // that it isn't stolen by re-authenticating them.
 type UserInteractive struct {
-	Completed []string
-	Flows     []userInteractiveFlow
+	Flows []userInteractiveFlow
 	// Map of login type to implementation
 	Types map[string]Type
-	// Map of session ID to completed login types, will need to be extended in future
-	Sessions map[string][]string
+	// The sessions which are in progress and their completed login types
+	Sessions *Sessions
 }
 
-func NewUserInteractive(getAccByPass GetAccountByPassword, cfg *config.ClientAPI) *UserInteractive {
+func NewUserInteractive(getAccByPass GetAccountByPassword, userAPI LoginThrottleAPI, cfg *config.ClientAPI, sessions *Sessions) *UserInteractive {
 	typePassword := &LoginTypePassword{
 		GetAccountByPassword: getAccByPass,
 		Config:               cfg,
+		UserAPI:              userAPI,
 	}
 	// TODO: Add SSO login
 	return &UserInteractive{
-		Completed: []string{},
 		Flows: []userInteractiveFlow{
 			{
 				Stages: []string{typePassword.Name()},
@@ -127,7 +128,7 @@ func NewUserInteractive(getAccByPass GetAccountByPassword, cfg *config.ClientAPI
 		Types: map[string]Type{
 			typePassword.Name(): typePassword,
 		},
-		Sessions: make(map[string][]string),
+		Sessions: sessions,
 	}
 }
 
@@ -140,14 +141,22 @@ func (u *UserInteractive) IsSingleStageFlow(authType string) bool {
 	return false
 }
 
-func (u *UserInteractive) AddCompletedStage(sessionID, authType string) {
-	// TODO: Handle multi-stage flows
-	u.Completed = append(u.Completed, authType)
-	delete(u.Sessions, sessionID)
+func (u *UserInteractive) AddCompletedStage(ctx context.Context, sessionID, authType string) {
+	// TODO: Handle multi-stage flows. For now every flow has a single stage,
+	// so the session is finished once a stage has been completed.
+	if err := u.Sessions.Delete(sessionID); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("Failed to delete user-interactive auth session")
+	}
 }
 
 // Challenge returns an HTTP 401 with the supported flows for authenticating
 func (u *UserInteractive) Challenge(sessionID string) *util.JSONResponse {
+	completed, err := u.Sessions.CompletedStages(sessionID)
+	if err != nil {
+		logrus.WithError(err).Error("failed to get completed stages for session")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
 	return &util.JSONResponse{
 		Code: 401,
 		JSON: struct {
@@ -157,7 +166,7 @@ func (u *UserInteractive) Challenge(sessionID string) *util.JSONResponse {
 			// TODO: Return any additional `params`
 			Params map[string]interface{} `json:"params"`
 		}{
-			u.Completed,
+			completed,
 			u.Flows,
 			sessionID,
 			make(map[string]interface{}),
@@ -173,7 +182,11 @@ func (u *UserInteractive) NewSession() *util.JSONResponse {
 		res := jsonerror.InternalServerError()
 		return &res
 	}
-	u.Sessions[sessionID] = []string{}
+	if err = u.Sessions.Create(sessionID); err != nil {
+		logrus.WithError(err).Error("failed to create session")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
 	return u.Challenge(sessionID)
 }
 
@@ -226,7 +239,13 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 
 	// retrieve the session
 	sessionID := gjson.GetBytes(bodyBytes, "auth.session").Str
-	if _, ok = u.Sessions[sessionID]; !ok {
+	exists, err := u.Sessions.Exists(sessionID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("u.Sessions.Exists failed")
+		res := jsonerror.InternalServerError()
+		return nil, &res
+	}
+	if !exists {
 		// if the login type is part of a single stage flow then allow them to omit the session ID
 		if !u.IsSingleStageFlow(authType) {
 			return nil, &util.JSONResponse{
@@ -237,7 +256,7 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 	}
 
 	r := loginType.Request()
-	if err := json.Unmarshal([]byte(gjson.GetBytes(bodyBytes, "auth").Raw), r); err != nil {
+	if err = json.Unmarshal([]byte(gjson.GetBytes(bodyBytes, "auth").Raw), r); err != nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
@@ -245,9 +264,13 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 	}
 	login, resErr := loginType.Login(ctx, r)
 	if resErr == nil {
-		u.AddCompletedStage(sessionID, authType)
+		u.AddCompletedStage(ctx, sessionID, authType)
 		// TODO: Check if there's more stages to go and return an error
 		return login, nil
 	}
+	if resErr.Code == http.StatusTooManyRequests {
+		// The client has to wait before it can retry the stage at all.
+		return nil, resErr
+	}
 	return nil, u.ResponseWithChallenge(sessionID, resErr.JSON)
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"testing"
 
 	"github.com/matrix-org/dendrite/setup/config"
@@ -38,7 +40,7 @@ func setup() *UserInteractive {
 			ServerName: serverName,
 		},
 	}
-	return NewUserInteractive(getAccountByPassword, cfg)
+	return NewUserInteractive(getAccountByPassword, nil, cfg, NewSessions(nil))
 }
 
 func TestUserInteractiveChallenge(t *testing.T) {
@@ -175,3 +177,88 @@ func TestUserInteractivePasswordBadLogin(t *testing.T) {
 		}
 	}
 }
+
+type fakeLoginThrottleAPI struct {
+	LoginThrottleAPI
+	retryAfterMS int64
+	attempts     []api.PerformLoginAttemptRequest
+	results      []api.PerformLoginResultRequest
+}
+
+func (f *fakeLoginThrottleAPI) PerformLoginAttempt(ctx context.Context, req *api.PerformLoginAttemptRequest, res *api.PerformLoginAttemptResponse) error {
+	f.attempts = append(f.attempts, *req)
+	res.RetryAfterMS = f.retryAfterMS
+	return nil
+}
+
+func (f *fakeLoginThrottleAPI) PerformLoginResult(ctx context.Context, req *api.PerformLoginResultRequest, res *api.PerformLoginResultResponse) error {
+	f.results = append(f.results, *req)
+	return nil
+}
+
+func TestUserInteractivePasswordThrottle(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: serverName,
+		},
+	}
+	throttle := &fakeLoginThrottleAPI{}
+	uia := NewUserInteractive(getAccountByPassword, throttle, cfg, NewSessions(nil))
+	lookup["carol herpassword"] = &api.Account{
+		Localpart:  "carol",
+		ServerName: serverName,
+		UserID:     fmt.Sprintf("@carol:%s", serverName),
+	}
+	ctx := ContextWithClientIP(context.Background(), net.ParseIP("10.0.0.1"))
+
+	tsts := []struct {
+		name         string
+		password     string
+		retryAfterMS int64
+		wantCode     int
+		wantResult   *api.PerformLoginResultRequest
+	}{
+		{
+			name:       "right password",
+			password:   "herpassword",
+			wantResult: &api.PerformLoginResultRequest{Localpart: "carol", RemoteAddr: "10.0.0.1", Success: true},
+		},
+		{
+			name:       "wrong password",
+			password:   "notherpassword",
+			wantCode:   http.StatusUnauthorized,
+			wantResult: &api.PerformLoginResultRequest{Localpart: "carol", RemoteAddr: "10.0.0.1", Success: false},
+		},
+		{
+			name:         "throttled",
+			password:     "herpassword",
+			retryAfterMS: 5000,
+			wantCode:     http.StatusTooManyRequests,
+		},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.name, func(t *testing.T) {
+			throttle.retryAfterMS = tst.retryAfterMS
+			throttle.attempts, throttle.results = nil, nil
+			body := []byte(`{"auth": {"type": "m.login.password", "user": "carol", "password": "` + tst.password + `"}}`)
+			_, errRes := uia.Verify(ctx, body, device)
+			gotCode := 0
+			if errRes != nil {
+				gotCode = errRes.Code
+			}
+			if gotCode != tst.wantCode {
+				t.Errorf("got code %d, want %d", gotCode, tst.wantCode)
+			}
+			wantAttempt := api.PerformLoginAttemptRequest{Localpart: "carol", RemoteAddr: "10.0.0.1"}
+			if len(throttle.attempts) != 1 || throttle.attempts[0] != wantAttempt {
+				t.Errorf("got attempts %+v, want %+v", throttle.attempts, wantAttempt)
+			}
+			switch {
+			case tst.wantResult == nil && len(throttle.results) != 0:
+				t.Errorf("got results %+v, want none", throttle.results)
+			case tst.wantResult != nil && (len(throttle.results) != 1 || throttle.results[0] != *tst.wantResult):
+				t.Errorf("got results %+v, want %+v", throttle.results, *tst.wantResult)
+			}
+		})
+	}
+}
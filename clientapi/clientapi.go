@@ -18,10 +18,14 @@ import (
 	"github.com/gorilla/mux"
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/api"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/consumers"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/clientapi/routing"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -30,12 +34,16 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // AddPublicRoutes sets up and registers HTTP handlers for the ClientAPI component.
 func AddPublicRoutes(
 	router *mux.Router,
+	wellKnownRouter *mux.Router,
 	synapseAdminRouter *mux.Router,
+	dendriteAdminRouter *mux.Router,
+	staticRouter *mux.Router,
 	cfg *config.ClientAPI,
 	accountsDB accounts.Database,
 	federation *gomatrixserverlib.FederationClient,
@@ -48,6 +56,7 @@ func AddPublicRoutes(
 	keyAPI keyserverAPI.KeyInternalAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 	mscCfg *config.MSCs,
+	rateLimits *httputil.RateLimits,
 ) {
 	js := jetstream.Prepare(&cfg.Matrix.JetStream)
 
@@ -56,9 +65,45 @@ func AddPublicRoutes(
 		Topic:     cfg.Matrix.JetStream.TopicFor(jetstream.OutputClientData),
 	}
 
+	rateLimitsProducer := &producers.RateLimitsProducer{
+		JetStream: js,
+		Topic:     cfg.Matrix.JetStream.TopicFor(jetstream.OutputRateLimitsUpdate),
+	}
+	rateLimitsConsumer := consumers.NewOutputRateLimitsConsumer(cfg, js, rateLimits)
+	if err := rateLimitsConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start rate limits consumer")
+	}
+
+	// User-interactive auth sessions, shared secret registration nonces,
+	// 3PID validation sessions, login tokens and the responses to transactions
+	// are stored in JetStream, so that clients can use any instance.
+	sessionsKV, err := js.KeyValue(cfg.Matrix.JetStream.TopicFor(jetstream.ClientAPISessions))
+	if err != nil {
+		logrus.WithError(err).Panic("failed to get sessions key-value bucket")
+	}
+	noncesKV, err := js.KeyValue(cfg.Matrix.JetStream.TopicFor(jetstream.ClientAPINonces))
+	if err != nil {
+		logrus.WithError(err).Panic("failed to get nonces key-value bucket")
+	}
+	validationKV, err := js.KeyValue(cfg.Matrix.JetStream.TopicFor(jetstream.ClientAPIValidationSessions))
+	if err != nil {
+		logrus.WithError(err).Panic("failed to get validation sessions key-value bucket")
+	}
+	loginTokensKV, err := js.KeyValue(cfg.Matrix.JetStream.TopicFor(jetstream.ClientAPILoginTokens))
+	if err != nil {
+		logrus.WithError(err).Panic("failed to get login tokens key-value bucket")
+	}
+	transactionsKV, err := js.KeyValue(cfg.Matrix.JetStream.TopicFor(jetstream.ClientAPITransactions))
+	if err != nil {
+		logrus.WithError(err).Panic("failed to get transactions key-value bucket")
+	}
+	transactionsCache.UseKeyValue(transactionsKV)
+
 	routing.Setup(
-		router, synapseAdminRouter, cfg, eduInputAPI, rsAPI, asAPI,
+		router, wellKnownRouter, synapseAdminRouter, dendriteAdminRouter, staticRouter, cfg, eduInputAPI, rsAPI, asAPI,
 		accountsDB, userAPI, federation,
 		syncProducer, transactionsCache, fsAPI, keyAPI, extRoomsProvider, mscCfg,
+		rateLimits, rateLimitsProducer, auth.NewSessions(sessionsKV), noncesKV,
+		threepid.NewValidationSessions(validationKV), auth.NewLoginTokens(loginTokensKV),
 	)
 }
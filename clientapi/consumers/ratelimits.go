@@ -0,0 +1,80 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputRateLimitsConsumer applies rate limiting settings which were changed
+// through the admin API on a client API instance. It is also used by the
+// federation API and media API when they run as separate components.
+type OutputRateLimitsConsumer struct {
+	jetstream  nats.JetStreamContext
+	topic      string
+	rateLimits *httputil.RateLimits
+}
+
+// NewOutputRateLimitsConsumer creates a new OutputRateLimitsConsumer.
+// Call Start() to begin consuming.
+func NewOutputRateLimitsConsumer(
+	cfg *config.ClientAPI,
+	js nats.JetStreamContext,
+	rateLimits *httputil.RateLimits,
+) *OutputRateLimitsConsumer {
+	return &OutputRateLimitsConsumer{
+		jetstream:  js,
+		topic:      cfg.Matrix.JetStream.TopicFor(jetstream.OutputRateLimitsUpdate),
+		rateLimits: rateLimits,
+	}
+}
+
+// Start consuming rate limiting updates. Every instance needs to see every
+// update, so each one uses its own ephemeral consumer rather than a durable
+// one, and only updates made after the instance started are applied.
+func (s *OutputRateLimitsConsumer) Start() error {
+	if _, err := s.jetstream.Subscribe(s.topic, s.onMessage, nats.DeliverNew()); err != nil {
+		return fmt.Errorf("s.jetstream.Subscribe: %w", err)
+	}
+	return nil
+}
+
+func (s *OutputRateLimitsConsumer) onMessage(msg *nats.Msg) {
+	defer func() {
+		if err := msg.Ack(); err != nil {
+			log.WithError(err).Warn("Failed to acknowledge rate limiting update")
+		}
+	}()
+	var cfg config.RateLimiting
+	if err := json.Unmarshal(msg.Data, &cfg); err != nil {
+		log.WithError(err).Error("Rate limiting update: message parse failure")
+		return
+	}
+	var configErrs config.ConfigErrors
+	cfg.Verify(&configErrs)
+	if len(configErrs) > 0 {
+		log.WithError(configErrs).Error("Rate limiting update: invalid settings")
+		return
+	}
+	s.rateLimits.Update(&cfg)
+	log.Infof("Rate limits updated: %+v", cfg)
+}
@@ -69,6 +69,12 @@ func NotFound(msg string) *MatrixError {
 	return &MatrixError{"M_NOT_FOUND", msg}
 }
 
+// Unrecognized is an error when the server received a request at
+// an unexpected endpoint.
+func Unrecognized(msg string) *MatrixError {
+	return &MatrixError{"M_UNRECOGNIZED", msg}
+}
+
 // MissingArgument is an error when the client tries to access a resource
 // without providing an argument that is required.
 func MissingArgument(msg string) *MatrixError {
@@ -93,6 +99,31 @@ func UnknownToken(msg string) *MatrixError {
 	return &MatrixError{"M_UNKNOWN_TOKEN", msg}
 }
 
+// UnknownTokenError is an M_UNKNOWN_TOKEN error which says whether the client
+// has only been soft logged out, in which case it can refresh its token.
+type UnknownTokenError struct {
+	MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
+// ExpiredToken is an error when the client tries to access a resource with
+// an access token which has expired, and has to be refreshed.
+func ExpiredToken(msg string) *UnknownTokenError {
+	return &UnknownTokenError{
+		MatrixError: MatrixError{"M_UNKNOWN_TOKEN", msg},
+		SoftLogout:  true,
+	}
+}
+
+// UserLocked is an error when the client tries to access a resource with
+// the access token of an account which has been locked by a server admin.
+func UserLocked(msg string) *UnknownTokenError {
+	return &UnknownTokenError{
+		MatrixError: MatrixError{"M_USER_LOCKED", msg},
+		SoftLogout:  true,
+	}
+}
+
 // WeakPassword is an error which is returned when the client tries to register
 // using a weak password. http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 func WeakPassword(msg string) *MatrixError {
@@ -185,6 +216,56 @@ func LimitExceeded(msg string, retryAfterMS int64) *LimitExceededError {
 	}
 }
 
+// ResourceLimitExceededError is an error when a limit on the resources of the
+// server has been reached.
+type ResourceLimitExceededError struct {
+	MatrixError
+	AdminContact string `json:"admin_contact"`
+	LimitType    string `json:"limit_type,omitempty"`
+}
+
+// MonthlyActiveUserLimitExceeded is an error when the user can't log in or
+// register because too many users have been active in the last month.
+func MonthlyActiveUserLimitExceeded(adminContact string) *ResourceLimitExceededError {
+	return &ResourceLimitExceededError{
+		MatrixError:  MatrixError{"M_RESOURCE_LIMIT_EXCEEDED", "This server has exceeded its monthly active user limit."},
+		AdminContact: adminContact,
+		LimitType:    "monthly_active_user",
+	}
+}
+
+// AccountExpired is an error when the client tries to access a resource with
+// the access token of an account which has expired, until it is renewed.
+func AccountExpired(adminContact string) *ResourceLimitExceededError {
+	return &ResourceLimitExceededError{
+		MatrixError:  MatrixError{"M_RESOURCE_LIMIT_EXCEEDED", "This account has expired and has to be renewed."},
+		AdminContact: adminContact,
+		LimitType:    "account_validity",
+	}
+}
+
+// ConsentNotGivenError is an error when the user has to agree to the privacy
+// policy of the server before they can do something.
+type ConsentNotGivenError struct {
+	MatrixError
+	ConsentURI string `json:"consent_uri"`
+}
+
+// ConsentNotGiven is an error when the user hasn't agreed to the current
+// version of the privacy policy, which they can do at the consent URI.
+func ConsentNotGiven(msg, consentURI string) *ConsentNotGivenError {
+	return &ConsentNotGivenError{
+		MatrixError: MatrixError{"M_CONSENT_NOT_GIVEN", msg},
+		ConsentURI:  consentURI,
+	}
+}
+
+// ProfileTooLarge is an error when setting a custom profile field would make
+// the user's profile bigger than the server allows.
+func ProfileTooLarge(msg string) *MatrixError {
+	return &MatrixError{"M_PROFILE_TOO_LARGE", msg}
+}
+
 // NotTrusted is an error which is returned when the client asks the server to
 // proxy a request (e.g. 3PID association) to a server that isn't trusted
 func NotTrusted(serverName string) *MatrixError {
@@ -0,0 +1,41 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// RateLimitsProducer tells every client API instance about rate limiting
+// settings which have been changed through the admin API.
+type RateLimitsProducer struct {
+	Topic     string
+	JetStream nats.JetStreamContext
+}
+
+// SendRateLimits sends the new rate limiting settings to all instances
+func (p *RateLimitsProducer) SendRateLimits(cfg *config.RateLimiting) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	log.Tracef("Producing to topic '%s'", p.Topic)
+	_, err = p.JetStream.Publish(p.Topic, data)
+	return err
+}
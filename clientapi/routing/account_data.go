@@ -26,6 +26,7 @@ import (
 	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
 )
@@ -101,16 +102,33 @@ func SaveAccountData(
 		}
 	}
 
+	if roomID != "" {
+		if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("Invalid room ID"),
+			}
+		}
+	}
+
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("ioutil.ReadAll failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if !json.Valid(body) {
+	// The account data is sent to clients as the content of an event, so it
+	// has to be an object.
+	var content map[string]json.RawMessage
+	if err = json.Unmarshal(body, &content); err != nil || content == nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON("Bad JSON content"),
+			JSON: jsonerror.BadJSON("Account data content must be a JSON object"),
+		}
+	}
+	if dataType == "m.ignored_user_list" && roomID == "" {
+		if resErr := validateIgnoredUsers(content, userID); resErr != nil {
+			return *resErr
 		}
 	}
 
@@ -138,6 +156,33 @@ func SaveAccountData(
 	}
 }
 
+// validateIgnoredUsers checks that the m.ignored_user_list account data
+// lists valid user IDs, as the sync API filters events by it.
+func validateIgnoredUsers(content map[string]json.RawMessage, userID string) *util.JSONResponse {
+	var ignoredUsers map[string]json.RawMessage
+	if err := json.Unmarshal(content["ignored_users"], &ignoredUsers); err != nil || ignoredUsers == nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("ignored_users must be a JSON object"),
+		}
+	}
+	for ignoredUserID := range ignoredUsers {
+		if _, _, err := gomatrixserverlib.SplitID('@', ignoredUserID); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("Invalid user ID " + ignoredUserID),
+			}
+		}
+		if ignoredUserID == userID {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("Users can't ignore themselves"),
+			}
+		}
+	}
+	return nil
+}
+
 type readMarkerJSON struct {
 	FullyRead string `json:"m.fully_read"`
 	Read      string `json:"m.read"`
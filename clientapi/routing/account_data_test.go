@@ -0,0 +1,56 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestSaveAccountDataInvalid(t *testing.T) {
+	device := &api.Device{UserID: "@alice:localhost"}
+	tsts := []struct {
+		Name   string
+		RoomID string
+		Body   string
+	}{
+		{"notJSON", "", `{"a":`},
+		{"array", "", `["a"]`},
+		{"string", "", `"a"`},
+		{"null", "", `null`},
+		{"invalidRoomID", "#room:localhost", `{"a":"b"}`},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/user/@alice:localhost/account_data/org.example.test", strings.NewReader(tst.Body))
+			res := SaveAccountData(req, nil, device, device.UserID, tst.RoomID, "org.example.test", nil)
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("got HTTP %d, want %d", res.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestSaveIgnoredUserListInvalid(t *testing.T) {
+	device := &api.Device{UserID: "@alice:localhost"}
+	tsts := []struct {
+		Name string
+		Body string
+	}{
+		{"missing", `{}`},
+		{"array", `{"ignored_users":["@bob:localhost"]}`},
+		{"invalidUserID", `{"ignored_users":{"bob":{}}}`},
+		{"self", `{"ignored_users":{"@alice:localhost":{}}}`},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/user/@alice:localhost/account_data/m.ignored_user_list", strings.NewReader(tst.Body))
+			res := SaveAccountData(req, nil, device, device.UserID, "", "m.ignored_user_list", nil)
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("got HTTP %d, want %d", res.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
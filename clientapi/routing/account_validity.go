@@ -0,0 +1,45 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// RenewAccount implements GET /_matrix/client/unstable/account_validity/renew,
+// which the links in account renewal emails point at.
+func RenewAccount(w http.ResponseWriter, req *http.Request, userAPI userapi.UserInternalAPI) *util.JSONResponse {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return writeHTTPMessage(w, req, "This link is invalid.", http.StatusBadRequest)
+	}
+	var res userapi.PerformAccountRenewalResponse
+	if err := userAPI.PerformAccountRenewal(req.Context(), &userapi.PerformAccountRenewalRequest{
+		Token: token,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAccountRenewal failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if res.UserID == "" {
+		return writeHTTPMessage(w, req, "This link is invalid or has already been used.", http.StatusBadRequest)
+	}
+	util.GetLogger(req.Context()).WithField("user_id", res.UserID).Info("Account renewed")
+	return writeHTTPMessage(w, req, "Your account has been renewed. You can now return to your client.", http.StatusOK)
+}
@@ -0,0 +1,958 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	clientutil "github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	roomserverTypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type adminServerVersionResponse struct {
+	ServerVersion string `json:"server_version"`
+}
+
+// AdminServerVersion implements GET /_dendrite/admin/v1/server_version
+func AdminServerVersion() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminServerVersionResponse{
+			ServerVersion: internal.VersionString(),
+		},
+	}
+}
+
+// AdminGetRateLimits implements GET /_dendrite/admin/v1/ratelimits
+func AdminGetRateLimits(rateLimits *httputil.RateLimits) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: rateLimits.Config(),
+	}
+}
+
+// AdminSetRateLimits implements PUT /_dendrite/admin/v1/ratelimits. The new
+// settings replace the current ones on every running client API, federation API
+// and media API instance until they are changed again or Dendrite is restarted,
+// at which point the settings from the config file apply again.
+func AdminSetRateLimits(req *http.Request, rateLimits *httputil.RateLimits, producer *producers.RateLimitsProducer) util.JSONResponse {
+	var r config.RateLimiting
+	if resErr := clientutil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	var configErrs config.ConfigErrors
+	r.Verify(&configErrs)
+	if len(configErrs) > 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(configErrs.Error()),
+		}
+	}
+	// Tell the other instances about the new settings too.
+	if err := producer.SendRateLimits(&r); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.SendRateLimits failed")
+		return jsonerror.InternalServerError()
+	}
+	rateLimits.Update(&r)
+	util.GetLogger(req.Context()).Infof("Rate limits updated: %+v", r)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: rateLimits.Config(),
+	}
+}
+
+type adminCreateUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+}
+
+type adminUserResponse struct {
+	UserID string `json:"user_id"`
+}
+
+// AdminCreateUser implements POST /_dendrite/admin/v1/users
+func AdminCreateUser(req *http.Request, cfg *config.ClientAPI, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	var r adminCreateUserRequest
+	if resErr := clientutil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if resErr := validateUsername(r.Username); resErr != nil {
+		return *resErr
+	}
+	if resErr := validatePassword(r.Password); resErr != nil {
+		return *resErr
+	}
+	accountType := userapi.AccountTypeUser
+	if r.Admin {
+		accountType = userapi.AccountTypeAdmin
+	}
+	var res userapi.PerformAccountCreationResponse
+	err := userAPI.PerformAccountCreation(req.Context(), &userapi.PerformAccountCreationRequest{
+		AccountType: accountType,
+		Localpart:   r.Username,
+		Password:    r.Password,
+		OnConflict:  userapi.ConflictAbort,
+	}, &res)
+	if err != nil {
+		var conflict *userapi.ErrorConflict
+		if errors.As(err, &conflict) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.UserInUse("Desired user ID is already taken."),
+			}
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAccountCreation failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithField("user_id", res.Account.UserID).Info("Admin created account")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminUserResponse{
+			UserID: res.Account.UserID,
+		},
+	}
+}
+
+// AdminDeactivateUser implements POST /_dendrite/admin/v1/users/{userID}/deactivate.
+// All of the user's devices are logged out and they leave all of their rooms.
+func AdminDeactivateUser(req *http.Request, cfg *config.ClientAPI, userAPI userapi.UserInternalAPI, userID string) util.JSONResponse {
+	localpart, resErr := adminLocalpart(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	var res userapi.PerformAccountDeactivationResponse
+	if err := userAPI.PerformAccountDeactivation(req.Context(), &userapi.PerformAccountDeactivationRequest{
+		Localpart: localpart,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithField("user_id", userID).Info("Admin deactivated account")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminUserResponse{
+			UserID: userID,
+		},
+	}
+}
+
+type adminResetPasswordRequest struct {
+	Password      string `json:"password"`
+	LogoutDevices bool   `json:"logout_devices"`
+}
+
+// AdminResetPassword implements POST /_dendrite/admin/v1/users/{userID}/password.
+// The new password has to follow the password policy, like the passwords
+// that users choose themselves.
+func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, userAPI userapi.UserInternalAPI, userID string) util.JSONResponse {
+	localpart, resErr := adminLocalpart(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	var r adminResetPasswordRequest
+	if resErr = clientutil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Password == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Expecting non-empty 'password'"),
+		}
+	}
+	if resErr = validatePasswordPolicy(r.Password, cfg); resErr != nil {
+		return *resErr
+	}
+	var res userapi.PerformPasswordUpdateResponse
+	if err := userAPI.PerformPasswordUpdate(req.Context(), &userapi.PerformPasswordUpdateRequest{
+		Localpart: localpart,
+		Password:  r.Password,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPasswordUpdate failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.PasswordUpdated {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist"),
+		}
+	}
+	if r.LogoutDevices {
+		var devRes userapi.PerformDeviceDeletionResponse
+		if err := userAPI.PerformDeviceDeletion(req.Context(), &userapi.PerformDeviceDeletionRequest{
+			UserID: userID,
+		}, &devRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformDeviceDeletion failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	util.GetLogger(req.Context()).WithField("user_id", userID).Info("Admin reset password")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminUserResponse{
+			UserID: userID,
+		},
+	}
+}
+
+type adminShadowBanResponse struct {
+	UserID       string `json:"user_id"`
+	ShadowBanned bool   `json:"shadow_banned"`
+}
+
+// AdminGetShadowBan implements GET /_dendrite/admin/v1/users/{userID}/shadow_ban
+func AdminGetShadowBan(req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, userID string) util.JSONResponse {
+	localpart, resErr := adminLocalpart(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	if resErr = adminAccountExists(req.Context(), accountDB, localpart); resErr != nil {
+		return *resErr
+	}
+	shadowBanned, err := accountDB.IsShadowBanned(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.IsShadowBanned failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminShadowBanResponse{
+			UserID:       userID,
+			ShadowBanned: shadowBanned,
+		},
+	}
+}
+
+// AdminSetShadowBan implements POST and DELETE /_dendrite/admin/v1/users/{userID}/shadow_ban.
+// The events and invites which shadow-banned users send are dropped, but
+// they are told that they were sent.
+func AdminSetShadowBan(req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, userID string, shadowBanned bool) util.JSONResponse {
+	localpart, resErr := adminLocalpart(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	if resErr = adminAccountExists(req.Context(), accountDB, localpart); resErr != nil {
+		return *resErr
+	}
+	if err := accountDB.SetShadowBanned(req.Context(), localpart, shadowBanned); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetShadowBanned failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithField("user_id", userID).WithField("shadow_banned", shadowBanned).Info("Admin changed shadow-ban")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminShadowBanResponse{
+			UserID:       userID,
+			ShadowBanned: shadowBanned,
+		},
+	}
+}
+
+type adminAccountLockResponse struct {
+	UserID string `json:"user_id"`
+	Locked bool   `json:"locked"`
+}
+
+// AdminGetAccountLock implements GET /_dendrite/admin/v1/users/{userID}/lock
+func AdminGetAccountLock(req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, userID string) util.JSONResponse {
+	localpart, resErr := adminLocalpart(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	if resErr = adminAccountExists(req.Context(), accountDB, localpart); resErr != nil {
+		return *resErr
+	}
+	locked, err := accountDB.IsAccountLocked(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.IsAccountLocked failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminAccountLockResponse{
+			UserID: userID,
+			Locked: locked,
+		},
+	}
+}
+
+// AdminSetAccountLock implements POST and DELETE /_dendrite/admin/v1/users/{userID}/lock.
+// The devices of locked users get M_USER_LOCKED errors until the account is
+// unlocked, but unlike deactivation, the user keeps their devices and rooms.
+func AdminSetAccountLock(req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, userID string, locked bool) util.JSONResponse {
+	localpart, resErr := adminLocalpart(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	if resErr = adminAccountExists(req.Context(), accountDB, localpart); resErr != nil {
+		return *resErr
+	}
+	if err := accountDB.SetAccountLocked(req.Context(), localpart, locked); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetAccountLocked failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithField("user_id", userID).WithField("locked", locked).Info("Admin changed account lock")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminAccountLockResponse{
+			UserID: userID,
+			Locked: locked,
+		},
+	}
+}
+
+type adminRenewAccountRequest struct {
+	// When the account expires after being renewed, as a unix timestamp
+	// (ms resolution), or one validity period from now if not given.
+	ExpirationTS gomatrixserverlib.Timestamp `json:"expiration_ts"`
+}
+
+type adminRenewAccountResponse struct {
+	UserID       string                      `json:"user_id"`
+	ExpirationTS gomatrixserverlib.Timestamp `json:"expiration_ts"`
+}
+
+// AdminRenewAccount implements POST /_dendrite/admin/v1/users/{userID}/renew,
+// which renews the account of the user like the link in a renewal email does.
+func AdminRenewAccount(req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, userAPI userapi.UserInternalAPI, userID string) util.JSONResponse {
+	localpart, resErr := adminLocalpart(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	var r adminRenewAccountRequest
+	if resErr = clientutil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if resErr = adminAccountExists(req.Context(), accountDB, localpart); resErr != nil {
+		return *resErr
+	}
+	var res userapi.PerformAccountRenewalResponse
+	if err := userAPI.PerformAccountRenewal(req.Context(), &userapi.PerformAccountRenewalRequest{
+		Localpart:    localpart,
+		ExpirationTS: r.ExpirationTS,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAccountRenewal failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithField("user_id", userID).WithField("expiration_ts", res.ExpirationTS).Info("Admin renewed account")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminRenewAccountResponse{
+			UserID:       res.UserID,
+			ExpirationTS: res.ExpirationTS,
+		},
+	}
+}
+
+type adminMonthlyActiveUsersResponse struct {
+	Count int64 `json:"monthly_active_users"`
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// AdminGetMonthlyActiveUsers implements GET /_dendrite/admin/v1/monthly_active_users,
+// returning the number of users who have been active in the last 30 days,
+// along with the limit on them if there is one.
+func AdminGetMonthlyActiveUsers(req *http.Request, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	var res userapi.QueryMonthlyActiveUsersResponse
+	if err := userAPI.QueryMonthlyActiveUsers(req.Context(), &userapi.QueryMonthlyActiveUsersRequest{}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryMonthlyActiveUsers failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminMonthlyActiveUsersResponse{
+			Count: res.Count,
+			Limit: res.Limit,
+		},
+	}
+}
+
+// AdminFederationQueues implements GET /_dendrite/admin/v1/federation/queues.
+// The optional "server_name" query parameter, which can be given more than
+// once, limits the response to those destinations.
+func AdminFederationQueues(req *http.Request, federationSender federationAPI.FederationInternalAPI) util.JSONResponse {
+	var request federationAPI.QueryFederationQueuesRequest
+	for _, serverName := range req.URL.Query()["server_name"] {
+		request.ServerNames = append(request.ServerNames, gomatrixserverlib.ServerName(serverName))
+	}
+	var res federationAPI.QueryFederationQueuesResponse
+	if err := federationSender.QueryFederationQueues(req.Context(), &request, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("federationSender.QueryFederationQueues failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+type adminDeviceListResyncResponse struct {
+	UserID string `json:"user_id"`
+	Stale  bool   `json:"stale"`
+}
+
+// AdminResyncDeviceList implements POST /_dendrite/admin/v1/device_lists/{userID}/resync.
+// The device list of the remote user is fetched from their server again, which
+// fixes device lists that have got stuck. The response says whether the list
+// is still stale, in which case it keeps being retried in the background.
+func AdminResyncDeviceList(req *http.Request, cfg *config.ClientAPI, keyAPI keyserverAPI.KeyInternalAPI, userID string) util.JSONResponse {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(fmt.Sprintf("Invalid user ID %q", userID)),
+		}
+	}
+	if domain == cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("The user ID must belong to another server"),
+		}
+	}
+	var res keyserverAPI.PerformDeviceListResyncResponse
+	keyAPI.PerformDeviceListResync(req.Context(), &keyserverAPI.PerformDeviceListResyncRequest{
+		UserID: userID,
+	}, &res)
+	if res.Error != nil {
+		util.GetLogger(req.Context()).WithError(res.Error).Error("keyAPI.PerformDeviceListResync failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithField("user_id", userID).WithField("stale", res.Stale).Info("Admin resynced device list")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminDeviceListResyncResponse{
+			UserID: userID,
+			Stale:  res.Stale,
+		},
+	}
+}
+
+type adminPusher struct {
+	UserID string `json:"user_id"`
+	userapi.Pusher
+}
+
+type adminPushersResponse struct {
+	Pushers []adminPusher `json:"pushers"`
+}
+
+// AdminGetPushers implements GET /_dendrite/admin/v1/pushers. The optional
+// "user_id", "app_id", "pushkey" and "url" query parameters filter the
+// pushers, which otherwise include those of every local user.
+func AdminGetPushers(req *http.Request, cfg *config.ClientAPI, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	filter, resErr := adminPusherFilter(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	var res userapi.QueryAllPushersResponse
+	if err := userAPI.QueryAllPushers(req.Context(), &userapi.QueryAllPushersRequest{
+		PusherFilter: filter,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAllPushers failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminPushersResponseFor(cfg, res.Pushers),
+	}
+}
+
+// AdminDeletePushers implements DELETE /_dendrite/admin/v1/pushers, removing
+// the pushers which match the same query parameters as AdminGetPushers. At
+// least one of them must be given, so that all pushers can't be removed by
+// accident. The removed pushers are returned.
+func AdminDeletePushers(req *http.Request, cfg *config.ClientAPI, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	filter, resErr := adminPusherFilter(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	if filter.IsEmpty() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Expecting at least one of 'user_id', 'app_id', 'pushkey' or 'url'"),
+		}
+	}
+	var res userapi.PerformPushersDeletionResponse
+	if err := userAPI.PerformPushersDeletion(req.Context(), &userapi.PerformPushersDeletionRequest{
+		PusherFilter: filter,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPushersDeletion failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithField("filter", filter).Infof("Admin removed %d pushers", len(res.Pushers))
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminPushersResponseFor(cfg, res.Pushers),
+	}
+}
+
+// adminPusherFilter returns the pusher filter from the query parameters.
+func adminPusherFilter(req *http.Request, cfg *config.ClientAPI) (userapi.PusherFilter, *util.JSONResponse) {
+	query := req.URL.Query()
+	filter := userapi.PusherFilter{
+		AppID:   query.Get("app_id"),
+		PushKey: query.Get("pushkey"),
+		URL:     query.Get("url"),
+	}
+	if userID := query.Get("user_id"); userID != "" {
+		localpart, resErr := adminLocalpart(cfg, userID)
+		if resErr != nil {
+			return filter, resErr
+		}
+		filter.Localpart = localpart
+	}
+	return filter, nil
+}
+
+func adminPushersResponseFor(cfg *config.ClientAPI, pushers []userapi.UserPusher) adminPushersResponse {
+	res := adminPushersResponse{
+		Pushers: make([]adminPusher, 0, len(pushers)),
+	}
+	for _, pusher := range pushers {
+		res.Pushers = append(res.Pushers, adminPusher{
+			UserID: userutil.MakeUserID(pusher.Localpart, cfg.Matrix.ServerName),
+			Pusher: pusher.Pusher,
+		})
+	}
+	return res
+}
+
+// defaultEventReportsLimit is how many event reports are returned at once if
+// the admin doesn't ask for a specific number.
+const defaultEventReportsLimit = 100
+
+type adminEventReportsResponse struct {
+	Reports   []roomserverTypes.EventReport `json:"event_reports"`
+	Total     int64                         `json:"total"`
+	NextToken *int64                        `json:"next_token,omitempty"`
+}
+
+// AdminGetEventReports implements GET /_dendrite/admin/v1/event_reports. The
+// optional "room_id" and "resolved" query parameters filter the reports, and
+// "from" and "limit" paginate through them, newest first.
+func AdminGetEventReports(req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI) util.JSONResponse {
+	query := req.URL.Query()
+	request := roomserverAPI.QueryEventReportsRequest{
+		RoomID: query.Get("room_id"),
+		Limit:  defaultEventReportsLimit,
+	}
+	if from := query.Get("from"); from != "" {
+		var err error
+		if request.From, err = strconv.ParseInt(from, 10, 64); err != nil || request.From < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("from must be a non-negative integer"),
+			}
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if request.Limit, err = strconv.Atoi(limit); err != nil || request.Limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("limit must be a positive integer"),
+			}
+		}
+	}
+	if resolved := query.Get("resolved"); resolved != "" {
+		value, err := strconv.ParseBool(resolved)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("resolved must be true or false"),
+			}
+		}
+		request.Resolved = &value
+	}
+	var res roomserverAPI.QueryEventReportsResponse
+	if err := rsAPI.QueryEventReports(req.Context(), &request, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryEventReports failed")
+		return jsonerror.InternalServerError()
+	}
+	response := adminEventReportsResponse{
+		Reports: res.Reports,
+		Total:   res.Total,
+	}
+	if next := request.From + int64(len(res.Reports)); next < res.Total {
+		response.NextToken = &next
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: response,
+	}
+}
+
+type adminEventReportResponse struct {
+	roomserverTypes.EventReport
+	Event *gomatrixserverlib.HeaderedEvent `json:"event,omitempty"`
+}
+
+// AdminGetEventReport implements GET /_dendrite/admin/v1/event_reports/{reportID},
+// returning the report along with the reported event if we still have it.
+func AdminGetEventReport(req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, reportID string) util.JSONResponse {
+	id, errRes := adminReportID(reportID)
+	if errRes != nil {
+		return *errRes
+	}
+	var res roomserverAPI.QueryEventReportResponse
+	if err := rsAPI.QueryEventReport(req.Context(), &roomserverAPI.QueryEventReportRequest{ReportID: id}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryEventReport failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Report == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event report not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminEventReportResponse{
+			EventReport: *res.Report,
+			Event:       res.Event,
+		},
+	}
+}
+
+// AdminResolveEventReport implements POST /_dendrite/admin/v1/event_reports/{reportID}/resolve.
+// Resolving a report which has already been resolved fails, so that the original
+// resolver and time are kept.
+func AdminResolveEventReport(req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, reportID string) util.JSONResponse {
+	id, errRes := adminReportID(reportID)
+	if errRes != nil {
+		return *errRes
+	}
+	var res roomserverAPI.PerformResolveEventReportResponse
+	err := rsAPI.PerformResolveEventReport(req.Context(), &roomserverAPI.PerformResolveEventReportRequest{
+		ReportID:   id,
+		ResolvedBy: httputil.AdminFromContext(req.Context()),
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformResolveEventReport failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.Resolved {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event report not found or already resolved"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+type adminPurgeRoomRequest struct {
+	// Purge the room even if local users are still joined to it.
+	Force bool `json:"force"`
+}
+
+// AdminPurgeRoom implements POST /_dendrite/admin/v1/rooms/{roomID}/purge. The
+// room and all of its events are deleted from the server, which can't be undone.
+// Rooms which local users are still joined to are only purged when forced to.
+func AdminPurgeRoom(req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string) util.JSONResponse {
+	var r adminPurgeRoomRequest
+	if resErr := clientutil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid room ID"),
+		}
+	}
+	if !r.Force {
+		var membersRes roomserverAPI.QueryMembershipsForRoomResponse
+		if err := rsAPI.QueryMembershipsForRoom(req.Context(), &roomserverAPI.QueryMembershipsForRoomRequest{
+			RoomID:     roomID,
+			JoinedOnly: true,
+			LocalOnly:  true,
+		}, &membersRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipsForRoom failed")
+			return jsonerror.InternalServerError()
+		}
+		if len(membersRes.JoinEvents) > 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown(fmt.Sprintf("%d local users are still joined to the room, force the purge to purge it anyway", len(membersRes.JoinEvents))),
+			}
+		}
+	}
+	var res roomserverAPI.PerformAdminPurgeRoomResponse
+	if err := rsAPI.PerformAdminPurgeRoom(req.Context(), &roomserverAPI.PerformAdminPurgeRoomRequest{
+		RoomID: roomID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformAdminPurgeRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.Purged {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+	util.GetLogger(req.Context()).WithField("room_id", roomID).Infof("Room purged by %s", httputil.AdminFromContext(req.Context()))
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// registrationTokenRegexp matches the characters which registration tokens
+// are allowed to contain by MSC3231.
+var registrationTokenRegexp = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,64}$`)
+
+const (
+	registrationTokenChars         = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	defaultRegistrationTokenLength = 16
+	maxRegistrationTokenLength     = 64
+)
+
+type adminCreateRegistrationTokenRequest struct {
+	// The token to create, or empty to generate a random token
+	Token string `json:"token"`
+	// The length of the token to generate if Token is empty
+	Length      int                          `json:"length"`
+	UsesAllowed *int32                       `json:"uses_allowed"`
+	ExpiryTime  *gomatrixserverlib.Timestamp `json:"expiry_time"`
+}
+
+type adminRegistrationTokensResponse struct {
+	RegistrationTokens []userapi.RegistrationToken `json:"registration_tokens"`
+}
+
+// AdminCreateRegistrationToken implements POST /_dendrite/admin/v1/registration_tokens/new.
+// A random token is generated unless the request names one.
+func AdminCreateRegistrationToken(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+	var r adminCreateRegistrationTokenRequest
+	if resErr := clientutil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.UsesAllowed != nil && *r.UsesAllowed < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("uses_allowed must not be negative"),
+		}
+	}
+	if r.ExpiryTime != nil && r.ExpiryTime.Time().Before(time.Now()) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("expiry_time must not be in the past"),
+		}
+	}
+	token := userapi.RegistrationToken{
+		Token:       r.Token,
+		UsesAllowed: r.UsesAllowed,
+		ExpiryTime:  r.ExpiryTime,
+	}
+	if token.Token == "" {
+		if r.Length == 0 {
+			r.Length = defaultRegistrationTokenLength
+		}
+		if r.Length < 0 || r.Length > maxRegistrationTokenLength {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(fmt.Sprintf("length must be between 1 and %d", maxRegistrationTokenLength)),
+			}
+		}
+		var err error
+		if token.Token, err = generateRegistrationToken(r.Length); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("generateRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+	} else if !registrationTokenRegexp.MatchString(token.Token) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(fmt.Sprintf("token must be at most %d characters from A-Z, a-z, 0-9, '.', '_', '~' and '-'", maxRegistrationTokenLength)),
+		}
+	}
+	created, err := accountDB.InsertRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.InsertRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if !created {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("The registration token already exists"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: token,
+	}
+}
+
+// AdminGetRegistrationTokens implements GET /_dendrite/admin/v1/registration_tokens.
+// With ?valid=true or ?valid=false only the tokens which can or can't still
+// be used are returned.
+func AdminGetRegistrationTokens(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+	tokens, err := accountDB.GetRegistrationTokens(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationTokens failed")
+		return jsonerror.InternalServerError()
+	}
+	if valid := req.URL.Query().Get("valid"); valid != "" {
+		wantValid, err := strconv.ParseBool(valid)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("valid must be true or false"),
+			}
+		}
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		filtered := []userapi.RegistrationToken{}
+		for i := range tokens {
+			if tokens[i].Valid(now) == wantValid {
+				filtered = append(filtered, tokens[i])
+			}
+		}
+		tokens = filtered
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminRegistrationTokensResponse{
+			RegistrationTokens: tokens,
+		},
+	}
+}
+
+// AdminGetRegistrationToken implements GET /_dendrite/admin/v1/registration_tokens/{token}.
+func AdminGetRegistrationToken(req *http.Request, accountDB accounts.Database, token string) util.JSONResponse {
+	t, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if t == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Registration token not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: t,
+	}
+}
+
+// AdminDeleteRegistrationToken implements DELETE /_dendrite/admin/v1/registration_tokens/{token}.
+// Accounts which were registered with the token are unaffected.
+func AdminDeleteRegistrationToken(req *http.Request, accountDB accounts.Database, token string) util.JSONResponse {
+	removed, err := accountDB.RemoveRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if !removed {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Registration token not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// generateRegistrationToken returns a random alphanumeric token.
+func generateRegistrationToken(length int) (string, error) {
+	token := make([]byte, 0, length)
+	b := make([]byte, 1)
+	for len(token) < length {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		// Skip the bytes above the largest multiple of the number of
+		// characters, so that every character is equally likely.
+		if int(b[0]) >= 256-256%len(registrationTokenChars) {
+			continue
+		}
+		token = append(token, registrationTokenChars[int(b[0])%len(registrationTokenChars)])
+	}
+	return string(token), nil
+}
+
+// adminAccountExists returns an error response if the user doesn't have an
+// account on this server.
+func adminAccountExists(ctx context.Context, accountDB accounts.Database, localpart string) *util.JSONResponse {
+	_, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+	if err == sql.ErrNoRows {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist"),
+		}
+	}
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
+
+// adminReportID parses an event report ID from the request path.
+func adminReportID(reportID string) (int64, *util.JSONResponse) {
+	id, err := strconv.ParseInt(reportID, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(fmt.Sprintf("Invalid event report ID %q", reportID)),
+		}
+	}
+	return id, nil
+}
+
+// adminLocalpart returns the localpart of a user ID, or an error response if
+// the user ID isn't valid or doesn't belong to this server.
+func adminLocalpart(cfg *config.ClientAPI, userID string) (string, *util.JSONResponse) {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(fmt.Sprintf("Invalid user ID %q", userID)),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("The user ID does not belong to this server"),
+		}
+	}
+	return localpart, nil
+}
@@ -0,0 +1,391 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminLocalpart(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "example.com",
+		},
+	}
+	localpart, resErr := adminLocalpart(cfg, "@alice:example.com")
+	if resErr != nil {
+		t.Fatalf("unexpected error response: %+v", resErr.JSON)
+	}
+	if localpart != "alice" {
+		t.Fatalf("got localpart %q want %q", localpart, "alice")
+	}
+	for _, userID := range []string{"alice", "@alice:remote.com", "!room:example.com"} {
+		if _, resErr = adminLocalpart(cfg, userID); resErr == nil {
+			t.Errorf("expected an error response for %q", userID)
+		}
+	}
+}
+
+type mockResyncKeyAPI struct {
+	keyserverAPI.KeyInternalAPI
+	userIDs []string
+}
+
+func (k *mockResyncKeyAPI) PerformDeviceListResync(ctx context.Context, req *keyserverAPI.PerformDeviceListResyncRequest, res *keyserverAPI.PerformDeviceListResyncResponse) {
+	k.userIDs = append(k.userIDs, req.UserID)
+	res.Stale = req.UserID == "@bob:down.com"
+}
+
+func TestAdminResyncDeviceList(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "example.com",
+		},
+	}
+	keyAPI := &mockResyncKeyAPI{}
+	tsts := []struct {
+		Name      string
+		UserID    string
+		WantCode  int
+		WantStale bool
+	}{
+		{"remoteUser", "@alice:remote.com", http.StatusOK, false},
+		{"stillStale", "@bob:down.com", http.StatusOK, true},
+		{"localUser", "@alice:example.com", http.StatusBadRequest, false},
+		{"invalidUserID", "alice", http.StatusBadRequest, false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/v1/device_lists/"+tst.UserID+"/resync", nil)
+			res := AdminResyncDeviceList(req, cfg, keyAPI, tst.UserID)
+			if res.Code != tst.WantCode {
+				t.Fatalf("got HTTP %d want %d", res.Code, tst.WantCode)
+			}
+			if res.Code != http.StatusOK {
+				return
+			}
+			if got := res.JSON.(adminDeviceListResyncResponse); got.UserID != tst.UserID || got.Stale != tst.WantStale {
+				t.Errorf("got %+v want stale=%v", got, tst.WantStale)
+			}
+		})
+	}
+	if want := []string{"@alice:remote.com", "@bob:down.com"}; !reflect.DeepEqual(keyAPI.userIDs, want) {
+		t.Errorf("got resyncs for %v want %v", keyAPI.userIDs, want)
+	}
+}
+
+type mockResetPasswordUserAPI struct {
+	userapi.UserInternalAPI
+	passwords       map[string]string
+	loggedOutUserID string
+}
+
+func (u *mockResetPasswordUserAPI) PerformPasswordUpdate(ctx context.Context, req *userapi.PerformPasswordUpdateRequest, res *userapi.PerformPasswordUpdateResponse) error {
+	if _, ok := u.passwords[req.Localpart]; ok {
+		u.passwords[req.Localpart] = req.Password
+		res.PasswordUpdated = true
+	}
+	return nil
+}
+
+func (u *mockResetPasswordUserAPI) PerformDeviceDeletion(ctx context.Context, req *userapi.PerformDeviceDeletionRequest, res *userapi.PerformDeviceDeletionResponse) error {
+	u.loggedOutUserID = req.UserID
+	return nil
+}
+
+func TestAdminResetPassword(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "example.com",
+		},
+		PasswordPolicy: config.PasswordPolicy{
+			MinLength:    10,
+			RequireDigit: true,
+		},
+		Derived: &config.Derived{},
+	}
+	tsts := []struct {
+		Name          string
+		UserID        string
+		Body          string
+		WantCode      int
+		WantPassword  string
+		WantLoggedOut bool
+	}{
+		{"noPassword", "@alice:example.com", `{}`, http.StatusBadRequest, "old", false},
+		{"weakPassword", "@alice:example.com", `{"password": "no digits here"}`, http.StatusBadRequest, "old", false},
+		{"unknownUser", "@bob:example.com", `{"password": "s3cret password"}`, http.StatusNotFound, "old", false},
+		{"remoteUser", "@alice:remote.com", `{"password": "s3cret password"}`, http.StatusBadRequest, "old", false},
+		{"reset", "@alice:example.com", `{"password": "s3cret password"}`, http.StatusOK, "s3cret password", false},
+		{"resetAndLogout", "@alice:example.com", `{"password": "s3cret password", "logout_devices": true}`, http.StatusOK, "s3cret password", true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			userAPI := &mockResetPasswordUserAPI{passwords: map[string]string{"alice": "old"}}
+			req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/v1/users/"+tst.UserID+"/password", strings.NewReader(tst.Body))
+			res := AdminResetPassword(req, cfg, userAPI, tst.UserID)
+			if res.Code != tst.WantCode {
+				t.Fatalf("got HTTP %d (%+v), want %d", res.Code, res.JSON, tst.WantCode)
+			}
+			if got := userAPI.passwords["alice"]; got != tst.WantPassword {
+				t.Errorf("got password %q, want %q", got, tst.WantPassword)
+			}
+			if loggedOut := userAPI.loggedOutUserID == tst.UserID; loggedOut != tst.WantLoggedOut {
+				t.Errorf("got devices logged out %v, want %v", loggedOut, tst.WantLoggedOut)
+			}
+		})
+	}
+}
+
+func TestAdminRegistrationTokens(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, "example.com", &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	cfg := &config.ClientAPI{RegistrationRequiresToken: true}
+
+	create := func(body string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/v1/registration_tokens/new", strings.NewReader(body))
+		return AdminCreateRegistrationToken(req, accountDB)
+	}
+	validity := func(token string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/register/m.login.registration_token/validity?token="+url.QueryEscape(token), nil)
+		res := RegistrationTokenValidity(req, cfg, accountDB)
+		if res.Code != http.StatusOK {
+			t.Fatalf("RegistrationTokenValidity(%q): got code %d (%+v), want 200", token, res.Code, res.JSON)
+		}
+		return res.JSON.(registrationTokenValidityResponse).Valid
+	}
+
+	for _, body := range []string{
+		`{"token": "not valid!"}`,
+		`{"uses_allowed": -1}`,
+		`{"expiry_time": 1}`,
+		`{"length": 65}`,
+	} {
+		if res := create(body); res.Code != http.StatusBadRequest {
+			t.Errorf("create %s: got code %d, want 400", body, res.Code)
+		}
+	}
+
+	res := create(`{}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("create: got code %d (%+v), want 200", res.Code, res.JSON)
+	}
+	generated := res.JSON.(userapi.RegistrationToken)
+	if !registrationTokenRegexp.MatchString(generated.Token) || len(generated.Token) != defaultRegistrationTokenLength {
+		t.Errorf("got generated token %q, want %d valid characters", generated.Token, defaultRegistrationTokenLength)
+	}
+	if res = create(`{"token": "once", "uses_allowed": 1}`); res.Code != http.StatusOK {
+		t.Fatalf("create: got code %d (%+v), want 200", res.Code, res.JSON)
+	}
+	if res = create(`{"token": "once"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("create duplicate: got code %d, want 400", res.Code)
+	}
+
+	if !validity("once") || validity("unknown") {
+		t.Errorf("got validity once=%v unknown=%v, want true and false", validity("once"), validity("unknown"))
+	}
+	used, err := accountDB.UseRegistrationToken(ctx, "once")
+	if err != nil || !used {
+		t.Fatalf("UseRegistrationToken: got %v, %v, want true", used, err)
+	}
+	if used, _ = accountDB.UseRegistrationToken(ctx, "once"); used {
+		t.Errorf("UseRegistrationToken: got true for a used up token, want false")
+	}
+	if validity("once") {
+		t.Errorf("got a used up token valid, want invalid")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/registration_tokens?valid=false", nil)
+	res = AdminGetRegistrationTokens(req, accountDB)
+	if res.Code != http.StatusOK {
+		t.Fatalf("list: got code %d (%+v), want 200", res.Code, res.JSON)
+	}
+	one := int32(1)
+	want := []userapi.RegistrationToken{{Token: "once", UsesAllowed: &one, Completed: 1}}
+	if got := res.JSON.(adminRegistrationTokensResponse).RegistrationTokens; !reflect.DeepEqual(got, want) {
+		t.Errorf("got invalid tokens %+v, want %+v", got, want)
+	}
+
+	if res = AdminDeleteRegistrationToken(req, accountDB, "once"); res.Code != http.StatusOK {
+		t.Errorf("delete: got code %d (%+v), want 200", res.Code, res.JSON)
+	}
+	if res = AdminGetRegistrationToken(req, accountDB, "once"); res.Code != http.StatusNotFound {
+		t.Errorf("get deleted token: got code %d, want 404", res.Code)
+	}
+	if res = AdminDeleteRegistrationToken(req, accountDB, "once"); res.Code != http.StatusNotFound {
+		t.Errorf("delete deleted token: got code %d, want 404", res.Code)
+	}
+}
+
+// shadowBanRoomserverAPI only knows the versions of rooms, so that any
+// attempt to send an event panics.
+type shadowBanRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+}
+
+func (r *shadowBanRoomserverAPI) QueryRoomVersionForRoom(ctx context.Context, req *roomserverAPI.QueryRoomVersionForRoomRequest, res *roomserverAPI.QueryRoomVersionForRoomResponse) error {
+	res.RoomVersion = gomatrixserverlib.RoomVersionV7
+	return nil
+}
+
+func TestAdminShadowBan(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, "example.com", &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(ctx, "alice", "", "", userapi.AccountTypeUser); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "example.com",
+		},
+	}
+	device := &userapi.Device{UserID: "@alice:example.com"}
+
+	shadowBanned := func(userID string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/users/"+userID+"/shadow_ban", nil)
+		res := AdminGetShadowBan(req, cfg, accountDB, userID)
+		if res.Code != http.StatusOK {
+			t.Fatalf("AdminGetShadowBan: got code %d (%+v), want 200", res.Code, res.JSON)
+		}
+		return res.JSON.(adminShadowBanResponse).ShadowBanned
+	}
+	set := func(userID string, shadowBanned bool) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/v1/users/"+userID+"/shadow_ban", nil)
+		return AdminSetShadowBan(req, cfg, accountDB, userID, shadowBanned)
+	}
+
+	if shadowBanned(device.UserID) {
+		t.Fatalf("got a shadow-banned user, want the user not to be shadow-banned")
+	}
+	if res := set("@bob:example.com", true); res.Code != http.StatusNotFound {
+		t.Errorf("shadow-banning an unknown user: got code %d, want 404", res.Code)
+	}
+	if res := set("@bob:remote.com", true); res.Code != http.StatusBadRequest {
+		t.Errorf("shadow-banning a remote user: got code %d, want 400", res.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if res := set(device.UserID, true); res.Code != http.StatusOK {
+			t.Fatalf("AdminSetShadowBan: got code %d (%+v), want 200", res.Code, res.JSON)
+		}
+	}
+	if !shadowBanned(device.UserID) {
+		t.Fatalf("got a user who isn't shadow-banned, want the user to be shadow-banned")
+	}
+
+	// The invite must look like it was sent, without reaching the roomserver.
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/rooms/!room:example.com/invite", strings.NewReader(`{"user_id": "@bob:example.com"}`))
+	if res := SendInvite(req, accountDB, device, "!room:example.com", cfg, &shadowBanRoomserverAPI{}, nil); res.Code != http.StatusOK {
+		t.Errorf("SendInvite: got code %d (%+v), want 200", res.Code, res.JSON)
+	}
+	eventID, err := fakeEventID()
+	if err != nil {
+		t.Fatalf("fakeEventID failed: %s", err)
+	}
+	if len(eventID) != 44 || eventID[0] != '$' {
+		t.Errorf("got fake event ID %q, want one which looks like an event ID", eventID)
+	}
+
+	if res := set(device.UserID, false); res.Code != http.StatusOK {
+		t.Fatalf("AdminSetShadowBan: got code %d (%+v), want 200", res.Code, res.JSON)
+	}
+	if shadowBanned(device.UserID) {
+		t.Errorf("got a shadow-banned user, want the shadow-ban to be lifted")
+	}
+}
+
+type mockWhoisUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *mockWhoisUserAPI) QueryAccountByLocalpart(ctx context.Context, req *userapi.QueryAccountByLocalpartRequest, res *userapi.QueryAccountByLocalpartResponse) error {
+	res.Account = &userapi.Account{Localpart: req.Localpart, AccountType: userapi.AccountTypeUser}
+	if req.Localpart == "admin" {
+		res.Account.AccountType = userapi.AccountTypeAdmin
+	}
+	return nil
+}
+
+func (u *mockWhoisUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
+	res.Devices = []userapi.Device{
+		{ID: "PHONE", UserID: req.UserID, LastSeenIP: "10.0.0.2", LastSeenTS: 2, UserAgent: "Element"},
+		{ID: "OLD", UserID: req.UserID, LastSeenIP: "10.0.0.3", LastSeenTS: 1, UserAgent: "Riot"},
+	}
+	return nil
+}
+
+func (u *mockWhoisUserAPI) QueryDeviceConnections(ctx context.Context, req *userapi.QueryDeviceConnectionsRequest, res *userapi.QueryDeviceConnectionsResponse) error {
+	res.Connections = map[string][]userapi.DeviceConnection{
+		"PHONE": {
+			{IP: "10.0.0.2", UserAgent: "Element", LastSeenTS: 2},
+			{IP: "10.0.0.1", UserAgent: "Element", LastSeenTS: 1},
+		},
+	}
+	return nil
+}
+
+func TestGetAdminWhois(t *testing.T) {
+	userAPI := &mockWhoisUserAPI{}
+	tsts := []struct {
+		Name      string
+		Requester string
+		WantCode  int
+	}{
+		{"self", "@alice:example.com", http.StatusOK},
+		{"admin", "@admin:example.com", http.StatusOK},
+		{"otherUser", "@bob:example.com", http.StatusForbidden},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/admin/whois/@alice:example.com", nil)
+			res := GetAdminWhois(req, userAPI, &userapi.Device{UserID: tst.Requester}, "@alice:example.com")
+			if res.Code != tst.WantCode {
+				t.Fatalf("got HTTP %d (%+v), want %d", res.Code, res.JSON, tst.WantCode)
+			}
+			if res.Code != http.StatusOK {
+				return
+			}
+			want := map[string]deviceInfo{
+				"PHONE": {Sessions: []sessionInfo{{Connections: []connectionInfo{
+					{IP: "10.0.0.2", LastSeen: 2, UserAgent: "Element"},
+					{IP: "10.0.0.1", LastSeen: 1, UserAgent: "Element"},
+				}}}},
+				// Devices without recorded connections fall back to when
+				// they were last seen.
+				"OLD": {Sessions: []sessionInfo{{Connections: []connectionInfo{
+					{IP: "10.0.0.3", LastSeen: 1, UserAgent: "Riot"},
+				}}}},
+			}
+			if got := res.JSON.(adminWhoisResponse).Devices; !reflect.DeepEqual(got, want) {
+				t.Errorf("got devices %+v, want %+v", got, want)
+			}
+		})
+	}
+}
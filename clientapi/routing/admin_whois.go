@@ -15,10 +15,12 @@
 package routing
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
 )
@@ -42,16 +44,23 @@ type connectionInfo struct {
 	UserAgent string `json:"user_agent"`
 }
 
-// GetAdminWhois implements GET /admin/whois/{userId}
+// GetAdminWhois implements GET /admin/whois/{userId}. Users can look up
+// themselves, and admins can look up any user on this server.
 func GetAdminWhois(
 	req *http.Request, userAPI api.UserInternalAPI, device *api.Device,
 	userID string,
 ) util.JSONResponse {
 	if userID != device.UserID {
-		// TODO: Still allow if user is admin
-		return util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("userID does not match the current user"),
+		allowed, err := isAdminDevice(req.Context(), userAPI, device)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("GetAdminWhois failed to query the requesting account")
+			return jsonerror.InternalServerError()
+		}
+		if !allowed {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("userID does not match the current user"),
+			}
 		}
 	}
 
@@ -63,20 +72,38 @@ func GetAdminWhois(
 		util.GetLogger(req.Context()).WithError(err).Error("GetAdminWhois failed to query user devices")
 		return jsonerror.InternalServerError()
 	}
+	var connRes api.QueryDeviceConnectionsResponse
+	err = userAPI.QueryDeviceConnections(req.Context(), &api.QueryDeviceConnectionsRequest{
+		UserID: userID,
+	}, &connRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("GetAdminWhois failed to query device connections")
+		return jsonerror.InternalServerError()
+	}
 
 	devices := make(map[string]deviceInfo)
 	for _, device := range queryRes.Devices {
-		connInfo := connectionInfo{
-			IP:        device.LastSeenIP,
-			LastSeen:  device.LastSeenTS,
-			UserAgent: device.UserAgent,
+		var connections []connectionInfo
+		for _, conn := range connRes.Connections[device.ID] {
+			connections = append(connections, connectionInfo{
+				IP:        conn.IP,
+				LastSeen:  conn.LastSeenTS,
+				UserAgent: conn.UserAgent,
+			})
+		}
+		if len(connections) == 0 {
+			// The device hasn't connected since connections were first
+			// recorded, so only what the device itself knows is given.
+			connections = []connectionInfo{{
+				IP:        device.LastSeenIP,
+				LastSeen:  device.LastSeenTS,
+				UserAgent: device.UserAgent,
+			}}
 		}
-		dev, ok := devices[device.ID]
-		if !ok {
-			dev.Sessions = []sessionInfo{{}}
+		// Each device has a single access token, and so a single session.
+		devices[device.ID] = deviceInfo{
+			Sessions: []sessionInfo{{Connections: connections}},
 		}
-		dev.Sessions[0].Connections = append(dev.Sessions[0].Connections, connInfo)
-		devices[device.ID] = dev
 	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -86,3 +113,21 @@ func GetAdminWhois(
 		},
 	}
 }
+
+// isAdminDevice returns true if the device belongs to an admin account.
+func isAdminDevice(ctx context.Context, userAPI api.UserInternalAPI, device *api.Device) (bool, error) {
+	if device.AppserviceID != "" {
+		return false, nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return false, err
+	}
+	var res api.QueryAccountByLocalpartResponse
+	if err = userAPI.QueryAccountByLocalpart(ctx, &api.QueryAccountByLocalpartRequest{
+		Localpart: localpart,
+	}, &res); err != nil {
+		return false, err
+	}
+	return res.Account != nil && res.Account.AccountType == api.AccountTypeAdmin, nil
+}
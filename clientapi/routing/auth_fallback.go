@@ -21,6 +21,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/util"
 )
 
@@ -31,7 +32,7 @@ const recaptchaTemplate = `
 <title>Authentication</title>
 <meta name='viewport' content='width=device-width, initial-scale=1,
     user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
-<script src="https://www.google.com/recaptcha/api.js"
+<script src="{{.scriptURL}}"
     async defer></script>
 <script src="//code.jquery.com/jquery-1.11.2.min.js"></script>
 <script>
@@ -51,7 +52,7 @@ function captchaDone() {
         Please verify that you're not a robot.
         </p>
 		<input type="hidden" name="session" value="{{.session}}" />
-        <div class="g-recaptcha"
+        <div class="{{.widgetClass}}"
             data-sitekey="{{.siteKey}}"
             data-callback="captchaDone">
         </div>
@@ -98,10 +99,38 @@ func serveTemplate(w http.ResponseWriter, templateHTML string, data map[string]s
 	}
 }
 
+// registrationTokenTemplate is an HTML webpage template for registration
+// token auth
+const registrationTokenTemplate = `
+<html>
+<head>
+<title>Authentication</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+<form id="registrationForm" method="post" action="{{.myUrl}}">
+    <div>
+        <p>
+        Registration on this server is by invitation only.
+        </p>
+        <p>
+        Please enter the registration token that you were given.
+        </p>
+        {{if .error}}<p style="color: #c00">{{.error}}</p>{{end}}
+        <input type="hidden" name="session" value="{{.session}}" />
+        <input type="text" name="token" autocomplete="off" />
+        <input type="submit" value="Continue" />
+    </div>
+</form>
+</body>
+</html>
+`
+
 // AuthFallback implements GET and POST /auth/{authType}/fallback/web?session={sessionID}
 func AuthFallback(
 	w http.ResponseWriter, req *http.Request, authType string,
-	cfg *config.ClientAPI,
+	cfg *config.ClientAPI, accountDB accounts.Database,
 ) *util.JSONResponse {
 	sessionID := req.URL.Query().Get("session")
 
@@ -112,13 +141,11 @@ func AuthFallback(
 		)
 	}
 
-	serveRecaptcha := func() {
-		data := map[string]string{
-			"myUrl":   req.URL.String(),
-			"session": sessionID,
-			"siteKey": cfg.RecaptchaPublicKey,
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return &util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.NotFound("Bad method"),
 		}
-		serveTemplate(w, recaptchaTemplate, data)
 	}
 
 	serveSuccess := func() {
@@ -126,56 +153,89 @@ func AuthFallback(
 		serveTemplate(w, successTemplate, data)
 	}
 
-	if req.Method == http.MethodGet {
-		// Handle Recaptcha
-		if authType == authtypes.LoginTypeRecaptcha {
-			if err := checkRecaptchaEnabled(cfg, w, req); err != nil {
-				return err
-			}
+	switch authType {
+	case authtypes.LoginTypeRecaptcha:
+		if err := checkRecaptchaEnabled(cfg, w, req); err != nil {
+			return err
+		}
 
-			serveRecaptcha()
+		provider := captchaProviderFor(cfg)
+		if req.Method == http.MethodGet {
+			data := map[string]string{
+				"myUrl":       req.URL.String(),
+				"session":     sessionID,
+				"siteKey":     cfg.RecaptchaPublicKey,
+				"scriptURL":   provider.scriptURL,
+				"widgetClass": provider.widgetClass,
+			}
+			serveTemplate(w, recaptchaTemplate, data)
 			return nil
 		}
-		return &util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: jsonerror.NotFound("Unknown auth stage type"),
+
+		clientIP := req.RemoteAddr
+		err := req.ParseForm()
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("req.ParseForm failed")
+			res := jsonerror.InternalServerError()
+			return &res
 		}
-	} else if req.Method == http.MethodPost {
-		// Handle Recaptcha
-		if authType == authtypes.LoginTypeRecaptcha {
-			if err := checkRecaptchaEnabled(cfg, w, req); err != nil {
-				return err
-			}
 
-			clientIP := req.RemoteAddr
-			err := req.ParseForm()
-			if err != nil {
-				util.GetLogger(req.Context()).WithError(err).Error("req.ParseForm failed")
-				res := jsonerror.InternalServerError()
-				return &res
-			}
+		response := req.Form.Get(provider.formField)
+		if err := validateRecaptcha(cfg, response, clientIP); err != nil {
+			util.GetLogger(req.Context()).Error(err)
+			return err
+		}
 
-			response := req.Form.Get("g-recaptcha-response")
-			if err := validateRecaptcha(cfg, response, clientIP); err != nil {
-				util.GetLogger(req.Context()).Error(err)
-				return err
-			}
+		// Success. Add recaptcha as a completed login flow
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
 
-			// Success. Add recaptcha as a completed login flow
-			AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
+		serveSuccess()
+		return nil
 
-			serveSuccess()
+	case authtypes.LoginTypeRegistrationToken:
+		if !cfg.RegistrationRequiresToken {
+			return writeHTTPMessage(w, req,
+				"Registration tokens are not required on this Homeserver",
+				http.StatusBadRequest,
+			)
+		}
+
+		data := map[string]string{
+			"myUrl":   req.URL.String(),
+			"session": sessionID,
+		}
+		if req.Method == http.MethodGet {
+			serveTemplate(w, registrationTokenTemplate, data)
 			return nil
 		}
 
-		return &util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: jsonerror.NotFound("Unknown auth stage type"),
+		if err := req.ParseForm(); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("req.ParseForm failed")
+			res := jsonerror.InternalServerError()
+			return &res
 		}
+
+		if resErr := useRegistrationToken(req, sessionID, req.Form.Get("token"), accountDB); resErr != nil {
+			if resErr.Code != http.StatusUnauthorized {
+				return resErr
+			}
+			// Let them try again with another token.
+			data["error"] = "The registration token is invalid."
+			w.WriteHeader(http.StatusUnauthorized)
+			serveTemplate(w, registrationTokenTemplate, data)
+			return nil
+		}
+
+		// Success. Add the registration token as a completed login flow
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRegistrationToken)
+
+		serveSuccess()
+		return nil
 	}
+
 	return &util.JSONResponse{
-		Code: http.StatusMethodNotAllowed,
-		JSON: jsonerror.NotFound("Bad method"),
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Unknown auth stage type"),
 	}
 }
 
@@ -0,0 +1,77 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthFallbackRegistrationToken(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "example.com",
+		},
+		RegistrationRequiresToken: true,
+	}
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, "example.com", &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	if _, err = accountDB.InsertRegistrationToken(context.Background(), userapi.RegistrationToken{Token: "invite"}); err != nil {
+		t.Fatalf("failed to make registration token: %s", err)
+	}
+	fallbackURL := "/_matrix/client/r0/auth/m.login.registration_token/fallback/web?session=fallback_session"
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fallbackURL, nil)
+	if res := AuthFallback(w, req, authtypes.LoginTypeRegistrationToken, cfg, accountDB); res != nil {
+		t.Fatalf("AuthFallback failed: %+v", res)
+	}
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="token"`) {
+		t.Fatalf("got HTTP %d with %q, want a form for the token", w.Code, w.Body.String())
+	}
+
+	submit := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fallbackURL, strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if res := AuthFallback(w, req, authtypes.LoginTypeRegistrationToken, cfg, accountDB); res != nil {
+			t.Fatalf("AuthFallback failed: %+v", res)
+		}
+		return w
+	}
+	if w = submit("wrong"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "invalid") {
+		t.Errorf("got HTTP %d for the wrong token, want the form again with an error", w.Code)
+	}
+	if stages := sessions.GetCompletedStages("fallback_session"); len(stages) != 0 {
+		t.Errorf("got completed stages %v after the wrong token, want none", stages)
+	}
+	if w = submit("invite"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "authDone") {
+		t.Errorf("got HTTP %d with %q, want the success page", w.Code, w.Body.String())
+	}
+	stages := sessions.GetCompletedStages("fallback_session")
+	if len(stages) != 1 || stages[0] != authtypes.LoginTypeRegistrationToken {
+		t.Errorf("got completed stages %v, want the registration token stage", stages)
+	}
+
+	cfg.RegistrationRequiresToken = false
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, fallbackURL, nil)
+	if res := AuthFallback(w, req, authtypes.LoginTypeRegistrationToken, cfg, accountDB); res != nil || w.Code != http.StatusBadRequest {
+		t.Errorf("got HTTP %d and %+v when tokens aren't required, want HTTP 400", w.Code, res)
+	}
+}
@@ -17,16 +17,22 @@ package routing
 import (
 	"net/http"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 
 	"github.com/matrix-org/util"
 )
 
+type capabilityEnabled struct {
+	Enabled bool `json:"enabled"`
+}
+
 // GetCapabilities returns information about the server's supported feature set
 // and other relevant capabilities to an authenticated user.
 func GetCapabilities(
-	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+	req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
 	roomVersionsQueryReq := roomserverAPI.QueryRoomVersionCapabilitiesRequest{}
 	roomVersionsQueryRes := roomserverAPI.QueryRoomVersionCapabilitiesResponse{}
@@ -39,17 +45,40 @@ func GetCapabilities(
 		return jsonerror.InternalServerError()
 	}
 
-	response := map[string]interface{}{
-		"capabilities": map[string]interface{}{
-			"m.change_password": map[string]bool{
-				"enabled": true,
-			},
-			"m.room_versions": roomVersionsQueryRes,
-		},
+	capabilities := map[string]interface{}{}
+	for name, capability := range cfg.ExtraCapabilities {
+		capabilities[name] = config.JSONCompatible(capability)
+	}
+	// Passwords can only be changed if users log in with them.
+	capabilities["m.change_password"] = capabilityEnabled{
+		Enabled: passwordLoginEnabled(),
+	}
+	capabilities["org.matrix.msc2000.password_policy"] = passwordPolicyCapabilityFor(&cfg.PasswordPolicy)
+	capabilities["m.room_versions"] = roomVersionsQueryRes
+	capabilities["m.set_displayname"] = capabilityEnabled{
+		Enabled: true,
+	}
+	capabilities["m.set_avatar_url"] = capabilityEnabled{
+		Enabled: true,
+	}
+	capabilities["uk.tcpip.msc4133.profile_fields"] = capabilityEnabled{
+		Enabled: true,
 	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: response,
+		JSON: map[string]interface{}{
+			"capabilities": capabilities,
+		},
+	}
+}
+
+// passwordLoginEnabled returns true if users can log in with a password.
+func passwordLoginEnabled() bool {
+	for _, f := range passwordLogin().Flows {
+		if f.Type == string(authtypes.LoginTypePassword) {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,63 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"gopkg.in/yaml.v2"
+)
+
+type capabilitiesRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+}
+
+func (r *capabilitiesRoomserverAPI) QueryRoomVersionCapabilities(
+	ctx context.Context,
+	req *roomserverAPI.QueryRoomVersionCapabilitiesRequest,
+	res *roomserverAPI.QueryRoomVersionCapabilitiesResponse,
+) error {
+	res.DefaultRoomVersion = gomatrixserverlib.RoomVersionV6
+	res.AvailableRoomVersions = map[gomatrixserverlib.RoomVersion]string{
+		gomatrixserverlib.RoomVersionV6: "stable",
+	}
+	return nil
+}
+
+func TestGetCapabilities(t *testing.T) {
+	cfg := &config.ClientAPI{}
+	if err := yaml.Unmarshal([]byte(`
+extra_capabilities:
+  org.example.feature:
+    enabled: true
+    options: [a, b]
+password_policy:
+  min_length: 10
+  require_digit: true
+`), cfg); err != nil {
+		t.Fatalf("failed to parse config: %s", err)
+	}
+	res := GetCapabilities(httptest.NewRequest("GET", "/capabilities", nil), cfg, &capabilitiesRoomserverAPI{})
+	if res.Code != 200 {
+		t.Fatalf("got HTTP %d want 200", res.Code)
+	}
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	want := `{"capabilities":{` +
+		`"m.change_password":{"enabled":true},` +
+		`"m.room_versions":{"default":"6","available":{"6":"stable"}},` +
+		`"m.set_avatar_url":{"enabled":true},` +
+		`"m.set_displayname":{"enabled":true},` +
+		`"org.example.feature":{"enabled":true,"options":["a","b"]},` +
+		`"org.matrix.msc2000.password_policy":{"m.minimum_length":10,"m.require_digit":true,"m.require_symbol":false,"m.require_lowercase":false,"m.require_uppercase":false},` +
+		`"uk.tcpip.msc4133.profile_fields":{"enabled":true}}}`
+	if string(body) != want {
+		t.Fatalf("got %s want %s", body, want)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+// commonPasswords are some of the passwords which come up most in lists of
+// leaked passwords, along with ones which are obvious for a Matrix server.
+// They are refused if the password policy denies common passwords.
+var commonPasswords = map[string]struct{}{
+	"123456": {}, "123456789": {}, "12345678": {}, "password": {}, "qwerty": {},
+	"1234567": {}, "12345": {}, "1234567890": {}, "111111": {}, "123123": {},
+	"abc123": {}, "password1": {}, "iloveyou": {}, "1q2w3e4r": {}, "000000": {},
+	"qwerty123": {}, "zaq12wsx": {}, "dragon": {}, "sunshine": {},
+	"princess": {}, "letmein": {}, "654321": {}, "monkey": {}, "27653": {},
+	"1qaz2wsx": {}, "123321": {}, "qwertyuiop": {}, "superman": {},
+	"asdfghjkl": {}, "123qwe": {}, "football": {}, "baseball": {},
+	"welcome": {}, "welcome1": {}, "admin": {}, "admin123": {},
+	"administrator": {}, "master": {}, "master123": {}, "login": {},
+	"passw0rd": {}, "password123": {}, "password12": {}, "password2": {},
+	"p@ssw0rd": {}, "p@ssword": {}, "pa55word": {}, "passwort": {},
+	"motdepasse": {}, "contraseña": {}, "trustno1": {}, "shadow": {},
+	"michael": {}, "jennifer": {}, "jordan23": {}, "hunter2": {},
+	"starwars": {}, "whatever": {}, "freedom": {}, "charlie": {},
+	"computer": {}, "michelle": {}, "jessica": {}, "pepper": {}, "daniel": {},
+	"access": {}, "11111111": {}, "1234qwer": {}, "mustang": {}, "123abc": {},
+	"696969": {}, "batman": {}, "thomas": {}, "hockey": {}, "ranger": {},
+	"killer": {}, "harley": {}, "12341234": {}, "88888888": {}, "87654321": {},
+	"11223344": {}, "121212": {}, "112233": {}, "666666": {}, "777777": {},
+	"987654321": {}, "99999999": {}, "00000000": {}, "12121212": {},
+	"22222222": {}, "55555555": {}, "66666666": {}, "77777777": {},
+	"1password": {}, "123456a": {}, "a123456": {}, "1234abcd": {},
+	"abcd1234": {}, "qwerty12": {}, "qwe123": {}, "q1w2e3r4": {},
+	"q1w2e3r4t5": {}, "1q2w3e": {}, "1q2w3e4r5t": {}, "qazwsx": {},
+	"qazwsxedc": {}, "1qazxsw2": {}, "asdf1234": {}, "asdfasdf": {},
+	"zxcvbnm": {}, "zxcvbnm123": {}, "asdfgh": {}, "qwertz": {}, "qweasd": {},
+	"qweasdzxc": {}, "aaaaaa": {}, "aaaaaaaa": {}, "abcdef": {}, "abcdefg": {},
+	"abcdefgh": {}, "abcdefghi": {}, "1234554321": {}, "samsung": {},
+	"google": {}, "internet": {}, "secret": {}, "secret123": {}, "changeme": {},
+	"changeit": {}, "default": {}, "guest": {}, "test": {}, "test123": {},
+	"testing": {}, "testtest": {}, "temp": {}, "temp123": {}, "letmein1": {},
+	"iloveyou1": {}, "iloveyou2": {}, "loveme": {}, "lovely": {}, "loveyou": {},
+	"babygirl": {}, "princess1": {}, "sunshine1": {}, "football1": {},
+	"baseball1": {}, "soccer": {}, "basketball": {}, "superman1": {},
+	"batman123": {}, "spiderman": {}, "naruto": {}, "pokemon": {},
+	"minecraft": {}, "matrix": {}, "matrix123": {}, "element": {},
+	"dendrite": {}, "synapse": {}, "homeserver": {}, "chatroom": {},
+	"whatsapp": {}, "facebook": {}, "instagram": {}, "linkedin": {},
+	"twitter": {}, "youtube": {}, "yahoo": {}, "hotmail": {}, "outlook": {},
+	"summer": {}, "summer2021": {}, "summer2022": {}, "winter": {},
+	"winter2021": {}, "winter2022": {}, "spring": {}, "autumn": {},
+	"monday": {}, "friday": {}, "january": {}, "february": {}, "december": {},
+	"welcome123": {}, "welcome2022": {}, "hello123": {}, "hello1234": {},
+	"helloworld": {}, "letmein123": {}, "mypassword": {}, "mypass": {},
+	"newpassword": {}, "password!": {}, "password1!": {}, "qwerty1": {},
+	"qwerty1234": {}, "qwertyu": {}, "1qaz2wsx3edc": {}, "zaq1zaq1": {},
+	"zaq1xsw2": {}, "!qaz2wsx": {}, "1q2w3e4r!": {}, "trustno11": {},
+	"jordan": {}, "michael1": {}, "charlie1": {}, "ashley": {}, "nicole": {},
+	"daniel1": {}, "andrew": {}, "joshua": {}, "matthew": {}, "anthony": {},
+	"william": {}, "robert": {}, "richard": {}, "george": {}, "thunder": {},
+	"jasmine": {}, "tigger": {}, "cookie": {}, "chocolate": {}, "butterfly": {},
+	"purple": {}, "orange": {}, "banana": {}, "apple123": {}, "cheese": {},
+	"chicken": {}, "flower": {}, "hannah": {}, "maggie": {}, "buster": {},
+	"ginger": {}, "bailey": {}, "shadow1": {}, "killer1": {}, "dragon1": {},
+	"monkey1": {}, "master1": {}, "jesus": {}, "jesus123": {}, "blessed": {},
+	"blessing": {}, "angel": {}, "angel123": {}, "family": {}, "forever": {},
+	"loveyou1": {}, "fuckyou": {}, "fuckyou1": {}, "asshole": {}, "bitch": {},
+	"bullshit": {}, "7777777": {}, "1111111": {}, "5555555": {}, "123654": {},
+	"159753": {}, "147258369": {}, "741852963": {}, "159357": {}, "753951": {},
+	"2580": {}, "13579": {}, "1234512345": {}, "0123456789": {},
+	"9876543210": {}, "abc12345": {}, "admin1": {}, "root": {}, "toor": {},
+	"rootroot": {}, "administrator1": {}, "passpass": {}, "pass1234": {},
+	"pass123": {}, "password01": {}, "password11": {}, "p4ssw0rd": {},
+	"letmein!": {}, "qwerty!": {}, "11111": {}, "121314": {}, "131313": {},
+	"a1b2c3": {}, "a1b2c3d4": {}, "aa123456": {}, "abc123456": {},
+	"baseball12": {}, "gabriel": {}, "liverpool": {}, "chelsea": {},
+	"arsenal": {}, "barcelona": {}, "realmadrid": {}, "juventus": {},
+	"manchester": {},
+}
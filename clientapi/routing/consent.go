@@ -0,0 +1,170 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// consentDocument is the data that the policy documents are executed with.
+// The user is only given when the document is linked for a user, in which
+// case it can include a form for them to agree to the policy.
+type consentDocument struct {
+	Version      string
+	UserID       string
+	UserHMAC     string
+	HasConsented bool
+}
+
+// consentHMAC signs the user ID, so that users can only agree to the policy
+// through the links which they are given themselves.
+func consentHMAC(cfg *config.Consent, userID string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.FormSecret))
+	_, _ = mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// consentURI returns the link to the current version of the policy through
+// which the user can agree to it.
+func consentURI(cfg *config.ClientAPI, userID string) string {
+	return config.ConsentPolicyURL(cfg.Matrix.WellKnownClientName, cfg.Consent.Version) + "&" + url.Values{
+		"u": {userID},
+		"h": {consentHMAC(&cfg.Consent, userID)},
+	}.Encode()
+}
+
+// consentLocalpart returns the localpart of the user in the request, or an
+// empty string if it doesn't name one. It returns false if the user isn't a
+// local user or the signature of their user ID is wrong.
+func consentLocalpart(req *http.Request, cfg *config.ClientAPI) (string, bool) {
+	userID, userHMAC := req.Form.Get("u"), req.Form.Get("h")
+	if userID == "" {
+		return "", true
+	}
+	if !hmac.Equal([]byte(userHMAC), []byte(consentHMAC(&cfg.Consent, userID))) {
+		return "", false
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != cfg.Matrix.ServerName {
+		return "", false
+	}
+	return localpart, true
+}
+
+// Consent implements GET and POST /_matrix/client/unstable/consent. GETs are
+// given the policy document for the version, or the current version if none
+// is given. POSTs are sent by the form in the document, and record that the
+// user agreed to the current version.
+func Consent(w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database) *util.JSONResponse {
+	if err := req.ParseForm(); err != nil {
+		return writeHTTPMessage(w, req, "The request could not be parsed.", http.StatusBadRequest)
+	}
+	version := req.Form.Get("v")
+	if version == "" {
+		version = cfg.Consent.Version
+	}
+	localpart, ok := consentLocalpart(req, cfg)
+	if !ok {
+		return writeHTTPMessage(w, req, "This link is invalid.", http.StatusForbidden)
+	}
+
+	if req.Method == http.MethodPost {
+		if localpart == "" {
+			return writeHTTPMessage(w, req, "The user is missing.", http.StatusBadRequest)
+		}
+		if version != cfg.Consent.Version {
+			return writeHTTPMessage(w, req, "This version of the policy is out of date.", http.StatusBadRequest)
+		}
+		if err := accountDB.SetConsentVersion(req.Context(), localpart, version); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetConsentVersion failed")
+			res := jsonerror.InternalServerError()
+			return &res
+		}
+		util.GetLogger(req.Context()).WithField("version", version).Info("User agreed to the privacy policy")
+		return writeHTTPMessage(w, req, "Thank you for agreeing to the "+cfg.Consent.PolicyName+". You can now return to your client.", http.StatusOK)
+	}
+
+	// The version names the template, so it mustn't lead out of the directory.
+	if version != filepath.Base(version) || strings.HasPrefix(version, ".") {
+		return writeHTTPMessage(w, req, "There is no such version of the policy.", http.StatusNotFound)
+	}
+	tmpl, err := template.ParseFiles(filepath.Join(cfg.Consent.TemplatesPath, version+".html"))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("version", version).Warn("Failed to load the policy document")
+		return writeHTTPMessage(w, req, "There is no such version of the policy.", http.StatusNotFound)
+	}
+	doc := consentDocument{Version: version}
+	if localpart != "" {
+		doc.UserID = req.Form.Get("u")
+		doc.UserHMAC = req.Form.Get("h")
+		consented, err := accountDB.GetConsentVersion(req.Context(), localpart)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetConsentVersion failed")
+			res := jsonerror.InternalServerError()
+			return &res
+		}
+		doc.HasConsented = consented == version
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = tmpl.Execute(w, doc); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("tmpl.Execute failed")
+	}
+	return nil
+}
+
+// checkConsent returns an error response if the user can't send messages
+// because they haven't agreed to the current version of the policy, which
+// links them to it. Application services don't have to agree to it.
+func checkConsent(ctx context.Context, cfg *config.ClientAPI, accountDB accounts.Database, device *userapi.Device) *util.JSONResponse {
+	if !cfg.Consent.Enabled || !cfg.Consent.BlockEventsUntilConsent || device.AppserviceID != "" {
+		return nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	version, err := accountDB.GetConsentVersion(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetConsentVersion failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if version == cfg.Consent.Version {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.ConsentNotGiven(
+			"You have to agree to the "+cfg.Consent.PolicyName+" before you can send messages.",
+			consentURI(cfg, device.UserID),
+		),
+	}
+}
@@ -0,0 +1,109 @@
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type mockConsentDatabase struct {
+	accounts.Database
+	versions map[string]string // localpart -> version
+}
+
+func (d *mockConsentDatabase) SetConsentVersion(ctx context.Context, localpart, version string) error {
+	d.versions[localpart] = version
+	return nil
+}
+
+func (d *mockConsentDatabase) GetConsentVersion(ctx context.Context, localpart string) (string, error) {
+	return d.versions[localpart], nil
+}
+
+func TestConsent(t *testing.T) {
+	dir := t.TempDir()
+	doc := `{{.Version}}|{{.UserID}}|{{.HasConsented}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "1.0.html"), []byte(doc), 0600); err != nil {
+		t.Fatalf("failed to write policy document: %s", err)
+	}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName:          "localhost",
+			WellKnownClientName: "https://matrix.localhost",
+		},
+		Consent: config.Consent{
+			Enabled:                 true,
+			Version:                 "1.0",
+			PolicyName:              "Privacy Policy",
+			TemplatesPath:           dir,
+			FormSecret:              "secret",
+			BlockEventsUntilConsent: true,
+		},
+	}
+	db := &mockConsentDatabase{versions: map[string]string{}}
+	device := &api.Device{UserID: "@alice:localhost"}
+
+	// Messages can't be sent until the policy is agreed to, and the error
+	// links to it.
+	resErr := checkConsent(context.Background(), cfg, db, device)
+	if resErr == nil || resErr.Code != http.StatusForbidden {
+		t.Fatalf("got %+v, want M_CONSENT_NOT_GIVEN", resErr)
+	}
+	link, err := url.Parse(consentURI(cfg, device.UserID))
+	if err != nil {
+		t.Fatalf("failed to parse consent URI: %s", err)
+	}
+	if !strings.HasPrefix(link.String(), "https://matrix.localhost"+config.ConsentPath+"?") {
+		t.Fatalf("got consent URI %s, want one under the client API", link)
+	}
+
+	tsts := []struct {
+		Name     string
+		Method   string
+		Query    url.Values
+		WantCode int
+		WantBody string
+	}{
+		{"document", http.MethodGet, url.Values{}, http.StatusOK, "1.0||false"},
+		{"userDocument", http.MethodGet, link.Query(), http.StatusOK, "1.0|@alice:localhost|false"},
+		{"unknownVersion", http.MethodGet, url.Values{"v": {"2.0"}}, http.StatusNotFound, ""},
+		{"otherDirectory", http.MethodGet, url.Values{"v": {"../1.0"}}, http.StatusNotFound, ""},
+		{"wrongHMAC", http.MethodPost, url.Values{"v": {"1.0"}, "u": {"@bob:localhost"}, "h": link.Query()["h"]}, http.StatusForbidden, ""},
+		{"agree", http.MethodPost, link.Query(), http.StatusOK, ""},
+		{"agreedDocument", http.MethodGet, link.Query(), http.StatusOK, "1.0|@alice:localhost|true"},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			var req *http.Request
+			if tst.Method == http.MethodPost {
+				req = httptest.NewRequest(tst.Method, config.ConsentPath, strings.NewReader(tst.Query.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(tst.Method, config.ConsentPath+"?"+tst.Query.Encode(), nil)
+			}
+			w := httptest.NewRecorder()
+			if res := Consent(w, req, cfg, db); res != nil {
+				t.Fatalf("got error response %+v", res)
+			}
+			if w.Code != tst.WantCode {
+				t.Errorf("got HTTP %d, want %d", w.Code, tst.WantCode)
+			}
+			if tst.WantBody != "" && w.Body.String() != tst.WantBody {
+				t.Errorf("got body %q, want %q", w.Body.String(), tst.WantBody)
+			}
+		})
+	}
+
+	if resErr = checkConsent(context.Background(), cfg, db, device); resErr != nil {
+		t.Errorf("got %+v after agreeing to the policy, want nil", resErr)
+	}
+}
@@ -28,6 +28,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -39,6 +40,7 @@ import (
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
 type createRoomRequest struct {
 	Invite                    []string                      `json:"invite"`
+	Invite3PID                []invite3PID                  `json:"invite_3pid"`
 	Name                      string                        `json:"name"`
 	Visibility                string                        `json:"visibility"`
 	Topic                     string                        `json:"topic"`
@@ -49,6 +51,14 @@ type createRoomRequest struct {
 	GuestCanJoin              bool                          `json:"guest_can_join"`
 	RoomVersion               gomatrixserverlib.RoomVersion `json:"room_version"`
 	PowerLevelContentOverride json.RawMessage               `json:"power_level_content_override"`
+	IsDirect                  bool                          `json:"is_direct"`
+}
+
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-createroom
+type invite3PID struct {
+	IDServer string `json:"id_server"`
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
 }
 
 const (
@@ -87,6 +97,14 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 			}
 		}
 	}
+	for _, invite := range r.Invite3PID {
+		if invite.IDServer == "" || invite.Medium == "" || invite.Address == "" {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(threepid.ErrMissingParameter.Error()),
+			}
+		}
+	}
 	switch r.Preset {
 	case presetPrivateChat, presetTrustedPrivateChat, presetPublicChat, "":
 	default:
@@ -166,6 +184,14 @@ func createRoom(
 	if resErr = r.Validate(); resErr != nil {
 		return *resErr
 	}
+	for _, invite := range r.Invite3PID {
+		if err := threepid.IsTrusted(invite.IDServer, cfg); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.NotTrusted(invite.IDServer),
+			}
+		}
+	}
 
 	evTime, err := httputil.ParseTSParam(req)
 	if err != nil {
@@ -175,6 +201,41 @@ func createRoom(
 		}
 	}
 
+	// Shadow-banned users can still create rooms, but nobody is invited.
+	shadowBanned, err := isShadowBanned(req.Context(), accountDB, device)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("isShadowBanned failed")
+		return jsonerror.InternalServerError()
+	}
+	if shadowBanned {
+		r.Invite, r.Invite3PID = nil, nil
+	}
+
+	// Look up the third-party invites before the room is created, so that a
+	// failed lookup doesn't leave a room behind with none of its invites sent.
+	// 3PIDs which are bound to a Matrix ID are invited as that user, and the
+	// identity servers are asked to store invites for the rest once the room
+	// exists.
+	invitees := append([]string{}, r.Invite...)
+	var threePIDInvites []threepid.MembershipRequest
+	for _, invite := range r.Invite3PID {
+		body := threepid.MembershipRequest{
+			IDServer: invite.IDServer,
+			Medium:   invite.Medium,
+			Address:  invite.Address,
+		}
+		mxid, lookupErr := threepid.LookupInvite(req.Context(), &body, cfg)
+		if lookupErr != nil {
+			util.GetLogger(req.Context()).WithError(lookupErr).Error("threepid.LookupInvite failed")
+			return jsonerror.InternalServerError()
+		}
+		if mxid != "" {
+			invitees = append(invitees, mxid)
+		} else {
+			threePIDInvites = append(threePIDInvites, body)
+		}
+	}
+
 	// Clobber keys: creator, room_version
 
 	roomVersion := roomserverVersion.DefaultRoomVersion()
@@ -226,31 +287,45 @@ func createRoom(
 		HistoryVisibility: historyVisibilityShared,
 	}
 
-	if r.PowerLevelContentOverride != nil {
-		// Merge powerLevelContentOverride fields by unmarshalling it atop the defaults
-		err = json.Unmarshal(r.PowerLevelContentOverride, &powerLevelContent)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("json.Unmarshal for power_level_content_override failed")
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.BadJSON("malformed power_level_content_override"),
-			}
+	// If no preset was given then the visibility of the room decides it.
+	preset := r.Preset
+	if preset == "" {
+		if r.Visibility == "public" {
+			preset = presetPublicChat
+		} else {
+			preset = presetPrivateChat
 		}
 	}
 
-	switch r.Preset {
+	switch preset {
 	case presetPrivateChat:
 		joinRuleContent.JoinRule = gomatrixserverlib.Invite
 		historyVisibilityContent.HistoryVisibility = historyVisibilityShared
 	case presetTrustedPrivateChat:
 		joinRuleContent.JoinRule = gomatrixserverlib.Invite
 		historyVisibilityContent.HistoryVisibility = historyVisibilityShared
-		// TODO If trusted_private_chat, all invitees are given the same power level as the room creator.
+		// All invitees are given the same power level as the room creator.
+		for _, invitee := range r.Invite {
+			powerLevelContent.Users[invitee] = powerLevelContent.Users[userID]
+		}
 	case presetPublicChat:
 		joinRuleContent.JoinRule = gomatrixserverlib.Public
 		historyVisibilityContent.HistoryVisibility = historyVisibilityShared
 	}
 
+	if r.PowerLevelContentOverride != nil {
+		// Merge powerLevelContentOverride fields by unmarshalling it atop the
+		// defaults, so that it takes precedence over the preset.
+		err = json.Unmarshal(r.PowerLevelContentOverride, &powerLevelContent)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("json.Unmarshal for power_level_content_override failed")
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("malformed power_level_content_override"),
+			}
+		}
+	}
+
 	createEvent := fledglingEvent{
 		Type:    gomatrixserverlib.MRoomCreate,
 		Content: createContent,
@@ -384,8 +459,8 @@ func createRoom(
 	//  8- other initial state items
 	//  9- m.room.name (opt)
 	//  10- m.room.topic (opt)
-	//  11- invite events (opt) - with is_direct flag if applicable TODO
-	//  12- 3pid invite events (opt) TODO
+	//  11- invite events (opt) - with is_direct flag if applicable
+	//  12- 3pid invite events (opt)
 	// This differs from Synapse slightly. Synapse would vary the ordering of 3-7
 	// depending on if those events were in "initial_state" or not. This made it
 	// harder to reason about, hence sticking to a strict static ordering.
@@ -409,9 +484,6 @@ func createRoom(
 		eventsToMake = append(eventsToMake, *aliasEvent)
 	}
 
-	// TODO: invite events
-	// TODO: 3pid invite events
-
 	var builtEvents []*gomatrixserverlib.HeaderedEvent
 	authEvents := gomatrixserverlib.NewAuthEvents(nil)
 	for i, e := range eventsToMake {
@@ -492,8 +564,19 @@ func createRoom(
 		}
 	}
 
-	// If this is a direct message then we should invite the participants.
-	if len(r.Invite) > 0 {
+	// Ask the identity servers to store the third-party invites which aren't
+	// bound to a Matrix ID. The room exists by now, so failures are skipped
+	// rather than failing the request.
+	for i := range threePIDInvites {
+		if err = threepid.StoreInvite(req.Context(), device, &threePIDInvites[i], cfg, rsAPI, accountDB, roomID, evTime); err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("address", threePIDInvites[i].Address).Error("threepid.StoreInvite failed")
+		}
+	}
+
+	// Invite the participants. If this is a direct message then the invites
+	// are flagged with is_direct, so that the invitees' clients can mark the
+	// room as a DM in m.direct.
+	if len(invitees) > 0 {
 		// Build some stripped state for the invite.
 		var globalStrippedState []gomatrixserverlib.InviteV2StrippedState
 		for _, event := range builtEvents {
@@ -516,11 +599,11 @@ func createRoom(
 		}
 
 		// Process the invites.
-		for _, invitee := range r.Invite {
+		for _, invitee := range invitees {
 			// Build the invite event.
 			inviteEvent, err := buildMembershipEvent(
 				req.Context(), invitee, "", accountDB, device, gomatrixserverlib.Invite,
-				roomID, true, cfg, evTime, rsAPI, asAPI,
+				roomID, r.IsDirect, cfg, evTime, rsAPI, asAPI,
 			)
 			if err != nil {
 				util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvent failed")
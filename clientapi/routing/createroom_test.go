@@ -0,0 +1,339 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// createRoomRoomserverAPI keeps the events sent into the room, so that later
+// events can be built on top of them, and the invites sent for it.
+type createRoomRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	events  []*gomatrixserverlib.HeaderedEvent
+	invites []*gomatrixserverlib.HeaderedEvent
+}
+
+func (r *createRoomRoomserverAPI) InputRoomEvents(ctx context.Context, req *roomserverAPI.InputRoomEventsRequest, res *roomserverAPI.InputRoomEventsResponse) {
+	for _, input := range req.InputRoomEvents {
+		r.events = append(r.events, input.Event)
+	}
+}
+
+func (r *createRoomRoomserverAPI) QueryLatestEventsAndState(ctx context.Context, req *roomserverAPI.QueryLatestEventsAndStateRequest, res *roomserverAPI.QueryLatestEventsAndStateResponse) error {
+	if len(r.events) == 0 {
+		return nil
+	}
+	latest := r.events[len(r.events)-1]
+	res.RoomExists = true
+	res.RoomVersion = r.events[0].RoomVersion
+	res.LatestEvents = []gomatrixserverlib.EventReference{latest.EventReference()}
+	res.Depth = latest.Depth() + 1
+	state := map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range r.events {
+		state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+	for _, ev := range state {
+		res.StateEvents = append(res.StateEvents, ev)
+	}
+	return nil
+}
+
+func (r *createRoomRoomserverAPI) QueryCurrentState(ctx context.Context, req *roomserverAPI.QueryCurrentStateRequest, res *roomserverAPI.QueryCurrentStateResponse) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	return nil
+}
+
+func (r *createRoomRoomserverAPI) PerformInvite(ctx context.Context, req *roomserverAPI.PerformInviteRequest, res *roomserverAPI.PerformInviteResponse) error {
+	r.invites = append(r.invites, req.Event)
+	return nil
+}
+
+func (r *createRoomRoomserverAPI) PerformPublish(ctx context.Context, req *roomserverAPI.PerformPublishRequest, res *roomserverAPI.PerformPublishResponse) {
+}
+
+// event returns the last event of the given type sent into the room, or nil.
+func (r *createRoomRoomserverAPI) event(eventType string) *gomatrixserverlib.HeaderedEvent {
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if r.events[i].Type() == eventType {
+			return r.events[i]
+		}
+	}
+	return nil
+}
+
+type createRoomAccountDatabase struct {
+	accounts.Database
+}
+
+func (d *createRoomAccountDatabase) GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error) {
+	return &authtypes.Profile{Localpart: localpart}, nil
+}
+
+func (d *createRoomAccountDatabase) IsShadowBanned(ctx context.Context, localpart string) (bool, error) {
+	return false, nil
+}
+
+func newCreateRoomConfig(t *testing.T, trustedIDServers ...string) *config.ClientAPI {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey failed: %s", err)
+	}
+	return &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName:       "test",
+			KeyID:            "ed25519:auto",
+			PrivateKey:       privateKey,
+			TrustedIDServers: trustedIDServers,
+		},
+	}
+}
+
+func testCreateRoom(t *testing.T, cfg *config.ClientAPI, body string) (util.JSONResponse, *createRoomRoomserverAPI) {
+	rsAPI := &createRoomRoomserverAPI{}
+	req := httptest.NewRequest(http.MethodPost, "/createRoom", strings.NewReader(body))
+	device := &userapi.Device{UserID: "@alice:test"}
+	res := createRoom(req, device, cfg, "!room:test", &createRoomAccountDatabase{}, rsAPI, nil)
+	return res, rsAPI
+}
+
+func TestCreateRoomPresets(t *testing.T) {
+	cfg := newCreateRoomConfig(t)
+	tsts := []struct {
+		Name           string
+		Body           string
+		WantJoinRule   string
+		WantUserLevels map[string]int64
+		WantIsDirect   bool
+	}{
+		{
+			Name:           "privateVisibility",
+			Body:           `{"visibility":"private","invite":["@bob:test"]}`,
+			WantJoinRule:   gomatrixserverlib.Invite,
+			WantUserLevels: map[string]int64{"@alice:test": 100, "@bob:test": 0},
+		},
+		{
+			Name:           "publicVisibility",
+			Body:           `{"visibility":"public","invite":["@bob:test"]}`,
+			WantJoinRule:   gomatrixserverlib.Public,
+			WantUserLevels: map[string]int64{"@alice:test": 100, "@bob:test": 0},
+		},
+		{
+			Name:           "presetOverVisibility",
+			Body:           `{"visibility":"public","preset":"private_chat"}`,
+			WantJoinRule:   gomatrixserverlib.Invite,
+			WantUserLevels: map[string]int64{"@alice:test": 100},
+		},
+		{
+			Name:           "trustedPrivateChat",
+			Body:           `{"preset":"trusted_private_chat","invite":["@bob:test","@carol:test"]}`,
+			WantJoinRule:   gomatrixserverlib.Invite,
+			WantUserLevels: map[string]int64{"@alice:test": 100, "@bob:test": 100, "@carol:test": 100},
+		},
+		{
+			Name:           "overrideOverPreset",
+			Body:           `{"preset":"trusted_private_chat","invite":["@bob:test"],"power_level_content_override":{"users":{"@bob:test":50}}}`,
+			WantJoinRule:   gomatrixserverlib.Invite,
+			WantUserLevels: map[string]int64{"@alice:test": 100, "@bob:test": 50},
+		},
+		{
+			Name:           "isDirect",
+			Body:           `{"preset":"trusted_private_chat","invite":["@bob:test"],"is_direct":true}`,
+			WantJoinRule:   gomatrixserverlib.Invite,
+			WantUserLevels: map[string]int64{"@alice:test": 100, "@bob:test": 100},
+			WantIsDirect:   true,
+		},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			res, rsAPI := testCreateRoom(t, cfg, tst.Body)
+			if res.Code != http.StatusOK {
+				t.Fatalf("got HTTP %d (%+v), want %d", res.Code, res.JSON, http.StatusOK)
+			}
+
+			var joinRules gomatrixserverlib.JoinRuleContent
+			if err := json.Unmarshal(rsAPI.event(gomatrixserverlib.MRoomJoinRules).Content(), &joinRules); err != nil {
+				t.Fatalf("failed to unmarshal join rules: %s", err)
+			}
+			if joinRules.JoinRule != tst.WantJoinRule {
+				t.Errorf("got join rule %v, want %v", joinRules.JoinRule, tst.WantJoinRule)
+			}
+
+			var powerLevels gomatrixserverlib.PowerLevelContent
+			if err := json.Unmarshal(rsAPI.event(gomatrixserverlib.MRoomPowerLevels).Content(), &powerLevels); err != nil {
+				t.Fatalf("failed to unmarshal power levels: %s", err)
+			}
+			for userID, want := range tst.WantUserLevels {
+				if got := powerLevels.UserLevel(userID); got != want {
+					t.Errorf("got power level %v for %s, want %v", got, userID, want)
+				}
+			}
+
+			var r createRoomRequest
+			if err := json.Unmarshal([]byte(tst.Body), &r); err != nil {
+				t.Fatalf("failed to unmarshal request: %s", err)
+			}
+			if len(rsAPI.invites) != len(r.Invite) {
+				t.Fatalf("got %d invites, want %d", len(rsAPI.invites), len(r.Invite))
+			}
+			for _, ev := range rsAPI.invites {
+				var content gomatrixserverlib.MemberContent
+				if err := json.Unmarshal(ev.Content(), &content); err != nil {
+					t.Fatalf("failed to unmarshal invite: %s", err)
+				}
+				if content.IsDirect != tst.WantIsDirect {
+					t.Errorf("got is_direct %v on the invite for %s, want %v", content.IsDirect, *ev.StateKey(), tst.WantIsDirect)
+				}
+			}
+		})
+	}
+}
+
+// fakeIdentityServer answers lookups of bound@example.com with @carol:test,
+// fails lookups of lookupfails@example.com and refuses to store invites for
+// storefails@example.com. Lookups of any other address find no Matrix ID.
+type fakeIdentityServer struct {
+	*httptest.Server
+	sync.Mutex
+	storedInvites []string
+}
+
+func newFakeIdentityServer(t *testing.T) *fakeIdentityServer {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey failed: %s", err)
+	}
+	s := &fakeIdentityServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/identity/api/v1/lookup", func(w http.ResponseWriter, req *http.Request) {
+		address := req.URL.Query().Get("address")
+		switch address {
+		case "lookupfails@example.com":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "bound@example.com":
+			now := time.Now().UnixNano() / 1000000
+			lookup, _ := json.Marshal(map[string]interface{}{
+				"ts":         now,
+				"not_before": now - 60000,
+				"not_after":  now + 60000,
+				"medium":     "email",
+				"address":    address,
+				"mxid":       "@carol:test",
+			})
+			signed, err := gomatrixserverlib.SignJSON(s.Listener.Addr().String(), "ed25519:0", privateKey, lookup)
+			if err != nil {
+				t.Errorf("gomatrixserverlib.SignJSON failed: %s", err)
+			}
+			_, _ = w.Write(signed)
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	})
+	mux.HandleFunc("/_matrix/identity/api/v1/pubkey/ed25519:0", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"public_key": base64.RawStdEncoding.EncodeToString(publicKey),
+		})
+	})
+	mux.HandleFunc("/_matrix/identity/api/v1/store-invite", func(w http.ResponseWriter, req *http.Request) {
+		address := req.FormValue("address")
+		if address == "storefails@example.com" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.Lock()
+		s.storedInvites = append(s.storedInvites, address)
+		s.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"token":        "token-" + address,
+			"public_key":   base64.RawStdEncoding.EncodeToString(publicKey),
+			"display_name": "a...@example.com",
+		})
+	})
+	s.Server = httptest.NewTLSServer(mux)
+	return s
+}
+
+func TestCreateRoomThirdPartyInvites(t *testing.T) {
+	idServer := newFakeIdentityServer(t)
+	defer idServer.Close()
+	// The identity server is only reachable over HTTPS with its own
+	// certificate, which the default transport doesn't trust.
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = idServer.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	idServerName := idServer.Listener.Addr().String()
+	cfg := newCreateRoomConfig(t, idServerName)
+
+	tsts := []struct {
+		Name        string
+		Invite      []string
+		Addresses   []string
+		WantCode    int
+		WantInvites []string
+		WantStored  []string
+	}{
+		{"boundMXID", nil, []string{"bound@example.com"}, http.StatusOK, []string{"@carol:test"}, nil},
+		{"storedInvite", nil, []string{"unbound@example.com"}, http.StatusOK, nil, []string{"unbound@example.com"}},
+		{"failedStore", []string{"@bob:test"}, []string{"storefails@example.com"}, http.StatusOK, []string{"@bob:test"}, nil},
+		{"failedLookup", []string{"@bob:test"}, []string{"lookupfails@example.com"}, http.StatusInternalServerError, nil, nil},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			idServer.storedInvites = nil
+			invite3PIDs := make([]invite3PID, 0, len(tst.Addresses))
+			for _, address := range tst.Addresses {
+				invite3PIDs = append(invite3PIDs, invite3PID{IDServer: idServerName, Medium: "email", Address: address})
+			}
+			body, _ := json.Marshal(map[string]interface{}{
+				"invite":      tst.Invite,
+				"invite_3pid": invite3PIDs,
+			})
+			res, rsAPI := testCreateRoom(t, cfg, string(body))
+			if res.Code != tst.WantCode {
+				t.Fatalf("got HTTP %d (%+v), want %d", res.Code, res.JSON, tst.WantCode)
+			}
+			if tst.WantCode != http.StatusOK {
+				if len(rsAPI.events) != 0 {
+					t.Errorf("got %d events sent, want the room not to be created", len(rsAPI.events))
+				}
+				return
+			}
+
+			var invitees []string
+			for _, ev := range rsAPI.invites {
+				invitees = append(invitees, *ev.StateKey())
+			}
+			if strings.Join(invitees, ",") != strings.Join(tst.WantInvites, ",") {
+				t.Errorf("got invites %v, want %v", invitees, tst.WantInvites)
+			}
+			if strings.Join(idServer.storedInvites, ",") != strings.Join(tst.WantStored, ",") {
+				t.Errorf("got stored invites %v, want %v", idServer.storedInvites, tst.WantStored)
+			}
+			var thirdPartyInvites []string
+			for _, ev := range rsAPI.events {
+				if ev.Type() == "m.room.third_party_invite" {
+					thirdPartyInvites = append(thirdPartyInvites, strings.TrimPrefix(*ev.StateKey(), "token-"))
+				}
+			}
+			if strings.Join(thirdPartyInvites, ",") != strings.Join(tst.WantStored, ",") {
+				t.Errorf("got m.room.third_party_invite events for %v, want %v", thirdPartyInvites, tst.WantStored)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package routing
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 
@@ -11,6 +12,14 @@ import (
 	"github.com/matrix-org/util"
 )
 
+type deactivateRequest struct {
+	Erase bool `json:"erase"`
+}
+
+type deactivateResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
 // Deactivate handles POST requests to /account/deactivate
 func Deactivate(
 	req *http.Request,
@@ -33,15 +42,33 @@ func Deactivate(
 		return *errRes
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', login.Username())
+	localpart, _, err := gomatrixserverlib.SplitID('@', deviceAPI.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
+	// make sure that the access token being used matches the login creds used
+	// for user interactive auth, so that users can't deactivate each other's
+	// accounts.
+	if login.Username() != localpart && login.Username() != deviceAPI.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot deactivate another user's account"),
+		}
+	}
+
+	var r deactivateRequest
+	if err = json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
 
 	var res api.PerformAccountDeactivationResponse
 	err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
 		Localpart: localpart,
+		Erase:     r.Erase,
 	}, &res)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
@@ -50,6 +77,10 @@ func Deactivate(
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: deactivateResponse{
+			// We don't unbind 3PIDs from identity servers, but they are
+			// removed from the account.
+			IDServerUnbindResult: "no-support",
+		},
 	}
 }
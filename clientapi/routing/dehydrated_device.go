@@ -0,0 +1,158 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type dehydratedDeviceRequest struct {
+	DeviceData        json.RawMessage `json:"device_data"`
+	InitialDeviceName *string         `json:"initial_device_display_name"`
+}
+
+type dehydratedDeviceResponse struct {
+	DeviceID   string          `json:"device_id"`
+	DeviceData json.RawMessage `json:"device_data,omitempty"`
+}
+
+type claimDehydratedDeviceRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+// GetDehydratedDevice implements GET /unstable/org.matrix.msc2697.v2/dehydrated_device
+func GetDehydratedDevice(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device) util.JSONResponse {
+	var res userapi.QueryDehydratedDeviceResponse
+	if err := userAPI.QueryDehydratedDevice(req.Context(), &userapi.QueryDehydratedDeviceRequest{
+		UserID: device.UserID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryDehydratedDevice failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No dehydrated device available"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: dehydratedDeviceResponse{
+			DeviceID:   res.DeviceID,
+			DeviceData: res.DeviceData,
+		},
+	}
+}
+
+// PutDehydratedDevice implements PUT /unstable/org.matrix.msc2697.v2/dehydrated_device
+func PutDehydratedDevice(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device) util.JSONResponse {
+	var r dehydratedDeviceRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	var deviceData map[string]interface{}
+	if err := json.Unmarshal(r.DeviceData, &deviceData); err != nil || deviceData == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("'device_data' must be an object"),
+		}
+	}
+	if _, ok := deviceData["algorithm"].(string); !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("'device_data' must have an 'algorithm'"),
+		}
+	}
+	var res userapi.PerformDeviceDehydrationResponse
+	if err := userAPI.PerformDeviceDehydration(req.Context(), &userapi.PerformDeviceDehydrationRequest{
+		UserID:            device.UserID,
+		DeviceData:        r.DeviceData,
+		DeviceDisplayName: r.InitialDeviceName,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformDeviceDehydration failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: dehydratedDeviceResponse{
+			DeviceID: res.Device.ID,
+		},
+	}
+}
+
+// ClaimDehydratedDevice implements POST /unstable/org.matrix.msc2697.v2/dehydrated_device/claim
+// The dehydrated device replaces the device making the request, and takes
+// over its access token.
+func ClaimDehydratedDevice(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device) util.JSONResponse {
+	var r claimDehydratedDeviceRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.DeviceID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Expecting 'device_id'"),
+		}
+	}
+	var res userapi.PerformDeviceRehydrationResponse
+	if err := userAPI.PerformDeviceRehydration(req.Context(), &userapi.PerformDeviceRehydrationRequest{
+		Device:   device,
+		DeviceID: r.DeviceID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformDeviceRehydration failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.Claimed {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No dehydrated device available"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Success bool `json:"success"`
+		}{true},
+	}
+}
+
+// UploadDehydratedDeviceKeys implements POST /keys/upload/{deviceID} for the
+// dehydrated device of the user. Keys for any other device ID are uploaded
+// for the device making the request, as if no device ID was given.
+func UploadDehydratedDeviceKeys(
+	req *http.Request, userAPI userapi.UserInternalAPI, keyAPI api.KeyInternalAPI, device *userapi.Device, deviceID string,
+) util.JSONResponse {
+	var res userapi.QueryDehydratedDeviceResponse
+	if err := userAPI.QueryDehydratedDevice(req.Context(), &userapi.QueryDehydratedDeviceRequest{
+		UserID: device.UserID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryDehydratedDevice failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.Exists || res.DeviceID != deviceID {
+		return UploadKeys(req, keyAPI, device)
+	}
+	return UploadKeys(req, keyAPI, &userapi.Device{
+		ID:     res.DeviceID,
+		UserID: device.UserID,
+	})
+}
@@ -15,6 +15,8 @@
 package routing
 
 import (
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -172,26 +174,10 @@ func DeleteDeviceById(
 			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
 		}
 	}
-	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
-	if errRes != nil {
+	if errRes := verifyDeviceDeletion(ctx, userInteractiveAuth, bodyBytes, device); errRes != nil {
 		return *errRes
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
-	if err != nil {
-		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
-		return jsonerror.InternalServerError()
-	}
-
-	// make sure that the access token being used matches the login creds used for user interactive auth, else
-	// 1 compromised access token could be used to logout all devices.
-	if login.Username() != localpart && login.Username() != device.UserID {
-		return util.JSONResponse{
-			Code: 403,
-			JSON: jsonerror.Forbidden("Cannot delete another user's device"),
-		}
-	}
-
 	var res api.PerformDeviceDeletionResponse
 	if err := userAPI.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
 		UserID:    device.UserID,
@@ -209,16 +195,36 @@ func DeleteDeviceById(
 
 // DeleteDevices handles POST requests to /delete_devices
 func DeleteDevices(
-	req *http.Request, userAPI api.UserInternalAPI, device *api.Device,
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, userAPI api.UserInternalAPI, device *api.Device,
 ) util.JSONResponse {
 	ctx := req.Context()
+	defer req.Body.Close() // nolint: errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
 	payload := devicesDeleteJSON{}
-
-	if resErr := httputil.UnmarshalJSONRequest(req, &payload); resErr != nil {
-		return *resErr
+	if err = json.Unmarshal(bodyBytes, &payload); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if errRes := verifyDeviceDeletion(ctx, userInteractiveAuth, bodyBytes, device); errRes != nil {
+		return *errRes
 	}
 
-	defer req.Body.Close() // nolint: errcheck
+	// The user API deletes all of the devices when it is given none, which
+	// isn't what was asked for here.
+	if len(payload.Devices) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
 
 	var res api.PerformDeviceDeletionResponse
 	if err := userAPI.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
@@ -235,6 +241,35 @@ func DeleteDevices(
 	}
 }
 
+// verifyDeviceDeletion checks the user-interactive auth in the body of a
+// request to delete devices, returning an error response if it is missing
+// or isn't for the user who owns the device.
+func verifyDeviceDeletion(
+	ctx context.Context, userInteractiveAuth *auth.UserInteractive, bodyBytes []byte, device *api.Device,
+) *util.JSONResponse {
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return errRes
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	// make sure that the access token being used matches the login creds used for user interactive auth, else
+	// 1 compromised access token could be used to logout all devices.
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("Cannot delete another user's device"),
+		}
+	}
+	return nil
+}
+
 // stripIPPort converts strings like "[::1]:12345" to "::1"
 func stripIPPort(addr string) string {
 	ip := net.ParseIP(addr)
@@ -0,0 +1,56 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestDeleteDevices(t *testing.T) {
+	device := &api.Device{UserID: "@alice:example.com", ID: "ALICEDEVICE"}
+	tsts := []struct {
+		Name        string
+		Body        string
+		WantCode    int
+		WantDevices []string
+	}{
+		{"noAuth", `{"devices": ["A", "B"]}`, http.StatusUnauthorized, nil},
+		{"wrongPassword", `{"devices": ["A"], "auth": {"type": "m.login.password", "user": "alice", "password": "wrong"}}`, http.StatusUnauthorized, nil},
+		{"otherUser", `{"devices": ["A"], "auth": {"type": "m.login.password", "user": "bob", "password": "bobpassword"}}`, http.StatusForbidden, nil},
+		{"badJSON", `{"devices": "A", "auth": {"type": "m.login.password", "user": "alice", "password": "password"}}`, http.StatusBadRequest, nil},
+		{"noDevices", `{"devices": [], "auth": {"type": "m.login.password", "user": "alice", "password": "password"}}`, http.StatusOK, nil},
+		{"devices", `{"devices": ["A", "B"], "auth": {"type": "m.login.password", "user": "@alice:example.com", "password": "password"}}`, http.StatusOK, []string{"A", "B"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			userAPI := &mockPasswordUserAPI{passwords: map[string]string{
+				"alice": "password",
+				"bob":   "bobpassword",
+			}}
+			cfg := &config.ClientAPI{Matrix: &config.Global{ServerName: "example.com"}, Derived: &config.Derived{}}
+			uia := auth.NewUserInteractive(userAPI.getAccountByPassword, nil, cfg, auth.NewSessions(nil))
+			req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/delete_devices", strings.NewReader(tst.Body))
+
+			res := DeleteDevices(req, uia, userAPI, device)
+			if res.Code != tst.WantCode {
+				t.Fatalf("got code %d (%+v), want %d", res.Code, res.JSON, tst.WantCode)
+			}
+			var gotDevices []string
+			if userAPI.loggedOut != nil {
+				if userAPI.loggedOut.UserID != device.UserID {
+					t.Errorf("got devices of %s deleted, want %s", userAPI.loggedOut.UserID, device.UserID)
+				}
+				gotDevices = userAPI.loggedOut.DeviceIDs
+			}
+			if !reflect.DeepEqual(gotDevices, tst.WantDevices) {
+				t.Errorf("got devices %v deleted, want %v", gotDevices, tst.WantDevices)
+			}
+		})
+	}
+}
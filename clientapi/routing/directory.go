@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -234,6 +235,10 @@ func GetVisibility(
 	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
 	roomID string,
 ) util.JSONResponse {
+	if resErr := checkRoomExists(req.Context(), rsAPI, roomID); resErr != nil {
+		return *resErr
+	}
+
 	var res roomserverAPI.QueryPublishedRoomsResponse
 	err := rsAPI.QueryPublishedRooms(req.Context(), &roomserverAPI.QueryPublishedRoomsRequest{
 		RoomID: roomID,
@@ -257,42 +262,79 @@ func GetVisibility(
 }
 
 // SetVisibility implements PUT /directory/list/room/{roomID}
-// TODO: Allow admin users to edit the room visibility
 func SetVisibility(
-	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, dev *userapi.Device,
-	roomID string,
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, userAPI userapi.UserInternalAPI,
+	dev *userapi.Device, roomID string,
 ) util.JSONResponse {
-	resErr := checkMemberInRoom(req.Context(), rsAPI, dev.UserID, roomID)
-	if resErr != nil {
-		return *resErr
+	var v roomVisibility
+	if reqErr := httputil.UnmarshalJSONRequest(req, &v); reqErr != nil {
+		return *reqErr
+	}
+	if v.Visibility != gomatrixserverlib.Public && v.Visibility != "private" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("visibility must be either 'public' or 'private'"),
+		}
 	}
 
 	queryEventsReq := roomserverAPI.QueryLatestEventsAndStateRequest{
 		RoomID: roomID,
 		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
+			EventType: gomatrixserverlib.MRoomCreate,
+			StateKey:  "",
+		}, {
 			EventType: gomatrixserverlib.MRoomPowerLevels,
 			StateKey:  "",
 		}},
 	}
 	var queryEventsRes roomserverAPI.QueryLatestEventsAndStateResponse
 	err := rsAPI.QueryLatestEventsAndState(req.Context(), &queryEventsReq, &queryEventsRes)
-	if err != nil || len(queryEventsRes.StateEvents) == 0 {
+	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("could not query events from room")
 		return jsonerror.InternalServerError()
 	}
-
-	// NOTSPEC: Check if the user's power is greater than power required to change m.room.canonical_alias event
-	power, _ := gomatrixserverlib.NewPowerLevelContentFromEvent(queryEventsRes.StateEvents[0].Event)
-	if power.UserLevel(dev.UserID) < power.EventLevel(gomatrixserverlib.MRoomCanonicalAlias, true) {
+	if !queryEventsRes.RoomExists {
 		return util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("userID doesn't have power level to change visibility"),
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
 		}
 	}
 
-	var v roomVisibility
-	if reqErr := httputil.UnmarshalJSONRequest(req, &v); reqErr != nil {
-		return *reqErr
+	// Server admins can change the visibility of any room, whether or not
+	// they are in it.
+	isAdmin, err := isServerAdmin(req.Context(), userAPI, dev)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("isServerAdmin failed")
+		return jsonerror.InternalServerError()
+	}
+	if !isAdmin {
+		if resErr := checkMemberInRoom(req.Context(), rsAPI, dev.UserID, roomID); resErr != nil {
+			return *resErr
+		}
+
+		// NOTSPEC: Check if the user's power is greater than power required to change m.room.canonical_alias event
+		var creator string
+		authEvents := gomatrixserverlib.NewAuthEvents(nil)
+		for _, ev := range queryEventsRes.StateEvents {
+			if ev.Type() == gomatrixserverlib.MRoomCreate {
+				creator = ev.Sender()
+			}
+			if err = authEvents.AddEvent(ev.Event); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("authEvents.AddEvent failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		power, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&authEvents, creator)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("failed to get power levels for room")
+			return jsonerror.InternalServerError()
+		}
+		if power.UserLevel(dev.UserID) < power.EventLevel(gomatrixserverlib.MRoomCanonicalAlias, true) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("userID doesn't have power level to change visibility"),
+			}
+		}
 	}
 
 	var publishRes roomserverAPI.PerformPublishResponse
@@ -305,8 +347,57 @@ func SetVisibility(
 		return publishRes.Error.JSONResponse()
 	}
 
+	// Update the public rooms cache now, rather than waiting for it to be
+	// refreshed, so that the change shows up in the directory straight away.
+	updatePublicRoomInCache(req.Context(), rsAPI, roomID, v.Visibility == gomatrixserverlib.Public)
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
 	}
 }
+
+// checkRoomExists returns a 404 response if the room isn't known to the
+// roomserver.
+func checkRoomExists(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) *util.JSONResponse {
+	var res roomserverAPI.QueryLatestEventsAndStateResponse
+	err := rsAPI.QueryLatestEventsAndState(ctx, &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
+			EventType: gomatrixserverlib.MRoomCreate,
+			StateKey:  "",
+		}},
+	}, &res)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("QueryLatestEventsAndState failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !res.RoomExists {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+	return nil
+}
+
+// isServerAdmin returns whether the device belongs to a server admin account.
+func isServerAdmin(ctx context.Context, userAPI userapi.UserInternalAPI, dev *userapi.Device) (bool, error) {
+	if dev.AppserviceID != "" {
+		return false, nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', dev.UserID)
+	if err != nil {
+		return false, err
+	}
+	var res userapi.QueryAccountByLocalpartResponse
+	if err = userAPI.QueryAccountByLocalpart(ctx, &userapi.QueryAccountByLocalpartRequest{
+		Localpart: localpart,
+	}, &res); err != nil {
+		return false, err
+	}
+	return res.Account != nil && res.Account.AccountType == userapi.AccountTypeAdmin, nil
+}
@@ -284,3 +284,32 @@ func dedupeAndShuffle(in []gomatrixserverlib.PublicRoom) []gomatrixserverlib.Pub
 	}
 	return publicRooms
 }
+
+// updatePublicRoomInCache adds or removes a single room from the public rooms
+// cache after its visibility has changed.
+func updatePublicRoomInCache(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string, published bool,
+) {
+	var pubRooms []gomatrixserverlib.PublicRoom
+	if published {
+		var err error
+		pubRooms, err = roomserverAPI.PopulatePublicRooms(ctx, []string{roomID}, rsAPI)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("PopulatePublicRooms failed")
+			return
+		}
+	}
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	rooms := make([]gomatrixserverlib.PublicRoom, 0, len(publicRoomsCache)+len(pubRooms))
+	for _, room := range publicRoomsCache {
+		if room.RoomID != roomID {
+			rooms = append(rooms, room)
+		}
+	}
+	rooms = append(rooms, pubRooms...)
+	sort.SliceStable(rooms, func(i, j int) bool {
+		return rooms[i].JoinedMembersCount > rooms[j].JoinedMembersCount
+	})
+	publicRoomsCache = rooms
+}
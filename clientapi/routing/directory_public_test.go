@@ -1,6 +1,7 @@
 package routing
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
@@ -56,3 +57,24 @@ func TestSliceInto(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdatePublicRoomInCacheUnpublish(t *testing.T) {
+	cacheMu.Lock()
+	publicRoomsCache = []gomatrixserverlib.PublicRoom{
+		{RoomID: "!a:test", JoinedMembersCount: 3},
+		{RoomID: "!b:test", JoinedMembersCount: 2},
+		{RoomID: "!c:test", JoinedMembersCount: 1},
+	}
+	cacheMu.Unlock()
+
+	updatePublicRoomInCache(context.Background(), nil, "!b:test", false)
+
+	got := getPublicRoomsFromCache()
+	want := []gomatrixserverlib.PublicRoom{
+		{RoomID: "!a:test", JoinedMembersCount: 3},
+		{RoomID: "!c:test", JoinedMembersCount: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cache is wrong after unpublishing, got %+v want %+v", got, want)
+	}
+}
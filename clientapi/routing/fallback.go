@@ -0,0 +1,407 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+// The login and registration fallback pages talk to the client API directly
+// from the browser, so the only server-side templating is of the captcha
+// script to load and of the client origins which the new access token may be
+// posted to. The callbacks they invoke on success match the ones used by Synapse, so that
+// clients which embed the pages in a webview work with either.
+
+// loginFallbackHTML is the page served at /_matrix/static/client/login/
+const loginFallbackHTML = `<!DOCTYPE html>
+<html>
+<head>
+<title>Login</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+<style>
+body { font-family: sans-serif; max-width: 24em; margin: 2em auto; padding: 0 1em; }
+input { display: block; width: 100%; margin: 0.5em 0; box-sizing: border-box; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Log in</h1>
+<p id="message"></p>
+<form id="loginForm" style="display: none">
+    <input type="text" id="user" placeholder="Username" autocomplete="username" />
+    <input type="password" id="password" placeholder="Password" autocomplete="current-password" />
+    <input type="submit" value="Log in" />
+</form>
+<script>
+var targetOrigins = [window.location.origin].concat({{.ClientOrigins}});
+window.matrixLogin = window.matrixLogin || {};
+if (!window.matrixLogin.onLogin) {
+    window.matrixLogin.onLogin = function(response) {
+        if (window.opener && window.opener.postMessage) {
+            // The response holds an access token, so it is only posted to
+            // the origins which are trusted with it.
+            targetOrigins.forEach(function(origin) {
+                window.opener.postMessage(response, origin);
+            });
+        }
+    };
+}
+
+var loginURL = "/_matrix/client/r0/login";
+var query = new URLSearchParams(window.location.search);
+
+function showMessage(text, isError) {
+    var message = document.getElementById("message");
+    message.textContent = text;
+    message.className = isError ? "error" : "";
+}
+
+function request(method, body) {
+    return fetch(loginURL, {
+        method: method,
+        headers: { "Content-Type": "application/json" },
+        body: body ? JSON.stringify(body) : undefined,
+    }).then(function(res) {
+        return res.json().then(function(json) {
+            if (!res.ok) {
+                throw new Error(json.error || "Request failed");
+            }
+            return json;
+        });
+    });
+}
+
+document.getElementById("loginForm").addEventListener("submit", function(ev) {
+    ev.preventDefault();
+    var body = {
+        type: "m.login.password",
+        identifier: { type: "m.id.user", user: document.getElementById("user").value },
+        password: document.getElementById("password").value,
+    };
+    if (query.get("device_id")) {
+        body.device_id = query.get("device_id");
+    }
+    if (query.get("initial_device_display_name")) {
+        body.initial_device_display_name = query.get("initial_device_display_name");
+    }
+    showMessage("Logging in...", false);
+    request("POST", body).then(function(response) {
+        document.getElementById("loginForm").style.display = "none";
+        showMessage("Login successful. You may now close this window.", false);
+        window.matrixLogin.onLogin(response);
+    }).catch(function(err) {
+        showMessage(err.message, true);
+    });
+});
+
+request("GET").then(function(response) {
+    var flows = response.flows || [];
+    for (var i = 0; i < flows.length; i++) {
+        if (flows[i].type === "m.login.password") {
+            document.getElementById("loginForm").style.display = "block";
+            return;
+        }
+    }
+    showMessage("This server doesn't support logging in with a password.", true);
+}).catch(function(err) {
+    showMessage(err.message, true);
+});
+</script>
+</body>
+</html>
+`
+
+// registerFallbackHTML is the page served at /_matrix/static/client/register/
+const registerFallbackHTML = `<!DOCTYPE html>
+<html>
+<head>
+<title>Registration</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+<style>
+body { font-family: sans-serif; max-width: 24em; margin: 2em auto; padding: 0 1em; }
+input[type=text], input[type=password], input[type=submit] { display: block; width: 100%; margin: 0.5em 0; box-sizing: border-box; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Create an account</h1>
+<p id="message"></p>
+<form id="registerForm">
+    <input type="text" id="username" placeholder="Username" autocomplete="username" />
+    <input type="password" id="password" placeholder="Password" autocomplete="new-password" />
+    <input type="password" id="confirm" placeholder="Confirm password" autocomplete="new-password" />
+    <input type="submit" value="Register" />
+</form>
+<div id="recaptchaStage" style="display: none">
+    <p>Please verify that you're not a robot.</p>
+    <div id="recaptcha"></div>
+</div>
+<form id="tokenStage" style="display: none">
+    <p>Registration on this server is by invitation only. Please enter your registration token:</p>
+    <input type="text" id="token" placeholder="Registration token" autocomplete="off" />
+    <input type="submit" value="Continue" />
+</form>
+<form id="termsStage" style="display: none">
+    <p>Please review and accept the policies of this server:</p>
+    <ul id="policies"></ul>
+    <label><input type="checkbox" id="acceptTerms" /> I accept these policies</label>
+    <input type="submit" value="Continue" />
+</form>
+<script>
+var targetOrigins = [window.location.origin].concat({{.ClientOrigins}});
+window.matrixRegistration = window.matrixRegistration || {};
+if (!window.matrixRegistration.onRegistered) {
+    window.matrixRegistration.onRegistered = function(hsURL, userID, accessToken) {
+        if (window.opener && window.opener.postMessage) {
+            // The message holds an access token, so it is only posted to
+            // the origins which are trusted with it.
+            targetOrigins.forEach(function(origin) {
+                window.opener.postMessage({
+                    home_server_url: hsURL,
+                    user_id: userID,
+                    access_token: accessToken,
+                }, origin);
+            });
+        }
+    };
+}
+
+var registerURL = "/_matrix/client/r0/register";
+var captchaScriptURL = {{.CaptchaScriptURL}};
+var supportedStages = ["m.login.dummy", "m.login.recaptcha", "m.login.registration_token", "m.login.terms"];
+var registration = null;
+var session = null;
+var params = {};
+var stages = [];
+
+function showMessage(text, isError) {
+    var message = document.getElementById("message");
+    message.textContent = text;
+    message.className = isError ? "error" : "";
+}
+
+function hideAll() {
+    ["registerForm", "recaptchaStage", "tokenStage", "termsStage"].forEach(function(id) {
+        document.getElementById(id).style.display = "none";
+    });
+}
+
+function register(auth) {
+    var body = Object.assign({}, registration);
+    if (auth) {
+        auth.session = session;
+        body.auth = auth;
+    }
+    return fetch(registerURL, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(body),
+    }).then(function(res) {
+        return res.json().then(function(json) {
+            if (res.status === 401 && json.flows) {
+                return handleFlows(json);
+            }
+            if (!res.ok) {
+                throw new Error(json.error || "Registration failed");
+            }
+            hideAll();
+            showMessage("Registration successful. You may now close this window.", false);
+            window.matrixRegistration.onRegistered(window.location.origin, json.user_id, json.access_token);
+        });
+    }).catch(function(err) {
+        showMessage(err.message, true);
+    });
+}
+
+function handleFlows(response) {
+    session = response.session;
+    params = response.params || {};
+    var completed = response.completed || [];
+    var flows = response.flows || [];
+    stages = null;
+    for (var i = 0; i < flows.length && stages === null; i++) {
+        var flowStages = flows[i].stages || [];
+        var supported = flowStages.every(function(stage) {
+            return supportedStages.indexOf(stage) !== -1;
+        });
+        if (supported) {
+            stages = flowStages.filter(function(stage) {
+                return completed.indexOf(stage) === -1;
+            });
+        }
+    }
+    if (stages === null) {
+        throw new Error("This server requires registration steps which aren't supported here.");
+    }
+    if (response.error && completed.length > 0) {
+        showMessage(response.error, true);
+    } else {
+        showMessage("", false);
+    }
+    nextStage();
+}
+
+function nextStage() {
+    hideAll();
+    var stage = stages.shift();
+    if (stage === undefined) {
+        // All of the stages have been completed already, just retry.
+        register({ type: "m.login.dummy" });
+    } else if (stage === "m.login.dummy") {
+        register({ type: stage });
+    } else if (stage === "m.login.recaptcha") {
+        showRecaptcha();
+    } else if (stage === "m.login.registration_token") {
+        document.getElementById("token").value = "";
+        document.getElementById("tokenStage").style.display = "block";
+    } else if (stage === "m.login.terms") {
+        showTerms();
+    }
+}
+
+function showRecaptcha() {
+    var publicKey = (params["m.login.recaptcha"] || {}).public_key;
+    document.getElementById("recaptchaStage").style.display = "block";
+    var render = function() {
+        document.getElementById("recaptcha").innerHTML = "";
+        window.grecaptcha.render("recaptcha", {
+            sitekey: publicKey,
+            callback: function(response) {
+                register({ type: "m.login.recaptcha", response: response });
+            },
+        });
+    };
+    if (window.grecaptcha) {
+        render();
+        return;
+    }
+    window.onRecaptchaLoaded = render;
+    var script = document.createElement("script");
+    // hCaptcha provides the same window.grecaptcha API as reCAPTCHA.
+    script.src = captchaScriptURL + "?onload=onRecaptchaLoaded&render=explicit";
+    script.async = true;
+    document.head.appendChild(script);
+}
+
+function showTerms() {
+    var policies = (params["m.login.terms"] || {}).policies || {};
+    var list = document.getElementById("policies");
+    list.innerHTML = "";
+    Object.keys(policies).forEach(function(name) {
+        var policy = policies[name];
+        var lang = policy.en || policy[Object.keys(policy).filter(function(k) { return k !== "version"; })[0]] || {};
+        var item = document.createElement("li");
+        var link = document.createElement("a");
+        link.href = lang.url;
+        link.target = "_blank";
+        link.textContent = lang.name || name;
+        item.appendChild(link);
+        list.appendChild(item);
+    });
+    document.getElementById("acceptTerms").checked = false;
+    document.getElementById("termsStage").style.display = "block";
+}
+
+document.getElementById("tokenStage").addEventListener("submit", function(ev) {
+    ev.preventDefault();
+    register({ type: "m.login.registration_token", token: document.getElementById("token").value });
+});
+
+document.getElementById("termsStage").addEventListener("submit", function(ev) {
+    ev.preventDefault();
+    if (!document.getElementById("acceptTerms").checked) {
+        showMessage("You must accept the policies to continue.", true);
+        return;
+    }
+    register({ type: "m.login.terms" });
+});
+
+document.getElementById("registerForm").addEventListener("submit", function(ev) {
+    ev.preventDefault();
+    var password = document.getElementById("password").value;
+    if (password !== document.getElementById("confirm").value) {
+        showMessage("The passwords don't match.", true);
+        return;
+    }
+    var query = new URLSearchParams(window.location.search);
+    registration = {
+        username: document.getElementById("username").value,
+        password: password,
+    };
+    if (query.get("initial_device_display_name")) {
+        registration.initial_device_display_name = query.get("initial_device_display_name");
+    }
+    showMessage("Registering...", false);
+    register(null);
+});
+</script>
+</body>
+</html>
+`
+
+var (
+	loginFallbackTemplate    = template.Must(template.New("login_fallback").Parse(loginFallbackHTML))
+	registerFallbackTemplate = template.Must(template.New("register_fallback").Parse(registerFallbackHTML))
+)
+
+type fallbackTemplateData struct {
+	CaptchaScriptURL string
+	// Never nil, so that it is rendered as an empty array.
+	ClientOrigins []string
+}
+
+func newFallbackTemplateData(cfg *config.ClientAPI) fallbackTemplateData {
+	return fallbackTemplateData{
+		CaptchaScriptURL: captchaProviderFor(cfg).scriptURL,
+		ClientOrigins:    append([]string{}, cfg.FallbackClientOrigins...),
+	}
+}
+
+// LoginFallback implements GET /_matrix/static/client/login/
+func LoginFallback(w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI) *util.JSONResponse {
+	return serveFallbackTemplate(w, req, loginFallbackTemplate, newFallbackTemplateData(cfg))
+}
+
+// RegisterFallback implements GET /_matrix/static/client/register/
+func RegisterFallback(w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI) *util.JSONResponse {
+	return serveFallbackTemplate(w, req, registerFallbackTemplate, newFallbackTemplateData(cfg))
+}
+
+func serveFallbackTemplate(w http.ResponseWriter, req *http.Request, tmpl *template.Template, data fallbackTemplateData) *util.JSONResponse {
+	// Render the whole page before writing anything, so that an error can
+	// still be returned instead.
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, data); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Errorf("%s.Execute failed", tmpl.Name())
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := page.WriteTo(w); err != nil {
+		// The headers have already been sent, so there's no way to tell
+		// the client.
+		util.GetLogger(req.Context()).WithError(err).Error("w.Write failed")
+	}
+	return nil
+}
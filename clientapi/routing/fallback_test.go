@@ -0,0 +1,70 @@
+package routing
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+func TestFallbackPagesPostToTrustedOrigins(t *testing.T) {
+	pages := map[string]func(w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI) *util.JSONResponse{
+		"login":    LoginFallback,
+		"register": RegisterFallback,
+	}
+	tests := []struct {
+		name    string
+		origins []string
+		want    string
+	}{
+		{
+			name: "homeserver only",
+			want: `var targetOrigins = [window.location.origin].concat([]);`,
+		},
+		{
+			name:    "configured clients",
+			origins: []string{"https://app.example.com", "http://localhost:8080"},
+			want:    `var targetOrigins = [window.location.origin].concat(["https://app.example.com","http://localhost:8080"]);`,
+		},
+	}
+	for page, serve := range pages {
+		for _, tt := range tests {
+			t.Run(page+" "+tt.name, func(t *testing.T) {
+				cfg := &config.ClientAPI{FallbackClientOrigins: tt.origins}
+				w := httptest.NewRecorder()
+				if res := serve(w, httptest.NewRequest(http.MethodGet, "/_matrix/static/client/"+page+"/", nil), cfg); res != nil {
+					t.Fatalf("got response %+v, want the page", res)
+				}
+				if w.Code != http.StatusOK {
+					t.Errorf("got status %v, want %v", w.Code, http.StatusOK)
+				}
+				if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+					t.Errorf("got Content-Type %v, want text/html", got)
+				}
+				body := w.Body.String()
+				if !strings.Contains(body, tt.want) {
+					t.Errorf("got page without %v", tt.want)
+				}
+				if strings.Contains(body, `"*"`) {
+					t.Errorf("got page which posts to any origin")
+				}
+			})
+		}
+	}
+}
+
+func TestFallbackTemplateErrorWritesNothing(t *testing.T) {
+	broken := template.Must(template.New("broken").Parse(`{{.Missing}}`))
+	w := httptest.NewRecorder()
+	res := serveFallbackTemplate(w, httptest.NewRequest(http.MethodGet, "/_matrix/static/client/login/", nil), broken, fallbackTemplateData{})
+	if res == nil || res.Code != http.StatusInternalServerError {
+		t.Fatalf("got response %+v, want an internal server error", res)
+	}
+	if w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+		t.Errorf("got page %q with Content-Type %q, want nothing written", w.Body.String(), w.Header().Get("Content-Type"))
+	}
+}
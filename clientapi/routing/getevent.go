@@ -19,6 +19,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -65,6 +66,13 @@ func GetEvent(
 	}
 
 	requestedEvent := eventsResp.Events[0].Event
+	if requestedEvent.RoomID() != roomID {
+		// Don't allow events to be fetched through a different room.
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+		}
+	}
 
 	r := getEventRequest{
 		req:            req,
@@ -82,6 +90,9 @@ func GetEvent(
 		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
 			EventType: gomatrixserverlib.MRoomMember,
 			StateKey:  device.UserID,
+		}, {
+			EventType: gomatrixserverlib.MRoomHistoryVisibility,
+			StateKey:  "",
 		}},
 	}
 	var stateResp api.QueryStateAfterEventsResponse
@@ -113,7 +124,15 @@ func GetEvent(
 		}
 	}
 
+	// Work out the user's membership and the history visibility of the room
+	// at the time the event was sent.
+	var membership string
+	stateEvents := make([]*gomatrixserverlib.Event, 0, len(stateResp.StateEvents))
 	for _, stateEvent := range stateResp.StateEvents {
+		stateEvents = append(stateEvents, stateEvent.Event)
+		if stateEvent.Type() != gomatrixserverlib.MRoomMember {
+			continue
+		}
 		if appService != nil {
 			if !appService.IsInterestedInUserID(*stateEvent.StateKey()) {
 				continue
@@ -121,16 +140,42 @@ func GetEvent(
 		} else if !stateEvent.StateKeyEquals(device.UserID) {
 			continue
 		}
-		membership, err := stateEvent.Membership()
+		var err error
+		membership, err = stateEvent.Membership()
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("stateEvent.Membership failed")
 			return jsonerror.InternalServerError()
 		}
-		if membership == gomatrixserverlib.Join {
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: gomatrixserverlib.ToClientEvent(r.requestedEvent, gomatrixserverlib.FormatAll),
-			}
+	}
+	historyVisibility := auth.HistoryVisibilityForRoom(stateEvents)
+
+	// https://matrix.org/docs/spec/client_server/r0.6.1#id89
+	allowed := false
+	switch {
+	case historyVisibility == gomatrixserverlib.WorldReadable:
+		allowed = true
+	case membership == gomatrixserverlib.Join:
+		allowed = true
+	case historyVisibility == "invited" && membership == gomatrixserverlib.Invite:
+		allowed = true
+	case historyVisibility == "shared":
+		// The user can see events from before they joined, as long as they
+		// are in the room now.
+		var membershipRes api.QueryMembershipForUserResponse
+		if err := rsAPI.QueryMembershipForUser(req.Context(), &api.QueryMembershipForUserRequest{
+			RoomID: roomID,
+			UserID: device.UserID,
+		}, &membershipRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+			return jsonerror.InternalServerError()
+		}
+		allowed = membershipRes.IsInRoom
+	}
+
+	if allowed {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: gomatrixserverlib.ToClientEvent(r.requestedEvent, gomatrixserverlib.FormatAll),
 		}
 	}
 
@@ -22,9 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/keyserver/api"
-	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
-	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/util"
 )
 
@@ -36,7 +34,6 @@ type crossSigningRequest struct {
 func UploadCrossSigningDeviceKeys(
 	req *http.Request, userInteractiveAuth *auth.UserInteractive,
 	keyserverAPI api.KeyInternalAPI, device *userapi.Device,
-	accountDB accounts.Database, cfg *config.ClientAPI,
 ) util.JSONResponse {
 	uploadReq := &crossSigningRequest{}
 	uploadRes := &api.PerformUploadDeviceKeysResponse{}
@@ -63,10 +60,7 @@ func UploadCrossSigningDeviceKeys(
 			),
 		}
 	}
-	typePassword := auth.LoginTypePassword{
-		GetAccountByPassword: accountDB.GetAccountByPassword,
-		Config:               cfg,
-	}
+	typePassword := userInteractiveAuth.Types[authtypes.LoginTypePassword]
 	if _, authErr := typePassword.Login(req.Context(), &uploadReq.Auth.PasswordRequest); authErr != nil {
 		return *authErr
 	}
@@ -76,27 +70,9 @@ func UploadCrossSigningDeviceKeys(
 	keyserverAPI.PerformUploadDeviceKeys(req.Context(), &uploadReq.PerformUploadDeviceKeysRequest, uploadRes)
 
 	if err := uploadRes.Error; err != nil {
-		switch {
-		case err.IsInvalidSignature:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.InvalidSignature(err.Error()),
-			}
-		case err.IsMissingParam:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.MissingParam(err.Error()),
-			}
-		case err.IsInvalidParam:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.InvalidParam(err.Error()),
-			}
-		default:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.Unknown(err.Error()),
-			}
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: keyErrorJSON(err),
 		}
 	}
 
@@ -118,32 +94,37 @@ func UploadCrossSigningDeviceSignatures(req *http.Request, keyserverAPI api.KeyI
 	keyserverAPI.PerformUploadDeviceSignatures(req.Context(), uploadReq, uploadRes)
 
 	if err := uploadRes.Error; err != nil {
-		switch {
-		case err.IsInvalidSignature:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.InvalidSignature(err.Error()),
-			}
-		case err.IsMissingParam:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.MissingParam(err.Error()),
-			}
-		case err.IsInvalidParam:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.InvalidParam(err.Error()),
-			}
-		default:
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.Unknown(err.Error()),
-			}
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: keyErrorJSON(err),
 		}
 	}
 
+	failures := map[string]map[string]*jsonerror.MatrixError{}
+	for userID, forUserID := range uploadRes.Failures {
+		failures[userID] = make(map[string]*jsonerror.MatrixError, len(forUserID))
+		for keyID, err := range forUserID {
+			failures[userID][keyID] = keyErrorJSON(err)
+		}
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: map[string]interface{}{
+			"failures": failures,
+		},
+	}
+}
+
+// keyErrorJSON returns the Matrix error for an error from the key server.
+func keyErrorJSON(err *api.KeyError) *jsonerror.MatrixError {
+	switch {
+	case err.IsInvalidSignature:
+		return jsonerror.InvalidSignature(err.Error())
+	case err.IsMissingParam:
+		return jsonerror.MissingParam(err.Error())
+	case err.IsInvalidParam:
+		return jsonerror.InvalidParam(err.Error())
+	default:
+		return jsonerror.Unknown(err.Error())
 	}
 }
@@ -93,11 +93,22 @@ type queryKeysRequest struct {
 	DeviceKeys map[string][]string `json:"device_keys"`
 }
 
+// maxQueryKeysTimeout is the longest that clients can ask us to wait for
+// remote servers to answer a key query.
+const maxQueryKeysTimeout = time.Minute
+
+// GetTimeout returns how long to wait for remote servers. Keys from servers
+// which haven't answered by then come from what we have stored, and the
+// servers are listed in the failures of the response.
 func (r *queryKeysRequest) GetTimeout() time.Duration {
-	if r.Timeout == 0 {
+	if r.Timeout <= 0 {
 		return 10 * time.Second
 	}
-	return time.Duration(r.Timeout) * time.Millisecond
+	timeout := time.Duration(r.Timeout) * time.Millisecond
+	if timeout > maxQueryKeysTimeout {
+		return maxQueryKeysTimeout
+	}
+	return timeout
 }
 
 func QueryKeys(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device) util.JSONResponse {
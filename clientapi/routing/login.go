@@ -15,10 +15,13 @@
 package routing
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
@@ -27,13 +30,16 @@ import (
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 type loginResponse struct {
-	UserID      string                       `json:"user_id"`
-	AccessToken string                       `json:"access_token"`
-	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
-	DeviceID    string                       `json:"device_id"`
+	UserID       string                       `json:"user_id"`
+	AccessToken  string                       `json:"access_token"`
+	RefreshToken string                       `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64                        `json:"expires_in_ms,omitempty"`
+	HomeServer   gomatrixserverlib.ServerName `json:"home_server"`
+	DeviceID     string                       `json:"device_id"`
 }
 
 type flows struct {
@@ -42,6 +48,15 @@ type flows struct {
 
 type flow struct {
 	Type string `json:"type"`
+	// The identity providers which can be used, for m.login.sso
+	IdentityProviders []identityProvider `json:"identity_providers,omitempty"`
+}
+
+type identityProvider struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Icon  string `json:"icon,omitempty"`
+	Brand string `json:"brand,omitempty"`
 }
 
 func passwordLogin() flows {
@@ -53,33 +68,107 @@ func passwordLogin() flows {
 	return f
 }
 
+// loginFlows returns the ways that users can log in, which include single
+// sign-on if it is enabled.
+func loginFlows(cfg *config.ClientAPI) flows {
+	f := passwordLogin()
+	if !cfg.SSO.Enabled {
+		return f
+	}
+	sso := flow{Type: authtypes.LoginTypeSSO}
+	cas := false
+	for _, p := range cfg.SSO.Providers {
+		sso.IdentityProviders = append(sso.IdentityProviders, identityProvider{
+			ID:    p.ID,
+			Name:  p.Name,
+			Icon:  p.Icon,
+			Brand: p.Brand,
+		})
+		cas = cas || p.Type == config.IdentityProviderTypeCAS
+	}
+	f.Flows = append(f.Flows, sso)
+	if cas {
+		// Older clients only know how to log in with CAS.
+		f.Flows = append(f.Flows, flow{Type: authtypes.LoginTypeCAS})
+	}
+	// Clients log in with the token which they are given when the user
+	// comes back from single sign-on.
+	f.Flows = append(f.Flows, flow{Type: authtypes.LoginTypeToken})
+	return f
+}
+
 // Login implements GET and POST /login
 func Login(
-	req *http.Request, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
-	cfg *config.ClientAPI,
+	req *http.Request, accountDB accounts.Database, getAccountByPassword auth.GetAccountByPassword,
+	userAPI userapi.UserInternalAPI, cfg *config.ClientAPI, loginTokens *auth.LoginTokens,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
-		// TODO: support other forms of login other than password, depending on config options
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: loginFlows(cfg),
 		}
 	} else if req.Method == http.MethodPost {
-		typePassword := auth.LoginTypePassword{
-			GetAccountByPassword: accountDB.GetAccountByPassword,
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("ioutil.ReadAll failed")
+			return jsonerror.InternalServerError()
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var loginType auth.Type = &auth.LoginTypePassword{
+			GetAccountByPassword: getAccountByPassword,
 			Config:               cfg,
+			UserAPI:              userAPI,
 		}
-		r := typePassword.Request()
+		switch gjson.GetBytes(body, "type").Str {
+		case authtypes.LoginTypeToken:
+			if cfg.SSO.Enabled {
+				loginType = &auth.LoginTypeToken{
+					LoginTokens: loginTokens,
+				}
+			}
+		case authtypes.LoginTypeApplicationService:
+			token, err := auth.ExtractAccessToken(req)
+			if err != nil {
+				return util.JSONResponse{
+					Code: http.StatusUnauthorized,
+					JSON: jsonerror.MissingToken(err.Error()),
+				}
+			}
+			loginType = &auth.LoginTypeApplicationService{
+				Config:                cfg,
+				Token:                 token,
+				GetAccountByLocalpart: accountDB.GetAccountByLocalpart,
+			}
+		}
+		r := loginType.Request()
 		resErr := httputil.UnmarshalJSONRequest(req, r)
 		if resErr != nil {
 			return *resErr
 		}
-		login, authErr := typePassword.Login(req.Context(), r)
+		login, authErr := loginType.Login(req.Context(), r)
 		if authErr != nil {
 			return *authErr
 		}
+		// Locked users can't log in again until they are unlocked.
+		if localpart, err := userutil.ParseUsernameParam(login.Username(), &cfg.Matrix.ServerName); err == nil {
+			locked, err := accountDB.IsAccountLocked(req.Context(), localpart)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.IsAccountLocked failed")
+				return jsonerror.InternalServerError()
+			}
+			if locked {
+				return util.JSONResponse{
+					Code: http.StatusUnauthorized,
+					JSON: jsonerror.UserLocked("This account has been locked"),
+				}
+			}
+		}
+		// Users of application services can log in regardless of the
+		// monthly active user limit.
+		_, isAppService := loginType.(*auth.LoginTypeApplicationService)
 		// make a device/access token
-		return completeAuth(req.Context(), cfg.Matrix.ServerName, userAPI, login, req.RemoteAddr, req.UserAgent())
+		return completeAuth(req.Context(), cfg.Matrix.ServerName, userAPI, login, req.RemoteAddr, req.UserAgent(), !isAppService)
 	}
 	return util.JSONResponse{
 		Code: http.StatusMethodNotAllowed,
@@ -89,7 +178,7 @@ func Login(
 
 func completeAuth(
 	ctx context.Context, serverName gomatrixserverlib.ServerName, userAPI userapi.UserInternalAPI, login *auth.Login,
-	ipAddr, userAgent string,
+	ipAddr, userAgent string, checkMonthlyActiveUsers bool,
 ) util.JSONResponse {
 	token, err := auth.GenerateAccessToken()
 	if err != nil {
@@ -102,6 +191,12 @@ func completeAuth(
 		util.GetLogger(ctx).WithError(err).Error("auth.ParseUsernameParam failed")
 		return jsonerror.InternalServerError()
 	}
+	if checkMonthlyActiveUsers {
+		userID := userutil.MakeUserID(localpart, serverName)
+		if resErr := checkMonthlyActiveUserLimit(ctx, userAPI, userID); resErr != nil {
+			return *resErr
+		}
+	}
 
 	var performRes userapi.PerformDeviceCreationResponse
 	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
@@ -111,6 +206,7 @@ func completeAuth(
 		Localpart:         localpart,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		Refreshable:       login.RefreshToken,
 	}, &performRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -122,10 +218,34 @@ func completeAuth(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: loginResponse{
-			UserID:      performRes.Device.UserID,
-			AccessToken: performRes.Device.AccessToken,
-			HomeServer:  serverName,
-			DeviceID:    performRes.Device.ID,
+			UserID:       performRes.Device.UserID,
+			AccessToken:  performRes.Device.AccessToken,
+			RefreshToken: performRes.RefreshToken,
+			ExpiresInMS:  expiresInMS(performRes.Device),
+			HomeServer:   serverName,
+			DeviceID:     performRes.Device.ID,
 		},
 	}
 }
+
+// checkMonthlyActiveUserLimit returns an error response if the user can't
+// log in because the limit on monthly active users has been reached, and
+// they aren't one of them. The user ID is empty for users who are
+// registering, who can't register at all once the limit is reached.
+func checkMonthlyActiveUserLimit(ctx context.Context, userAPI userapi.UserInternalAPI, userID string) *util.JSONResponse {
+	var res userapi.QueryMonthlyActiveUsersResponse
+	if err := userAPI.QueryMonthlyActiveUsers(ctx, &userapi.QueryMonthlyActiveUsersRequest{
+		UserID: userID,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryMonthlyActiveUsers failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !res.LimitExceeded {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.MonthlyActiveUserLimitExceeded(res.AdminContact),
+	}
+}
@@ -208,6 +208,19 @@ func SendInvite(
 		return *reqErr
 	}
 
+	// Pretend that the invites of shadow-banned users were sent.
+	shadowBanned, err := isShadowBanned(req.Context(), accountDB, device)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("isShadowBanned failed")
+		return jsonerror.InternalServerError()
+	}
+	if shadowBanned {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	inviteStored, jsonErrResp := checkAndProcessThreepid(
 		req, device, body, cfg, rsAPI, accountDB, roomID, evTime,
 	)
@@ -16,10 +16,12 @@ package routing
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
@@ -64,7 +66,8 @@ func CreateOpenIDToken(
 			AccessToken:      response.Token.Token,
 			TokenType:        "Bearer",
 			MatrixServerName: string(cfg.Matrix.ServerName),
-			ExpiresIn:        response.Token.ExpiresAtMS / 1000, // convert ms to s
+			// The number of seconds until the token expires
+			ExpiresIn: int64(time.Until(gomatrixserverlib.Timestamp(response.Token.ExpiresAtMS).Time()) / time.Second),
 		},
 	}
 }
@@ -1,12 +1,16 @@
 package routing
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -24,77 +28,175 @@ type newPasswordAuth struct {
 	Type    string `json:"type"`
 	Session string `json:"session"`
 	auth.PasswordRequest
+	// The validated email address to reset the password of, for email auth
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
 }
 
+// Password implements POST /account/password for users who are logged in,
+// who have to authenticate again with their current password.
 func Password(
 	req *http.Request,
+	userInteractiveAuth *auth.UserInteractive,
 	userAPI api.UserInternalAPI,
-	accountDB accounts.Database,
 	device *api.Device,
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+
 	// Check that the existing password is right.
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+
+	// Get the local part.
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	// make sure that the access token being used matches the login creds used
+	// for user interactive auth, so that users can't change the passwords of
+	// accounts other than their own.
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot change another user's password"),
+		}
+	}
+
+	// Unmarshal the request.
 	var r newPasswordRequest
 	r.LogoutDevices = true
+	if err = json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
 
-	// Unmarshal the request.
-	resErr := httputil.UnmarshalJSONRequest(req, &r)
-	if resErr != nil {
+	// Check the new password strength.
+	if resErr := validatePasswordPolicy(r.NewPassword, cfg); resErr != nil {
+		return *resErr
+	}
+
+	// Ask the user API to perform the password change.
+	passwordReq := &api.PerformPasswordUpdateRequest{
+		Localpart: localpart,
+		Password:  r.NewPassword,
+	}
+	passwordRes := &api.PerformPasswordUpdateResponse{}
+	if err = userAPI.PerformPasswordUpdate(ctx, passwordReq, passwordRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("PerformPasswordUpdate failed")
+		return jsonerror.InternalServerError()
+	}
+	if !passwordRes.PasswordUpdated {
+		util.GetLogger(ctx).Error("Expected password to have been updated but wasn't")
+		return jsonerror.InternalServerError()
+	}
+
+	// If the request asks us to log out all other devices then
+	// ask the user API to do that.
+	if r.LogoutDevices {
+		logoutReq := &api.PerformDeviceDeletionRequest{
+			UserID:         device.UserID,
+			DeviceIDs:      nil,
+			ExceptDeviceID: device.ID,
+		}
+		logoutRes := &api.PerformDeviceDeletionResponse{}
+		if err = userAPI.PerformDeviceDeletion(ctx, logoutReq, logoutRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("PerformDeviceDeletion failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	// Return a success code.
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// ResetPassword implements POST /account/password for users who aren't logged
+// in, who prove that they own the account by validating its email address.
+func ResetPassword(
+	req *http.Request,
+	userAPI api.UserInternalAPI,
+	accountDB accounts.Database,
+	cfg *config.ClientAPI,
+	emailValidator *threepid.EmailValidator,
+) util.JSONResponse {
+	var r newPasswordRequest
+	r.LogoutDevices = true
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
 		return *resErr
 	}
 
-	// Retrieve or generate the sessionID
 	sessionID := r.Auth.Session
 	if sessionID == "" {
-		// Generate a new, random session ID
 		sessionID = util.RandomString(sessionIDLength)
 	}
-
-	// Require password auth to change the password.
-	if r.Auth.Type != authtypes.LoginTypePassword {
+	flows := []authtypes.Flow{
+		{
+			Stages: []authtypes.LoginType{authtypes.LoginTypeEmail},
+		},
+	}
+	if r.Auth.Type != authtypes.LoginTypeEmail {
 		return util.JSONResponse{
 			Code: http.StatusUnauthorized,
-			JSON: newUserInteractiveResponse(
-				sessionID,
-				[]authtypes.Flow{
-					{
-						Stages: []authtypes.LoginType{authtypes.LoginTypePassword},
-					},
-				},
-				nil,
-			),
+			JSON: newUserInteractiveResponse(sessionID, flows, nil),
 		}
 	}
 
-	// Check if the existing password is correct.
-	typePassword := auth.LoginTypePassword{
-		GetAccountByPassword: accountDB.GetAccountByPassword,
-		Config:               cfg,
-	}
-	if _, authErr := typePassword.Login(req.Context(), &r.Auth.PasswordRequest); authErr != nil {
-		return *authErr
+	creds := r.Auth.ThreePIDCreds
+	address, err := emailValidator.ValidatedAddress(creds.SID, creds.Secret)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("emailValidator.ValidatedAddress failed")
+		return jsonerror.InternalServerError()
 	}
-	AddCompletedSessionStage(sessionID, authtypes.LoginTypePassword)
-
-	// Check the new password strength.
-	if resErr = validatePassword(r.NewPassword); resErr != nil {
-		return *resErr
+	if address == "" {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "The email address has not been validated",
+			},
+		}
 	}
 
-	// Get the local part.
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), address, "email")
 	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
 		return jsonerror.InternalServerError()
 	}
+	if localpart == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "Email address not found",
+			},
+		}
+	}
+
+	if resErr := validatePasswordPolicy(r.NewPassword, cfg); resErr != nil {
+		return *resErr
+	}
 
-	// Ask the user API to perform the password change.
 	passwordReq := &api.PerformPasswordUpdateRequest{
 		Localpart: localpart,
 		Password:  r.NewPassword,
 	}
 	passwordRes := &api.PerformPasswordUpdateResponse{}
-	if err := userAPI.PerformPasswordUpdate(req.Context(), passwordReq, passwordRes); err != nil {
+	if err = userAPI.PerformPasswordUpdate(req.Context(), passwordReq, passwordRes); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("PerformPasswordUpdate failed")
 		return jsonerror.InternalServerError()
 	}
@@ -103,22 +205,25 @@ func Password(
 		return jsonerror.InternalServerError()
 	}
 
-	// If the request asks us to log out all other devices then
-	// ask the user API to do that.
+	// The validation can't be used to reset the password again.
+	if err = emailValidator.Forget(creds.SID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Warn("emailValidator.Forget failed")
+	}
+
+	// Whoever reset the password may not have been using any of the devices,
+	// so all of them are logged out if the request asks for it.
 	if r.LogoutDevices {
 		logoutReq := &api.PerformDeviceDeletionRequest{
-			UserID:         device.UserID,
-			DeviceIDs:      nil,
-			ExceptDeviceID: device.ID,
+			UserID:    userutil.MakeUserID(localpart, cfg.Matrix.ServerName),
+			DeviceIDs: nil,
 		}
 		logoutRes := &api.PerformDeviceDeletionResponse{}
-		if err := userAPI.PerformDeviceDeletion(req.Context(), logoutReq, logoutRes); err != nil {
+		if err = userAPI.PerformDeviceDeletion(req.Context(), logoutReq, logoutRes); err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("PerformDeviceDeletion failed")
 			return jsonerror.InternalServerError()
 		}
 	}
 
-	// Return a success code.
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
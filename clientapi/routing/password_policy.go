@@ -0,0 +1,100 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+// passwordPolicyCapability is the password policy as advertised in
+// /capabilities, using the names from MSC2000.
+type passwordPolicyCapability struct {
+	MinimumLength    int  `json:"m.minimum_length"`
+	RequireDigit     bool `json:"m.require_digit"`
+	RequireSymbol    bool `json:"m.require_symbol"`
+	RequireLowercase bool `json:"m.require_lowercase"`
+	RequireUppercase bool `json:"m.require_uppercase"`
+}
+
+func passwordPolicyCapabilityFor(policy *config.PasswordPolicy) passwordPolicyCapability {
+	return passwordPolicyCapability{
+		MinimumLength:    policy.MinLength,
+		RequireDigit:     policy.RequireDigit,
+		RequireSymbol:    policy.RequireSymbol,
+		RequireLowercase: policy.RequireLowercase,
+		RequireUppercase: policy.RequireUppercase,
+	}
+}
+
+// validatePasswordPolicy returns an error response if the password that a
+// user chose doesn't follow the password policy. Empty passwords are left
+// for the caller to refuse, as application services register users without
+// them.
+func validatePasswordPolicy(password string, cfg *config.ClientAPI) *util.JSONResponse {
+	if password == "" {
+		return nil
+	}
+	if resErr := validatePassword(password); resErr != nil {
+		return resErr
+	}
+	policy := &cfg.PasswordPolicy
+	weak := func(msg string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.WeakPassword(msg),
+		}
+	}
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return weak(fmt.Sprintf("password too weak: min %d chars", policy.MinLength))
+	}
+	var digit, symbol, lower, upper bool
+	for _, r := range password {
+		switch {
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+	switch {
+	case policy.RequireDigit && !digit:
+		return weak("password too weak: must contain a digit")
+	case policy.RequireSymbol && !symbol:
+		return weak("password too weak: must contain a symbol")
+	case policy.RequireLowercase && !lower:
+		return weak("password too weak: must contain a lowercase letter")
+	case policy.RequireUppercase && !upper:
+		return weak("password too weak: must contain an uppercase letter")
+	}
+	lowered := strings.ToLower(password)
+	_, common := commonPasswords[lowered]
+	_, denied := cfg.Derived.PasswordDenylist[lowered]
+	if (policy.DenyCommonPasswords && common) || denied {
+		return weak("password too weak: this password is too common")
+	}
+	return nil
+}
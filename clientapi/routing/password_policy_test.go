@@ -0,0 +1,51 @@
+package routing
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestValidatePasswordPolicy(t *testing.T) {
+	cfg := &config.ClientAPI{
+		PasswordPolicy: config.PasswordPolicy{
+			MinLength:           10,
+			RequireDigit:        true,
+			RequireSymbol:       true,
+			RequireLowercase:    true,
+			RequireUppercase:    true,
+			DenyCommonPasswords: true,
+		},
+		Derived: &config.Derived{
+			PasswordDenylist: map[string]struct{}{"correct-h0rse-battery": {}},
+		},
+	}
+	tsts := []struct {
+		Name     string
+		Password string
+		WantOK   bool
+	}{
+		{"empty", "", true},
+		{"strong", "Tr0ub4dor&3x", true},
+		{"tooShort", "Sh0rt!", false},
+		{"shortInRunes", "Ünïcødé!1", false},
+		{"noDigit", "Troubador&xx", false},
+		{"noSymbol", "Troub4dor3x", false},
+		{"noLowercase", "TR0UB4DOR&3X", false},
+		{"noUppercase", "tr0ub4dor&3x", false},
+		{"common", "Password1!", false},
+		{"denylist", "Correct-H0rse-battery", false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			res := validatePasswordPolicy(tst.Password, cfg)
+			if ok := res == nil; ok != tst.WantOK {
+				t.Fatalf("got %+v, want OK %v", res, tst.WantOK)
+			}
+			if res != nil && res.Code != http.StatusBadRequest {
+				t.Errorf("got HTTP %d, want 400", res.Code)
+			}
+		})
+	}
+}
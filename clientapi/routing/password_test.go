@@ -0,0 +1,82 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+type mockPasswordUserAPI struct {
+	api.UserInternalAPI
+	passwords map[string]string // localpart -> password
+	loggedOut *api.PerformDeviceDeletionRequest
+}
+
+func (m *mockPasswordUserAPI) getAccountByPassword(ctx context.Context, localpart, password string) (*api.Account, error) {
+	if m.passwords[localpart] != password {
+		return nil, fmt.Errorf("unknown user/password")
+	}
+	return &api.Account{Localpart: localpart, ServerName: "example.com"}, nil
+}
+
+func (m *mockPasswordUserAPI) PerformPasswordUpdate(ctx context.Context, req *api.PerformPasswordUpdateRequest, res *api.PerformPasswordUpdateResponse) error {
+	m.passwords[req.Localpart] = req.Password
+	res.PasswordUpdated = true
+	return nil
+}
+
+func (m *mockPasswordUserAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
+	m.loggedOut = req
+	return nil
+}
+
+func TestPassword(t *testing.T) {
+	device := &api.Device{UserID: "@alice:example.com", ID: "ALICEDEVICE"}
+	tsts := []struct {
+		Name          string
+		Body          string
+		WantCode      int
+		WantPassword  string
+		WantLogoutAll bool
+	}{
+		{"noAuth", `{"new_password": "newpassword"}`, http.StatusUnauthorized, "oldpassword", false},
+		{"wrongPassword", `{"new_password": "newpassword", "auth": {"type": "m.login.password", "user": "alice", "password": "wrong"}}`, http.StatusUnauthorized, "oldpassword", false},
+		{"otherUser", `{"new_password": "newpassword", "auth": {"type": "m.login.password", "user": "bob", "password": "bobpassword"}}`, http.StatusForbidden, "oldpassword", false},
+		{"weakPassword", `{"new_password": "new", "auth": {"type": "m.login.password", "user": "alice", "password": "oldpassword"}}`, http.StatusBadRequest, "oldpassword", false},
+		{"logoutDevices", `{"new_password": "newpassword", "auth": {"type": "m.login.password", "user": "@alice:example.com", "password": "oldpassword"}}`, http.StatusOK, "newpassword", true},
+		{"keepDevices", `{"new_password": "newpassword", "logout_devices": false, "auth": {"type": "m.login.password", "user": "alice", "password": "oldpassword"}}`, http.StatusOK, "newpassword", false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			userAPI := &mockPasswordUserAPI{passwords: map[string]string{
+				"alice": "oldpassword",
+				"bob":   "bobpassword",
+			}}
+			cfg := &config.ClientAPI{Matrix: &config.Global{ServerName: "example.com"}, Derived: &config.Derived{}}
+			cfg.PasswordPolicy.Defaults()
+			uia := auth.NewUserInteractive(userAPI.getAccountByPassword, nil, cfg, auth.NewSessions(nil))
+			req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/account/password", strings.NewReader(tst.Body))
+
+			res := Password(req, uia, userAPI, device, cfg)
+			if res.Code != tst.WantCode {
+				t.Fatalf("got code %d (%+v), want %d", res.Code, res.JSON, tst.WantCode)
+			}
+			if userAPI.passwords["alice"] != tst.WantPassword || userAPI.passwords["bob"] != "bobpassword" {
+				t.Errorf("got passwords %v, want alice's to be %q", userAPI.passwords, tst.WantPassword)
+			}
+			if loggedOut := userAPI.loggedOut != nil; loggedOut != tst.WantLogoutAll {
+				t.Fatalf("got other devices logged out %v, want %v", loggedOut, tst.WantLogoutAll)
+			}
+			if tst.WantLogoutAll && (userAPI.loggedOut.UserID != device.UserID || userAPI.loggedOut.ExceptDeviceID != device.ID) {
+				t.Errorf("got device deletion %+v, want all of alice's devices except the current one", userAPI.loggedOut)
+			}
+		})
+	}
+}
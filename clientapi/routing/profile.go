@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"time"
 
@@ -54,12 +55,30 @@ func GetProfile(
 		return jsonerror.InternalServerError()
 	}
 
+	// Local users can have custom profile fields as well.
+	fields, err := localProfileFields(req.Context(), accountDB, cfg, userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("localProfileFields failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(fields) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: eventutil.ProfileResponse{
+				AvatarURL:   profile.AvatarURL,
+				DisplayName: profile.DisplayName,
+			},
+		}
+	}
+	res := make(map[string]interface{}, len(fields)+2)
+	for name, value := range fields {
+		res[name] = value
+	}
+	res["avatar_url"] = profile.AvatarURL
+	res["displayname"] = profile.DisplayName
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: eventutil.ProfileResponse{
-			AvatarURL:   profile.AvatarURL,
-			DisplayName: profile.DisplayName,
-		},
+		JSON: res,
 	}
 }
 
@@ -154,8 +173,14 @@ func SetAvatarURL(
 		AvatarURL:   r.AvatarURL,
 	}
 
+	fields, err := membershipProfileFields(req.Context(), accountDB, cfg, localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("membershipProfileFields failed")
+		return jsonerror.InternalServerError()
+	}
+
 	events, err := buildMembershipEvents(
-		req.Context(), res.RoomIDs, newProfile, userID, cfg, evTime, rsAPI,
+		req.Context(), res.RoomIDs, newProfile, fields, userID, cfg, evTime, rsAPI,
 	)
 	switch e := err.(type) {
 	case nil:
@@ -271,8 +296,14 @@ func SetDisplayName(
 		AvatarURL:   oldProfile.AvatarURL,
 	}
 
+	fields, err := membershipProfileFields(req.Context(), accountDB, cfg, localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("membershipProfileFields failed")
+		return jsonerror.InternalServerError()
+	}
+
 	events, err := buildMembershipEvents(
-		req.Context(), res.RoomIDs, newProfile, userID, cfg, evTime, rsAPI,
+		req.Context(), res.RoomIDs, newProfile, fields, userID, cfg, evTime, rsAPI,
 	)
 	switch e := err.(type) {
 	case nil:
@@ -339,10 +370,13 @@ func getProfile(
 	return profile, nil
 }
 
+// buildMembershipEvents builds the join events which update the user's
+// profile in the rooms, which include the custom profile fields that are
+// copied into membership events.
 func buildMembershipEvents(
 	ctx context.Context,
 	roomIDs []string,
-	newProfile authtypes.Profile, userID string, cfg *config.ClientAPI,
+	newProfile authtypes.Profile, fields map[string]json.RawMessage, userID string, cfg *config.ClientAPI,
 	evTime time.Time, rsAPI api.RoomserverInternalAPI,
 ) ([]*gomatrixserverlib.HeaderedEvent, error) {
 	evs := []*gomatrixserverlib.HeaderedEvent{}
@@ -368,7 +402,11 @@ func buildMembershipEvents(
 		content.DisplayName = newProfile.DisplayName
 		content.AvatarURL = newProfile.AvatarURL
 
-		if err := builder.SetContent(content); err != nil {
+		memberContent, err := withProfileFields(content, fields)
+		if err != nil {
+			return nil, err
+		}
+		if err = builder.SetContent(memberContent); err != nil {
 			return nil, err
 		}
 
@@ -0,0 +1,337 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// maxProfileFieldNameLength is the longest that the names of custom profile
+// fields can be, in bytes.
+const maxProfileFieldNameLength = 255
+
+// GetProfileField implements GET /uk.tcpip.msc4133/profile/{userID}/{keyName}
+// The display name and avatar URL can be fetched for any user, but custom
+// fields only for local users, since they aren't available over federation.
+func GetProfileField(
+	req *http.Request, accountDB accounts.Database, cfg *config.ClientAPI,
+	userID, name string, asAPI appserviceAPI.AppServiceQueryAPI,
+	federation *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	profile, err := getProfile(req.Context(), accountDB, cfg, userID, asAPI, federation)
+	if err != nil {
+		if err == eventutil.ErrProfileNoExists {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("The user does not exist or does not have a profile"),
+			}
+		}
+
+		util.GetLogger(req.Context()).WithError(err).Error("getProfile failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var value interface{}
+	switch name {
+	case "displayname":
+		value = profile.DisplayName
+	case "avatar_url":
+		value = profile.AvatarURL
+	default:
+		fields, err := localProfileFields(req.Context(), accountDB, cfg, userID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("localProfileFields failed")
+			return jsonerror.InternalServerError()
+		}
+		field, ok := fields[name]
+		if !ok {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("The user does not have this profile field"),
+			}
+		}
+		value = field
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			name: value,
+		},
+	}
+}
+
+// SetProfileField implements PUT /uk.tcpip.msc4133/profile/{userID}/{keyName}
+func SetProfileField(
+	req *http.Request, accountDB accounts.Database,
+	device *userapi.Device, userID, name string, cfg *config.ClientAPI, rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	if resErr := checkProfileFieldRequest(device, userID, name); resErr != nil {
+		return *resErr
+	}
+
+	var r map[string]json.RawMessage
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	value, ok := r[name]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("'" + name + "' must be supplied."),
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	evTime, err := httputil.ParseTSParam(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	// The limit is on the size of all of the fields together, so check what
+	// the profile would look like with the new value.
+	fields, err := accountDB.GetProfileFields(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetProfileFields failed")
+		return jsonerror.InternalServerError()
+	}
+	fields[name] = value
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(encoded) > cfg.ProfileFields.MaxSize {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.ProfileTooLarge("The profile would be larger than the server allows"),
+		}
+	}
+
+	if err = accountDB.SetProfileField(req.Context(), localpart, name, value); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetProfileField failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return updateMembershipProfileFields(req, accountDB, device, localpart, name, cfg, evTime, rsAPI)
+}
+
+// DeleteProfileField implements DELETE /uk.tcpip.msc4133/profile/{userID}/{keyName}
+func DeleteProfileField(
+	req *http.Request, accountDB accounts.Database,
+	device *userapi.Device, userID, name string, cfg *config.ClientAPI, rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	if resErr := checkProfileFieldRequest(device, userID, name); resErr != nil {
+		return *resErr
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	evTime, err := httputil.ParseTSParam(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	if err = accountDB.RemoveProfileField(req.Context(), localpart, name); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveProfileField failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return updateMembershipProfileFields(req, accountDB, device, localpart, name, cfg, evTime, rsAPI)
+}
+
+// checkProfileFieldRequest returns an error response if the user can't change
+// the custom profile field.
+func checkProfileFieldRequest(device *userapi.Device, userID, name string) *util.JSONResponse {
+	if userID != device.UserID {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("userID does not match the current user"),
+		}
+	}
+	switch {
+	case name == "displayname" || name == "avatar_url":
+		// These have their own endpoints, which also update the user's
+		// membership events.
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Use the " + name + " endpoint to change '" + name + "'"),
+		}
+	case name == "" || len(name) > maxProfileFieldNameLength:
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Profile field names must be between 1 and 255 bytes long"),
+		}
+	}
+	return nil
+}
+
+// updateMembershipProfileFields sends new membership events to the rooms that
+// the user is joined to if the custom profile field is copied into them.
+func updateMembershipProfileFields(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device,
+	localpart, name string, cfg *config.ClientAPI, evTime time.Time, rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	if !isMembershipProfileField(cfg, name) {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	profile, err := accountDB.GetProfileByLocalpart(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetProfileByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	fields, err := membershipProfileFields(req.Context(), accountDB, cfg, localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("membershipProfileFields failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var res api.QueryRoomsForUserResponse
+	err = rsAPI.QueryRoomsForUser(req.Context(), &api.QueryRoomsForUserRequest{
+		UserID:         device.UserID,
+		WantMembership: "join",
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("QueryRoomsForUser failed")
+		return jsonerror.InternalServerError()
+	}
+
+	events, err := buildMembershipEvents(
+		req.Context(), res.RoomIDs, authtypes.Profile{
+			Localpart:   localpart,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}, fields, device.UserID, cfg, evTime, rsAPI,
+	)
+	switch e := err.(type) {
+	case nil:
+	case gomatrixserverlib.BadJSONError:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(e.Error()),
+		}
+	default:
+		util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if err := api.SendEvents(req.Context(), rsAPI, api.KindNew, events, cfg.Matrix.ServerName, cfg.Matrix.ServerName, nil, false); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// localProfileFields returns the custom profile fields of the user, or none
+// if they aren't a local user.
+func localProfileFields(
+	ctx context.Context, accountDB accounts.Database, cfg *config.ClientAPI, userID string,
+) (map[string]json.RawMessage, error) {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	if domain != cfg.Matrix.ServerName {
+		return nil, nil
+	}
+	return accountDB.GetProfileFields(ctx, localpart)
+}
+
+// membershipProfileFields returns the custom profile fields of the local user
+// which are copied into their membership events.
+func membershipProfileFields(
+	ctx context.Context, accountDB accounts.Database, cfg *config.ClientAPI, localpart string,
+) (map[string]json.RawMessage, error) {
+	if len(cfg.ProfileFields.MembershipFields) == 0 {
+		return nil, nil
+	}
+	fields, err := accountDB.GetProfileFields(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	for name := range fields {
+		if !isMembershipProfileField(cfg, name) {
+			delete(fields, name)
+		}
+	}
+	return fields, nil
+}
+
+func isMembershipProfileField(cfg *config.ClientAPI, name string) bool {
+	for _, field := range cfg.ProfileFields.MembershipFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withProfileFields adds the custom profile fields to the content of the
+// membership event. They can't replace the keys which the content already has.
+func withProfileFields(content gomatrixserverlib.MemberContent, fields map[string]json.RawMessage) (interface{}, error) {
+	if len(fields) == 0 {
+		return content, nil
+	}
+	raw, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		merged[name] = value
+	}
+	if err = json.Unmarshal(raw, &merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
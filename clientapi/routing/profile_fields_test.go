@@ -0,0 +1,128 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type mockProfileFieldsDatabase struct {
+	accounts.Database
+	fields map[string]json.RawMessage
+}
+
+func (d *mockProfileFieldsDatabase) GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error) {
+	return &authtypes.Profile{Localpart: localpart, DisplayName: "Alice"}, nil
+}
+
+func (d *mockProfileFieldsDatabase) GetProfileFields(ctx context.Context, localpart string) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage, len(d.fields))
+	for name, value := range d.fields {
+		fields[name] = value
+	}
+	return fields, nil
+}
+
+func (d *mockProfileFieldsDatabase) SetProfileField(ctx context.Context, localpart, name string, value json.RawMessage) error {
+	d.fields[name] = value
+	return nil
+}
+
+func (d *mockProfileFieldsDatabase) RemoveProfileField(ctx context.Context, localpart, name string) error {
+	delete(d.fields, name)
+	return nil
+}
+
+func TestProfileFields(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "localhost"},
+		ProfileFields: config.ProfileFields{
+			MaxSize: 64,
+		},
+	}
+	db := &mockProfileFieldsDatabase{fields: map[string]json.RawMessage{}}
+	device := &api.Device{UserID: "@alice:localhost"}
+
+	tsts := []struct {
+		Name     string
+		UserID   string
+		Field    string
+		Body     string
+		WantCode int
+	}{
+		{"set", "@alice:localhost", "m.tz", `{"m.tz":"Europe/London"}`, http.StatusOK},
+		{"object", "@alice:localhost", "org.example.pets", `{"org.example.pets":{"cats":2}}`, http.StatusOK},
+		{"otherUser", "@bob:localhost", "m.tz", `{"m.tz":"Europe/London"}`, http.StatusForbidden},
+		{"missingValue", "@alice:localhost", "m.tz", `{"m.pronouns":"they/them"}`, http.StatusBadRequest},
+		{"displayName", "@alice:localhost", "displayname", `{"displayname":"Alice"}`, http.StatusBadRequest},
+		{"tooLarge", "@alice:localhost", "org.example.bio", `{"org.example.bio":"` + strings.Repeat("a", 64) + `"}`, http.StatusBadRequest},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tst.Body))
+			res := SetProfileField(req, db, device, tst.UserID, tst.Field, cfg, nil)
+			if res.Code != tst.WantCode {
+				t.Errorf("got code %d, want %d: %+v", res.Code, tst.WantCode, res.JSON)
+			}
+		})
+	}
+	if got := string(db.fields["m.tz"]); got != `"Europe/London"` {
+		t.Errorf("got m.tz %s, want %q", got, "Europe/London")
+	}
+	if _, ok := db.fields["org.example.bio"]; ok {
+		t.Errorf("got org.example.bio, want it not to be set as it is too large")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	res := GetProfileField(req, db, cfg, "@alice:localhost", "org.example.pets", nil, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got code %d, want %d", res.Code, http.StatusOK)
+	}
+	got, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	if want := `{"org.example.pets":{"cats":2}}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/", nil)
+	if res = DeleteProfileField(req, db, device, "@alice:localhost", "m.tz", cfg, nil); res.Code != http.StatusOK {
+		t.Fatalf("got code %d, want %d", res.Code, http.StatusOK)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	if res = GetProfileField(req, db, cfg, "@alice:localhost", "m.tz", nil, nil); res.Code != http.StatusNotFound {
+		t.Errorf("got code %d, want %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func TestWithProfileFields(t *testing.T) {
+	content := gomatrixserverlib.MemberContent{
+		Membership:  gomatrixserverlib.Join,
+		DisplayName: "Alice",
+	}
+	merged, err := withProfileFields(content, map[string]json.RawMessage{
+		"m.tz":        json.RawMessage(`"Europe/London"`),
+		"displayname": json.RawMessage(`"Mallory"`),
+	})
+	if err != nil {
+		t.Fatalf("withProfileFields failed: %s", err)
+	}
+	got, err := json.Marshal(merged)
+	if err != nil {
+		t.Fatalf("failed to marshal content: %s", err)
+	}
+	// The custom fields can't replace the display name.
+	if want := `{"displayname":"Alice","m.tz":"Europe/London","membership":"join"}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetPushers handles /_matrix/client/r0/pushers
+func GetPushers(
+	req *http.Request, device *api.Device,
+	userAPI api.UserInternalAPI,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	var queryRes api.QueryPushersResponse
+	if err = userAPI.QueryPushers(req.Context(), &api.QueryPushersRequest{
+		Localpart: localpart,
+	}, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryPushers failed")
+		return jsonerror.InternalServerError()
+	}
+	for i := range queryRes.Pushers {
+		// The session ID is internal and isn't part of the response.
+		queryRes.Pushers[i].SessionID = 0
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
+
+// SetPusher handles /_matrix/client/r0/pushers/set
+// This endpoint allows the creation, modification and deletion of pushers for this user ID.
+// The behaviour of this endpoint varies depending on the values in the JSON body.
+func SetPusher(
+	req *http.Request, device *api.Device,
+	userAPI api.UserInternalAPI, accountDB accounts.Database,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	body := api.PerformPusherSetRequest{}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if resErr := validatePusher(&body.Pusher); resErr != nil {
+		return *resErr
+	}
+	if body.Kind == api.EmailKind {
+		// Emails can only be sent to addresses that the user has verified.
+		threepids, err := accountDB.GetThreePIDsForLocalpart(req.Context(), localpart)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetThreePIDsForLocalpart failed")
+			return jsonerror.InternalServerError()
+		}
+		if !hasEmailThreePID(threepids, body.PushKey) {
+			return *invalidPusherParam(jsonerror.InvalidParam("pushkey must be an email address associated with the account."))
+		}
+	}
+	body.Localpart = localpart
+	body.SessionID = device.SessionID
+	var res api.PerformPusherSetResponse
+	if err = userAPI.PerformPusherSet(req.Context(), &body, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPusherSet failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Error != nil {
+		return *invalidPusherParam(jsonerror.InvalidParam(res.Error.Message + "."))
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func validatePusher(pusher *api.Pusher) *util.JSONResponse {
+	switch {
+	case pusher.AppID == "":
+		return invalidPusherParam(jsonerror.MissingParam("Missing app_id."))
+	case len(pusher.AppID) > 64:
+		return invalidPusherParam(jsonerror.InvalidParam("Length of app_id must be no more than 64 characters."))
+	case pusher.PushKey == "":
+		return invalidPusherParam(jsonerror.MissingParam("Missing pushkey."))
+	case len(pusher.PushKey) > 512:
+		return invalidPusherParam(jsonerror.InvalidParam("Length of pushkey must be no more than 512 bytes."))
+	}
+	if pusher.Kind == "" {
+		// The pusher is being deleted, so nothing else is needed.
+		return nil
+	}
+	switch pusher.Kind {
+	case api.HTTPKind:
+	case api.EmailKind:
+		if pusher.AppID != api.EmailPusherAppID {
+			return invalidPusherParam(jsonerror.InvalidParam("app_id must be " + api.EmailPusherAppID + " for an email pusher."))
+		}
+		return nil
+	case api.WebPushKind:
+		if _, err := pushgateway.ParseWebPushSubscription(pusher.Data); err != nil {
+			return invalidPusherParam(jsonerror.InvalidParam(err.Error() + " for a WebPush pusher."))
+		}
+		return nil
+	default:
+		return invalidPusherParam(jsonerror.InvalidParam("Unsupported pusher kind."))
+	}
+	pushURL, ok := pusher.Data["url"].(string)
+	if !ok || pushURL == "" {
+		return invalidPusherParam(jsonerror.MissingParam("Missing data.url for an HTTP pusher."))
+	}
+	parsed, err := url.Parse(pushURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return invalidPusherParam(jsonerror.InvalidParam("data.url must be an absolute HTTP or HTTPS URL."))
+	}
+	return nil
+}
+
+// hasEmailThreePID returns whether the address is one of the email 3PIDs.
+func hasEmailThreePID(threepids []authtypes.ThreePID, address string) bool {
+	for _, threepid := range threepids {
+		if threepid.Medium == "email" && strings.EqualFold(threepid.Address, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func invalidPusherParam(err *jsonerror.MatrixError) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: err,
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// pushRulesAccountDataType is the global account data type that the push
+// rules are stored in, so that clients are told about changes in /sync.
+const pushRulesAccountDataType = "m.push_rules"
+
+// pushRulesScopePattern matches the scope in the push rules paths. Device
+// scopes contain a slash, so they need a pattern of their own, which must
+// come first so that a profile tag isn't taken as a kind.
+const pushRulesScopePattern = "{scope:device/[^/]+|[^/]+}"
+
+// pushRulesErrorResponse turns the Matrix errors returned by the push rules
+// helpers into responses, and logs any other error as an internal error.
+func pushRulesErrorResponse(ctx context.Context, err error, msg string, args ...interface{}) util.JSONResponse {
+	if eerr, ok := err.(*jsonerror.MatrixError); ok {
+		var status int
+		switch eerr.ErrCode {
+		case "M_INVALID_ARGUMENT_VALUE":
+			status = http.StatusBadRequest
+		case "M_NOT_FOUND":
+			status = http.StatusNotFound
+		default:
+			status = http.StatusInternalServerError
+		}
+		return util.MatrixErrorResponse(status, eerr.ErrCode, eerr.Err)
+	}
+	util.GetLogger(ctx).WithError(err).Errorf(msg, args...)
+	return jsonerror.InternalServerError()
+}
+
+// GetAllPushRules implements GET /pushrules/
+func GetAllPushRules(ctx context.Context, device *userapi.Device, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "queryPushRules failed")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSets,
+	}
+}
+
+// GetPushRulesByScope implements GET /pushrules/{scope}/
+func GetPushRulesByScope(ctx context.Context, scope string, device *userapi.Device, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "queryPushRules failed")
+	}
+	ruleSet := pushRuleSetByScope(ruleSets, pushrules.Scope(scope))
+	if ruleSet == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rule set"), "pushRuleSetByScope failed")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSet,
+	}
+}
+
+// GetPushRulesByKind implements GET /pushrules/{scope}/{kind}/
+func GetPushRulesByKind(ctx context.Context, scope, kind string, device *userapi.Device, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "queryPushRules failed")
+	}
+	ruleSet := pushRuleSetByScope(ruleSets, pushrules.Scope(scope))
+	if ruleSet == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rule set"), "pushRuleSetByScope failed")
+	}
+	rulesPtr := ruleSet.Rules(pushrules.Kind(kind))
+	if rulesPtr == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rules kind"), "RuleSet.Rules failed")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: *rulesPtr,
+	}
+}
+
+// GetPushRuleByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}
+func GetPushRuleByRuleID(ctx context.Context, scope, kind, ruleID string, device *userapi.Device, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "queryPushRules failed")
+	}
+	ruleSet := pushRuleSetByScope(ruleSets, pushrules.Scope(scope))
+	if ruleSet == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rule set"), "pushRuleSetByScope failed")
+	}
+	rulesPtr := ruleSet.Rules(pushrules.Kind(kind))
+	if rulesPtr == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rules kind"), "RuleSet.Rules failed")
+	}
+	i := pushRuleIndexByID(*rulesPtr, ruleID)
+	if i < 0 {
+		return pushRulesErrorResponse(ctx, jsonerror.NotFound("push rule ID not found"), "pushRuleIndexByID failed")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: (*rulesPtr)[i],
+	}
+}
+
+// PutPushRuleByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}
+func PutPushRuleByRuleID(
+	req *http.Request, scope, kind, ruleID, afterRuleID, beforeRuleID string,
+	device *userapi.Device, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	ctx := req.Context()
+	var newRule pushrules.Rule
+	if resErr := httputil.UnmarshalJSONRequest(req, &newRule); resErr != nil {
+		return *resErr
+	}
+	newRule.RuleID = ruleID
+
+	if isReservedPushRuleID(ruleID) {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("cannot create or replace server-default rules"), "isReservedPushRuleID failed")
+	}
+	errs := pushrules.ValidateRule(pushrules.Kind(kind), &newRule)
+	if len(errs) > 0 {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue(errs[0].Error()), "rule sanity check failed: %v", errs)
+	}
+
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "queryPushRules failed")
+	}
+	ruleSet := pushRuleSetByScope(ruleSets, pushrules.Scope(scope))
+	if ruleSet == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rule set"), "pushRuleSetByScope failed")
+	}
+	rulesPtr := ruleSet.Rules(pushrules.Kind(kind))
+	if rulesPtr == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rules kind"), "RuleSet.Rules failed")
+	}
+	i := pushRuleIndexByID(*rulesPtr, ruleID)
+	if i >= 0 && afterRuleID == "" && beforeRuleID == "" {
+		// Modify the rule in place. Whether it is enabled can only be
+		// changed through the enabled attribute.
+		newRule.Enabled = (*rulesPtr)[i].Enabled
+		*((*rulesPtr)[i]) = newRule
+		util.GetLogger(ctx).Infof("Modified existing push rule at %d", i)
+	} else {
+		if i >= 0 {
+			// Move the rule by deleting it and adding it again.
+			newRule.Enabled = (*rulesPtr)[i].Enabled
+			*rulesPtr = append((*rulesPtr)[:i], (*rulesPtr)[i+1:]...)
+			util.GetLogger(ctx).Infof("Deleted old push rule at %d", i)
+		} else {
+			// SPEC: When creating push rules, they MUST be enabled by default.
+			newRule.Enabled = true
+		}
+
+		// Add new rule.
+		i, err = findPushRuleInsertionIndex(*rulesPtr, afterRuleID, beforeRuleID)
+		if err != nil {
+			return pushRulesErrorResponse(ctx, err, "findPushRuleInsertionIndex failed")
+		}
+
+		*rulesPtr = append((*rulesPtr)[:i], append([]*pushrules.Rule{&newRule}, (*rulesPtr)[i:]...)...)
+		util.GetLogger(ctx).WithField("after", afterRuleID).WithField("before", beforeRuleID).Infof("Added new push rule at %d", i)
+	}
+
+	if err := putPushRules(ctx, device.UserID, ruleSets, userAPI, syncProducer); err != nil {
+		return pushRulesErrorResponse(ctx, err, "putPushRules failed")
+	}
+
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// DeletePushRuleByRuleID implements DELETE /pushrules/{scope}/{kind}/{ruleID}
+func DeletePushRuleByRuleID(
+	ctx context.Context, scope, kind, ruleID string,
+	device *userapi.Device, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "queryPushRules failed")
+	}
+	ruleSet := pushRuleSetByScope(ruleSets, pushrules.Scope(scope))
+	if ruleSet == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rule set"), "pushRuleSetByScope failed")
+	}
+	rulesPtr := ruleSet.Rules(pushrules.Kind(kind))
+	if rulesPtr == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rules kind"), "RuleSet.Rules failed")
+	}
+	i := pushRuleIndexByID(*rulesPtr, ruleID)
+	if i < 0 {
+		return pushRulesErrorResponse(ctx, jsonerror.NotFound("push rule ID not found"), "pushRuleIndexByID failed")
+	}
+	if (*rulesPtr)[i].Default {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("cannot delete server-default rules"), "rule is a default rule")
+	}
+
+	*rulesPtr = append((*rulesPtr)[:i], (*rulesPtr)[i+1:]...)
+
+	if err = putPushRules(ctx, device.UserID, ruleSets, userAPI, syncProducer); err != nil {
+		return pushRulesErrorResponse(ctx, err, "putPushRules failed")
+	}
+
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// GetPushRuleAttrByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}/{attr}
+func GetPushRuleAttrByRuleID(
+	ctx context.Context, scope, kind, ruleID, attr string,
+	device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	attrGet, err := pushRuleAttrGetter(attr)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "pushRuleAttrGetter failed")
+	}
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "queryPushRules failed")
+	}
+	ruleSet := pushRuleSetByScope(ruleSets, pushrules.Scope(scope))
+	if ruleSet == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rule set"), "pushRuleSetByScope failed")
+	}
+	rulesPtr := ruleSet.Rules(pushrules.Kind(kind))
+	if rulesPtr == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rules kind"), "RuleSet.Rules failed")
+	}
+	i := pushRuleIndexByID(*rulesPtr, ruleID)
+	if i < 0 {
+		return pushRulesErrorResponse(ctx, jsonerror.NotFound("push rule ID not found"), "pushRuleIndexByID failed")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			attr: attrGet((*rulesPtr)[i]),
+		},
+	}
+}
+
+// PutPushRuleAttrByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}/{attr}
+func PutPushRuleAttrByRuleID(
+	req *http.Request, scope, kind, ruleID, attr string,
+	device *userapi.Device, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	ctx := req.Context()
+	var newPartialRule pushrules.Rule
+	if resErr := httputil.UnmarshalJSONRequest(req, &newPartialRule); resErr != nil {
+		return *resErr
+	}
+	if newPartialRule.Actions == nil {
+		// This ensures json.Marshal encodes the empty list as [] rather than null.
+		newPartialRule.Actions = []*pushrules.Action{}
+	}
+
+	attrGet, err := pushRuleAttrGetter(attr)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "pushRuleAttrGetter failed")
+	}
+	attrSet, err := pushRuleAttrSetter(attr)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "pushRuleAttrSetter failed")
+	}
+
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		return pushRulesErrorResponse(ctx, err, "queryPushRules failed")
+	}
+	ruleSet := pushRuleSetByScope(ruleSets, pushrules.Scope(scope))
+	if ruleSet == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rule set"), "pushRuleSetByScope failed")
+	}
+	rulesPtr := ruleSet.Rules(pushrules.Kind(kind))
+	if rulesPtr == nil {
+		return pushRulesErrorResponse(ctx, jsonerror.InvalidArgumentValue("invalid push rules kind"), "RuleSet.Rules failed")
+	}
+	i := pushRuleIndexByID(*rulesPtr, ruleID)
+	if i < 0 {
+		return pushRulesErrorResponse(ctx, jsonerror.NotFound("push rule ID not found"), "pushRuleIndexByID failed")
+	}
+
+	if !reflect.DeepEqual(attrGet((*rulesPtr)[i]), attrGet(&newPartialRule)) {
+		attrSet((*rulesPtr)[i], &newPartialRule)
+
+		if err := putPushRules(ctx, device.UserID, ruleSets, userAPI, syncProducer); err != nil {
+			return pushRulesErrorResponse(ctx, err, "putPushRules failed")
+		}
+	}
+
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// queryPushRules returns the user's push rules. The user API returns the
+// default push rules if the user has never stored any.
+func queryPushRules(ctx context.Context, userID string, userAPI userapi.UserInternalAPI) (*pushrules.AccountRuleSets, error) {
+	var res userapi.QueryAccountDataResponse
+	if err := userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: pushRulesAccountDataType,
+	}, &res); err != nil {
+		return nil, fmt.Errorf("userAPI.QueryAccountData: %w", err)
+	}
+	data, ok := res.GlobalAccountData[pushRulesAccountDataType]
+	if !ok {
+		return nil, fmt.Errorf("userAPI.QueryAccountData: no push rules for %s", userID)
+	}
+	var ruleSets pushrules.AccountRuleSets
+	if err := json.Unmarshal(data, &ruleSets); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	for _, kind := range pushrules.Kinds {
+		// Always return a list for each kind, even if it's empty.
+		if rules := ruleSets.Global.Rules(kind); *rules == nil {
+			*rules = []*pushrules.Rule{}
+		}
+	}
+	for profileTag := range ruleSets.Device {
+		ruleSets.RuleSet(pushrules.DeviceScope(profileTag))
+	}
+	return &ruleSets, nil
+}
+
+// putPushRules stores the user's push rules and tells the sync API that they
+// have changed.
+func putPushRules(
+	ctx context.Context, userID string, ruleSets *pushrules.AccountRuleSets,
+	userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+) error {
+	data, err := json.Marshal(ruleSets)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err = userAPI.InputAccountData(ctx, &userapi.InputAccountDataRequest{
+		UserID:      userID,
+		DataType:    pushRulesAccountDataType,
+		AccountData: data,
+	}, &userapi.InputAccountDataResponse{}); err != nil {
+		return fmt.Errorf("userAPI.InputAccountData: %w", err)
+	}
+	if err = syncProducer.SendData(userID, "", pushRulesAccountDataType); err != nil {
+		return fmt.Errorf("syncProducer.SendData: %w", err)
+	}
+	return nil
+}
+
+func pushRuleSetByScope(ruleSets *pushrules.AccountRuleSets, scope pushrules.Scope) *pushrules.RuleSet {
+	return ruleSets.RuleSet(scope)
+}
+
+func pushRuleIndexByID(rules []*pushrules.Rule, id string) int {
+	for i, rule := range rules {
+		if rule.RuleID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// findPushRuleInsertionIndex returns the index that a new rule should be
+// inserted at. Without before or after, this is as the most important
+// user-defined rule, which is after the master rule if there is one.
+func findPushRuleInsertionIndex(rules []*pushrules.Rule, afterID, beforeID string) (int, error) {
+	var i int
+
+	if afterID != "" {
+		for ; i < len(rules); i++ {
+			if rules[i].RuleID == afterID {
+				break
+			}
+		}
+		if i == len(rules) {
+			return 0, jsonerror.NotFound("after: rule ID not found")
+		}
+		if rules[i].Default {
+			return 0, jsonerror.InvalidArgumentValue("after: rule ID must not be a default rule")
+		}
+		// We stopped on the "after" match to differentiate
+		// not-found from is-last-entry. Now we move to the earliest
+		// insertion point.
+		i++
+	}
+
+	if beforeID != "" {
+		for ; i < len(rules); i++ {
+			if rules[i].RuleID == beforeID {
+				break
+			}
+		}
+		if i == len(rules) {
+			return 0, jsonerror.NotFound("before: rule ID not found")
+		}
+		if rules[i].Default {
+			return 0, jsonerror.InvalidArgumentValue("before: rule ID must not be a default rule")
+		}
+	}
+
+	if afterID == "" && beforeID == "" {
+		for i < len(rules) && rules[i].RuleID == pushrules.MRuleMaster {
+			i++
+		}
+	}
+
+	return i, nil
+}
+
+func pushRuleAttrGetter(attr string) (func(*pushrules.Rule) interface{}, error) {
+	switch attr {
+	case "actions":
+		return func(rule *pushrules.Rule) interface{} { return rule.Actions }, nil
+	case "enabled":
+		return func(rule *pushrules.Rule) interface{} { return rule.Enabled }, nil
+	default:
+		return nil, jsonerror.InvalidArgumentValue("invalid push rule attribute")
+	}
+}
+
+func pushRuleAttrSetter(attr string) (func(dest, src *pushrules.Rule), error) {
+	switch attr {
+	case "actions":
+		return func(dest, src *pushrules.Rule) { dest.Actions = src.Actions }, nil
+	case "enabled":
+		return func(dest, src *pushrules.Rule) { dest.Enabled = src.Enabled }, nil
+	default:
+		return nil, jsonerror.InvalidArgumentValue("invalid push rule attribute")
+	}
+}
+
+// isReservedPushRuleID returns whether the rule ID is in the namespace of the
+// server-default rules, which users can't create.
+func isReservedPushRuleID(ruleID string) bool {
+	return strings.HasPrefix(ruleID, ".")
+}
@@ -0,0 +1,89 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+)
+
+func TestFindPushRuleInsertionIndex(t *testing.T) {
+	rules := []*pushrules.Rule{
+		{RuleID: pushrules.MRuleMaster, Default: true},
+		{RuleID: "a"},
+		{RuleID: "b"},
+		{RuleID: ".m.rule.suppress_notices", Default: true},
+	}
+	tsts := []struct {
+		Name     string
+		After    string
+		Before   string
+		Want     int
+		WantFail bool
+	}{
+		{Name: "firstAfterMaster", Want: 1},
+		{Name: "after", After: "a", Want: 2},
+		{Name: "before", Before: "b", Want: 2},
+		{Name: "afterAndBefore", After: "a", Before: "b", Want: 2},
+		{Name: "afterNotFound", After: "c", WantFail: true},
+		{Name: "beforeNotFound", Before: "c", WantFail: true},
+		{Name: "beforeDefault", Before: ".m.rule.suppress_notices", WantFail: true},
+		{Name: "afterDefault", After: pushrules.MRuleMaster, WantFail: true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			got, err := findPushRuleInsertionIndex(rules, tst.After, tst.Before)
+			if tst.WantFail {
+				if err == nil {
+					t.Fatalf("got index %d, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("findPushRuleInsertionIndex failed: %v", err)
+			}
+			if got != tst.Want {
+				t.Errorf("got index %d, want %d", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestPushRulesScopePattern(t *testing.T) {
+	router := mux.NewRouter().UseEncodedPath()
+	router.Handle("/pushrules/"+pushRulesScopePattern+"/", http.NotFoundHandler()).Name("scope")
+	router.Handle("/pushrules/"+pushRulesScopePattern+"/{kind}/", http.NotFoundHandler()).Name("kind")
+	router.Handle("/pushrules/"+pushRulesScopePattern+"/{kind}/{ruleID}", http.NotFoundHandler()).Name("ruleID")
+	router.Handle("/pushrules/"+pushRulesScopePattern+"/{kind}/{ruleID}/{attr}", http.NotFoundHandler()).Name("attr")
+
+	tsts := []struct {
+		Path      string
+		WantRoute string
+		WantVars  map[string]string
+	}{
+		{"/pushrules/global/", "scope", map[string]string{"scope": "global"}},
+		{"/pushrules/device/phone/", "scope", map[string]string{"scope": "device/phone"}},
+		{"/pushrules/global/override/", "kind", map[string]string{"scope": "global", "kind": "override"}},
+		{"/pushrules/device/phone/override/", "kind", map[string]string{"scope": "device/phone", "kind": "override"}},
+		{"/pushrules/global/override/myrule", "ruleID", map[string]string{"scope": "global", "kind": "override", "ruleID": "myrule"}},
+		{"/pushrules/device/phone/override/myrule", "ruleID", map[string]string{"scope": "device/phone", "kind": "override", "ruleID": "myrule"}},
+		{"/pushrules/device/phone/override/myrule/enabled", "attr", map[string]string{"scope": "device/phone", "kind": "override", "ruleID": "myrule", "attr": "enabled"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Path, func(t *testing.T) {
+			var match mux.RouteMatch
+			if !router.Match(httptest.NewRequest(http.MethodGet, tst.Path, nil), &match) {
+				t.Fatalf("Match: got no route, want %q", tst.WantRoute)
+			}
+			if got := match.Route.GetName(); got != tst.WantRoute {
+				t.Errorf("Match: got route %q, want %q", got, tst.WantRoute)
+			}
+			if !reflect.DeepEqual(match.Vars, tst.WantVars) {
+				t.Errorf("Match: got vars %v, want %v", match.Vars, tst.WantVars)
+			}
+		})
+	}
+}
@@ -25,6 +25,7 @@ import (
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -39,7 +40,7 @@ type redactionResponse struct {
 
 func SendRedaction(
 	req *http.Request, device *userapi.Device, roomID, eventID string, cfg *config.ClientAPI,
-	rsAPI roomserverAPI.RoomserverInternalAPI,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
 	resErr := checkMemberInRoom(req.Context(), rsAPI, device.UserID, roomID)
 	if resErr != nil {
@@ -99,6 +100,26 @@ func SendRedaction(
 		return *resErr
 	}
 
+	// Pretend that the redactions of shadow-banned users were sent.
+	shadowBanned, err := isShadowBanned(req.Context(), accountDB, device)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("isShadowBanned failed")
+		return jsonerror.InternalServerError()
+	}
+	if shadowBanned {
+		redactionID, err := fakeEventID()
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("fakeEventID failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: 200,
+			JSON: redactionResponse{
+				EventID: redactionID,
+			},
+		}
+	}
+
 	// create the new event and set all the fields we can
 	builder := gomatrixserverlib.EventBuilder{
 		Sender:  device.UserID,
@@ -106,7 +127,7 @@ func SendRedaction(
 		Type:    gomatrixserverlib.MRoomRedaction,
 		Redacts: eventID,
 	}
-	err := builder.SetContent(r)
+	err = builder.SetContent(r)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
 		return jsonerror.InternalServerError()
@@ -17,16 +17,17 @@ package routing
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
@@ -36,6 +37,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -69,47 +71,45 @@ func init() {
 }
 
 // sessionsDict keeps track of completed auth stages for each session.
-// It shouldn't be passed by value because it contains a mutex.
 type sessionsDict struct {
-	sync.Mutex
-	sessions map[string][]authtypes.LoginType
+	store *auth.Sessions
 }
 
 // GetCompletedStages returns the completed stages for a session.
 func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginType {
-	d.Lock()
-	defer d.Unlock()
-
-	if completedStages, ok := d.sessions[sessionID]; ok {
+	// Ensure that a empty slice is returned and not nil. See #399.
+	completedStages := make([]authtypes.LoginType, 0)
+	stages, err := d.store.CompletedStages(sessionID)
+	if err != nil {
+		log.WithError(err).Error("Failed to get completed stages for registration session")
 		return completedStages
 	}
-	// Ensure that a empty slice is returned and not nil. See #399.
-	return make([]authtypes.LoginType, 0)
+	for _, stage := range stages {
+		completedStages = append(completedStages, authtypes.LoginType(stage))
+	}
+	return completedStages
 }
 
-func newSessionsDict() *sessionsDict {
+func newSessionsDict(store *auth.Sessions) *sessionsDict {
+	if store == nil {
+		store = auth.NewSessions(nil)
+	}
 	return &sessionsDict{
-		sessions: make(map[string][]authtypes.LoginType),
+		store: store,
 	}
 }
 
 // AddCompletedSessionStage records that a session has completed an auth stage.
 func AddCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
-	sessions.Lock()
-	defer sessions.Unlock()
-
-	for _, completedStage := range sessions.sessions[sessionID] {
-		if completedStage == stage {
-			return
-		}
+	if err := sessions.store.AddCompletedStage(sessionID, string(stage)); err != nil {
+		log.WithError(err).Error("Failed to add completed stage to registration session")
 	}
-	sessions.sessions[sessionID] = append(sessions.sessions[sessionID], stage)
 }
 
 var (
-	// TODO: Remove old sessions. Need to do so on a session-specific timeout.
 	// sessions stores the completed flow stages for all sessions. Referenced using their sessionID.
-	sessions           = newSessionsDict()
+	// It is replaced by Setup with one backed by JetStream, so that it is shared between instances.
+	sessions           = newSessionsDict(nil)
 	validUsernameRegex = regexp.MustCompile(`^[0-9a-z_\-=./]+$`)
 )
 
@@ -135,6 +135,9 @@ type registerRequest struct {
 	// Prevent this user from logging in
 	InhibitLogin eventutil.WeakBoolean `json:"inhibit_login"`
 
+	// Whether the client supports refresh tokens, see MSC2918
+	RefreshToken bool `json:"refresh_token"`
+
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
@@ -147,6 +150,10 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+	// Email identity
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
+	// Registration token
+	Token string `json:"token"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -172,10 +179,12 @@ func newUserInteractiveResponse(
 
 // http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#post-matrix-client-unstable-register
 type registerResponse struct {
-	UserID      string                       `json:"user_id"`
-	AccessToken string                       `json:"access_token,omitempty"`
-	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
-	DeviceID    string                       `json:"device_id,omitempty"`
+	UserID       string                       `json:"user_id"`
+	AccessToken  string                       `json:"access_token,omitempty"`
+	RefreshToken string                       `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64                        `json:"expires_in_ms,omitempty"`
+	HomeServer   gomatrixserverlib.ServerName `json:"home_server"`
+	DeviceID     string                       `json:"device_id,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -183,7 +192,44 @@ type recaptchaResponse struct {
 	Success     bool      `json:"success"`
 	ChallengeTS time.Time `json:"challenge_ts"`
 	Hostname    string    `json:"hostname"`
-	ErrorCodes  []int     `json:"error-codes"`
+	ErrorCodes  []string  `json:"error-codes"`
+}
+
+// captchaProvider describes a captcha service which is compatible with
+// reCAPTCHA, so that responses are verified in the same way.
+type captchaProvider struct {
+	// The default endpoint for verifying captcha responses
+	siteVerifyAPI string
+	// The script which renders the captcha in the fallback pages
+	scriptURL string
+	// The class of the element which the script renders the captcha into
+	widgetClass string
+	// The form field which the rendered captcha puts its response in
+	formField string
+}
+
+var captchaProviders = map[string]captchaProvider{
+	config.CaptchaProviderRecaptcha: {
+		siteVerifyAPI: "https://www.google.com/recaptcha/api/siteverify",
+		scriptURL:     "https://www.google.com/recaptcha/api.js",
+		widgetClass:   "g-recaptcha",
+		formField:     "g-recaptcha-response",
+	},
+	config.CaptchaProviderHCaptcha: {
+		siteVerifyAPI: "https://hcaptcha.com/siteverify",
+		scriptURL:     "https://js.hcaptcha.com/1/api.js",
+		widgetClass:   "h-captcha",
+		formField:     "h-captcha-response",
+	},
+}
+
+// captchaProviderFor returns the configured captcha provider, defaulting to
+// reCAPTCHA.
+func captchaProviderFor(cfg *config.ClientAPI) captchaProvider {
+	if provider, ok := captchaProviders[cfg.CaptchaProvider]; ok {
+		return provider
+	}
+	return captchaProviders[config.CaptchaProviderRecaptcha]
 }
 
 // validateUsername returns an error response if the username is invalid
@@ -261,8 +307,22 @@ func validateRecaptcha(
 		}
 	}
 
-	// Make a POST request to Google's API to check the captcha response
-	resp, err := http.PostForm(cfg.RecaptchaSiteVerifyAPI,
+	if cfg.RecaptchaBypassSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(response), []byte(cfg.RecaptchaBypassSecret)) == 1 {
+		return nil
+	}
+
+	// The captcha service wants the IP address without the port
+	if host, _, err := net.SplitHostPort(clientip); err == nil {
+		clientip = host
+	}
+
+	// Make a POST request to the captcha service to check the captcha response
+	siteVerifyAPI := cfg.RecaptchaSiteVerifyAPI
+	if siteVerifyAPI == "" {
+		siteVerifyAPI = captchaProviderFor(cfg).siteVerifyAPI
+	}
+	resp, err := http.PostForm(siteVerifyAPI,
 		url.Values{
 			"secret":   {cfg.RecaptchaPrivateKey},
 			"response": {response},
@@ -449,6 +509,8 @@ func Register(
 	userAPI userapi.UserInternalAPI,
 	accountDB accounts.Database,
 	cfg *config.ClientAPI,
+	emailValidator *threepid.EmailValidator,
+	msisdnValidator *threepid.MSISDNValidator,
 ) util.JSONResponse {
 	var r registerRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
@@ -456,6 +518,9 @@ func Register(
 		return *resErr
 	}
 	if req.URL.Query().Get("kind") == "guest" {
+		if resErr = checkMonthlyActiveUserLimit(req.Context(), userAPI, ""); resErr != nil {
+			return *resErr
+		}
 		return handleGuestRegistration(req, r, cfg, userAPI)
 	}
 
@@ -510,8 +575,13 @@ func Register(
 		if resErr = validateUsername(r.Username); resErr != nil {
 			return *resErr
 		}
+		// Users of application services can register regardless of the
+		// monthly active user limit.
+		if resErr = checkMonthlyActiveUserLimit(req.Context(), userAPI, ""); resErr != nil {
+			return *resErr
+		}
 	}
-	if resErr = validatePassword(r.Password); resErr != nil {
+	if resErr = validatePasswordPolicy(r.Password, cfg); resErr != nil {
 		return *resErr
 	}
 
@@ -522,7 +592,7 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accessToken, accessTokenErr)
+	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accountDB, emailValidator, msisdnValidator, accessToken, accessTokenErr)
 }
 
 func handleGuestRegistration(
@@ -588,6 +658,9 @@ func handleRegistrationFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+	emailValidator *threepid.EmailValidator,
+	msisdnValidator *threepid.MSISDNValidator,
 	accessToken string,
 	accessTokenErr error,
 ) util.JSONResponse {
@@ -597,8 +670,6 @@ func handleRegistrationFlow(
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
 
-	// TODO: email / msisdn auth types.
-
 	// Appservices are special and are not affected by disabled
 	// registration or user exclusivity. We'll go onto the appservice
 	// registration flow if a valid access token was provided or if
@@ -628,6 +699,9 @@ func handleRegistrationFlow(
 		}
 	}
 
+	// The 3PID which was validated by this request, if any
+	var threePID authtypes.ThreePID
+
 	switch r.Auth.Type {
 	case authtypes.LoginTypeRecaptcha:
 		// Check given captcha response
@@ -644,6 +718,63 @@ func handleRegistrationFlow(
 		// Add Dummy to the list of completed registration stages
 		AddCompletedSessionStage(sessionID, authtypes.LoginTypeDummy)
 
+	case authtypes.LoginTypeEmail:
+		if emailValidator == nil {
+			return util.JSONResponse{
+				Code: http.StatusNotImplemented,
+				JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
+			}
+		}
+		var resErr *util.JSONResponse
+		if threePID.Address, resErr = validateRegistrationEmail(req, r.Auth.ThreePIDCreds, accountDB, emailValidator); resErr != nil {
+			return *resErr
+		}
+		threePID.Medium = "email"
+
+		// Add Email to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
+	case authtypes.LoginTypeMSISDN:
+		if msisdnValidator == nil {
+			return util.JSONResponse{
+				Code: http.StatusNotImplemented,
+				JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
+			}
+		}
+		var resErr *util.JSONResponse
+		if threePID.Address, resErr = validateRegistrationMSISDN(req, r.Auth.ThreePIDCreds, accountDB, msisdnValidator); resErr != nil {
+			return *resErr
+		}
+		threePID.Medium = "msisdn"
+
+		// Add MSISDN to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeMSISDN)
+
+	case authtypes.LoginTypeRegistrationToken:
+		if !cfg.RegistrationRequiresToken {
+			return util.JSONResponse{
+				Code: http.StatusNotImplemented,
+				JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
+			}
+		}
+		if resErr := useRegistrationToken(req, sessionID, r.Auth.Token, accountDB); resErr != nil {
+			return *resErr
+		}
+
+		// Add the registration token to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRegistrationToken)
+
+	case authtypes.LoginTypeTerms:
+		if !cfg.Consent.Enabled || !cfg.Consent.RequireAtRegistration {
+			return util.JSONResponse{
+				Code: http.StatusNotImplemented,
+				JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
+			}
+		}
+
+		// Add the terms to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeTerms)
+
 	case "":
 		// An empty auth type means that we want to fetch the available
 		// flows. It can also mean that we want to register as an appservice
@@ -658,8 +789,144 @@ func handleRegistrationFlow(
 	// Check if the user's registration flow has been completed successfully
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
-	return checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
+	res := checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
 		req, r, sessionID, cfg, userAPI)
+
+	// Every flow ends with agreeing to the privacy policy when it is
+	// required, so the new user has agreed to the current version.
+	if res.Code == http.StatusOK && cfg.Consent.Enabled && cfg.Consent.RequireAtRegistration {
+		if err := accountDB.SetConsentVersion(req.Context(), r.Username, cfg.Consent.Version); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetConsentVersion failed")
+		}
+	}
+
+	// Add the validated 3PID to the new account. This is only possible if
+	// the 3PID stage is the one which completed the flow.
+	if res.Code == http.StatusOK && threePID.Address != "" {
+		if err := accountDB.SaveThreePIDAssociation(req.Context(), threePID.Address, r.Username, threePID.Medium); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveThreePIDAssociation failed")
+		}
+		var err error
+		if threePID.Medium == "msisdn" {
+			err = msisdnValidator.Forget(r.Auth.ThreePIDCreds.SID, r.Auth.ThreePIDCreds.Secret)
+		} else {
+			err = emailValidator.Forget(r.Auth.ThreePIDCreds.SID)
+		}
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Warn("failed to forget the 3PID validation session")
+		}
+	}
+	return res
+}
+
+// useRegistrationToken counts the registration against the token, or returns
+// an error response if the token can't be used. The use is counted when the
+// stage is completed rather than when the account is created, so that people
+// can't register more accounts than the token allows by completing the stage
+// in several sessions at once, at the cost of counting registrations which
+// are abandoned afterwards.
+func useRegistrationToken(
+	req *http.Request, sessionID, token string, accountDB accounts.Database,
+) *util.JSONResponse {
+	for _, stage := range sessions.GetCompletedStages(sessionID) {
+		if stage == authtypes.LoginTypeRegistrationToken {
+			// The token has already been counted for this session.
+			return nil
+		}
+	}
+	used, err := accountDB.UseRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.UseRegistrationToken failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if !used {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_UNAUTHORIZED",
+				Err:     "The registration token is invalid",
+			},
+		}
+	}
+	return nil
+}
+
+// validateRegistrationEmail returns the email address of the validation
+// session, or an error response if it hasn't been validated or the email
+// address already belongs to an account.
+func validateRegistrationEmail(
+	req *http.Request, creds threepid.Credentials, accountDB accounts.Database, emailValidator *threepid.EmailValidator,
+) (string, *util.JSONResponse) {
+	address, err := emailValidator.ValidatedAddress(creds.SID, creds.Secret)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("emailValidator.ValidatedAddress failed")
+		res := jsonerror.InternalServerError()
+		return "", &res
+	}
+	if address == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "The email address has not been validated",
+			},
+		}
+	}
+	if resErr := checkRegistration3PIDNotInUse(req, accountDB, address, "email"); resErr != nil {
+		return "", resErr
+	}
+	return address, nil
+}
+
+// validateRegistrationMSISDN returns the phone number of the validation
+// session, or an error response if the identity server hasn't validated it or
+// the phone number already belongs to an account.
+func validateRegistrationMSISDN(
+	req *http.Request, creds threepid.Credentials, accountDB accounts.Database, msisdnValidator *threepid.MSISDNValidator,
+) (string, *util.JSONResponse) {
+	msisdn, err := msisdnValidator.ValidatedMSISDN(req.Context(), creds.SID, creds.Secret)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("msisdnValidator.ValidatedMSISDN failed")
+		res := jsonerror.InternalServerError()
+		return "", &res
+	}
+	if msisdn == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "The phone number has not been validated",
+			},
+		}
+	}
+	if resErr := checkRegistration3PIDNotInUse(req, accountDB, msisdn, "msisdn"); resErr != nil {
+		return "", resErr
+	}
+	return msisdn, nil
+}
+
+// checkRegistration3PIDNotInUse returns an error response if the 3PID already
+// belongs to an account.
+func checkRegistration3PIDNotInUse(
+	req *http.Request, accountDB accounts.Database, address, medium string,
+) *util.JSONResponse {
+	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), address, medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if localpart != "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     accounts.Err3PIDInUse.Error(),
+			},
+		}
+	}
+	return nil
 }
 
 // handleApplicationServiceRegistration handles the registration of an
@@ -701,7 +968,7 @@ func handleApplicationServiceRegistration(
 	// application service registration is entirely separate.
 	return completeRegistration(
 		req.Context(), userAPI, r.Username, "", appserviceID, req.RemoteAddr, req.UserAgent(),
-		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		r.InhibitLogin, r.RefreshToken, r.InitialDisplayName, r.DeviceID,
 	)
 }
 
@@ -720,7 +987,7 @@ func checkAndCompleteFlow(
 		// This flow was completed, registration can continue
 		return completeRegistration(
 			req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(),
-			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			r.InhibitLogin, r.RefreshToken, r.InitialDisplayName, r.DeviceID,
 		)
 	}
 
@@ -743,7 +1010,7 @@ func completeRegistration(
 	ctx context.Context,
 	userAPI userapi.UserInternalAPI,
 	username, password, appserviceID, ipAddr, userAgent string,
-	inhibitLogin eventutil.WeakBoolean,
+	inhibitLogin eventutil.WeakBoolean, refreshable bool,
 	displayName, deviceID *string,
 ) util.JSONResponse {
 	if username == "" {
@@ -812,6 +1079,7 @@ func completeRegistration(
 		DeviceID:          deviceID,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		Refreshable:       refreshable,
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -823,10 +1091,12 @@ func completeRegistration(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
-			UserID:      devRes.Device.UserID,
-			AccessToken: devRes.Device.AccessToken,
-			HomeServer:  accRes.Account.ServerName,
-			DeviceID:    devRes.Device.ID,
+			UserID:       devRes.Device.UserID,
+			AccessToken:  devRes.Device.AccessToken,
+			RefreshToken: devRes.RefreshToken,
+			ExpiresInMS:  expiresInMS(devRes.Device),
+			HomeServer:   accRes.Account.ServerName,
+			DeviceID:     devRes.Device.ID,
 		},
 	}
 }
@@ -894,6 +1164,12 @@ func RegisterAvailable(
 	accountDB accounts.Database,
 ) util.JSONResponse {
 	username := req.URL.Query().Get("username")
+	if username == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("The 'username' parameter is required."),
+		}
+	}
 
 	// Squash username to all lowercase letters
 	username = strings.ToLower(username)
@@ -903,22 +1179,17 @@ func RegisterAvailable(
 	}
 
 	// Check if this username is reserved by an application service
-	userID := userutil.MakeUserID(username, cfg.Matrix.ServerName)
-	for _, appservice := range cfg.Derived.ApplicationServices {
-		if appservice.OwnsNamespaceCoveringUserId(userID) {
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.UserInUse("Desired user ID is reserved by an application service."),
-			}
+	if UsernameMatchesExclusiveNamespaces(cfg, username) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.ASExclusive("Desired user ID is reserved by an application service."),
 		}
 	}
 
 	availability, availabilityErr := accountDB.CheckAccountAvailability(req.Context(), username)
 	if availabilityErr != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: jsonerror.Unknown("failed to check availability: " + availabilityErr.Error()),
-		}
+		util.GetLogger(req.Context()).WithError(availabilityErr).Error("accountDB.CheckAccountAvailability failed")
+		return jsonerror.InternalServerError()
 	}
 	if !availability {
 		return util.JSONResponse{
@@ -935,6 +1206,44 @@ func RegisterAvailable(
 	}
 }
 
+type registrationTokenValidityResponse struct {
+	Valid bool `json:"valid"`
+}
+
+// RegistrationTokenValidity implements GET /register/m.login.registration_token/validity,
+// which lets clients check a registration token before asking for the rest of
+// the user's details. It doesn't count as a use of the token.
+func RegistrationTokenValidity(
+	req *http.Request,
+	cfg *config.ClientAPI,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	if cfg.RegistrationDisabled || !cfg.RegistrationRequiresToken {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration tokens are not in use"),
+		}
+	}
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("The 'token' parameter is required."),
+		}
+	}
+	t, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: registrationTokenValidityResponse{
+			Valid: t != nil && t.Valid(gomatrixserverlib.AsTimestamp(time.Now())),
+		},
+	}
+}
+
 func handleSharedSecretRegistration(userAPI userapi.UserInternalAPI, sr *SharedSecretRegistration, req *http.Request) util.JSONResponse {
 	ssrr, err := NewSharedSecretRegistrationRequest(req.Body)
 	if err != nil {
@@ -963,5 +1272,5 @@ func handleSharedSecretRegistration(userAPI userapi.UserInternalAPI, sr *SharedS
 		return *resErr
 	}
 	deviceID := "shared_secret_registration"
-	return completeRegistration(req.Context(), userAPI, ssrr.User, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), false, &ssrr.User, &deviceID)
+	return completeRegistration(req.Context(), userAPI, ssrr.User, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), false, false, &ssrr.User, &deviceID)
 }
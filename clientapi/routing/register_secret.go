@@ -14,7 +14,9 @@ import (
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
 	cache "github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
 )
 
 type SharedSecretRegistrationRequest struct {
@@ -40,23 +42,42 @@ func NewSharedSecretRegistrationRequest(reader io.ReadCloser) (*SharedSecretRegi
 type SharedSecretRegistration struct {
 	sharedSecret string
 	nonces       *cache.Cache
+	// sharedNonces, if set, is used instead of nonces so that a nonce from
+	// one client API instance can be used with any other.
+	sharedNonces nats.KeyValue
 }
 
-func NewSharedSecretRegistration(sharedSecret string) *SharedSecretRegistration {
+// NewSharedSecretRegistration returns a SharedSecretRegistration. If the
+// nonces key-value bucket is nil then nonces are kept in memory instead.
+func NewSharedSecretRegistration(sharedSecret string, nonces nats.KeyValue) *SharedSecretRegistration {
 	return &SharedSecretRegistration{
 		sharedSecret: sharedSecret,
 		// nonces live for 5mins, purge every 10mins
-		nonces: cache.New(5*time.Minute, 10*time.Minute),
+		nonces:       cache.New(5*time.Minute, 10*time.Minute),
+		sharedNonces: nonces,
 	}
 }
 
 func (r *SharedSecretRegistration) GenerateNonce() string {
 	nonce := util.RandomString(16)
+	if r.sharedNonces != nil {
+		// The bucket expires nonces after 5mins.
+		if _, err := r.sharedNonces.Put(nonce, []byte{1}); err != nil {
+			logrus.WithError(err).Error("Failed to store shared secret registration nonce")
+		}
+		return nonce
+	}
 	r.nonces.Set(nonce, true, cache.DefaultExpiration)
 	return nonce
 }
 
 func (r *SharedSecretRegistration) validNonce(nonce string) bool {
+	if r.sharedNonces != nil {
+		// Nonces are alphanumeric, so anything else is invalid as a key and
+		// can't have come from us.
+		_, err := r.sharedNonces.Get(nonce)
+		return err == nil
+	}
 	_, exists := r.nonces.Get(nonce)
 	return exists
 }
@@ -18,7 +18,7 @@ func TestSharedSecretRegister(t *testing.T) {
 		t.Fatalf("failed to read request: %s", err)
 	}
 
-	r := NewSharedSecretRegistration(sharedSecret)
+	r := NewSharedSecretRegistration(sharedSecret, nil)
 
 	// force the nonce to be known
 	r.nonces.Set(req.Nonce, true, cache.DefaultExpiration)
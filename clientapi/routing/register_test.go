@@ -15,10 +15,15 @@
 package routing
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"regexp"
 	"testing"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
 )
 
@@ -138,7 +143,7 @@ func TestFlowCheckingExtraneousIncorrectInput(t *testing.T) {
 // Completed flows stages should always be a valid slice header.
 // TestEmptyCompletedFlows checks that sessionsDict returns a slice & not nil.
 func TestEmptyCompletedFlows(t *testing.T) {
-	fakeEmptySessions := newSessionsDict()
+	fakeEmptySessions := newSessionsDict(nil)
 	fakeSessionID := "aRandomSessionIDWhichDoesNotExist"
 	ret := fakeEmptySessions.GetCompletedStages(fakeSessionID)
 
@@ -208,3 +213,92 @@ func TestValidationOfApplicationServices(t *testing.T) {
 		t.Errorf("user_id should not have been valid: @_something_else:localhost")
 	}
 }
+
+// This method tests that usernames which can't be registered are rejected by
+// /register/available without needing to look up the account.
+func TestRegisterAvailableRejectsUnavailableUsernames(t *testing.T) {
+	fakeConfig := &config.Dendrite{}
+	fakeConfig.Defaults(true)
+	fakeConfig.Global.ServerName = "localhost"
+	fakeConfig.ClientAPI.Derived.ExclusiveApplicationServicesUsernameRegexp = regexp.MustCompile("@bridge_.*")
+
+	testCases := []struct {
+		username string
+		wantCode string
+	}{
+		{"", "M_MISSING_PARAM"},
+		{"not valid!", "M_INVALID_USERNAME"},
+		{"_underscore", "M_INVALID_USERNAME"},
+		{"bridge_alice", "M_EXCLUSIVE"},
+		{"Bridge_Alice", "M_EXCLUSIVE"},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/register/available?username="+url.QueryEscape(tc.username), nil)
+		res := RegisterAvailable(req, &fakeConfig.ClientAPI, nil)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("username %q: got status %d, want %d", tc.username, res.Code, http.StatusBadRequest)
+			continue
+		}
+		if err, ok := res.JSON.(*jsonerror.MatrixError); !ok || err.ErrCode != tc.wantCode {
+			t.Errorf("username %q: got error %+v, want %s", tc.username, res.JSON, tc.wantCode)
+		}
+	}
+}
+
+// This method tests that captcha responses are checked with the captcha
+// service, unless they are the bypass secret.
+func TestValidateRecaptcha(t *testing.T) {
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("req.ParseForm failed: %s", err)
+		}
+		forms = append(forms, req.PostForm)
+		if req.PostForm.Get("response") == "good" {
+			_, _ = w.Write([]byte(`{"success": true}`))
+		} else {
+			_, _ = w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		}
+	}))
+	defer server.Close()
+	cfg := &config.ClientAPI{
+		RecaptchaEnabled:       true,
+		CaptchaProvider:        config.CaptchaProviderHCaptcha,
+		RecaptchaPrivateKey:    "secretkey",
+		RecaptchaBypassSecret:  "bypass",
+		RecaptchaSiteVerifyAPI: server.URL,
+	}
+
+	testCases := []struct {
+		response string
+		wantCode int
+	}{
+		{"good", 0},
+		{"bad", http.StatusUnauthorized},
+		{"", http.StatusBadRequest},
+		{"bypass", 0},
+	}
+	for _, tc := range testCases {
+		res := validateRecaptcha(cfg, tc.response, "10.0.0.1:1234")
+		if res == nil && tc.wantCode != 0 {
+			t.Errorf("response %q: got success, want status %d", tc.response, tc.wantCode)
+		} else if res != nil && res.Code != tc.wantCode {
+			t.Errorf("response %q: got status %d (%+v), want %d", tc.response, res.Code, res.JSON, tc.wantCode)
+		}
+	}
+	// Only the responses which aren't empty or the bypass secret are checked.
+	if len(forms) != 2 {
+		t.Fatalf("got %d requests to the captcha service, want 2", len(forms))
+	}
+	want := url.Values{"secret": {"secretkey"}, "response": {"good"}, "remoteip": {"10.0.0.1"}}
+	if !reflect.DeepEqual(forms[0], want) {
+		t.Errorf("got form %v, want %v", forms[0], want)
+	}
+
+	if provider := captchaProviderFor(cfg); provider.formField != "h-captcha-response" {
+		t.Errorf("got form field %q, want h-captcha-response", provider.formField)
+	}
+	if provider := captchaProviderFor(&config.ClientAPI{}); provider.formField != "g-recaptcha-response" {
+		t.Errorf("got form field %q for the default provider, want g-recaptcha-response", provider.formField)
+	}
+}
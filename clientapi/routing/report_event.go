@@ -0,0 +1,98 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type reportEventRequest struct {
+	Reason string `json:"reason"`
+	Score  *int64 `json:"score"`
+}
+
+// ReportEvent implements POST /rooms/{roomId}/report/{eventId}
+func ReportEvent(
+	req *http.Request, device *userapi.Device,
+	roomID, eventID string, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var r reportEventRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Score != nil && (*r.Score < -100 || *r.Score > 0) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("score must be between -100 and 0"),
+		}
+	}
+
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithField("roomID", roomID).WithField("eventID", eventID)
+
+	// Only let users report events from rooms that they have been in, and
+	// don't reveal whether the event exists otherwise.
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("The event was not found or you are not in the room"),
+	}
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	err := rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes)
+	if err != nil {
+		logger.WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.HasBeenInRoom {
+		return notFound
+	}
+	var eventsRes roomserverAPI.QueryEventsByIDResponse
+	err = rsAPI.QueryEventsByID(ctx, &roomserverAPI.QueryEventsByIDRequest{
+		EventIDs: []string{eventID},
+	}, &eventsRes)
+	if err != nil {
+		logger.WithError(err).Error("rsAPI.QueryEventsByID failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(eventsRes.Events) != 1 || eventsRes.Events[0].RoomID() != roomID {
+		return notFound
+	}
+
+	var reportRes roomserverAPI.PerformReportEventResponse
+	err = rsAPI.PerformReportEvent(ctx, &roomserverAPI.PerformReportEventRequest{
+		RoomID:     roomID,
+		EventID:    eventID,
+		ReporterID: device.UserID,
+		Reason:     r.Reason,
+		Score:      r.Score,
+	}, &reportRes)
+	if err != nil {
+		logger.WithError(err).Error("rsAPI.PerformReportEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	logger.WithField("reportID", reportRes.ReportID).WithField("userID", device.UserID).Info("Event reported")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -15,7 +15,6 @@
 package routing
 
 import (
-	"encoding/json"
 	"net/http"
 	"strings"
 
@@ -23,9 +22,11 @@ import (
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
 	clientutil "github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
@@ -37,6 +38,7 @@ import (
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 )
 
@@ -47,7 +49,7 @@ import (
 // applied:
 // nolint: gocyclo
 func Setup(
-	publicAPIMux, synapseAdminRouter *mux.Router, cfg *config.ClientAPI,
+	publicAPIMux, wkMux, synapseAdminRouter, dendriteAdminRouter, staticRouter *mux.Router, cfg *config.ClientAPI,
 	eduAPI eduServerAPI.EDUServerInputAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
@@ -60,17 +62,36 @@ func Setup(
 	keyAPI keyserverAPI.KeyInternalAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 	mscCfg *config.MSCs,
+	rateLimits *httputil.RateLimits,
+	rateLimitsProducer *producers.RateLimitsProducer,
+	uiaSessions *auth.Sessions,
+	nonces nats.KeyValue,
+	validationSessions *threepid.ValidationSessions,
+	loginTokens *auth.LoginTokens,
 ) {
-	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting)
-	userInteractiveAuth := auth.NewUserInteractive(accountDB.GetAccountByPassword, cfg)
-
-	unstableFeatures := map[string]bool{
-		"org.matrix.e2e_cross_signing": true,
+	// Passwords are checked with the password providers before the account
+	// database, wherever users log in with them.
+	getAccountByPassword := auth.WithPasswordProviders(auth.NewPasswordProviders(cfg), accountDB)
+	userInteractiveAuth := auth.NewUserInteractive(getAccountByPassword, userAPI, cfg, uiaSessions)
+	sessions = newSessionsDict(uiaSessions)
+
+	var emailValidator *threepid.EmailValidator
+	if cfg.Email.Enabled {
+		var err error
+		emailValidator, err = threepid.NewEmailValidator(cfg, validationSessions)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to set up email validation")
+		}
 	}
-	for _, msc := range cfg.MSCs.MSCs {
-		unstableFeatures["org.matrix."+msc] = true
+	var msisdnValidator *threepid.MSISDNValidator
+	if cfg.MSISDN.Enabled {
+		msisdnValidator = threepid.NewMSISDNValidator(cfg, validationSessions)
 	}
 
+	unstableFeatures := cfg.MSCs.AdvertisedUnstableFeatures(map[string]bool{
+		"org.matrix.e2e_cross_signing": true,
+	})
+
 	publicAPIMux.Handle("/versions",
 		httputil.MakeExternalAPI("versions", func(req *http.Request) util.JSONResponse {
 			return util.JSONResponse{
@@ -91,9 +112,23 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	if cfg.Matrix.WellKnownServerName != "" {
+		logrus.Infof("Setting m.server as %s at /.well-known/matrix/server", cfg.Matrix.WellKnownServerName)
+		wkMux.Handle("/server", httputil.MakeExternalAPI("wellknown_server", func(req *http.Request) util.JSONResponse {
+			return WellKnownServer(cfg.Matrix)
+		})).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	if cfg.Matrix.WellKnownClientName != "" {
+		logrus.Infof("Setting m.homeserver as %s at /.well-known/matrix/client", cfg.Matrix.WellKnownClientName)
+		wkMux.Handle("/client", httputil.MakeExternalAPI("wellknown_client", func(req *http.Request) util.JSONResponse {
+			return WellKnownClient(cfg.Matrix)
+		})).Methods(http.MethodGet, http.MethodOptions)
+	}
+
 	if cfg.RegistrationSharedSecret != "" {
 		logrus.Info("Enabling shared secret registration at /_synapse/admin/v1/register")
-		sr := NewSharedSecretRegistration(cfg.RegistrationSharedSecret)
+		sr := NewSharedSecretRegistration(cfg.RegistrationSharedSecret, nonces)
 		synapseAdminRouter.Handle("/admin/v1/register",
 			httputil.MakeExternalAPI("shared_secret_registration", func(req *http.Request) util.JSONResponse {
 				if req.Method == http.MethodGet {
@@ -117,7 +152,183 @@ func Setup(
 		).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 	}
 
+	dendriteAdminRouter.Handle("/admin/v1/server_version",
+		httputil.MakeAdminAPI("admin_server_version", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			return AdminServerVersion()
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/ratelimits",
+		httputil.MakeAdminAPI("admin_ratelimits", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			if req.Method == http.MethodPut {
+				return AdminSetRateLimits(req, rateLimits, rateLimitsProducer)
+			}
+			return AdminGetRateLimits(rateLimits)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/users",
+		httputil.MakeAdminAPI("admin_create_user", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			return AdminCreateUser(req, cfg, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/users/{userID}/deactivate",
+		httputil.MakeAdminAPI("admin_deactivate_user", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminDeactivateUser(req, cfg, userAPI, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/users/{userID}/password",
+		httputil.MakeAdminAPI("admin_reset_password", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminResetPassword(req, cfg, userAPI, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/users/{userID}/shadow_ban",
+		httputil.MakeAdminAPI("admin_shadow_ban", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			switch req.Method {
+			case http.MethodPost:
+				return AdminSetShadowBan(req, cfg, accountDB, vars["userID"], true)
+			case http.MethodDelete:
+				return AdminSetShadowBan(req, cfg, accountDB, vars["userID"], false)
+			}
+			return AdminGetShadowBan(req, cfg, accountDB, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/users/{userID}/lock",
+		httputil.MakeAdminAPI("admin_account_lock", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			switch req.Method {
+			case http.MethodPost:
+				return AdminSetAccountLock(req, cfg, accountDB, vars["userID"], true)
+			case http.MethodDelete:
+				return AdminSetAccountLock(req, cfg, accountDB, vars["userID"], false)
+			}
+			return AdminGetAccountLock(req, cfg, accountDB, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/users/{userID}/renew",
+		httputil.MakeAdminAPI("admin_renew_account", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminRenewAccount(req, cfg, accountDB, userAPI, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/monthly_active_users",
+		httputil.MakeAdminAPI("admin_monthly_active_users", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			return AdminGetMonthlyActiveUsers(req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/registration_tokens",
+		httputil.MakeAdminAPI("admin_registration_tokens", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			return AdminGetRegistrationTokens(req, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/registration_tokens/new",
+		httputil.MakeAdminAPI("admin_create_registration_token", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			return AdminCreateRegistrationToken(req, accountDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/registration_tokens/{token}",
+		httputil.MakeAdminAPI("admin_registration_token", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			if req.Method == http.MethodDelete {
+				return AdminDeleteRegistrationToken(req, accountDB, vars["token"])
+			}
+			return AdminGetRegistrationToken(req, accountDB, vars["token"])
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/federation/queues",
+		httputil.MakeAdminAPI("admin_federation_queues", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			return AdminFederationQueues(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/device_lists/{userID}/resync",
+		httputil.MakeAdminAPI("admin_resync_device_list", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminResyncDeviceList(req, cfg, keyAPI, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/pushers",
+		httputil.MakeAdminAPI("admin_pushers", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			if req.Method == http.MethodDelete {
+				return AdminDeletePushers(req, cfg, userAPI)
+			}
+			return AdminGetPushers(req, cfg, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/event_reports",
+		httputil.MakeAdminAPI("admin_event_reports", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			return AdminGetEventReports(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/event_reports/{reportID}",
+		httputil.MakeAdminAPI("admin_event_report", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminGetEventReport(req, rsAPI, vars["reportID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/event_reports/{reportID}/resolve",
+		httputil.MakeAdminAPI("admin_resolve_event_report", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminResolveEventReport(req, rsAPI, vars["reportID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/rooms/{roomID}/purge",
+		httputil.MakeAdminAPI("admin_purge_room", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminPurgeRoom(req, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
+	v1mux := publicAPIMux.PathPrefix("/v1").Subrouter()
 	unstableMux := publicAPIMux.PathPrefix("/unstable").Subrouter()
 
 	r0mux.Handle("/createRoom",
@@ -127,7 +338,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/join/{roomIDOrAlias}",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -143,7 +354,7 @@ func Setup(
 	if mscCfg.Enabled("msc2753") {
 		r0mux.Handle("/peek/{roomIDOrAlias}",
 			httputil.MakeAuthAPI(gomatrixserverlib.Peek, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-				if r := rateLimits.Limit(req); r != nil {
+				if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
 					return *r
 				}
 				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -156,6 +367,23 @@ func Setup(
 			}),
 		).Methods(http.MethodPost, http.MethodOptions)
 	}
+	if mscCfg.Enabled("msc2697") {
+		unstableMux.Handle("/org.matrix.msc2697.v2/dehydrated_device",
+			httputil.MakeAuthAPI("get_dehydrated_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return GetDehydratedDevice(req, userAPI, device)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		unstableMux.Handle("/org.matrix.msc2697.v2/dehydrated_device",
+			httputil.MakeAuthAPI("put_dehydrated_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return PutDehydratedDevice(req, userAPI, device)
+			}),
+		).Methods(http.MethodPut)
+		unstableMux.Handle("/org.matrix.msc2697.v2/dehydrated_device/claim",
+			httputil.MakeAuthAPI("claim_dehydrated_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return ClaimDehydratedDevice(req, userAPI, device)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
 	r0mux.Handle("/joined_rooms",
 		httputil.MakeAuthAPI("joined_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetJoinedRooms(req, device, rsAPI)
@@ -163,7 +391,7 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/join",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -177,7 +405,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/leave",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -211,7 +439,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/invite",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -241,22 +469,28 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, accountDB, rsAPI, nil)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
-				nil, cfg, rsAPI, transactionsCache)
+				nil, cfg, accountDB, rsAPI, transactionsCache)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/event/{eventID}",
@@ -277,13 +511,16 @@ func Setup(
 		return OnIncomingStateRequest(req.Context(), device, rsAPI, vars["roomID"])
 	})).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/aliases", httputil.MakeAuthAPI("aliases", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+	getAliases := httputil.MakeAuthAPI("aliases", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
 		return GetAliases(req, rsAPI, device, vars["roomID"])
-	})).Methods(http.MethodGet, http.MethodOptions)
+	})
+	r0mux.Handle("/rooms/{roomID}/aliases", getAliases).Methods(http.MethodGet, http.MethodOptions)
+	// Some clients still use the unstable path from MSC2432.
+	unstableMux.Handle("/org.matrix.msc2432/rooms/{roomID}/aliases", getAliases).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state/{type:[^/]+/?}", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -307,41 +544,56 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			emptyString := ""
 			eventType := strings.TrimSuffix(vars["eventType"], "/")
-			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, accountDB, rsAPI, nil)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType}/{stateKey}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			stateKey := vars["stateKey"]
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, accountDB, rsAPI, nil)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.Limit(req); r != nil {
+		if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
 			return *r
 		}
-		return Register(req, userAPI, accountDB, cfg)
+		return Register(req, userAPI, accountDB, cfg, emailValidator, msisdnValidator)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/register/available", httputil.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.Limit(req); r != nil {
+		if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
 			return *r
 		}
 		return RegisterAvailable(req, cfg, accountDB)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	registrationTokenValidity := httputil.MakeExternalAPI("registration_token_validity", func(req *http.Request) util.JSONResponse {
+		if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+			return *r
+		}
+		return RegistrationTokenValidity(req, cfg, accountDB)
+	})
+	v1mux.Handle("/register/m.login.registration_token/validity", registrationTokenValidity).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/org.matrix.msc3231/register/org.matrix.msc3231.login.registration_token/validity", registrationTokenValidity).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/directory/room/{roomAlias}",
 		httputil.MakeExternalAPI("directory_room", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -370,7 +622,7 @@ func Setup(
 			}
 			return RemoveLocalAlias(req, device, vars["roomAlias"], rsAPI)
 		}),
-	).Methods(http.MethodDelete, http.MethodOptions)
+	).Methods(http.MethodDelete)
 	r0mux.Handle("/directory/list/room/{roomID}",
 		httputil.MakeExternalAPI("directory_list", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -387,7 +639,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SetVisibility(req, rsAPI, device, vars["roomID"])
+			return SetVisibility(req, rsAPI, userAPI, device, vars["roomID"])
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/publicRooms",
@@ -397,20 +649,20 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/logout",
-		httputil.MakeAuthAPI("logout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeLockedAuthAPI("logout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return Logout(req, userAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/logout/all",
-		httputil.MakeAuthAPI("logout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeLockedAuthAPI("logout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return LogoutAll(req, userAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/typing/{userID}",
 		httputil.MakeAuthAPI("rooms_typing", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -422,20 +674,26 @@ func Setup(
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/redact/{eventID}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendRedaction(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI)
+			return SendRedaction(req, device, vars["roomID"], vars["eventID"], cfg, accountDB, rsAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/redact/{eventID}/{txnId}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendRedaction(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI)
+			return SendRedaction(req, device, vars["roomID"], vars["eventID"], cfg, accountDB, rsAPI)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -466,28 +724,44 @@ func Setup(
 
 	r0mux.Handle("/account/whoami",
 		httputil.MakeAuthAPI("whoami", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
 				return *r
 			}
 			return Whoami(req, device)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	if emailValidator != nil {
+		// Users who aren't logged in can reset their password by validating
+		// the email address of their account.
+		r0mux.Handle("/account/password",
+			httputil.MakeExternalAPI("password_reset", func(req *http.Request) util.JSONResponse {
+				if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+					return *r
+				}
+				return ResetPassword(req, userAPI, accountDB, cfg, emailValidator)
+			}),
+		).Methods(http.MethodPost).MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			_, err := auth.ExtractAccessToken(req)
+			return err != nil
+		})
+	}
+
 	r0mux.Handle("/account/password",
 		httputil.MakeAuthAPI("password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupLogin); r != nil {
 				return *r
 			}
-			return Password(req, userAPI, accountDB, device, cfg)
+			return Password(withClientIP(req, rateLimits), userInteractiveAuth, userAPI, device, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/account/deactivate",
 		httputil.MakeAuthAPI("deactivate", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupLogin); r != nil {
 				return *r
 			}
-			return Deactivate(req, userInteractiveAuth, userAPI, device)
+			return Deactivate(withClientIP(req, rateLimits), userInteractiveAuth, userAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -495,39 +769,207 @@ func Setup(
 
 	r0mux.Handle("/login",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
 				return *r
 			}
-			return Login(req, accountDB, userAPI, cfg)
+			return Login(withClientIP(req, rateLimits), accountDB, getAccountByPassword, userAPI, cfg, loginTokens)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	refresh := httputil.MakeExternalAPI("refresh", func(req *http.Request) util.JSONResponse {
+		if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+			return *r
+		}
+		return Refresh(req, userAPI)
+	})
+	r0mux.Handle("/refresh", refresh).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/org.matrix.msc2918.refresh_token/refresh", refresh).Methods(http.MethodPost, http.MethodOptions)
+
+	if cfg.SSO.Enabled {
+		ssoAuthenticator, err := sso.NewAuthenticator(&cfg.SSO)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to set up single sign-on")
+		}
+		ssoRedirect := httputil.MakeHTMLAPI("login_sso_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+				return r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				res := util.ErrorResponse(err)
+				return &res
+			}
+			return SSORedirect(w, req, vars["idpID"], cfg, ssoAuthenticator)
+		})
+		r0mux.Handle("/login/sso/redirect", ssoRedirect).Methods(http.MethodGet)
+		r0mux.Handle("/login/sso/redirect/{idpID}", ssoRedirect).Methods(http.MethodGet)
+		r0mux.Handle("/login/cas/redirect",
+			httputil.MakeHTMLAPI("login_cas_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+					return r
+				}
+				return CASRedirect(w, req, cfg, ssoAuthenticator)
+			}),
+		).Methods(http.MethodGet)
+		r0mux.Handle("/login/sso/callback",
+			httputil.MakeHTMLAPI("login_sso_callback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+					return r
+				}
+				return SSOCallback(w, req, cfg, accountDB, userAPI, ssoAuthenticator, loginTokens)
+			}),
+		).Methods(http.MethodGet, http.MethodPost)
+		r0mux.Handle("/login/sso/saml/metadata/{idpID}",
+			httputil.MakeHTMLAPI("login_sso_saml_metadata", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					res := util.ErrorResponse(err)
+					return &res
+				}
+				return SSOSAMLMetadata(w, req, vars["idpID"], cfg, ssoAuthenticator)
+			}),
+		).Methods(http.MethodGet)
+	}
+
 	r0mux.Handle("/auth/{authType}/fallback/web",
 		httputil.MakeHTMLAPI("auth_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
 			vars := mux.Vars(req)
-			return AuthFallback(w, req, vars["authType"], cfg)
+			return AuthFallback(w, req, vars["authType"], cfg, accountDB)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
-	r0mux.Handle("/pushrules/",
-		httputil.MakeExternalAPI("push_rules", func(req *http.Request) util.JSONResponse {
-			// TODO: Implement push rules API
-			res := json.RawMessage(`{
-					"global": {
-						"content": [],
-						"override": [],
-						"room": [],
-						"sender": [],
-						"underride": []
-					}
-				}`)
+	if cfg.Consent.Enabled {
+		unstableMux.Handle("/consent",
+			httputil.MakeHTMLAPI("consent", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				return Consent(w, req, cfg, accountDB)
+			}),
+		).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	}
+
+	// The links in account renewal emails point here.
+	unstableMux.Handle("/account_validity/renew",
+		httputil.MakeHTMLAPI("account_validity_renew", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			return RenewAccount(w, req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	loginFallback := httputil.MakeHTMLAPI("login_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+		return LoginFallback(w, req, cfg)
+	})
+	staticRouter.Handle("/client/login", loginFallback).Methods(http.MethodGet)
+	staticRouter.Handle("/client/login/", loginFallback).Methods(http.MethodGet)
+	registerFallback := httputil.MakeHTMLAPI("register_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+		return RegisterFallback(w, req, cfg)
+	})
+	staticRouter.Handle("/client/register", registerFallback).Methods(http.MethodGet)
+	staticRouter.Handle("/client/register/", registerFallback).Methods(http.MethodGet)
+
+	r0mux.Handle("/notifications",
+		httputil.MakeAuthAPI("get_notifications", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetNotifications(req, device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	// Push rules. The scope is either "global" or "device/<profile_tag>".
+
+	r0mux.Handle("/pushrules",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: &res,
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("missing trailing slash"),
 			}
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/pushrules/",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetAllPushRules(req.Context(), device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/"+pushRulesScopePattern+"/",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRulesByScope(req.Context(), vars["scope"], device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/"+pushRulesScopePattern+"/{kind}/",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRulesByKind(req.Context(), vars["scope"], vars["kind"], device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/"+pushRulesScopePattern+"/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/"+pushRulesScopePattern+"/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			query := req.URL.Query()
+			return PutPushRuleByRuleID(req, vars["scope"], vars["kind"], vars["ruleID"], query.Get("after"), query.Get("before"), device, userAPI, syncProducer)
+		}),
+	).Methods(http.MethodPut)
+
+	r0mux.Handle("/pushrules/"+pushRulesScopePattern+"/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeletePushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], device, userAPI, syncProducer)
+		}),
+	).Methods(http.MethodDelete)
+
+	r0mux.Handle("/pushrules/"+pushRulesScopePattern+"/{kind}/{ruleID}/{attr}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRuleAttrByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/"+pushRulesScopePattern+"/{kind}/{ruleID}/{attr}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleAttrByRuleID(req, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], device, userAPI, syncProducer)
+		}),
+	).Methods(http.MethodPut)
+
+	r0mux.Handle("/pushers",
+		httputil.MakeAuthAPI("get_pushers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetPushers(req, device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushers/set",
+		httputil.MakeAuthAPI("set_pushers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return SetPusher(req, device, userAPI, accountDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	// Element user settings
 
 	r0mux.Handle("/profile/{userID}",
@@ -552,7 +994,7 @@ func Setup(
 
 	r0mux.Handle("/profile/{userID}/avatar_url",
 		httputil.MakeAuthAPI("profile_avatar_url", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -577,7 +1019,7 @@ func Setup(
 
 	r0mux.Handle("/profile/{userID}/displayname",
 		httputil.MakeAuthAPI("profile_displayname", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -590,6 +1032,32 @@ func Setup(
 	// Browsers use the OPTIONS HTTP method to check if the CORS policy allows
 	// PUT requests, so we need to allow this method
 
+	unstableMux.Handle("/uk.tcpip.msc4133/profile/{userID}/{keyName}",
+		httputil.MakeExternalAPI("profile_field", func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetProfileField(req, accountDB, cfg, vars["userID"], vars["keyName"], asAPI, federation)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	unstableMux.Handle("/uk.tcpip.msc4133/profile/{userID}/{keyName}",
+		httputil.MakeAuthAPI("profile_field", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			if req.Method == http.MethodDelete {
+				return DeleteProfileField(req, accountDB, device, vars["userID"], vars["keyName"], cfg, rsAPI)
+			}
+			return SetProfileField(req, accountDB, device, vars["userID"], vars["keyName"], cfg, rsAPI)
+		}),
+	).Methods(http.MethodPut, http.MethodDelete, http.MethodOptions)
+
 	r0mux.Handle("/account/3pid",
 		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetAssociated3PIDs(req, accountDB, device)
@@ -598,26 +1066,71 @@ func Setup(
 
 	r0mux.Handle("/account/3pid",
 		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return CheckAndSave3PIDAssociation(req, accountDB, device, cfg)
+			return CheckAndSave3PIDAssociation(req, accountDB, device, cfg, emailValidator)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/3pid/add",
+		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Add3PID(withClientIP(req, rateLimits), userInteractiveAuth, accountDB, device, cfg, emailValidator)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	unstableMux.Handle("/account/3pid/delete",
+	r0mux.Handle("/account/3pid/bind",
 		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return Forget3PID(req, accountDB)
+			return Bind3PID(req, device, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	r0mux.Handle("/{path:(?:account/3pid|register)}/email/requestToken",
+	forget3PID := httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return Forget3PID(req, accountDB, device)
+	})
+	r0mux.Handle("/account/3pid/delete", forget3PID).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/account/3pid/delete", forget3PID).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/{path:(?:account/3pid|register|account/password)}/email/requestToken",
 		httputil.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
-			return RequestEmailToken(req, accountDB, cfg)
+			if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+				return *r
+			}
+			return RequestEmailToken(req, accountDB, cfg, emailValidator, mux.Vars(req)["path"])
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	if emailValidator != nil {
+		unstableMux.Handle("/validate/email/submitToken",
+			httputil.MakeHTMLAPI("validate_email_submit_token_link", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+					return r
+				}
+				return SubmitEmailTokenLink(w, req, emailValidator)
+			}),
+		).Methods(http.MethodGet)
+		unstableMux.Handle("/validate/email/submitToken",
+			httputil.MakeExternalAPI("validate_email_submit_token", func(req *http.Request) util.JSONResponse {
+				if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+					return *r
+				}
+				return SubmitEmailToken(req, emailValidator)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+
+	if msisdnValidator != nil {
+		r0mux.Handle("/register/msisdn/requestToken",
+			httputil.MakeExternalAPI("register_msisdn_request_token", func(req *http.Request) util.JSONResponse {
+				if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupLogin); r != nil {
+					return *r
+				}
+				return RequestMSISDNToken(req, accountDB, msisdnValidator)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+
 	// Element logs get flooded unless this is handled
 	r0mux.Handle("/presence/{userID}/status",
 		httputil.MakeExternalAPI("presence", func(req *http.Request) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupClient); r != nil {
 				return *r
 			}
 			// TODO: Set presence (probably the responsibility of a presence server not clientapi)
@@ -630,7 +1143,7 @@ func Setup(
 
 	r0mux.Handle("/voip/turnServer",
 		httputil.MakeAuthAPI("turn_server", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
 				return *r
 			}
 			return RequestTurnServer(req, device, cfg)
@@ -709,7 +1222,7 @@ func Setup(
 
 	r0mux.Handle("/user/{userID}/openid/request_token",
 		httputil.MakeAuthAPI("openid_request_token", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -722,7 +1235,7 @@ func Setup(
 
 	r0mux.Handle("/user_directory/search",
 		httputil.MakeAuthAPI("userdirectory_search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
 				return *r
 			}
 			postContent := struct {
@@ -737,8 +1250,6 @@ func Setup(
 				req.Context(),
 				device,
 				userAPI,
-				rsAPI,
-				cfg.Matrix.ServerName,
 				postContent.SearchString,
 				postContent.Limit,
 			)
@@ -767,7 +1278,7 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/read_markers",
 		httputil.MakeAuthAPI("rooms_read_markers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -780,7 +1291,7 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/forget",
 		httputil.MakeAuthAPI("rooms_forget", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -791,6 +1302,19 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/rooms/{roomID}/report/{eventID}",
+		httputil.MakeAuthAPI("report_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ReportEvent(req, device, vars["roomID"], vars["eventID"], rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/devices",
 		httputil.MakeAuthAPI("get_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetDevicesByLocalpart(req, userAPI, device)
@@ -823,13 +1347,13 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return DeleteDeviceById(req, userInteractiveAuth, userAPI, device, vars["deviceID"])
+			return DeleteDeviceById(withClientIP(req, rateLimits), userInteractiveAuth, userAPI, device, vars["deviceID"])
 		}),
-	).Methods(http.MethodDelete, http.MethodOptions)
+	).Methods(http.MethodDelete)
 
 	r0mux.Handle("/delete_devices",
 		httputil.MakeAuthAPI("delete_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return DeleteDevices(req, userAPI, device)
+			return DeleteDevices(withClientIP(req, rateLimits), userInteractiveAuth, userAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -880,14 +1404,14 @@ func Setup(
 			}
 			return DeleteTag(req, userAPI, device, vars["userId"], vars["roomId"], vars["tag"], syncProducer)
 		}),
-	).Methods(http.MethodDelete, http.MethodOptions)
+	).Methods(http.MethodDelete)
 
 	r0mux.Handle("/capabilities",
 		httputil.MakeAuthAPI("capabilities", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
 				return *r
 			}
-			return GetCapabilities(req, rsAPI)
+			return GetCapabilities(req, cfg, rsAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -1061,10 +1585,38 @@ func Setup(
 
 	// Deleting E2E Backup Keys
 
+	deleteBackupKeys := httputil.MakeAuthAPI("delete_backup_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return DeleteBackupKeys(req, userAPI, device, req.URL.Query().Get("version"), "", "")
+	})
+
+	deleteBackupKeysRoom := httputil.MakeAuthAPI("delete_backup_keys_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return DeleteBackupKeys(req, userAPI, device, req.URL.Query().Get("version"), vars["roomID"], "")
+	})
+
+	deleteBackupKeysRoomSession := httputil.MakeAuthAPI("delete_backup_keys_room_session", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return DeleteBackupKeys(req, userAPI, device, req.URL.Query().Get("version"), vars["roomID"], vars["sessionID"])
+	})
+
+	r0mux.Handle("/room_keys/keys", deleteBackupKeys).Methods(http.MethodDelete)
+	r0mux.Handle("/room_keys/keys/{roomID}", deleteBackupKeysRoom).Methods(http.MethodDelete)
+	r0mux.Handle("/room_keys/keys/{roomID}/{sessionID}", deleteBackupKeysRoomSession).Methods(http.MethodDelete)
+
+	unstableMux.Handle("/room_keys/keys", deleteBackupKeys).Methods(http.MethodDelete)
+	unstableMux.Handle("/room_keys/keys/{roomID}", deleteBackupKeysRoom).Methods(http.MethodDelete)
+	unstableMux.Handle("/room_keys/keys/{roomID}/{sessionID}", deleteBackupKeysRoomSession).Methods(http.MethodDelete)
+
 	// Cross-signing device keys
 
 	postDeviceSigningKeys := httputil.MakeAuthAPI("post_device_signing_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-		return UploadCrossSigningDeviceKeys(req, userInteractiveAuth, keyAPI, device, accountDB, cfg)
+		return UploadCrossSigningDeviceKeys(withClientIP(req, rateLimits), userInteractiveAuth, keyAPI, device)
 	})
 
 	postDeviceSigningSignatures := httputil.MakeAuthAPI("post_device_signing_signatures", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -1080,11 +1632,26 @@ func Setup(
 	// Supplying a device ID is deprecated.
 	r0mux.Handle("/keys/upload/{deviceID}",
 		httputil.MakeAuthAPI("keys_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
+				return *r
+			}
+			if mscCfg.Enabled("msc2697") {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				if vars["deviceID"] != device.ID {
+					return UploadDehydratedDeviceKeys(req, userAPI, keyAPI, device, vars["deviceID"])
+				}
+			}
 			return UploadKeys(req, keyAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/keys/upload",
 		httputil.MakeAuthAPI("keys_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupClient); r != nil {
+				return *r
+			}
 			return UploadKeys(req, keyAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
@@ -1100,7 +1667,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomId}/receipt/{receiptType}/{eventId}",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMessaging); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -1112,3 +1679,9 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 }
+
+// withClientIP returns the request with the IP address of the client in its
+// context, so that wrong passwords are throttled by it as well as by account.
+func withClientIP(req *http.Request, rateLimits *httputil.RateLimits) *http.Request {
+	return req.WithContext(auth.ContextWithClientIP(req.Context(), rateLimits.ClientIP(req)))
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -70,6 +71,7 @@ func SendEvent(
 	device *userapi.Device,
 	roomID, eventType string, txnID, stateKey *string,
 	cfg *config.ClientAPI,
+	accountDB accounts.Database,
 	rsAPI api.RoomserverInternalAPI,
 	txnCache *transactions.Cache,
 ) util.JSONResponse {
@@ -96,6 +98,42 @@ func SendEvent(
 	mutex.(*sync.Mutex).Lock()
 	defer mutex.(*sync.Mutex).Unlock()
 
+	var txnAndSessionID *api.TransactionID
+	if txnID != nil {
+		txnAndSessionID = &api.TransactionID{
+			TransactionID: *txnID,
+			SessionID:     device.SessionID,
+		}
+
+		// The transactions cache doesn't survive a restart, so also ask the
+		// roomserver whether it has already seen this transaction.
+		txnReq := api.QueryTransactionEventIDRequest{
+			TransactionID: *txnAndSessionID,
+			UserID:        device.UserID,
+		}
+		txnRes := api.QueryTransactionEventIDResponse{}
+		if err := rsAPI.QueryTransactionEventID(req.Context(), &txnReq, &txnRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryTransactionEventID failed")
+			return jsonerror.InternalServerError()
+		}
+		if txnRes.EventID != "" {
+			res := util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: sendEventResponse{txnRes.EventID},
+			}
+			txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+			return res
+		}
+	}
+
+	// Users may have to agree to the privacy policy before they can send
+	// messages, but they can still change the state of rooms.
+	if stateKey == nil {
+		if resErr := checkConsent(req.Context(), cfg, accountDB, device); resErr != nil {
+			return *resErr
+		}
+	}
+
 	startedGeneratingEvent := time.Now()
 	e, resErr := generateSendEvent(req, device, roomID, eventType, stateKey, cfg, rsAPI)
 	if resErr != nil {
@@ -103,16 +141,33 @@ func SendEvent(
 	}
 	timeToGenerateEvent := time.Since(startedGeneratingEvent)
 
-	var txnAndSessionID *api.TransactionID
-	if txnID != nil {
-		txnAndSessionID = &api.TransactionID{
-			TransactionID: *txnID,
-			SessionID:     device.SessionID,
+	// The events of shadow-banned users are dropped, apart from their own
+	// membership changes, but they are given an event ID like any other.
+	if membership, _ := e.Membership(); e.Type() != gomatrixserverlib.MRoomMember || membership == gomatrixserverlib.Invite {
+		shadowBanned, err := isShadowBanned(req.Context(), accountDB, device)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("isShadowBanned failed")
+			return jsonerror.InternalServerError()
+		}
+		if shadowBanned {
+			eventID, err := fakeEventID()
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("fakeEventID failed")
+				return jsonerror.InternalServerError()
+			}
+			res := util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: sendEventResponse{eventID},
+			}
+			if txnID != nil {
+				txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+			}
+			return res
 		}
 	}
 
-	// pass the new event to the roomserver and receive the correct event ID
-	// event ID in case of duplicate transaction is discarded
+	// pass the new event to the roomserver, which will discard it if the
+	// transaction ID has already been used
 	startedSubmittingEvent := time.Now()
 	if err := api.SendEvents(
 		req.Context(), rsAPI,
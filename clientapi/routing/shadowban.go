@@ -0,0 +1,47 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// isShadowBanned returns true if a server admin has shadow-banned the user
+// who the device belongs to. The events and invites which they send are
+// dropped, but they are told that the requests succeeded, so that they
+// don't know that they have been banned.
+func isShadowBanned(ctx context.Context, accountDB accounts.Database, device *userapi.Device) (bool, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return false, err
+	}
+	return accountDB.IsShadowBanned(ctx, localpart)
+}
+
+// fakeEventID returns a random event ID, which shadow-banned users are given
+// in place of the ID of the event that they think they sent.
+func fakeEventID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "$" + base64.RawURLEncoding.EncodeToString(b), nil
+}
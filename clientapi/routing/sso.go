@@ -0,0 +1,424 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// ssoCallbackPath is where identity providers send users back to.
+	ssoCallbackPath = "/_matrix/client/r0/login/sso/callback"
+	// ssoCookieName is the cookie which remembers the login attempt while
+	// the user is at the identity provider.
+	ssoCookieName = "dendrite_sso"
+	// ssoCookieLifetime is how long the user has to log in at the identity
+	// provider.
+	ssoCookieLifetime = 10 * time.Minute
+	// maxSSOLocalpartAttempts is how many numbered localparts we try for a
+	// new user when the one that the identity provider suggests is taken.
+	maxSSOLocalpartAttempts = 1000
+)
+
+// ssoState is what we remember about a login attempt in a cookie while the
+// user is at the identity provider.
+type ssoState struct {
+	// The state which the identity provider sends back to us
+	State string `json:"state"`
+	// The identity provider which the user is logging in with
+	ProviderID string `json:"provider_id"`
+	// Where the client wants the user to be sent once they have logged in
+	RedirectURL string `json:"redirect_url"`
+	// The PKCE code verifier for the code that the identity provider gives us
+	CodeVerifier string `json:"code_verifier"`
+}
+
+// ssoConfirmTemplate is shown to users once they have logged in, so that
+// they have to agree to give their login token to the client. Otherwise a
+// link to /login/sso/redirect which somebody sent them could log them in to
+// someone else's client.
+var ssoConfirmTemplate = template.Must(template.New("sso_confirm").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Continue to your client</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+<style>
+body { font-family: sans-serif; max-width: 24em; margin: 2em auto; padding: 0 1em; }
+</style>
+</head>
+<body>
+<p>You have logged in as {{.UserID}}.</p>
+<p>Continue to {{.ClientName}} to use your account there. If you didn't
+try to log in to {{.ClientName}}, close this page instead.</p>
+<p><a href="{{.RedirectURL}}">Continue to {{.ClientName}}</a></p>
+</body>
+</html>
+`))
+
+// ssoCallbackURL returns the URL that identity providers send users back to.
+func ssoCallbackURL(cfg *config.ClientAPI) string {
+	if cfg.SSO.CallbackURL != "" {
+		return cfg.SSO.CallbackURL
+	}
+	return strings.TrimSuffix(cfg.Matrix.WellKnownClientName, "/") + ssoCallbackPath
+}
+
+// ssoRandomString returns a random string which is safe to use in URLs.
+func ssoRandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// SSORedirect implements GET /login/sso/redirect and /login/sso/redirect/{idpID},
+// sending the user to the identity provider to log in. The default provider
+// is used if the client doesn't say which one.
+func SSORedirect(
+	w http.ResponseWriter, req *http.Request, providerID string,
+	cfg *config.ClientAPI, authenticator *sso.Authenticator,
+) *util.JSONResponse {
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if redirectURL == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("The 'redirectUrl' parameter is required."),
+		}
+	}
+	if u, err := url.Parse(redirectURL); err != nil || !validSSORedirectURL(u) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("The 'redirectUrl' parameter must be an absolute URL."),
+		}
+	}
+	if providerID == "" {
+		providerID = authenticator.DefaultProvider()
+	}
+
+	state, err := ssoRandomString()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("ssoRandomString failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	codeVerifier, err := ssoRandomString()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("ssoRandomString failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	authURL, err := authenticator.AuthorizationURL(
+		req.Context(), providerID, ssoCallbackURL(cfg), state,
+		base64.RawURLEncoding.EncodeToString(challenge[:]),
+	)
+	if err == sso.ErrUnknownProvider {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown identity provider"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("authenticator.AuthorizationURL failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+
+	cookie, err := json.Marshal(ssoState{
+		State:        state,
+		ProviderID:   providerID,
+		RedirectURL:  redirectURL,
+		CodeVerifier: codeVerifier,
+	})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	http.SetCookie(w, ssoCookie(cfg, base64.RawURLEncoding.EncodeToString(cookie), int(ssoCookieLifetime/time.Second)))
+	http.Redirect(w, req, authURL, http.StatusFound)
+	return nil
+}
+
+// SSOSAMLMetadata implements GET /login/sso/saml/metadata/{idpID}, returning
+// the metadata of Dendrite as a service provider of the SAML identity
+// provider.
+func SSOSAMLMetadata(
+	w http.ResponseWriter, req *http.Request, providerID string,
+	cfg *config.ClientAPI, authenticator *sso.Authenticator,
+) *util.JSONResponse {
+	metadata, err := authenticator.SAMLMetadata(providerID, ssoCallbackURL(cfg))
+	if err == sso.ErrUnknownProvider {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown SAML identity provider"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("authenticator.SAMLMetadata failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	if _, err = w.Write(metadata); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("w.Write failed")
+	}
+	return nil
+}
+
+// CASRedirect implements GET /login/cas/redirect, which clients that only
+// support the m.login.cas login type use instead of /login/sso/redirect. The
+// user is sent to the first CAS identity provider.
+func CASRedirect(
+	w http.ResponseWriter, req *http.Request,
+	cfg *config.ClientAPI, authenticator *sso.Authenticator,
+) *util.JSONResponse {
+	providerID := authenticator.CASProvider()
+	if providerID == "" {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("CAS isn't enabled"),
+		}
+	}
+	return SSORedirect(w, req, providerID, cfg, authenticator)
+}
+
+// validSSORedirectURL returns true if the user can be sent to the URL with
+// their login token. Clients on mobile devices use their own schemes, so any
+// scheme which can't run code in the browser is allowed.
+func validSSORedirectURL(u *url.URL) bool {
+	switch strings.ToLower(u.Scheme) {
+	case "", "javascript", "data", "vbscript":
+		return false
+	}
+	return u.Host != "" || u.Opaque != "" || u.Path != ""
+}
+
+// ssoCookie returns the cookie which remembers the login attempt. It is sent
+// when the identity provider sends the user back to the callback. SAML
+// identity providers do so by posting a form from their own site, which
+// browsers only send the cookie with if it is SameSite=None. That is safe
+// because the callback checks that the state which it is given matches the
+// cookie, but browsers only allow it for secure cookies.
+func ssoCookie(cfg *config.ClientAPI, value string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     ssoCookieName,
+		Value:    value,
+		Path:     ssoCallbackPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if u, err := url.Parse(ssoCallbackURL(cfg)); err == nil {
+		cookie.Path = u.Path
+		cookie.Secure = u.Scheme == "https"
+	}
+	if cookie.Secure {
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
+
+// SSOCallback implements GET and POST /login/sso/callback, which the identity
+// provider sends the user back to. SAML identity providers post their
+// assertion here, so this is also the assertion consumer service. The user gets an account if they don't have one
+// yet, and is then asked whether to continue to the client with a login
+// token.
+func SSOCallback(
+	w http.ResponseWriter, req *http.Request,
+	cfg *config.ClientAPI, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+	authenticator *sso.Authenticator, loginTokens *auth.LoginTokens,
+) *util.JSONResponse {
+	state, ok := ssoStateFromCookie(req)
+	// The login attempt can only be used once.
+	http.SetCookie(w, ssoCookie(cfg, "", -1))
+	if !ok {
+		return ssoInvalidAttempt(w, req)
+	}
+
+	info, err := authenticator.ProcessCallback(req, state.ProviderID, ssoCallbackURL(cfg), state.State, state.CodeVerifier)
+	switch {
+	case errors.Is(err, sso.ErrInvalidState):
+		return ssoInvalidAttempt(w, req)
+	case errors.Is(err, sso.ErrLoginRefused):
+		util.GetLogger(req.Context()).WithError(err).WithField("provider_id", state.ProviderID).Warn("Identity provider didn't log the user in")
+		return writeHTTPMessage(w, req,
+			"The identity provider didn't log you in. Please try logging in again.",
+			http.StatusUnauthorized,
+		)
+	case err != nil:
+		util.GetLogger(req.Context()).WithError(err).WithField("provider_id", state.ProviderID).Error("authenticator.ProcessCallback failed")
+		return writeHTTPMessage(w, req,
+			"Failed to find out who you are from the identity provider. Please try logging in again.",
+			http.StatusBadGateway,
+		)
+	}
+
+	localpart, err := accountDB.GetLocalpartForSSOIdentity(req.Context(), state.ProviderID, info.Subject)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForSSOIdentity failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if localpart == "" {
+		if resErr := checkMonthlyActiveUserLimit(req.Context(), userAPI, ""); resErr != nil {
+			if resErr.Code != http.StatusForbidden {
+				return resErr
+			}
+			return writeHTTPMessage(w, req,
+				"This server has reached its limit on active users, so can't make an account for you.",
+				http.StatusForbidden,
+			)
+		}
+		if localpart, err = registerSSOUser(req, cfg, accountDB, userAPI, state.ProviderID, info); err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("provider_id", state.ProviderID).Error("registerSSOUser failed")
+			return writeHTTPMessage(w, req,
+				"Failed to make an account for you. The identity provider may not have given a valid username.",
+				http.StatusBadRequest,
+			)
+		}
+	}
+
+	userID := userutil.MakeUserID(localpart, cfg.Matrix.ServerName)
+	token, err := loginTokens.Create(userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("loginTokens.Create failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	redirectURL, err := url.Parse(state.RedirectURL)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("url.Parse failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	q := redirectURL.Query()
+	q.Set("loginToken", token)
+	redirectURL.RawQuery = q.Encode()
+	clientName := redirectURL.Host
+	if clientName == "" {
+		clientName = redirectURL.Scheme
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err = ssoConfirmTemplate.Execute(w, map[string]interface{}{
+		"UserID":     userID,
+		"ClientName": clientName,
+		// The redirect URL was checked by SSORedirect, and clients may use
+		// schemes that the template would otherwise refuse to link to.
+		"RedirectURL": template.URL(redirectURL.String()), // nolint:gosec
+	})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("ssoConfirmTemplate.Execute failed")
+	}
+	return nil
+}
+
+// ssoInvalidAttempt tells the user that the callback isn't for a login
+// attempt which they made in this browser.
+func ssoInvalidAttempt(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+	return writeHTTPMessage(w, req,
+		"The login attempt is unknown or has expired. Please try logging in again.",
+		http.StatusBadRequest,
+	)
+}
+
+// ssoStateFromCookie returns the login attempt which the cookie remembers.
+func ssoStateFromCookie(req *http.Request) (*ssoState, bool) {
+	cookie, err := req.Cookie(ssoCookieName)
+	if err != nil {
+		return nil, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, false
+	}
+	var state ssoState
+	if err = json.Unmarshal(b, &state); err != nil || state.State == "" {
+		return nil, false
+	}
+	return &state, true
+}
+
+// registerSSOUser makes an account for a user who logged in with single
+// sign-on for the first time, from what the identity provider told us about
+// them. If the localpart that the identity provider suggests is taken then
+// a number is added to it. Accounts are made even if registration is
+// disabled, since the identity provider decides who can log in.
+func registerSSOUser(
+	req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+	providerID string, info *sso.UserInfo,
+) (string, error) {
+	base, err := sso.MapLocalpart(info.SuggestedLocalpart)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 0; attempt < maxSSOLocalpartAttempts; attempt++ {
+		localpart := base
+		if attempt > 0 {
+			localpart += strconv.Itoa(attempt)
+		}
+		if resErr := validateUsername(localpart); resErr != nil {
+			return "", fmt.Errorf("invalid localpart %q: %+v", localpart, resErr.JSON)
+		}
+		if UsernameMatchesExclusiveNamespaces(cfg, localpart) {
+			continue
+		}
+		var res userapi.PerformAccountCreationResponse
+		err = userAPI.PerformAccountCreation(req.Context(), &userapi.PerformAccountCreationRequest{
+			AccountType: userapi.AccountTypeUser,
+			Localpart:   localpart,
+			OnConflict:  userapi.ConflictAbort,
+		}, &res)
+		var conflict *userapi.ErrorConflict
+		if errors.As(err, &conflict) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("userAPI.PerformAccountCreation: %w", err)
+		}
+		if err = accountDB.SaveSSOIdentity(req.Context(), providerID, info.Subject, localpart); err != nil {
+			return "", fmt.Errorf("accountDB.SaveSSOIdentity: %w", err)
+		}
+		if info.DisplayName != "" {
+			if err = accountDB.SetDisplayName(req.Context(), localpart, info.DisplayName); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Warn("Failed to set the display name of a new SSO user")
+			}
+		}
+		util.GetLogger(req.Context()).WithField("user_id", res.Account.UserID).WithField("provider_id", providerID).Info("Registered single sign-on user")
+		return localpart, nil
+	}
+	return "", fmt.Errorf("no free localpart based on %q", base)
+}
@@ -0,0 +1,250 @@
+package routing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type mockSSOUserAPI struct {
+	userapi.UserInternalAPI
+	accountDB        accounts.Database
+	mauLimitExceeded bool
+}
+
+func (m *mockSSOUserAPI) QueryMonthlyActiveUsers(ctx context.Context, req *userapi.QueryMonthlyActiveUsersRequest, res *userapi.QueryMonthlyActiveUsersResponse) error {
+	res.LimitExceeded = m.mauLimitExceeded
+	return nil
+}
+
+func (m *mockSSOUserAPI) PerformAccountCreation(ctx context.Context, req *userapi.PerformAccountCreationRequest, res *userapi.PerformAccountCreationResponse) error {
+	if _, err := m.accountDB.GetAccountByLocalpart(ctx, req.Localpart); err == nil {
+		return &userapi.ErrorConflict{Message: "account already exists"}
+	}
+	account, err := m.accountDB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID, req.AccountType)
+	if err != nil {
+		return err
+	}
+	res.AccountCreated = true
+	res.Account = account
+	return nil
+}
+
+// newTestSSOProvider returns an OpenID Connect provider which says that
+// whoever logs in is the user with the subject "1234". The code challenge of
+// the last authorization request must match the code verifier that is given
+// to the token endpoint.
+func newTestSSOProvider(t *testing.T, codeChallenge *string) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		challenge := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+		if req.PostFormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(challenge[:]) != *codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token": "access", "token_type": "Bearer"}`))
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`{"sub": "1234", "preferred_username": "Alice", "name": "Alice Smith"}`))
+	})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSSO(t *testing.T) {
+	var codeChallenge string
+	srv := newTestSSOProvider(t, &codeChallenge)
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName:          "example.com",
+			WellKnownClientName: "https://matrix.example.com/",
+		},
+		SSO: config.SSO{
+			Enabled: true,
+			Providers: []config.IdentityProvider{{
+				ID:           "test",
+				Name:         "Test",
+				DiscoveryURL: srv.URL + "/.well-known/openid-configuration",
+				ClientID:     "dendrite",
+			}},
+		},
+		Derived: &config.Derived{
+			ExclusiveApplicationServicesUsernameRegexp: regexp.MustCompile("@alice1:example.com"),
+		},
+	}
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, "example.com", &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	// The localpart that the identity provider suggests is taken, and the
+	// next one is reserved for an application service.
+	if _, err = accountDB.CreateAccount(context.Background(), "alice", "password", "", userapi.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	userAPI := &mockSSOUserAPI{accountDB: accountDB}
+	authenticator, err := sso.NewAuthenticator(&cfg.SSO)
+	if err != nil {
+		t.Fatalf("NewAuthenticator failed: %s", err)
+	}
+	loginTokens := auth.NewLoginTokens(nil)
+
+	for _, tst := range []struct {
+		Name       string
+		ProviderID string
+		Query      string
+		WantCode   int
+	}{
+		{"noRedirectURL", "", "", http.StatusBadRequest},
+		{"javascriptRedirectURL", "", "?redirectUrl=javascript:alert(1)", http.StatusBadRequest},
+		{"relativeRedirectURL", "", "?redirectUrl=/client", http.StatusBadRequest},
+		{"unknownProvider", "unknown", "?redirectUrl=https://client.example.com/", http.StatusNotFound},
+	} {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login/sso/redirect"+tst.Query, nil)
+			res := SSORedirect(httptest.NewRecorder(), req, tst.ProviderID, cfg, authenticator)
+			if res == nil || res.Code != tst.WantCode {
+				t.Errorf("got %+v, want HTTP %d", res, tst.WantCode)
+			}
+		})
+	}
+
+	// The legacy CAS endpoint only works with CAS identity providers.
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login/cas/redirect?redirectUrl=https://client.example.com/", nil)
+	if res := CASRedirect(httptest.NewRecorder(), req, cfg, authenticator); res == nil || res.Code != http.StatusNotFound {
+		t.Errorf("CASRedirect: got %+v, want HTTP 404", res)
+	}
+	// Only SAML identity providers have service provider metadata.
+	req = httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login/sso/saml/metadata/test", nil)
+	if res := SSOSAMLMetadata(httptest.NewRecorder(), req, "test", cfg, authenticator); res == nil || res.Code != http.StatusNotFound {
+		t.Errorf("SSOSAMLMetadata: got %+v, want HTTP 404", res)
+	}
+
+	// login goes through the identity provider and returns the page which
+	// the callback shows, along with the user who the login token is for.
+	login := func(t *testing.T, state string) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login/sso/redirect?redirectUrl="+url.QueryEscape("element://login?x=y"), nil)
+		w := httptest.NewRecorder()
+		if res := SSORedirect(w, req, "", cfg, authenticator); res != nil {
+			t.Fatalf("SSORedirect failed: %+v", res)
+		}
+		if w.Code != http.StatusFound {
+			t.Fatalf("got HTTP %d, want a redirect to the identity provider", w.Code)
+		}
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("url.Parse failed: %s", err)
+		}
+		if location.Path != "/authorize" || location.Query().Get("redirect_uri") != "https://matrix.example.com"+ssoCallbackPath {
+			t.Fatalf("got redirect to %s, want the authorization endpoint", location)
+		}
+		codeChallenge = location.Query().Get("code_challenge")
+		if state == "" {
+			state = location.Query().Get("state")
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure || cookies[0].Path != ssoCallbackPath {
+			t.Fatalf("got cookies %+v, want a secure cookie for the callback", cookies)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, ssoCallbackPath+"?code=code&state="+url.QueryEscape(state), nil)
+		req.AddCookie(cookies[0])
+		w = httptest.NewRecorder()
+		if res := SSOCallback(w, req, cfg, accountDB, userAPI, authenticator, loginTokens); res != nil {
+			t.Fatalf("SSOCallback failed: %+v", res)
+		}
+		m := regexp.MustCompile(`href="element://login\?loginToken=([^&"]+)&amp;x=y"`).FindStringSubmatch(w.Body.String())
+		if m == nil {
+			return w, ""
+		}
+		userID, err := loginTokens.Consume(m[1])
+		if err != nil {
+			t.Fatalf("Consume failed: %s", err)
+		}
+		return w, userID
+	}
+
+	t.Run("wrongState", func(t *testing.T) {
+		w, userID := login(t, "wrong")
+		if w.Code != http.StatusBadRequest || userID != "" {
+			t.Errorf("got HTTP %d with a login token for %q, want HTTP 400", w.Code, userID)
+		}
+	})
+	t.Run("monthlyActiveUserLimit", func(t *testing.T) {
+		userAPI.mauLimitExceeded = true
+		defer func() { userAPI.mauLimitExceeded = false }()
+		if w, userID := login(t, ""); w.Code != http.StatusForbidden || userID != "" {
+			t.Errorf("got HTTP %d with a login token for %q, want HTTP 403", w.Code, userID)
+		}
+	})
+	t.Run("newUser", func(t *testing.T) {
+		w, userID := login(t, "")
+		if w.Code != http.StatusOK || userID != "@alice2:example.com" {
+			t.Fatalf("got HTTP %d with a login token for %q, want a login token for @alice2:example.com", w.Code, userID)
+		}
+		profile, err := accountDB.GetProfileByLocalpart(context.Background(), "alice2")
+		if err != nil {
+			t.Fatalf("GetProfileByLocalpart failed: %s", err)
+		}
+		if profile.DisplayName != "Alice Smith" {
+			t.Errorf("got display name %q, want Alice Smith", profile.DisplayName)
+		}
+	})
+	t.Run("existingUser", func(t *testing.T) {
+		if w, userID := login(t, ""); w.Code != http.StatusOK || userID != "@alice2:example.com" {
+			t.Errorf("got HTTP %d with a login token for %q, want a login token for @alice2:example.com", w.Code, userID)
+		}
+		if _, err := accountDB.GetAccountByLocalpart(context.Background(), "alice3"); err == nil {
+			t.Errorf("got a second account for the same identity, want none")
+		}
+	})
+}
+
+func TestLoginFlows(t *testing.T) {
+	tsts := []struct {
+		Name      string
+		SSO       config.SSO
+		WantTypes []string
+	}{
+		{"disabled", config.SSO{}, []string{"m.login.password"}},
+		{"oidc", config.SSO{Enabled: true, Providers: []config.IdentityProvider{{ID: "oidc"}}}, []string{"m.login.password", "m.login.sso", "m.login.token"}},
+		{"cas", config.SSO{Enabled: true, Providers: []config.IdentityProvider{{ID: "oidc"}, {ID: "cas", Type: config.IdentityProviderTypeCAS}}}, []string{"m.login.password", "m.login.sso", "m.login.cas", "m.login.token"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			var types []string
+			for _, f := range loginFlows(&config.ClientAPI{SSO: tst.SSO}).Flows {
+				types = append(types, f.Type)
+			}
+			if !reflect.DeepEqual(types, tst.WantTypes) {
+				t.Errorf("got flows %v, want %v", types, tst.WantTypes)
+			}
+		})
+	}
+}
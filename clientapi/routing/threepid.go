@@ -15,8 +15,12 @@
 package routing
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -30,17 +34,29 @@ import (
 )
 
 type reqTokenResponse struct {
-	SID string `json:"sid"`
+	SID       string `json:"sid"`
+	SubmitURL string `json:"submit_url,omitempty"`
 }
 
 type threePIDsResponse struct {
 	ThreePIDs []authtypes.ThreePID `json:"threepids"`
 }
 
+type forget3PIDResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
 // RequestEmailToken implements:
 //     POST /account/3pid/email/requestToken
 //     POST /register/email/requestToken
-func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *config.ClientAPI) util.JSONResponse {
+//     POST /account/password/email/requestToken
+// The path is the part of the path before /email/requestToken. The token is
+// sent by the email validator if there is one, and otherwise by the identity
+// server that the client asks for.
+func RequestEmailToken(
+	req *http.Request, accountDB accounts.Database, cfg *config.ClientAPI,
+	emailValidator *threepid.EmailValidator, path string,
+) util.JSONResponse {
 	var body threepid.EmailAssociationRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
@@ -56,13 +72,65 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 		return jsonerror.InternalServerError()
 	}
 
-	if len(localpart) > 0 {
+	var purpose string
+	switch path {
+	case "account/password":
+		// Passwords can only be reset for the email addresses of accounts.
+		purpose = threepid.PurposePasswordReset
+		if emailValidator == nil {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Password resets by email are not enabled on this server"),
+			}
+		}
+		if len(localpart) == 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MatrixError{
+					ErrCode: "M_THREEPID_NOT_FOUND",
+					Err:     "Email address not found",
+				},
+			}
+		}
+	default:
+		purpose = threepid.PurposeRegistration
+		if path == "account/3pid" {
+			purpose = threepid.PurposeAddThreePID
+		}
+		if len(localpart) > 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MatrixError{
+					ErrCode: "M_THREEPID_IN_USE",
+					Err:     accounts.Err3PIDInUse.Error(),
+				},
+			}
+		}
+	}
+
+	if emailValidator != nil {
+		if body.NextLink != "" {
+			if nextLink, perr := url.Parse(body.NextLink); perr != nil || (nextLink.Scheme != "http" && nextLink.Scheme != "https") {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidParam("next_link must be an http or https URL"),
+				}
+			}
+		}
+		resp.SID, err = emailValidator.RequestToken(purpose, body.Secret, body.Email, body.SendAttempt, body.NextLink)
+		if err == threepid.ErrInvalidEmailAddress {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(err.Error()),
+			}
+		} else if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("emailValidator.RequestToken failed")
+			return jsonerror.InternalServerError()
+		}
+		resp.SubmitURL = emailValidator.SubmitURL()
 		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.MatrixError{
-				ErrCode: "M_THREEPID_IN_USE",
-				Err:     accounts.Err3PIDInUse.Error(),
-			},
+			Code: http.StatusOK,
+			JSON: resp,
 		}
 	}
 
@@ -83,22 +151,198 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 	}
 }
 
+// RequestMSISDNToken implements POST /register/msisdn/requestToken. The
+// token is sent by the identity server in the config, whichever one the
+// client asks for.
+func RequestMSISDNToken(
+	req *http.Request, accountDB accounts.Database, msisdnValidator *threepid.MSISDNValidator,
+) util.JSONResponse {
+	var body threepid.MSISDNAssociationRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if body.Secret == "" || body.Country == "" || body.PhoneNumber == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("client_secret, country and phone_number are required"),
+		}
+	}
+	if body.NextLink != "" {
+		if nextLink, perr := url.Parse(body.NextLink); perr != nil || (nextLink.Scheme != "http" && nextLink.Scheme != "https") {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("next_link must be an http or https URL"),
+			}
+		}
+	}
+
+	session, err := msisdnValidator.RequestToken(req.Context(), body)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("msisdnValidator.RequestToken failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Check if the 3PID is already in use locally. We only know the phone
+	// number in its canonical form once the identity server has told us.
+	if session.MSISDN != "" {
+		localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), session.MSISDN, "msisdn")
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+			return jsonerror.InternalServerError()
+		}
+		if len(localpart) > 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MatrixError{
+					ErrCode: "M_THREEPID_IN_USE",
+					Err:     accounts.Err3PIDInUse.Error(),
+				},
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: reqTokenResponse{
+			SID:       session.SID,
+			SubmitURL: session.SubmitURL,
+		},
+	}
+}
+
+type submitTokenRequest struct {
+	SID    string `json:"sid"`
+	Secret string `json:"client_secret"`
+	Token  string `json:"token"`
+}
+
+// SubmitEmailToken implements POST /validate/email/submitToken, which clients
+// can submit the token from a validation email to.
+func SubmitEmailToken(req *http.Request, emailValidator *threepid.EmailValidator) util.JSONResponse {
+	var body submitTokenRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	_, err := emailValidator.SubmitToken(body.SID, body.Secret, body.Token)
+	if err != nil && err != threepid.ErrInvalidToken {
+		util.GetLogger(req.Context()).WithError(err).Error("emailValidator.SubmitToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Success bool `json:"success"`
+		}{err == nil},
+	}
+}
+
+// SubmitEmailTokenLink implements GET /validate/email/submitToken, which the
+// links in validation emails point at. The user is sent to the next_link of
+// the session if the client gave one.
+func SubmitEmailTokenLink(w http.ResponseWriter, req *http.Request, emailValidator *threepid.EmailValidator) *util.JSONResponse {
+	query := req.URL.Query()
+	session, err := emailValidator.SubmitToken(query.Get("sid"), query.Get("client_secret"), query.Get("token"))
+	if err == threepid.ErrInvalidToken {
+		return writeHTTPMessage(w, req, "This link is invalid or has expired.", http.StatusBadRequest)
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("emailValidator.SubmitToken failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if session.NextLink != "" {
+		http.Redirect(w, req, session.NextLink, http.StatusFound)
+		return nil
+	}
+	return writeHTTPMessage(w, req, "Your email address has been validated. You can now return to your client.", http.StatusOK)
+}
+
 // CheckAndSave3PIDAssociation implements POST /account/3pid
 func CheckAndSave3PIDAssociation(
 	req *http.Request, accountDB accounts.Database, device *api.Device,
-	cfg *config.ClientAPI,
+	cfg *config.ClientAPI, emailValidator *threepid.EmailValidator,
 ) util.JSONResponse {
 	var body threepid.EmailAssociationCheckRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
+	return checkAndSave3PIDAssociation(req, accountDB, device, body.Creds, body.Bind, cfg, emailValidator)
+}
+
+// Add3PID implements POST /account/3pid/add
+func Add3PID(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive,
+	accountDB accounts.Database, device *api.Device, cfg *config.ClientAPI,
+	emailValidator *threepid.EmailValidator,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	// make sure that the access token being used matches the login creds used
+	// for user interactive auth, so that a stolen access token alone can't be
+	// used to add a 3PID to the account.
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot add a 3PID to another user's account"),
+		}
+	}
 
-	// Check if the association has been validated
-	verified, address, medium, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg)
+	var creds threepid.Credentials
+	if err = json.Unmarshal(bodyBytes, &creds); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	// The validation sessions which /account/3pid/email/requestToken creates
+	// are on an identity server, but clients don't have to say which one.
+	if creds.IDServer == "" && len(cfg.Matrix.TrustedIDServers) > 0 {
+		creds.IDServer = cfg.Matrix.TrustedIDServers[0]
+	}
+	return checkAndSave3PIDAssociation(req, accountDB, device, creds, false, cfg, emailValidator)
+}
+
+func checkAndSave3PIDAssociation(
+	req *http.Request, accountDB accounts.Database, device *api.Device,
+	creds threepid.Credentials, bind bool, cfg *config.ClientAPI,
+	emailValidator *threepid.EmailValidator,
+) util.JSONResponse {
+	// Check if the association has been validated, by us if we sent the
+	// token and otherwise by the identity server.
+	var verified, local bool
+	var address, medium string
+	var err error
+	if emailValidator != nil {
+		address, err = emailValidator.ValidatedAddress(creds.SID, creds.Secret)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("emailValidator.ValidatedAddress failed")
+			return jsonerror.InternalServerError()
+		}
+		verified, local, medium = address != "", address != "", "email"
+	}
+	if !local {
+		verified, address, medium, err = threepid.CheckAssociation(req.Context(), creds, cfg)
+	}
 	if err == threepid.ErrNotTrusted {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.NotTrusted(body.Creds.IDServer),
+			JSON: jsonerror.NotTrusted(creds.IDServer),
 		}
 	} else if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("threepid.CheckAssociation failed")
@@ -115,13 +359,15 @@ func CheckAndSave3PIDAssociation(
 		}
 	}
 
-	if body.Bind {
+	// Sessions which we validated ourselves aren't known to any identity
+	// server, so there is nothing to publish them on.
+	if bind && !local {
 		// Publish the association on the identity server if requested
-		err = threepid.PublishAssociation(body.Creds, device.UserID, cfg)
+		err = threepid.PublishAssociation(creds, device.UserID, cfg)
 		if err == threepid.ErrNotTrusted {
 			return util.JSONResponse{
 				Code: http.StatusBadRequest,
-				JSON: jsonerror.NotTrusted(body.Creds.IDServer),
+				JSON: jsonerror.NotTrusted(creds.IDServer),
 			}
 		} else if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("threepid.PublishAssociation failed")
@@ -136,10 +382,53 @@ func CheckAndSave3PIDAssociation(
 		return jsonerror.InternalServerError()
 	}
 
-	if err = accountDB.SaveThreePIDAssociation(req.Context(), address, localpart, medium); err != nil {
+	if err = accountDB.SaveThreePIDAssociation(req.Context(), address, localpart, medium); err == accounts.Err3PIDInUse {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     accounts.Err3PIDInUse.Error(),
+			},
+		}
+	} else if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountsDB.SaveThreePIDAssociation failed")
 		return jsonerror.InternalServerError()
 	}
+	if local {
+		if err = emailValidator.Forget(creds.SID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Warn("emailValidator.Forget failed")
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// Bind3PID implements POST /account/3pid/bind
+func Bind3PID(req *http.Request, device *api.Device, cfg *config.ClientAPI) util.JSONResponse {
+	var creds threepid.Credentials
+	if reqErr := httputil.UnmarshalJSONRequest(req, &creds); reqErr != nil {
+		return *reqErr
+	}
+	if creds.IDServer == "" || creds.SID == "" || creds.Secret == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("id_server, sid and client_secret are required"),
+		}
+	}
+
+	err := threepid.PublishAssociation(creds, device.UserID, cfg)
+	if err == threepid.ErrNotTrusted {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotTrusted(creds.IDServer),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threepid.PublishAssociation failed")
+		return jsonerror.InternalServerError()
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -170,19 +459,38 @@ func GetAssociated3PIDs(
 }
 
 // Forget3PID implements POST /account/3pid/delete
-func Forget3PID(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+func Forget3PID(req *http.Request, accountDB accounts.Database, device *api.Device) util.JSONResponse {
 	var body authtypes.ThreePID
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
 
-	if err := accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	owner, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Address, body.Medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
 		return jsonerror.InternalServerError()
 	}
 
+	// Only remove the 3PID if it belongs to the user. Deleting a 3PID which
+	// isn't associated with the account does nothing, rather than telling
+	// the user who it belongs to.
+	if owner == localpart {
+		if err = accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: forget3PIDResponse{
+			// We don't unbind 3PIDs from identity servers.
+			IDServerUnbindResult: "no-support",
+		},
 	}
 }
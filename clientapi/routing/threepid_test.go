@@ -0,0 +1,63 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type mockThreePIDDatabase struct {
+	accounts.Database
+	threepids map[string]string // address -> localpart
+}
+
+func (d *mockThreePIDDatabase) GetLocalpartForThreePID(ctx context.Context, threepid, medium string) (string, error) {
+	return d.threepids[threepid], nil
+}
+
+func (d *mockThreePIDDatabase) RemoveThreePIDAssociation(ctx context.Context, threepid, medium string) error {
+	delete(d.threepids, threepid)
+	return nil
+}
+
+func TestForget3PID(t *testing.T) {
+	db := &mockThreePIDDatabase{
+		threepids: map[string]string{
+			"alice@example.com": "alice",
+			"bob@example.com":   "bob",
+		},
+	}
+	device := &api.Device{UserID: "@alice:localhost"}
+
+	tsts := []struct {
+		Name    string
+		Address string
+		Want    map[string]string
+	}{
+		{"otherUser", "bob@example.com", map[string]string{"alice@example.com": "alice", "bob@example.com": "bob"}},
+		{"unknown", "carol@example.com", map[string]string{"alice@example.com": "alice", "bob@example.com": "bob"}},
+		{"ownThreePID", "alice@example.com", map[string]string{"bob@example.com": "bob"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			body := `{"medium":"email","address":"` + tst.Address + `"}`
+			res := Forget3PID(httptest.NewRequest("POST", "/account/3pid/delete", strings.NewReader(body)), db, device)
+			if res.Code != http.StatusOK {
+				t.Fatalf("got HTTP %d, want %d", res.Code, http.StatusOK)
+			}
+			if len(db.threepids) != len(tst.Want) {
+				t.Fatalf("got 3PIDs %v, want %v", db.threepids, tst.Want)
+			}
+			for address, localpart := range tst.Want {
+				if db.threepids[address] != localpart {
+					t.Errorf("got 3PIDs %v, want %v", db.threepids, tst.Want)
+				}
+			}
+		})
+	}
+}
@@ -19,9 +19,7 @@ import (
 	"fmt"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
-	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
-	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
@@ -30,12 +28,12 @@ type UserDirectoryResponse struct {
 	Limited bool                              `json:"limited"`
 }
 
+// SearchUserDirectory implements POST /user_directory/search, finding the
+// users whose user ID or display name matches the search string.
 func SearchUserDirectory(
 	ctx context.Context,
 	device *userapi.Device,
 	userAPI userapi.UserInternalAPI,
-	rsAPI api.RoomserverInternalAPI,
-	serverName gomatrixserverlib.ServerName,
 	searchString string,
 	limit int,
 ) *util.JSONResponse {
@@ -43,71 +41,24 @@ func SearchUserDirectory(
 		limit = 10
 	}
 
-	results := map[string]authtypes.FullyQualifiedProfile{}
-	response := &UserDirectoryResponse{
-		Results: []authtypes.FullyQualifiedProfile{},
-		Limited: false,
-	}
-
-	// First start searching local users.
-
-	userReq := &userapi.QuerySearchProfilesRequest{
+	userReq := &userapi.QuerySearchUserDirectoryRequest{
+		UserID:       device.UserID,
 		SearchString: searchString,
 		Limit:        limit,
 	}
-	userRes := &userapi.QuerySearchProfilesResponse{}
-	if err := userAPI.QuerySearchProfiles(ctx, userReq, userRes); err != nil {
-		errRes := util.ErrorResponse(fmt.Errorf("userAPI.QuerySearchProfiles: %w", err))
+	userRes := &userapi.QuerySearchUserDirectoryResponse{}
+	if err := userAPI.QuerySearchUserDirectory(ctx, userReq, userRes); err != nil {
+		errRes := util.ErrorResponse(fmt.Errorf("userAPI.QuerySearchUserDirectory: %w", err))
 		return &errRes
 	}
 
-	for _, user := range userRes.Profiles {
-		if len(results) == limit {
-			response.Limited = true
-			break
-		}
-
-		userID := fmt.Sprintf("@%s:%s", user.Localpart, serverName)
-		if _, ok := results[userID]; !ok {
-			results[userID] = authtypes.FullyQualifiedProfile{
-				UserID:      userID,
-				DisplayName: user.DisplayName,
-				AvatarURL:   user.AvatarURL,
-			}
-		}
-	}
-
-	// Then, if we have enough room left in the response,
-	// start searching for known users from joined rooms.
-
-	if len(results) <= limit {
-		stateReq := &api.QueryKnownUsersRequest{
-			UserID:       device.UserID,
-			SearchString: searchString,
-			Limit:        limit - len(results),
-		}
-		stateRes := &api.QueryKnownUsersResponse{}
-		if err := rsAPI.QueryKnownUsers(ctx, stateReq, stateRes); err != nil {
-			errRes := util.ErrorResponse(fmt.Errorf("rsAPI.QueryKnownUsers: %w", err))
-			return &errRes
-		}
-
-		for _, user := range stateRes.Users {
-			if len(results) == limit {
-				response.Limited = true
-				break
-			}
-
-			if _, ok := results[user.UserID]; !ok {
-				results[user.UserID] = user
-			}
-		}
+	response := &UserDirectoryResponse{
+		Results: userRes.Results,
+		Limited: userRes.Limited,
 	}
-
-	for _, result := range results {
-		response.Results = append(response.Results, result)
+	if response.Results == nil {
+		response.Results = []authtypes.FullyQualifiedProfile{}
 	}
-
 	return &util.JSONResponse{
 		Code: 200,
 		JSON: response,
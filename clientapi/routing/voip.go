@@ -51,16 +51,16 @@ func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.Client
 	}
 
 	if turnConfig.SharedSecret != "" {
+		// This is the TURN REST API scheme supported by coturn: the username
+		// is the expiry timestamp and the user ID, and the password is the
+		// HMAC-SHA1 of the username, keyed with the shared secret.
 		expiry := time.Now().Add(duration).Unix()
+		resp.Username = fmt.Sprintf("%d:%s", expiry, device.UserID)
 		mac := hmac.New(sha1.New, []byte(turnConfig.SharedSecret))
-		_, err := mac.Write([]byte(resp.Username))
-
-		if err != nil {
+		if _, err := mac.Write([]byte(resp.Username)); err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("mac.Write failed")
 			return jsonerror.InternalServerError()
 		}
-
-		resp.Username = fmt.Sprintf("%d:%s", expiry, device.UserID)
 		resp.Password = base64.StdEncoding.EncodeToString(mac.Sum(nil))
 	} else if turnConfig.Username != "" && turnConfig.Password != "" {
 		resp.Username = turnConfig.Username
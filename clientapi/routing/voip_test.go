@@ -0,0 +1,63 @@
+package routing
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrix"
+)
+
+func TestRequestTurnServerSharedSecret(t *testing.T) {
+	cfg := &config.ClientAPI{
+		TURN: config.TURN{
+			UserLifetime: "1h",
+			URIs:         []string{"turn:turn.example.com:3478?transport=udp"},
+			SharedSecret: "secret",
+		},
+	}
+	device := &api.Device{UserID: "@alice:localhost"}
+	res := RequestTurnServer(httptest.NewRequest("GET", "/voip/turnServer", nil), device, cfg)
+	if res.Code != 200 {
+		t.Fatalf("got HTTP %d want 200", res.Code)
+	}
+	resp, ok := res.JSON.(gomatrix.RespTurnServer)
+	if !ok {
+		t.Fatalf("got response %+v want gomatrix.RespTurnServer", res.JSON)
+	}
+	if resp.TTL != 3600 {
+		t.Errorf("got TTL %d want 3600", resp.TTL)
+	}
+	if !strings.HasSuffix(resp.Username, ":"+device.UserID) {
+		t.Errorf("got username %q want it to end with the user ID", resp.Username)
+	}
+	mac := hmac.New(sha1.New, []byte("secret"))
+	_, _ = mac.Write([]byte(resp.Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); resp.Password != want {
+		t.Errorf("got password %q want %q", resp.Password, want)
+	}
+}
+
+func TestRequestTurnServerStaticCredentials(t *testing.T) {
+	cfg := &config.ClientAPI{
+		TURN: config.TURN{
+			UserLifetime: "5m",
+			URIs:         []string{"turn:turn.example.com:3478"},
+			Username:     "user",
+			Password:     "pass",
+		},
+	}
+	res := RequestTurnServer(httptest.NewRequest("GET", "/voip/turnServer", nil), &api.Device{UserID: "@alice:localhost"}, cfg)
+	resp, ok := res.JSON.(gomatrix.RespTurnServer)
+	if !ok {
+		t.Fatalf("got response %+v want gomatrix.RespTurnServer", res.JSON)
+	}
+	if resp.Username != "user" || resp.Password != "pass" || resp.TTL != 300 {
+		t.Errorf("got %+v want static credentials with a TTL of 300", resp)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+type wellKnownServerResponse struct {
+	ServerName string `json:"m.server"`
+}
+
+type wellKnownBaseURL struct {
+	BaseURL string `json:"base_url"`
+}
+
+type wellKnownSlidingSync struct {
+	URL string `json:"url"`
+}
+
+type wellKnownClientResponse struct {
+	Homeserver       wellKnownBaseURL      `json:"m.homeserver"`
+	IdentityServer   *wellKnownBaseURL     `json:"m.identity_server,omitempty"`
+	SlidingSyncProxy *wellKnownSlidingSync `json:"org.matrix.msc3575.proxy,omitempty"`
+}
+
+// WellKnownServer implements GET /.well-known/matrix/server, which tells other
+// homeservers where to send federation traffic for our server name.
+func WellKnownServer(cfg *config.Global) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: wellKnownServerResponse{
+			ServerName: cfg.WellKnownServerName,
+		},
+	}
+}
+
+// WellKnownClient implements GET /.well-known/matrix/client, which tells
+// clients which base URLs to use for the client-server API and, optionally,
+// the identity server and sliding sync proxy.
+func WellKnownClient(cfg *config.Global) util.JSONResponse {
+	res := wellKnownClientResponse{
+		Homeserver: wellKnownBaseURL{
+			BaseURL: cfg.WellKnownClientName,
+		},
+	}
+	if cfg.WellKnownIdentityServer != "" {
+		res.IdentityServer = &wellKnownBaseURL{
+			BaseURL: cfg.WellKnownIdentityServer,
+		}
+	}
+	if cfg.WellKnownSlidingSyncProxy != "" {
+		res.SlidingSyncProxy = &wellKnownSlidingSync{
+			URL: cfg.WellKnownSlidingSyncProxy,
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
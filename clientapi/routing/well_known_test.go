@@ -0,0 +1,32 @@
+package routing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestWellKnownClient(t *testing.T) {
+	cfg := &config.Global{
+		WellKnownClientName: "https://matrix.example.com",
+	}
+	body, err := json.Marshal(WellKnownClient(cfg).JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	if want := `{"m.homeserver":{"base_url":"https://matrix.example.com"}}`; string(body) != want {
+		t.Fatalf("got %s want %s", body, want)
+	}
+
+	cfg.WellKnownIdentityServer = "https://id.example.com"
+	cfg.WellKnownSlidingSyncProxy = "https://sync.example.com"
+	body, err = json.Marshal(WellKnownClient(cfg).JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	want := `{"m.homeserver":{"base_url":"https://matrix.example.com"},"m.identity_server":{"base_url":"https://id.example.com"},"org.matrix.msc3575.proxy":{"url":"https://sync.example.com"}}`
+	if string(body) != want {
+		t.Fatalf("got %s want %s", body, want)
+	}
+}
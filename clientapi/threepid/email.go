@@ -0,0 +1,287 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The reasons for validating an email address, which choose the template of
+// the email that is sent.
+const (
+	PurposeRegistration  = "registration"
+	PurposePasswordReset = "password_reset"
+	PurposeAddThreePID   = "add_threepid"
+)
+
+// SubmitTokenPath is the path of the client API endpoint which the links in
+// the emails point at.
+const SubmitTokenPath = "/_matrix/client/unstable/validate/email/submitToken"
+
+// emailTokenByteLength is the number of random bytes in a token.
+const emailTokenByteLength = 24
+
+// defaultEmailTemplates are the templates of the emails for each purpose. Each
+// template defines a "subject" and a "body" template.
+var defaultEmailTemplates = map[string]string{
+	PurposeRegistration: `{{define "subject"}}Validate your email address for {{.ServerName}}{{end}}
+{{define "body"}}Someone asked to register an account on {{.ServerName}} with this email address.
+
+To continue registering, open this link:
+
+{{.Link}}
+
+If it wasn't you, you can ignore this email.
+{{end}}`,
+	PurposePasswordReset: `{{define "subject"}}Reset your password on {{.ServerName}}{{end}}
+{{define "body"}}Someone asked to reset the password of the account on {{.ServerName}} with this email address.
+
+To allow the password to be reset, open this link:
+
+{{.Link}}
+
+If it wasn't you, you can ignore this email and your password won't be changed.
+{{end}}`,
+	PurposeAddThreePID: `{{define "subject"}}Validate your email address for {{.ServerName}}{{end}}
+{{define "body"}}Someone asked to add this email address to an account on {{.ServerName}}.
+
+To allow the email address to be added, open this link:
+
+{{.Link}}
+
+If it wasn't you, you can ignore this email.
+{{end}}`,
+}
+
+var (
+	// ErrInvalidToken is returned when a token doesn't match the session
+	// that it was submitted for, or has expired.
+	ErrInvalidToken = errors.New("the token is invalid or has expired")
+	// ErrInvalidEmailAddress is returned when asked to send a token to
+	// something which isn't a plain email address.
+	ErrInvalidEmailAddress = errors.New("invalid email address")
+)
+
+// emailTemplateData is what the email templates are executed with.
+type emailTemplateData struct {
+	ServerName gomatrixserverlib.ServerName
+	Address    string
+	Link       string
+	Token      string
+}
+
+// EmailValidator validates that users own email addresses, by emailing them a
+// token which they have to submit back to us.
+type EmailValidator struct {
+	cfg        *config.Email
+	serverName gomatrixserverlib.ServerName
+	submitURL  string
+	from       string
+	sessions   *ValidationSessions
+	templates  map[string]*template.Template
+	sendMail   func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+	now        func() time.Time
+}
+
+// NewEmailValidator returns an EmailValidator which keeps its sessions in the
+// given store. It fails if the templates or the from address aren't valid.
+func NewEmailValidator(cfg *config.ClientAPI, sessions *ValidationSessions) (*EmailValidator, error) {
+	from, err := mail.ParseAddress(cfg.Email.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", cfg.Email.From, err)
+	}
+	v := &EmailValidator{
+		cfg:        &cfg.Email,
+		serverName: cfg.Matrix.ServerName,
+		submitURL:  strings.TrimSuffix(cfg.Matrix.WellKnownClientName, "/") + SubmitTokenPath,
+		from:       from.Address,
+		sessions:   sessions,
+		templates:  make(map[string]*template.Template, len(defaultEmailTemplates)),
+		sendMail:   smtp.SendMail,
+		now:        time.Now,
+	}
+	for purpose, text := range defaultEmailTemplates {
+		if cfg.Email.TemplatesPath != "" {
+			data, rerr := os.ReadFile(filepath.Join(cfg.Email.TemplatesPath, purpose+".txt"))
+			switch {
+			case rerr == nil:
+				text = string(data)
+			case !errors.Is(rerr, os.ErrNotExist):
+				return nil, fmt.Errorf("failed to read the %s email template: %w", purpose, rerr)
+			}
+		}
+		t, perr := template.New(purpose).Parse(text)
+		if perr != nil {
+			return nil, fmt.Errorf("invalid %s email template: %w", purpose, perr)
+		}
+		if t.Lookup("subject") == nil || t.Lookup("body") == nil {
+			return nil, fmt.Errorf("the %s email template must define the subject and body templates", purpose)
+		}
+		v.templates[purpose] = t
+	}
+	return v, nil
+}
+
+// SubmitURL returns the URL which tokens can be submitted to.
+func (v *EmailValidator) SubmitURL() string {
+	return v.submitURL
+}
+
+// RequestToken emails a token to the address, for the given purpose, and
+// returns the ID of the validation session. Clients retry requests with the
+// same send attempt, so no email is sent unless the send attempt is higher
+// than the last one for the session, or the session's token has expired.
+func (v *EmailValidator) RequestToken(purpose, clientSecret, address string, sendAttempt int, nextLink string) (string, error) {
+	if _, ok := v.templates[purpose]; !ok {
+		return "", fmt.Errorf("unknown purpose %q", purpose)
+	}
+	// Only accept addresses without names, so that what we store is what
+	// the email is sent to.
+	if parsed, err := mail.ParseAddress(address); err != nil || parsed.Address != address {
+		return "", ErrInvalidEmailAddress
+	}
+	sid := ValidationSessionID(clientSecret, "email", address)
+	session, err := v.sessions.Get(sid)
+	if err != nil {
+		return "", err
+	}
+	now := v.now()
+	if session != nil && sendAttempt <= session.SendAttempt && now.Before(session.ExpiresTS.Time()) {
+		return sid, nil
+	}
+
+	b := make([]byte, emailTokenByteLength)
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+	session = &ValidationSession{
+		SID:          sid,
+		ClientSecret: clientSecret,
+		Medium:       "email",
+		Address:      address,
+		Token:        base64.RawURLEncoding.EncodeToString(b),
+		SendAttempt:  sendAttempt,
+		NextLink:     nextLink,
+		ExpiresTS:    gomatrixserverlib.AsTimestamp(now.Add(v.cfg.TokenLifetime)),
+	}
+	if err = v.sessions.Put(session); err != nil {
+		return "", err
+	}
+	if err = v.send(purpose, session); err != nil {
+		return "", err
+	}
+	return sid, nil
+}
+
+// SubmitToken marks the session as validated if the token is the one which
+// was sent for it, and returns the session.
+func (v *EmailValidator) SubmitToken(sid, clientSecret, token string) (*ValidationSession, error) {
+	session, err := v.sessions.Get(sid)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || session.Medium != "email" ||
+		subtle.ConstantTimeCompare([]byte(session.ClientSecret), []byte(clientSecret)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(session.Token), []byte(token)) != 1 ||
+		!v.now().Before(session.ExpiresTS.Time()) {
+		return nil, ErrInvalidToken
+	}
+	if !session.Validated {
+		session.Validated = true
+		if err = v.sessions.Put(session); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// ValidatedAddress returns the email address of the session if its token has
+// been submitted, or an empty string if it hasn't.
+func (v *EmailValidator) ValidatedAddress(sid, clientSecret string) (string, error) {
+	session, err := v.sessions.Get(sid)
+	if err != nil {
+		return "", err
+	}
+	if session == nil || session.Medium != "email" || !session.Validated ||
+		subtle.ConstantTimeCompare([]byte(session.ClientSecret), []byte(clientSecret)) != 1 {
+		return "", nil
+	}
+	return session.Address, nil
+}
+
+// Forget deletes the session, so that it can't be used again.
+func (v *EmailValidator) Forget(sid string) error {
+	return v.sessions.Delete(sid)
+}
+
+// send emails the token of the session to its address.
+func (v *EmailValidator) send(purpose string, session *ValidationSession) error {
+	to := mail.Address{Address: session.Address}
+	query := url.Values{}
+	query.Set("sid", session.SID)
+	query.Set("client_secret", session.ClientSecret)
+	query.Set("token", session.Token)
+	data := emailTemplateData{
+		ServerName: v.serverName,
+		Address:    to.Address,
+		Link:       v.submitURL + "?" + query.Encode(),
+		Token:      session.Token,
+	}
+	var subject, body bytes.Buffer
+	if err := v.templates[purpose].ExecuteTemplate(&subject, "subject", data); err != nil {
+		return fmt.Errorf("failed to execute the subject template: %w", err)
+	}
+	if err := v.templates[purpose].ExecuteTemplate(&body, "body", data); err != nil {
+		return fmt.Errorf("failed to execute the body template: %w", err)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", v.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(&msg, "Date: %s\r\n", v.now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.TrimLeft(body.String(), "\n"), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if v.cfg.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(v.cfg.SMTPServer)
+		auth = smtp.PlainAuth("", v.cfg.SMTPUsername, v.cfg.SMTPPassword, host)
+	}
+	if err := v.sendMail(v.cfg.SMTPServer, auth, v.from, []string{to.Address}, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package threepid
+
+import (
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+type sentEmail struct {
+	from string
+	to   []string
+	msg  string
+}
+
+func newTestEmailValidator(t *testing.T, templatesPath string) (*EmailValidator, *[]sentEmail) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName:          "localhost",
+			WellKnownClientName: "https://matrix.localhost/",
+		},
+		Email: config.Email{
+			Enabled:       true,
+			SMTPServer:    "smtp.localhost:25",
+			From:          "Dendrite <dendrite@localhost>",
+			TokenLifetime: time.Hour,
+			TemplatesPath: templatesPath,
+		},
+	}
+	v, err := NewEmailValidator(cfg, NewValidationSessions(nil))
+	if err != nil {
+		t.Fatalf("NewEmailValidator failed: %s", err)
+	}
+	var sent []sentEmail
+	v.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, sentEmail{from, to, string(msg)})
+		return nil
+	}
+	return v, &sent
+}
+
+var linkRegexp = regexp.MustCompile(`https://\S+`)
+
+// emailedToken returns the token from the link in the email.
+func emailedToken(t *testing.T, email sentEmail) string {
+	link := linkRegexp.FindString(email.msg)
+	if !strings.HasPrefix(link, "https://matrix.localhost"+SubmitTokenPath+"?") {
+		t.Fatalf("got link %q, want a link to the submit token endpoint", link)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("url.Parse failed: %s", err)
+	}
+	return u.Query().Get("token")
+}
+
+func TestEmailValidatorRequestToken(t *testing.T) {
+	v, sent := newTestEmailValidator(t, "")
+
+	sid, err := v.RequestToken(PurposeRegistration, "secret", "alice@example.com", 1, "")
+	if err != nil {
+		t.Fatalf("RequestToken failed: %s", err)
+	}
+	if len(*sent) != 1 {
+		t.Fatalf("got %d emails, want 1", len(*sent))
+	}
+	email := (*sent)[0]
+	if email.from != "dendrite@localhost" || len(email.to) != 1 || email.to[0] != "alice@example.com" {
+		t.Errorf("got email from %q to %v, want from dendrite@localhost to alice@example.com", email.from, email.to)
+	}
+	if !strings.Contains(email.msg, "Subject: Validate your email address for localhost\r\n") {
+		t.Errorf("got email %q, want the registration subject", email.msg)
+	}
+
+	// Retrying with the same send attempt doesn't send another email.
+	retrySID, err := v.RequestToken(PurposeRegistration, "secret", "alice@example.com", 1, "")
+	if err != nil {
+		t.Fatalf("RequestToken failed: %s", err)
+	}
+	if retrySID != sid || len(*sent) != 1 {
+		t.Errorf("got session %q and %d emails, want session %q and 1 email", retrySID, len(*sent), sid)
+	}
+	// A higher send attempt sends a new token.
+	if _, err = v.RequestToken(PurposeRegistration, "secret", "alice@example.com", 2, ""); err != nil {
+		t.Fatalf("RequestToken failed: %s", err)
+	}
+	if len(*sent) != 2 {
+		t.Fatalf("got %d emails, want 2", len(*sent))
+	}
+	if emailedToken(t, (*sent)[0]) == emailedToken(t, (*sent)[1]) {
+		t.Errorf("got the same token for both send attempts, want a new token")
+	}
+
+	for _, address := range []string{"", "not an address", "Alice <alice@example.com>", "alice@example.com\r\nBcc: mallory@example.com"} {
+		if _, err = v.RequestToken(PurposeRegistration, "secret", address, 1, ""); err != ErrInvalidEmailAddress {
+			t.Errorf("RequestToken(%q): got %v, want ErrInvalidEmailAddress", address, err)
+		}
+	}
+}
+
+func TestEmailValidatorSubmitToken(t *testing.T) {
+	v, sent := newTestEmailValidator(t, "")
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	sid, err := v.RequestToken(PurposePasswordReset, "secret", "alice@example.com", 1, "https://client.localhost")
+	if err != nil {
+		t.Fatalf("RequestToken failed: %s", err)
+	}
+	token := emailedToken(t, (*sent)[0])
+
+	tsts := []struct {
+		Name         string
+		SID          string
+		ClientSecret string
+		Token        string
+	}{
+		{"wrongToken", sid, "secret", "wrong"},
+		{"wrongClientSecret", sid, "other", token},
+		{"unknownSession", "unknown", "secret", token},
+		{"emptyToken", sid, "secret", ""},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if _, err := v.SubmitToken(tst.SID, tst.ClientSecret, tst.Token); err != ErrInvalidToken {
+				t.Errorf("SubmitToken: got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+	if address, _ := v.ValidatedAddress(sid, "secret"); address != "" {
+		t.Fatalf("ValidatedAddress: got %q before the token was submitted, want none", address)
+	}
+
+	session, err := v.SubmitToken(sid, "secret", token)
+	if err != nil {
+		t.Fatalf("SubmitToken failed: %s", err)
+	}
+	if session.NextLink != "https://client.localhost" {
+		t.Errorf("got next link %q, want https://client.localhost", session.NextLink)
+	}
+	if address, _ := v.ValidatedAddress(sid, "other"); address != "" {
+		t.Errorf("ValidatedAddress: got %q with the wrong client secret, want none", address)
+	}
+	if address, _ := v.ValidatedAddress(sid, "secret"); address != "alice@example.com" {
+		t.Errorf("ValidatedAddress: got %q, want alice@example.com", address)
+	}
+
+	if err = v.Forget(sid); err != nil {
+		t.Fatalf("Forget failed: %s", err)
+	}
+	if address, _ := v.ValidatedAddress(sid, "secret"); address != "" {
+		t.Errorf("ValidatedAddress: got %q after the session was forgotten, want none", address)
+	}
+
+	// Tokens can't be submitted once they have expired.
+	sid, err = v.RequestToken(PurposeAddThreePID, "secret", "bob@example.com", 1, "")
+	if err != nil {
+		t.Fatalf("RequestToken failed: %s", err)
+	}
+	token = emailedToken(t, (*sent)[1])
+	now = now.Add(2 * time.Hour)
+	if _, err = v.SubmitToken(sid, "secret", token); err != ErrInvalidToken {
+		t.Errorf("SubmitToken: got %v for an expired token, want ErrInvalidToken", err)
+	}
+}
+
+func TestEmailValidatorTemplates(t *testing.T) {
+	dir := t.TempDir()
+	template := `{{define "subject"}}Welcome to {{.ServerName}}{{end}}{{define "body"}}Your token is {{.Token}}{{end}}`
+	if err := os.WriteFile(filepath.Join(dir, PurposeRegistration+".txt"), []byte(template), 0600); err != nil {
+		t.Fatalf("os.WriteFile failed: %s", err)
+	}
+	v, sent := newTestEmailValidator(t, dir)
+
+	if _, err := v.RequestToken(PurposeRegistration, "secret", "alice@example.com", 1, ""); err != nil {
+		t.Fatalf("RequestToken failed: %s", err)
+	}
+	if _, err := v.RequestToken(PurposePasswordReset, "secret", "bob@example.com", 1, ""); err != nil {
+		t.Fatalf("RequestToken failed: %s", err)
+	}
+	if !strings.Contains((*sent)[0].msg, "Subject: Welcome to localhost\r\n") || !strings.Contains((*sent)[0].msg, "Your token is ") {
+		t.Errorf("got email %q, want the registration template from the templates path", (*sent)[0].msg)
+	}
+	if !strings.Contains((*sent)[1].msg, "Subject: Reset your password on localhost\r\n") {
+		t.Errorf("got email %q, want the builtin password reset template", (*sent)[1].msg)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, PurposeAddThreePID+".txt"), []byte(`{{define "body"}}no subject{{end}}`), 0600); err != nil {
+		t.Fatalf("os.WriteFile failed: %s", err)
+	}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "localhost"},
+		Email:  config.Email{From: "dendrite@localhost", TemplatesPath: dir},
+	}
+	if _, err := NewEmailValidator(cfg, NewValidationSessions(nil)); err == nil {
+		t.Errorf("NewEmailValidator: got nil, want an error for a template without a subject")
+	}
+}
@@ -31,6 +31,7 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
 // MembershipRequest represents the body of an incoming POST request
@@ -102,7 +103,7 @@ func CheckAndProcessInvite(
 		return
 	}
 
-	lookupRes, storeInviteRes, err := queryIDServer(ctx, db, cfg, device, body, roomID)
+	lookupRes, storeInviteRes, err := queryIDServer(ctx, db, cfg, rsAPI, device, body, roomID)
 	if err != nil {
 		return
 	}
@@ -126,35 +127,82 @@ func CheckAndProcessInvite(
 	return
 }
 
+// LookupInvite looks up the Matrix ID which the 3PID of a third-party invite
+// is bound to on the given identity server. Returns an empty Matrix ID if the
+// 3PID isn't bound to one, in which case the invite has to be stored with
+// StoreInvite once the room exists.
+// Returns an error if a check or a request failed.
+func LookupInvite(
+	ctx context.Context, body *MembershipRequest, cfg *config.ClientAPI,
+) (string, error) {
+	lookupRes, err := lookupThreePID(ctx, cfg, body)
+	if err != nil {
+		return "", err
+	}
+	return lookupRes.MXID, nil
+}
+
+// StoreInvite asks the identity server to store a third-party invite for a
+// 3PID which isn't bound to a Matrix ID, and emits the matching
+// "m.room.third_party_invite" event into the room.
+// Returns an error if something failed in the process.
+func StoreInvite(
+	ctx context.Context,
+	device *userapi.Device, body *MembershipRequest, cfg *config.ClientAPI,
+	rsAPI api.RoomserverInternalAPI, db accounts.Database,
+	roomID string,
+	evTime time.Time,
+) error {
+	storeInviteRes, err := queryIDServerStoreInvite(ctx, db, cfg, rsAPI, device, body, roomID)
+	if err != nil {
+		return err
+	}
+	return emit3PIDInviteEvent(ctx, body, storeInviteRes, device, roomID, cfg, rsAPI, evTime)
+}
+
 // queryIDServer handles all the requests to the identity server, starting by
 // looking up the given 3PID on the given identity server.
-// If the lookup returned a Matrix ID, checks if the current time is within the
-// time frame in which the 3PID-MXID association is known to be valid, and checks
-// the response's signatures. If one of the checks fails, returns an error.
 // If the lookup didn't return a Matrix ID, asks the identity server to store
 // the invite and to respond with a token.
 // Returns a representation of the response for both cases.
 // Returns an error if a check or a request failed.
 func queryIDServer(
 	ctx context.Context,
-	db accounts.Database, cfg *config.ClientAPI, device *userapi.Device,
-	body *MembershipRequest, roomID string,
+	db accounts.Database, cfg *config.ClientAPI, rsAPI api.RoomserverInternalAPI,
+	device *userapi.Device, body *MembershipRequest, roomID string,
 ) (lookupRes *idServerLookupResponse, storeInviteRes *idServerStoreInviteResponse, err error) {
-	if err = isTrusted(body.IDServer, cfg); err != nil {
+	lookupRes, err = lookupThreePID(ctx, cfg, body)
+	if err != nil {
 		return
 	}
 
+	if lookupRes.MXID == "" {
+		// No Matrix ID matches with the given 3PID, ask the server to store the
+		// invite and return a token
+		storeInviteRes, err = queryIDServerStoreInvite(ctx, db, cfg, rsAPI, device, body, roomID)
+	}
+	return
+}
+
+// lookupThreePID looks up the given 3PID on the given identity server.
+// If the lookup returned a Matrix ID, checks if the current time is within the
+// time frame in which the 3PID-MXID association is known to be valid, and checks
+// the response's signatures. If one of the checks fails, returns an error.
+func lookupThreePID(
+	ctx context.Context, cfg *config.ClientAPI, body *MembershipRequest,
+) (*idServerLookupResponse, error) {
+	if err := IsTrusted(body.IDServer, cfg); err != nil {
+		return nil, err
+	}
+
 	// Lookup the 3PID
-	lookupRes, err = queryIDServerLookup(ctx, body)
+	lookupRes, err := queryIDServerLookup(ctx, body)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	if lookupRes.MXID == "" {
-		// No Matrix ID matches with the given 3PID, ask the server to store the
-		// invite and return a token
-		storeInviteRes, err = queryIDServerStoreInvite(ctx, db, cfg, device, body, roomID)
-		return
+		return lookupRes, nil
 	}
 
 	// A Matrix ID matches with the given 3PID
@@ -164,15 +212,15 @@ func queryIDServer(
 	if lookupRes.NotBefore > now || now > lookupRes.NotAfter {
 		// If the current timestamp isn't in the time frame in which the association
 		// is known to be valid, re-run the query
-		return queryIDServer(ctx, db, cfg, device, body, roomID)
+		return lookupThreePID(ctx, cfg, body)
 	}
 
 	// Check the request signatures and send an error if one isn't valid
 	if err = checkIDServerSignatures(ctx, body, lookupRes); err != nil {
-		return
+		return nil, err
 	}
 
-	return
+	return lookupRes, nil
 }
 
 // queryIDServerLookup sends a response to the identity server on /_matrix/identity/api/v1/lookup
@@ -206,8 +254,8 @@ func queryIDServerLookup(ctx context.Context, body *MembershipRequest) (*idServe
 // Returns an error if the request failed to send or if the response couldn't be parsed.
 func queryIDServerStoreInvite(
 	ctx context.Context,
-	db accounts.Database, cfg *config.ClientAPI, device *userapi.Device,
-	body *MembershipRequest, roomID string,
+	db accounts.Database, cfg *config.ClientAPI, rsAPI api.RoomserverInternalAPI,
+	device *userapi.Device, body *MembershipRequest, roomID string,
 ) (*idServerStoreInviteResponse, error) {
 	// Retrieve the sender's profile to get their display name
 	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
@@ -233,12 +281,18 @@ func queryIDServerStoreInvite(
 	data.Add("room_id", roomID)
 	data.Add("sender", device.UserID)
 	data.Add("sender_display_name", profile.DisplayName)
-	// TODO: Also send:
-	//      - The room name (room_name)
-	//      - The room's avatar url (room_avatar_url)
-	//      See https://github.com/matrix-org/sydent/blob/master/sydent/http/servlets/store_invite_servlet.py#L82-L91
-	//      These can be easily retrieved by requesting the public rooms API
-	//      server's database.
+	data.Add("sender_avatar_url", profile.AvatarURL)
+
+	// The identity server uses the details of the room in the message it
+	// sends to the invitee.
+	// See https://github.com/matrix-org/sydent/blob/master/sydent/http/servlets/store_invite_servlet.py#L82-L91
+	roomDetails, err := queryRoomDetails(ctx, rsAPI, roomID)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range roomDetails {
+		data.Add(key, value)
+	}
 
 	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/store-invite", body.IDServer)
 	req, err := http.NewRequest(http.MethodPost, requestURL, strings.NewReader(data.Encode()))
@@ -262,6 +316,49 @@ func queryIDServerStoreInvite(
 	return &idResp, err
 }
 
+// queryRoomDetails returns the name, avatar, canonical alias and join rule of
+// the room, keyed by the parameter names used by /store-invite. Details which
+// aren't set in the room are left out.
+func queryRoomDetails(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID string,
+) (map[string]string, error) {
+	tuples := map[gomatrixserverlib.StateKeyTuple]string{
+		{EventType: gomatrixserverlib.MRoomName, StateKey: ""}:           "room_name",
+		{EventType: "m.room.avatar", StateKey: ""}:                       "room_avatar_url",
+		{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}: "room_alias",
+		{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}:      "room_join_rules",
+	}
+	req := api.QueryCurrentStateRequest{
+		RoomID: roomID,
+	}
+	for tuple := range tuples {
+		req.StateTuples = append(req.StateTuples, tuple)
+	}
+	var res api.QueryCurrentStateResponse
+	if err := rsAPI.QueryCurrentState(ctx, &req, &res); err != nil {
+		return nil, err
+	}
+
+	details := map[string]string{}
+	for tuple, ev := range res.StateEvents {
+		var value string
+		switch tuple.EventType {
+		case gomatrixserverlib.MRoomName:
+			value = gjson.GetBytes(ev.Content(), "name").Str
+		case "m.room.avatar":
+			value = gjson.GetBytes(ev.Content(), "url").Str
+		case gomatrixserverlib.MRoomCanonicalAlias:
+			value = gjson.GetBytes(ev.Content(), "alias").Str
+		case gomatrixserverlib.MRoomJoinRules:
+			value = gjson.GetBytes(ev.Content(), "join_rule").Str
+		}
+		if value != "" {
+			details[tuples[tuple]] = value
+		}
+	}
+	return details, nil
+}
+
 // queryIDServerPubKey requests a public key identified with a given ID to the
 // a given identity server and returns the matching base64-decoded public key.
 // We assume that the ID server is trusted at this point.
@@ -0,0 +1,108 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"context"
+	"crypto/subtle"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// MSISDNValidator validates that users own phone numbers, by asking the
+// configured identity server to text them a token. The sessions which we
+// create on the identity server are tracked, so that only those can be used
+// to register, and so that the identity server which a session is on is
+// remembered even if the configuration changes.
+type MSISDNValidator struct {
+	cfg              *config.ClientAPI
+	sessions         *ValidationSessions
+	createSession    func(ctx context.Context, req MSISDNAssociationRequest, cfg *config.ClientAPI) (*MSISDNSession, error)
+	checkAssociation func(ctx context.Context, creds Credentials, cfg *config.ClientAPI) (bool, string, string, error)
+}
+
+// NewMSISDNValidator returns an MSISDNValidator which keeps its sessions in
+// the given store.
+func NewMSISDNValidator(cfg *config.ClientAPI, sessions *ValidationSessions) *MSISDNValidator {
+	return &MSISDNValidator{
+		cfg:              cfg,
+		sessions:         sessions,
+		createSession:    CreateMSISDNSession,
+		checkAssociation: CheckAssociation,
+	}
+}
+
+// msisdnSessionKey returns the key of our record of a session on the identity
+// server. The key includes the client secret so that the sessions of other
+// clients can't be looked up.
+func msisdnSessionKey(sid, clientSecret string) string {
+	return ValidationSessionID(clientSecret, "msisdn", sid)
+}
+
+// RequestToken asks the identity server to text a token to the phone number,
+// and returns the session on the identity server. The identity server decides
+// whether to send another text message when the request is retried.
+func (v *MSISDNValidator) RequestToken(ctx context.Context, req MSISDNAssociationRequest) (*MSISDNSession, error) {
+	req.IDServer = v.cfg.MSISDN.IdentityServer
+	session, err := v.createSession(ctx, req, v.cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = v.sessions.Put(&ValidationSession{
+		SID:          msisdnSessionKey(session.SID, req.Secret),
+		ClientSecret: req.Secret,
+		Medium:       "msisdn",
+		Address:      session.MSISDN,
+		SendAttempt:  req.SendAttempt,
+		NextLink:     req.NextLink,
+		IDServer:     req.IDServer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// ValidatedMSISDN returns the phone number of the session if the user has
+// submitted its token to the identity server, or an empty string if they
+// haven't or the session wasn't created by RequestToken.
+func (v *MSISDNValidator) ValidatedMSISDN(ctx context.Context, sid, clientSecret string) (string, error) {
+	session, err := v.sessions.Get(msisdnSessionKey(sid, clientSecret))
+	if err != nil {
+		return "", err
+	}
+	if session == nil || session.Medium != "msisdn" ||
+		subtle.ConstantTimeCompare([]byte(session.ClientSecret), []byte(clientSecret)) != 1 {
+		return "", nil
+	}
+	creds := Credentials{
+		SID:      sid,
+		IDServer: session.IDServer,
+		Secret:   clientSecret,
+	}
+	verified, address, medium, err := v.checkAssociation(ctx, creds, v.cfg)
+	if err != nil {
+		return "", err
+	}
+	if !verified || medium != "msisdn" {
+		return "", nil
+	}
+	return address, nil
+}
+
+// Forget deletes our record of the session, so that it can't be used again.
+func (v *MSISDNValidator) Forget(sid, clientSecret string) error {
+	return v.sessions.Delete(msisdnSessionKey(sid, clientSecret))
+}
@@ -0,0 +1,72 @@
+package threepid
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestMSISDNValidator(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{TrustedIDServers: []string{"id.localhost"}},
+		MSISDN: config.MSISDN{Enabled: true, IdentityServer: "id.localhost"},
+	}
+	v := NewMSISDNValidator(cfg, NewValidationSessions(nil))
+	var created []MSISDNAssociationRequest
+	v.createSession = func(ctx context.Context, req MSISDNAssociationRequest, cfg *config.ClientAPI) (*MSISDNSession, error) {
+		created = append(created, req)
+		return &MSISDNSession{SID: "1234", MSISDN: "447700900000"}, nil
+	}
+	validated := map[string]bool{}
+	v.checkAssociation = func(ctx context.Context, creds Credentials, cfg *config.ClientAPI) (bool, string, string, error) {
+		if creds.IDServer != "id.localhost" {
+			t.Errorf("got identity server %q, want id.localhost", creds.IDServer)
+		}
+		if !validated[creds.SID] {
+			return false, "", "", nil
+		}
+		return true, "447700900000", "msisdn", nil
+	}
+
+	ctx := context.Background()
+	session, err := v.RequestToken(ctx, MSISDNAssociationRequest{
+		IDServer:    "other.localhost",
+		Secret:      "secret",
+		Country:     "GB",
+		PhoneNumber: "07700 900000",
+		SendAttempt: 1,
+	})
+	if err != nil {
+		t.Fatalf("RequestToken failed: %s", err)
+	}
+	if session.SID != "1234" {
+		t.Errorf("got session %q, want 1234", session.SID)
+	}
+	if len(created) != 1 || created[0].IDServer != "id.localhost" {
+		t.Fatalf("got requests %+v, want one request to id.localhost", created)
+	}
+
+	if msisdn, _ := v.ValidatedMSISDN(ctx, "1234", "secret"); msisdn != "" {
+		t.Errorf("ValidatedMSISDN: got %q before the token was submitted, want none", msisdn)
+	}
+	validated["1234"] = true
+	validated["5678"] = true
+	if msisdn, _ := v.ValidatedMSISDN(ctx, "1234", "secret"); msisdn != "447700900000" {
+		t.Errorf("ValidatedMSISDN: got %q, want 447700900000", msisdn)
+	}
+	if msisdn, _ := v.ValidatedMSISDN(ctx, "1234", "other"); msisdn != "" {
+		t.Errorf("ValidatedMSISDN: got %q with the wrong client secret, want none", msisdn)
+	}
+	// Sessions which we didn't create can't be used.
+	if msisdn, _ := v.ValidatedMSISDN(ctx, "5678", "secret"); msisdn != "" {
+		t.Errorf("ValidatedMSISDN: got %q for an unknown session, want none", msisdn)
+	}
+
+	if err = v.Forget("1234", "secret"); err != nil {
+		t.Fatalf("Forget failed: %s", err)
+	}
+	if msisdn, _ := v.ValidatedMSISDN(ctx, "1234", "secret"); msisdn != "" {
+		t.Errorf("ValidatedMSISDN: got %q after the session was forgotten, want none", msisdn)
+	}
+}
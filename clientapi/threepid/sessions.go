@@ -0,0 +1,153 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+)
+
+// ValidationSession is an attempt to validate that a user owns a 3PID, which
+// we sent a token to.
+type ValidationSession struct {
+	SID          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Medium       string `json:"medium"`
+	Address      string `json:"address"`
+	Token        string `json:"token"`
+	SendAttempt  int    `json:"send_attempt"`
+	NextLink     string `json:"next_link,omitempty"`
+	// The identity server which sent the token, if we didn't
+	IDServer string `json:"id_server,omitempty"`
+	// The time that the token can't be used after
+	ExpiresTS gomatrixserverlib.Timestamp `json:"expires_ts"`
+	// Whether the token has been submitted
+	Validated bool `json:"validated"`
+}
+
+// ValidationSessionID returns the ID of the session for validating the 3PID
+// with the client secret. Every request for a token with the same client
+// secret and 3PID is part of the same session.
+func ValidationSessionID(clientSecret, medium, address string) string {
+	hash := sha256.Sum256([]byte(clientSecret + "\x00" + medium + "\x00" + address))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// ValidationSessions keeps track of 3PID validation sessions, which are
+// forgotten config.MaxEmailTokenLifetime after they were last stored. If a
+// JetStream key-value bucket is given then sessions are stored there, so that
+// a token can be submitted to any instance of the client API. Otherwise they
+// are kept in memory, which is only suitable when running a single instance.
+type ValidationSessions struct {
+	kv    nats.KeyValue
+	mutex sync.Mutex
+	local map[string]localValidationSession
+}
+
+// localValidationSession is a session which is kept in memory, along with when
+// to forget about it, like the key-value bucket does.
+type localValidationSession struct {
+	session ValidationSession
+	expires time.Time
+}
+
+// NewValidationSessions returns a session store backed by the given key-value
+// bucket, or an in-memory store if kv is nil.
+func NewValidationSessions(kv nats.KeyValue) *ValidationSessions {
+	return &ValidationSessions{
+		kv:    kv,
+		local: make(map[string]localValidationSession),
+	}
+}
+
+// Get returns the session with the given ID, or nil if there isn't one.
+func (s *ValidationSessions) Get(sid string) (*ValidationSession, error) {
+	if s.kv == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		local, ok := s.local[sid]
+		if !ok || time.Now().After(local.expires) {
+			return nil, nil
+		}
+		return &local.session, nil
+	}
+	// Session IDs come from clients, so check that it is one of ours before
+	// using it as a key.
+	if _, err := base64.RawURLEncoding.DecodeString(sid); err != nil || sid == "" {
+		return nil, nil
+	}
+	entry, err := s.kv.Get(sid)
+	switch err {
+	case nil:
+	case nats.ErrKeyNotFound, nats.ErrKeyDeleted:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("s.kv.Get: %w", err)
+	}
+	var session ValidationSession
+	if err = json.Unmarshal(entry.Value(), &session); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return &session, nil
+}
+
+// Put stores the session, replacing any session with the same ID.
+func (s *ValidationSessions) Put(session *ValidationSession) error {
+	if s.kv == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		now := time.Now()
+		for sid, local := range s.local {
+			if now.After(local.expires) {
+				delete(s.local, sid)
+			}
+		}
+		s.local[session.SID] = localValidationSession{
+			session: *session,
+			expires: now.Add(config.MaxEmailTokenLifetime),
+		}
+		return nil
+	}
+	value, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if _, err = s.kv.Put(session.SID, value); err != nil {
+		return fmt.Errorf("s.kv.Put: %w", err)
+	}
+	return nil
+}
+
+// Delete forgets about the session.
+func (s *ValidationSessions) Delete(sid string) error {
+	if s.kv == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.local, sid)
+		return nil
+	}
+	if err := s.kv.Delete(sid); err != nil && err != nats.ErrKeyNotFound {
+		return fmt.Errorf("s.kv.Delete: %w", err)
+	}
+	return nil
+}
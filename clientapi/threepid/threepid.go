@@ -33,6 +33,28 @@ type EmailAssociationRequest struct {
 	Secret      string `json:"client_secret"`
 	Email       string `json:"email"`
 	SendAttempt int    `json:"send_attempt"`
+	NextLink    string `json:"next_link"`
+}
+
+// MSISDNAssociationRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-register-msisdn-requesttoken
+type MSISDNAssociationRequest struct {
+	IDServer    string `json:"id_server"`
+	Secret      string `json:"client_secret"`
+	Country     string `json:"country"`
+	PhoneNumber string `json:"phone_number"`
+	SendAttempt int    `json:"send_attempt"`
+	NextLink    string `json:"next_link"`
+}
+
+// MSISDNSession is the response of an identity server to a request for a
+// token to be sent to a phone number.
+type MSISDNSession struct {
+	SID string `json:"sid"`
+	// The phone number in international format, without a leading +
+	MSISDN string `json:"msisdn"`
+	// Where the client can submit the token, if not the identity server's
+	// default endpoint
+	SubmitURL string `json:"submit_url"`
 }
 
 // EmailAssociationCheckRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-account-3pid
@@ -55,7 +77,7 @@ type Credentials struct {
 func CreateSession(
 	ctx context.Context, req EmailAssociationRequest, cfg *config.ClientAPI,
 ) (string, error) {
-	if err := isTrusted(req.IDServer, cfg); err != nil {
+	if err := IsTrusted(req.IDServer, cfg); err != nil {
 		return "", err
 	}
 
@@ -93,6 +115,53 @@ func CreateSession(
 	return sid.SID, err
 }
 
+// CreateMSISDNSession creates a session on an identity server, which sends a
+// token to the phone number in a text message.
+// Returns an error if there was a problem sending the request or decoding the
+// response, or if the identity server responded with a non-OK status.
+func CreateMSISDNSession(
+	ctx context.Context, req MSISDNAssociationRequest, cfg *config.ClientAPI,
+) (*MSISDNSession, error) {
+	if err := IsTrusted(req.IDServer, cfg); err != nil {
+		return nil, err
+	}
+
+	postURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/validate/msisdn/requestToken", req.IDServer)
+
+	data := url.Values{}
+	data.Add("client_secret", req.Secret)
+	data.Add("country", req.Country)
+	data.Add("phone_number", req.PhoneNumber)
+	data.Add("send_attempt", strconv.Itoa(req.SendAttempt))
+	if req.NextLink != "" {
+		data.Add("next_link", req.NextLink)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, postURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	client := http.Client{}
+	resp, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	// Error if the status isn't OK
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not create a session on the server %s", req.IDServer)
+	}
+
+	var session MSISDNSession
+	if err = json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
 // CheckAssociation checks the status of an ongoing association validation on an
 // identity server.
 // Returns a boolean set to true if the association has been validated, false if not.
@@ -103,7 +172,7 @@ func CreateSession(
 func CheckAssociation(
 	ctx context.Context, creds Credentials, cfg *config.ClientAPI,
 ) (bool, string, string, error) {
-	if err := isTrusted(creds.IDServer, cfg); err != nil {
+	if err := IsTrusted(creds.IDServer, cfg); err != nil {
 		return false, "", "", err
 	}
 
@@ -143,7 +212,7 @@ func CheckAssociation(
 // Returns an error if there was a problem sending the request or decoding the
 // response, or if the identity server responded with a non-OK status.
 func PublishAssociation(creds Credentials, userID string, cfg *config.ClientAPI) error {
-	if err := isTrusted(creds.IDServer, cfg); err != nil {
+	if err := IsTrusted(creds.IDServer, cfg); err != nil {
 		return err
 	}
 
@@ -174,10 +243,10 @@ func PublishAssociation(creds Credentials, userID string, cfg *config.ClientAPI)
 	return nil
 }
 
-// isTrusted checks if a given identity server is part of the list of trusted
+// IsTrusted checks if a given identity server is part of the list of trusted
 // identity servers in the configuration file.
 // Returns an error if the server isn't trusted.
-func isTrusted(idServer string, cfg *config.ClientAPI) error {
+func IsTrusted(idServer string, cfg *config.ClientAPI) error {
 	for _, server := range cfg.Matrix.TrustedIDServers {
 		if idServer == server {
 			return nil
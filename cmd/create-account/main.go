@@ -23,11 +23,13 @@ import (
 	"os"
 	"strings"
 
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/setup"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/term"
 )
 
@@ -35,6 +37,10 @@ const usage = `Usage: %s
 
 Creates a new user account on the homeserver.
 
+The account is written straight to the database named in the config file, so
+this works while the server is stopped, e.g. to create the first admin account.
+Use dendrite-admin to manage accounts on a running server through the admin API.
+
 Example:
 
 	# provide password by parameter
@@ -46,6 +52,8 @@ Example:
 	# read password from stdin
 	%s --config dendrite.yaml -username alice -passwordstdin < my.pass
 	cat my.pass | %s --config dendrite.yaml -username alice -passwordstdin
+	# create an admin account, which can use the admin API
+	%s --config dendrite.yaml -username alice -ask-pass -admin
 
 Arguments:
 
@@ -57,12 +65,13 @@ var (
 	pwdFile  = flag.String("passwordfile", "", "The file to use for the password (e.g. for automated account creation)")
 	pwdStdin = flag.Bool("passwordstdin", false, "Reads the password from stdin")
 	askPass  = flag.Bool("ask-pass", false, "Ask for the password to use")
+	isAdmin  = flag.Bool("admin", false, "Create an admin account, which is allowed to use the admin API")
 )
 
 func main() {
 	name := os.Args[0]
 	flag.Usage = func() {
-		_, _ = fmt.Fprintf(os.Stderr, usage, name, name, name, name, name, name)
+		_, _ = fmt.Fprintf(os.Stderr, usage, name, name, name, name, name, name, name)
 		flag.PrintDefaults()
 	}
 	cfg := setup.ParseFlags(true)
@@ -74,14 +83,23 @@ func main() {
 
 	pass := getPassword(password, pwdFile, pwdStdin, askPass, os.Stdin)
 
+	defaultPushRules, err := pushrules.NewDefaultRuleOverrides(cfg.UserAPI.DefaultPushRules)
+	if err != nil {
+		logrus.Fatalln("Invalid default push rules:", err.Error())
+	}
 	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
 		ConnectionString: cfg.UserAPI.AccountDatabase.ConnectionString,
-	}, cfg.Global.ServerName, bcrypt.DefaultCost, cfg.UserAPI.OpenIDTokenLifetimeMS)
+	}, cfg.Global.ServerName, passwordhash.NewHasher(&cfg.UserAPI), cfg.UserAPI.OpenIDTokenLifetimeMS, defaultPushRules)
 	if err != nil {
 		logrus.Fatalln("Failed to connect to the database:", err.Error())
 	}
 
-	_, err = accountDB.CreateAccount(context.Background(), *username, pass, "")
+	accountType := api.AccountTypeUser
+	if *isAdmin {
+		accountType = api.AccountTypeAdmin
+	}
+
+	_, err = accountDB.CreateAccount(context.Background(), *username, pass, "", accountType)
 	if err != nil {
 		logrus.Fatalln("Failed to create the account:", err.Error())
 	}
@@ -0,0 +1,363 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: %s [options] <command> [command options]
+
+Talks to the Dendrite admin API. Authenticate with either the admin token from
+the config file (global.admin_api.token) or the access token of an admin
+account. The token can also be given in the DENDRITE_ADMIN_TOKEN environment
+variable. Responses are printed as JSON, and the exit code is non-zero if the
+request failed, so the commands can be used in scripts.
+
+Unlike create-account, which writes to the database directly and so works
+while the server is stopped, this only needs the URL of a running server and
+can be used from any machine which can reach it.
+
+Commands:
+
+	version                      Show the server version
+	ratelimits                   Show the current rate limiting settings
+	monthly-active-users         Show the number of users active in the last 30 days
+	create-user                  Create an account
+	deactivate-user <user ID>    Deactivate an account and log out its devices
+	reset-password <user ID>     Set a new password for an account
+	shadow-ban <user ID>         Silently drop the events and invites that a user sends
+	lock-user <user ID>          Lock an account, keeping its devices and rooms
+	federation-queues [servers]  Show the outgoing federation queues
+	event-reports                List events reported by users
+	event-report <report ID>     Show a report along with the reported event
+	resolve-event-report <ID>    Mark a report as resolved
+	purge-room <room ID>         Delete a room and all of its events from the server
+	quarantine-media <server> <media ID>
+	                             Stop the media from being downloaded through the server
+
+Examples:
+
+	%s -token $TOKEN create-user -username alice -passwordstdin < alice.pass
+	%s -token $TOKEN reset-password -passwordstdin -logout-devices @alice:example.com < alice.pass
+	%s -server https://matrix.example.com federation-queues
+	%s event-reports -unresolved -room '!abc:example.com'
+	%s purge-room -force '!abc:example.com'
+	%s quarantine-media -lift example.com abcdefghijklmnop
+
+Options:
+
+`
+
+var (
+	serverURL = flag.String("server", "http://localhost:8008", "The base URL of the Dendrite client API")
+	token     = flag.String("token", "", "The admin token or the access token of an admin account (default $DENDRITE_ADMIN_TOKEN)")
+	timeout   = flag.Duration("timeout", time.Second*30, "How long to wait for the server to respond")
+)
+
+func main() {
+	name := os.Args[0]
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, usage, name, name, name, name, name, name, name)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *token == "" {
+		*token = os.Getenv("DENDRITE_ADMIN_TOKEN")
+	}
+
+	c := &client{
+		baseURL: strings.TrimSuffix(*serverURL, "/"),
+		token:   *token,
+		http:    &http.Client{Timeout: *timeout},
+	}
+	command, args := flag.Arg(0), flag.Args()[1:]
+	var err error
+	switch command {
+	case "version":
+		err = c.do(http.MethodGet, "/server_version", nil)
+	case "ratelimits":
+		err = c.do(http.MethodGet, "/ratelimits", nil)
+	case "monthly-active-users":
+		err = c.do(http.MethodGet, "/monthly_active_users", nil)
+	case "create-user":
+		err = createUser(c, args)
+	case "deactivate-user":
+		err = deactivateUser(c, args)
+	case "reset-password":
+		err = resetPassword(c, args)
+	case "shadow-ban":
+		err = shadowBan(c, args)
+	case "lock-user":
+		err = lockUser(c, args)
+	case "federation-queues":
+		query := url.Values{}
+		for _, serverName := range args {
+			query.Add("server_name", serverName)
+		}
+		path := "/federation/queues"
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+		err = c.do(http.MethodGet, path, nil)
+	case "event-reports":
+		err = eventReports(c, args)
+	case "event-report":
+		if len(args) != 1 {
+			err = fmt.Errorf("expected a single report ID")
+			break
+		}
+		err = c.do(http.MethodGet, "/event_reports/"+url.PathEscape(args[0]), nil)
+	case "resolve-event-report":
+		if len(args) != 1 {
+			err = fmt.Errorf("expected a single report ID")
+			break
+		}
+		err = c.do(http.MethodPost, "/event_reports/"+url.PathEscape(args[0])+"/resolve", struct{}{})
+	case "purge-room":
+		err = purgeRoom(c, args)
+	case "quarantine-media":
+		err = quarantineMedia(c, args)
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func createUser(c *client, args []string) error {
+	fs := flag.NewFlagSet("create-user", flag.ExitOnError)
+	username := fs.String("username", "", "The localpart of the account to create, e.g. 'alice' for '@alice:example.com'")
+	password := fs.String("password", "", "The password for the account (the account will be password-less if not given)")
+	pwdStdin := fs.Bool("passwordstdin", false, "Read the password from stdin")
+	admin := fs.Bool("admin", false, "Create an admin account, which is allowed to use the admin API")
+	_ = fs.Parse(args)
+	if *username == "" {
+		return fmt.Errorf("-username is required")
+	}
+	pass, err := readPassword(*password, *pwdStdin, os.Stdin)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, "/users", map[string]interface{}{
+		"username": *username,
+		"password": pass,
+		"admin":    *admin,
+	})
+}
+
+func deactivateUser(c *client, args []string) error {
+	fs := flag.NewFlagSet("deactivate-user", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single user ID")
+	}
+	return c.do(http.MethodPost, "/users/"+url.PathEscape(fs.Arg(0))+"/deactivate", struct{}{})
+}
+
+func shadowBan(c *client, args []string) error {
+	fs := flag.NewFlagSet("shadow-ban", flag.ExitOnError)
+	lift := fs.Bool("lift", false, "Lift the shadow-ban instead")
+	show := fs.Bool("show", false, "Only show whether the user is shadow-banned")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single user ID")
+	}
+	path := "/users/" + url.PathEscape(fs.Arg(0)) + "/shadow_ban"
+	switch {
+	case *show:
+		return c.do(http.MethodGet, path, nil)
+	case *lift:
+		return c.do(http.MethodDelete, path, nil)
+	}
+	return c.do(http.MethodPost, path, struct{}{})
+}
+
+func lockUser(c *client, args []string) error {
+	fs := flag.NewFlagSet("lock-user", flag.ExitOnError)
+	unlock := fs.Bool("unlock", false, "Unlock the account instead")
+	show := fs.Bool("show", false, "Only show whether the account is locked")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single user ID")
+	}
+	path := "/users/" + url.PathEscape(fs.Arg(0)) + "/lock"
+	switch {
+	case *show:
+		return c.do(http.MethodGet, path, nil)
+	case *unlock:
+		return c.do(http.MethodDelete, path, nil)
+	}
+	return c.do(http.MethodPost, path, struct{}{})
+}
+
+func purgeRoom(c *client, args []string) error {
+	fs := flag.NewFlagSet("purge-room", flag.ExitOnError)
+	force := fs.Bool("force", false, "Purge the room even if local users are still joined to it")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single room ID")
+	}
+	return c.do(http.MethodPost, "/rooms/"+url.PathEscape(fs.Arg(0))+"/purge", map[string]interface{}{
+		"force": *force,
+	})
+}
+
+func quarantineMedia(c *client, args []string) error {
+	fs := flag.NewFlagSet("quarantine-media", flag.ExitOnError)
+	lift := fs.Bool("lift", false, "Lift the quarantine instead")
+	show := fs.Bool("show", false, "Only show whether the media is quarantined")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("expected a server name and a media ID")
+	}
+	path := "/media/" + url.PathEscape(fs.Arg(0)) + "/" + url.PathEscape(fs.Arg(1)) + "/quarantine"
+	switch {
+	case *show:
+		return c.do(http.MethodGet, path, nil)
+	case *lift:
+		return c.do(http.MethodDelete, path, nil)
+	}
+	return c.do(http.MethodPost, path, struct{}{})
+}
+
+func resetPassword(c *client, args []string) error {
+	fs := flag.NewFlagSet("reset-password", flag.ExitOnError)
+	password := fs.String("password", "", "The new password")
+	pwdStdin := fs.Bool("passwordstdin", false, "Read the new password from stdin")
+	logout := fs.Bool("logout-devices", false, "Log out all of the user's devices")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a single user ID")
+	}
+	pass, err := readPassword(*password, *pwdStdin, os.Stdin)
+	if err != nil {
+		return err
+	}
+	if pass == "" {
+		return fmt.Errorf("one of -password or -passwordstdin is required")
+	}
+	return c.do(http.MethodPost, "/users/"+url.PathEscape(fs.Arg(0))+"/password", map[string]interface{}{
+		"password":       pass,
+		"logout_devices": *logout,
+	})
+}
+
+func eventReports(c *client, args []string) error {
+	fs := flag.NewFlagSet("event-reports", flag.ExitOnError)
+	roomID := fs.String("room", "", "Only list reports for events in this room")
+	unresolved := fs.Bool("unresolved", false, "Only list reports which haven't been resolved yet")
+	from := fs.Int64("from", 0, "The number of reports to skip, as given by next_token in the previous response")
+	limit := fs.Int("limit", 0, "The maximum number of reports to list (default decided by the server)")
+	_ = fs.Parse(args)
+	query := url.Values{}
+	if *roomID != "" {
+		query.Set("room_id", *roomID)
+	}
+	if *unresolved {
+		query.Set("resolved", "false")
+	}
+	if *from > 0 {
+		query.Set("from", fmt.Sprint(*from))
+	}
+	if *limit > 0 {
+		query.Set("limit", fmt.Sprint(*limit))
+	}
+	path := "/event_reports"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return c.do(http.MethodGet, path, nil)
+}
+
+func readPassword(password string, fromStdin bool, r io.Reader) (string, error) {
+	if !fromStdin {
+		return password, nil
+	}
+	if password != "" {
+		return "", fmt.Errorf("only one of -password or -passwordstdin can be given")
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read password from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+type client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// do makes a request to the admin API and prints the response to stdout.
+// Returns an error if the request fails or the server returns an error.
+func (c *client) do(method, path string, body interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.baseURL+"/_dendrite/admin/v1"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, data, "", "  ") == nil {
+		data = pretty.Bytes()
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s failed with HTTP %d: %s", method, path, res.StatusCode, data)
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(data))
+	return err
+}
@@ -0,0 +1,35 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package personalities
+
+import (
+	"github.com/matrix-org/dendrite/clientapi/consumers"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	basepkg "github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/sirupsen/logrus"
+)
+
+// rateLimits creates the rate limits for a component other than the client
+// API, which also applies the settings that are changed through the admin API
+// of the client API.
+func rateLimits(base *basepkg.BaseDendrite) *httputil.RateLimits {
+	rateLimits := httputil.NewRateLimits(&base.Cfg.ClientAPI.RateLimiting)
+	js := jetstream.Prepare(&base.Cfg.Global.JetStream)
+	if err := consumers.NewOutputRateLimitsConsumer(&base.Cfg.ClientAPI, js, rateLimits).Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start rate limits consumer")
+	}
+	return rateLimits
+}
@@ -15,11 +15,17 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 
+	"github.com/matrix-org/dendrite/internal/pushgateway"
 	"github.com/matrix-org/dendrite/internal/test"
 )
 
@@ -38,6 +44,7 @@ var (
 	authorityCertFile = flag.String("tls-authority-cert", "", "Optional: Create TLS certificate/keys based on this CA authority. Useful for integration testing.")
 	authorityKeyFile  = flag.String("tls-authority-key", "", "Optional: Create TLS certificate/keys based on this CA authority. Useful for integration testing.")
 	serverName        = flag.String("server", "", "Optional: Create TLS certificate/keys with this domain name set. Useful for integration testing.")
+	vapidKeyFile      = flag.String("vapid-key", "", "A VAPID private key to generate for signing WebPush notifications")
 )
 
 func main() {
@@ -48,7 +55,7 @@ func main() {
 
 	flag.Parse()
 
-	if *tlsCertFile == "" && *tlsKeyFile == "" && *privateKeyFile == "" {
+	if *tlsCertFile == "" && *tlsKeyFile == "" && *privateKeyFile == "" && *vapidKeyFile == "" {
 		flag.Usage()
 		return
 	}
@@ -77,4 +84,27 @@ func main() {
 		}
 		fmt.Printf("Created private key file: %s\n", *privateKeyFile)
 	}
+
+	if *vapidKeyFile != "" {
+		publicKey, err := newVAPIDKey(*vapidKeyFile)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Created VAPID key file:   %s\n", *vapidKeyFile)
+		fmt.Printf("VAPID public key:         %s\n", publicKey)
+	}
+}
+
+// newVAPIDKey writes a new VAPID private key to the file in the format used
+// by the config, and returns the public key which browsers subscribe with.
+func newVAPIDKey(path string) (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32)))
+	if err = ioutil.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return "", err
+	}
+	return pushgateway.VAPIDPublicKey(key), nil
 }
@@ -8,6 +8,8 @@ import (
 	"log"
 	"os"
 
+	pgkeyserver "github.com/matrix-org/dendrite/keyserver/storage/postgres/deltas"
+	slkeyserver "github.com/matrix-org/dendrite/keyserver/storage/sqlite3/deltas"
 	pgaccounts "github.com/matrix-org/dendrite/userapi/storage/accounts/postgres/deltas"
 	slaccounts "github.com/matrix-org/dendrite/userapi/storage/accounts/sqlite3/deltas"
 	pgdevices "github.com/matrix-org/dendrite/userapi/storage/devices/postgres/deltas"
@@ -143,18 +145,28 @@ Commands:
 
 func loadSQLiteDeltas(component string) {
 	switch component {
+	case KeyServer:
+		slkeyserver.LoadFromGoose()
+		slkeyserver.LoadFromGooseAddKeyChangesTimestamp()
 	case UserAPIAccounts:
 		slaccounts.LoadFromGoose()
+		slaccounts.LoadFromGooseAddAccountType()
 	case UserAPIDevices:
 		sldevices.LoadFromGoose()
+		sldevices.LoadFromGooseRefreshTokens()
 	}
 }
 
 func loadPostgresDeltas(component string) {
 	switch component {
+	case KeyServer:
+		pgkeyserver.LoadFromGoose()
+		pgkeyserver.LoadFromGooseAddKeyChangesTimestamp()
 	case UserAPIAccounts:
 		pgaccounts.LoadFromGoose()
+		pgaccounts.LoadFromGooseAddAccountType()
 	case UserAPIDevices:
 		pgdevices.LoadFromGoose()
+		pgdevices.LoadFromGooseRefreshTokens()
 	}
 }
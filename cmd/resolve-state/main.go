@@ -40,7 +40,7 @@ func main() {
 
 	fmt.Println("Fetching", len(snapshotNIDs), "snapshot NIDs")
 
-	cache, err := caching.NewInMemoryLRUCache(true)
+	cache, err := caching.NewInMemoryLRUCache(&cfg.Global.Cache, true)
 	if err != nil {
 		panic(err)
 	}
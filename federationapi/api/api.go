@@ -62,6 +62,12 @@ type FederationInternalAPI interface {
 		request *QueryJoinedHostServerNamesInRoomRequest,
 		response *QueryJoinedHostServerNamesInRoomResponse,
 	) error
+	// Query the state of the outgoing federation queues, for the admin API.
+	QueryFederationQueues(
+		ctx context.Context,
+		request *QueryFederationQueuesRequest,
+		response *QueryFederationQueuesResponse,
+	) error
 	// Handle an instruction to make_join & send_join with a remote server.
 	PerformJoin(
 		ctx context.Context,
@@ -137,6 +143,28 @@ type PerformDirectoryLookupResponse struct {
 	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
 }
 
+// QueryFederationQueuesRequest is a request to QueryFederationQueues
+type QueryFederationQueuesRequest struct {
+	// The destinations to report on. If empty, all destinations which have
+	// pending PDUs or EDUs are reported.
+	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
+}
+
+// FederationQueue describes the outgoing queue for a single destination.
+type FederationQueue struct {
+	ServerName   gomatrixserverlib.ServerName `json:"server_name"`
+	PendingPDUs  int64                        `json:"pending_pdus"`
+	PendingEDUs  int64                        `json:"pending_edus"`
+	BackingOff   bool                         `json:"backing_off"`
+	RetryAfterTS gomatrixserverlib.Timestamp  `json:"retry_after_ts,omitempty"`
+	Blacklisted  bool                         `json:"blacklisted"`
+}
+
+// QueryFederationQueuesResponse is a response to QueryFederationQueues
+type QueryFederationQueuesResponse struct {
+	Queues []FederationQueue `json:"queues"`
+}
+
 type PerformJoinRequest struct {
 	RoomID string `json:"room_id"`
 	UserID string `json:"user_id"`
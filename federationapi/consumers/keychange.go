@@ -55,7 +55,7 @@ func NewKeyChangeConsumer(
 	return &KeyChangeConsumer{
 		ctx:        process.Context(),
 		jetstream:  js,
-		durable:    cfg.Matrix.JetStream.TopicFor("FederationAPIKeyChangeConsumer"),
+		durable:    cfg.Matrix.JetStream.Durable("FederationAPIKeyChangeConsumer"),
 		topic:      cfg.Matrix.JetStream.TopicFor(jetstream.OutputKeyChangeEvent),
 		queues:     queues,
 		db:         store,
@@ -80,7 +80,7 @@ func (t *KeyChangeConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
 		logrus.WithError(err).Errorf("failed to read device message from key change topic")
 		return true
 	}
-	if m.DeviceKeys == nil && m.OutputCrossSigningKeyUpdate == nil {
+	if m.DeviceKeys == nil && m.OutputCrossSigningKeyUpdate == nil && m.OneTimeKeysCount == nil {
 		// This probably shouldn't happen but stops us from panicking if we come
 		// across an update that doesn't satisfy either types.
 		return true
@@ -88,6 +88,9 @@ func (t *KeyChangeConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
 	switch m.Type {
 	case api.TypeCrossSigningUpdate:
 		return t.onCrossSigningMessage(m)
+	case api.TypeOneTimeKeysCountUpdate:
+		// Other servers don't need to know about our one-time keys.
+		return true
 	case api.TypeDeviceKeyUpdate:
 		fallthrough
 	default:
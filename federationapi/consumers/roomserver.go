@@ -118,6 +118,14 @@ func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msg *nats.Msg)
 			"received new invite, send device keys",
 		)
 
+	case api.OutputTypePurgeRoom:
+		// Forgetting the joined hosts of the room means that nothing will be
+		// sent to other servers for it any more.
+		if err := s.db.PurgeRoomState(s.ctx, output.PurgeRoom.RoomID); err != nil {
+			log.WithError(err).Errorf("roomserver output log: purge room state failure")
+			return false
+		}
+
 	case api.OutputTypeNewInboundPeek:
 		if err := s.processInboundPeek(*output.NewInboundPeek); err != nil {
 			log.WithFields(log.Fields{
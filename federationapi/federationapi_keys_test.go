@@ -63,7 +63,7 @@ func TestMain(m *testing.M) {
 		}
 
 		// Create a new cache but don't enable prometheus!
-		s.cache, err = caching.NewInMemoryLRUCache(false)
+		s.cache, err = caching.NewInMemoryLRUCache(nil, false)
 		if err != nil {
 			panic("can't create cache: " + err.Error())
 		}
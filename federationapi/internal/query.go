@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/dendrite/federationapi/api"
@@ -25,6 +26,59 @@ func (f *FederationInternalAPI) QueryJoinedHostServerNamesInRoom(
 	return
 }
 
+// QueryFederationQueues implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryFederationQueues(
+	ctx context.Context,
+	request *api.QueryFederationQueuesRequest,
+	response *api.QueryFederationQueuesResponse,
+) error {
+	serverNames := request.ServerNames
+	if len(serverNames) == 0 {
+		pduServerNames, err := f.db.GetPendingPDUServerNames(ctx)
+		if err != nil {
+			return fmt.Errorf("f.db.GetPendingPDUServerNames: %w", err)
+		}
+		eduServerNames, err := f.db.GetPendingEDUServerNames(ctx)
+		if err != nil {
+			return fmt.Errorf("f.db.GetPendingEDUServerNames: %w", err)
+		}
+		seen := map[gomatrixserverlib.ServerName]bool{}
+		for _, serverName := range append(pduServerNames, eduServerNames...) {
+			if !seen[serverName] {
+				seen[serverName] = true
+				serverNames = append(serverNames, serverName)
+			}
+		}
+		sort.Slice(serverNames, func(i, j int) bool {
+			return serverNames[i] < serverNames[j]
+		})
+	}
+	response.Queues = make([]api.FederationQueue, 0, len(serverNames))
+	for _, serverName := range serverNames {
+		pdus, err := f.db.GetPendingPDUCount(ctx, serverName)
+		if err != nil {
+			return fmt.Errorf("f.db.GetPendingPDUCount: %w", err)
+		}
+		edus, err := f.db.GetPendingEDUCount(ctx, serverName)
+		if err != nil {
+			return fmt.Errorf("f.db.GetPendingEDUCount: %w", err)
+		}
+		queue := api.FederationQueue{
+			ServerName:  serverName,
+			PendingPDUs: pdus,
+			PendingEDUs: edus,
+		}
+		until, blacklisted := f.statistics.ForServer(serverName).BackoffInfo()
+		queue.Blacklisted = blacklisted
+		if until != nil && until.After(time.Now()) {
+			queue.BackingOff = true
+			queue.RetryAfterTS = gomatrixserverlib.AsTimestamp(*until)
+		}
+		response.Queues = append(response.Queues, queue)
+	}
+	return nil
+}
+
 func (a *FederationInternalAPI) fetchServerKeysDirectly(ctx context.Context, serverName gomatrixserverlib.ServerName) (*gomatrixserverlib.ServerKeys, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
@@ -17,6 +17,7 @@ import (
 const (
 	FederationAPIQueryJoinedHostServerNamesInRoomPath = "/federationapi/queryJoinedHostServerNamesInRoom"
 	FederationAPIQueryServerKeysPath                  = "/federationapi/queryServerKeys"
+	FederationAPIQueryFederationQueuesPath            = "/federationapi/queryFederationQueues"
 
 	FederationAPIPerformDirectoryLookupRequestPath = "/federationapi/performDirectoryLookup"
 	FederationAPIPerformJoinRequestPath            = "/federationapi/performJoinRequest"
@@ -122,6 +123,19 @@ func (h *httpFederationInternalAPI) QueryJoinedHostServerNamesInRoom(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryFederationQueues implements FederationInternalAPI
+func (h *httpFederationInternalAPI) QueryFederationQueues(
+	ctx context.Context,
+	request *api.QueryFederationQueuesRequest,
+	response *api.QueryFederationQueuesResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryFederationQueues")
+	defer span.Finish()
+
+	apiURL := h.federationAPIURL + FederationAPIQueryFederationQueuesPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // Handle an instruction to make_join & send_join with a remote server.
 func (h *httpFederationInternalAPI) PerformJoin(
 	ctx context.Context,
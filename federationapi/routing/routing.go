@@ -29,7 +29,6 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
-	"github.com/sirupsen/logrus"
 )
 
 // Setup registers HTTP handlers with the given ServeMux.
@@ -41,7 +40,7 @@ import (
 // applied:
 // nolint: gocyclo
 func Setup(
-	fedMux, keyMux, wkMux *mux.Router,
+	fedMux, keyMux *mux.Router,
 	cfg *config.FederationAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	eduAPI eduserverAPI.EDUServerInputAPI,
@@ -52,6 +51,7 @@ func Setup(
 	keyAPI keyserverAPI.KeyInternalAPI,
 	mscCfg *config.MSCs,
 	servers federationAPI.ServersInRoomProvider,
+	rateLimits *httputil.RateLimits,
 ) {
 	v2keysmux := keyMux.PathPrefix("/v2").Subrouter()
 	v1fedmux := fedMux.PathPrefix("/v1").Subrouter()
@@ -85,21 +85,6 @@ func Setup(
 		return NotaryKeys(req, cfg, fsAPI, pkReq)
 	})
 
-	if cfg.Matrix.WellKnownServerName != "" {
-		logrus.Infof("Setting m.server as %s at /.well-known/matrix/server", cfg.Matrix.WellKnownServerName)
-		wkMux.Handle("/server", httputil.MakeExternalAPI("wellknown", func(req *http.Request) util.JSONResponse {
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: struct {
-					ServerName string `json:"m.server"`
-				}{
-					ServerName: cfg.Matrix.WellKnownServerName,
-				},
-			}
-		}),
-		).Methods(http.MethodGet, http.MethodOptions)
-	}
-
 	// Ignore the {keyID} argument as we only have a single server key so we always
 	// return that key.
 	// Even if we had more than one server key, we would probably still ignore the
@@ -114,6 +99,9 @@ func Setup(
 	v1fedmux.Handle("/send/{txnID}", httputil.MakeFedAPI(
 		"federation_send", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			if r := rateLimits.LimitFederation(httpReq, request.Origin()); r != nil {
+				return *r
+			}
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
 				cfg, rsAPI, eduAPI, keyAPI, keys, federation, mu, servers,
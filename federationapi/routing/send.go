@@ -399,6 +399,14 @@ func (t *txnReq) processSigningKeyUpdate(ctx context.Context, e gomatrixserverli
 		}).Debug("Failed to unmarshal signing key update")
 		return err
 	}
+	_, domain, err := gomatrixserverlib.SplitID('@', updatePayload.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != t.Origin {
+		util.GetLogger(ctx).Debugf("Dropping signing key update where user domain (%q) doesn't match origin (%q)", domain, t.Origin)
+		return nil
+	}
 
 	keys := gomatrixserverlib.CrossSigningKeys{}
 	if updatePayload.MasterKey != nil {
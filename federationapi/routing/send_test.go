@@ -10,6 +10,7 @@ import (
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/test"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -91,6 +92,19 @@ func (o *testEDUProducer) InputCrossSigningKeyUpdate(
 	return nil
 }
 
+type testKeyAPI struct {
+	keyapi.KeyInternalAPI
+	uploads []keyapi.PerformUploadDeviceKeysRequest
+}
+
+func (k *testKeyAPI) PerformUploadDeviceKeys(
+	ctx context.Context,
+	req *keyapi.PerformUploadDeviceKeysRequest,
+	res *keyapi.PerformUploadDeviceKeysResponse,
+) {
+	k.uploads = append(k.uploads, *req)
+}
+
 type testRoomserverAPI struct {
 	api.RoomserverInternalAPITrace
 	inputRoomEvents            []api.InputRoomEvent
@@ -620,3 +634,24 @@ func TestTransactionFetchMissingStateByStateIDs(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{eventB, eventC, eventD})
 }
 */
+
+func TestSigningKeyUpdateFromOrigin(t *testing.T) {
+	keyAPI := &testKeyAPI{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.keyAPI = keyAPI
+
+	for _, userID := range []string{"@alice:" + string(testOrigin), "@bob:somewhere.else"} {
+		edu := gomatrixserverlib.EDU{
+			Type:    eduAPI.MSigningKeyUpdate,
+			Content: []byte(fmt.Sprintf(`{"user_id":%q,"master_key":{"user_id":%q,"usage":["master"],"keys":{"ed25519:key":"a2V5"}}}`, userID, userID)),
+		}
+		if err := txn.processSigningKeyUpdate(context.Background(), edu); err != nil {
+			t.Fatalf("processSigningKeyUpdate(%s) failed: %s", userID, err)
+		}
+	}
+
+	// Only the update for the user of the origin server is stored.
+	if len(keyAPI.uploads) != 1 || keyAPI.uploads[0].UserID != "@alice:"+string(testOrigin) {
+		t.Fatalf("got uploads %+v, want only the one for the user of the origin", keyAPI.uploads)
+	}
+}
@@ -0,0 +1,49 @@
+package caching
+
+import (
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	DeviceKeysCacheName       = "device_keys"
+	DeviceKeysCacheMaxEntries = 4096
+	DeviceKeysCacheMutable    = true
+)
+
+// UserDeviceKeys are the device and cross-signing keys of a remote user, as
+// returned by their server, and when they stop being fresh enough to use.
+type UserDeviceKeys struct {
+	DeviceKeys     map[string]gomatrixserverlib.DeviceKeys
+	MasterKey      *gomatrixserverlib.CrossSigningKey
+	SelfSigningKey *gomatrixserverlib.CrossSigningKey
+	Expires        time.Time
+}
+
+// DeviceKeysCache contains the subset of functions needed for a cache of
+// the keys of remote users. It must only be used from the keyserver, which
+// invalidates the keys when it hears that they have changed.
+type DeviceKeysCache interface {
+	GetDeviceKeys(userID string) (keys *UserDeviceKeys, ok bool)
+	StoreDeviceKeys(userID string, keys *UserDeviceKeys)
+	InvalidateDeviceKeys(userID string)
+}
+
+func (c Caches) GetDeviceKeys(userID string) (*UserDeviceKeys, bool) {
+	val, found := c.DeviceKeys.Get(userID)
+	if found && val != nil {
+		if keys, ok := val.(*UserDeviceKeys); ok {
+			return keys, true
+		}
+	}
+	return nil, false
+}
+
+func (c Caches) StoreDeviceKeys(userID string, keys *UserDeviceKeys) {
+	c.DeviceKeys.Set(userID, keys)
+}
+
+func (c Caches) InvalidateDeviceKeys(userID string) {
+	c.DeviceKeys.Unset(userID)
+}
@@ -24,6 +24,7 @@ const (
 type RoomInfoCache interface {
 	GetRoomInfo(roomID string) (roomInfo types.RoomInfo, ok bool)
 	StoreRoomInfo(roomID string, roomInfo types.RoomInfo)
+	InvalidateRoomInfo(roomID string)
 }
 
 // GetRoomInfo must only be called from the roomserver only. It is not
@@ -43,3 +44,9 @@ func (c Caches) GetRoomInfo(roomID string) (types.RoomInfo, bool) {
 func (c Caches) StoreRoomInfo(roomID string, roomInfo types.RoomInfo) {
 	c.RoomInfos.Set(roomID, roomInfo)
 }
+
+// InvalidateRoomInfo must only be called from the roomserver only. It is not
+// safe for use from other components.
+func (c Caches) InvalidateRoomInfo(roomID string) {
+	c.RoomInfos.Unset(roomID)
+}
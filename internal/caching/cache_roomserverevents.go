@@ -0,0 +1,39 @@
+package caching
+
+import (
+	"strconv"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	RoomServerStateEventsCacheName       = "roomserver_state_events"
+	RoomServerStateEventsCacheMaxEntries = 4096
+	// The same event is loaded, and stored, again by state resolutions which
+	// miss the cache at the same time, and each load is a new pointer.
+	RoomServerStateEventsCacheMutable = true
+)
+
+// RoomServerStateEventsCache contains the subset of functions needed for
+// a cache of the state events loaded by state resolution. It must only be
+// used from the roomserver, and only for state resolution, as the events
+// aren't updated if they are redacted after being cached.
+type RoomServerStateEventsCache interface {
+	GetRoomServerStateEvent(eventNID types.EventNID) (*gomatrixserverlib.Event, bool)
+	StoreRoomServerStateEvent(eventNID types.EventNID, event *gomatrixserverlib.Event)
+}
+
+func (c Caches) GetRoomServerStateEvent(eventNID types.EventNID) (*gomatrixserverlib.Event, bool) {
+	val, found := c.RoomServerStateEvents.Get(strconv.FormatInt(int64(eventNID), 10))
+	if found && val != nil {
+		if event, ok := val.(*gomatrixserverlib.Event); ok {
+			return event, true
+		}
+	}
+	return nil, false
+}
+
+func (c Caches) StoreRoomServerStateEvent(eventNID types.EventNID, event *gomatrixserverlib.Event) {
+	c.RoomServerStateEvents.Set(strconv.FormatInt(int64(eventNID), 10), event)
+}
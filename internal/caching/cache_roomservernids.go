@@ -24,6 +24,7 @@ type RoomServerCaches interface {
 	RoomServerNIDsCache
 	RoomVersionCache
 	RoomInfoCache
+	RoomServerStateEventsCache
 }
 
 // RoomServerNIDsCache contains the subset of functions needed for
@@ -12,6 +12,8 @@ type Caches struct {
 	RoomServerRoomIDs       Cache // RoomServerNIDsCache
 	RoomInfos               Cache // RoomInfoCache
 	FederationEvents        Cache // FederationEventsCache
+	RoomServerStateEvents   Cache // RoomServerStateEventsCache
+	DeviceKeys              Cache // DeviceKeysCache
 }
 
 // Cache is the interface that an implementation must satisfy.
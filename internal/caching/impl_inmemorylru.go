@@ -2,93 +2,93 @@ package caching
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
 )
 
-func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
-	roomVersions, err := NewInMemoryLRUCachePartition(
-		RoomVersionCacheName,
-		RoomVersionCacheMutable,
-		RoomVersionCacheMaxEntries,
-		enablePrometheus,
-	)
-	if err != nil {
-		return nil, err
+// NewInMemoryLRUCache creates all of the named caches. The maximum number of
+// entries for each cache can be overridden by name in the configuration, and
+// caches which aren't mentioned in the configuration use their default sizes.
+func NewInMemoryLRUCache(cfg *config.Cache, enablePrometheus bool) (*Caches, error) {
+	caches := &Caches{}
+	partitions := []struct {
+		name       string
+		mutable    bool
+		maxEntries int
+		cache      *Cache
+	}{
+		{RoomVersionCacheName, RoomVersionCacheMutable, RoomVersionCacheMaxEntries, &caches.RoomVersions},
+		{ServerKeyCacheName, ServerKeyCacheMutable, ServerKeyCacheMaxEntries, &caches.ServerKeys},
+		{RoomServerStateKeyNIDsCacheName, RoomServerStateKeyNIDsCacheMutable, RoomServerStateKeyNIDsCacheMaxEntries, &caches.RoomServerStateKeyNIDs},
+		{RoomServerEventTypeNIDsCacheName, RoomServerEventTypeNIDsCacheMutable, RoomServerEventTypeNIDsCacheMaxEntries, &caches.RoomServerEventTypeNIDs},
+		{RoomServerRoomIDsCacheName, RoomServerRoomIDsCacheMutable, RoomServerRoomIDsCacheMaxEntries, &caches.RoomServerRoomIDs},
+		{RoomInfoCacheName, RoomInfoCacheMutable, RoomInfoCacheMaxEntries, &caches.RoomInfos},
+		{FederationEventCacheName, FederationEventCacheMutable, FederationEventCacheMaxEntries, &caches.FederationEvents},
+		{RoomServerStateEventsCacheName, RoomServerStateEventsCacheMutable, RoomServerStateEventsCacheMaxEntries, &caches.RoomServerStateEvents},
+		{DeviceKeysCacheName, DeviceKeysCacheMutable, DeviceKeysCacheMaxEntries, &caches.DeviceKeys},
 	}
-	serverKeys, err := NewInMemoryLRUCachePartition(
-		ServerKeyCacheName,
-		ServerKeyCacheMutable,
-		ServerKeyCacheMaxEntries,
-		enablePrometheus,
-	)
-	if err != nil {
-		return nil, err
-	}
-	roomServerStateKeyNIDs, err := NewInMemoryLRUCachePartition(
-		RoomServerStateKeyNIDsCacheName,
-		RoomServerStateKeyNIDsCacheMutable,
-		RoomServerStateKeyNIDsCacheMaxEntries,
-		enablePrometheus,
-	)
-	if err != nil {
-		return nil, err
-	}
-	roomServerEventTypeNIDs, err := NewInMemoryLRUCachePartition(
-		RoomServerEventTypeNIDsCacheName,
-		RoomServerEventTypeNIDsCacheMutable,
-		RoomServerEventTypeNIDsCacheMaxEntries,
-		enablePrometheus,
-	)
-	if err != nil {
-		return nil, err
+
+	var maxEntries map[string]int
+	if cfg != nil {
+		maxEntries = cfg.MaxEntries
 	}
-	roomServerRoomIDs, err := NewInMemoryLRUCachePartition(
-		RoomServerRoomIDsCacheName,
-		RoomServerRoomIDsCacheMutable,
-		RoomServerRoomIDsCacheMaxEntries,
-		enablePrometheus,
-	)
-	if err != nil {
-		return nil, err
+	known := make(map[string]struct{}, len(partitions))
+	created := make([]*InMemoryLRUCachePartition, 0, len(partitions))
+	for _, p := range partitions {
+		known[p.name] = struct{}{}
+		size := p.maxEntries
+		if n, ok := maxEntries[p.name]; ok && n > 0 {
+			size = n
+		}
+		partition, err := NewInMemoryLRUCachePartition(p.name, p.mutable, size, enablePrometheus)
+		if err != nil {
+			return nil, err
+		}
+		*p.cache = partition
+		created = append(created, partition)
 	}
-	roomInfos, err := NewInMemoryLRUCachePartition(
-		RoomInfoCacheName,
-		RoomInfoCacheMutable,
-		RoomInfoCacheMaxEntries,
-		enablePrometheus,
-	)
-	if err != nil {
-		return nil, err
+	for name := range maxEntries {
+		if _, ok := known[name]; !ok {
+			logrus.Warnf("Ignoring size for unknown cache %q", name)
+		}
 	}
-	federationEvents, err := NewInMemoryLRUCachePartition(
-		FederationEventCacheName,
-		FederationEventCacheMutable,
-		FederationEventCacheMaxEntries,
-		enablePrometheus,
-	)
-	if err != nil {
-		return nil, err
+	if enablePrometheus {
+		registerCacheMetrics.Do(func() {
+			prometheus.MustRegister(cacheHits, cacheMisses, cacheEvictions)
+		})
 	}
-	go cacheCleaner(
-		roomVersions, serverKeys, roomServerStateKeyNIDs,
-		roomServerEventTypeNIDs, roomServerRoomIDs,
-		roomInfos, federationEvents,
-	)
-	return &Caches{
-		RoomVersions:            roomVersions,
-		ServerKeys:              serverKeys,
-		RoomServerStateKeyNIDs:  roomServerStateKeyNIDs,
-		RoomServerEventTypeNIDs: roomServerEventTypeNIDs,
-		RoomServerRoomIDs:       roomServerRoomIDs,
-		RoomInfos:               roomInfos,
-		FederationEvents:        federationEvents,
-	}, nil
+	go cacheCleaner(created...)
+	return caches, nil
 }
 
+var (
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching_in_memory_lru",
+		Name:      "hits_total",
+		Help:      "Number of cache lookups which found an entry",
+	}, []string{"cache"})
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching_in_memory_lru",
+		Name:      "misses_total",
+		Help:      "Number of cache lookups which didn't find an entry",
+	}, []string{"cache"})
+	cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching_in_memory_lru",
+		Name:      "evictions_total",
+		Help:      "Number of entries removed from the cache to make room for new ones",
+	}, []string{"cache"})
+	registerCacheMetrics sync.Once
+)
+
 func cacheCleaner(caches ...*InMemoryLRUCachePartition) {
 	for {
 		time.Sleep(time.Minute)
@@ -139,7 +139,9 @@ func (c *InMemoryLRUCachePartition) Set(key string, value interface{}) {
 			panic(fmt.Sprintf("invalid use of immutable cache tries to mutate existing value of %q", key))
 		}
 	}
-	c.lru.Add(key, value)
+	if evicted := c.lru.Add(key, value); evicted {
+		cacheEvictions.WithLabelValues(c.name).Inc()
+	}
 }
 
 func (c *InMemoryLRUCachePartition) Unset(key string) {
@@ -150,5 +152,11 @@ func (c *InMemoryLRUCachePartition) Unset(key string) {
 }
 
 func (c *InMemoryLRUCachePartition) Get(key string) (value interface{}, ok bool) {
-	return c.lru.Get(key)
+	value, ok = c.lru.Get(key)
+	if ok {
+		cacheHits.WithLabelValues(c.name).Inc()
+	} else {
+		cacheMisses.WithLabelValues(c.name).Inc()
+	}
+	return value, ok
 }
@@ -0,0 +1,79 @@
+package caching
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInMemoryLRUCacheSizes(t *testing.T) {
+	caches, err := NewInMemoryLRUCache(&config.Cache{
+		MaxEntries: map[string]int{
+			RoomVersionCacheName: 2,
+		},
+	}, false)
+	if err != nil {
+		t.Fatalf("failed to create caches: %s", err)
+	}
+	roomVersions := caches.RoomVersions.(*InMemoryLRUCachePartition)
+	if roomVersions.maxEntries != 2 {
+		t.Fatalf("expected configured size 2, got %d", roomVersions.maxEntries)
+	}
+	if serverKeys := caches.ServerKeys.(*InMemoryLRUCachePartition); serverKeys.maxEntries != ServerKeyCacheMaxEntries {
+		t.Fatalf("expected default size %d, got %d", ServerKeyCacheMaxEntries, serverKeys.maxEntries)
+	}
+
+	hits := testutil.ToFloat64(cacheHits.WithLabelValues(RoomVersionCacheName))
+	misses := testutil.ToFloat64(cacheMisses.WithLabelValues(RoomVersionCacheName))
+	evictions := testutil.ToFloat64(cacheEvictions.WithLabelValues(RoomVersionCacheName))
+
+	caches.StoreRoomVersion("!a:test", "1")
+	caches.StoreRoomVersion("!b:test", "1")
+	caches.StoreRoomVersion("!c:test", "1")
+	if _, ok := caches.GetRoomVersion("!a:test"); ok {
+		t.Fatalf("expected oldest entry to have been evicted")
+	}
+	if _, ok := caches.GetRoomVersion("!c:test"); !ok {
+		t.Fatalf("expected newest entry to be cached")
+	}
+
+	if got := testutil.ToFloat64(cacheHits.WithLabelValues(RoomVersionCacheName)) - hits; got != 1 {
+		t.Errorf("expected 1 hit, got %v", got)
+	}
+	if got := testutil.ToFloat64(cacheMisses.WithLabelValues(RoomVersionCacheName)) - misses; got != 1 {
+		t.Errorf("expected 1 miss, got %v", got)
+	}
+	if got := testutil.ToFloat64(cacheEvictions.WithLabelValues(RoomVersionCacheName)) - evictions; got != 1 {
+		t.Errorf("expected 1 eviction, got %v", got)
+	}
+}
+
+func TestInMemoryLRUCacheEvictionsExcludeUnset(t *testing.T) {
+	caches, err := NewInMemoryLRUCache(&config.Cache{
+		MaxEntries: map[string]int{
+			DeviceKeysCacheName: 2,
+		},
+	}, false)
+	if err != nil {
+		t.Fatalf("failed to create caches: %s", err)
+	}
+
+	evictions := testutil.ToFloat64(cacheEvictions.WithLabelValues(DeviceKeysCacheName))
+
+	caches.StoreDeviceKeys("@alice:test", &UserDeviceKeys{})
+	caches.StoreDeviceKeys("@bob:test", &UserDeviceKeys{})
+	caches.InvalidateDeviceKeys("@alice:test")
+	if _, ok := caches.GetDeviceKeys("@alice:test"); ok {
+		t.Fatalf("expected invalidated entry to have been removed")
+	}
+	if got := testutil.ToFloat64(cacheEvictions.WithLabelValues(DeviceKeysCacheName)) - evictions; got != 0 {
+		t.Errorf("expected 0 evictions after invalidating, got %v", got)
+	}
+
+	caches.StoreDeviceKeys("@charlie:test", &UserDeviceKeys{})
+	caches.StoreDeviceKeys("@dave:test", &UserDeviceKeys{})
+	if got := testutil.ToFloat64(cacheEvictions.WithLabelValues(DeviceKeysCacheName)) - evictions; got != 1 {
+		t.Errorf("expected 1 eviction, got %v", got)
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dnscache implements an in-process cache for DNS responses. It sits
+// underneath the Go resolver, so it caches every lookup made through
+// net.DefaultResolver, including the SRV and A/AAAA lookups made when
+// resolving federation destinations. Records are cached for as long as their
+// TTLs allow, up to a configured maximum, and negative answers are cached too.
+package dnscache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	lookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "dns_cache",
+		Name:      "lookups_total",
+		Help:      "Number of DNS lookups by result: hit, negative_hit or miss",
+	}, []string{"result"})
+	registerMetrics sync.Once
+)
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type cacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// Cache is a cache of DNS responses. Use Dial as the Dial function of a
+// net.Resolver with PreferGo set, or call Install to use it for all lookups.
+type Cache struct {
+	mutex       sync.Mutex
+	entries     map[cacheKey]*cacheEntry
+	size        int
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	dialer      func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// New returns a cache which holds up to size responses. Responses are cached
+// for the lowest TTL of their records, but never longer than maxTTL. Negative
+// responses are cached for the TTL given by the zone, but never longer than
+// negativeTTL.
+func New(size int, maxTTL, negativeTTL time.Duration) *Cache {
+	d := &net.Dialer{}
+	return &Cache{
+		entries:     make(map[cacheKey]*cacheEntry),
+		size:        size,
+		maxTTL:      maxTTL,
+		negativeTTL: negativeTTL,
+		dialer:      d.DialContext,
+	}
+}
+
+// Install replaces net.DefaultResolver with one which uses the cache. This
+// should be called before anything takes a reference to the default resolver.
+func (c *Cache) Install(enablePrometheus bool) {
+	if enablePrometheus {
+		registerMetrics.Do(func() {
+			prometheus.MustRegister(lookups)
+			prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: "dendrite",
+				Subsystem: "dns_cache",
+				Name:      "entries",
+				Help:      "Number of DNS responses currently cached",
+			}, func() float64 {
+				c.mutex.Lock()
+				defer c.mutex.Unlock()
+				return float64(len(c.entries))
+			}))
+		})
+	}
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial:     c.Dial,
+	}
+}
+
+// Dial returns a connection to the given DNS server which answers queries from
+// the cache where possible, forwarding them to the server otherwise.
+func (c *Cache) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return &conn{
+		ctx:     ctx,
+		cache:   c,
+		network: network,
+		address: address,
+	}, nil
+}
+
+func (c *Cache) get(key cacheKey, now time.Time) (*cacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+func (c *Cache) store(key cacheKey, msg dnsmessage.Message, now time.Time) {
+	ttl, ok := c.ttl(&msg)
+	if !ok || ttl <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// If the cache is full then make room by evicting the entry which
+	// is closest to expiry.
+	for len(c.entries) >= c.size && len(c.entries) > 0 {
+		var oldest cacheKey
+		var oldestExpiry time.Time
+		for k, e := range c.entries {
+			if oldestExpiry.IsZero() || e.expires.Before(oldestExpiry) {
+				oldest, oldestExpiry = k, e.expires
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = &cacheEntry{
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+}
+
+// ttl works out how long a response can be cached for. Returns false if the
+// response shouldn't be cached at all.
+func (c *Cache) ttl(msg *dnsmessage.Message) (time.Duration, bool) {
+	if msg.Truncated {
+		return 0, false
+	}
+	switch {
+	case msg.RCode == dnsmessage.RCodeNameError,
+		msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) == 0:
+		// Negative responses are cached for the lower of the SOA record's
+		// TTL and its minimum field, as per RFC 2308.
+		ttl := c.negativeTTL
+		for _, rr := range msg.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				soaTTL := rr.Header.TTL
+				if soa.MinTTL < soaTTL {
+					soaTTL = soa.MinTTL
+				}
+				if d := time.Duration(soaTTL) * time.Second; d < ttl {
+					ttl = d
+				}
+			}
+		}
+		return ttl, true
+	case msg.RCode == dnsmessage.RCodeSuccess:
+		ttl := c.maxTTL
+		for _, rr := range msg.Answers {
+			if d := time.Duration(rr.Header.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+		return ttl, true
+	default:
+		// Don't cache server failures, refusals and so on.
+		return 0, false
+	}
+}
+
+// conn is a fake connection to a DNS server. The Go resolver writes a single
+// query to it and reads back a single response. Since conn isn't a
+// net.PacketConn, the resolver always prefixes messages with their length as
+// it would over TCP, regardless of the network that it asked for.
+type conn struct {
+	ctx      context.Context
+	cache    *Cache
+	network  string
+	address  string
+	query    bytes.Buffer
+	response bytes.Reader
+	deadline time.Time
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	query := c.query.Bytes()
+	if len(query) < 2 || len(query) < 2+int(binary.BigEndian.Uint16(query)) {
+		// Wait for the rest of the message.
+		return len(b), nil
+	}
+	response, err := c.exchange(query[2:])
+	if err != nil {
+		return 0, err
+	}
+	framed := make([]byte, 2, 2+len(response))
+	binary.BigEndian.PutUint16(framed, uint16(len(response)))
+	c.response.Reset(append(framed, response...))
+	return len(b), nil
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if c.response.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.response.Read(b)
+}
+
+// exchange answers the query from the cache, or forwards it to the DNS server
+// and caches the response.
+func (c *conn) exchange(query []byte) ([]byte, error) {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		return nil, err
+	}
+	if len(q.Questions) != 1 {
+		return c.forward(query)
+	}
+	question := q.Questions[0]
+	key := cacheKey{
+		name:  strings.ToLower(question.Name.String()),
+		qtype: question.Type,
+		class: question.Class,
+	}
+	now := time.Now()
+	if entry, ok := c.cache.get(key, now); ok {
+		if len(entry.msg.Answers) == 0 {
+			lookups.WithLabelValues("negative_hit").Inc()
+		} else {
+			lookups.WithLabelValues("hit").Inc()
+		}
+		return cachedResponse(entry, q.Header.ID, now)
+	}
+	lookups.WithLabelValues("miss").Inc()
+
+	response, err := c.forward(query)
+	if err != nil {
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err = msg.Unpack(response); err == nil && msg.Header.ID == q.Header.ID {
+		c.cache.store(key, msg, now)
+	}
+	return response, nil
+}
+
+// forward sends the query to the real DNS server and returns the response.
+func (c *conn) forward(query []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	upstream, err := c.cache.dialer(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	defer upstream.Close() // nolint: errcheck
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = upstream.SetDeadline(deadline)
+	}
+	if strings.HasPrefix(c.network, "udp") {
+		if _, err = upstream.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := upstream.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	framed := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	if _, err = upstream.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(upstream, framed[:2]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(framed[:2]))
+	if _, err = io.ReadFull(upstream, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// cachedResponse builds a response to the query with the given ID from a cache
+// entry, with the TTLs reduced by the time that the entry has been cached for.
+func cachedResponse(entry *cacheEntry, id uint16, now time.Time) ([]byte, error) {
+	msg := entry.msg
+	msg.Header.ID = id
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	age := func(rrs []dnsmessage.Resource) []dnsmessage.Resource {
+		aged := make([]dnsmessage.Resource, len(rrs))
+		for i, rr := range rrs {
+			if rr.Header.Type != dnsmessage.TypeOPT {
+				if rr.Header.TTL > elapsed {
+					rr.Header.TTL -= elapsed
+				} else {
+					rr.Header.TTL = 0
+				}
+			}
+			aged[i] = rr
+		}
+		return aged
+	}
+	msg.Answers = age(msg.Answers)
+	msg.Authorities = age(msg.Authorities)
+	msg.Additionals = age(msg.Additionals)
+	return msg.Pack()
+}
+
+func (c *conn) Close() error { return nil }
+
+func (c *conn) LocalAddr() net.Addr { return nil }
+
+func (c *conn) RemoteAddr() net.Addr { return nil }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+var _ net.Conn = &conn{}
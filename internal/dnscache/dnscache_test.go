@@ -0,0 +1,118 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startServer runs a DNS server on localhost which answers SRV queries for
+// _matrix._tcp.example.com and returns NXDOMAIN for everything else.
+func startServer(t *testing.T, queries *int32) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if err = q.Unpack(buf[:n]); err != nil || len(q.Questions) != 1 {
+				continue
+			}
+			atomic.AddInt32(queries, 1)
+			res := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+				Questions: q.Questions,
+			}
+			question := q.Questions[0]
+			if question.Type == dnsmessage.TypeSRV && question.Name.String() == "_matrix._tcp.example.com." {
+				res.Header.RCode = dnsmessage.RCodeSuccess
+				res.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: 300},
+					Body: &dnsmessage.SRVResource{
+						Priority: 10, Weight: 5, Port: 8448,
+						Target: dnsmessage.MustNewName("matrix.example.com."),
+					},
+				}}
+			} else {
+				res.Authorities = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 600},
+					Body: &dnsmessage.SOAResource{
+						NS: dnsmessage.MustNewName("ns.example.com."), MBox: dnsmessage.MustNewName("admin.example.com."),
+						Serial: 1, Refresh: 60, Retry: 60, Expire: 60, MinTTL: 30,
+					},
+				}}
+			}
+			packed, err := res.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = pc.WriteTo(packed, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestCache(t *testing.T) {
+	var queries int32
+	server := startServer(t, &queries)
+	cache := New(16, time.Hour, time.Minute)
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return cache.Dial(ctx, network, server)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// The second SRV lookup should be answered from the cache.
+	for i := 0; i < 2; i++ {
+		_, addrs, err := resolver.LookupSRV(ctx, "matrix", "tcp", "example.com")
+		if err != nil {
+			t.Fatalf("lookup %d failed: %s", i, err)
+		}
+		if len(addrs) != 1 || addrs[0].Target != "matrix.example.com." || addrs[0].Port != 8448 {
+			t.Fatalf("unexpected SRV records: %+v", addrs)
+		}
+	}
+	if got := atomic.LoadInt32(&queries); got != 1 {
+		t.Fatalf("expected 1 upstream query, got %d", got)
+	}
+
+	// Negative answers are cached too.
+	atomic.StoreInt32(&queries, 0)
+	for i := 0; i < 2; i++ {
+		if _, _, err := resolver.LookupSRV(ctx, "matrix", "tcp", "missing.example.com"); err == nil {
+			t.Fatalf("expected lookup %d to fail", i)
+		}
+	}
+	if got := atomic.LoadInt32(&queries); got != 1 {
+		t.Fatalf("expected 1 upstream query for negative answer, got %d", got)
+	}
+
+	// The negative TTL comes from the SOA minimum, capped by our maximum.
+	key := cacheKey{name: "_matrix._tcp.missing.example.com.", qtype: dnsmessage.TypeSRV, class: dnsmessage.ClassINET}
+	entry, ok := cache.get(key, time.Now())
+	if !ok {
+		t.Fatalf("expected negative answer to be cached")
+	}
+	if ttl := entry.expires.Sub(entry.stored); ttl != 30*time.Second {
+		t.Fatalf("expected negative TTL of 30s, got %s", ttl)
+	}
+
+	// Entries expire once their TTL has passed.
+	if _, ok = cache.get(key, time.Now().Add(time.Minute)); ok {
+		t.Fatalf("expected cache entry to have expired")
+	}
+}
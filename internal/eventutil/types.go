@@ -30,6 +30,32 @@ type AccountData struct {
 	Type   string `json:"type"`
 }
 
+// NotificationData contains the unread notification counts of a user in a
+// room, sent from the user API server to the sync API server. The counts of
+// the room include those of its threads.
+type NotificationData struct {
+	RoomID                  string `json:"room_id"`
+	UnreadHighlightCount    int    `json:"unread_highlight_count"`
+	UnreadNotificationCount int    `json:"unread_notification_count"`
+	// The counts of the threads which have unread notifications, by the
+	// event ID of their root event
+	UnreadThreadCounts map[string]*ThreadNotificationData `json:"unread_thread_counts,omitempty"`
+}
+
+// ThreadNotificationData contains the unread notification counts of a user
+// in a thread
+type ThreadNotificationData struct {
+	UnreadHighlightCount    int `json:"unread_highlight_count"`
+	UnreadNotificationCount int `json:"unread_notification_count"`
+}
+
+// DeletedDevicesData contains the IDs of the devices of a user which were
+// deleted, sent from the user API server to the sync API server so that it
+// can drop their to-device inboxes.
+type DeletedDevicesData struct {
+	DeviceIDs []string `json:"device_ids"`
+}
+
 // ProfileResponse is a struct containing all known user profile data
 type ProfileResponse struct {
 	AvatarURL   string `json:"avatar_url"`
@@ -0,0 +1,209 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is the header used to pass request IDs between Dendrite
+// components, and which is returned to clients so that they can quote the
+// request ID when reporting problems.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID that we'll accept from a
+// caller. Anything longer, or containing unexpected characters, is replaced.
+const maxRequestIDLength = 64
+
+type accessLogContextKey string
+
+const (
+	ctxValueRequestID = accessLogContextKey("request_id")
+	ctxValueAccessLog = accessLogContextKey("access_log")
+)
+
+// accessLogEntry collects the details of a request which are only known once
+// it has been routed and authenticated, so that they can be included in the
+// access log line written by WithAccessLogging.
+type accessLogEntry struct {
+	mu     sync.Mutex
+	route  string
+	userID string
+}
+
+// RequestIDFromContext returns the request ID for the inbound request which
+// the context belongs to, or an empty string if there isn't one.
+func RequestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(ctxValueRequestID).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// ContextWithRequestID returns a copy of the context carrying the given
+// request ID. Internal API calls made with the context will pass the request
+// ID to the called component.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxValueRequestID, id)
+}
+
+// WithAccessLogging wraps a listener's handler so that every request is given
+// a request ID and a structured access log line is written once the request
+// has completed. Requests which arrive with a valid X-Request-ID header keep
+// that ID, so that calls between components can be correlated. Internal API
+// requests are logged at debug level since there are a lot of them.
+func WithAccessLogging(listener string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = util.RandomString(12)
+		}
+		entry := &accessLogEntry{}
+		ctx := ContextWithRequestID(req.Context(), id)
+		ctx = context.WithValue(ctx, ctxValueAccessLog, entry)
+		w.Header().Set(RequestIDHeader, id)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, req.WithContext(ctx))
+
+		entry.mu.Lock()
+		route, userID := entry.route, entry.userID
+		entry.mu.Unlock()
+		if route == "" {
+			route = "unknown"
+		}
+		logger := logrus.WithFields(logrus.Fields{
+			"listener":    listener,
+			"req.id":      id,
+			"req.method":  req.Method,
+			"req.route":   route,
+			"status":      rec.status,
+			"duration_ms": time.Since(start).Milliseconds(),
+		})
+		if userID != "" {
+			logger = logger.WithField("user_id", userID)
+		}
+		if strings.HasPrefix(req.URL.Path, InternalPathPrefix) {
+			logger.Debug("Handled internal API request")
+		} else {
+			logger.Info("Handled request")
+		}
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID wraps a handler so that the logger attached to the request
+// context reports our request ID rather than the one generated by util.
+func withRequestID(f func(*http.Request) util.JSONResponse) func(*http.Request) util.JSONResponse {
+	return func(req *http.Request) util.JSONResponse {
+		if id := RequestIDFromContext(req.Context()); id != "" {
+			logger := util.GetLogger(req.Context()).WithField("req.id", id)
+			req = req.WithContext(util.ContextWithLogger(req.Context(), logger))
+		}
+		return f(req)
+	}
+}
+
+// setAccessLogRoute records the template of the route which matched the
+// request, e.g. /rooms/{roomID}/send/{eventType}/{txnID}. Templates are logged
+// instead of paths so that the access log doesn't contain IDs or tokens.
+func setAccessLogRoute(req *http.Request) {
+	entry, ok := req.Context().Value(ctxValueAccessLog).(*accessLogEntry)
+	if !ok {
+		return
+	}
+	tmpl := routeTemplate(req)
+	if tmpl == "" {
+		return
+	}
+	entry.mu.Lock()
+	entry.route = tmpl
+	entry.mu.Unlock()
+}
+
+// routeTemplate returns the template of the route which matched the request,
+// or an empty string if the request wasn't routed by gorilla/mux.
+func routeTemplate(req *http.Request) string {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return ""
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return tmpl
+}
+
+// setAccessLogUser records the user, admin or origin server which made the
+// request.
+func setAccessLogUser(req *http.Request, userID string) {
+	entry, ok := req.Context().Value(ctxValueAccessLog).(*accessLogEntry)
+	if !ok {
+		return
+	}
+	entry.mu.Lock()
+	entry.userID = userID
+	entry.mu.Unlock()
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
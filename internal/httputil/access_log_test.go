@@ -0,0 +1,91 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/util"
+	"github.com/opentracing/opentracing-go"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestAccessLogging(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(logrus.InfoLevel)
+
+	// The upstream component checks that the request ID reaches it.
+	var upstreamID string
+	upstream := mux.NewRouter()
+	upstream.PathPrefix(InternalPathPrefix).Handler(MakeInternalAPI("test_upstream", func(req *http.Request) util.JSONResponse {
+		upstreamID = RequestIDFromContext(req.Context())
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}))
+	upstreamSrv := httptest.NewServer(WithAccessLogging("internal", upstream))
+	defer upstreamSrv.Close()
+
+	var handlerID string
+	r := mux.NewRouter()
+	r.Handle("/rooms/{roomID}", MakeExternalAPI("test_room", func(req *http.Request) util.JSONResponse {
+		handlerID = RequestIDFromContext(req.Context())
+		span := opentracing.StartSpan("test")
+		defer span.Finish()
+		var res struct{}
+		if err := PostJSON(req.Context(), span, upstreamSrv.Client(), upstreamSrv.URL+"/test", struct{}{}, &res); err != nil {
+			t.Errorf("PostJSON failed: %s", err)
+		}
+		return util.JSONResponse{Code: http.StatusTeapot, JSON: struct{}{}}
+	}))
+	h := WithAccessLogging("external", r)
+
+	// A request ID is generated when the caller doesn't supply one.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rooms/!secret:test", nil))
+	id := rec.Header().Get(RequestIDHeader)
+	if id == "" {
+		t.Fatalf("no request ID was returned")
+	}
+	if handlerID != id || upstreamID != id {
+		t.Fatalf("request ID not propagated: response %q, handler %q, upstream %q", id, handlerID, upstreamID)
+	}
+
+	var found bool
+	for _, e := range hook.AllEntries() {
+		if e.Data["listener"] != "external" {
+			continue
+		}
+		found = true
+		if e.Data["req.id"] != id || e.Data["req.method"] != http.MethodGet {
+			t.Errorf("unexpected access log fields: %v", e.Data)
+		}
+		if e.Data["req.route"] != "/rooms/{roomID}" {
+			t.Errorf("expected route template to be logged, got %v", e.Data["req.route"])
+		}
+		if e.Data["status"] != http.StatusTeapot {
+			t.Errorf("expected status %d to be logged, got %v", http.StatusTeapot, e.Data["status"])
+		}
+	}
+	if !found {
+		t.Fatalf("no access log line was written")
+	}
+
+	// Valid request IDs from the caller are kept, invalid ones are replaced.
+	req := httptest.NewRequest(http.MethodGet, "/rooms/!room:test", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get(RequestIDHeader); got != "abc-123" {
+		t.Fatalf("expected caller's request ID to be kept, got %q", got)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/rooms/!room:test", nil)
+	req.Header.Set(RequestIDHeader, "not a valid\nid")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get(RequestIDHeader); got == "not a valid\nid" || got == "" {
+		t.Fatalf("expected invalid request ID to be replaced, got %q", got)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	runtimepprof "runtime/pprof"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// DebugHandler returns a handler which serves runtime debugging endpoints under
+// DebugPathPrefix:
+//   - /debug/pprof/ serves the standard net/http/pprof profiles
+//   - /debug/gc returns garbage collector and memory statistics as JSON
+//   - /debug/goroutines returns the stack traces of all running goroutines
+func DebugHandler() http.Handler {
+	r := mux.NewRouter().SkipClean(true).PathPrefix(DebugPathPrefix).Subrouter()
+	r.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/pprof/profile", pprof.Profile)
+	r.HandleFunc("/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/pprof/trace", pprof.Trace)
+	r.PathPrefix("/pprof/").HandlerFunc(pprof.Index)
+	r.HandleFunc("/gc", debugGCStats).Methods(http.MethodGet)
+	r.HandleFunc("/goroutines", debugGoroutines).Methods(http.MethodGet)
+	return r
+}
+
+type gcStatsResponse struct {
+	NumGoroutine   int           `json:"num_goroutine"`
+	NumGC          int64         `json:"num_gc"`
+	LastGC         time.Time     `json:"last_gc"`
+	PauseTotal     time.Duration `json:"pause_total_ns"`
+	HeapAlloc      uint64        `json:"heap_alloc_bytes"`
+	HeapSys        uint64        `json:"heap_sys_bytes"`
+	HeapObjects    uint64        `json:"heap_objects"`
+	NextGC         uint64        `json:"next_gc_bytes"`
+	Sys            uint64        `json:"sys_bytes"`
+	TotalAllocated uint64        `json:"total_alloc_bytes"`
+}
+
+func debugGCStats(w http.ResponseWriter, req *http.Request) {
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(gcStatsResponse{
+		NumGoroutine:   runtime.NumGoroutine(),
+		NumGC:          gc.NumGC,
+		LastGC:         gc.LastGC,
+		PauseTotal:     gc.PauseTotal,
+		HeapAlloc:      mem.HeapAlloc,
+		HeapSys:        mem.HeapSys,
+		HeapObjects:    mem.HeapObjects,
+		NextGC:         mem.NextGC,
+		Sys:            mem.Sys,
+		TotalAllocated: mem.TotalAlloc,
+	}); err != nil {
+		logrus.WithError(err).Error("Failed to write GC stats")
+	}
+}
+
+func debugGoroutines(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// debug=2 prints each goroutine's stack in the same format as an unrecovered panic.
+	if err := runtimepprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		logrus.WithError(err).Error("Failed to write goroutine dump")
+	}
+}
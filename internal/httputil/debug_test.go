@@ -0,0 +1,77 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	handler := DebugHandler()
+
+	tests := []struct {
+		path     string
+		wantCode int
+		check    func(t *testing.T, body string)
+	}{
+		{
+			path:     "/debug/pprof/",
+			wantCode: http.StatusOK,
+		},
+		{
+			path:     "/debug/gc",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, body string) {
+				var res gcStatsResponse
+				if err := json.Unmarshal([]byte(body), &res); err != nil {
+					t.Fatalf("failed to decode GC stats: %s", err)
+				}
+				if res.NumGoroutine < 1 {
+					t.Errorf("expected at least one goroutine, got %d", res.NumGoroutine)
+				}
+			},
+		},
+		{
+			path:     "/debug/goroutines",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, body string) {
+				if !strings.Contains(body, "TestDebugHandler") {
+					t.Errorf("expected goroutine dump to contain the test function")
+				}
+			},
+		},
+		{
+			path:     "/debug/unknown",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d", tt.wantCode, w.Code)
+			}
+			if tt.check != nil {
+				tt.check(t, w.Body.String())
+			}
+		})
+	}
+}
@@ -61,6 +61,9 @@ func PostJSON(
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if id := RequestIDFromContext(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
 
 	res, err := httpClient.Do(req.WithContext(ctx))
 	if res != nil {
@@ -16,6 +16,7 @@ package httputil
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"io"
 	"net/http"
@@ -29,7 +30,9 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationapiAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -51,32 +54,40 @@ type BasicAuth struct {
 func MakeAuthAPI(
 	metricsName string, userAPI userapi.UserInternalAPI,
 	f func(*http.Request, *userapi.Device) util.JSONResponse,
+) http.Handler {
+	return makeAuthAPI(metricsName, userAPI, false, f)
+}
+
+// MakeLockedAuthAPI is like MakeAuthAPI, but users whose accounts are locked
+// or have expired can also use it, e.g. so that they can log out.
+func MakeLockedAuthAPI(
+	metricsName string, userAPI userapi.UserInternalAPI,
+	f func(*http.Request, *userapi.Device) util.JSONResponse,
+) http.Handler {
+	return makeAuthAPI(metricsName, userAPI, true, f)
+}
+
+func makeAuthAPI(
+	metricsName string, userAPI userapi.UserInternalAPI, allowLocked bool,
+	f func(*http.Request, *userapi.Device) util.JSONResponse,
 ) http.Handler {
 	h := func(req *http.Request) util.JSONResponse {
 		logger := util.GetLogger(req.Context())
 		device, err := auth.VerifyUserFromRequest(req, userAPI)
-		if err != nil {
+		if err != nil && (device == nil || !allowLocked) {
 			logger.Debugf("VerifyUserFromRequest %s -> HTTP %d", req.RemoteAddr, err.Code)
 			return *err
 		}
 		// add the user ID to the logger
 		logger = logger.WithField("user_id", device.UserID)
 		req = req.WithContext(util.ContextWithLogger(req.Context(), logger))
+		setAccessLogUser(req, device.UserID)
 		// add the user to Sentry, if enabled
 		hub := sentry.GetHubFromContext(req.Context())
 		if hub != nil {
 			hub.Scope().SetTag("user_id", device.UserID)
 			hub.Scope().SetTag("device_id", device.ID)
 		}
-		defer func() {
-			if r := recover(); r != nil {
-				if hub != nil {
-					hub.CaptureException(fmt.Errorf("%s panicked", req.URL.Path))
-				}
-				// re-panic to return the 500
-				panic(r)
-			}
-		}()
 
 		jsonRes := f(req, device)
 		// do not log 4xx as errors as they are client fails, not server fails
@@ -89,6 +100,121 @@ func MakeAuthAPI(
 	return MakeExternalAPI(metricsName, h)
 }
 
+type adminContextKey struct{}
+
+// AdminFromContext returns the description of the admin making the request, as
+// passed to handlers made with MakeAdminAPI: either the user ID of an admin
+// account or "admin_token".
+func AdminFromContext(ctx context.Context) string {
+	admin, _ := ctx.Value(adminContextKey{}).(string)
+	return admin
+}
+
+// MakeAdminAPI turns a util.JSONRequestHandler function into an http.Handler which
+// only allows requests from admin accounts, or requests bearing the static admin
+// token from the config. Every request which reaches the handler is audit logged.
+func MakeAdminAPI(
+	metricsName string, userAPI userapi.UserInternalAPI, cfg *config.AdminAPI,
+	f func(*http.Request) util.JSONResponse,
+) http.Handler {
+	h := func(req *http.Request) util.JSONResponse {
+		logger := util.GetLogger(req.Context())
+		admin, errRes := verifyAdminFromRequest(req, userAPI, cfg)
+		if errRes != nil {
+			logger.WithFields(logrus.Fields{
+				"method": req.Method,
+				"path":   req.URL.Path,
+				"code":   errRes.Code,
+			}).Warn("Admin API request rejected")
+			return *errRes
+		}
+		logger = logger.WithField("admin", admin)
+		ctx := context.WithValue(req.Context(), adminContextKey{}, admin)
+		req = req.WithContext(util.ContextWithLogger(ctx, logger))
+		setAccessLogUser(req, admin)
+
+		jsonRes := f(req)
+		logger.WithFields(logrus.Fields{
+			"method": req.Method,
+			"path":   req.URL.Path,
+			"code":   jsonRes.Code,
+		}).Info("Admin API request")
+		return jsonRes
+	}
+	return MakeExternalAPI(metricsName, h)
+}
+
+// verifyAdminFromRequest returns a description of the admin making the request,
+// either the user ID of an admin account or "admin_token" if the static token from
+// the config was used. Returns an error response if the request is not allowed.
+func verifyAdminFromRequest(
+	req *http.Request, userAPI userapi.UserInternalAPI, cfg *config.AdminAPI,
+) (string, *util.JSONResponse) {
+	token, err := auth.ExtractAccessToken(req)
+	if err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken(err.Error()),
+		}
+	}
+	if cfg.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) == 1 {
+		return "admin_token", nil
+	}
+	device, errRes := auth.VerifyUserFromRequest(req, userAPI)
+	if errRes != nil {
+		return "", errRes
+	}
+	forbidden := &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("This API can only be used by admin users."),
+	}
+	if device.AppserviceID != "" {
+		return "", forbidden
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return "", forbidden
+	}
+	var res userapi.QueryAccountByLocalpartResponse
+	if err = userAPI.QueryAccountByLocalpart(req.Context(), &userapi.QueryAccountByLocalpartRequest{
+		Localpart: localpart,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccountByLocalpart failed")
+		jsonErr := jsonerror.InternalServerError()
+		return "", &jsonErr
+	}
+	if res.Account == nil || res.Account.AccountType != userapi.AccountTypeAdmin {
+		return "", forbidden
+	}
+	return device.UserID, nil
+}
+
+// withSentry tags the request's Sentry hub, if there is one, with the route
+// which matched the request and the request ID, and reports panics in the handler to Sentry before
+// re-panicking so that a 500 is still returned.
+func withSentry(f func(*http.Request) util.JSONResponse) func(*http.Request) util.JSONResponse {
+	return func(req *http.Request) util.JSONResponse {
+		hub := sentry.GetHubFromContext(req.Context())
+		if hub == nil {
+			return f(req)
+		}
+		if tmpl := routeTemplate(req); tmpl != "" {
+			hub.Scope().SetTag("route", tmpl)
+		}
+		if id := RequestIDFromContext(req.Context()); id != "" {
+			hub.Scope().SetTag("request_id", id)
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				hub.CaptureException(fmt.Errorf("%s panicked: %v", req.URL.Path, r))
+				// re-panic to return the 500
+				panic(r)
+			}
+		}()
+		return f(req)
+	}
+}
+
 // MakeExternalAPI turns a util.JSONRequestHandler function into an http.Handler.
 // This is used for APIs that are called from the internet.
 func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
@@ -98,8 +224,9 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 	if os.Getenv("DENDRITE_TRACE_HTTP") == "1" {
 		verbose = true
 	}
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(withRequestID(withSentry(f))))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
+		setAccessLogRoute(req)
 		nextWriter := w
 		if verbose {
 			logger := logrus.NewEntry(logrus.StandardLogger())
@@ -155,6 +282,7 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 // This is used to serve HTML alongside JSON error messages
 func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request) *util.JSONResponse) http.Handler {
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
+		setAccessLogRoute(req)
 		span := opentracing.StartSpan(metricsName)
 		defer span.Finish()
 		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
@@ -183,8 +311,9 @@ func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request)
 // If we are passed a tracing context in the request headers then we use that
 // as the parent of any tracing spans we create.
 func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(withRequestID(withSentry(f))))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
+		setAccessLogRoute(req)
 		carrier := opentracing.HTTPHeadersCarrier(req.Header)
 		tracer := opentracing.GlobalTracer()
 		clientContext, err := tracer.Extract(opentracing.HTTPHeaders, carrier)
@@ -219,21 +348,13 @@ func MakeFedAPI(
 		if fedReq == nil {
 			return errResp
 		}
+		setAccessLogUser(req, string(fedReq.Origin()))
 		// add the user to Sentry, if enabled
 		hub := sentry.GetHubFromContext(req.Context())
 		if hub != nil {
 			hub.Scope().SetTag("origin", string(fedReq.Origin()))
 			hub.Scope().SetTag("uri", fedReq.RequestURI())
 		}
-		defer func() {
-			if r := recover(); r != nil {
-				if hub != nil {
-					hub.CaptureException(fmt.Errorf("%s panicked", req.URL.Path))
-				}
-				// re-panic to return the 500
-				panic(r)
-			}
-		}()
 		go wakeup.Wakeup(req.Context(), fedReq.Origin())
 		vars, err := URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
@@ -277,10 +398,10 @@ func (f *FederationWakeups) Wakeup(ctx context.Context, origin gomatrixserverlib
 	}
 }
 
-// WrapHandlerInBasicAuth adds basic auth to a handler. Only used for /metrics
+// WrapHandlerInBasicAuth adds basic auth to a handler. Only used for /metrics and /debug
 func WrapHandlerInBasicAuth(h http.Handler, b BasicAuth) http.HandlerFunc {
 	if b.Username == "" || b.Password == "" {
-		logrus.Warn("Metrics are exposed without protection. Make sure you set up protection at proxy level.")
+		logrus.Warn("Metrics or debug endpoints are exposed without protection. Make sure you set up protection at proxy level.")
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Serve without authorization if either Username or Password is unset
@@ -15,9 +15,14 @@
 package httputil
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -107,3 +112,52 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+type lockedUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *lockedUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
+	res.Device = &userapi.Device{UserID: "@alice:example.com", ID: "device"}
+	res.Locked = true
+	return nil
+}
+
+type expiredUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *expiredUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
+	res.Device = &userapi.Device{UserID: "@alice:example.com", ID: "device"}
+	res.Expired = true
+	res.AdminContact = "mailto:admin@example.com"
+	return nil
+}
+
+func TestMakeLockedAuthAPI(t *testing.T) {
+	f := func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		wantCode int
+		wantBody string
+	}{
+		{"auth", MakeAuthAPI("test", &lockedUserAPI{}, f), http.StatusUnauthorized, `"errcode":"M_USER_LOCKED"`},
+		{"lockedAuth", MakeLockedAuthAPI("test", &lockedUserAPI{}, f), http.StatusOK, `{}`},
+		{"expiredAuth", MakeAuthAPI("test", &expiredUserAPI{}, f), http.StatusForbidden, `"errcode":"M_RESOURCE_LIMIT_EXCEEDED"`},
+		{"expiredLockedAuth", MakeLockedAuthAPI("test", &expiredUserAPI{}, f), http.StatusOK, `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/logout", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, req)
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("got HTTP %d %s, want HTTP %d with %s", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
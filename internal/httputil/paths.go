@@ -20,5 +20,8 @@ const (
 	PublicKeyPathPrefix        = "/_matrix/key/"
 	PublicMediaPathPrefix      = "/_matrix/media/"
 	PublicWellKnownPrefix      = "/.well-known/matrix/"
+	PublicStaticPath           = "/_matrix/static/"
+	DendriteAdminPathPrefix    = "/_dendrite/"
 	InternalPathPrefix         = "/api/"
+	DebugPathPrefix            = "/debug/"
 )
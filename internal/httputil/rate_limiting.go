@@ -1,35 +1,142 @@
 package httputil
 
 import (
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 )
 
-type RateLimits struct {
-	limits           map[string]chan struct{}
-	limitsMutex      sync.RWMutex
-	cleanMutex       sync.RWMutex
-	enabled          bool
+// RateLimitGroup identifies a class of endpoints which share rate limiting
+// settings. Callers are tracked separately in each group, so hitting the
+// limit in one group doesn't affect requests in other groups.
+type RateLimitGroup string
+
+const (
+	// RateLimitGroupClient covers client API endpoints which don't belong to
+	// one of the more specific groups below.
+	RateLimitGroupClient RateLimitGroup = "client"
+	// RateLimitGroupLogin covers login, registration and other account
+	// management endpoints.
+	RateLimitGroupLogin RateLimitGroup = "login"
+	// RateLimitGroupMessaging covers endpoints which send events into rooms.
+	RateLimitGroupMessaging RateLimitGroup = "messaging"
+	// RateLimitGroupMedia covers media uploads, downloads and thumbnails.
+	RateLimitGroupMedia RateLimitGroup = "media"
+	// RateLimitGroupFederation covers inbound federation transactions, which
+	// are limited per origin server.
+	RateLimitGroupFederation RateLimitGroup = "federation"
+)
+
+type rateLimitGroupSettings struct {
 	requestThreshold int64
 	cooloffDuration  time.Duration
 }
 
+type RateLimits struct {
+	limits        map[string]chan struct{}
+	limitsMutex   sync.RWMutex
+	cleanMutex    sync.RWMutex
+	cleanOnce     sync.Once
+	settingsMutex sync.RWMutex
+	cfg           config.RateLimiting
+	enabled       bool
+	groups        map[RateLimitGroup]rateLimitGroupSettings
+	exemptUserIDs map[string]struct{}
+	exemptIPNets  []*net.IPNet
+	proxyIPNets   []*net.IPNet
+}
+
 func NewRateLimits(cfg *config.RateLimiting) *RateLimits {
 	l := &RateLimits{
-		limits:           make(map[string]chan struct{}),
-		enabled:          cfg.Enabled,
+		limits: make(map[string]chan struct{}),
+	}
+	l.Update(cfg)
+	return l
+}
+
+// Config returns a copy of the rate limiting configuration currently in use.
+func (l *RateLimits) Config() config.RateLimiting {
+	l.settingsMutex.RLock()
+	defer l.settingsMutex.RUnlock()
+	return l.cfg
+}
+
+// Update replaces the rate limiting configuration at runtime. The configuration
+// should already have been verified. All callers have their limits reset, since
+// the thresholds that they were counted against may have changed.
+func (l *RateLimits) Update(cfg *config.RateLimiting) {
+	groups := map[RateLimitGroup]rateLimitGroupSettings{
+		RateLimitGroupClient:     groupSettings(cfg, config.RateLimitingGroup{}),
+		RateLimitGroupLogin:      groupSettings(cfg, cfg.Login),
+		RateLimitGroupMessaging:  groupSettings(cfg, cfg.Messaging),
+		RateLimitGroupMedia:      groupSettings(cfg, cfg.Media),
+		RateLimitGroupFederation: groupSettings(cfg, cfg.Federation),
+	}
+	exemptUserIDs := make(map[string]struct{}, len(cfg.ExemptUserIDs))
+	for _, userID := range cfg.ExemptUserIDs {
+		exemptUserIDs[userID] = struct{}{}
+	}
+	exemptIPNets := parseIPNets(cfg.ExemptIPAddresses, "rate limiting exemption")
+	proxyIPNets := parseIPNets(cfg.TrustedProxies, "trusted proxy")
+
+	l.settingsMutex.Lock()
+	l.cfg = *cfg
+	l.enabled = cfg.Enabled
+	l.groups = groups
+	l.exemptUserIDs = exemptUserIDs
+	l.exemptIPNets = exemptIPNets
+	l.proxyIPNets = proxyIPNets
+	l.settingsMutex.Unlock()
+
+	l.cleanMutex.Lock()
+	l.limitsMutex.Lock()
+	l.limits = make(map[string]chan struct{})
+	l.limitsMutex.Unlock()
+	l.cleanMutex.Unlock()
+
+	if cfg.Enabled {
+		l.cleanOnce.Do(func() {
+			go l.clean()
+		})
+	}
+}
+
+func parseIPNets(addrs []string, what string) []*net.IPNet {
+	ipNets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		ipNet, err := config.ParseIPOrCIDR(addr)
+		if err != nil {
+			logrus.WithError(err).Warnf("Ignoring invalid %s %q", what, addr)
+			continue
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets
+}
+
+// groupSettings returns the settings for a group, falling back to the
+// top-level threshold and cooloff for any values that the group doesn't set.
+func groupSettings(cfg *config.RateLimiting, group config.RateLimitingGroup) rateLimitGroupSettings {
+	s := rateLimitGroupSettings{
 		requestThreshold: cfg.Threshold,
 		cooloffDuration:  time.Duration(cfg.CooloffMS) * time.Millisecond,
 	}
-	if l.enabled {
-		go l.clean()
+	if group.Threshold > 0 {
+		s.requestThreshold = group.Threshold
 	}
-	return l
+	if group.CooloffMS > 0 {
+		s.cooloffDuration = time.Duration(group.CooloffMS) * time.Millisecond
+	}
+	return s
 }
 
 func (l *RateLimits) clean() {
@@ -52,9 +159,46 @@ func (l *RateLimits) clean() {
 	}
 }
 
-func (l *RateLimits) Limit(req *http.Request) *util.JSONResponse {
-	// If rate limiting is disabled then do nothing.
-	if !l.enabled {
+// Limit applies the rate limits for the given group to a client request.
+// Requests made by a device are limited per user, and all other requests
+// are limited per IP address. Returns nil if the request may proceed.
+func (l *RateLimits) Limit(req *http.Request, device *userapi.Device, group RateLimitGroup) *util.JSONResponse {
+	ip := l.ClientIP(req)
+	if device != nil {
+		if l.isExemptUser(device.UserID) {
+			return nil
+		}
+		return l.limit(group, device.UserID, ip)
+	}
+	caller := req.RemoteAddr
+	if ip != nil {
+		caller = ip.String()
+	}
+	return l.limit(group, caller, ip)
+}
+
+// LimitFederation applies the federation rate limits to a request from the
+// given origin server. Returns nil if the request may proceed.
+func (l *RateLimits) LimitFederation(req *http.Request, origin gomatrixserverlib.ServerName) *util.JSONResponse {
+	return l.limit(RateLimitGroupFederation, string(origin), l.ClientIP(req))
+}
+
+func (l *RateLimits) isExemptUser(userID string) bool {
+	l.settingsMutex.RLock()
+	defer l.settingsMutex.RUnlock()
+	_, ok := l.exemptUserIDs[userID]
+	return ok
+}
+
+func (l *RateLimits) limit(group RateLimitGroup, caller string, ip net.IP) *util.JSONResponse {
+	l.settingsMutex.RLock()
+	enabled := l.enabled
+	settings := l.groups[group]
+	exempt := ip != nil && containsIP(l.exemptIPNets, ip)
+	l.settingsMutex.RUnlock()
+
+	// If rate limiting is disabled or the caller is exempt then do nothing.
+	if !enabled || exempt {
 		return nil
 	}
 
@@ -65,25 +209,23 @@ func (l *RateLimits) Limit(req *http.Request) *util.JSONResponse {
 	l.cleanMutex.RLock()
 	defer l.cleanMutex.RUnlock()
 
-	// First of all, work out if X-Forwarded-For was sent to us. If not
-	// then we'll just use the IP address of the caller.
-	caller := req.RemoteAddr
-	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		caller = forwardedFor
-	}
+	// Callers are tracked separately in each group.
+	key := string(group) + "|" + caller
 
 	// Look up the caller's channel, if they have one.
 	l.limitsMutex.RLock()
-	rateLimit, ok := l.limits[caller]
+	rateLimit, ok := l.limits[key]
 	l.limitsMutex.RUnlock()
 
 	// If the caller doesn't have a channel, create one and write it
-	// back to the map.
+	// back to the map. Another request from the same caller may have
+	// beaten us to it, in which case use theirs.
 	if !ok {
-		rateLimit = make(chan struct{}, l.requestThreshold)
-
 		l.limitsMutex.Lock()
-		l.limits[caller] = rateLimit
+		if rateLimit, ok = l.limits[key]; !ok {
+			rateLimit = make(chan struct{}, settings.requestThreshold)
+			l.limits[key] = rateLimit
+		}
 		l.limitsMutex.Unlock()
 	}
 
@@ -95,15 +237,63 @@ func (l *RateLimits) Limit(req *http.Request) *util.JSONResponse {
 		// We hit the rate limit. Tell the client to back off.
 		return &util.JSONResponse{
 			Code: http.StatusTooManyRequests,
-			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", l.cooloffDuration.Milliseconds()),
+			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", settings.cooloffDuration.Milliseconds()),
 		}
 	}
 
 	// After the time interval, drain a resource from the rate limiting
 	// channel. This will free up space in the channel for new requests.
 	go func() {
-		<-time.After(l.cooloffDuration)
+		<-time.After(settings.cooloffDuration)
 		<-rateLimit
 	}()
 	return nil
 }
+
+// ClientIP works out the IP address of the client which made the request.
+// This is the address of the remote end of the connection, unless that is one
+// of the trusted proxies, in which case the X-Forwarded-For header is followed
+// back to the first address which isn't a trusted proxy. Returns nil if no
+// valid IP address could be found.
+func (l *RateLimits) ClientIP(req *http.Request) net.IP {
+	l.settingsMutex.RLock()
+	proxyIPNets := l.proxyIPNets
+	l.settingsMutex.RUnlock()
+	return clientIP(req, proxyIPNets)
+}
+
+func clientIP(req *http.Request, proxyIPNets []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(proxyIPNets, ip) {
+		return ip
+	}
+	// Each proxy appends the address that it received the request from, so
+	// the addresses are checked from the last one. Anything before the first
+	// address which isn't a trusted proxy was sent by the client and can't be
+	// trusted.
+	forwardedFor := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwarded := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if forwarded == nil {
+			break
+		}
+		ip = forwarded
+		if !containsIP(proxyIPNets, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func containsIP(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestRateLimits(t *testing.T) {
+	cfg := &config.RateLimiting{
+		Enabled:           true,
+		Threshold:         2,
+		CooloffMS:         60 * 60 * 1000,
+		ExemptUserIDs:     []string{"@bot:test"},
+		ExemptIPAddresses: []string{"10.0.0.0/8"},
+		Login: config.RateLimitingGroup{
+			Threshold: 1,
+		},
+	}
+	l := NewRateLimits(cfg)
+
+	newRequest := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+	alice := &userapi.Device{UserID: "@alice:test"}
+	bot := &userapi.Device{UserID: "@bot:test"}
+
+	// Requests from the same IP address on different ports share a limit.
+	if r := l.Limit(newRequest("192.0.2.1:1000"), nil, RateLimitGroupClient); r != nil {
+		t.Fatalf("first request was unexpectedly limited")
+	}
+	if r := l.Limit(newRequest("192.0.2.1:1001"), nil, RateLimitGroupClient); r != nil {
+		t.Fatalf("second request was unexpectedly limited")
+	}
+	if r := l.Limit(newRequest("192.0.2.1:1002"), nil, RateLimitGroupClient); r == nil || r.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request should have been limited")
+	}
+
+	// Groups are tracked separately and can override the threshold.
+	if r := l.Limit(newRequest("192.0.2.1:1003"), nil, RateLimitGroupLogin); r != nil {
+		t.Fatalf("first login request was unexpectedly limited")
+	}
+	if r := l.Limit(newRequest("192.0.2.1:1004"), nil, RateLimitGroupLogin); r == nil {
+		t.Fatalf("second login request should have been limited")
+	}
+
+	// Authenticated requests are limited per user rather than per IP address.
+	for i := 0; i < 2; i++ {
+		if r := l.Limit(newRequest("192.0.2.1:1005"), alice, RateLimitGroupClient); r != nil {
+			t.Fatalf("request %d from alice was unexpectedly limited", i)
+		}
+	}
+	if r := l.Limit(newRequest("192.0.2.2:1000"), alice, RateLimitGroupClient); r == nil {
+		t.Fatalf("request from alice should have been limited")
+	}
+
+	// Exempt users and IP addresses are never limited.
+	for i := 0; i < 5; i++ {
+		if r := l.Limit(newRequest("192.0.2.1:1006"), bot, RateLimitGroupClient); r != nil {
+			t.Fatalf("request %d from exempt user was limited", i)
+		}
+		if r := l.Limit(newRequest("10.1.2.3:1000"), nil, RateLimitGroupClient); r != nil {
+			t.Fatalf("request %d from exempt IP address was limited", i)
+		}
+	}
+
+	// Federation requests are limited per origin server.
+	for i := 0; i < 2; i++ {
+		if r := l.LimitFederation(newRequest("192.0.2.3:1000"), "a.test"); r != nil {
+			t.Fatalf("federation request %d was unexpectedly limited", i)
+		}
+	}
+	if r := l.LimitFederation(newRequest("192.0.2.3:1000"), "a.test"); r == nil {
+		t.Fatalf("federation request should have been limited")
+	}
+	if r := l.LimitFederation(newRequest("192.0.2.3:1000"), "b.test"); r != nil {
+		t.Fatalf("federation request from another origin was unexpectedly limited")
+	}
+
+	// Updating the settings at runtime resets existing limits.
+	updated := *cfg
+	updated.Threshold = 3
+	l.Update(&updated)
+	for i := 0; i < 3; i++ {
+		if r := l.Limit(newRequest("192.0.2.1:1007"), nil, RateLimitGroupClient); r != nil {
+			t.Fatalf("request %d after update was unexpectedly limited", i)
+		}
+	}
+	if r := l.Limit(newRequest("192.0.2.1:1008"), nil, RateLimitGroupClient); r == nil {
+		t.Fatalf("request after update should have been limited")
+	}
+	if got := l.Config().Threshold; got != 3 {
+		t.Fatalf("expected updated threshold 3, got %d", got)
+	}
+
+	// Disabling rate limiting at runtime lets everything through.
+	updated.Enabled = false
+	l.Update(&updated)
+	if r := l.Limit(newRequest("192.0.2.1:1009"), nil, RateLimitGroupLogin); r != nil {
+		t.Fatalf("request was limited while rate limiting was disabled")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	l := NewRateLimits(&config.RateLimiting{
+		TrustedProxies: []string{"192.0.2.0/24"},
+	})
+	tsts := []struct {
+		Name         string
+		RemoteAddr   string
+		ForwardedFor []string
+		Want         string
+	}{
+		{"direct", "198.51.100.1:1000", nil, "198.51.100.1"},
+		{"untrusted peer", "198.51.100.1:1000", []string{"10.1.2.3"}, "198.51.100.1"},
+		{"trusted proxy", "192.0.2.1:1000", []string{"198.51.100.2"}, "198.51.100.2"},
+		{"proxy chain", "192.0.2.1:1000", []string{"198.51.100.2, 192.0.2.2"}, "198.51.100.2"},
+		{"spoofed by client", "192.0.2.1:1000", []string{"10.1.2.3, 198.51.100.2"}, "198.51.100.2"},
+		{"several headers", "192.0.2.1:1000", []string{"10.1.2.3", "198.51.100.2"}, "198.51.100.2"},
+		{"invalid address", "192.0.2.1:1000", []string{"198.51.100.2, nonsense"}, "192.0.2.1"},
+		{"no header", "192.0.2.1:1000", nil, "192.0.2.1"},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tst.RemoteAddr
+			for _, v := range tst.ForwardedFor {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := l.ClientIP(req).String(); got != tst.Want {
+				t.Errorf("got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestForwardedForIsNotTrustedByDefault(t *testing.T) {
+	l := NewRateLimits(&config.RateLimiting{
+		Enabled:           true,
+		Threshold:         1,
+		CooloffMS:         60 * 60 * 1000,
+		ExemptIPAddresses: []string{"10.0.0.0/8"},
+	})
+	// Neither claiming to be an exempt address nor rotating addresses gets
+	// around the limit of the address that the requests come from.
+	for i, forwardedFor := range []string{"10.1.2.3", "10.1.2.3", "198.51.100.1"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1000"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		r := l.Limit(req, nil, RateLimitGroupClient)
+		if limited := r != nil; limited != (i > 0) {
+			t.Fatalf("request %d with X-Forwarded-For %s: got limited %v, want %v", i, forwardedFor, limited, i > 0)
+		}
+	}
+}
@@ -15,7 +15,11 @@
 package httputil
 
 import (
+	"net/http"
 	"net/url"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
 )
 
 // URLDecodeMapValues is a function that iterates through each of the items in a
@@ -33,3 +37,25 @@ func URLDecodeMapValues(vmap map[string]string) (map[string]string, error) {
 
 	return decoded, nil
 }
+
+// NotFoundHandler returns a handler which responds to requests for unknown
+// endpoints with a Matrix-style M_UNRECOGNIZED error.
+func NotFoundHandler() http.Handler {
+	return util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.Unrecognized("Unrecognized request"),
+		}
+	}))
+}
+
+// MethodNotAllowedHandler returns a handler which responds to requests made
+// with an unsupported method with a Matrix-style M_UNRECOGNIZED error.
+func MethodNotAllowedHandler() http.Handler {
+	return util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.Unrecognized("Unrecognized request"),
+		}
+	}))
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package passwordhash hashes passwords for storing in the account database,
+// with either bcrypt or argon2id.
+package passwordhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// ErrMismatchedHashAndPassword is returned by Compare when the password
+// doesn't match the hash.
+var ErrMismatchedHashAndPassword = bcrypt.ErrMismatchedHashAndPassword
+
+// Hasher hashes new passwords with the algorithm which the server is set up
+// to use, and checks passwords against hashes made with any algorithm.
+type Hasher struct {
+	// The algorithm to hash with, which is bcrypt if it is empty.
+	Algorithm  config.PasswordHashingAlgorithm
+	BCryptCost int
+	Argon2id   config.Argon2id
+}
+
+// NewHasher returns a hasher which hashes passwords as the user API config
+// says to.
+func NewHasher(cfg *config.UserAPI) *Hasher {
+	return &Hasher{
+		Algorithm:  cfg.PasswordHashing,
+		BCryptCost: cfg.BCryptCost,
+		Argon2id:   cfg.Argon2id,
+	}
+}
+
+// Hash hashes the password.
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.Algorithm != config.PasswordHashingArgon2id {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BCryptCost)
+		return string(hash), err
+	}
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := h.Argon2id
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, argon2idKeyLength)
+	// This is the PHC string format, as used by the reference implementation.
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Compare returns ErrMismatchedHashAndPassword if the password doesn't match
+// the hash. If it does, needsRehash is true if the hash was made with another
+// algorithm or with different parameters than new passwords are hashed with,
+// so that the password should be hashed again.
+func (h *Hasher) Compare(hash, password string) (needsRehash bool, err error) {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		if err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return false, err
+		}
+		if h.Algorithm == config.PasswordHashingArgon2id {
+			return true, nil
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.BCryptCost, nil
+	}
+	p, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, ErrMismatchedHashAndPassword
+	}
+	return h.Algorithm != config.PasswordHashingArgon2id || p != h.Argon2id || len(key) != argon2idKeyLength, nil
+}
+
+// decodeArgon2id returns the parameters, salt and key of an argon2id hash.
+func decodeArgon2id(hash string) (p config.Argon2id, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errors.New("passwordhash: malformed argon2id hash")
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, fmt.Errorf("passwordhash: malformed argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("passwordhash: unsupported argon2id version %d", version)
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, fmt.Errorf("passwordhash: malformed argon2id parameters: %w", err)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, fmt.Errorf("passwordhash: malformed argon2id salt: %w", err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, fmt.Errorf("passwordhash: malformed argon2id key: %w", err)
+	}
+	if len(key) == 0 || p.Time == 0 || p.Threads == 0 {
+		return p, nil, nil, errors.New("passwordhash: invalid argon2id parameters")
+	}
+	return p, salt, key, nil
+}
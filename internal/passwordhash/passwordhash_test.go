@@ -0,0 +1,70 @@
+package passwordhash
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHasher(t *testing.T) {
+	bcryptHasher := &Hasher{Algorithm: config.PasswordHashingBCrypt, BCryptCost: bcrypt.MinCost}
+	argon2idHasher := &Hasher{
+		Algorithm: config.PasswordHashingArgon2id,
+		Argon2id:  config.Argon2id{Time: 1, Memory: 64, Threads: 1},
+	}
+	tsts := []struct {
+		Name            string
+		HashWith        *Hasher
+		CompareWith     *Hasher
+		WantPrefix      string
+		WantNeedsRehash bool
+	}{
+		{"bcrypt", bcryptHasher, bcryptHasher, "$2a$", false},
+		{"argon2id", argon2idHasher, argon2idHasher, "$argon2id$v=19$m=64,t=1,p=1$", false},
+		{"bcryptToArgon2id", bcryptHasher, argon2idHasher, "$2a$", true},
+		{"argon2idToBCrypt", argon2idHasher, bcryptHasher, "$argon2id$", true},
+		{"bcryptCost", bcryptHasher, &Hasher{BCryptCost: bcrypt.MinCost + 1}, "$2a$", true},
+		{"argon2idParameters", argon2idHasher, &Hasher{
+			Algorithm: config.PasswordHashingArgon2id,
+			Argon2id:  config.Argon2id{Time: 2, Memory: 64, Threads: 1},
+		}, "$argon2id$", true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			hash, err := tst.HashWith.Hash("password")
+			if err != nil {
+				t.Fatalf("Hash failed: %s", err)
+			}
+			if !strings.HasPrefix(hash, tst.WantPrefix) {
+				t.Fatalf("got hash %q, want one starting with %q", hash, tst.WantPrefix)
+			}
+			if _, err = tst.CompareWith.Compare(hash, "wrong"); err != ErrMismatchedHashAndPassword {
+				t.Errorf("Compare with the wrong password: got %v, want ErrMismatchedHashAndPassword", err)
+			}
+			needsRehash, err := tst.CompareWith.Compare(hash, "password")
+			if err != nil {
+				t.Fatalf("Compare failed: %s", err)
+			}
+			if needsRehash != tst.WantNeedsRehash {
+				t.Errorf("got needsRehash %v, want %v", needsRehash, tst.WantNeedsRehash)
+			}
+		})
+	}
+}
+
+func TestCompareMalformedArgon2id(t *testing.T) {
+	h := &Hasher{}
+	for _, hash := range []string{
+		"$argon2id$",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$",
+	} {
+		if _, err := h.Compare(hash, "password"); err == nil || err == ErrMismatchedHashAndPassword {
+			t.Errorf("Compare(%q): got %v, want an error for a malformed hash", hash, err)
+		}
+	}
+}
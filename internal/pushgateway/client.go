@@ -0,0 +1,94 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// Client sends notifications to push gateways.
+type Client interface {
+	// Notify sends a notification to the push gateway at the given URL.
+	Notify(ctx context.Context, url string, req *NotifyRequest, res *NotifyResponse) error
+}
+
+// StatusError is returned by Notify when the push gateway responds with an
+// unsuccessful HTTP status.
+type StatusError struct {
+	Code int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("push gateway returned HTTP %d", e.Code)
+}
+
+// Temporary returns whether the request might succeed if it is retried. Push
+// gateways respond with a 4xx status when the notification will never be
+// accepted.
+func (e StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
+type httpClient struct {
+	hc *http.Client
+}
+
+// NewHTTPClient creates a client which sends notifications over HTTP, to the
+// push gateways which the config allows connecting to.
+func NewHTTPClient(cfg *config.PushGateways) Client {
+	return &httpClient{
+		hc: NewRestrictedHTTPClient(cfg, 30*time.Second),
+	}
+}
+
+func (c *httpClient) Notify(ctx context.Context, url string, req *NotifyRequest, res *NotifyResponse) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hres, err := c.hc.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Drain the body so that the connection can be reused.
+		_, _ = io.Copy(ioutil.Discard, hres.Body)
+		_ = hres.Body.Close()
+	}()
+	if hres.StatusCode != http.StatusOK {
+		return StatusError{Code: hres.StatusCode}
+	}
+	// Some UnifiedPush gateways respond without a body when they accept all
+	// of the pushkeys.
+	if err = json.NewDecoder(hres.Body).Decode(res); err != nil && err != io.EOF {
+		return fmt.Errorf("json.Decode: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// ErrPrivateAddress is returned when a request would be sent to a private
+// address, which the config doesn't allow.
+var ErrPrivateAddress = errors.New("push gateways at private addresses are not allowed")
+
+// privateNetworks are the networks, besides loopback and link-local ones,
+// which aren't reachable from the internet.
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckURL returns an error saying what is wrong with the URL of a push
+// gateway if the config doesn't allow it.
+func CheckURL(ctx context.Context, cfg *config.PushGateways, gatewayURL string) error {
+	parsed, err := url.Parse(gatewayURL)
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("must be an absolute URL")
+	}
+	if err = checkSchemeAndHost(cfg, parsed); err != nil {
+		return err
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if cfg.DenyPrivateIPs {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("must have a host which can be resolved")
+		}
+		for _, addr := range addrs {
+			if isPrivateIP(addr.IP) {
+				return fmt.Errorf("must not be at a private address")
+			}
+		}
+	}
+	return nil
+}
+
+func checkSchemeAndHost(cfg *config.PushGateways, u *url.URL) error {
+	if !containsString(cfg.AllowedSchemes, u.Scheme) {
+		return fmt.Errorf("must use one of the schemes %s", strings.Join(cfg.AllowedSchemes, ", "))
+	}
+	if len(cfg.AllowedHosts) > 0 && !isAllowedHost(cfg.AllowedHosts, strings.ToLower(u.Hostname())) {
+		return fmt.Errorf("must be at one of the allowed hosts")
+	}
+	return nil
+}
+
+func isAllowedHost(allowed []string, host string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if host == a || (strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRestrictedHTTPClient creates an HTTP client which refuses to connect to
+// private addresses if the config says so. The addresses are checked when
+// connecting, so that hosts which resolve to a different address after their
+// URL was checked are still refused. Redirects are only followed to URLs with
+// an allowed scheme and host.
+func NewRestrictedHTTPClient(cfg *config.PushGateways, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.DenyPrivateIPs {
+		dialer := &net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+					return ErrPrivateAddress
+				}
+				return nil
+			},
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if err := checkSchemeAndHost(cfg, req.URL); err != nil {
+				return fmt.Errorf("push gateway redirected to a URL which %w", err)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestCheckURL(t *testing.T) {
+	cfg := &config.PushGateways{
+		AllowedSchemes: []string{"https"},
+		AllowedHosts:   []string{"8.8.8.8", "*.example.com"},
+		DenyPrivateIPs: true,
+	}
+	tsts := []struct {
+		Name    string
+		URL     string
+		WantErr bool
+	}{
+		{"allowedHost", "https://8.8.8.8/_matrix/push/v1/notify", false},
+		{"relative", "/_matrix/push/v1/notify", true},
+		{"disallowedScheme", "http://8.8.8.8/_matrix/push/v1/notify", true},
+		{"disallowedHost", "https://8.8.4.4/_matrix/push/v1/notify", true},
+		{"lookalikeHost", "https://push.example.com.invalid/_matrix/push/v1/notify", true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if err := CheckURL(context.Background(), cfg, tst.URL); (err != nil) != tst.WantErr {
+				t.Errorf("CheckURL: got error %v, want error %v", err, tst.WantErr)
+			}
+		})
+	}
+
+	open := &config.PushGateways{AllowedSchemes: []string{"https", "http"}}
+	for _, u := range []string{"http://127.0.0.1:8080/", "https://[::1]/", "http://10.1.2.3/", "http://192.168.0.1/", "http://169.254.169.254/"} {
+		if err := CheckURL(context.Background(), open, u); err != nil {
+			t.Errorf("CheckURL(%q): got error %v want private addresses allowed", u, err)
+		}
+		open.DenyPrivateIPs = true
+		if err := CheckURL(context.Background(), open, u); err == nil {
+			t.Errorf("CheckURL(%q): got no error want private addresses refused", u)
+		}
+		open.DenyPrivateIPs = false
+	}
+}
+
+func TestIsAllowedHost(t *testing.T) {
+	allowed := []string{"push.example.com", "*.gateway.org"}
+	for host, want := range map[string]bool{
+		"push.example.com":     true,
+		"other.example.com":    false,
+		"a.gateway.org":        true,
+		"a.b.gateway.org":      true,
+		"gateway.org":          false,
+		"evilgateway.org":      false,
+		"push.example.com.org": false,
+	} {
+		if got := isAllowedHost(allowed, host); got != want {
+			t.Errorf("isAllowedHost(%q): got %v want %v", host, got, want)
+		}
+	}
+}
+
+func TestRestrictedHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+
+	hc := NewRestrictedHTTPClient(&config.PushGateways{DenyPrivateIPs: true}, time.Second)
+	if _, err := hc.Get(srv.URL); !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("got error %v want %v", err, ErrPrivateAddress)
+	}
+	hc = NewRestrictedHTTPClient(&config.PushGateways{}, time.Second)
+	res, err := hc.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("got error %v want private addresses allowed", err)
+	}
+	_ = res.Body.Close()
+}
+
+func TestRestrictedHTTPClientRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if target := req.URL.Query().Get("to"); target != "" {
+			http.Redirect(w, req, target, http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	// srv.URL is at 127.0.0.1, so redirects to localhost reach the same
+	// server under a different host.
+	localhostURL := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	cfg := &config.PushGateways{
+		AllowedSchemes: []string{"http"},
+		AllowedHosts:   []string{"127.0.0.1"},
+	}
+	tsts := []struct {
+		Name    string
+		To      string
+		WantErr bool
+	}{
+		{"allowedHost", srv.URL + "/notify", false},
+		{"disallowedHost", localhostURL + "/notify", true},
+		{"disallowedScheme", strings.Replace(srv.URL, "http://", "https://", 1) + "/notify", true},
+	}
+	hc := NewRestrictedHTTPClient(cfg, time.Second)
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			res, err := hc.Get(srv.URL + "/?to=" + url.QueryEscape(tst.To))
+			if err == nil {
+				_ = res.Body.Close()
+			}
+			if (err != nil) != tst.WantErr {
+				t.Errorf("got error %v, want error %v", err, tst.WantErr)
+			}
+		})
+	}
+}
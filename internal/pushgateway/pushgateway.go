@@ -0,0 +1,103 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushgateway implements a client for the Push Gateway API, which
+// homeservers use to deliver push notifications to the gateways registered
+// by a user's pushers.
+package pushgateway
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// NotifyRequest is the body of a request to /_matrix/push/v1/notify.
+// https://spec.matrix.org/v1.2/push-gateway-api/#post_matrixpushv1notify
+type NotifyRequest struct {
+	Notification Notification `json:"notification"`
+}
+
+// NotifyResponse is the response to a request to /_matrix/push/v1/notify.
+type NotifyResponse struct {
+	// The pushkeys which the gateway rejected. Pushers using them should be
+	// removed, as the gateway will never accept them.
+	Rejected []string `json:"rejected"`
+}
+
+// Notification describes the event that a push notification is for.
+type Notification struct {
+	Content           json.RawMessage `json:"content,omitempty"`
+	Counts            *Counts         `json:"counts,omitempty"`
+	Devices           []*Device       `json:"devices"`
+	EventID           string          `json:"event_id,omitempty"`
+	Prio              Prio            `json:"prio,omitempty"`
+	RoomAlias         string          `json:"room_alias,omitempty"`
+	RoomID            string          `json:"room_id,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	Type              string          `json:"type,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+}
+
+// Counts are the unread counts to display, for example as a badge.
+type Counts struct {
+	MissedCalls int `json:"missed_calls,omitempty"`
+	Unread      int `json:"unread"`
+}
+
+// Device is a pusher that the notification should be delivered to.
+type Device struct {
+	AppID     string                      `json:"app_id"`
+	Data      map[string]interface{}      `json:"data"`
+	PushKey   string                      `json:"pushkey"`
+	PushKeyTS gomatrixserverlib.Timestamp `json:"pushkey_ts,omitempty"`
+	Tweaks    map[string]interface{}      `json:"tweaks,omitempty"`
+}
+
+// EventIDOnlyFormat is the value of the format key in the pusher data which
+// asks for notifications to only contain the event and room IDs, the counts
+// and the priority. The client then fetches the event itself, so that its
+// content isn't seen by the push gateway or the push provider.
+const EventIDOnlyFormat = "event_id_only"
+
+// EncryptedEventType is the type of end-to-end encrypted events.
+const EncryptedEventType = "m.room.encrypted"
+
+// Format returns the notification as it should be sent to pushers which
+// asked for the given format in their data. Notifications for encrypted
+// events are always in the event_id_only format: the push gateway can't
+// read the ciphertext, which is often larger than push providers accept,
+// and the client has to fetch the event to decrypt it anyway.
+func (n *Notification) Format(format string) Notification {
+	if format != EventIDOnlyFormat && n.Type != EncryptedEventType {
+		return *n
+	}
+	return Notification{
+		Counts:  n.Counts,
+		Devices: n.Devices,
+		EventID: n.EventID,
+		Prio:    n.Prio,
+		RoomID:  n.RoomID,
+	}
+}
+
+// Prio is the priority of a notification.
+type Prio string
+
+const (
+	HighPrio Prio = "high"
+	LowPrio  Prio = "low"
+)
@@ -0,0 +1,87 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// NotifyPath is the path of the notify endpoint of push gateways.
+const NotifyPath = "/_matrix/push/v1/notify"
+
+// unifiedPushDiscovery is the response of a UnifiedPush gateway to a GET
+// request, which says what kind of gateway it is.
+type unifiedPushDiscovery struct {
+	UnifiedPush struct {
+		Gateway string `json:"gateway"`
+	} `json:"unifiedpush"`
+}
+
+// DiscoverGateway returns the URL to send the notifications for a pusher to.
+// URLs which end with the notify path are used as they are. Otherwise the URL
+// is expected to be a UnifiedPush gateway, such as one which is built into a
+// self-hosted distributor, or the endpoint of a UnifiedPush distributor whose
+// server has a Matrix gateway at the notify path, which the URL is rewritten
+// to. Either is checked with the discovery request of UnifiedPush.
+func DiscoverGateway(ctx context.Context, hc *http.Client, pushURL string) (string, error) {
+	parsed, err := url.Parse(pushURL)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(parsed.Path, NotifyPath) {
+		return pushURL, nil
+	}
+	if isMatrixGateway(ctx, hc, pushURL) {
+		return pushURL, nil
+	}
+	rewritten := (&url.URL{Scheme: parsed.Scheme, Host: parsed.Host, Path: NotifyPath}).String()
+	if isMatrixGateway(ctx, hc, rewritten) {
+		return rewritten, nil
+	}
+	return "", fmt.Errorf("%s is not a push gateway", pushURL)
+}
+
+// isMatrixGateway returns whether the URL is a UnifiedPush gateway for
+// Matrix notifications.
+func isMatrixGateway(ctx context.Context, hc *http.Client, gatewayURL string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gatewayURL, nil)
+	if err != nil {
+		return false
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		// Drain the body so that the connection can be reused.
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+	var discovery unifiedPushDiscovery
+	if err = json.NewDecoder(io.LimitReader(res.Body, 4096)).Decode(&discovery); err != nil {
+		return false
+	}
+	return discovery.UnifiedPush.Gateway == "matrix"
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestDiscoverGateway(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case NotifyPath, "/index.php/apps/uppush/gateway/matrix":
+			_, _ = w.Write([]byte(`{"unifiedpush":{"gateway":"matrix"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+
+	tsts := []struct {
+		Name    string
+		URL     string
+		Want    string
+		WantErr bool
+	}{
+		{"notifyPath", other.URL + NotifyPath, other.URL + NotifyPath, false},
+		{"notifyPathUnderPrefix", other.URL + "/sygnal" + NotifyPath, other.URL + "/sygnal" + NotifyPath, false},
+		{"selfHostedGateway", srv.URL + "/index.php/apps/uppush/gateway/matrix", srv.URL + "/index.php/apps/uppush/gateway/matrix", false},
+		{"distributorEndpoint", srv.URL + "/upABCDEF?up=1", srv.URL + NotifyPath, false},
+		{"notAGateway", other.URL + "/upABCDEF", "", true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			got, err := DiscoverGateway(context.Background(), srv.Client(), tst.URL)
+			if (err != nil) != tst.WantErr {
+				t.Fatalf("DiscoverGateway: got error %v, want error %v", err, tst.WantErr)
+			}
+			if got != tst.Want {
+				t.Errorf("DiscoverGateway: got %q, want %q", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestNotifyWithoutResponseBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var res NotifyResponse
+	if err := NewHTTPClient(&config.PushGateways{}).Notify(context.Background(), srv.URL+NotifyPath, &NotifyRequest{}, &res); err != nil {
+		t.Fatalf("got error %s want a response without a body to be accepted", err)
+	}
+	if len(res.Rejected) != 0 {
+		t.Fatalf("got rejected %v want none", res.Rejected)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"golang.org/x/crypto/hkdf"
+)
+
+// webPushMaxBodySize is the largest encrypted body which all push services
+// accept, and webPushRecordSize the record size used to encrypt it.
+const (
+	webPushMaxBodySize = 4096
+	webPushRecordSize  = 4096
+)
+
+// WebPushSubscription is the push subscription of a browser, as kept in the
+// data of a WebPush pusher.
+type WebPushSubscription struct {
+	// The URL of the push service to send the notifications to.
+	Endpoint string
+	// The authentication secret of the subscription.
+	Auth []byte
+	// The P-256 public key of the browser, in uncompressed form.
+	P256DH []byte
+}
+
+// ParseWebPushSubscription gets the subscription from the data of a WebPush
+// pusher, which must contain the endpoint, auth and p256dh values of the
+// subscription, the latter two being base64url encoded.
+func ParseWebPushSubscription(data map[string]interface{}) (*WebPushSubscription, error) {
+	endpoint, _ := data["endpoint"].(string)
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, fmt.Errorf("data.endpoint must be an absolute HTTPS URL")
+	}
+	auth, err := decodeBase64URL(data["auth"])
+	if err != nil || len(auth) != 16 {
+		return nil, fmt.Errorf("data.auth must be a base64url encoded 16 byte secret")
+	}
+	p256dh, err := decodeBase64URL(data["p256dh"])
+	if err != nil {
+		return nil, fmt.Errorf("data.p256dh must be base64url encoded")
+	}
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), p256dh); x == nil {
+		return nil, fmt.Errorf("data.p256dh must be an uncompressed P-256 public key")
+	}
+	return &WebPushSubscription{
+		Endpoint: endpoint,
+		Auth:     auth,
+		P256DH:   p256dh,
+	}, nil
+}
+
+// decodeBase64URL decodes base64url with or without padding, as browsers
+// differ in which they give.
+func decodeBase64URL(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("not a string")
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// ParseVAPIDPrivateKey parses an unpadded base64url encoded P-256 private key,
+// as used in the config.
+func ParseVAPIDPrivateKey(s string) (*ecdsa.PrivateKey, error) {
+	d, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) != 32 {
+		return nil, fmt.Errorf("expected a 32 byte key, got %d bytes", len(d))
+	}
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = elliptic.P256()
+	key.PublicKey.X, key.PublicKey.Y = key.PublicKey.Curve.ScalarBaseMult(d)
+	return key, nil
+}
+
+// VAPIDPublicKey returns the public key that browsers need to subscribe with,
+// as unpadded base64url of the uncompressed key.
+func VAPIDPublicKey(key *ecdsa.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+type webPushClient struct {
+	hc        *http.Client
+	key       *ecdsa.PrivateKey
+	publicKey string
+	subject   string
+	ttl       time.Duration
+}
+
+// NewWebPushClient creates a client which sends notifications straight to
+// the push services of browsers, as described in RFC 8030. The notifications
+// are encrypted as in RFC 8291, and signed with the VAPID key as in RFC 8292.
+// Push services at private addresses are refused if the push gateway config
+// says so.
+func NewWebPushClient(cfg *config.WebPush, gateways *config.PushGateways) (Client, error) {
+	key, err := ParseVAPIDPrivateKey(cfg.VAPIDPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("ParseVAPIDPrivateKey: %w", err)
+	}
+	return &webPushClient{
+		hc:        NewRestrictedHTTPClient(gateways, 30*time.Second),
+		key:       key,
+		publicKey: VAPIDPublicKey(key),
+		subject:   cfg.Subject,
+		ttl:       cfg.TTL,
+	}, nil
+}
+
+// Notify sends the notification to the subscription of each of the devices.
+// The URL is ignored, since each subscription has its own endpoint. Devices
+// whose subscriptions are invalid, or have expired, are rejected.
+func (c *webPushClient) Notify(ctx context.Context, _ string, req *NotifyRequest, res *NotifyResponse) error {
+	payload, err := webPushPayload(&req.Notification)
+	if err != nil {
+		return err
+	}
+	for _, device := range req.Notification.Devices {
+		sub, err := ParseWebPushSubscription(device.Data)
+		if err != nil {
+			res.Rejected = append(res.Rejected, device.PushKey)
+			continue
+		}
+		gone, err := c.send(ctx, sub, req.Notification.Prio, payload)
+		if err != nil {
+			return err
+		}
+		if gone {
+			res.Rejected = append(res.Rejected, device.PushKey)
+		}
+	}
+	return nil
+}
+
+// webPushPayload returns the notification to send, without the devices as
+// their data is only meant for the server. Notifications which are too large
+// for push services to accept are reduced to the event ID only format.
+func webPushPayload(n *Notification) ([]byte, error) {
+	payload := *n
+	payload.Devices = nil
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	if len(body) <= maxWebPushPayloadSize() {
+		return body, nil
+	}
+	payload = n.Format(EventIDOnlyFormat)
+	payload.Devices = nil
+	return json.Marshal(payload)
+}
+
+// maxWebPushPayloadSize is how large the payload can be for the encrypted
+// body to fit in webPushMaxBodySize: the header holds the salt, record size,
+// key ID length and the 65 byte key ID, and the record a padding delimiter
+// and the 16 byte authentication tag.
+func maxWebPushPayloadSize() int {
+	return webPushMaxBodySize - (16 + 4 + 1 + 65) - (1 + 16)
+}
+
+// send sends the payload to the subscription, and returns whether the push
+// service says that the subscription no longer exists.
+func (c *webPushClient) send(ctx context.Context, sub *WebPushSubscription, prio Prio, payload []byte) (bool, error) {
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return false, fmt.Errorf("encryptWebPush: %w", err)
+	}
+	auth, err := c.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return false, fmt.Errorf("c.vapidAuthorization: %w", err)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	hreq.Header.Set("Authorization", auth)
+	hreq.Header.Set("Content-Encoding", "aes128gcm")
+	hreq.Header.Set("Content-Type", "application/octet-stream")
+	hreq.Header.Set("TTL", strconv.Itoa(int(c.ttl.Seconds())))
+	if prio == LowPrio {
+		hreq.Header.Set("Urgency", "low")
+	} else {
+		hreq.Header.Set("Urgency", "high")
+	}
+
+	hres, err := c.hc.Do(hreq)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		// Drain the body so that the connection can be reused.
+		_, _ = io.Copy(ioutil.Discard, hres.Body)
+		_ = hres.Body.Close()
+	}()
+	switch {
+	case hres.StatusCode == http.StatusNotFound || hres.StatusCode == http.StatusGone:
+		return true, nil
+	case hres.StatusCode < 200 || hres.StatusCode >= 300:
+		return false, StatusError{Code: hres.StatusCode}
+	}
+	return false, nil
+}
+
+// vapidAuthorization returns the Authorization header for a request to the
+// endpoint, which is a JWT for the origin of the endpoint signed with the
+// VAPID key.
+func (c *webPushClient) vapidAuthorization(endpoint string) (string, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": parsed.Scheme + "://" + parsed.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": c.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) +
+		"." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return "vapid t=" + unsigned + "." + base64.RawURLEncoding.EncodeToString(sig) + ", k=" + c.publicKey, nil
+}
+
+// encryptWebPush encrypts the payload for the subscription as a single
+// aes128gcm record, with a key agreed between a new ephemeral key and the
+// browser's key, as described in RFC 8291.
+func encryptWebPush(sub *WebPushSubscription, payload []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, sub.P256DH)
+	if uaX == nil {
+		return nil, fmt.Errorf("invalid p256dh key")
+	}
+	asPrivate, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asX, asY)
+	sharedX, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := sharedX.FillBytes(make([]byte, 32))
+
+	keyInfo := append([]byte("WebPush: info\x00"), sub.P256DH...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm, err := hkdfBytes(ecdhSecret, sub.Auth, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek, err := hkdfBytes(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdfBytes(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[16:20], webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// The payload is followed by the delimiter of the last record, 0x02.
+	plaintext := make([]byte, 0, len(payload)+1)
+	plaintext = append(plaintext, payload...)
+	plaintext = append(plaintext, 2)
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+func hkdfBytes(secret, salt, info []byte, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustGenerateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	return key
+}
+
+// decryptWebPush is what the browser does to the body of a notification.
+func decryptWebPush(t *testing.T, uaKey *ecdsa.PrivateKey, auth, body []byte) []byte {
+	t.Helper()
+	salt, rs, idLen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	asPublic, ciphertext := body[21:21+idLen], body[21+idLen:]
+	if rs != webPushRecordSize {
+		t.Fatalf("got record size %d want %d", rs, webPushRecordSize)
+	}
+	asX, asY := elliptic.Unmarshal(elliptic.P256(), asPublic)
+	if asX == nil {
+		t.Fatalf("invalid key ID in header")
+	}
+	uaPublic := elliptic.Marshal(elliptic.P256(), uaKey.X, uaKey.Y)
+	sharedX, _ := elliptic.P256().ScalarMult(asX, asY, uaKey.D.Bytes())
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm, _ := hkdfBytes(sharedX.FillBytes(make([]byte, 32)), auth, keyInfo, 32)
+	cek, _ := hkdfBytes(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce, _ := hkdfBytes(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %s", err)
+	}
+	if plaintext[len(plaintext)-1] != 2 {
+		t.Fatalf("missing last record delimiter")
+	}
+	return plaintext[:len(plaintext)-1]
+}
+
+// verifyVAPID checks the Authorization header of a notification, as the push
+// service does.
+func verifyVAPID(t *testing.T, header string, key *ecdsa.PrivateKey, aud string) {
+	t.Helper()
+	if !strings.HasPrefix(header, "vapid t=") {
+		t.Fatalf("got Authorization %q want a vapid one", header)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, "vapid t="), ", k=", 2)
+	if len(parts) != 2 || parts[1] != VAPIDPublicKey(key) {
+		t.Fatalf("got Authorization %q want it to end with the VAPID public key", header)
+	}
+	jwt := strings.Split(parts[0], ".")
+	if len(jwt) != 3 {
+		t.Fatalf("got malformed JWT %q", parts[0])
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(jwt[2])
+	hash := sha256.Sum256([]byte(jwt[0] + "." + jwt[1]))
+	if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Fatalf("JWT signature doesn't verify")
+	}
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(jwt[1])
+	var claims struct {
+		Aud string `json:"aud"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil || claims.Aud != aud || claims.Sub != "mailto:admin@example.com" {
+		t.Fatalf("got claims %s want aud %q", claimsJSON, aud)
+	}
+}
+
+func TestWebPushNotify(t *testing.T) {
+	vapidKey := mustGenerateKey(t)
+	uaKey := mustGenerateKey(t)
+	auth := make([]byte, 16)
+	_, _ = rand.Read(auth)
+
+	status := http.StatusCreated
+	var received []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "aes128gcm" || req.Header.Get("TTL") != "3600" {
+			t.Errorf("got headers %v", req.Header)
+		}
+		verifyVAPID(t, req.Header.Get("Authorization"), vapidKey, "https://"+req.Host)
+		body, _ := ioutil.ReadAll(req.Body)
+		received = decryptWebPush(t, uaKey, auth, body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	c := &webPushClient{
+		hc:        srv.Client(),
+		key:       vapidKey,
+		publicKey: VAPIDPublicKey(vapidKey),
+		subject:   "mailto:admin@example.com",
+		ttl:       time.Hour,
+	}
+	device := &Device{
+		AppID:   "com.example.web",
+		PushKey: "key",
+		Data: map[string]interface{}{
+			"endpoint": srv.URL + "/push/abc",
+			"auth":     base64.RawURLEncoding.EncodeToString(auth),
+			"p256dh":   base64.URLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), uaKey.X, uaKey.Y)),
+		},
+	}
+	req := &NotifyRequest{Notification: Notification{
+		EventID: "$event:example.com",
+		RoomID:  "!room:example.com",
+		Devices: []*Device{device},
+	}}
+
+	var res NotifyResponse
+	if err := c.Notify(context.Background(), "", req, &res); err != nil {
+		t.Fatalf("failed to notify: %s", err)
+	}
+	if len(res.Rejected) != 0 {
+		t.Fatalf("got rejected %v want none", res.Rejected)
+	}
+	var got Notification
+	if err := json.Unmarshal(received, &got); err != nil {
+		t.Fatalf("failed to unmarshal payload %q: %s", received, err)
+	}
+	if got.EventID != req.Notification.EventID || got.RoomID != req.Notification.RoomID || got.Devices != nil {
+		t.Fatalf("got payload %s want the notification without the devices", received)
+	}
+
+	// A subscription which has expired is rejected, so that the pusher is
+	// removed.
+	status = http.StatusGone
+	res = NotifyResponse{}
+	if err := c.Notify(context.Background(), "", req, &res); err != nil {
+		t.Fatalf("failed to notify: %s", err)
+	}
+	if len(res.Rejected) != 1 || res.Rejected[0] != "key" {
+		t.Fatalf("got rejected %v want the pushkey", res.Rejected)
+	}
+}
+
+func TestWebPushPayloadTooLarge(t *testing.T) {
+	n := &Notification{
+		Content: json.RawMessage(`{"body":"` + strings.Repeat("a", webPushMaxBodySize) + `"}`),
+		EventID: "$event:example.com",
+		RoomID:  "!room:example.com",
+	}
+	payload, err := webPushPayload(n)
+	if err != nil {
+		t.Fatalf("failed to make payload: %s", err)
+	}
+	if len(payload) > maxWebPushPayloadSize() || strings.Contains(string(payload), "body") {
+		t.Fatalf("got payload %s want the event ID only format", payload)
+	}
+}
+
+func TestParseVAPIDPrivateKey(t *testing.T) {
+	key := mustGenerateKey(t)
+	parsed, err := ParseVAPIDPrivateKey(base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))))
+	if err != nil {
+		t.Fatalf("failed to parse key: %s", err)
+	}
+	if VAPIDPublicKey(parsed) != VAPIDPublicKey(key) {
+		t.Fatalf("got a different public key for the parsed key")
+	}
+	if _, err = ParseVAPIDPrivateKey("c2hvcnQ"); err == nil {
+		t.Fatalf("expected a short key to be refused")
+	}
+}
@@ -0,0 +1,50 @@
+package pushrules
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestActionJSON(t *testing.T) {
+	tsts := []struct {
+		Want Action
+		JSON string
+	}{
+		{Action{Kind: NotifyAction}, `"notify"`},
+		{Action{Kind: DontNotifyAction}, `"dont_notify"`},
+		{Action{Kind: CoalesceAction}, `"coalesce"`},
+		{Action{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"}, `{"set_tweak":"sound","value":"default"}`},
+		{Action{Kind: SetTweakAction, Tweak: HighlightTweak}, `{"set_tweak":"highlight"}`},
+		{Action{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false}, `{"set_tweak":"highlight","value":false}`},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.JSON, func(t *testing.T) {
+			bs, err := json.Marshal(&tst.Want)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if string(bs) != tst.JSON {
+				t.Errorf("Marshal: got %s, want %s", bs, tst.JSON)
+			}
+
+			var got Action
+			if err := json.Unmarshal([]byte(tst.JSON), &got); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tst.Want) {
+				t.Errorf("Unmarshal: got %+v, want %+v", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestActionJSONInvalid(t *testing.T) {
+	var a Action
+	if err := json.Unmarshal([]byte(`{"value":"default"}`), &a); err == nil {
+		t.Errorf("Unmarshal succeeded for an object without set_tweak")
+	}
+	if _, err := json.Marshal(&Action{Kind: NotifyAction, Value: true}); err == nil {
+		t.Errorf("Marshal succeeded for a notify action with a value")
+	}
+}
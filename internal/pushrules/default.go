@@ -0,0 +1,415 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DefaultAccountRuleSets is the initial push rules of a new account,
+// which are also used if the account has no push rules stored. The
+// server-default rules are changed by the overrides from the config.
+func DefaultAccountRuleSets(localpart string, serverName gomatrixserverlib.ServerName, overrides *DefaultRuleOverrides) *AccountRuleSets {
+	ruleSet := DefaultGlobalRuleSet(localpart, serverName)
+	overrides.Apply(ruleSet)
+	return &AccountRuleSets{
+		Global: *ruleSet,
+	}
+}
+
+// AddMissingDefaults adds the server-default global rules which the rule
+// sets don't have, for example because they were stored before the rule
+// became a default. A missing rule is added before the next default rule
+// which the rule sets do have, so that it stays after the user's rules,
+// or last if there is none. Returns whether any rules were added.
+func (s *AccountRuleSets) AddMissingDefaults(defaults *AccountRuleSets) bool {
+	added := false
+	for _, kind := range Kinds {
+		rules := s.Global.Rules(kind)
+		defaultRules := *defaults.Global.Rules(kind)
+		for j, rule := range defaultRules {
+			if ruleIndexByID(*rules, rule.RuleID) >= 0 {
+				continue
+			}
+			i := len(*rules)
+			for _, next := range defaultRules[j+1:] {
+				if k := ruleIndexByID(*rules, next.RuleID); k >= 0 {
+					i = k
+					break
+				}
+			}
+			*rules = append((*rules)[:i], append([]*Rule{rule}, (*rules)[i:]...)...)
+			added = true
+		}
+	}
+	return added
+}
+
+// DefaultGlobalRuleSet returns the server-default global push rules, which
+// are the predefined rules of the specification in the same order.
+// Every call returns new rules, so that they can be modified.
+func DefaultGlobalRuleSet(localpart string, serverName gomatrixserverlib.ServerName) *RuleSet {
+	return &RuleSet{
+		Override: []*Rule{
+			mRuleMasterDefinition(),
+			mRuleSuppressNoticesDefinition(),
+			mRuleInviteForMeDefinition(localpart, serverName),
+			mRuleMemberEventDefinition(),
+			mRuleContainsDisplayNameDefinition(),
+			mRuleTombstoneDefinition(),
+			mRuleRoomNotifDefinition(),
+		},
+		Content: []*Rule{
+			mRuleContainsUserNameDefinition(localpart),
+		},
+		Room:   []*Rule{},
+		Sender: []*Rule{},
+		Underride: []*Rule{
+			mRuleCallDefinition(),
+			mRuleEncryptedRoomOneToOneDefinition(),
+			mRuleRoomOneToOneDefinition(),
+			mRuleMessageDefinition(),
+			mRuleEncryptedDefinition(),
+		},
+	}
+}
+
+const (
+	MRuleMaster                = ".m.rule.master"
+	MRuleSuppressNotices       = ".m.rule.suppress_notices"
+	MRuleInviteForMe           = ".m.rule.invite_for_me"
+	MRuleMemberEvent           = ".m.rule.member_event"
+	MRuleContainsDisplayName   = ".m.rule.contains_display_name"
+	MRuleTombstone             = ".m.rule.tombstone"
+	MRuleRoomNotif             = ".m.rule.roomnotif"
+	MRuleContainsUserName      = ".m.rule.contains_user_name"
+	MRuleCall                  = ".m.rule.call"
+	MRuleEncryptedRoomOneToOne = ".m.rule.encrypted_room_one_to_one"
+	MRuleRoomOneToOne          = ".m.rule.room_one_to_one"
+	MRuleMessage               = ".m.rule.message"
+	MRuleEncrypted             = ".m.rule.encrypted"
+)
+
+// mRuleMasterDefinition suppresses all notifications when it is
+// enabled. It is always the most important rule.
+func mRuleMasterDefinition() *Rule {
+	return &Rule{
+		RuleID:     MRuleMaster,
+		Default:    true,
+		Enabled:    false,
+		Conditions: []*Condition{},
+		Actions:    []*Action{{Kind: DontNotifyAction}},
+	}
+}
+
+// mRuleSuppressNoticesDefinition doesn't notify for notices, which are
+// usually sent by bots.
+func mRuleSuppressNoticesDefinition() *Rule {
+	return &Rule{
+		RuleID:  MRuleSuppressNotices,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "content.msgtype",
+				Pattern: "m.notice",
+			},
+		},
+		Actions: []*Action{{Kind: DontNotifyAction}},
+	}
+}
+
+func mRuleInviteForMeDefinition(localpart string, serverName gomatrixserverlib.ServerName) *Rule {
+	return &Rule{
+		RuleID:  MRuleInviteForMe,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.member",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "content.membership",
+				Pattern: "invite",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "state_key",
+				Pattern: "@" + localpart + ":" + string(serverName),
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+}
+
+// mRuleMemberEventDefinition doesn't notify for membership changes, other
+// than the invites of the user which mRuleInviteForMeDefinition notifies
+// for.
+func mRuleMemberEventDefinition() *Rule {
+	return &Rule{
+		RuleID:  MRuleMemberEvent,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.member",
+			},
+		},
+		Actions: []*Action{{Kind: DontNotifyAction}},
+	}
+}
+
+// mRuleContainsDisplayNameDefinition highlights messages which mention the
+// user by their display name in the room.
+func mRuleContainsDisplayNameDefinition() *Rule {
+	return &Rule{
+		RuleID:  MRuleContainsDisplayName,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{Kind: ContainsDisplayNameCondition},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
+}
+
+// mRuleTombstoneDefinition highlights the upgrade of a room, so that the
+// user knows to join the new room.
+func mRuleTombstoneDefinition() *Rule {
+	return &Rule{
+		RuleID:  MRuleTombstone,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.tombstone",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "state_key",
+				Pattern: "",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
+}
+
+// mRuleRoomNotifDefinition highlights @room mentions by users who are
+// allowed to notify the whole room.
+func mRuleRoomNotifDefinition() *Rule {
+	return &Rule{
+		RuleID:  MRuleRoomNotif,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "content.body",
+				Pattern: "@room",
+			},
+			{
+				Kind: SenderNotificationPermissionCondition,
+				Key:  "room",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: true,
+			},
+		},
+	}
+}
+
+// mRuleContainsUserNameDefinition highlights messages which mention the
+// localpart of the user.
+func mRuleContainsUserNameDefinition(localpart string) *Rule {
+	return &Rule{
+		RuleID:  MRuleContainsUserName,
+		Default: true,
+		Enabled: true,
+		Pattern: localpart,
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
+}
+
+// mRuleCallDefinition rings for incoming calls.
+func mRuleCallDefinition() *Rule {
+	return &Rule{
+		RuleID:  MRuleCall,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.call.invite",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "ring",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+}
+
+// mRuleRoomOneToOneDefinition notifies with a sound for messages in rooms
+// with two members, which are usually direct chats.
+func mRuleRoomOneToOneDefinition() *Rule {
+	return oneToOneRule(MRuleRoomOneToOne, "m.room.message")
+}
+
+// mRuleEncryptedRoomOneToOneDefinition is the same as
+// mRuleRoomOneToOneDefinition for encrypted messages.
+func mRuleEncryptedRoomOneToOneDefinition() *Rule {
+	return oneToOneRule(MRuleEncryptedRoomOneToOne, "m.room.encrypted")
+}
+
+func oneToOneRule(ruleID, eventType string) *Rule {
+	return &Rule{
+		RuleID:  ruleID,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind: RoomMemberCountCondition,
+				Is:   "2",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: eventType,
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+}
+
+func mRuleEncryptedDefinition() *Rule {
+	return &Rule{
+		RuleID:  MRuleEncrypted,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.encrypted",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+}
+
+func mRuleMessageDefinition() *Rule {
+	return &Rule{
+		RuleID:  MRuleMessage,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.message",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+}
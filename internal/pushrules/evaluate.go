@@ -0,0 +1,246 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// An EvaluationContext gives a RuleSetEvaluator access to the
+// information about the user and room that some conditions need.
+type EvaluationContext interface {
+	// UserDisplayName returns the current user's display name in the
+	// room of the current event, or "" if they don't have one.
+	UserDisplayName() (string, error)
+
+	// RoomMemberCount returns the number of members in the room of
+	// the current event.
+	RoomMemberCount() (int, error)
+
+	// HasPowerLevel returns whether the user has at least the power
+	// level that the notifications key, e.g. "room", requires in the
+	// room of the current event.
+	HasPowerLevel(userID, levelKey string) (bool, error)
+}
+
+// A RuleSetEvaluator encapsulates context to evaluate an event
+// against a rule set.
+type RuleSetEvaluator struct {
+	ec      EvaluationContext
+	ruleSet []kindAndRules
+}
+
+type kindAndRules struct {
+	Kind  Kind
+	Rules []*Rule
+}
+
+// NewRuleSetEvaluator creates a new evaluator for the given rule set.
+func NewRuleSetEvaluator(ec EvaluationContext, ruleSet *RuleSet) *RuleSetEvaluator {
+	return &RuleSetEvaluator{
+		ec: ec,
+		ruleSet: []kindAndRules{
+			{OverrideKind, ruleSet.Override},
+			{ContentKind, ruleSet.Content},
+			{RoomKind, ruleSet.Room},
+			{SenderKind, ruleSet.Sender},
+			{UnderrideKind, ruleSet.Underride},
+		},
+	}
+}
+
+// MatchEvent returns the first matching rule. Returns nil if there
+// was no match rule.
+func (rse *RuleSetEvaluator) MatchEvent(event *gomatrixserverlib.Event) (*Rule, error) {
+	// The rules of each kind are stored in order of priority, with new
+	// user rules placed after the master rule but before the other
+	// server-default rules.
+	for _, rsat := range rse.ruleSet {
+		for _, rule := range rsat.Rules {
+			ok, err := ruleMatches(rule, rsat.Kind, event, rse.ec)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return rule, nil
+			}
+		}
+	}
+
+	// No matching rule.
+	return nil, nil
+}
+
+func ruleMatches(rule *Rule, kind Kind, event *gomatrixserverlib.Event, ec EvaluationContext) (bool, error) {
+	if !rule.Enabled {
+		return false, nil
+	}
+
+	switch kind {
+	case OverrideKind, UnderrideKind:
+		for _, cond := range rule.Conditions {
+			ok, err := conditionMatches(cond, event, ec)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+		return true, nil
+
+	case ContentKind:
+		// Content rules match the body of (unencrypted) messages.
+		return patternMatches("content.body", rule.Pattern, event)
+
+	case RoomKind:
+		return rule.RuleID == event.RoomID(), nil
+
+	case SenderKind:
+		return rule.RuleID == event.Sender(), nil
+
+	default:
+		return false, nil
+	}
+}
+
+func conditionMatches(cond *Condition, event *gomatrixserverlib.Event, ec EvaluationContext) (bool, error) {
+	switch cond.Kind {
+	case EventMatchCondition:
+		return patternMatches(cond.Key, cond.Pattern, event)
+
+	case ContainsDisplayNameCondition:
+		displayName, err := ec.UserDisplayName()
+		if err != nil {
+			return false, fmt.Errorf("UserDisplayName failed: %w", err)
+		}
+		return containsDisplayName(event, displayName)
+
+	case RoomMemberCountCondition:
+		cmp, err := parseRoomMemberCountCondition(cond.Is)
+		if err != nil {
+			return false, fmt.Errorf("parsing room_member_count condition: %w", err)
+		}
+		n, err := ec.RoomMemberCount()
+		if err != nil {
+			return false, fmt.Errorf("RoomMemberCount failed: %w", err)
+		}
+		return cmp(n), nil
+
+	case SenderNotificationPermissionCondition:
+		ok, err := ec.HasPowerLevel(event.Sender(), cond.Key)
+		if err != nil {
+			return false, fmt.Errorf("HasPowerLevel failed: %w", err)
+		}
+		return ok, nil
+
+	default:
+		// SPEC: Unrecognised conditions MUST NOT match any events,
+		// effectively making the push rule disabled.
+		return false, nil
+	}
+}
+
+// containsDisplayName returns whether the display name appears as whole
+// words in the body of the event, ignoring case.
+func containsDisplayName(event *gomatrixserverlib.Event, displayName string) (bool, error) {
+	if displayName == "" {
+		return false, nil
+	}
+	body, ok, err := lookupString(event, "content.body")
+	if err != nil || !ok {
+		return false, err
+	}
+	re, err := wordsToRegexp(displayName)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(body), nil
+}
+
+func parseRoomMemberCountCondition(s string) (func(int) bool, error) {
+	var b int
+	var cmp = func(a int) bool { return a == b }
+	switch {
+	case strings.HasPrefix(s, "<="):
+		cmp = func(a int) bool { return a <= b }
+		s = s[2:]
+	case strings.HasPrefix(s, ">="):
+		cmp = func(a int) bool { return a >= b }
+		s = s[2:]
+	case strings.HasPrefix(s, "<"):
+		cmp = func(a int) bool { return a < b }
+		s = s[1:]
+	case strings.HasPrefix(s, ">"):
+		cmp = func(a int) bool { return a > b }
+		s = s[1:]
+	case strings.HasPrefix(s, "=="):
+		// Same cmp as the default.
+		s = s[2:]
+	}
+
+	v, err := strconv.ParseInt(s, 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	b = int(v)
+	return cmp, nil
+}
+
+func patternMatches(key, pattern string, event *gomatrixserverlib.Event) (bool, error) {
+	// The body of a message is matched by words, everything else by the
+	// whole value.
+	re, err := globToRegexp(pattern, key == "content.body")
+	if err != nil {
+		// A pattern which isn't valid, say with a set like [z-a], can't
+		// match anything, like a rule with an unrecognised condition.
+		return false, nil
+	}
+	value, ok, err := lookupString(event, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return re.MatchString(value), nil
+}
+
+// lookupString returns the string value at the dot-separated key path
+// in the event JSON, e.g. "content.body". Values which aren't strings
+// don't match any pattern.
+func lookupString(event *gomatrixserverlib.Event, key string) (string, bool, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(event.JSON(), &m); err != nil {
+		return "", false, err
+	}
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		v, ok := m[part]
+		if !ok {
+			return "", false, nil
+		}
+		if i == len(parts)-1 {
+			s, ok := v.(string)
+			return s, ok, nil
+		}
+		if m, ok = v.(map[string]interface{}); !ok {
+			return "", false, nil
+		}
+	}
+	return "", false, nil
+}
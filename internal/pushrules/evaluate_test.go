@@ -0,0 +1,245 @@
+package pushrules
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustEventFromJSON(t *testing.T, json string) *gomatrixserverlib.Event {
+	t.Helper()
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(json), false, gomatrixserverlib.RoomVersionV7)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev
+}
+
+type fakeEvaluationContext struct{}
+
+func (fakeEvaluationContext) UserDisplayName() (string, error) { return "Dear User", nil }
+func (fakeEvaluationContext) RoomMemberCount() (int, error)    { return 2, nil }
+func (fakeEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	return userID == "@bob:example.com" && levelKey == "room", nil
+}
+
+func TestRuleSetEvaluatorMatchEvent(t *testing.T) {
+	ev := mustEventFromJSON(t, `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.message","content":{"body":"Hello Dear User"}}`)
+
+	defaultEnabled := &Rule{
+		RuleID:  ".default.enabled",
+		Default: true,
+		Enabled: true,
+	}
+	userEnabled := &Rule{
+		RuleID:  "user.enabled",
+		Default: false,
+		Enabled: true,
+	}
+	userEnabled2 := &Rule{
+		RuleID:  "user.enabled.2",
+		Default: false,
+		Enabled: true,
+	}
+
+	tsts := []struct {
+		Name    string
+		RuleSet RuleSet
+		Want    *Rule
+	}{
+		{"empty", RuleSet{}, nil},
+		{"defaultCanWin", RuleSet{Override: []*Rule{defaultEnabled}}, defaultEnabled},
+		{"userWins", RuleSet{Override: []*Rule{userEnabled, defaultEnabled}}, userEnabled},
+		{"firstUserWins", RuleSet{Override: []*Rule{userEnabled, userEnabled2}}, userEnabled},
+		{"overrideOverContent", RuleSet{Override: []*Rule{userEnabled2}, Content: []*Rule{{RuleID: "hello", Enabled: true, Pattern: "Hello*"}}}, userEnabled2},
+		{"content", RuleSet{Content: []*Rule{{RuleID: "hello", Enabled: true, Pattern: "hello*"}}}, &Rule{RuleID: "hello", Enabled: true, Pattern: "hello*"}},
+		{"room", RuleSet{Room: []*Rule{{RuleID: "!room:example.com", Enabled: true}}}, &Rule{RuleID: "!room:example.com", Enabled: true}},
+		{"sender", RuleSet{Sender: []*Rule{{RuleID: "@bob:example.com", Enabled: true}}}, &Rule{RuleID: "@bob:example.com", Enabled: true}},
+		{"disabledIgnored", RuleSet{Override: []*Rule{{RuleID: "disabled"}}, Underride: []*Rule{userEnabled}}, userEnabled},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			rse := NewRuleSetEvaluator(fakeEvaluationContext{}, &tst.RuleSet)
+			got, err := rse.MatchEvent(ev)
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %v", err)
+			}
+			if (got == nil) != (tst.Want == nil) || (got != nil && got.RuleID != tst.Want.RuleID) {
+				t.Errorf("MatchEvent: got %+v, want %+v", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestConditionMatches(t *testing.T) {
+	ev := mustEventFromJSON(t, `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.message","content":{"body":"Hello Dear User","count":1}}`)
+
+	tsts := []struct {
+		Name string
+		Cond Condition
+		Want bool
+	}{
+		{"empty", Condition{}, false},
+		{"unknownKind", Condition{Kind: "unknown"}, false},
+		{"eventMatch", Condition{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.message"}, true},
+		{"eventMatchCaseInsensitive", Condition{Kind: EventMatchCondition, Key: "type", Pattern: "M.ROOM.MESSAGE"}, true},
+		{"eventMatchGlob", Condition{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.*"}, true},
+		{"eventMatchQuestionMark", Condition{Kind: EventMatchCondition, Key: "sender", Pattern: "@b?b:example.com"}, true},
+		{"eventMatchNoMatch", Condition{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.member"}, false},
+		{"eventMatchNested", Condition{Kind: EventMatchCondition, Key: "content.body", Pattern: "hello*"}, true},
+		{"eventMatchBodyWord", Condition{Kind: EventMatchCondition, Key: "content.body", Pattern: "dear"}, true},
+		{"eventMatchBodyPartialWord", Condition{Kind: EventMatchCondition, Key: "content.body", Pattern: "ear"}, false},
+		{"eventMatchInvalidPattern", Condition{Kind: EventMatchCondition, Key: "type", Pattern: "[z-a]"}, false},
+		{"eventMatchMissingKey", Condition{Kind: EventMatchCondition, Key: "content.missing", Pattern: "*"}, false},
+		{"eventMatchNotString", Condition{Kind: EventMatchCondition, Key: "content.count", Pattern: "*"}, false},
+		{"containsDisplayName", Condition{Kind: ContainsDisplayNameCondition}, true},
+		{"roomMemberCount", Condition{Kind: RoomMemberCountCondition, Is: "2"}, true},
+		{"roomMemberCountEquals", Condition{Kind: RoomMemberCountCondition, Is: "==2"}, true},
+		{"roomMemberCountLessThan", Condition{Kind: RoomMemberCountCondition, Is: "<2"}, false},
+		{"roomMemberCountLessThanEqual", Condition{Kind: RoomMemberCountCondition, Is: "<=2"}, true},
+		{"roomMemberCountGreaterThan", Condition{Kind: RoomMemberCountCondition, Is: ">1"}, true},
+		{"roomMemberCountGreaterThanEqual", Condition{Kind: RoomMemberCountCondition, Is: ">=3"}, false},
+		{"senderNotificationPermission", Condition{Kind: SenderNotificationPermissionCondition, Key: "room"}, true},
+		{"senderNotificationPermissionTooLow", Condition{Kind: SenderNotificationPermissionCondition, Key: "other"}, false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			got, err := conditionMatches(&tst.Cond, ev, fakeEvaluationContext{})
+			if err != nil {
+				t.Fatalf("conditionMatches failed: %v", err)
+			}
+			if got != tst.Want {
+				t.Errorf("conditionMatches: got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestActionsToTweaks(t *testing.T) {
+	kind, tweaks, err := ActionsToTweaks([]*Action{
+		{Kind: NotifyAction},
+		{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+		{Kind: SetTweakAction, Tweak: HighlightTweak},
+	})
+	if err != nil {
+		t.Fatalf("ActionsToTweaks failed: %v", err)
+	}
+	if kind != NotifyAction {
+		t.Errorf("got kind %q, want %q", kind, NotifyAction)
+	}
+	if len(tweaks) != 2 || tweaks["sound"] != "default" {
+		t.Errorf("got tweaks %+v, want sound and highlight", tweaks)
+	}
+
+	if _, _, err = ActionsToTweaks([]*Action{{Kind: NotifyAction}, {Kind: DontNotifyAction}}); err == nil {
+		t.Errorf("ActionsToTweaks succeeded with two primary actions")
+	}
+}
+
+// fakeGroupEvaluationContext is a fakeEvaluationContext for a room with
+// more than two members.
+type fakeGroupEvaluationContext struct{ fakeEvaluationContext }
+
+func (fakeGroupEvaluationContext) RoomMemberCount() (int, error) { return 3, nil }
+
+func TestDefaultRulesNotifyForMessagesAndInvites(t *testing.T) {
+	rse := NewRuleSetEvaluator(fakeGroupEvaluationContext{}, DefaultGlobalRuleSet("alice", "example.com"))
+
+	tsts := []struct {
+		Name string
+		JSON string
+		Want string
+	}{
+		{"message", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.message","content":{"body":"hi"}}`, MRuleMessage},
+		{"encrypted", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.encrypted","content":{}}`, MRuleEncrypted},
+		{"inviteForMe", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.member","state_key":"@alice:example.com","content":{"membership":"invite"}}`, MRuleInviteForMe},
+		{"containsDisplayName", `{"room_id":"!room:example.com","sender":"@carol:example.com","type":"m.room.message","content":{"body":"hi dear user"}}`, MRuleContainsDisplayName},
+		{"roomNotif", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.message","content":{"body":"@room hi"}}`, MRuleRoomNotif},
+		{"roomNotifWithoutPermission", `{"room_id":"!room:example.com","sender":"@carol:example.com","type":"m.room.message","content":{"body":"@room hi"}}`, MRuleMessage},
+		{"inviteForSomeoneElse", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.member","state_key":"@carol:example.com","content":{"membership":"invite"}}`, MRuleMemberEvent},
+		{"notice", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.message","content":{"msgtype":"m.notice","body":"hi dear user"}}`, MRuleSuppressNotices},
+		{"tombstone", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.tombstone","state_key":"","content":{"replacement_room":"!new:example.com"}}`, MRuleTombstone},
+		{"containsUserName", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.message","content":{"body":"hi Alice!"}}`, MRuleContainsUserName},
+		{"userNameInWord", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.message","content":{"body":"hi malice"}}`, MRuleMessage},
+		{"call", `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.call.invite","content":{"call_id":"1"}}`, MRuleCall},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			rule, err := rse.MatchEvent(mustEventFromJSON(t, tst.JSON))
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %v", err)
+			}
+			var got string
+			if rule != nil {
+				got = rule.RuleID
+			}
+			if got != tst.Want {
+				t.Errorf("got rule %q, want %q", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestContainsDisplayName(t *testing.T) {
+	tsts := []struct {
+		Name        string
+		Body        string
+		DisplayName string
+		Want        bool
+	}{
+		{"match", "Hello Dear User", "Dear User", true},
+		{"caseInsensitive", "hello dear user!", "Dear User", true},
+		{"partialWord", "Hello Dear Users", "Dear User", false},
+		{"punctuation", "Hi, Alice.", "Alice", true},
+		{"notGlob", "Hello Alice", "A*", false},
+		{"specialCharacters", "ping [bot] now", "[bot]", true},
+		{"emptyDisplayName", "Hello", "", false},
+		{"noMatch", "Hello Bob", "Alice", false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			content, err := json.Marshal(map[string]string{"body": tst.Body})
+			if err != nil {
+				t.Fatalf("json.Marshal failed: %v", err)
+			}
+			ev := mustEventFromJSON(t, `{"room_id":"!room:example.com","sender":"@bob:example.com","type":"m.room.message","content":`+string(content)+`}`)
+			got, err := containsDisplayName(ev, tst.DisplayName)
+			if err != nil {
+				t.Fatalf("containsDisplayName failed: %v", err)
+			}
+			if got != tst.Want {
+				t.Errorf("containsDisplayName(%q, %q): got %v, want %v", tst.Body, tst.DisplayName, got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestDefaultRulesNotifyForOneToOneRooms(t *testing.T) {
+	rse := NewRuleSetEvaluator(fakeEvaluationContext{}, DefaultGlobalRuleSet("alice", "example.com"))
+
+	tsts := []struct {
+		Name string
+		JSON string
+		Want string
+	}{
+		{"message", `{"room_id":"!room:example.com","sender":"@carol:example.com","type":"m.room.message","content":{"body":"hi"}}`, MRuleRoomOneToOne},
+		{"encrypted", `{"room_id":"!room:example.com","sender":"@carol:example.com","type":"m.room.encrypted","content":{}}`, MRuleEncryptedRoomOneToOne},
+		{"notMessage", `{"room_id":"!room:example.com","sender":"@carol:example.com","type":"m.room.topic","state_key":"","content":{"topic":"hi"}}`, ""},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			rule, err := rse.MatchEvent(mustEventFromJSON(t, tst.JSON))
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %v", err)
+			}
+			var got string
+			if rule != nil {
+				got = rule.RuleID
+			}
+			if got != tst.Want {
+				t.Errorf("got rule %q, want %q", got, tst.Want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"regexp"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// globCacheSize is the number of compiled patterns kept in globCache. The
+// patterns come from push rules, which are mostly the same between users,
+// so this is enough to avoid compiling patterns for every event.
+const globCacheSize = 4096
+
+var globCache = mustNewLRU(globCacheSize)
+
+func mustNewLRU(size int) *lru.Cache {
+	cache, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return cache
+}
+
+type globCacheKey struct {
+	pattern      string
+	wordBoundary bool
+	literal      bool
+}
+
+// globToRegexp returns the compiled regular expression for the glob
+// pattern of an event_match condition or a content rule, from the cache if
+// it has been compiled before.
+//
+// The pattern matches case-insensitively, with * matching any number of
+// characters, ? matching exactly one character, and [abc], [a-z] and [!a-z]
+// matching a character from, or not from, a set. Without wordBoundary the
+// whole value has to match. With it, the pattern only has to match a run of
+// whole words in the value, which is how the body of a message is matched.
+func globToRegexp(pattern string, wordBoundary bool) (*regexp.Regexp, error) {
+	return cachedRegexp(globCacheKey{pattern: pattern, wordBoundary: wordBoundary})
+}
+
+// wordsToRegexp returns the compiled regular expression which matches the
+// words, taken literally, as whole words in a value, case-insensitively.
+func wordsToRegexp(words string) (*regexp.Regexp, error) {
+	return cachedRegexp(globCacheKey{pattern: words, wordBoundary: true, literal: true})
+}
+
+func cachedRegexp(key globCacheKey) (*regexp.Regexp, error) {
+	if re, ok := globCache.Get(key); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	var expr string
+	if key.literal {
+		expr = regexp.QuoteMeta(key.pattern)
+	} else {
+		expr = globToRegexpString(key.pattern)
+	}
+	if key.wordBoundary {
+		expr = `(?i)(^|[^\pL\pN_])` + expr + `([^\pL\pN_]|$)`
+	} else {
+		expr = "(?i)^" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	globCache.Add(key, re)
+	return re, nil
+}
+
+// globToRegexpString translates a glob pattern into a regular expression,
+// without anchors or flags.
+func globToRegexpString(pattern string) string {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			// A set runs until the next ], but its first character can't
+			// close it, so that []] is a set containing ]. A [ without a
+			// matching ] is taken literally.
+			start := i + 1
+			negate := start < len(pattern) && pattern[start] == '!'
+			if negate {
+				start++
+			}
+			end := -1
+			if start < len(pattern) {
+				if j := strings.IndexByte(pattern[start+1:], ']'); j >= 0 {
+					end = start + 1 + j
+				}
+			}
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			sb.WriteByte('[')
+			if negate {
+				sb.WriteByte('^')
+			}
+			sb.WriteString(quoteSet(pattern[start:end]))
+			sb.WriteByte(']')
+			i = end
+		default:
+			// Multi-byte characters are quoted one byte at a time, which
+			// leaves them unchanged as QuoteMeta only escapes ASCII.
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	return sb.String()
+}
+
+// quoteSet escapes the characters of a glob set which are special inside a
+// regular expression character class, apart from - for ranges.
+func quoteSet(set string) string {
+	var sb strings.Builder
+	for i := 0; i < len(set); i++ {
+		switch c := set[i]; c {
+		case '\\', '[', ']', '^':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
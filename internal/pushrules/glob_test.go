@@ -0,0 +1,80 @@
+package pushrules
+
+import (
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tsts := []struct {
+		Name         string
+		Pattern      string
+		WordBoundary bool
+		Value        string
+		Want         bool
+	}{
+		{"literal", "m.room.message", false, "m.room.message", true},
+		{"literalIsWhole", "m.room", false, "m.room.message", false},
+		{"dotIsLiteral", "m.room.message", false, "mxroomxmessage", false},
+		{"caseInsensitive", "M.Room.*", false, "m.room.message", true},
+		{"star", "m.*", false, "m.room.message", true},
+		{"starMatchesEmpty", "m.room.message*", false, "m.room.message", true},
+		{"questionMark", "@b?b:example.com", false, "@bob:example.com", true},
+		{"questionMarkIsOne", "@b?b:example.com", false, "@boob:example.com", false},
+		{"set", "[bc]at", false, "cat", true},
+		{"setNoMatch", "[bc]at", false, "hat", false},
+		{"range", "[a-c]at", false, "bat", true},
+		{"negatedSet", "[!bc]at", false, "hat", true},
+		{"negatedSetNoMatch", "[!bc]at", false, "bat", false},
+		{"setWithBracket", "[]]", false, "]", true},
+		{"setWithCaret", "[^a]", false, "^", true},
+		{"unclosedSet", "[abc", false, "[abc", true},
+		{"regexpIsLiteral", "a+(b)|c", false, "a+(b)|c", true},
+		{"regexpIsLiteralNoMatch", "a+(b)|c", false, "c", false},
+		{"unicode", "café*", false, "café au lait", true},
+		{"wordMatch", "cake", true, "I like cake!", true},
+		{"wordMatchAtStart", "cake", true, "cake is nice", true},
+		{"wordMatchCaseInsensitive", "cake", true, "CAKE", true},
+		{"wordMatchPartialWord", "cake", true, "cupcakes", false},
+		{"wordMatchUnicodeLetters", "cake", true, "écake", false},
+		{"wordMatchGlob", "cake*", true, "I like cakes", true},
+		{"wordMatchPhrase", "dear user", true, "Hello Dear User, hi", true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			re, err := globToRegexp(tst.Pattern, tst.WordBoundary)
+			if err != nil {
+				t.Fatalf("globToRegexp failed: %v", err)
+			}
+			if got := re.MatchString(tst.Value); got != tst.Want {
+				t.Errorf("%q (%s) matching %q: got %v, want %v", tst.Pattern, re, tst.Value, got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestGlobToRegexpCache(t *testing.T) {
+	re1, err := globToRegexp("cached*", false)
+	if err != nil {
+		t.Fatalf("globToRegexp failed: %v", err)
+	}
+	re2, err := globToRegexp("cached*", false)
+	if err != nil {
+		t.Fatalf("globToRegexp failed: %v", err)
+	}
+	if re1 != re2 {
+		t.Errorf("globToRegexp: got a new regexp for a cached pattern")
+	}
+	re3, err := globToRegexp("cached*", true)
+	if err != nil {
+		t.Fatalf("globToRegexp failed: %v", err)
+	}
+	if re3 == re1 {
+		t.Errorf("globToRegexp: got the same regexp with and without word boundaries")
+	}
+}
+
+func TestGlobToRegexpInvalidSet(t *testing.T) {
+	if _, err := globToRegexp("[z-a]", false); err == nil {
+		t.Errorf("globToRegexp: got no error for an invalid range")
+	}
+}
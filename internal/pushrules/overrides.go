@@ -0,0 +1,166 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// DefaultRuleOverrides are the changes to the server-default push rules
+// from the config. A nil *DefaultRuleOverrides makes no changes.
+type DefaultRuleOverrides struct {
+	overrides []*defaultRuleOverride
+}
+
+type defaultRuleOverride struct {
+	kind       Kind
+	ruleID     string
+	enabled    *bool
+	actions    []*Action    // nil keeps the actions of the default rule
+	conditions []*Condition // nil keeps the conditions of the default rule
+	pattern    string       // "" keeps the pattern of the default rule
+}
+
+// NewDefaultRuleOverrides parses the default push rules from the config. It
+// fails if the rules that they result in aren't valid.
+func NewDefaultRuleOverrides(cfg []config.DefaultPushRule) (*DefaultRuleOverrides, error) {
+	o := &DefaultRuleOverrides{}
+	for i := range cfg {
+		override, err := newDefaultRuleOverride(&cfg[i])
+		if err != nil {
+			return nil, fmt.Errorf("default push rule %q: %w", cfg[i].RuleID, err)
+		}
+		o.overrides = append(o.overrides, override)
+	}
+	// Check the rules which the overrides result in, with a placeholder
+	// user for the rules which depend on who they are for.
+	ruleSet := DefaultGlobalRuleSet("user", "localhost")
+	o.Apply(ruleSet)
+	for _, override := range o.overrides {
+		rules := *ruleSet.Rules(override.kind)
+		rule := rules[ruleIndexByID(rules, override.ruleID)]
+		if errs := ValidateRule(override.kind, rule); len(errs) > 0 {
+			return nil, fmt.Errorf("default push rule %q: %v", rule.RuleID, errs[0])
+		}
+	}
+	return o, nil
+}
+
+func newDefaultRuleOverride(cfg *config.DefaultPushRule) (*defaultRuleOverride, error) {
+	o := &defaultRuleOverride{
+		kind:    Kind(cfg.Kind),
+		ruleID:  cfg.RuleID,
+		enabled: cfg.Enabled,
+		pattern: cfg.Pattern,
+	}
+	switch o.kind {
+	case OverrideKind, ContentKind, UnderrideKind:
+	default:
+		// Room and sender rules have room and user IDs as their rule IDs,
+		// so they can't be server-default rules.
+		return nil, fmt.Errorf("invalid kind %q", cfg.Kind)
+	}
+	if cfg.Actions != nil {
+		if err := fromConfigValue(cfg.Actions, &o.actions); err != nil {
+			return nil, fmt.Errorf("invalid actions: %w", err)
+		}
+	}
+	if cfg.Conditions != nil {
+		if err := fromConfigValue(cfg.Conditions, &o.conditions); err != nil {
+			return nil, fmt.Errorf("invalid conditions: %w", err)
+		}
+	}
+	return o, nil
+}
+
+// Apply changes the default rules of the rule set, and adds the new default
+// rules after those of the same kind. Added rules are enabled unless the
+// config says otherwise.
+func (o *DefaultRuleOverrides) Apply(ruleSet *RuleSet) {
+	if o == nil {
+		return
+	}
+	for _, override := range o.overrides {
+		rules := ruleSet.Rules(override.kind)
+		if rules == nil {
+			continue
+		}
+		var rule *Rule
+		if i := ruleIndexByID(*rules, override.ruleID); i >= 0 {
+			rule = (*rules)[i]
+		} else {
+			rule = &Rule{
+				RuleID:  override.ruleID,
+				Default: true,
+				Enabled: true,
+			}
+			*rules = append(*rules, rule)
+		}
+		if override.enabled != nil {
+			rule.Enabled = *override.enabled
+		}
+		if override.actions != nil {
+			rule.Actions = copyActions(override.actions)
+		}
+		if override.conditions != nil {
+			rule.Conditions = copyConditions(override.conditions)
+		}
+		if override.pattern != "" {
+			rule.Pattern = override.pattern
+		}
+	}
+}
+
+func ruleIndexByID(rules []*Rule, ruleID string) int {
+	for i, rule := range rules {
+		if rule.RuleID == ruleID {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyActions copies the actions, so that the rules of each account can be
+// changed without changing those of other accounts.
+func copyActions(actions []*Action) []*Action {
+	res := make([]*Action, 0, len(actions))
+	for _, action := range actions {
+		a := *action
+		res = append(res, &a)
+	}
+	return res
+}
+
+func copyConditions(conditions []*Condition) []*Condition {
+	res := make([]*Condition, 0, len(conditions))
+	for _, cond := range conditions {
+		c := *cond
+		res = append(res, &c)
+	}
+	return res
+}
+
+// fromConfigValue decodes a value from the YAML config as if it was the
+// JSON of the push rules API.
+func fromConfigValue(v interface{}, dst interface{}) error {
+	data, err := json.Marshal(config.JSONCompatible(v))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
@@ -0,0 +1,76 @@
+package pushrules
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestDefaultRuleOverrides(t *testing.T) {
+	disabled := false
+	overrides, err := NewDefaultRuleOverrides([]config.DefaultPushRule{
+		{Kind: "underride", RuleID: MRuleEncrypted, Enabled: &disabled},
+		{Kind: "override", RuleID: MRuleRoomNotif, Actions: []interface{}{"dont_notify"}},
+		{
+			Kind:   "underride",
+			RuleID: ".com.example.rule.reaction",
+			Conditions: []interface{}{
+				map[interface{}]interface{}{"kind": "event_match", "key": "type", "pattern": "m.reaction"},
+			},
+			Actions: []interface{}{
+				"notify",
+				map[interface{}]interface{}{"set_tweak": "sound", "value": "default"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewDefaultRuleOverrides failed: %s", err)
+	}
+
+	ruleSets := DefaultAccountRuleSets("alice", "example.com", overrides)
+	underride := ruleSets.Global.Underride
+	if i := ruleIndexByID(underride, MRuleEncrypted); i < 0 || underride[i].Enabled {
+		t.Errorf("got %s %+v, want it to be disabled", MRuleEncrypted, underride)
+	}
+	if i := ruleIndexByID(ruleSets.Global.Override, MRuleRoomNotif); i < 0 {
+		t.Errorf("got no %s rule", MRuleRoomNotif)
+	} else if rule := ruleSets.Global.Override[i]; len(rule.Actions) != 1 || rule.Actions[0].Kind != DontNotifyAction || len(rule.Conditions) != 2 {
+		t.Errorf("got %s %+v, want its actions to be replaced", MRuleRoomNotif, rule)
+	}
+	added := underride[len(underride)-1]
+	if added.RuleID != ".com.example.rule.reaction" || !added.Default || !added.Enabled {
+		t.Fatalf("got last underride rule %+v, want the added rule", added)
+	}
+	if len(added.Actions) != 2 || added.Actions[1].Tweak != SoundTweak || added.Actions[1].Value != "default" {
+		t.Errorf("got actions %+v, want notify with a sound", added.Actions)
+	}
+	if len(added.Conditions) != 1 || added.Conditions[0].Pattern != "m.reaction" {
+		t.Errorf("got conditions %+v, want the m.reaction condition", added.Conditions)
+	}
+
+	// Each account gets its own copy of the changed rules.
+	added.Actions[0].Kind = DontNotifyAction
+	other := DefaultAccountRuleSets("bob", "example.com", overrides).Global.Underride
+	if other[len(other)-1].Actions[0].Kind != NotifyAction {
+		t.Errorf("changing the rules of one account changed those of another")
+	}
+}
+
+func TestDefaultRuleOverridesInvalid(t *testing.T) {
+	tsts := []struct {
+		Name string
+		Rule config.DefaultPushRule
+	}{
+		{"newRuleWithoutActions", config.DefaultPushRule{Kind: "override", RuleID: ".com.example.rule"}},
+		{"newContentRuleWithoutPattern", config.DefaultPushRule{Kind: "content", RuleID: ".com.example.rule", Actions: []interface{}{"notify"}}},
+		{"unknownAction", config.DefaultPushRule{Kind: "override", RuleID: MRuleMaster, Actions: []interface{}{"explode"}}},
+		{"invalidCondition", config.DefaultPushRule{Kind: "underride", RuleID: MRuleMessage, Conditions: []interface{}{"type"}}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if _, err := NewDefaultRuleOverrides([]config.DefaultPushRule{tst.Rule}); err == nil {
+				t.Errorf("NewDefaultRuleOverrides: got no error, want an error")
+			}
+		})
+	}
+}
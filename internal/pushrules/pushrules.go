@@ -0,0 +1,171 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushrules contains the types for push rules, as described in
+// https://spec.matrix.org/v1.2/client-server-api/#push-rules
+package pushrules
+
+import "strings"
+
+// An AccountRuleSets carries the rule sets associated with an
+// account. It is stored in the m.push_rules global account data.
+type AccountRuleSets struct {
+	Global RuleSet `json:"global"` // Required
+
+	// Device holds the rule sets of the device/<profile_tag> scopes,
+	// keyed by profile tag. They only apply to the pushers which were
+	// registered with that profile tag.
+	Device map[string]*RuleSet `json:"device,omitempty"`
+}
+
+// RuleSet returns the rule set of the given scope, or nil if the scope
+// is unknown. An empty device rule set is added if the profile tag
+// doesn't have one yet, so that rules can be added to it.
+func (s *AccountRuleSets) RuleSet(scope Scope) *RuleSet {
+	if scope == GlobalScope {
+		return &s.Global
+	}
+	profileTag := strings.TrimPrefix(string(scope), DeviceScopePrefix)
+	if profileTag == string(scope) || profileTag == "" {
+		return nil
+	}
+	ruleSet, ok := s.Device[profileTag]
+	if !ok {
+		if s.Device == nil {
+			s.Device = map[string]*RuleSet{}
+		}
+		ruleSet = &RuleSet{}
+		s.Device[profileTag] = ruleSet
+	}
+	for _, kind := range Kinds {
+		// Always have a list for each kind, even if it's empty.
+		if rules := ruleSet.Rules(kind); *rules == nil {
+			*rules = []*Rule{}
+		}
+	}
+	return ruleSet
+}
+
+// ProfileRuleSet returns the rules which apply to pushers with the given
+// profile tag. The device rules of each kind take precedence over the
+// global rules of the same kind. It returns nil if the profile tag has
+// no device rules, in which case only the global rules apply.
+func (s *AccountRuleSets) ProfileRuleSet(profileTag string) *RuleSet {
+	device, ok := s.Device[profileTag]
+	if !ok || profileTag == "" {
+		return nil
+	}
+	var ruleSet RuleSet
+	for _, kind := range Kinds {
+		rules := ruleSet.Rules(kind)
+		*rules = append(*rules, *device.Rules(kind)...)
+		*rules = append(*rules, *s.Global.Rules(kind)...)
+	}
+	return &ruleSet
+}
+
+// A RuleSet contains all the various push rules for an
+// account. Listed in decreasing order of priority.
+type RuleSet struct {
+	Override  []*Rule `json:"override"`
+	Content   []*Rule `json:"content"`
+	Room      []*Rule `json:"room"`
+	Sender    []*Rule `json:"sender"`
+	Underride []*Rule `json:"underride"`
+}
+
+// Rules returns a pointer to the rules of the given kind, so that they
+// can be modified, or nil if the kind is unknown.
+func (s *RuleSet) Rules(kind Kind) *[]*Rule {
+	switch kind {
+	case OverrideKind:
+		return &s.Override
+	case ContentKind:
+		return &s.Content
+	case RoomKind:
+		return &s.Room
+	case SenderKind:
+		return &s.Sender
+	case UnderrideKind:
+		return &s.Underride
+	default:
+		return nil
+	}
+}
+
+// A Rule contains matchers, conditions and final actions. While
+// evaluating, at most one rule is considered matching.
+//
+// Kind and scope are part of the push rules request/responses, but
+// not of the core data model.
+type Rule struct {
+	// RuleID is either a free identifier, or the sender's MXID for
+	// SenderKind. Required.
+	RuleID string `json:"rule_id"`
+
+	// Default indicates whether this is a server-defined default, or
+	// a user-provided rule. Required.
+	//
+	// The server-default rules have the lowest priority.
+	Default bool `json:"default"`
+
+	// Enabled allows the user to disable rules while keeping them
+	// around. Required.
+	Enabled bool `json:"enabled"`
+
+	// Actions describe the desired outcome, should the rule
+	// match. Required.
+	Actions []*Action `json:"actions"`
+
+	// Conditions provide the rule's conditions for OverrideKind and
+	// UnderrideKind. Not allowed for other kinds.
+	Conditions []*Condition `json:"conditions,omitempty"`
+
+	// Pattern is the body pattern to match for ContentKind. Required
+	// for that kind. The interpretation is the same as that of
+	// Condition.Pattern.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Scope is either the global scope, or a device scope made of
+// DeviceScopePrefix followed by a profile tag. See also AccountRuleSets.
+type Scope string
+
+const (
+	UnknownScope Scope = ""
+	GlobalScope  Scope = "global"
+)
+
+// DeviceScopePrefix is the prefix of the device scopes.
+const DeviceScopePrefix = "device/"
+
+// DeviceScope returns the scope of the device rules for a profile tag.
+func DeviceScope(profileTag string) Scope {
+	return Scope(DeviceScopePrefix + profileTag)
+}
+
+// Kind is the type of push rule. See also RuleSet.
+type Kind string
+
+const (
+	UnknownKind   Kind = ""
+	OverrideKind  Kind = "override"
+	ContentKind   Kind = "content"
+	RoomKind      Kind = "room"
+	SenderKind    Kind = "sender"
+	UnderrideKind Kind = "underride"
+)
+
+// Kinds are the kinds of push rules, in decreasing order of priority.
+var Kinds = []Kind{OverrideKind, ContentKind, RoomKind, SenderKind, UnderrideKind}
@@ -0,0 +1,135 @@
+package pushrules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAccountRuleSetsRuleSet(t *testing.T) {
+	ruleSets := AccountRuleSets{}
+
+	tsts := []struct {
+		Name  string
+		Scope Scope
+		Want  bool
+	}{
+		{"global", GlobalScope, true},
+		{"device", DeviceScope("phone"), true},
+		{"deviceWithoutProfileTag", DeviceScope(""), false},
+		{"unknown", Scope("elsewhere"), false},
+		{"empty", UnknownScope, false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			got := ruleSets.RuleSet(tst.Scope)
+			if (got != nil) != tst.Want {
+				t.Errorf("RuleSet(%q): got %+v, want found=%v", tst.Scope, got, tst.Want)
+			}
+		})
+	}
+
+	if _, ok := ruleSets.Device["phone"]; !ok {
+		t.Fatalf("RuleSet didn't add the device rule set: got %+v", ruleSets.Device)
+	}
+	if got := ruleSets.RuleSet(DeviceScope("phone")); got != ruleSets.Device["phone"] {
+		t.Errorf("RuleSet: got %p, want the existing device rule set %p", got, ruleSets.Device["phone"])
+	}
+	for _, kind := range Kinds {
+		if rules := ruleSets.Device["phone"].Rules(kind); *rules == nil {
+			t.Errorf("RuleSet: got nil %s rules, want an empty list", kind)
+		}
+	}
+}
+
+func TestAccountRuleSetsProfileRuleSet(t *testing.T) {
+	global := &Rule{RuleID: "global", Enabled: true}
+	device := &Rule{RuleID: "device", Enabled: true}
+	ruleSets := AccountRuleSets{
+		Global: RuleSet{Override: []*Rule{global}, Underride: []*Rule{global}},
+		Device: map[string]*RuleSet{
+			"phone": {Override: []*Rule{device}, Room: []*Rule{device}},
+		},
+	}
+
+	if got := ruleSets.ProfileRuleSet("desktop"); got != nil {
+		t.Errorf("ProfileRuleSet(desktop): got %+v, want nil", got)
+	}
+	if got := ruleSets.ProfileRuleSet(""); got != nil {
+		t.Errorf("ProfileRuleSet(\"\"): got %+v, want nil", got)
+	}
+
+	got := ruleSets.ProfileRuleSet("phone")
+	if got == nil {
+		t.Fatalf("ProfileRuleSet(phone): got nil, want a rule set")
+	}
+	tsts := []struct {
+		Kind Kind
+		Want []*Rule
+	}{
+		{OverrideKind, []*Rule{device, global}},
+		{ContentKind, nil},
+		{RoomKind, []*Rule{device}},
+		{SenderKind, nil},
+		{UnderrideKind, []*Rule{global}},
+	}
+	for _, tst := range tsts {
+		rules := *got.Rules(tst.Kind)
+		if len(rules) != len(tst.Want) {
+			t.Errorf("%s rules: got %d rules, want %d", tst.Kind, len(rules), len(tst.Want))
+			continue
+		}
+		for i := range rules {
+			if rules[i] != tst.Want[i] {
+				t.Errorf("%s rules[%d]: got %q, want %q", tst.Kind, i, rules[i].RuleID, tst.Want[i].RuleID)
+			}
+		}
+	}
+
+	// Changing the profile rules mustn't change the stored rule sets.
+	got.Override[0] = global
+	if ruleSets.Device["phone"].Override[0] != device {
+		t.Errorf("ProfileRuleSet shares its lists with the device rule set")
+	}
+}
+
+func TestAccountRuleSetsAddMissingDefaults(t *testing.T) {
+	defaults := DefaultAccountRuleSets("alice", "example.com", nil)
+	user := &Rule{RuleID: "user", Enabled: true}
+	master := mRuleMasterDefinition()
+	master.Enabled = true
+	ruleSets := AccountRuleSets{
+		Global: RuleSet{
+			Override:  []*Rule{master, user, mRuleInviteForMeDefinition("alice", "example.com"), mRuleRoomNotifDefinition()},
+			Content:   []*Rule{user},
+			Underride: []*Rule{mRuleMessageDefinition()},
+		},
+	}
+	if !ruleSets.AddMissingDefaults(defaults) {
+		t.Fatalf("AddMissingDefaults: got false, want rules to be added")
+	}
+
+	tsts := []struct {
+		Kind Kind
+		Want []string
+	}{
+		{OverrideKind, []string{MRuleMaster, "user", MRuleSuppressNotices, MRuleInviteForMe, MRuleMemberEvent, MRuleContainsDisplayName, MRuleTombstone, MRuleRoomNotif}},
+		{ContentKind, []string{"user", MRuleContainsUserName}},
+		{RoomKind, nil},
+		{UnderrideKind, []string{MRuleCall, MRuleEncryptedRoomOneToOne, MRuleRoomOneToOne, MRuleMessage, MRuleEncrypted}},
+	}
+	for _, tst := range tsts {
+		var got []string
+		for _, rule := range *ruleSets.Global.Rules(tst.Kind) {
+			got = append(got, rule.RuleID)
+		}
+		if !reflect.DeepEqual(got, tst.Want) {
+			t.Errorf("%s rules: got %v, want %v", tst.Kind, got, tst.Want)
+		}
+	}
+	if !ruleSets.Global.Override[0].Enabled {
+		t.Errorf("AddMissingDefaults changed the existing master rule")
+	}
+	if ruleSets.AddMissingDefaults(defaults) {
+		t.Errorf("AddMissingDefaults: got true, want no more rules to be added")
+	}
+}
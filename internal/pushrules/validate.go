@@ -0,0 +1,121 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// roomMemberCountRE matches the "is" field of a room_member_count
+// condition, e.g. "2" or ">=10".
+var roomMemberCountRE = regexp.MustCompile(`^(==|<|>|<=|>=)?[0-9]+$`)
+
+// ValidateRule checks the rule for errors. These follow from Sytests
+// and the specification.
+func ValidateRule(kind Kind, rule *Rule) []error {
+	var errs []error
+
+	if rule.RuleID == "" {
+		errs = append(errs, fmt.Errorf("empty rule ID"))
+	}
+
+	switch kind {
+	case OverrideKind, UnderrideKind:
+		// The empty list of conditions is allowed, and matches every event.
+		for _, cond := range rule.Conditions {
+			errs = append(errs, validateCondition(cond)...)
+		}
+
+	case ContentKind:
+		if rule.Pattern == "" {
+			errs = append(errs, fmt.Errorf("missing content rule pattern"))
+		}
+
+	case RoomKind:
+		if !strings.HasPrefix(rule.RuleID, "!") {
+			errs = append(errs, fmt.Errorf("room rule ID must be a room ID: %q", rule.RuleID))
+		}
+
+	case SenderKind:
+		if !strings.HasPrefix(rule.RuleID, "@") {
+			errs = append(errs, fmt.Errorf("sender rule ID must be a user ID: %q", rule.RuleID))
+		}
+
+	default:
+		errs = append(errs, fmt.Errorf("invalid rule kind: %s", kind))
+	}
+
+	if len(rule.Actions) == 0 {
+		errs = append(errs, fmt.Errorf("missing actions"))
+	}
+	for _, action := range rule.Actions {
+		errs = append(errs, validateAction(action)...)
+	}
+
+	return errs
+}
+
+func validateCondition(cond *Condition) []error {
+	var errs []error
+
+	switch cond.Kind {
+	case EventMatchCondition:
+		if cond.Key == "" {
+			errs = append(errs, fmt.Errorf("missing condition key"))
+		}
+		if cond.Pattern == "" {
+			errs = append(errs, fmt.Errorf("missing condition pattern"))
+		}
+
+	case ContainsDisplayNameCondition:
+		// Nothing to validate.
+
+	case RoomMemberCountCondition:
+		if !roomMemberCountRE.MatchString(cond.Is) {
+			errs = append(errs, fmt.Errorf("invalid room member count comparison: %q", cond.Is))
+		}
+
+	case SenderNotificationPermissionCondition:
+		if cond.Key == "" {
+			errs = append(errs, fmt.Errorf("missing condition key"))
+		}
+
+	default:
+		errs = append(errs, fmt.Errorf("unknown condition kind: %q", cond.Kind))
+	}
+
+	return errs
+}
+
+func validateAction(action *Action) []error {
+	var errs []error
+
+	switch action.Kind {
+	case NotifyAction, DontNotifyAction, CoalesceAction:
+		// Nothing to validate.
+
+	case SetTweakAction:
+		if action.Tweak == UnknownTweak {
+			errs = append(errs, fmt.Errorf("missing tweak for set_tweak action"))
+		}
+
+	default:
+		errs = append(errs, fmt.Errorf("invalid action kind: %q", action.Kind))
+	}
+
+	return errs
+}
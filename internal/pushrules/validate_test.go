@@ -0,0 +1,52 @@
+package pushrules
+
+import "testing"
+
+func TestValidateRuleOK(t *testing.T) {
+	tsts := []struct {
+		Name string
+		Kind Kind
+		Rule Rule
+	}{
+		{"override", OverrideKind, Rule{RuleID: "a", Actions: []*Action{{Kind: NotifyAction}}, Conditions: []*Condition{{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.message"}}}},
+		{"overrideNoConditions", OverrideKind, Rule{RuleID: "a", Actions: []*Action{{Kind: DontNotifyAction}}}},
+		{"underrideMemberCount", UnderrideKind, Rule{RuleID: "a", Actions: []*Action{{Kind: NotifyAction}}, Conditions: []*Condition{{Kind: RoomMemberCountCondition, Is: ">=2"}}}},
+		{"content", ContentKind, Rule{RuleID: "a", Pattern: "cake*", Actions: []*Action{{Kind: NotifyAction}, {Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"}}}},
+		{"room", RoomKind, Rule{RuleID: "!room:example.com", Actions: []*Action{{Kind: DontNotifyAction}}}},
+		{"sender", SenderKind, Rule{RuleID: "@alice:example.com", Actions: []*Action{{Kind: NotifyAction}}}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if errs := ValidateRule(tst.Kind, &tst.Rule); len(errs) > 0 {
+				t.Errorf("ValidateRule: got %v, want no errors", errs)
+			}
+		})
+	}
+}
+
+func TestValidateRuleErrors(t *testing.T) {
+	tsts := []struct {
+		Name string
+		Kind Kind
+		Rule Rule
+	}{
+		{"emptyRuleID", OverrideKind, Rule{Actions: []*Action{{Kind: NotifyAction}}}},
+		{"unknownKind", Kind("unknown"), Rule{RuleID: "a", Actions: []*Action{{Kind: NotifyAction}}}},
+		{"noActions", OverrideKind, Rule{RuleID: "a"}},
+		{"unknownAction", OverrideKind, Rule{RuleID: "a", Actions: []*Action{{Kind: "dance"}}}},
+		{"tweakWithoutKey", OverrideKind, Rule{RuleID: "a", Actions: []*Action{{Kind: SetTweakAction}}}},
+		{"unknownCondition", OverrideKind, Rule{RuleID: "a", Actions: []*Action{{Kind: NotifyAction}}, Conditions: []*Condition{{Kind: "unknown"}}}},
+		{"eventMatchWithoutPattern", OverrideKind, Rule{RuleID: "a", Actions: []*Action{{Kind: NotifyAction}}, Conditions: []*Condition{{Kind: EventMatchCondition, Key: "type"}}}},
+		{"badMemberCount", UnderrideKind, Rule{RuleID: "a", Actions: []*Action{{Kind: NotifyAction}}, Conditions: []*Condition{{Kind: RoomMemberCountCondition, Is: "=>2"}}}},
+		{"contentWithoutPattern", ContentKind, Rule{RuleID: "a", Actions: []*Action{{Kind: NotifyAction}}}},
+		{"roomWithoutRoomID", RoomKind, Rule{RuleID: "a", Actions: []*Action{{Kind: NotifyAction}}}},
+		{"senderWithoutUserID", SenderKind, Rule{RuleID: "a", Actions: []*Action{{Kind: NotifyAction}}}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if errs := ValidateRule(tst.Kind, &tst.Rule); len(errs) == 0 {
+				t.Errorf("ValidateRule: got no errors, want some")
+			}
+		})
+	}
+}
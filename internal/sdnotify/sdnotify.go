@@ -0,0 +1,106 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sdnotify implements the systemd service notification protocol, so
+// that Dendrite can be run as a Type=notify unit with a watchdog. All of the
+// functions are no-ops when the process wasn't started by systemd.
+package sdnotify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// StateReady tells systemd that startup has finished.
+	StateReady = "READY=1"
+	// StateStopping tells systemd that we have started shutting down.
+	StateStopping = "STOPPING=1"
+	// StateWatchdog tells systemd that we are still alive.
+	StateWatchdog = "WATCHDOG=1"
+)
+
+// Notify sends the given state to systemd. Returns false without an error if
+// the NOTIFY_SOCKET environment variable is not set.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// Sockets starting with @ are in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("net.DialUnix: %w", err)
+	}
+	defer conn.Close() // nolint: errcheck
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("conn.Write: %w", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval after which systemd will consider the
+// process to be hung if it hasn't received a watchdog notification. Returns 0
+// if the watchdog isn't enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// The watchdog is meant for another process.
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// Watchdog sends watchdog notifications to systemd at half of the configured
+// watchdog interval until the context is done. It returns immediately if the
+// watchdog isn't enabled, so should be run in a goroutine.
+func Watchdog(ctx context.Context) {
+	interval, err := WatchdogInterval()
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to read systemd watchdog interval")
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	logrus.Infof("Sending systemd watchdog notifications every %s", interval/2)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := Notify(StateWatchdog); err != nil {
+				logrus.WithError(err).Warn("Failed to send systemd watchdog notification")
+			}
+		}
+	}
+}
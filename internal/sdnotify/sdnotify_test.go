@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	setenv(t, "NOTIFY_SOCKET", "")
+	if sent, err := Notify(StateReady); sent || err != nil {
+		t.Fatalf("expected no-op without NOTIFY_SOCKET, got sent=%v err=%v", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer conn.Close() // nolint: errcheck
+
+	setenv(t, "NOTIFY_SOCKET", path)
+	if sent, err := Notify(StateReady); !sent || err != nil {
+		t.Fatalf("expected notification to be sent, got sent=%v err=%v", sent, err)
+	}
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read notification: %s", err)
+	}
+	if got := string(buf[:n]); got != StateReady {
+		t.Fatalf("got %q want %q", got, StateReady)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	setenv(t, "WATCHDOG_USEC", "")
+	if interval, err := WatchdogInterval(); interval != 0 || err != nil {
+		t.Fatalf("expected watchdog to be disabled, got %s, %v", interval, err)
+	}
+	setenv(t, "WATCHDOG_USEC", "30000000")
+	setenv(t, "WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval, err := WatchdogInterval(); interval != 30*time.Second || err != nil {
+		t.Fatalf("expected 30s interval, got %s, %v", interval, err)
+	}
+	setenv(t, "WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if interval, err := WatchdogInterval(); interval != 0 || err != nil {
+		t.Fatalf("expected watchdog for another process to be ignored, got %s, %v", interval, err)
+	}
+	setenv(t, "WATCHDOG_PID", "")
+	setenv(t, "WATCHDOG_USEC", "nonsense")
+	if _, err := WatchdogInterval(); err == nil {
+		t.Fatalf("expected error for invalid WATCHDOG_USEC")
+	}
+}
+
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("failed to set %s: %s", key, err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, prev)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
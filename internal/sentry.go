@@ -0,0 +1,117 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+// SetupSentry initialises Sentry error reporting from the configuration. Every
+// event is tagged with the name of the component which sent it, and log lines
+// at or above the configured level are sent to Sentry as well as panics.
+func SetupSentry(cfg *config.Global, componentName string) error {
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              cfg.Sentry.DSN,
+		Environment:      cfg.Sentry.Environment,
+		Debug:            true,
+		ServerName:       string(cfg.ServerName),
+		Release:          "dendrite@" + VersionString(),
+		AttachStacktrace: true,
+	})
+	if err != nil {
+		return fmt.Errorf("sentry.Init: %w", err)
+	}
+	sentry.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetTag("component", componentName)
+	})
+	if cfg.Sentry.LogLevel != "" {
+		level, err := logrus.ParseLevel(cfg.Sentry.LogLevel)
+		if err != nil {
+			return fmt.Errorf("logrus.ParseLevel: %w", err)
+		}
+		logrus.AddHook(&sentryHook{level: level})
+	}
+	return nil
+}
+
+// sentryHook is a logrus hook which sends log entries to Sentry.
+type sentryHook struct {
+	level logrus.Level
+}
+
+// Levels returns all the levels at or above the configured level.
+func (h *sentryHook) Levels() []logrus.Level {
+	levels := make([]logrus.Level, 0)
+	for _, level := range logrus.AllLevels {
+		if level <= h.level {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// Fire sends the log entry to Sentry. If the entry has an error attached then
+// it is reported as an exception, otherwise as a message. The remaining fields,
+// such as the request ID and user ID, are attached to the event.
+func (h *sentryHook) Fire(entry *logrus.Entry) error {
+	hub := sentry.CurrentHub()
+	if entry.Context != nil {
+		if ctxHub := sentry.GetHubFromContext(entry.Context); ctxHub != nil {
+			hub = ctxHub
+		}
+	}
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetLevel(sentryLevel(entry.Level))
+		var err error
+		for k, v := range entry.Data {
+			if e, ok := v.(error); ok && k == logrus.ErrorKey {
+				err = e
+				continue
+			}
+			scope.SetExtra(k, v)
+		}
+		if err != nil {
+			scope.SetExtra("message", entry.Message)
+			hub.CaptureException(err)
+		} else {
+			hub.CaptureMessage(entry.Message)
+		}
+	})
+	// The process is about to exit, so give the event a chance to be sent.
+	if entry.Level <= logrus.FatalLevel {
+		hub.Flush(time.Second * 2)
+	}
+	return nil
+}
+
+func sentryLevel(level logrus.Level) sentry.Level {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return sentry.LevelFatal
+	case logrus.ErrorLevel:
+		return sentry.LevelError
+	case logrus.WarnLevel:
+		return sentry.LevelWarning
+	case logrus.InfoLevel:
+		return sentry.LevelInfo
+	default:
+		return sentry.LevelDebug
+	}
+}
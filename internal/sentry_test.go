@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+)
+
+type recordingTransport struct {
+	mu     sync.Mutex
+	events []*sentry.Event
+}
+
+func (t *recordingTransport) Flush(timeout time.Duration) bool       { return true }
+func (t *recordingTransport) Configure(options sentry.ClientOptions) {}
+func (t *recordingTransport) SendEvent(event *sentry.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, event)
+}
+
+func TestSentryHook(t *testing.T) {
+	transport := &recordingTransport{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:       "https://public@sentry.example.com/1",
+		Transport: transport,
+	})
+	if err != nil {
+		t.Fatalf("failed to create Sentry client: %s", err)
+	}
+	hub := sentry.NewHub(client, sentry.NewScope())
+	hub.Scope().SetTag("component", "test")
+	ctx := sentry.SetHubOnContext(context.Background(), hub)
+
+	logger := logrus.New()
+	logger.AddHook(&sentryHook{level: logrus.ErrorLevel})
+	logger.WithContext(ctx).Warn("not important enough")
+	logger.WithContext(ctx).WithField("req.id", "abc").WithError(errors.New("boom")).Error("something failed")
+
+	if len(transport.events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(transport.events))
+	}
+	event := transport.events[0]
+	if event.Level != sentry.LevelError {
+		t.Errorf("expected error level, got %s", event.Level)
+	}
+	if event.Tags["component"] != "test" {
+		t.Errorf("expected component tag, got %v", event.Tags)
+	}
+	if event.Extra["req.id"] != "abc" || event.Extra["message"] != "something failed" {
+		t.Errorf("expected log fields to be attached, got %v", event.Extra)
+	}
+	if len(event.Exception) == 0 || event.Exception[0].Value != "boom" {
+		t.Errorf("expected error to be reported as an exception, got %+v", event.Exception)
+	}
+}
@@ -13,10 +13,15 @@
 package transactions
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
 )
 
 // DefaultCleanupPeriod represents the default time duration after which cacheCleanService runs.
@@ -34,10 +39,21 @@ type CacheKey struct {
 // Cache represents a temporary store for response entries.
 // Entries are evicted after a certain period, defined by cleanupPeriod.
 // This works by keeping two maps of entries, and cycling the maps after the cleanupPeriod.
+// If a JetStream key-value bucket is set with UseKeyValue then entries are
+// stored there instead, so that retries can be sent to any instance.
 type Cache struct {
 	sync.RWMutex
 	txnsMaps      [2]txnsMap
 	cleanupPeriod time.Duration
+	kv            nats.KeyValue
+}
+
+// storedResponse is how responses are stored in the key-value bucket. The
+// JSON is kept as it was encoded, so that it is returned unchanged.
+type storedResponse struct {
+	Code    int               `json:"code"`
+	JSON    json.RawMessage   `json:"json"`
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 // New is a wrapper which calls NewWithCleanupPeriod with DefaultCleanupPeriod as argument.
@@ -57,10 +73,31 @@ func NewWithCleanupPeriod(cleanupPeriod time.Duration) *Cache {
 	return &t
 }
 
+// UseKeyValue makes the Cache store its entries in the given key-value bucket,
+// which should expire them after the cleanup period.
+func (t *Cache) UseKeyValue(kv nats.KeyValue) {
+	t.Lock()
+	defer t.Unlock()
+	t.kv = kv
+}
+
+// kvKey hashes the (accessToken, txnID) tuple, so that access tokens aren't
+// stored in the bucket and clients can't send invalid keys.
+func kvKey(accessToken, txnID string) string {
+	h := sha256.New()
+	_, _ = h.Write([]byte(accessToken))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(txnID))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
 // FetchTransaction looks up an entry for the (accessToken, txnID) tuple in Cache.
 // Looks in both the txnMaps.
 // Returns (JSON response, true) if txnID is found, else the returned bool is false.
 func (t *Cache) FetchTransaction(accessToken, txnID string) (*util.JSONResponse, bool) {
+	if kv := t.keyValue(); kv != nil {
+		return fetchFromKeyValue(kv, accessToken, txnID)
+	}
 	t.RLock()
 	defer t.RUnlock()
 	for _, txns := range t.txnsMaps {
@@ -75,12 +112,67 @@ func (t *Cache) FetchTransaction(accessToken, txnID string) (*util.JSONResponse,
 // AddTransaction adds an entry for the (accessToken, txnID) tuple in Cache.
 // Adds to the front txnMap.
 func (t *Cache) AddTransaction(accessToken, txnID string, res *util.JSONResponse) {
+	if kv := t.keyValue(); kv != nil {
+		addToKeyValue(kv, accessToken, txnID, res)
+		return
+	}
 	t.Lock()
 	defer t.Unlock()
 
 	t.txnsMaps[0][CacheKey{accessToken, txnID}] = res
 }
 
+func (t *Cache) keyValue() nats.KeyValue {
+	t.RLock()
+	defer t.RUnlock()
+	return t.kv
+}
+
+// fetchFromKeyValue looks up the response in the bucket. Errors are logged and
+// treated as the transaction not being found, in which case the request is
+// processed again.
+func fetchFromKeyValue(kv nats.KeyValue, accessToken, txnID string) (*util.JSONResponse, bool) {
+	entry, err := kv.Get(kvKey(accessToken, txnID))
+	switch err {
+	case nil:
+	case nats.ErrKeyNotFound, nats.ErrKeyDeleted:
+		return nil, false
+	default:
+		logrus.WithError(err).Error("Failed to fetch transaction")
+		return nil, false
+	}
+	var stored storedResponse
+	if err = json.Unmarshal(entry.Value(), &stored); err != nil {
+		logrus.WithError(err).Error("Failed to decode transaction")
+		return nil, false
+	}
+	return &util.JSONResponse{
+		Code:    stored.Code,
+		JSON:    stored.JSON,
+		Headers: stored.Headers,
+	}, true
+}
+
+func addToKeyValue(kv nats.KeyValue, accessToken, txnID string, res *util.JSONResponse) {
+	stored := storedResponse{
+		Code:    res.Code,
+		Headers: res.Headers,
+	}
+	var err error
+	if stored.JSON, err = json.Marshal(res.JSON); err != nil {
+		logrus.WithError(err).Error("Failed to encode transaction")
+		return
+	}
+	value, err := json.Marshal(stored)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode transaction")
+		return
+	}
+	if _, err = kv.Put(kvKey(accessToken, txnID), value); err != nil {
+		logrus.WithError(err).Error("Failed to store transaction")
+	}
+}
+
 // cacheCleanService is responsible for cleaning up entries after cleanupPeriod.
 // It guarantees that an entry will be present in cache for at least cleanupPeriod & at most 2 * cleanupPeriod.
 // This cycles the txnMaps forward, i.e. back map is assigned the front and front is assigned an empty map.
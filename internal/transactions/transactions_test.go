@@ -13,10 +13,13 @@
 package transactions
 
 import (
+	"encoding/json"
 	"net/http"
 	"strconv"
 	"testing"
 
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/util"
 )
 
@@ -76,3 +79,44 @@ func TestCacheScope(t *testing.T) {
 		t.Errorf("Wrong cache entry for (%s, %s). Expected: %v; got: %v", fakeAccessToken, fakeTxnID, fakeResponse2.JSON, res.JSON)
 	}
 }
+
+// TestCacheJetStream ensures that responses stored in a key-value bucket can
+// be fetched by another instance of the Cache.
+func TestCacheJetStream(t *testing.T) {
+	cfg := &config.JetStream{
+		InMemory:    true,
+		TopicPrefix: "TransactionsTest",
+		StoragePath: config.Path(t.TempDir()),
+	}
+	js := jetstream.Prepare(cfg)
+	kv, err := js.KeyValue(cfg.TopicFor(jetstream.ClientAPITransactions))
+	if err != nil {
+		t.Fatalf("failed to get key-value bucket: %s", err)
+	}
+	instance1, instance2 := New(), New()
+	instance1.UseKeyValue(kv)
+	instance2.UseKeyValue(kv)
+
+	instance1.AddTransaction(fakeAccessToken, fakeTxnID, &util.JSONResponse{
+		Code:    http.StatusOK,
+		JSON:    fakeType{ID: "0"},
+		Headers: map[string]string{"X-Test": "yes"},
+	})
+	res, ok := instance2.FetchTransaction(fakeAccessToken, fakeTxnID)
+	if !ok {
+		t.Fatalf("failed to retrieve entry for (%s, %s)", fakeAccessToken, fakeTxnID)
+	}
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	if got, want := string(body), `{"ID":"0"}`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if res.Code != http.StatusOK || res.Headers["X-Test"] != "yes" {
+		t.Errorf("got %+v, want code %d and the stored headers", res, http.StatusOK)
+	}
+	if _, ok = instance2.FetchTransaction(fakeAccessToken2, fakeTxnID); ok {
+		t.Errorf("entry for (%s, %s) should not be shared with another access token", fakeAccessToken2, fakeTxnID)
+	}
+}
@@ -37,8 +37,14 @@ type KeyInternalAPI interface {
 	PerformDeleteKeys(ctx context.Context, req *PerformDeleteKeysRequest, res *PerformDeleteKeysResponse)
 	PerformUploadDeviceKeys(ctx context.Context, req *PerformUploadDeviceKeysRequest, res *PerformUploadDeviceKeysResponse)
 	PerformUploadDeviceSignatures(ctx context.Context, req *PerformUploadDeviceSignaturesRequest, res *PerformUploadDeviceSignaturesResponse)
+	// PerformDeviceListResync marks the device list of a remote user as stale and fetches it again
+	PerformDeviceListResync(ctx context.Context, req *PerformDeviceListResyncRequest, res *PerformDeviceListResyncResponse)
 	QueryKeys(ctx context.Context, req *QueryKeysRequest, res *QueryKeysResponse)
+	// QueryBulkDeviceKeys returns the stored device keys of many users at once, without asking remote servers
+	QueryBulkDeviceKeys(ctx context.Context, req *QueryBulkDeviceKeysRequest, res *QueryBulkDeviceKeysResponse)
 	QueryKeyChanges(ctx context.Context, req *QueryKeyChangesRequest, res *QueryKeyChangesResponse)
+	// QueryLatestKeyChange returns the offset of the latest key change, so that consumers can resume from it
+	QueryLatestKeyChange(ctx context.Context, req *QueryLatestKeyChangeRequest, res *QueryLatestKeyChangeResponse)
 	QueryOneTimeKeys(ctx context.Context, req *QueryOneTimeKeysRequest, res *QueryOneTimeKeysResponse)
 	QueryDeviceMessages(ctx context.Context, req *QueryDeviceMessagesRequest, res *QueryDeviceMessagesResponse)
 	QuerySignatures(ctx context.Context, req *QuerySignaturesRequest, res *QuerySignaturesResponse)
@@ -61,6 +67,7 @@ type DeviceMessageType int
 const (
 	TypeDeviceKeyUpdate DeviceMessageType = iota
 	TypeCrossSigningUpdate
+	TypeOneTimeKeysCountUpdate
 )
 
 // DeviceMessage represents the message produced into Kafka by the key server.
@@ -68,6 +75,8 @@ type DeviceMessage struct {
 	Type                                DeviceMessageType `json:"Type,omitempty"`
 	*DeviceKeys                         `json:"DeviceKeys,omitempty"`
 	*eduapi.OutputCrossSigningKeyUpdate `json:"CrossSigningKeyUpdate,omitempty"`
+	// The new one-time key counts of a local device, for TypeOneTimeKeysCountUpdate.
+	OneTimeKeysCount *OneTimeKeysCount `json:"OneTimeKeysCount,omitempty"`
 	// A monotonically increasing number which represents device changes for this user.
 	StreamID       int
 	DeviceChangeID int64
@@ -176,7 +185,8 @@ type PerformClaimKeysRequest struct {
 type PerformClaimKeysResponse struct {
 	// Map of user_id to device_id to algorithm:key_id to key JSON
 	OneTimeKeys map[string]map[string]map[string]json.RawMessage
-	// Map of remote server domain to error JSON
+	// Map of server domain to error JSON, which includes the devices which
+	// keys weren't claimed for because the algorithm isn't supported
 	Failures map[string]interface{}
 	// Set if there was a fatal error processing this action
 	Error *KeyError
@@ -200,6 +210,9 @@ type PerformUploadDeviceSignaturesRequest struct {
 
 type PerformUploadDeviceSignaturesResponse struct {
 	Error *KeyError
+	// The signatures which couldn't be stored, by user ID and then by the
+	// device ID or public key of the key that they are for.
+	Failures map[string]map[string]*KeyError
 }
 
 type QueryKeysRequest struct {
@@ -212,7 +225,8 @@ type QueryKeysRequest struct {
 }
 
 type QueryKeysResponse struct {
-	// Map of remote server domain to error JSON
+	// Map of server domain to error JSON, which includes the devices which
+	// keys weren't claimed for because the algorithm isn't supported
 	Failures map[string]interface{}
 	// Map of user_id to device_id to device_key
 	DeviceKeys map[string]map[string]json.RawMessage
@@ -224,6 +238,19 @@ type QueryKeysResponse struct {
 	Error *KeyError
 }
 
+type QueryBulkDeviceKeysRequest struct {
+	// The users to get the device keys of
+	UserIDs []string
+}
+
+type QueryBulkDeviceKeysResponse struct {
+	// Map of user_id to device_id to device_key. Every user asked for has an
+	// entry, even if they have no devices.
+	DeviceKeys map[string]map[string]json.RawMessage
+	// Set if there was a fatal error processing this query
+	Error *KeyError
+}
+
 type QueryKeyChangesRequest struct {
 	// The offset of the last received key event, or sarama.OffsetOldest if this is from the beginning
 	Offset int64
@@ -241,6 +268,16 @@ type QueryKeyChangesResponse struct {
 	Error *KeyError
 }
 
+type QueryLatestKeyChangeRequest struct {
+}
+
+type QueryLatestKeyChangeResponse struct {
+	// The offset of the latest key change, or 0 if there have been none.
+	Offset int64
+	// Set if there was a problem handling the request.
+	Error *KeyError
+}
+
 type QueryOneTimeKeysRequest struct {
 	// The local user to query OTK counts for
 	UserID string
@@ -290,3 +327,16 @@ type InputDeviceListUpdateRequest struct {
 type InputDeviceListUpdateResponse struct {
 	Error *KeyError
 }
+
+// PerformDeviceListResyncRequest asks the keyserver to fetch the device
+// list of a remote user again, whether or not it thinks the list is stale.
+type PerformDeviceListResyncRequest struct {
+	UserID string
+}
+
+type PerformDeviceListResyncResponse struct {
+	// True if the device list couldn't be fetched in time. It stays stale
+	// and is retried in the background.
+	Stale bool
+	Error *KeyError
+}
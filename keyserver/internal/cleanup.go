@@ -0,0 +1,71 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+// KeyCleanup periodically deletes the keys of devices which were deleted long
+// ago and the old history of key changes, as configured in key_server.cleanup.
+type KeyCleanup struct {
+	Cfg *config.KeyCleanup
+	DB  storage.Database
+}
+
+// Start cleans up on a fixed interval, starting straight away. It does not
+// return, so should be run in a goroutine. It returns immediately if the
+// cleanup is turned off.
+func (c *KeyCleanup) Start() {
+	if c.Cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.Cfg.Interval)
+	defer ticker.Stop()
+	for {
+		c.cleanup(time.Now())
+		<-ticker.C
+	}
+}
+
+func (c *KeyCleanup) cleanup(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	if c.Cfg.DeletedDeviceRetention > 0 {
+		deviceKeys, oneTimeKeys, err := c.DB.PruneDeletedDevices(ctx, now.Add(-c.Cfg.DeletedDeviceRetention))
+		if err != nil {
+			logrus.WithError(err).Error("Failed to delete the keys of deleted devices")
+		} else if deviceKeys > 0 || oneTimeKeys > 0 {
+			logrus.WithFields(logrus.Fields{
+				"device_keys":   deviceKeys,
+				"one_time_keys": oneTimeKeys,
+			}).Info("Deleted the keys of deleted devices")
+		}
+	}
+	if c.Cfg.KeyChangeRetention > 0 {
+		keyChanges, err := c.DB.PruneKeyChanges(ctx, now.Add(-c.Cfg.KeyChangeRetention))
+		if err != nil {
+			logrus.WithError(err).Error("Failed to delete old key changes")
+		} else if keyChanges > 0 {
+			logrus.WithField("key_changes", keyChanges).Info("Deleted old key changes")
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"crypto/ed25519"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -27,6 +28,7 @@ import (
 	"github.com/matrix-org/dendrite/keyserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/sjson"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -68,7 +70,7 @@ func sanityCheckKey(key gomatrixserverlib.CrossSigningKey, userID string, purpos
 	// Check to see if the signatures make sense
 	for _, forOriginUser := range key.Signatures {
 		for originKeyID, originSignature := range forOriginUser {
-			switch strings.SplitN(string(originKeyID), ":", 1)[0] {
+			switch strings.SplitN(string(originKeyID), ":", 2)[0] {
 			case "ed25519":
 				if len(originSignature) != ed25519.SignatureSize {
 					return fmt.Errorf("ed25519 signature is not the correct length")
@@ -196,6 +198,7 @@ func (a *KeyInternalAPI) PerformUploadDeviceKeys(ctx context.Context, req *api.P
 		}
 		return
 	}
+	a.KeysCache.Invalidate(req.UserID)
 
 	// Now upload any signatures that were included with the keys.
 	for _, key := range byPurpose {
@@ -240,74 +243,58 @@ func (a *KeyInternalAPI) PerformUploadDeviceKeys(ctx context.Context, req *api.P
 }
 
 func (a *KeyInternalAPI) PerformUploadDeviceSignatures(ctx context.Context, req *api.PerformUploadDeviceSignaturesRequest, res *api.PerformUploadDeviceSignaturesResponse) {
-	// Before we do anything, we need the master and self-signing keys for this user.
-	// Then we can verify the signatures make sense.
+	// Before we do anything, we need the keys of the uploading user and of the
+	// users whose keys they signed. Then we can verify the signatures make sense.
 	queryReq := &api.QueryKeysRequest{
-		UserID:        req.UserID,
-		UserToDevices: map[string][]string{},
+		UserID: req.UserID,
+		UserToDevices: map[string][]string{
+			req.UserID: {},
+		},
 	}
 	queryRes := &api.QueryKeysResponse{}
 	for userID := range req.Signatures {
 		queryReq.UserToDevices[userID] = []string{}
 	}
 	a.QueryKeys(ctx, queryReq, queryRes)
-
-	selfSignatures := map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.CrossSigningForKeyOrDevice{}
-	otherSignatures := map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.CrossSigningForKeyOrDevice{}
-
-	// Sort signatures into two groups: one where people have signed their own
-	// keys and one where people have signed someone elses
-	for userID, forUserID := range req.Signatures {
-		for keyID, keyOrDevice := range forUserID {
-			switch key := keyOrDevice.CrossSigningBody.(type) {
-			case *gomatrixserverlib.CrossSigningKey:
-				if key.UserID == req.UserID {
-					if _, ok := selfSignatures[userID]; !ok {
-						selfSignatures[userID] = map[gomatrixserverlib.KeyID]gomatrixserverlib.CrossSigningForKeyOrDevice{}
-					}
-					selfSignatures[userID][keyID] = keyOrDevice
-				} else {
-					if _, ok := otherSignatures[userID]; !ok {
-						otherSignatures[userID] = map[gomatrixserverlib.KeyID]gomatrixserverlib.CrossSigningForKeyOrDevice{}
-					}
-					otherSignatures[userID][keyID] = keyOrDevice
-				}
-
-			case *gomatrixserverlib.DeviceKeys:
-				if key.UserID == req.UserID {
-					if _, ok := selfSignatures[userID]; !ok {
-						selfSignatures[userID] = map[gomatrixserverlib.KeyID]gomatrixserverlib.CrossSigningForKeyOrDevice{}
-					}
-					selfSignatures[userID][keyID] = keyOrDevice
-				} else {
-					if _, ok := otherSignatures[userID]; !ok {
-						otherSignatures[userID] = map[gomatrixserverlib.KeyID]gomatrixserverlib.CrossSigningForKeyOrDevice{}
-					}
-					otherSignatures[userID][keyID] = keyOrDevice
-				}
-
-			default:
-				continue
-			}
-		}
-	}
-
-	if err := a.processSelfSignatures(ctx, selfSignatures); err != nil {
+	if queryRes.Error != nil {
 		res.Error = &api.KeyError{
-			Err: fmt.Sprintf("a.processSelfSignatures: %s", err),
+			Err: fmt.Sprintf("a.QueryKeys: %s", queryRes.Error),
 		}
 		return
 	}
 
-	if err := a.processOtherSignatures(ctx, req.UserID, queryRes, otherSignatures); err != nil {
-		res.Error = &api.KeyError{
-			Err: fmt.Sprintf("a.processOtherSignatures: %s", err),
+	// Signatures which can't be verified are reported for the key that they
+	// are for, the others are still stored.
+	updatedUsers := map[string]struct{}{}
+	for targetUserID, forTargetUserID := range req.Signatures {
+		for targetID, keyOrDevice := range forTargetUserID {
+			var err error
+			if targetUserID == req.UserID {
+				err = a.processSelfSignature(ctx, req.UserID, string(targetID), keyOrDevice, queryRes)
+			} else {
+				err = a.processOtherSignature(ctx, req.UserID, targetUserID, keyOrDevice, queryRes)
+			}
+			if keyErr, ok := err.(*api.KeyError); ok {
+				if res.Failures == nil {
+					res.Failures = map[string]map[string]*api.KeyError{}
+				}
+				if _, ok := res.Failures[targetUserID]; !ok {
+					res.Failures[targetUserID] = map[string]*api.KeyError{}
+				}
+				res.Failures[targetUserID][string(targetID)] = keyErr
+				continue
+			} else if err != nil {
+				res.Error = &api.KeyError{
+					Err: err.Error(),
+				}
+				return
+			}
+			updatedUsers[targetUserID] = struct{}{}
 		}
-		return
 	}
 
 	// Finally, generate a notification that we updated the signatures.
-	for userID := range req.Signatures {
+	for userID := range updatedUsers {
 		update := eduserverAPI.CrossSigningKeyUpdate{
 			UserID: userID,
 		}
@@ -320,108 +307,176 @@ func (a *KeyInternalAPI) PerformUploadDeviceSignatures(ctx context.Context, req
 	}
 }
 
-func (a *KeyInternalAPI) processSelfSignatures(
-	ctx context.Context,
-	signatures map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.CrossSigningForKeyOrDevice,
+// processSelfSignature stores the signatures of a user over their own keys:
+// * The user signing their own devices using their self-signing key
+// * The user signing their master key using one of their devices
+func (a *KeyInternalAPI) processSelfSignature(
+	ctx context.Context, userID, targetID string,
+	signature gomatrixserverlib.CrossSigningForKeyOrDevice, queryRes *api.QueryKeysResponse,
 ) error {
-	// Here we will process:
-	// * The user signing their own devices using their self-signing key
-	// * The user signing their master key using one of their devices
-
-	for targetUserID, forTargetUserID := range signatures {
-		for targetKeyID, signature := range forTargetUserID {
-			switch sig := signature.CrossSigningBody.(type) {
-			case *gomatrixserverlib.CrossSigningKey:
-				for originUserID, forOriginUserID := range sig.Signatures {
-					for originKeyID, originSig := range forOriginUserID {
-						if err := a.DB.StoreCrossSigningSigsForTarget(
-							ctx, originUserID, originKeyID, targetUserID, targetKeyID, originSig,
-						); err != nil {
-							return fmt.Errorf("a.DB.StoreCrossSigningKeysForTarget: %w", err)
-						}
-					}
-				}
-
-			case *gomatrixserverlib.DeviceKeys:
-				for originUserID, forOriginUserID := range sig.Signatures {
-					for originKeyID, originSig := range forOriginUserID {
-						if err := a.DB.StoreCrossSigningSigsForTarget(
-							ctx, originUserID, originKeyID, targetUserID, targetKeyID, originSig,
-						); err != nil {
-							return fmt.Errorf("a.DB.StoreCrossSigningKeysForTarget: %w", err)
-						}
-					}
-				}
+	switch sig := signature.CrossSigningBody.(type) {
+	case *gomatrixserverlib.DeviceKeys:
+		deviceJSON, ok := queryRes.DeviceKeys[userID][targetID]
+		if !ok || sig.UserID != userID || sig.DeviceID != targetID {
+			return &api.KeyError{
+				Err:            fmt.Sprintf("unknown device %q", targetID),
+				IsInvalidParam: true,
+			}
+		}
+		selfSigningKey, ok := queryRes.SelfSigningKeys[userID]
+		if !ok {
+			return &api.KeyError{
+				Err:            "no self-signing key was found",
+				IsMissingParam: true,
+			}
+		}
+		return a.storeVerifiedSignatures(
+			ctx, userID, userID, gomatrixserverlib.KeyID(targetID), deviceJSON,
+			sig.Signatures[userID], selfSigningKey.Keys,
+		)
 
-			default:
-				return fmt.Errorf("unexpected type assertion")
+	case *gomatrixserverlib.CrossSigningKey:
+		masterKeyID, masterJSON, err := localMasterKey(queryRes, userID, sig)
+		if err != nil {
+			return err
+		}
+		// Each of the user's devices signs with its own ed25519 key.
+		deviceKeys := map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{}
+		for _, deviceJSON := range queryRes.DeviceKeys[userID] {
+			var device gomatrixserverlib.DeviceKeys
+			if err = json.Unmarshal(deviceJSON, &device); err != nil {
+				continue
+			}
+			keyID := gomatrixserverlib.KeyID("ed25519:" + device.DeviceID)
+			if key, ok := device.Keys[keyID]; ok {
+				deviceKeys[keyID] = key
 			}
 		}
+		return a.storeVerifiedSignatures(
+			ctx, userID, userID, masterKeyID, masterJSON, sig.Signatures[userID], deviceKeys,
+		)
+
+	default:
+		return &api.KeyError{
+			Err:            "unexpected type of key",
+			IsInvalidParam: true,
+		}
 	}
-
-	return nil
 }
 
-func (a *KeyInternalAPI) processOtherSignatures(
-	ctx context.Context, userID string, queryRes *api.QueryKeysResponse,
-	signatures map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.CrossSigningForKeyOrDevice,
+// processOtherSignature stores the signatures of a user over someone else's
+// master key, made using their user-signing key.
+func (a *KeyInternalAPI) processOtherSignature(
+	ctx context.Context, userID, targetUserID string,
+	signature gomatrixserverlib.CrossSigningForKeyOrDevice, queryRes *api.QueryKeysResponse,
 ) error {
-	// Here we will process:
-	// * A user signing someone else's master keys using their user-signing keys
-
-	for targetUserID, forTargetUserID := range signatures {
-		for _, signature := range forTargetUserID {
-			switch sig := signature.CrossSigningBody.(type) {
-			case *gomatrixserverlib.CrossSigningKey:
-				// Find the local copy of the master key. We'll use this to be
-				// sure that the supplied stanza matches the key that we think it
-				// should be.
-				masterKey, ok := queryRes.MasterKeys[targetUserID]
-				if !ok {
-					return fmt.Errorf("failed to find master key for user %q", targetUserID)
-				}
-
-				// For each key ID, write the signatures. Maybe there'll be more
-				// than one algorithm in the future so it's best not to focus on
-				// everything being ed25519:.
-				for targetKeyID, suppliedKeyData := range sig.Keys {
-					// The master key will be supplied in the request, but we should
-					// make sure that it matches what we think the master key should
-					// actually be.
-					localKeyData, lok := masterKey.Keys[targetKeyID]
-					if !lok {
-						return fmt.Errorf("uploaded master key %q for user %q doesn't match local copy", targetKeyID, targetUserID)
-					} else if !bytes.Equal(suppliedKeyData, localKeyData) {
-						return fmt.Errorf("uploaded master key %q for user %q doesn't match local copy", targetKeyID, targetUserID)
-					}
-
-					// We only care about the signatures from the uploading user, so
-					// we will ignore anything that didn't originate from them.
-					userSigs, ok := sig.Signatures[userID]
-					if !ok {
-						return fmt.Errorf("there are no signatures on master key %q from uploading user %q", targetKeyID, userID)
-					}
+	sig, ok := signature.CrossSigningBody.(*gomatrixserverlib.CrossSigningKey)
+	if !ok {
+		// Users should only be signing another person's master key.
+		return &api.KeyError{
+			Err:            "only the master keys of other users can be signed",
+			IsInvalidParam: true,
+		}
+	}
+	masterKeyID, masterJSON, err := localMasterKey(queryRes, targetUserID, sig)
+	if err != nil {
+		return err
+	}
+	userSigningKey, ok := queryRes.UserSigningKeys[userID]
+	if !ok {
+		return &api.KeyError{
+			Err:            "no user-signing key was found",
+			IsMissingParam: true,
+		}
+	}
+	return a.storeVerifiedSignatures(
+		ctx, userID, targetUserID, masterKeyID, masterJSON, sig.Signatures[userID], userSigningKey.Keys,
+	)
+}
 
-					for originKeyID, originSig := range userSigs {
-						if err := a.DB.StoreCrossSigningSigsForTarget(
-							ctx, userID, originKeyID, targetUserID, targetKeyID, originSig,
-						); err != nil {
-							return fmt.Errorf("a.DB.StoreCrossSigningKeysForTarget: %w", err)
-						}
-					}
-				}
+// localMasterKey returns the key ID and the JSON of our copy of the master key
+// of the user, making sure that the supplied key matches it.
+func localMasterKey(
+	queryRes *api.QueryKeysResponse, userID string, supplied *gomatrixserverlib.CrossSigningKey,
+) (gomatrixserverlib.KeyID, []byte, error) {
+	masterKey, ok := queryRes.MasterKeys[userID]
+	if !ok {
+		return "", nil, &api.KeyError{
+			Err:            fmt.Sprintf("failed to find master key for user %q", userID),
+			IsInvalidParam: true,
+		}
+	}
+	var masterKeyID gomatrixserverlib.KeyID
+	for keyID := range masterKey.Keys { // iterates once, see sanityCheckKey
+		masterKeyID = keyID
+	}
+	if supplied.UserID != userID || len(supplied.Keys) != 1 || !bytes.Equal(supplied.Keys[masterKeyID], masterKey.Keys[masterKeyID]) {
+		return "", nil, &api.KeyError{
+			Err:            fmt.Sprintf("uploaded master key for user %q doesn't match local copy", userID),
+			IsInvalidParam: true,
+		}
+	}
+	masterJSON, err := json.Marshal(masterKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	return masterKeyID, masterJSON, nil
+}
 
-			default:
-				// Users should only be signing another person's master key,
-				// so if we're here, it's probably because it's actually a
-				// gomatrixserverlib.DeviceKeys, which doesn't make sense.
+// storeVerifiedSignatures stores the signatures of the origin user over the
+// target key which were made by one of the signing keys. Signatures by other
+// keys are ignored, e.g. the signature of a device over its own keys, but it
+// fails if none of the signatures are by one of the signing keys.
+func (a *KeyInternalAPI) storeVerifiedSignatures(
+	ctx context.Context, originUserID, targetUserID string, targetKeyID gomatrixserverlib.KeyID, targetJSON []byte,
+	signatures map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes, signingKeys map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes,
+) error {
+	stored := 0
+	for originKeyID, originSig := range signatures {
+		publicKey, ok := signingKeys[originKeyID]
+		if !ok {
+			continue
+		}
+		if err := verifySignature(targetJSON, originUserID, originKeyID, publicKey, originSig); err != nil {
+			return &api.KeyError{
+				Err:                fmt.Sprintf("signature %q is invalid: %s", originKeyID, err),
+				IsInvalidSignature: true,
 			}
 		}
+		if err := a.DB.StoreCrossSigningSigsForTarget(
+			ctx, originUserID, originKeyID, targetUserID, targetKeyID, originSig,
+		); err != nil {
+			return fmt.Errorf("a.DB.StoreCrossSigningSigsForTarget: %w", err)
+		}
+		stored++
+	}
+	if stored == 0 {
+		return &api.KeyError{
+			Err:                "there are no signatures by a key which can sign this key",
+			IsInvalidSignature: true,
+		}
 	}
-
 	return nil
 }
 
+// verifySignature checks the signature over the JSON of a key, ignoring any
+// other signatures that the key has.
+func verifySignature(
+	keyJSON []byte, userID string, keyID gomatrixserverlib.KeyID,
+	publicKey gomatrixserverlib.Base64Bytes, signature gomatrixserverlib.Base64Bytes,
+) error {
+	if !strings.HasPrefix(string(keyID), "ed25519:") || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("only ed25519 signatures are supported")
+	}
+	signed, err := sjson.SetBytes(keyJSON, "signatures", map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+		userID: {keyID: signature},
+	})
+	if err != nil {
+		return err
+	}
+	return gomatrixserverlib.VerifyJSON(userID, keyID, ed25519.PublicKey(publicKey), signed)
+}
+
 func (a *KeyInternalAPI) crossSigningKeysFromDatabase(
 	ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse,
 ) {
@@ -477,7 +532,11 @@ func (a *KeyInternalAPI) crossSigningKeysFromDatabase(
 				res.SelfSigningKeys[userID] = key
 
 			case gomatrixserverlib.CrossSigningKeyPurposeUserSigning:
-				res.UserSigningKeys[userID] = key
+				// Only the user themselves gets to see their user-signing
+				// key.
+				if req.UserID == userID {
+					res.UserSigningKeys[userID] = key
+				}
 			}
 		}
 	}
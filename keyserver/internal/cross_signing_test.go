@@ -0,0 +1,106 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestVerifySignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey failed: %s", err)
+	}
+	keyID := gomatrixserverlib.KeyID("ed25519:" + gomatrixserverlib.Base64Bytes(publicKey).Encode())
+	deviceJSON := []byte(`{"user_id":"@alice:test","device_id":"PHONE","algorithms":["m.olm.v1.curve25519-aes-sha2"],"keys":{"ed25519:PHONE":"a2V5"},"signatures":{"@alice:test":{"ed25519:PHONE":"c2ln"}}}`)
+	signed, err := gomatrixserverlib.SignJSON("@alice:test", keyID, privateKey, deviceJSON)
+	if err != nil {
+		t.Fatalf("gomatrixserverlib.SignJSON failed: %s", err)
+	}
+	var device gomatrixserverlib.DeviceKeys
+	if err = json.Unmarshal(signed, &device); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	signature := device.Signatures["@alice:test"][keyID]
+
+	// The signature is checked against our copy of the key, whatever other
+	// signatures and unsigned data it has.
+	storedJSON := []byte(`{"user_id":"@alice:test","device_id":"PHONE","algorithms":["m.olm.v1.curve25519-aes-sha2"],"keys":{"ed25519:PHONE":"a2V5"},"unsigned":{"device_display_name":"Phone"}}`)
+	if err = verifySignature(storedJSON, "@alice:test", keyID, gomatrixserverlib.Base64Bytes(publicKey), signature); err != nil {
+		t.Errorf("verifySignature: got %s, want the signature to be valid", err)
+	}
+
+	tsts := []struct {
+		Name      string
+		KeyJSON   []byte
+		UserID    string
+		KeyID     gomatrixserverlib.KeyID
+		PublicKey gomatrixserverlib.Base64Bytes
+	}{
+		{"otherKey", []byte(`{"user_id":"@alice:test","device_id":"PHONE","keys":{"ed25519:PHONE":"b3RoZXI"}}`), "@alice:test", keyID, gomatrixserverlib.Base64Bytes(publicKey)},
+		{"notEd25519", storedJSON, "@alice:test", "curve25519:key", gomatrixserverlib.Base64Bytes(publicKey)},
+		{"shortPublicKey", storedJSON, "@alice:test", keyID, gomatrixserverlib.Base64Bytes("short")},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if err := verifySignature(tst.KeyJSON, tst.UserID, tst.KeyID, tst.PublicKey, signature); err == nil {
+				t.Errorf("verifySignature: got nil, want an error")
+			}
+		})
+	}
+}
+
+func TestLocalMasterKey(t *testing.T) {
+	masterKey := gomatrixserverlib.CrossSigningKey{
+		UserID: "@alice:test",
+		Usage:  []gomatrixserverlib.CrossSigningKeyPurpose{gomatrixserverlib.CrossSigningKeyPurposeMaster},
+		Keys: map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+			"ed25519:a2V5": gomatrixserverlib.Base64Bytes("key"),
+		},
+	}
+	queryRes := &api.QueryKeysResponse{
+		MasterKeys: map[string]gomatrixserverlib.CrossSigningKey{
+			"@alice:test": masterKey,
+		},
+	}
+
+	keyID, keyJSON, err := localMasterKey(queryRes, "@alice:test", &masterKey)
+	if err != nil {
+		t.Fatalf("localMasterKey failed: %s", err)
+	}
+	if keyID != "ed25519:a2V5" {
+		t.Errorf("got key ID %q, want %q", keyID, "ed25519:a2V5")
+	}
+	var got gomatrixserverlib.CrossSigningKey
+	if err = json.Unmarshal(keyJSON, &got); err != nil || got.UserID != "@alice:test" {
+		t.Errorf("got key JSON %s, want the master key", keyJSON)
+	}
+
+	otherKey := masterKey
+	otherKey.Keys = map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+		"ed25519:b3RoZXI": gomatrixserverlib.Base64Bytes("other"),
+	}
+	if _, _, err = localMasterKey(queryRes, "@alice:test", &otherKey); err == nil {
+		t.Errorf("localMasterKey: got nil, want an error for a key which doesn't match")
+	}
+	if _, _, err = localMasterKey(queryRes, "@bob:test", &masterKey); err == nil {
+		t.Errorf("localMasterKey: got nil, want an error for a user without a master key")
+	}
+}
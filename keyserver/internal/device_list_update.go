@@ -24,6 +24,7 @@ import (
 
 	fedsenderapi "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -74,6 +75,8 @@ func init() {
 //     than being stuck behind foo.bar
 // In the event that the query fails, a lock is acquired and the server name along with the time to wait before retrying is
 // set in a map. A restarter goroutine periodically probes this map and injects servers which are ready to be retried.
+// The time to wait grows with the number of failures in a row, following the configured backoff schedule. Device lists
+// which are still stale are also retried periodically, for the servers which aren't being backed off from.
 type DeviceListUpdater struct {
 	// A map from user_id to a mutex. Used when we are missing prev IDs so we don't make more than 1
 	// request to the remote server and race.
@@ -87,6 +90,14 @@ type DeviceListUpdater struct {
 	fedClient   fedsenderapi.FederationClient
 	workerChans []chan gomatrixserverlib.ServerName
 
+	backoff            []time.Duration
+	staleRetryInterval time.Duration
+	// The servers which failed and when to retry them, along with how many
+	// times in a row they have failed.
+	retries   map[gomatrixserverlib.ServerName]time.Time
+	failures  map[gomatrixserverlib.ServerName]int
+	retriesMu *sync.Mutex
+
 	// When device lists are stale for a user, they get inserted into this map with a channel which `Update` will
 	// block on or timeout via a select.
 	userIDToChan   map[string]chan bool
@@ -127,7 +138,7 @@ type KeyChangeProducer interface {
 // NewDeviceListUpdater creates a new updater which fetches fresh device lists when they go stale.
 func NewDeviceListUpdater(
 	db DeviceListUpdaterDatabase, api DeviceListUpdaterAPI, producer KeyChangeProducer,
-	fedClient fedsenderapi.FederationClient, numWorkers int,
+	fedClient fedsenderapi.FederationClient, cfg *config.DeviceListUpdater,
 ) *DeviceListUpdater {
 	return &DeviceListUpdater{
 		userIDToMutex:  make(map[string]*sync.Mutex),
@@ -136,9 +147,15 @@ func NewDeviceListUpdater(
 		api:            api,
 		producer:       producer,
 		fedClient:      fedClient,
-		workerChans:    make([]chan gomatrixserverlib.ServerName, numWorkers),
+		workerChans:    make([]chan gomatrixserverlib.ServerName, cfg.Workers),
 		userIDToChan:   make(map[string]chan bool),
 		userIDToChanMu: &sync.Mutex{},
+
+		backoff:            cfg.Backoff,
+		staleRetryInterval: cfg.StaleRetryInterval,
+		retries:            make(map[gomatrixserverlib.ServerName]time.Time),
+		failures:           make(map[gomatrixserverlib.ServerName]int),
+		retriesMu:          &sync.Mutex{},
 	}
 }
 
@@ -152,13 +169,17 @@ func (u *DeviceListUpdater) Start() error {
 		u.workerChans[i] = ch
 		go u.worker(ch)
 	}
+	go u.restarter()
+	if u.staleRetryInterval > 0 {
+		go u.staleRetrier()
+	}
 
 	staleLists, err := u.db.StaleDeviceLists(context.Background(), []gomatrixserverlib.ServerName{})
 	if err != nil {
 		return err
 	}
 	for _, userID := range staleLists {
-		u.notifyWorkers(userID)
+		u.notifyWorkers(context.Background(), userID)
 	}
 	return nil
 }
@@ -182,7 +203,7 @@ func (u *DeviceListUpdater) ManualUpdate(ctx context.Context, serverName gomatri
 	if err != nil {
 		return fmt.Errorf("ManualUpdate: failed to mark device list for %s as stale: %w", userID, err)
 	}
-	u.notifyWorkers(userID)
+	u.notifyWorkers(ctx, userID)
 	return nil
 }
 
@@ -195,7 +216,7 @@ func (u *DeviceListUpdater) Update(ctx context.Context, event gomatrixserverlib.
 	}
 	if isDeviceListStale {
 		// poke workers to handle stale device lists
-		u.notifyWorkers(event.UserID)
+		u.notifyWorkers(ctx, event.UserID)
 	}
 	return nil
 }
@@ -262,19 +283,21 @@ func (u *DeviceListUpdater) update(ctx context.Context, event gomatrixserverlib.
 	return true, nil
 }
 
-func (u *DeviceListUpdater) notifyWorkers(userID string) {
+func (u *DeviceListUpdater) notifyWorkers(ctx context.Context, userID string) {
 	_, remoteServer, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		return
 	}
-	hash := fnv.New32a()
-	_, _ = hash.Write([]byte(remoteServer))
-	index := int(int64(hash.Sum32()) % int64(len(u.workerChans)))
-
 	ch := u.assignChannel(userID)
-	u.workerChans[index] <- remoteServer
+	select {
+	case u.workerChans[u.workerIndex(remoteServer)] <- remoteServer:
+	case <-ctx.Done():
+		return
+	}
 	select {
 	case <-ch:
+	case <-ctx.Done():
+		// the caller has stopped waiting, e.g. because their request timed out
 	case <-time.After(10 * time.Second):
 		// we don't return an error in this case as it's not a failure condition.
 		// we mainly block for the benefit of sytest anyway
@@ -301,41 +324,90 @@ func (u *DeviceListUpdater) clearChannel(userID string) {
 	}
 }
 
-func (u *DeviceListUpdater) worker(ch chan gomatrixserverlib.ServerName) {
-	retries := make(map[gomatrixserverlib.ServerName]time.Time)
-	retriesMu := &sync.Mutex{}
-	// restarter goroutine which will inject failed servers into ch when it is time
-	go func() {
-		for {
-			var serversToRetry []gomatrixserverlib.ServerName
-			time.Sleep(time.Second)
-			retriesMu.Lock()
-			now := time.Now()
-			for srv, retryAt := range retries {
-				if now.After(retryAt) {
-					serversToRetry = append(serversToRetry, srv)
-				}
-			}
-			for _, srv := range serversToRetry {
-				delete(retries, srv)
+// workerIndex returns the index of the worker which is responsible for the server.
+func (u *DeviceListUpdater) workerIndex(serverName gomatrixserverlib.ServerName) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(serverName))
+	return int(int64(hash.Sum32()) % int64(len(u.workerChans)))
+}
+
+// restarter injects failed servers into the channels of their workers when it is time to retry them.
+func (u *DeviceListUpdater) restarter() {
+	for {
+		var serversToRetry []gomatrixserverlib.ServerName
+		time.Sleep(time.Second)
+		u.retriesMu.Lock()
+		now := time.Now()
+		for srv, retryAt := range u.retries {
+			if now.After(retryAt) {
+				serversToRetry = append(serversToRetry, srv)
 			}
-			retriesMu.Unlock()
-			for _, srv := range serversToRetry {
-				ch <- srv
+		}
+		for _, srv := range serversToRetry {
+			delete(u.retries, srv)
+		}
+		u.retriesMu.Unlock()
+		for _, srv := range serversToRetry {
+			u.workerChans[u.workerIndex(srv)] <- srv
+		}
+	}
+}
+
+// staleRetrier periodically pokes the workers for the servers of the device lists which are still stale,
+// unless we are backing off from them.
+func (u *DeviceListUpdater) staleRetrier() {
+	ticker := time.NewTicker(u.staleRetryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		staleLists, err := u.db.StaleDeviceLists(context.Background(), []gomatrixserverlib.ServerName{})
+		if err != nil {
+			logrus.WithError(err).Error("failed to load stale device lists for retrying")
+			continue
+		}
+		servers := make(map[gomatrixserverlib.ServerName]struct{})
+		for _, userID := range staleLists {
+			_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+			if err != nil {
+				continue
 			}
+			servers[serverName] = struct{}{}
+		}
+		u.retriesMu.Lock()
+		for srv := range u.retries {
+			delete(servers, srv)
 		}
-	}()
+		u.retriesMu.Unlock()
+		for srv := range servers {
+			u.workerChans[u.workerIndex(srv)] <- srv
+		}
+	}
+}
+
+func (u *DeviceListUpdater) worker(ch chan gomatrixserverlib.ServerName) {
 	for serverName := range ch {
 		waitTime, shouldRetry := u.processServer(serverName)
+		u.retriesMu.Lock()
 		if shouldRetry {
-			retriesMu.Lock()
-			_, exists := retries[serverName]
-			if !exists {
-				retries[serverName] = time.Now().Add(waitTime)
+			u.failures[serverName]++
+			if _, exists := u.retries[serverName]; !exists {
+				u.retries[serverName] = time.Now().Add(waitTime)
 			}
-			retriesMu.Unlock()
+		} else {
+			delete(u.failures, serverName)
 		}
+		u.retriesMu.Unlock()
+	}
+}
+
+// backoffFor returns how long to wait before retrying the server if it fails again.
+func (u *DeviceListUpdater) backoffFor(serverName gomatrixserverlib.ServerName) time.Duration {
+	u.retriesMu.Lock()
+	failures := u.failures[serverName]
+	u.retriesMu.Unlock()
+	if failures >= len(u.backoff) {
+		return u.backoff[len(u.backoff)-1]
 	}
+	return u.backoff[failures]
 }
 
 func (u *DeviceListUpdater) processServer(serverName gomatrixserverlib.ServerName) (time.Duration, bool) {
@@ -344,7 +416,7 @@ func (u *DeviceListUpdater) processServer(serverName gomatrixserverlib.ServerNam
 	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 	logger := util.GetLogger(ctx).WithField("server_name", serverName)
-	waitTime := 2 * time.Second
+	waitTime := u.backoffFor(serverName)
 	// fetch stale device lists
 	userIDs, err := u.db.StaleDeviceLists(ctx, []gomatrixserverlib.ServerName{serverName})
 	if err != nil {
@@ -363,13 +435,12 @@ func (u *DeviceListUpdater) processServer(serverName gomatrixserverlib.ServerNam
 			failCount += 1
 			fcerr, ok := err.(*fedsenderapi.FederationClientError)
 			if ok {
-				if fcerr.RetryAfter > 0 {
+				if fcerr.RetryAfter > waitTime {
 					waitTime = fcerr.RetryAfter
 				} else if fcerr.Blacklisted {
-					waitTime = time.Hour * 8
+					waitTime = u.backoff[len(u.backoff)-1]
 				}
 			} else {
-				waitTime = time.Hour
 				logger.WithError(err).Warn("GetUserDevices returned unknown error type")
 			}
 			continue
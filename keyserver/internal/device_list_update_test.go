@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -121,6 +122,13 @@ func newFedClient(tripper func(*http.Request) (*http.Response, error)) *gomatrix
 	return fedClient
 }
 
+func testDeviceListUpdaterConfig(workers int) *config.DeviceListUpdater {
+	cfg := &config.DeviceListUpdater{}
+	cfg.Defaults()
+	cfg.Workers = workers
+	return cfg
+}
+
 // Test that the device keys get persisted and emitted if we have the previous IDs.
 func TestUpdateHavePrevID(t *testing.T) {
 	db := &mockDeviceListUpdaterDatabase{
@@ -131,7 +139,7 @@ func TestUpdateHavePrevID(t *testing.T) {
 	}
 	ap := &mockDeviceListUpdaterAPI{}
 	producer := &mockKeyChangeProducer{}
-	updater := NewDeviceListUpdater(db, ap, producer, nil, 1)
+	updater := NewDeviceListUpdater(db, ap, producer, nil, testDeviceListUpdaterConfig(1))
 	event := gomatrixserverlib.DeviceListUpdateEvent{
 		DeviceDisplayName: "Foo Bar",
 		Deleted:           false,
@@ -203,7 +211,7 @@ func TestUpdateNoPrevID(t *testing.T) {
 			`)),
 		}, nil
 	})
-	updater := NewDeviceListUpdater(db, ap, producer, fedClient, 2)
+	updater := NewDeviceListUpdater(db, ap, producer, fedClient, testDeviceListUpdaterConfig(2))
 	if err := updater.Start(); err != nil {
 		t.Fatalf("failed to start updater: %s", err)
 	}
@@ -247,3 +255,41 @@ func TestUpdateNoPrevID(t *testing.T) {
 	}
 
 }
+
+// Test that servers which keep failing are backed off from according to the schedule.
+func TestUpdateBackoff(t *testing.T) {
+	remoteUserID := "@alice:example.somewhere"
+	db := &mockDeviceListUpdaterDatabase{
+		staleUsers: map[string]bool{remoteUserID: true},
+	}
+	fedClient := newFedClient(func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("test: server is down")
+	})
+	cfg := testDeviceListUpdaterConfig(1)
+	cfg.Backoff = []time.Duration{time.Minute, time.Hour}
+	updater := NewDeviceListUpdater(db, &mockDeviceListUpdaterAPI{}, &mockKeyChangeProducer{}, fedClient, cfg)
+	ch := make(chan gomatrixserverlib.ServerName)
+	go updater.worker(ch)
+
+	for _, want := range []time.Duration{time.Minute, time.Hour, time.Hour} {
+		start := time.Now()
+		ch <- "example.somewhere"
+		var retryAt time.Time
+		for i := 0; i < 100 && retryAt.IsZero(); i++ {
+			time.Sleep(10 * time.Millisecond)
+			updater.retriesMu.Lock()
+			retryAt = updater.retries["example.somewhere"]
+			delete(updater.retries, "example.somewhere")
+			updater.retriesMu.Unlock()
+		}
+		if retryAt.IsZero() {
+			t.Fatalf("server wasn't marked to be retried")
+		}
+		if got := retryAt.Sub(start); got < want || got > want+time.Minute/2 {
+			t.Errorf("got retry after %s, want %s", got, want)
+		}
+	}
+	if !db.staleUsers[remoteUserID] {
+		t.Errorf("%s no longer marked as stale", remoteUserID)
+	}
+}
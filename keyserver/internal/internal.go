@@ -17,8 +17,10 @@ package internal
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -41,6 +43,10 @@ type KeyInternalAPI struct {
 	UserAPI    userapi.UserInternalAPI
 	Producer   *producers.KeyChange
 	Updater    *DeviceListUpdater
+	KeysCache  *QueryKeysCache
+	// The most one-time keys that each device can have stored. 0 means
+	// that there is no limit.
+	MaxOneTimeKeysPerDevice int
 }
 
 func (a *KeyInternalAPI) SetUserAPI(i userapi.UserInternalAPI) {
@@ -50,6 +56,7 @@ func (a *KeyInternalAPI) SetUserAPI(i userapi.UserInternalAPI) {
 func (a *KeyInternalAPI) InputDeviceListUpdate(
 	ctx context.Context, req *api.InputDeviceListUpdateRequest, res *api.InputDeviceListUpdateResponse,
 ) {
+	a.KeysCache.Invalidate(req.Event.UserID)
 	err := a.Updater.Update(ctx, req.Event)
 	if err != nil {
 		res.Error = &api.KeyError{
@@ -58,6 +65,46 @@ func (a *KeyInternalAPI) InputDeviceListUpdate(
 	}
 }
 
+func (a *KeyInternalAPI) PerformDeviceListResync(
+	ctx context.Context, req *api.PerformDeviceListResyncRequest, res *api.PerformDeviceListResyncResponse,
+) {
+	_, serverName, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err:            fmt.Sprintf("invalid user ID %q", req.UserID),
+			IsInvalidParam: true,
+		}
+		return
+	}
+	if serverName == a.ThisServer {
+		res.Error = &api.KeyError{
+			Err:            "the device lists of local users can't be resynced",
+			IsInvalidParam: true,
+		}
+		return
+	}
+	a.KeysCache.Invalidate(req.UserID)
+	// This blocks until the device list has been fetched, or for a short while if the server is slow.
+	if err = a.Updater.ManualUpdate(ctx, serverName, req.UserID); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to resync device list: %s", err),
+		}
+		return
+	}
+	staleLists, err := a.DB.StaleDeviceLists(ctx, []gomatrixserverlib.ServerName{serverName})
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to load stale device lists: %s", err),
+		}
+		return
+	}
+	for _, userID := range staleLists {
+		if userID == req.UserID {
+			res.Stale = true
+		}
+	}
+}
+
 func (a *KeyInternalAPI) QueryKeyChanges(ctx context.Context, req *api.QueryKeyChangesRequest, res *api.QueryKeyChangesResponse) {
 	userIDs, latest, err := a.DB.KeyChanges(ctx, req.Offset, req.ToOffset)
 	if err != nil {
@@ -69,12 +116,30 @@ func (a *KeyInternalAPI) QueryKeyChanges(ctx context.Context, req *api.QueryKeyC
 	res.UserIDs = userIDs
 }
 
+func (a *KeyInternalAPI) QueryLatestKeyChange(ctx context.Context, req *api.QueryLatestKeyChangeRequest, res *api.QueryLatestKeyChangeResponse) {
+	offset, err := a.DB.LatestKeyChange(ctx)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: err.Error(),
+		}
+		return
+	}
+	res.Offset = offset
+}
+
 func (a *KeyInternalAPI) PerformUploadKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
 	res.KeyErrors = make(map[string]map[string]*api.KeyError)
 	a.uploadLocalDeviceKeys(ctx, req, res)
 	a.uploadOneTimeKeys(ctx, req, res)
 }
 
+// supportedOneTimeKeyAlgorithms are the algorithms which one-time keys can be
+// claimed for.
+var supportedOneTimeKeyAlgorithms = map[string]bool{
+	"curve25519":        true,
+	"signed_curve25519": true,
+}
+
 func (a *KeyInternalAPI) PerformClaimKeys(ctx context.Context, req *api.PerformClaimKeysRequest, res *api.PerformClaimKeysResponse) {
 	res.OneTimeKeys = make(map[string]map[string]map[string]json.RawMessage)
 	res.Failures = make(map[string]interface{})
@@ -85,11 +150,22 @@ func (a *KeyInternalAPI) PerformClaimKeys(ctx context.Context, req *api.PerformC
 		if err != nil {
 			continue // ignore invalid users
 		}
+		devices := make(map[string]string, len(val))
+		for deviceID, algorithm := range val {
+			if !supportedOneTimeKeyAlgorithms[algorithm] {
+				addUnsupportedAlgorithmFailure(res, string(serverName), userID, deviceID, algorithm)
+				continue
+			}
+			devices[deviceID] = algorithm
+		}
+		if len(devices) == 0 {
+			continue
+		}
 		nested, ok := domainToDeviceKeys[string(serverName)]
 		if !ok {
 			nested = make(map[string]map[string]string)
 		}
-		nested[userID] = val
+		nested[userID] = devices
 		domainToDeviceKeys[string(serverName)] = nested
 	}
 	// claim local keys
@@ -102,6 +178,7 @@ func (a *KeyInternalAPI) PerformClaimKeys(ctx context.Context, req *api.PerformC
 		}
 		util.GetLogger(ctx).WithField("keys_claimed", len(keys)).WithField("num_users", len(local)).Info("Claimed local keys")
 		for _, key := range keys {
+			a.emitOneTimeKeysCount(ctx, key.UserID, key.DeviceID)
 			_, ok := res.OneTimeKeys[key.UserID]
 			if !ok {
 				res.OneTimeKeys[key.UserID] = make(map[string]map[string]json.RawMessage)
@@ -121,6 +198,28 @@ func (a *KeyInternalAPI) PerformClaimKeys(ctx context.Context, req *api.PerformC
 	}
 }
 
+// addUnsupportedAlgorithmFailure records in the failures of the server that
+// the device's keys weren't claimed because of the algorithm asked for.
+func addUnsupportedAlgorithmFailure(res *api.PerformClaimKeysResponse, serverName, userID, deviceID, algorithm string) {
+	failure, ok := res.Failures[serverName].(map[string]interface{})
+	if !ok {
+		failure = map[string]interface{}{
+			"message": "unsupported one-time key algorithm",
+			"devices": make(map[string]map[string]string),
+		}
+		res.Failures[serverName] = failure
+	}
+	devices := failure["devices"].(map[string]map[string]string)
+	if _, ok = devices[userID]; !ok {
+		devices[userID] = make(map[string]string)
+	}
+	devices[userID][deviceID] = algorithm
+}
+
+// maxConcurrentClaimRequests is the most servers that claimRemoteKeys
+// sends /keys/claim requests to at once.
+const maxConcurrentClaimRequests = 8
+
 func (a *KeyInternalAPI) claimRemoteKeys(
 	ctx context.Context, timeout time.Duration, res *api.PerformClaimKeysResponse, domainToDeviceKeys map[string]map[string]map[string]string,
 ) {
@@ -130,14 +229,22 @@ func (a *KeyInternalAPI) claimRemoteKeys(
 	wg.Add(len(domainToDeviceKeys))
 	// mutex for failures
 	var failMu sync.Mutex
+	// limits how many servers we claim keys from at once
+	sem := make(chan struct{}, maxConcurrentClaimRequests)
 	util.GetLogger(ctx).WithField("num_servers", len(domainToDeviceKeys)).Info("Claiming remote keys from servers")
 
-	// fan out
+	// fan out, with a single request for all of the keys on each server
 	for d, k := range domainToDeviceKeys {
 		go func(domain string, keysToClaim map[string]map[string]string) {
 			defer wg.Done()
-			fedCtx, cancel := context.WithTimeout(ctx, timeout)
-			defer cancel()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			fedCtx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				fedCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
 			claimKeyRes, err := a.FedClient.ClaimKeys(fedCtx, gomatrixserverlib.ServerName(domain), keysToClaim)
 			if err != nil {
 				util.GetLogger(ctx).WithError(err).WithField("server", domain).Error("ClaimKeys failed")
@@ -148,6 +255,26 @@ func (a *KeyInternalAPI) claimRemoteKeys(
 				failMu.Unlock()
 				return
 			}
+			// only take the keys of the users and devices we asked this server
+			// about, for the algorithms that we asked for
+			for userID, devices := range claimKeyRes.OneTimeKeys {
+				if _, ok := keysToClaim[userID]; !ok {
+					delete(claimKeyRes.OneTimeKeys, userID)
+					continue
+				}
+				for deviceID, keys := range devices {
+					algorithm, ok := keysToClaim[userID][deviceID]
+					if !ok {
+						delete(devices, deviceID)
+						continue
+					}
+					for keyIDWithAlgo := range keys {
+						if !strings.HasPrefix(keyIDWithAlgo, algorithm+":") {
+							delete(keys, keyIDWithAlgo)
+						}
+					}
+				}
+			}
 			resultCh <- &claimKeyRes
 		}(d, k)
 	}
@@ -233,6 +360,21 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 	// get cross-signing keys from the database
 	a.crossSigningKeysFromDatabase(ctx, req, res)
 
+	// query the keys of all of the local devices at once
+	localUserToDevices := make(map[string][]string)
+	for userID, deviceIDs := range req.UserToDevices {
+		if _, serverName, err := gomatrixserverlib.SplitID('@', userID); err == nil && serverName == a.ThisServer {
+			localUserToDevices[userID] = deviceIDs
+		}
+	}
+	localDeviceKeys, err := a.storedDeviceKeys(ctx, localUserToDevices)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query local device keys: %s", err),
+		}
+		return
+	}
+
 	// make a map from domain to device keys
 	domainToDeviceKeys := make(map[string]map[string][]string)
 	domainToCrossSigningKeys := make(map[string]map[string]struct{})
@@ -244,44 +386,7 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 		domain := string(serverName)
 		// query local devices
 		if serverName == a.ThisServer {
-			deviceKeys, err := a.DB.DeviceKeysForUser(ctx, userID, deviceIDs)
-			if err != nil {
-				res.Error = &api.KeyError{
-					Err: fmt.Sprintf("failed to query local device keys: %s", err),
-				}
-				return
-			}
-
-			// pull out display names after we have the keys so we handle wildcards correctly
-			var dids []string
-			for _, dk := range deviceKeys {
-				dids = append(dids, dk.DeviceID)
-			}
-			var queryRes userapi.QueryDeviceInfosResponse
-			err = a.UserAPI.QueryDeviceInfos(ctx, &userapi.QueryDeviceInfosRequest{
-				DeviceIDs: dids,
-			}, &queryRes)
-			if err != nil {
-				util.GetLogger(ctx).Warnf("Failed to QueryDeviceInfos for device IDs, display names will be missing")
-			}
-
-			if res.DeviceKeys[userID] == nil {
-				res.DeviceKeys[userID] = make(map[string]json.RawMessage)
-			}
-			for _, dk := range deviceKeys {
-				if len(dk.KeyJSON) == 0 {
-					continue // don't include blank keys
-				}
-				// inject display name if known (either locally or remotely)
-				displayName := dk.DisplayName
-				if queryRes.DeviceInfo[dk.DeviceID].DisplayName != "" {
-					displayName = queryRes.DeviceInfo[dk.DeviceID].DisplayName
-				}
-				dk.KeyJSON, _ = sjson.SetBytes(dk.KeyJSON, "unsigned", struct {
-					DisplayName string `json:"device_display_name,omitempty"`
-				}{displayName})
-				res.DeviceKeys[userID][dk.DeviceID] = dk.KeyJSON
-			}
+			res.DeviceKeys[userID] = localDeviceKeys[userID]
 		} else {
 			domainToDeviceKeys[domain] = make(map[string][]string)
 			domainToDeviceKeys[domain][userID] = append(domainToDeviceKeys[domain][userID], deviceIDs...)
@@ -326,7 +431,13 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 			if err = json.Unmarshal(key, &deviceKey); err != nil {
 				continue
 			}
+			if deviceKey.Signatures == nil {
+				deviceKey.Signatures = map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{}
+			}
 			for sourceUserID, forSourceUser := range sigMap {
+				if _, ok := deviceKey.Signatures[sourceUserID]; !ok {
+					deviceKey.Signatures[sourceUserID] = map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{}
+				}
 				for sourceKeyID, sourceSig := range forSourceUser {
 					deviceKey.Signatures[sourceUserID][sourceKeyID] = sourceSig
 				}
@@ -338,6 +449,90 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 	}
 }
 
+// QueryBulkDeviceKeys returns the device keys of many users with a single
+// database query. Unlike QueryKeys, remote servers are never asked, so the
+// keys of remote users are those that we have stored.
+func (a *KeyInternalAPI) QueryBulkDeviceKeys(ctx context.Context, req *api.QueryBulkDeviceKeysRequest, res *api.QueryBulkDeviceKeysResponse) {
+	userToDevices := make(map[string][]string, len(req.UserIDs))
+	for _, userID := range req.UserIDs {
+		userToDevices[userID] = nil
+	}
+	deviceKeys, err := a.storedDeviceKeys(ctx, userToDevices)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query device keys: %s", err),
+		}
+		return
+	}
+	res.DeviceKeys = deviceKeys
+}
+
+// storedDeviceKeys returns the stored keys of the given devices of each user,
+// or of all of their devices if none are given, keyed by user ID and device ID.
+// Every user has an entry, even if they have no devices. The display names of
+// local devices are added from the user API.
+func (a *KeyInternalAPI) storedDeviceKeys(ctx context.Context, userToDevices map[string][]string) (map[string]map[string]json.RawMessage, error) {
+	result := make(map[string]map[string]json.RawMessage, len(userToDevices))
+	if len(userToDevices) == 0 {
+		return result, nil
+	}
+	userIDs := make([]string, 0, len(userToDevices))
+	for userID := range userToDevices {
+		userIDs = append(userIDs, userID)
+		result[userID] = make(map[string]json.RawMessage)
+	}
+	userDeviceKeys, err := a.DB.DeviceKeysForUsers(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// pull out display names after we have the keys so we handle wildcards correctly
+	var dids []string
+	for userID, deviceKeys := range userDeviceKeys {
+		if _, serverName, err := gomatrixserverlib.SplitID('@', userID); err != nil || serverName != a.ThisServer {
+			continue
+		}
+		for _, dk := range deviceKeys {
+			dids = append(dids, dk.DeviceID)
+		}
+	}
+	var queryRes userapi.QueryDeviceInfosResponse
+	if len(dids) > 0 {
+		err = a.UserAPI.QueryDeviceInfos(ctx, &userapi.QueryDeviceInfosRequest{
+			DeviceIDs: dids,
+		}, &queryRes)
+		if err != nil {
+			util.GetLogger(ctx).Warnf("Failed to QueryDeviceInfos for device IDs, display names will be missing")
+		}
+	}
+
+	for userID, deviceKeys := range userDeviceKeys {
+		wanted := make(map[string]bool, len(userToDevices[userID]))
+		for _, deviceID := range userToDevices[userID] {
+			wanted[deviceID] = true
+		}
+		for _, dk := range deviceKeys {
+			if len(dk.KeyJSON) == 0 {
+				continue // don't include blank keys
+			}
+			// include the key if we want all keys (no device) or it was asked
+			if len(wanted) > 0 && !wanted[dk.DeviceID] {
+				continue
+			}
+			// inject display name if known (either locally or remotely)
+			displayName := dk.DisplayName
+			if info, ok := queryRes.DeviceInfo[dk.DeviceID]; ok && info.UserID == userID && info.DisplayName != "" {
+				displayName = info.DisplayName
+			}
+			dk.KeyJSON, _ = sjson.SetBytes(dk.KeyJSON, "unsigned", struct {
+				DisplayName string `json:"device_display_name,omitempty"`
+			}{displayName})
+			result[userID][dk.DeviceID] = dk.KeyJSON
+		}
+	}
+	return result, nil
+}
+
 func (a *KeyInternalAPI) remoteKeysFromDatabase(
 	ctx context.Context, res *api.QueryKeysResponse, domainToDeviceKeys map[string]map[string][]string,
 ) map[string]map[string][]string {
@@ -461,7 +656,8 @@ func (a *KeyInternalAPI) queryRemoteKeysOnServer(
 		}
 	}
 	for userID := range userIDsForAllDevices {
-		err := a.Updater.ManualUpdate(context.Background(), gomatrixserverlib.ServerName(serverName), userID)
+		// this waits for the update for as long as the caller is willing to wait for the server
+		err := a.Updater.ManualUpdate(fedCtx, gomatrixserverlib.ServerName(serverName), userID)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				logrus.ErrorKey: err,
@@ -488,11 +684,29 @@ func (a *KeyInternalAPI) queryRemoteKeysOnServer(
 			continue
 		}
 	}
+	// answer what we can from the cache and only ask the server about the rest
+	cached := &gomatrixserverlib.RespQueryKeys{}
+	for userID, deviceIDs := range devKeys {
+		if a.KeysCache.AddToResponse(cached, userID, deviceIDs) {
+			delete(devKeys, userID)
+		}
+	}
+	if len(cached.DeviceKeys) > 0 {
+		resultCh <- cached
+	}
 	if len(devKeys) == 0 {
 		return
 	}
+	var userIDsToCache []string
+	for userID, deviceIDs := range devKeys {
+		if len(deviceIDs) == 0 {
+			userIDsToCache = append(userIDsToCache, userID)
+		}
+	}
+	generation := a.KeysCache.Generation()
 	queryKeysResp, err := a.FedClient.QueryKeys(fedCtx, gomatrixserverlib.ServerName(serverName), devKeys)
 	if err == nil {
+		a.KeysCache.Store(generation, &queryKeysResp, userIDsToCache)
 		resultCh <- &queryKeysResp
 		return
 	}
@@ -558,19 +772,11 @@ func (a *KeyInternalAPI) uploadLocalDeviceKeys(ctx context.Context, req *api.Per
 			keysToStore = append(keysToStore, key.WithStreamID(0))
 			continue // deleted keys don't need sanity checking
 		}
-		gotUserID := gjson.GetBytes(key.KeyJSON, "user_id").Str
-		gotDeviceID := gjson.GetBytes(key.KeyJSON, "device_id").Str
-		if gotUserID == key.UserID && gotDeviceID == key.DeviceID {
-			keysToStore = append(keysToStore, key.WithStreamID(0))
+		if keyErr := verifyDeviceKeys(req, key); keyErr != nil {
+			res.KeyError(key.UserID, key.DeviceID, keyErr)
 			continue
 		}
-
-		res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
-			Err: fmt.Sprintf(
-				"user_id or device_id mismatch: users: %s - %s, devices: %s - %s",
-				gotUserID, key.UserID, gotDeviceID, key.DeviceID,
-			),
-		})
+		keysToStore = append(keysToStore, key.WithStreamID(0))
 	}
 
 	// get existing device keys so we can check for changes
@@ -593,6 +799,8 @@ func (a *KeyInternalAPI) uploadLocalDeviceKeys(ctx context.Context, req *api.Per
 	if req.OnlyDisplayNameUpdates {
 		// add the display name field from keysToStore into existingKeys
 		keysToStore = appendDisplayNames(existingKeys, keysToStore)
+	} else {
+		a.fillDisplayNames(ctx, existingKeys, keysToStore)
 	}
 	// store the device keys and emit changes
 	err := a.DB.StoreLocalDeviceKeys(ctx, keysToStore)
@@ -608,6 +816,58 @@ func (a *KeyInternalAPI) uploadLocalDeviceKeys(ctx context.Context, req *api.Per
 	}
 }
 
+// verifyDeviceKeys checks that the uploaded keys are for the device which is
+// uploading them, and that they are signed by the device's own ed25519 key, so
+// that nobody can upload keys that claim to be from another device.
+func verifyDeviceKeys(req *api.PerformUploadKeysRequest, key api.DeviceKeys) *api.KeyError {
+	if (req.UserID != "" && key.UserID != req.UserID) || (req.DeviceID != "" && key.DeviceID != req.DeviceID) {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("keys for %s device %s can't be uploaded by %s device %s", key.UserID, key.DeviceID, req.UserID, req.DeviceID),
+			IsInvalidParam: true,
+		}
+	}
+	gotUserID := gjson.GetBytes(key.KeyJSON, "user_id").Str
+	gotDeviceID := gjson.GetBytes(key.KeyJSON, "device_id").Str
+	if gotUserID != key.UserID || gotDeviceID != key.DeviceID {
+		return &api.KeyError{
+			Err: fmt.Sprintf(
+				"user_id or device_id mismatch: users: %s - %s, devices: %s - %s",
+				gotUserID, key.UserID, gotDeviceID, key.DeviceID,
+			),
+			IsInvalidParam: true,
+		}
+	}
+
+	var deviceKeys gomatrixserverlib.DeviceKeys
+	if err := json.Unmarshal(key.KeyJSON, &deviceKeys); err != nil {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("invalid device keys: %s", err),
+			IsInvalidParam: true,
+		}
+	}
+	keyID := gomatrixserverlib.KeyID("ed25519:" + key.DeviceID)
+	publicKey := deviceKeys.Keys[keyID]
+	if len(publicKey) != ed25519.PublicKeySize {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("device keys are missing the ed25519 key %s", keyID),
+			IsInvalidParam: true,
+		}
+	}
+	if _, ok := deviceKeys.Signatures[key.UserID][keyID]; !ok {
+		return &api.KeyError{
+			Err:                fmt.Sprintf("device keys aren't signed by %s", keyID),
+			IsInvalidSignature: true,
+		}
+	}
+	if err := gomatrixserverlib.VerifyJSON(key.UserID, keyID, ed25519.PublicKey(publicKey), key.KeyJSON); err != nil {
+		return &api.KeyError{
+			Err:                fmt.Sprintf("invalid signature by %s on the device keys: %s", keyID, err),
+			IsInvalidSignature: true,
+		}
+	}
+	return nil
+}
+
 func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
 	if req.UserID == "" {
 		res.Error = &api.KeyError{
@@ -650,6 +910,10 @@ func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perform
 				continue
 			}
 		}
+		if keyErr := a.checkOneTimeKeysLimit(ctx, key, existingKeys); keyErr != nil {
+			res.KeyError(req.UserID, req.DeviceID, keyErr)
+			continue
+		}
 		// store one-time keys
 		counts, err := a.DB.StoreOneTimeKeys(ctx, key)
 		if err != nil {
@@ -660,8 +924,59 @@ func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perform
 		}
 		// collect counts
 		res.OneTimeKeyCounts = append(res.OneTimeKeyCounts, *counts)
+		if err = a.Producer.ProduceOneTimeKeysCountUpdate(*counts); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to produce one-time key count update")
+		}
+	}
+
+}
+
+// checkOneTimeKeysLimit returns an error if storing the keys would leave
+// their device with more one-time keys than it is allowed. Keys which are
+// already stored don't count again.
+func (a *KeyInternalAPI) checkOneTimeKeysLimit(ctx context.Context, key api.OneTimeKeys, existingKeys map[string]json.RawMessage) *api.KeyError {
+	if a.MaxOneTimeKeysPerDevice <= 0 {
+		return nil
+	}
+	newKeys := 0
+	for keyIDWithAlgo := range key.KeyJSON {
+		if _, ok := existingKeys[keyIDWithAlgo]; !ok {
+			newKeys++
+		}
+	}
+	if newKeys == 0 {
+		return nil
+	}
+	counts, err := a.DB.OneTimeKeysCount(ctx, key.UserID, key.DeviceID)
+	if err != nil {
+		return &api.KeyError{
+			Err: fmt.Sprintf("%s device %s : failed to count one-time keys: %s", key.UserID, key.DeviceID, err.Error()),
+		}
+	}
+	stored := 0
+	for _, count := range counts.KeyCount {
+		stored += count
+	}
+	if stored+newKeys > a.MaxOneTimeKeysPerDevice {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("%s device %s : too many one-time keys, %d are stored and at most %d are allowed", key.UserID, key.DeviceID, stored, a.MaxOneTimeKeysPerDevice),
+			IsInvalidParam: true,
+		}
 	}
+	return nil
+}
 
+// emitOneTimeKeysCount tells the sync API about the one-time key counts of a
+// device whose keys were claimed, so that it can replenish them.
+func (a *KeyInternalAPI) emitOneTimeKeysCount(ctx context.Context, userID, deviceID string) {
+	counts, err := a.DB.OneTimeKeysCount(ctx, userID, deviceID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to count one-time keys")
+		return
+	}
+	if err = a.Producer.ProduceOneTimeKeysCountUpdate(*counts); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to produce one-time key count update")
+	}
 }
 
 func emitDeviceKeyChanges(producer KeyChangeProducer, existing, new []api.DeviceMessage) error {
@@ -672,7 +987,8 @@ func emitDeviceKeyChanges(producer KeyChangeProducer, existing, new []api.Device
 		for _, existingKey := range existing {
 			// Do not treat the absence of keys as equal, or else we will not emit key changes
 			// when users delete devices which never had a key to begin with as both KeyJSONs are nil.
-			if bytes.Equal(existingKey.KeyJSON, newKey.KeyJSON) && len(existingKey.KeyJSON) > 0 {
+			// Renaming a device is a change too, so that other users can see the new name.
+			if bytes.Equal(existingKey.KeyJSON, newKey.KeyJSON) && len(existingKey.KeyJSON) > 0 && existingKey.DisplayName == newKey.DisplayName {
 				exists = true
 				break
 			}
@@ -684,15 +1000,59 @@ func emitDeviceKeyChanges(producer KeyChangeProducer, existing, new []api.Device
 	return producer.ProduceKeyChanges(keysAdded)
 }
 
+// appendDisplayNames returns the existing keys with the display names of the
+// new keys. The existing keys aren't changed, so that they can be compared
+// with the result to see which devices were renamed.
 func appendDisplayNames(existing, new []api.DeviceMessage) []api.DeviceMessage {
+	result := make([]api.DeviceMessage, len(existing))
 	for i, existingDevice := range existing {
+		deviceKeys := *existingDevice.DeviceKeys
 		for _, newDevice := range new {
 			if existingDevice.DeviceID != newDevice.DeviceID {
 				continue
 			}
-			existingDevice.DisplayName = newDevice.DisplayName
-			existing[i] = existingDevice
+			deviceKeys.DisplayName = newDevice.DisplayName
+		}
+		existingDevice.DeviceKeys = &deviceKeys
+		result[i] = existingDevice
+	}
+	return result
+}
+
+// fillDisplayNames adds display names to the new keys of devices, as clients
+// never include them when uploading keys. Devices keep the name that they
+// already have, otherwise the name is taken from the user API, so that the
+// keys of every device have the name that the user gave it.
+func (a *KeyInternalAPI) fillDisplayNames(ctx context.Context, existing, new []api.DeviceMessage) {
+	var missing []string
+	for i := range new {
+		if new[i].DisplayName != "" || len(new[i].KeyJSON) == 0 {
+			continue
+		}
+		for _, existingDevice := range existing {
+			if existingDevice.UserID == new[i].UserID && existingDevice.DeviceID == new[i].DeviceID {
+				new[i].DisplayName = existingDevice.DisplayName
+			}
+		}
+		if new[i].DisplayName == "" {
+			missing = append(missing, new[i].DeviceID)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	var queryRes userapi.QueryDeviceInfosResponse
+	err := a.UserAPI.QueryDeviceInfos(ctx, &userapi.QueryDeviceInfosRequest{
+		DeviceIDs: missing,
+	}, &queryRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("Failed to QueryDeviceInfos for device IDs, display names will be missing")
+		return
+	}
+	for i := range new {
+		info, ok := queryRes.DeviceInfo[new[i].DeviceID]
+		if ok && info.UserID == new[i].UserID && new[i].DisplayName == "" {
+			new[i].DisplayName = info.DisplayName
 		}
 	}
-	return existing
 }
@@ -0,0 +1,549 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	fedsenderapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/dendrite/keyserver/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type mockClaimKeysClient struct {
+	fedsenderapi.FederationClient
+	mu       sync.Mutex
+	calls    map[gomatrixserverlib.ServerName]int
+	inFlight int
+	maxSeen  int
+}
+
+func (c *mockClaimKeysClient) ClaimKeys(ctx context.Context, s gomatrixserverlib.ServerName, oneTimeKeys map[string]map[string]string) (gomatrixserverlib.RespClaimKeys, error) {
+	c.mu.Lock()
+	c.calls[s]++
+	c.inFlight++
+	if c.inFlight > c.maxSeen {
+		c.maxSeen = c.inFlight
+	}
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+
+	res := gomatrixserverlib.RespClaimKeys{
+		OneTimeKeys: map[string]map[string]map[string]json.RawMessage{},
+	}
+	for userID, devices := range oneTimeKeys {
+		res.OneTimeKeys[userID] = map[string]map[string]json.RawMessage{}
+		for deviceID, algorithm := range devices {
+			res.OneTimeKeys[userID][deviceID] = map[string]json.RawMessage{
+				algorithm + ":AAAA": json.RawMessage(`"key"`),
+				// A key for an algorithm we didn't ask for, which should be ignored.
+				"other_algorithm:BBBB": json.RawMessage(`"key"`),
+			}
+		}
+	}
+	// A user we didn't ask about, which should be ignored.
+	res.OneTimeKeys["@mallory:elsewhere"] = map[string]map[string]json.RawMessage{
+		"DEVICE": {"signed_curve25519:AAAA": json.RawMessage(`"key"`)},
+	}
+	return res, nil
+}
+
+func TestPerformClaimKeysBatchesPerServer(t *testing.T) {
+	fedClient := &mockClaimKeysClient{
+		calls: map[gomatrixserverlib.ServerName]int{},
+	}
+	a := &KeyInternalAPI{
+		ThisServer: "localhost",
+		FedClient:  fedClient,
+	}
+	req := &api.PerformClaimKeysRequest{
+		OneTimeKeys: map[string]map[string]string{},
+		Timeout:     time.Second,
+	}
+	numServers := maxConcurrentClaimRequests * 2
+	for i := 0; i < numServers; i++ {
+		for j := 0; j < 3; j++ {
+			userID := fmt.Sprintf("@user%d:server%d", j, i)
+			req.OneTimeKeys[userID] = map[string]string{
+				"PHONE":  "signed_curve25519",
+				"LAPTOP": "signed_curve25519",
+			}
+		}
+	}
+	res := &api.PerformClaimKeysResponse{}
+	a.PerformClaimKeys(context.Background(), req, res)
+
+	if len(fedClient.calls) != numServers {
+		t.Errorf("got claims to %d servers, want %d", len(fedClient.calls), numServers)
+	}
+	for serverName, calls := range fedClient.calls {
+		if calls != 1 {
+			t.Errorf("got %d claims to %s, want 1", calls, serverName)
+		}
+	}
+	if fedClient.maxSeen > maxConcurrentClaimRequests {
+		t.Errorf("got %d concurrent claims, want at most %d", fedClient.maxSeen, maxConcurrentClaimRequests)
+	}
+	if len(res.OneTimeKeys) != numServers*3 {
+		t.Errorf("got keys for %d users, want %d", len(res.OneTimeKeys), numServers*3)
+	}
+	if _, ok := res.OneTimeKeys["@mallory:elsewhere"]; ok {
+		t.Errorf("got keys for a user which wasn't on the server they were claimed from")
+	}
+	for userID, devices := range res.OneTimeKeys {
+		if len(devices) != 2 {
+			t.Errorf("got keys for %d devices of %s, want 2", len(devices), userID)
+		}
+	}
+}
+
+func TestPerformClaimKeysAlgorithms(t *testing.T) {
+	fedClient := &mockClaimKeysClient{
+		calls: map[gomatrixserverlib.ServerName]int{},
+	}
+	a := &KeyInternalAPI{
+		ThisServer: "localhost",
+		FedClient:  fedClient,
+	}
+	req := &api.PerformClaimKeysRequest{
+		OneTimeKeys: map[string]map[string]string{
+			"@alice:remote": {
+				"PHONE":  "signed_curve25519",
+				"LAPTOP": "unknown_algorithm",
+				"TABLET": "",
+			},
+			"@bob:other": {
+				"PHONE": "unknown_algorithm",
+			},
+		},
+		Timeout: time.Second,
+	}
+	res := &api.PerformClaimKeysResponse{}
+	a.PerformClaimKeys(context.Background(), req, res)
+
+	if calls := fedClient.calls["other"]; calls != 0 {
+		t.Errorf("got %d claims to a server with no supported algorithms asked for, want 0", calls)
+	}
+	wantKeys := map[string]map[string]map[string]json.RawMessage{
+		"@alice:remote": {
+			"PHONE": {"signed_curve25519:AAAA": json.RawMessage(`"key"`)},
+		},
+	}
+	if !reflect.DeepEqual(res.OneTimeKeys, wantKeys) {
+		t.Errorf("got keys %v, want %v", res.OneTimeKeys, wantKeys)
+	}
+
+	tsts := []struct {
+		Name       string
+		ServerName string
+		Want       map[string]map[string]string
+	}{
+		{"remote", "remote", map[string]map[string]string{"@alice:remote": {"LAPTOP": "unknown_algorithm", "TABLET": ""}}},
+		{"other", "other", map[string]map[string]string{"@bob:other": {"PHONE": "unknown_algorithm"}}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			failure, ok := res.Failures[tst.ServerName].(map[string]interface{})
+			if !ok {
+				t.Fatalf("got failures %v, want a failure for %s", res.Failures, tst.ServerName)
+			}
+			if !reflect.DeepEqual(failure["devices"], tst.Want) {
+				t.Errorf("got failed devices %v, want %v", failure["devices"], tst.Want)
+			}
+		})
+	}
+}
+
+type mockOneTimeKeysCountDatabase struct {
+	storage.Database
+	counts map[string]int
+}
+
+func (d *mockOneTimeKeysCountDatabase) OneTimeKeysCount(ctx context.Context, userID, deviceID string) (*api.OneTimeKeysCount, error) {
+	return &api.OneTimeKeysCount{
+		UserID:   userID,
+		DeviceID: deviceID,
+		KeyCount: d.counts,
+	}, nil
+}
+
+func TestCheckOneTimeKeysLimit(t *testing.T) {
+	a := &KeyInternalAPI{
+		DB: &mockOneTimeKeysCountDatabase{
+			counts: map[string]int{"signed_curve25519": 90, "curve25519": 8},
+		},
+		MaxOneTimeKeysPerDevice: 100,
+	}
+	keys := func(keyIDs ...string) map[string]json.RawMessage {
+		res := make(map[string]json.RawMessage, len(keyIDs))
+		for _, keyID := range keyIDs {
+			res[keyID] = json.RawMessage(`{"key":"v1"}`)
+		}
+		return res
+	}
+
+	tsts := []struct {
+		Name     string
+		Max      int
+		KeyJSON  map[string]json.RawMessage
+		Existing map[string]json.RawMessage
+		WantErr  bool
+	}{
+		{"underLimit", 100, keys("signed_curve25519:A"), nil, false},
+		{"atLimit", 100, keys("signed_curve25519:A", "signed_curve25519:B"), nil, false},
+		{"overLimit", 100, keys("signed_curve25519:A", "signed_curve25519:B", "signed_curve25519:C"), nil, true},
+		{"existingKeysDontCount", 100, keys("signed_curve25519:A", "signed_curve25519:B", "signed_curve25519:C"), keys("signed_curve25519:C"), false},
+		{"noLimit", 0, keys("signed_curve25519:A", "signed_curve25519:B", "signed_curve25519:C"), nil, false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			a.MaxOneTimeKeysPerDevice = tst.Max
+			key := api.OneTimeKeys{
+				UserID:   "@alice:localhost",
+				DeviceID: "PHONE",
+				KeyJSON:  tst.KeyJSON,
+			}
+			keyErr := a.checkOneTimeKeysLimit(context.Background(), key, tst.Existing)
+			if (keyErr != nil) != tst.WantErr {
+				t.Errorf("checkOneTimeKeysLimit: got %v, want error=%v", keyErr, tst.WantErr)
+			}
+		})
+	}
+}
+
+type mockDeviceKeysDatabase struct {
+	storage.Database
+	deviceKeys map[string][]api.DeviceMessage
+}
+
+func (d *mockDeviceKeysDatabase) DeviceKeysForUsers(ctx context.Context, userIDs []string) (map[string][]api.DeviceMessage, error) {
+	res := make(map[string][]api.DeviceMessage)
+	for _, userID := range userIDs {
+		if deviceKeys, ok := d.deviceKeys[userID]; ok {
+			res[userID] = deviceKeys
+		}
+	}
+	return res, nil
+}
+
+type mockDeviceInfosUserAPI struct {
+	userapi.UserInternalAPI
+	res userapi.QueryDeviceInfosResponse
+}
+
+func (u *mockDeviceInfosUserAPI) QueryDeviceInfos(ctx context.Context, req *userapi.QueryDeviceInfosRequest, res *userapi.QueryDeviceInfosResponse) error {
+	*res = u.res
+	return nil
+}
+
+func TestQueryBulkDeviceKeys(t *testing.T) {
+	deviceKey := func(userID, deviceID, displayName string) api.DeviceMessage {
+		return api.DeviceMessage{
+			Type: api.TypeDeviceKeyUpdate,
+			DeviceKeys: &api.DeviceKeys{
+				UserID:      userID,
+				DeviceID:    deviceID,
+				DisplayName: displayName,
+				KeyJSON:     []byte(`{"key":"v1"}`),
+			},
+		}
+	}
+	userAPI := &mockDeviceInfosUserAPI{}
+	userAPI.res.DeviceInfo = map[string]struct {
+		DisplayName string
+		UserID      string
+	}{
+		"PHONE": {DisplayName: "Alice's phone", UserID: "@alice:localhost"},
+	}
+	a := &KeyInternalAPI{
+		ThisServer: "localhost",
+		DB: &mockDeviceKeysDatabase{
+			deviceKeys: map[string][]api.DeviceMessage{
+				"@alice:localhost": {deviceKey("@alice:localhost", "PHONE", "")},
+				"@bob:localhost":   {deviceKey("@bob:localhost", "PHONE", "Stored name")},
+				"@carol:remote":    {deviceKey("@carol:remote", "PHONE", "Carol's phone")},
+			},
+		},
+		UserAPI: userAPI,
+	}
+	res := &api.QueryBulkDeviceKeysResponse{}
+	a.QueryBulkDeviceKeys(context.Background(), &api.QueryBulkDeviceKeysRequest{
+		UserIDs: []string{"@alice:localhost", "@bob:localhost", "@carol:remote", "@dave:localhost"},
+	}, res)
+	if res.Error != nil {
+		t.Fatalf("QueryBulkDeviceKeys failed: %s", res.Error)
+	}
+
+	tsts := []struct {
+		UserID      string
+		DisplayName string
+	}{
+		{"@alice:localhost", "Alice's phone"},
+		// The device info of another user's device with the same ID isn't used.
+		{"@bob:localhost", "Stored name"},
+		{"@carol:remote", "Carol's phone"},
+	}
+	for _, tst := range tsts {
+		var got struct {
+			Unsigned struct {
+				DisplayName string `json:"device_display_name"`
+			} `json:"unsigned"`
+		}
+		if err := json.Unmarshal(res.DeviceKeys[tst.UserID]["PHONE"], &got); err != nil {
+			t.Errorf("%s: got key JSON %s, want a device key", tst.UserID, res.DeviceKeys[tst.UserID]["PHONE"])
+			continue
+		}
+		if got.Unsigned.DisplayName != tst.DisplayName {
+			t.Errorf("%s: got display name %q, want %q", tst.UserID, got.Unsigned.DisplayName, tst.DisplayName)
+		}
+	}
+	if devices, ok := res.DeviceKeys["@dave:localhost"]; !ok || len(devices) != 0 {
+		t.Errorf("got %v for a user without devices, want an empty entry", devices)
+	}
+}
+
+func TestVerifyDeviceKeys(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey failed: %s", err)
+	}
+	_, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey failed: %s", err)
+	}
+	deviceJSON := func(userID, deviceID string) []byte {
+		return []byte(fmt.Sprintf(
+			`{"user_id":%q,"device_id":%q,"algorithms":["m.olm.v1.curve25519-aes-sha2"],"keys":{"ed25519:PHONE":%q}}`,
+			userID, deviceID, gomatrixserverlib.Base64Bytes(publicKey).Encode(),
+		))
+	}
+	sign := func(keyJSON []byte, privateKey ed25519.PrivateKey) []byte {
+		signed, err := gomatrixserverlib.SignJSON("@alice:localhost", "ed25519:PHONE", privateKey, keyJSON)
+		if err != nil {
+			t.Fatalf("gomatrixserverlib.SignJSON failed: %s", err)
+		}
+		return signed
+	}
+	req := &api.PerformUploadKeysRequest{
+		UserID:   "@alice:localhost",
+		DeviceID: "PHONE",
+	}
+
+	tsts := []struct {
+		Name     string
+		DeviceID string
+		KeyJSON  []byte
+		WantErr  bool
+	}{
+		{"valid", "PHONE", sign(deviceJSON("@alice:localhost", "PHONE"), privateKey), false},
+		{"unsigned", "PHONE", deviceJSON("@alice:localhost", "PHONE"), true},
+		{"signedByOtherKey", "PHONE", sign(deviceJSON("@alice:localhost", "PHONE"), otherPrivateKey), true},
+		{"otherUserInJSON", "PHONE", sign(deviceJSON("@bob:localhost", "PHONE"), privateKey), true},
+		{"otherDeviceInJSON", "PHONE", sign(deviceJSON("@alice:localhost", "LAPTOP"), privateKey), true},
+		{"otherDeviceUploading", "LAPTOP", sign(deviceJSON("@alice:localhost", "LAPTOP"), privateKey), true},
+		{"missingKey", "PHONE", sign([]byte(`{"user_id":"@alice:localhost","device_id":"PHONE","keys":{}}`), privateKey), true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			key := api.DeviceKeys{
+				UserID:   "@alice:localhost",
+				DeviceID: tst.DeviceID,
+				KeyJSON:  tst.KeyJSON,
+			}
+			keyErr := verifyDeviceKeys(req, key)
+			if (keyErr != nil) != tst.WantErr {
+				t.Errorf("verifyDeviceKeys: got %v, want error=%v", keyErr, tst.WantErr)
+			}
+		})
+	}
+}
+
+type mockQueryKeysClient struct {
+	fedsenderapi.FederationClient
+}
+
+func (c *mockQueryKeysClient) QueryKeys(ctx context.Context, s gomatrixserverlib.ServerName, keys map[string][]string) (gomatrixserverlib.RespQueryKeys, error) {
+	if s == "slow" {
+		<-ctx.Done()
+		return gomatrixserverlib.RespQueryKeys{}, ctx.Err()
+	}
+	res := gomatrixserverlib.RespQueryKeys{
+		DeviceKeys: map[string]map[string]gomatrixserverlib.DeviceKeys{},
+	}
+	for userID, deviceIDs := range keys {
+		res.DeviceKeys[userID] = map[string]gomatrixserverlib.DeviceKeys{}
+		if len(deviceIDs) == 0 {
+			deviceIDs = []string{"PHONE"}
+		}
+		for _, deviceID := range deviceIDs {
+			var key gomatrixserverlib.DeviceKeys
+			key.UserID = userID
+			key.DeviceID = deviceID
+			res.DeviceKeys[userID][deviceID] = key
+		}
+	}
+	return res, nil
+}
+
+type mockQueryKeysDatabase struct {
+	storage.Database
+}
+
+func (d *mockQueryKeysDatabase) CrossSigningKeysForUser(ctx context.Context, userID string) (map[gomatrixserverlib.CrossSigningKeyPurpose]gomatrixserverlib.CrossSigningKey, error) {
+	return nil, nil
+}
+
+func (d *mockQueryKeysDatabase) CrossSigningSigsForTarget(ctx context.Context, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (types.CrossSigningSigMap, error) {
+	return nil, nil
+}
+
+func (d *mockQueryKeysDatabase) DeviceKeysForUser(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceMessage, error) {
+	return nil, nil
+}
+
+func TestQueryKeysTimeout(t *testing.T) {
+	a := &KeyInternalAPI{
+		ThisServer: "localhost",
+		DB:         &mockQueryKeysDatabase{},
+		FedClient:  &mockQueryKeysClient{},
+	}
+	// The updater isn't started, so waiting for it to update a device list
+	// never finishes.
+	db := &mockDeviceListUpdaterDatabase{
+		staleUsers: make(map[string]bool),
+	}
+	a.Updater = NewDeviceListUpdater(db, nil, &mockKeyChangeProducer{}, nil, testDeviceListUpdaterConfig(1))
+	res := &api.QueryKeysResponse{}
+	start := time.Now()
+	a.QueryKeys(context.Background(), &api.QueryKeysRequest{
+		UserToDevices: map[string][]string{
+			"@alice:fast": {"PHONE"},
+			"@bob:slow":   {"PHONE"},
+			"@carol:slow": {},
+		},
+		Timeout: 50 * time.Millisecond,
+	}, res)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("QueryKeys took %s, want it to give up on slow servers after the timeout", elapsed)
+	}
+	if _, ok := res.DeviceKeys["@alice:fast"]["PHONE"]; !ok {
+		t.Errorf("got device keys %v, want the keys from the server which answered", res.DeviceKeys)
+	}
+	if _, ok := res.Failures["slow"]; !ok {
+		t.Errorf("got failures %v, want the server which timed out", res.Failures)
+	}
+	if _, ok := res.Failures["fast"]; ok {
+		t.Errorf("got failures %v, want no failure for the server which answered", res.Failures)
+	}
+}
+
+func TestDeviceRenameEmitsKeyChange(t *testing.T) {
+	existing := []api.DeviceMessage{
+		{
+			Type: api.TypeDeviceKeyUpdate,
+			DeviceKeys: &api.DeviceKeys{
+				UserID:      "@alice:localhost",
+				DeviceID:    "PHONE",
+				DisplayName: "Old name",
+				KeyJSON:     []byte(`{"key":"v1"}`),
+			},
+		},
+	}
+	renamed := appendDisplayNames(existing, []api.DeviceMessage{
+		{
+			DeviceKeys: &api.DeviceKeys{
+				UserID:      "@alice:localhost",
+				DeviceID:    "PHONE",
+				DisplayName: "New name",
+			},
+		},
+	})
+	if existing[0].DisplayName != "Old name" {
+		t.Fatalf("appendDisplayNames changed the existing keys: got %q", existing[0].DisplayName)
+	}
+	if renamed[0].DisplayName != "New name" || string(renamed[0].KeyJSON) != `{"key":"v1"}` {
+		t.Fatalf("appendDisplayNames: got %+v, want the existing keys with the new name", renamed[0].DeviceKeys)
+	}
+
+	producer := &mockKeyChangeProducer{}
+	if err := emitDeviceKeyChanges(producer, existing, renamed); err != nil {
+		t.Fatalf("emitDeviceKeyChanges failed: %s", err)
+	}
+	if len(producer.events) != 1 || producer.events[0].DisplayName != "New name" {
+		t.Errorf("emitDeviceKeyChanges: got %+v, want a key change with the new name", producer.events)
+	}
+
+	producer = &mockKeyChangeProducer{}
+	if err := emitDeviceKeyChanges(producer, existing, existing); err != nil {
+		t.Fatalf("emitDeviceKeyChanges failed: %s", err)
+	}
+	if len(producer.events) != 0 {
+		t.Errorf("emitDeviceKeyChanges: got %d key changes, want none for unchanged keys", len(producer.events))
+	}
+}
+
+func TestFillDisplayNames(t *testing.T) {
+	userAPI := &mockDeviceInfosUserAPI{}
+	userAPI.res.DeviceInfo = map[string]struct {
+		DisplayName string
+		UserID      string
+	}{
+		"LAPTOP": {DisplayName: "Alice's laptop", UserID: "@alice:localhost"},
+		"TABLET": {DisplayName: "Bob's tablet", UserID: "@bob:localhost"},
+	}
+	a := &KeyInternalAPI{
+		ThisServer: "localhost",
+		UserAPI:    userAPI,
+	}
+	deviceKey := func(deviceID, displayName string) api.DeviceMessage {
+		return api.DeviceMessage{
+			Type: api.TypeDeviceKeyUpdate,
+			DeviceKeys: &api.DeviceKeys{
+				UserID:      "@alice:localhost",
+				DeviceID:    deviceID,
+				DisplayName: displayName,
+				KeyJSON:     []byte(`{"key":"v2"}`),
+			},
+		}
+	}
+	existing := []api.DeviceMessage{deviceKey("PHONE", "Alice's phone")}
+	keys := []api.DeviceMessage{
+		deviceKey("PHONE", ""),
+		deviceKey("LAPTOP", ""),
+		deviceKey("TABLET", ""),
+		deviceKey("WATCH", "Given name"),
+	}
+	a.fillDisplayNames(context.Background(), existing, keys)
+
+	want := []string{"Alice's phone", "Alice's laptop", "", "Given name"}
+	for i := range keys {
+		if keys[i].DisplayName != want[i] {
+			t.Errorf("device %s: got display name %q, want %q", keys[i].DeviceID, keys[i].DisplayName, want[i])
+		}
+	}
+}
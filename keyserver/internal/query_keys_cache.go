@@ -0,0 +1,159 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// QueryKeysCache keeps the results of recent /keys/query requests to remote
+// servers in memory for a short time, so that clients in a large federated
+// room which all query the same users don't make us ask each server for the
+// same keys over and over. Entries are invalidated when we hear about
+// changes to the user's devices or cross-signing keys.
+//
+// Only the keys of users who were queried for all of their devices are
+// cached, as those are the only results which can answer any later query.
+// The keys are held in the device keys cache, whose size is configured with
+// the other caches. A nil *QueryKeysCache caches nothing.
+type QueryKeysCache struct {
+	ttl   time.Duration
+	cache caching.DeviceKeysCache
+	now   func() time.Time
+
+	// generation is incremented by every invalidation, so that keys which
+	// were requested before an invalidation aren't added to the cache after
+	// it, which would keep the old keys until they expire.
+	generation      uint64
+	generationMutex sync.Mutex
+}
+
+// NewQueryKeysCache returns a cache which holds the keys of users in the
+// given cache for the given amount of time.
+func NewQueryKeysCache(cache caching.DeviceKeysCache, ttl time.Duration) *QueryKeysCache {
+	return &QueryKeysCache{
+		ttl:   ttl,
+		cache: cache,
+		now:   time.Now,
+	}
+}
+
+// Generation returns the current generation of the cache, which must be
+// passed to Store with the results of a query made after calling it.
+func (c *QueryKeysCache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.generationMutex.Lock()
+	defer c.generationMutex.Unlock()
+	return c.generation
+}
+
+// AddToResponse adds the cached keys of the user to the response. The device
+// IDs are those which were asked for, and all of the user's devices are added
+// if there are none. It returns false if the keys aren't in the cache, or if
+// any of the devices asked for aren't known.
+func (c *QueryKeysCache) AddToResponse(res *gomatrixserverlib.RespQueryKeys, userID string, deviceIDs []string) bool {
+	if c == nil {
+		return false
+	}
+	entry, ok := c.cache.GetDeviceKeys(userID)
+	if !ok {
+		return false
+	}
+	if !c.now().Before(entry.Expires) {
+		c.cache.InvalidateDeviceKeys(userID)
+		return false
+	}
+	deviceKeys := make(map[string]gomatrixserverlib.DeviceKeys, len(entry.DeviceKeys))
+	if len(deviceIDs) == 0 {
+		for deviceID, keys := range entry.DeviceKeys {
+			deviceKeys[deviceID] = keys
+		}
+	} else {
+		for _, deviceID := range deviceIDs {
+			keys, ok := entry.DeviceKeys[deviceID]
+			if !ok {
+				return false
+			}
+			deviceKeys[deviceID] = keys
+		}
+	}
+
+	if res.DeviceKeys == nil {
+		res.DeviceKeys = make(map[string]map[string]gomatrixserverlib.DeviceKeys)
+	}
+	res.DeviceKeys[userID] = deviceKeys
+	if entry.MasterKey != nil {
+		if res.MasterKeys == nil {
+			res.MasterKeys = make(map[string]gomatrixserverlib.CrossSigningKey)
+		}
+		res.MasterKeys[userID] = *entry.MasterKey
+	}
+	if entry.SelfSigningKey != nil {
+		if res.SelfSigningKeys == nil {
+			res.SelfSigningKeys = make(map[string]gomatrixserverlib.CrossSigningKey)
+		}
+		res.SelfSigningKeys[userID] = *entry.SelfSigningKey
+	}
+	return true
+}
+
+// Store caches the keys of the given users from the response to a query for
+// all of their devices. Nothing is cached if the cache has been invalidated
+// since the generation was taken.
+func (c *QueryKeysCache) Store(generation uint64, res *gomatrixserverlib.RespQueryKeys, userIDs []string) {
+	if c == nil {
+		return
+	}
+	c.generationMutex.Lock()
+	defer c.generationMutex.Unlock()
+	if c.generation != generation {
+		return
+	}
+	expires := c.now().Add(c.ttl)
+	for _, userID := range userIDs {
+		entry := &caching.UserDeviceKeys{
+			DeviceKeys: make(map[string]gomatrixserverlib.DeviceKeys, len(res.DeviceKeys[userID])),
+			Expires:    expires,
+		}
+		for deviceID, keys := range res.DeviceKeys[userID] {
+			entry.DeviceKeys[deviceID] = keys
+		}
+		if key, ok := res.MasterKeys[userID]; ok {
+			entry.MasterKey = &key
+		}
+		if key, ok := res.SelfSigningKeys[userID]; ok {
+			entry.SelfSigningKey = &key
+		}
+		c.cache.StoreDeviceKeys(userID, entry)
+	}
+}
+
+// Invalidate removes the user's keys from the cache, so that they are
+// requested from their server again the next time that they are queried.
+func (c *QueryKeysCache) Invalidate(userID string) {
+	if c == nil {
+		return
+	}
+	c.generationMutex.Lock()
+	defer c.generationMutex.Unlock()
+	c.generation++
+	c.cache.InvalidateDeviceKeys(userID)
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestQueryKeysCache(t *testing.T) {
+	caches, err := caching.NewInMemoryLRUCache(&config.Cache{}, false)
+	if err != nil {
+		t.Fatalf("NewInMemoryLRUCache failed: %s", err)
+	}
+	c := NewQueryKeysCache(caches, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	fetched := &gomatrixserverlib.RespQueryKeys{
+		DeviceKeys: map[string]map[string]gomatrixserverlib.DeviceKeys{
+			"@alice:remote": {"PHONE": {}, "LAPTOP": {}},
+			"@bob:remote":   {"PHONE": {}},
+		},
+		MasterKeys: map[string]gomatrixserverlib.CrossSigningKey{
+			"@alice:remote": {UserID: "@alice:remote"},
+		},
+	}
+	c.Store(c.Generation(), fetched, []string{"@alice:remote"})
+
+	tsts := []struct {
+		Name      string
+		UserID    string
+		DeviceIDs []string
+		Want      int
+	}{
+		{"allDevices", "@alice:remote", nil, 2},
+		{"someDevices", "@alice:remote", []string{"PHONE"}, 1},
+		{"unknownDevice", "@alice:remote", []string{"PHONE", "TABLET"}, -1},
+		{"notQueriedForAllDevices", "@bob:remote", nil, -1},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			var res gomatrixserverlib.RespQueryKeys
+			ok := c.AddToResponse(&res, tst.UserID, tst.DeviceIDs)
+			if ok != (tst.Want >= 0) {
+				t.Fatalf("AddToResponse: got %v, want %v", ok, tst.Want >= 0)
+			}
+			if ok && len(res.DeviceKeys[tst.UserID]) != tst.Want {
+				t.Errorf("got %d devices, want %d", len(res.DeviceKeys[tst.UserID]), tst.Want)
+			}
+		})
+	}
+
+	var res gomatrixserverlib.RespQueryKeys
+	if !c.AddToResponse(&res, "@alice:remote", nil) || res.MasterKeys["@alice:remote"].UserID != "@alice:remote" {
+		t.Errorf("got master keys %+v, want the cached master key", res.MasterKeys)
+	}
+
+	// Keys which were requested before an invalidation aren't cached.
+	generation := c.Generation()
+	c.Invalidate("@alice:remote")
+	if c.AddToResponse(&res, "@alice:remote", nil) {
+		t.Errorf("AddToResponse: got true after Invalidate, want false")
+	}
+	c.Store(generation, fetched, []string{"@alice:remote"})
+	if c.AddToResponse(&res, "@alice:remote", nil) {
+		t.Errorf("AddToResponse: got true after storing an old generation, want false")
+	}
+
+	c.Store(c.Generation(), fetched, []string{"@alice:remote"})
+	now = now.Add(time.Minute)
+	if c.AddToResponse(&res, "@alice:remote", nil) {
+		t.Errorf("AddToResponse: got true after the TTL, want false")
+	}
+
+	var nilCache *QueryKeysCache
+	nilCache.Store(nilCache.Generation(), fetched, []string{"@alice:remote"})
+	if nilCache.AddToResponse(&res, "@alice:remote", nil) {
+		t.Errorf("AddToResponse: got true for a nil cache, want false")
+	}
+}
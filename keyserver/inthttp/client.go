@@ -33,8 +33,11 @@ const (
 	PerformDeleteKeysPath             = "/keyserver/performDeleteKeys"
 	PerformUploadDeviceKeysPath       = "/keyserver/performUploadDeviceKeys"
 	PerformUploadDeviceSignaturesPath = "/keyserver/performUploadDeviceSignatures"
+	PerformDeviceListResyncPath       = "/keyserver/performDeviceListResync"
 	QueryKeysPath                     = "/keyserver/queryKeys"
+	QueryBulkDeviceKeysPath           = "/keyserver/queryBulkDeviceKeys"
 	QueryKeyChangesPath               = "/keyserver/queryKeyChanges"
+	QueryLatestKeyChangePath          = "/keyserver/queryLatestKeyChange"
 	QueryOneTimeKeysPath              = "/keyserver/queryOneTimeKeys"
 	QueryDeviceMessagesPath           = "/keyserver/queryDeviceMessages"
 	QuerySignaturesPath               = "/keyserver/querySignatures"
@@ -180,6 +183,23 @@ func (h *httpKeyInternalAPI) QueryDeviceMessages(
 	}
 }
 
+func (h *httpKeyInternalAPI) QueryBulkDeviceKeys(
+	ctx context.Context,
+	request *api.QueryBulkDeviceKeysRequest,
+	response *api.QueryBulkDeviceKeysResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryBulkDeviceKeys")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryBulkDeviceKeysPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.KeyError{
+			Err: err.Error(),
+		}
+	}
+}
+
 func (h *httpKeyInternalAPI) QueryKeyChanges(
 	ctx context.Context,
 	request *api.QueryKeyChangesRequest,
@@ -197,6 +217,23 @@ func (h *httpKeyInternalAPI) QueryKeyChanges(
 	}
 }
 
+func (h *httpKeyInternalAPI) QueryLatestKeyChange(
+	ctx context.Context,
+	request *api.QueryLatestKeyChangeRequest,
+	response *api.QueryLatestKeyChangeResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryLatestKeyChange")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryLatestKeyChangePath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.KeyError{
+			Err: err.Error(),
+		}
+	}
+}
+
 func (h *httpKeyInternalAPI) PerformUploadDeviceKeys(
 	ctx context.Context,
 	request *api.PerformUploadDeviceKeysRequest,
@@ -247,3 +284,20 @@ func (h *httpKeyInternalAPI) QuerySignatures(
 		}
 	}
 }
+
+func (h *httpKeyInternalAPI) PerformDeviceListResync(
+	ctx context.Context,
+	request *api.PerformDeviceListResyncRequest,
+	response *api.PerformDeviceListResyncResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeviceListResync")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformDeviceListResyncPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.KeyError{
+			Err: err.Error(),
+		}
+	}
+}
@@ -124,6 +124,17 @@ func AddRoutes(internalAPIMux *mux.Router, s api.KeyInternalAPI) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(QueryBulkDeviceKeysPath,
+		httputil.MakeInternalAPI("queryBulkDeviceKeys", func(req *http.Request) util.JSONResponse {
+			request := api.QueryBulkDeviceKeysRequest{}
+			response := api.QueryBulkDeviceKeysResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			s.QueryBulkDeviceKeys(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(QueryKeyChangesPath,
 		httputil.MakeInternalAPI("queryKeyChanges", func(req *http.Request) util.JSONResponse {
 			request := api.QueryKeyChangesRequest{}
@@ -135,6 +146,17 @@ func AddRoutes(internalAPIMux *mux.Router, s api.KeyInternalAPI) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(QueryLatestKeyChangePath,
+		httputil.MakeInternalAPI("queryLatestKeyChange", func(req *http.Request) util.JSONResponse {
+			request := api.QueryLatestKeyChangeRequest{}
+			response := api.QueryLatestKeyChangeResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			s.QueryLatestKeyChange(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(QuerySignaturesPath,
 		httputil.MakeInternalAPI("querySignatures", func(req *http.Request) util.JSONResponse {
 			request := api.QuerySignaturesRequest{}
@@ -146,4 +168,15 @@ func AddRoutes(internalAPIMux *mux.Router, s api.KeyInternalAPI) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(PerformDeviceListResyncPath,
+		httputil.MakeInternalAPI("performDeviceListResync", func(req *http.Request) util.JSONResponse {
+			request := api.PerformDeviceListResyncRequest{}
+			response := api.PerformDeviceListResyncResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			s.PerformDeviceListResync(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
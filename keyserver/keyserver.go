@@ -15,6 +15,8 @@
 package keyserver
 
 import (
+	"time"
+
 	"github.com/gorilla/mux"
 	fedsenderapi "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/keyserver/api"
@@ -28,6 +30,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// queryKeysCacheTTL is how long the keys of remote users are cached for.
+const queryKeysCacheTTL = time.Minute
+
 // AddInternalRoutes registers HTTP handlers for the internal API. Invokes functions
 // on the given input API.
 func AddInternalRoutes(router *mux.Router, intAPI api.KeyInternalAPI) {
@@ -55,9 +60,17 @@ func NewInternalAPI(
 		ThisServer: cfg.Matrix.ServerName,
 		FedClient:  fedClient,
 		Producer:   keyChangeProducer,
+
+		MaxOneTimeKeysPerDevice: cfg.MaxOneTimeKeysPerDevice,
 	}
-	updater := internal.NewDeviceListUpdater(db, ap, keyChangeProducer, fedClient, 8) // 8 workers TODO: configurable
+	ap.KeysCache = internal.NewQueryKeysCache(base.Caches, queryKeysCacheTTL)
+	updater := internal.NewDeviceListUpdater(db, ap, keyChangeProducer, fedClient, &cfg.DeviceListUpdater)
 	ap.Updater = updater
+	cleanup := &internal.KeyCleanup{
+		Cfg: &cfg.Cleanup,
+		DB:  db,
+	}
+	go cleanup.Start()
 	go func() {
 		if err := updater.Start(); err != nil {
 			logrus.WithError(err).Panicf("failed to start device list updater")
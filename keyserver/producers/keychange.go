@@ -106,3 +106,36 @@ func (p *KeyChange) ProduceSigningKeyUpdate(key eduapi.CrossSigningKeyUpdate) er
 	}).Tracef("Produced to cross-signing update topic '%s'", p.Topic)
 	return nil
 }
+
+// ProduceOneTimeKeysCountUpdate tells the sync API that one-time keys of a
+// local device were uploaded or claimed. Unlike key changes, these aren't
+// stored as key changes, as only the device itself needs to know about them.
+func (p *KeyChange) ProduceOneTimeKeysCountUpdate(counts api.OneTimeKeysCount) error {
+	output := &api.DeviceMessage{
+		Type:             api.TypeOneTimeKeysCountUpdate,
+		OneTimeKeysCount: &counts,
+	}
+
+	value, err := json.Marshal(output)
+	if err != nil {
+		return err
+	}
+
+	m := &nats.Msg{
+		Subject: p.Topic,
+		Header:  nats.Header{},
+	}
+	m.Header.Set(jetstream.UserID, counts.UserID)
+	m.Data = value
+
+	_, err = p.JetStream.PublishMsg(m)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"user_id":   counts.UserID,
+		"device_id": counts.DeviceID,
+	}).Tracef("Produced to one-time key count update topic '%s'", p.Topic)
+	return nil
+}
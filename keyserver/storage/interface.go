@@ -17,6 +17,7 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/keyserver/types"
@@ -59,6 +60,10 @@ type Database interface {
 	// cross-signing signatures relating to that device.
 	DeleteDeviceKeys(ctx context.Context, userID string, deviceIDs []gomatrixserverlib.KeyID) error
 
+	// DeviceKeysForUsers returns the keys of all of the devices of the given users in one go, keyed by user ID.
+	// Deleted devices aren't returned.
+	DeviceKeysForUsers(ctx context.Context, userIDs []string) (map[string][]api.DeviceMessage, error)
+
 	// ClaimKeys based on the 3-uple of user_id, device_id and algorithm name. Returns the keys claimed. Returns no error if a key
 	// cannot be claimed or if none exist for this (user, device, algorithm), instead it is omitted from the returned slice.
 	ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[string]map[string]string) ([]api.OneTimeKeys, error)
@@ -72,6 +77,17 @@ type Database interface {
 	// Returns the offset of the latest key change.
 	KeyChanges(ctx context.Context, fromOffset, toOffset int64) (userIDs []string, latestOffset int64, err error)
 
+	// LatestKeyChange returns the offset of the latest key change, which is never lower than any offset previously
+	// returned by StoreKeyChange, even once key changes have been pruned.
+	LatestKeyChange(ctx context.Context) (int64, error)
+
+	// PruneKeyChanges deletes the key changes from before the given time. Returns how many were deleted.
+	PruneKeyChanges(ctx context.Context, before time.Time) (int64, error)
+
+	// PruneDeletedDevices deletes the device keys of devices which were deleted before the given time, and the
+	// one-time keys of devices which have been deleted since before then. Returns how many of each were deleted.
+	PruneDeletedDevices(ctx context.Context, before time.Time) (deviceKeys, oneTimeKeys int64, err error)
+
 	// StaleDeviceLists returns a list of user IDs ending with the domains provided who have stale device lists.
 	// If no domains are given, all user IDs with stale device lists are returned.
 	StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
@@ -0,0 +1,54 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/pressly/goose"
+)
+
+func LoadFromGooseAddKeyChangesTimestamp() {
+	goose.AddMigration(UpAddKeyChangesTimestamp, DownAddKeyChangesTimestamp)
+}
+
+func LoadAddKeyChangesTimestamp(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddKeyChangesTimestamp, DownAddKeyChangesTimestamp)
+}
+
+func UpAddKeyChangesTimestamp(tx *sql.Tx) error {
+	// Existing key changes are treated as if they happened now, so that none
+	// of them are pruned until they are older than the retention period.
+	_, err := tx.Exec("ALTER TABLE keyserver_key_changes ADD COLUMN IF NOT EXISTS ts_changed_secs BIGINT NOT NULL DEFAULT 0;")
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	_, err = tx.Exec("UPDATE keyserver_key_changes SET ts_changed_secs = $1 WHERE ts_changed_secs = 0;", time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddKeyChangesTimestamp(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE keyserver_key_changes DROP COLUMN ts_changed_secs;")
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -48,7 +48,7 @@ const upsertDeviceKeysSQL = "" +
 	"INSERT INTO keyserver_device_keys (user_id, device_id, ts_added_secs, key_json, stream_id, display_name)" +
 	" VALUES ($1, $2, $3, $4, $5, $6)" +
 	" ON CONFLICT ON CONSTRAINT keyserver_device_keys_unique" +
-	" DO UPDATE SET key_json = $4, stream_id = $5, display_name = $6"
+	" DO UPDATE SET ts_added_secs = $3, key_json = $4, stream_id = $5, display_name = $6"
 
 const selectDeviceKeysSQL = "" +
 	"SELECT key_json, stream_id, display_name FROM keyserver_device_keys WHERE user_id=$1 AND device_id=$2"
@@ -56,6 +56,9 @@ const selectDeviceKeysSQL = "" +
 const selectBatchDeviceKeysSQL = "" +
 	"SELECT device_id, key_json, stream_id, display_name FROM keyserver_device_keys WHERE user_id=$1 AND key_json <> ''"
 
+const selectBatchDeviceKeysForUsersSQL = "" +
+	"SELECT user_id, device_id, key_json, stream_id, display_name FROM keyserver_device_keys WHERE user_id = ANY($1) AND key_json <> ''"
+
 const selectMaxStreamForUserSQL = "" +
 	"SELECT MAX(stream_id) FROM keyserver_device_keys WHERE user_id=$1"
 
@@ -68,15 +71,23 @@ const deleteDeviceKeysSQL = "" +
 const deleteAllDeviceKeysSQL = "" +
 	"DELETE FROM keyserver_device_keys WHERE user_id=$1"
 
+// Deleted devices have an empty key_json. The record with the latest stream ID of each user is kept, so that
+// the stream IDs of the user's devices carry on from it.
+const deleteDeletedDeviceKeysSQL = "" +
+	"DELETE FROM keyserver_device_keys WHERE key_json = '' AND ts_added_secs < $1" +
+	" AND stream_id < (SELECT MAX(d.stream_id) FROM keyserver_device_keys AS d WHERE d.user_id = keyserver_device_keys.user_id)"
+
 type deviceKeysStatements struct {
-	db                         *sql.DB
-	upsertDeviceKeysStmt       *sql.Stmt
-	selectDeviceKeysStmt       *sql.Stmt
-	selectBatchDeviceKeysStmt  *sql.Stmt
-	selectMaxStreamForUserStmt *sql.Stmt
-	countStreamIDsForUserStmt  *sql.Stmt
-	deleteDeviceKeysStmt       *sql.Stmt
-	deleteAllDeviceKeysStmt    *sql.Stmt
+	db                                *sql.DB
+	upsertDeviceKeysStmt              *sql.Stmt
+	selectDeviceKeysStmt              *sql.Stmt
+	selectBatchDeviceKeysStmt         *sql.Stmt
+	selectBatchDeviceKeysForUsersStmt *sql.Stmt
+	selectMaxStreamForUserStmt        *sql.Stmt
+	countStreamIDsForUserStmt         *sql.Stmt
+	deleteDeviceKeysStmt              *sql.Stmt
+	deleteAllDeviceKeysStmt           *sql.Stmt
+	deleteDeletedDeviceKeysStmt       *sql.Stmt
 }
 
 func NewPostgresDeviceKeysTable(db *sql.DB) (tables.DeviceKeys, error) {
@@ -96,6 +107,9 @@ func NewPostgresDeviceKeysTable(db *sql.DB) (tables.DeviceKeys, error) {
 	if s.selectBatchDeviceKeysStmt, err = db.Prepare(selectBatchDeviceKeysSQL); err != nil {
 		return nil, err
 	}
+	if s.selectBatchDeviceKeysForUsersStmt, err = db.Prepare(selectBatchDeviceKeysForUsersSQL); err != nil {
+		return nil, err
+	}
 	if s.selectMaxStreamForUserStmt, err = db.Prepare(selectMaxStreamForUserSQL); err != nil {
 		return nil, err
 	}
@@ -108,6 +122,9 @@ func NewPostgresDeviceKeysTable(db *sql.DB) (tables.DeviceKeys, error) {
 	if s.deleteAllDeviceKeysStmt, err = db.Prepare(deleteAllDeviceKeysSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteDeletedDeviceKeysStmt, err = db.Prepare(deleteDeletedDeviceKeysSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -180,6 +197,14 @@ func (s *deviceKeysStatements) DeleteAllDeviceKeys(ctx context.Context, txn *sql
 	return err
 }
 
+func (s *deviceKeysStatements) DeleteDeletedDeviceKeys(ctx context.Context, txn *sql.Tx, before int64) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteDeletedDeviceKeysStmt).ExecContext(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (s *deviceKeysStatements) SelectBatchDeviceKeys(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceMessage, error) {
 	rows, err := s.selectBatchDeviceKeysStmt.QueryContext(ctx, userID)
 	if err != nil {
@@ -215,3 +240,29 @@ func (s *deviceKeysStatements) SelectBatchDeviceKeys(ctx context.Context, userID
 	}
 	return result, rows.Err()
 }
+
+func (s *deviceKeysStatements) SelectBatchDeviceKeysForUsers(ctx context.Context, userIDs []string) (map[string][]api.DeviceMessage, error) {
+	rows, err := s.selectBatchDeviceKeysForUsersStmt.QueryContext(ctx, pq.StringArray(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectBatchDeviceKeysForUsersStmt: rows.close() failed")
+	result := make(map[string][]api.DeviceMessage, len(userIDs))
+	for rows.Next() {
+		dk := api.DeviceMessage{
+			Type:       api.TypeDeviceKeyUpdate,
+			DeviceKeys: &api.DeviceKeys{},
+		}
+		var keyJSON string
+		var displayName sql.NullString
+		if err := rows.Scan(&dk.UserID, &dk.DeviceID, &keyJSON, &dk.StreamID, &displayName); err != nil {
+			return nil, err
+		}
+		dk.KeyJSON = []byte(keyJSON)
+		if displayName.Valid {
+			dk.DisplayName = displayName.String
+		}
+		result[dk.UserID] = append(result[dk.UserID], dk)
+	}
+	return result, rows.Err()
+}
@@ -17,8 +17,10 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/keyserver/storage/tables"
 )
 
@@ -28,6 +30,8 @@ CREATE SEQUENCE IF NOT EXISTS keyserver_key_changes_seq;
 CREATE TABLE IF NOT EXISTS keyserver_key_changes (
 	change_id BIGINT PRIMARY KEY DEFAULT nextval('keyserver_key_changes_seq'),
     user_id TEXT NOT NULL,
+    -- When the keys last changed, so that old changes can be pruned
+    ts_changed_secs BIGINT NOT NULL DEFAULT 0,
     CONSTRAINT keyserver_key_changes_unique_per_user UNIQUE (user_id)
 );
 `
@@ -35,19 +39,28 @@ CREATE TABLE IF NOT EXISTS keyserver_key_changes (
 // Replace based on user ID. We don't care how many times the user's keys have changed, only that they
 // have changed, hence we can just keep bumping the change ID for this user.
 const upsertKeyChangeSQL = "" +
-	"INSERT INTO keyserver_key_changes (user_id)" +
-	" VALUES ($1)" +
+	"INSERT INTO keyserver_key_changes (user_id, ts_changed_secs)" +
+	" VALUES ($1, $2)" +
 	" ON CONFLICT ON CONSTRAINT keyserver_key_changes_unique_per_user" +
-	" DO UPDATE SET change_id = nextval('keyserver_key_changes_seq')" +
+	" DO UPDATE SET change_id = nextval('keyserver_key_changes_seq'), ts_changed_secs = $2" +
 	" RETURNING change_id"
 
 const selectKeyChangesSQL = "" +
 	"SELECT user_id, change_id FROM keyserver_key_changes WHERE change_id > $1 AND change_id <= $2"
 
+const deleteKeyChangesBeforeSQL = "" +
+	"DELETE FROM keyserver_key_changes WHERE ts_changed_secs < $1"
+
+// The change IDs come from the sequence, so the latest one is kept even once it's been deleted.
+const selectLatestChangeIDSQL = "" +
+	"SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM keyserver_key_changes_seq"
+
 type keyChangesStatements struct {
-	db                   *sql.DB
-	upsertKeyChangeStmt  *sql.Stmt
-	selectKeyChangesStmt *sql.Stmt
+	db                         *sql.DB
+	upsertKeyChangeStmt        *sql.Stmt
+	selectKeyChangesStmt       *sql.Stmt
+	deleteKeyChangesBeforeStmt *sql.Stmt
+	selectLatestChangeIDStmt   *sql.Stmt
 }
 
 func NewPostgresKeyChangesTable(db *sql.DB) (tables.KeyChanges, error) {
@@ -65,11 +78,30 @@ func (s *keyChangesStatements) Prepare() (err error) {
 	if s.selectKeyChangesStmt, err = s.db.Prepare(selectKeyChangesSQL); err != nil {
 		return err
 	}
+	if s.deleteKeyChangesBeforeStmt, err = s.db.Prepare(deleteKeyChangesBeforeSQL); err != nil {
+		return err
+	}
+	if s.selectLatestChangeIDStmt, err = s.db.Prepare(selectLatestChangeIDSQL); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (s *keyChangesStatements) InsertKeyChange(ctx context.Context, userID string) (changeID int64, err error) {
-	err = s.upsertKeyChangeStmt.QueryRowContext(ctx, userID).Scan(&changeID)
+	err = s.upsertKeyChangeStmt.QueryRowContext(ctx, userID, time.Now().Unix()).Scan(&changeID)
+	return
+}
+
+func (s *keyChangesStatements) DeleteKeyChangesBefore(ctx context.Context, txn *sql.Tx, before int64) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteKeyChangesBeforeStmt).ExecContext(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *keyChangesStatements) SelectLatestChangeID(ctx context.Context) (changeID int64, err error) {
+	err = s.selectLatestChangeIDStmt.QueryRowContext(ctx).Scan(&changeID)
 	return
 }
 
@@ -56,16 +56,25 @@ const selectKeysCountSQL = "" +
 const deleteOneTimeKeySQL = "" +
 	"DELETE FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 AND key_id = $4"
 
+// The keys of a device are kept while it has device keys, and for as long after it was deleted as the keys
+// themselves are kept.
+const deleteOneTimeKeysOfDeletedDevicesSQL = "" +
+	"DELETE FROM keyserver_one_time_keys WHERE ts_added_secs < $1" +
+	" AND NOT EXISTS (SELECT 1 FROM keyserver_device_keys AS d" +
+	" WHERE d.user_id = keyserver_one_time_keys.user_id AND d.device_id = keyserver_one_time_keys.device_id" +
+	" AND (d.key_json <> '' OR d.ts_added_secs >= $1))"
+
 const selectKeyByAlgorithmSQL = "" +
 	"SELECT key_id, key_json FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 LIMIT 1"
 
 type oneTimeKeysStatements struct {
-	db                       *sql.DB
-	upsertKeysStmt           *sql.Stmt
-	selectKeysStmt           *sql.Stmt
-	selectKeysCountStmt      *sql.Stmt
-	selectKeyByAlgorithmStmt *sql.Stmt
-	deleteOneTimeKeyStmt     *sql.Stmt
+	db                                    *sql.DB
+	upsertKeysStmt                        *sql.Stmt
+	selectKeysStmt                        *sql.Stmt
+	selectKeysCountStmt                   *sql.Stmt
+	selectKeyByAlgorithmStmt              *sql.Stmt
+	deleteOneTimeKeyStmt                  *sql.Stmt
+	deleteOneTimeKeysOfDeletedDevicesStmt *sql.Stmt
 }
 
 func NewPostgresOneTimeKeysTable(db *sql.DB) (tables.OneTimeKeys, error) {
@@ -91,6 +100,9 @@ func NewPostgresOneTimeKeysTable(db *sql.DB) (tables.OneTimeKeys, error) {
 	if s.deleteOneTimeKeyStmt, err = db.Prepare(deleteOneTimeKeySQL); err != nil {
 		return nil, err
 	}
+	if s.deleteOneTimeKeysOfDeletedDevicesStmt, err = db.Prepare(deleteOneTimeKeysOfDeletedDevicesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -187,3 +199,11 @@ func (s *oneTimeKeysStatements) SelectAndDeleteOneTimeKey(
 		algorithm + ":" + keyID: json.RawMessage(keyJSON),
 	}, err
 }
+
+func (s *oneTimeKeysStatements) DeleteOneTimeKeysOfDeletedDevices(ctx context.Context, txn *sql.Tx, before int64) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteOneTimeKeysOfDeletedDevicesStmt).ExecContext(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
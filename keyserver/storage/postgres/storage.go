@@ -28,11 +28,11 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*shared.Database, error)
 	if err != nil {
 		return nil, err
 	}
-	otk, err := NewPostgresOneTimeKeysTable(db)
+	dk, err := NewPostgresDeviceKeysTable(db)
 	if err != nil {
 		return nil, err
 	}
-	dk, err := NewPostgresDeviceKeysTable(db)
+	otk, err := NewPostgresOneTimeKeysTable(db)
 	if err != nil {
 		return nil, err
 	}
@@ -54,6 +54,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*shared.Database, error)
 	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadRefactorKeyChanges(m)
+	deltas.LoadAddKeyChangesTimestamp(m)
 	if err = m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
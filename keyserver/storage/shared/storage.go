@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/keyserver/api"
@@ -112,6 +113,10 @@ func (d *Database) DeviceKeysForUser(ctx context.Context, userID string, deviceI
 	return d.DeviceKeysTable.SelectBatchDeviceKeys(ctx, userID, deviceIDs)
 }
 
+func (d *Database) DeviceKeysForUsers(ctx context.Context, userIDs []string) (map[string][]api.DeviceMessage, error) {
+	return d.DeviceKeysTable.SelectBatchDeviceKeysForUsers(ctx, userIDs)
+}
+
 func (d *Database) ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[string]map[string]string) ([]api.OneTimeKeys, error) {
 	var result []api.OneTimeKeys
 	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
@@ -147,6 +152,30 @@ func (d *Database) KeyChanges(ctx context.Context, fromOffset, toOffset int64) (
 	return d.KeyChangesTable.SelectKeyChanges(ctx, fromOffset, toOffset)
 }
 
+func (d *Database) LatestKeyChange(ctx context.Context) (int64, error) {
+	return d.KeyChangesTable.SelectLatestChangeID(ctx)
+}
+
+func (d *Database) PruneKeyChanges(ctx context.Context, before time.Time) (count int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		count, err = d.KeyChangesTable.DeleteKeyChangesBefore(ctx, txn, before.Unix())
+		return err
+	})
+	return
+}
+
+func (d *Database) PruneDeletedDevices(ctx context.Context, before time.Time) (deviceKeys, oneTimeKeys int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		oneTimeKeys, err = d.OneTimeKeysTable.DeleteOneTimeKeysOfDeletedDevices(ctx, txn, before.Unix())
+		if err != nil {
+			return err
+		}
+		deviceKeys, err = d.DeviceKeysTable.DeleteDeletedDeviceKeys(ctx, txn, before.Unix())
+		return err
+	})
+	return
+}
+
 // StaleDeviceLists returns a list of user IDs ending with the domains provided who have stale device lists.
 // If no domains are given, all user IDs with stale device lists are returned.
 func (d *Database) StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
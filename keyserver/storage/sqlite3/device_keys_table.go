@@ -44,7 +44,7 @@ const upsertDeviceKeysSQL = "" +
 	"INSERT INTO keyserver_device_keys (user_id, device_id, ts_added_secs, key_json, stream_id, display_name)" +
 	" VALUES ($1, $2, $3, $4, $5, $6)" +
 	" ON CONFLICT (user_id, device_id)" +
-	" DO UPDATE SET key_json = $4, stream_id = $5, display_name = $6"
+	" DO UPDATE SET ts_added_secs = $3, key_json = $4, stream_id = $5, display_name = $6"
 
 const selectDeviceKeysSQL = "" +
 	"SELECT key_json, stream_id, display_name FROM keyserver_device_keys WHERE user_id=$1 AND device_id=$2"
@@ -52,6 +52,9 @@ const selectDeviceKeysSQL = "" +
 const selectBatchDeviceKeysSQL = "" +
 	"SELECT device_id, key_json, stream_id, display_name FROM keyserver_device_keys WHERE user_id=$1 AND key_json <> ''"
 
+const selectBatchDeviceKeysForUsersSQL = "" +
+	"SELECT user_id, device_id, key_json, stream_id, display_name FROM keyserver_device_keys WHERE user_id IN ($1) AND key_json <> ''"
+
 const selectMaxStreamForUserSQL = "" +
 	"SELECT MAX(stream_id) FROM keyserver_device_keys WHERE user_id=$1"
 
@@ -64,14 +67,21 @@ const deleteDeviceKeysSQL = "" +
 const deleteAllDeviceKeysSQL = "" +
 	"DELETE FROM keyserver_device_keys WHERE user_id=$1"
 
+// Deleted devices have an empty key_json. The record with the latest stream ID of each user is kept, so that
+// the stream IDs of the user's devices carry on from it.
+const deleteDeletedDeviceKeysSQL = "" +
+	"DELETE FROM keyserver_device_keys WHERE key_json = '' AND ts_added_secs < $1" +
+	" AND stream_id < (SELECT MAX(d.stream_id) FROM keyserver_device_keys AS d WHERE d.user_id = keyserver_device_keys.user_id)"
+
 type deviceKeysStatements struct {
-	db                         *sql.DB
-	upsertDeviceKeysStmt       *sql.Stmt
-	selectDeviceKeysStmt       *sql.Stmt
-	selectBatchDeviceKeysStmt  *sql.Stmt
-	selectMaxStreamForUserStmt *sql.Stmt
-	deleteDeviceKeysStmt       *sql.Stmt
-	deleteAllDeviceKeysStmt    *sql.Stmt
+	db                          *sql.DB
+	upsertDeviceKeysStmt        *sql.Stmt
+	selectDeviceKeysStmt        *sql.Stmt
+	selectBatchDeviceKeysStmt   *sql.Stmt
+	selectMaxStreamForUserStmt  *sql.Stmt
+	deleteDeviceKeysStmt        *sql.Stmt
+	deleteAllDeviceKeysStmt     *sql.Stmt
+	deleteDeletedDeviceKeysStmt *sql.Stmt
 }
 
 func NewSqliteDeviceKeysTable(db *sql.DB) (tables.DeviceKeys, error) {
@@ -100,6 +110,9 @@ func NewSqliteDeviceKeysTable(db *sql.DB) (tables.DeviceKeys, error) {
 	if s.deleteAllDeviceKeysStmt, err = db.Prepare(deleteAllDeviceKeysSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteDeletedDeviceKeysStmt, err = db.Prepare(deleteDeletedDeviceKeysSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -113,6 +126,14 @@ func (s *deviceKeysStatements) DeleteAllDeviceKeys(ctx context.Context, txn *sql
 	return err
 }
 
+func (s *deviceKeysStatements) DeleteDeletedDeviceKeys(ctx context.Context, txn *sql.Tx, before int64) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteDeletedDeviceKeysStmt).ExecContext(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (s *deviceKeysStatements) SelectBatchDeviceKeys(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceMessage, error) {
 	deviceIDMap := make(map[string]bool)
 	for _, d := range deviceIDs {
@@ -214,3 +235,37 @@ func (s *deviceKeysStatements) InsertDeviceKeys(ctx context.Context, txn *sql.Tx
 	}
 	return nil
 }
+
+func (s *deviceKeysStatements) SelectBatchDeviceKeysForUsers(ctx context.Context, userIDs []string) (map[string][]api.DeviceMessage, error) {
+	if len(userIDs) == 0 {
+		return map[string][]api.DeviceMessage{}, nil
+	}
+	iUserIDs := make([]interface{}, len(userIDs))
+	for i := range userIDs {
+		iUserIDs[i] = userIDs[i]
+	}
+	query := strings.Replace(selectBatchDeviceKeysForUsersSQL, "($1)", sqlutil.QueryVariadic(len(userIDs)), 1)
+	rows, err := s.db.QueryContext(ctx, query, iUserIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectBatchDeviceKeysForUsersStmt: rows.close() failed")
+	result := make(map[string][]api.DeviceMessage, len(userIDs))
+	for rows.Next() {
+		dk := api.DeviceMessage{
+			Type:       api.TypeDeviceKeyUpdate,
+			DeviceKeys: &api.DeviceKeys{},
+		}
+		var keyJSON string
+		var displayName sql.NullString
+		if err := rows.Scan(&dk.UserID, &dk.DeviceID, &keyJSON, &dk.StreamID, &displayName); err != nil {
+			return nil, err
+		}
+		dk.KeyJSON = []byte(keyJSON)
+		if displayName.Valid {
+			dk.DisplayName = displayName.String
+		}
+		result[dk.UserID] = append(result[dk.UserID], dk)
+	}
+	return result, rows.Err()
+}
@@ -2,12 +2,15 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/keyserver/types"
@@ -62,6 +65,28 @@ func TestKeyChanges(t *testing.T) {
 	}
 }
 
+func TestLatestKeyChange(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	latest, err := db.LatestKeyChange(ctx)
+	MustNotError(t, err)
+	if latest != 0 {
+		t.Fatalf("LatestKeyChange: got %d, want 0 before any key changes", latest)
+	}
+	_, err = db.StoreKeyChange(ctx, "@alice:localhost")
+	MustNotError(t, err)
+	_, err = db.StoreKeyChange(ctx, "@bob:localhost")
+	MustNotError(t, err)
+	// Replacing a user's change still moves the latest change on.
+	want, err := db.StoreKeyChange(ctx, "@alice:localhost")
+	MustNotError(t, err)
+	latest, err = db.LatestKeyChange(ctx)
+	MustNotError(t, err)
+	if latest != want {
+		t.Fatalf("LatestKeyChange: got %d, want %d", latest, want)
+	}
+}
+
 func TestKeyChangesNoDupes(t *testing.T) {
 	db, clean := MustCreateDatabase(t)
 	defer clean()
@@ -190,3 +215,163 @@ func TestDeviceKeysStreamIDGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestPruneKeyChanges(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	_, err := db.StoreKeyChange(ctx, "@alice:localhost")
+	MustNotError(t, err)
+	latest, err := db.StoreKeyChange(ctx, "@bob:localhost")
+	MustNotError(t, err)
+
+	count, err := db.PruneKeyChanges(ctx, time.Now().Add(-time.Hour))
+	MustNotError(t, err)
+	if count != 0 {
+		t.Fatalf("PruneKeyChanges: got %d deleted, want 0 for recent changes", count)
+	}
+	count, err = db.PruneKeyChanges(ctx, time.Now().Add(time.Second))
+	MustNotError(t, err)
+	if count != 2 {
+		t.Fatalf("PruneKeyChanges: got %d deleted, want 2", count)
+	}
+	userIDs, _, err := db.KeyChanges(ctx, 0, types.OffsetNewest)
+	MustNotError(t, err)
+	if len(userIDs) != 0 {
+		t.Fatalf("KeyChanges: got %v, want no changes after pruning", userIDs)
+	}
+
+	// The latest key change is still known once it's been pruned.
+	latestChange, err := db.LatestKeyChange(ctx)
+	MustNotError(t, err)
+	if latestChange != latest {
+		t.Fatalf("LatestKeyChange: got %d, want %d", latestChange, latest)
+	}
+
+	// New changes carry on from the stream position of the pruned ones.
+	next, err := db.StoreKeyChange(ctx, "@alice:localhost")
+	MustNotError(t, err)
+	if next <= latest {
+		t.Fatalf("StoreKeyChange: got %d, want a position after %d", next, latest)
+	}
+}
+
+func TestPruneDeletedDevices(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:TestPruneDeletedDevices"
+	device := func(deviceID, keyJSON string) api.DeviceMessage {
+		return api.DeviceMessage{
+			Type: api.TypeDeviceKeyUpdate,
+			DeviceKeys: &api.DeviceKeys{
+				DeviceID: deviceID,
+				UserID:   alice,
+				KeyJSON:  []byte(keyJSON),
+			},
+		}
+	}
+	MustNotError(t, db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		device("LIVE", `{"key":"v1"}`),
+		device("DELETED", `{"key":"v1"}`),
+		device("LATEST", `{"key":"v1"}`),
+	}))
+	for _, deviceID := range []string{"LIVE", "DELETED", "LATEST"} {
+		_, err := db.StoreOneTimeKeys(ctx, api.OneTimeKeys{
+			UserID:   alice,
+			DeviceID: deviceID,
+			KeyJSON: map[string]json.RawMessage{
+				"signed_curve25519:AAAA": json.RawMessage(`{"key":"v1"}`),
+			},
+		})
+		MustNotError(t, err)
+	}
+	// Delete two of the devices. The last one has the latest stream ID of the
+	// user, so it has to be kept.
+	MustNotError(t, db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		device("DELETED", ""),
+		device("LATEST", ""),
+	}))
+
+	deviceKeys, oneTimeKeys, err := db.PruneDeletedDevices(ctx, time.Now().Add(-time.Hour))
+	MustNotError(t, err)
+	if deviceKeys != 0 || oneTimeKeys != 0 {
+		t.Fatalf("PruneDeletedDevices: got %d device keys and %d one-time keys deleted, want none for recently deleted devices", deviceKeys, oneTimeKeys)
+	}
+	deviceKeys, oneTimeKeys, err = db.PruneDeletedDevices(ctx, time.Now().Add(time.Second))
+	MustNotError(t, err)
+	if deviceKeys != 1 {
+		t.Errorf("PruneDeletedDevices: got %d device keys deleted, want 1", deviceKeys)
+	}
+	if oneTimeKeys != 2 {
+		t.Errorf("PruneDeletedDevices: got %d one-time keys deleted, want 2", oneTimeKeys)
+	}
+
+	tsts := []struct {
+		DeviceID string
+		Want     int
+	}{
+		{"LIVE", 1},
+		{"DELETED", 0},
+		{"LATEST", 0},
+	}
+	for _, tst := range tsts {
+		counts, err := db.OneTimeKeysCount(ctx, alice, tst.DeviceID)
+		MustNotError(t, err)
+		if got := counts.KeyCount["signed_curve25519"]; got != tst.Want {
+			t.Errorf("OneTimeKeysCount(%s): got %d, want %d", tst.DeviceID, got, tst.Want)
+		}
+	}
+	// The stream IDs of new devices carry on from the deleted devices.
+	msgs := []api.DeviceMessage{device("NEW", `{"key":"v1"}`)}
+	MustNotError(t, db.StoreLocalDeviceKeys(ctx, msgs))
+	if msgs[0].StreamID != 6 {
+		t.Errorf("StoreLocalDeviceKeys: got StreamID=%d, want 6", msgs[0].StreamID)
+	}
+}
+
+func TestDeviceKeysForUsers(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:TestDeviceKeysForUsers"
+	bob := "@bob:TestDeviceKeysForUsers"
+	charlie := "@charlie:TestDeviceKeysForUsers"
+	device := func(userID, deviceID, keyJSON string) api.DeviceMessage {
+		return api.DeviceMessage{
+			Type: api.TypeDeviceKeyUpdate,
+			DeviceKeys: &api.DeviceKeys{
+				DeviceID: deviceID,
+				UserID:   userID,
+				KeyJSON:  []byte(keyJSON),
+			},
+		}
+	}
+	MustNotError(t, db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		device(alice, "PHONE", `{"key":"v1"}`),
+		device(alice, "LAPTOP", `{"key":"v1"}`),
+		device(alice, "DELETED", ""),
+		device(bob, "PHONE", `{"key":"v1"}`),
+		device(charlie, "PHONE", `{"key":"v1"}`),
+	}))
+
+	got, err := db.DeviceKeysForUsers(ctx, []string{alice, bob, "@nobody:TestDeviceKeysForUsers"})
+	MustNotError(t, err)
+	want := map[string][]string{
+		alice: {"LAPTOP", "PHONE"},
+		bob:   {"PHONE"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("DeviceKeysForUsers: got %d users, want %d", len(got), len(want))
+	}
+	for userID, wantDeviceIDs := range want {
+		var deviceIDs []string
+		for _, dk := range got[userID] {
+			if dk.UserID != userID {
+				t.Errorf("DeviceKeysForUsers: got user %s in the keys of %s", dk.UserID, userID)
+			}
+			deviceIDs = append(deviceIDs, dk.DeviceID)
+		}
+		sort.Strings(deviceIDs)
+		if !reflect.DeepEqual(deviceIDs, wantDeviceIDs) {
+			t.Errorf("DeviceKeysForUsers(%s): got devices %v, want %v", userID, deviceIDs, wantDeviceIDs)
+		}
+	}
+}
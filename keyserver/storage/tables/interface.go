@@ -31,6 +31,9 @@ type OneTimeKeys interface {
 	// SelectAndDeleteOneTimeKey selects a single one time key matching the user/device/algorithm specified and returns the algo:key_id => JSON.
 	// Returns an empty map if the key does not exist.
 	SelectAndDeleteOneTimeKey(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+	// DeleteOneTimeKeysOfDeletedDevices deletes the one-time keys added before the given time in seconds which belong
+	// to devices that have no device keys, or that were deleted before that time. Returns how many were deleted.
+	DeleteOneTimeKeysOfDeletedDevices(ctx context.Context, txn *sql.Tx, before int64) (int64, error)
 }
 
 type DeviceKeys interface {
@@ -39,8 +42,13 @@ type DeviceKeys interface {
 	SelectMaxStreamIDForUser(ctx context.Context, txn *sql.Tx, userID string) (streamID int32, err error)
 	CountStreamIDsForUser(ctx context.Context, userID string, streamIDs []int64) (int, error)
 	SelectBatchDeviceKeys(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceMessage, error)
+	// SelectBatchDeviceKeysForUsers returns the keys of all of the devices of the given users, keyed by user ID.
+	SelectBatchDeviceKeysForUsers(ctx context.Context, userIDs []string) (map[string][]api.DeviceMessage, error)
 	DeleteDeviceKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
 	DeleteAllDeviceKeys(ctx context.Context, txn *sql.Tx, userID string) error
+	// DeleteDeletedDeviceKeys deletes the records of devices which were deleted before the given time in seconds,
+	// apart from the one with the latest stream ID for each user. Returns how many were deleted.
+	DeleteDeletedDeviceKeys(ctx context.Context, txn *sql.Tx, before int64) (int64, error)
 }
 
 type KeyChanges interface {
@@ -48,6 +56,11 @@ type KeyChanges interface {
 	// SelectKeyChanges returns the set (de-duplicated) of users who have changed their keys between the two offsets.
 	// Results are exclusive of fromOffset and inclusive of toOffset. A toOffset of types.OffsetNewest means no upper offset.
 	SelectKeyChanges(ctx context.Context, fromOffset, toOffset int64) (userIDs []string, latestOffset int64, err error)
+	// DeleteKeyChangesBefore deletes the key changes from before the given time in seconds, returning how many were deleted.
+	DeleteKeyChangesBefore(ctx context.Context, txn *sql.Tx, before int64) (int64, error)
+	// SelectLatestChangeID returns the latest change ID which was handed out, even if the change has since been
+	// replaced or deleted, or 0 if there have been no changes.
+	SelectLatestChangeID(ctx context.Context) (int64, error)
 
 	Prepare() error
 }
@@ -16,8 +16,11 @@ package mediaapi
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/takeout"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -27,9 +30,11 @@ import (
 // AddPublicRoutes sets up and registers HTTP handlers for the MediaAPI component.
 func AddPublicRoutes(
 	router *mux.Router,
+	dendriteAdminRouter *mux.Router,
 	cfg *config.MediaAPI,
-	rateLimit *config.RateLimiting,
+	rateLimits *httputil.RateLimits,
 	userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 	client *gomatrixserverlib.Client,
 ) {
 	mediaDB, err := storage.Open(&cfg.Database)
@@ -37,7 +42,10 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	exporter := takeout.NewExporter(cfg, mediaDB, userAPI, rsAPI)
+	exporter.Start()
+
 	routing.Setup(
-		router, cfg, rateLimit, mediaDB, userAPI, client,
+		router, dendriteAdminRouter, cfg, rateLimits, mediaDB, userAPI, client, exporter,
 	)
 }
@@ -122,6 +122,21 @@ func Download(
 		return
 	}
 
+	// quarantined media isn't served, nor fetched from remote servers
+	quarantine, err := db.GetQuarantine(req.Context(), mediaID, origin)
+	if err != nil {
+		dReq.Logger.WithError(err).Error("db.GetQuarantine failed")
+		dReq.jsonErrorResponse(w, jsonerror.InternalServerError())
+		return
+	}
+	if quarantine != nil {
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		})
+		return
+	}
+
 	metadata, err := dReq.doDownload(
 		req.Context(), w, cfg, db, client,
 		activeRemoteRequests, activeThumbnailGeneration,
@@ -0,0 +1,81 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type quarantineResponse struct {
+	Quarantined   bool         `json:"quarantined"`
+	QuarantinedBy string       `json:"quarantined_by,omitempty"`
+	QuarantinedTS types.UnixMs `json:"quarantined_ts,omitempty"`
+}
+
+// AdminQuarantineMedia implements /_dendrite/admin/v1/media/{serverName}/{mediaID}/quarantine.
+// POST blocks the media from being downloaded or thumbnailed through this server,
+// DELETE lifts the block again and GET returns whether the media is blocked.
+// The media itself is left in place, so that lifting the block restores it.
+func AdminQuarantineMedia(req *http.Request, db storage.Database, origin gomatrixserverlib.ServerName, mediaID types.MediaID) util.JSONResponse {
+	if !mediaIDRegex.MatchString(string(mediaID)) || origin == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid server name or media ID"),
+		}
+	}
+	logger := util.GetLogger(req.Context()).WithField("origin", origin).WithField("media_id", mediaID)
+	switch req.Method {
+	case http.MethodPost:
+		if err := db.QuarantineMedia(req.Context(), &types.Quarantine{
+			MediaID:              mediaID,
+			Origin:               origin,
+			QuarantinedBy:        httputil.AdminFromContext(req.Context()),
+			QuarantinedTimestamp: types.UnixMs(time.Now().UnixNano() / 1000000),
+		}); err != nil {
+			logger.WithError(err).Error("db.QuarantineMedia failed")
+			return jsonerror.InternalServerError()
+		}
+		logger.Info("Media quarantined")
+	case http.MethodDelete:
+		if err := db.UnquarantineMedia(req.Context(), mediaID, origin); err != nil {
+			logger.WithError(err).Error("db.UnquarantineMedia failed")
+			return jsonerror.InternalServerError()
+		}
+		logger.Info("Media quarantine lifted")
+	}
+	quarantine, err := db.GetQuarantine(req.Context(), mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("db.GetQuarantine failed")
+		return jsonerror.InternalServerError()
+	}
+	res := quarantineResponse{}
+	if quarantine != nil {
+		res.Quarantined = true
+		res.QuarantinedBy = quarantine.QuarantinedBy
+		res.QuarantinedTS = quarantine.QuarantinedTimestamp
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
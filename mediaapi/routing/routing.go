@@ -22,6 +22,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/takeout"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -45,16 +46,17 @@ type configResponse struct {
 // nolint: gocyclo
 func Setup(
 	publicAPIMux *mux.Router,
+	dendriteAdminRouter *mux.Router,
 	cfg *config.MediaAPI,
-	rateLimit *config.RateLimiting,
+	rateLimits *httputil.RateLimits,
 	db storage.Database,
 	userAPI userapi.UserInternalAPI,
 	client *gomatrixserverlib.Client,
+	exporter *takeout.Exporter,
 ) {
-	rateLimits := httputil.NewRateLimits(rateLimit)
-
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
 	v1mux := publicAPIMux.PathPrefix("/v1").Subrouter()
+	unstableMux := publicAPIMux.PathPrefix("/unstable").Subrouter()
 
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
@@ -63,7 +65,7 @@ func Setup(
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
 		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req); r != nil {
+			if r := rateLimits.Limit(req, dev, httputil.RateLimitGroupMedia); r != nil {
 				return *r
 			}
 			return Upload(req, cfg, dev, db, activeThumbnailGeneration)
@@ -71,7 +73,7 @@ func Setup(
 	)
 
 	configHandler := httputil.MakeAuthAPI("config", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-		if r := rateLimits.Limit(req); r != nil {
+		if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMedia); r != nil {
 			return *r
 		}
 		return util.JSONResponse{
@@ -97,6 +99,56 @@ func Setup(
 	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
 		makeDownloadAPI("thumbnail", cfg, rateLimits, db, client, activeRemoteRequests, activeThumbnailGeneration),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	unstableMux.Handle("/takeout",
+		httputil.MakeAuthAPI("takeout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device, httputil.RateLimitGroupMedia); r != nil {
+				return *r
+			}
+			if req.Method == http.MethodPost {
+				return RequestTakeout(req, exporter, device.UserID)
+			}
+			return GetTakeout(req, db, device.UserID)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/takeout/download/{token}",
+		httputil.MakeHTMLAPI("takeout_download", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupMedia); r != nil {
+				return r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				resErr := util.ErrorResponse(err)
+				return &resErr
+			}
+			return DownloadTakeout(w, req, db, exporter, vars["token"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/v1/users/{userID}/takeout",
+		httputil.MakeAdminAPI("admin_takeout", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			if resErr := localUserID(cfg, vars["userID"]); resErr != nil {
+				return *resErr
+			}
+			if req.Method == http.MethodPost {
+				return RequestTakeout(req, exporter, vars["userID"])
+			}
+			return GetTakeout(req, db, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	dendriteAdminRouter.Handle("/admin/v1/media/{serverName}/{mediaId}/quarantine",
+		httputil.MakeAdminAPI("admin_quarantine_media", userAPI, &cfg.Matrix.AdminAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminQuarantineMedia(req, db, gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]))
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
 }
 
 func makeDownloadAPI(
@@ -124,7 +176,7 @@ func makeDownloadAPI(
 		w.Header().Set("Content-Type", "application/json")
 
 		// Ratelimit requests
-		if r := rateLimits.Limit(req); r != nil {
+		if r := rateLimits.Limit(req, nil, httputil.RateLimitGroupMedia); r != nil {
 			if err := json.NewEncoder(w).Encode(r); err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
@@ -0,0 +1,149 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/takeout"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// takeoutDownloadPath is where archives of users' data are downloaded from,
+// followed by the download token.
+const takeoutDownloadPath = "/_matrix/media/unstable/takeout/download/"
+
+type takeoutResponse struct {
+	Status      types.TakeoutStatus `json:"status"`
+	CreatedTS   types.UnixMs        `json:"created_ts"`
+	CompletedTS types.UnixMs        `json:"completed_ts,omitempty"`
+	Size        types.FileSizeBytes `json:"size,omitempty"`
+	// Only given once the archive can be downloaded. Anyone with the path
+	// can download the archive, so it must be kept secret.
+	DownloadPath string `json:"download_path,omitempty"`
+}
+
+func newTakeoutResponse(t *types.Takeout) takeoutResponse {
+	res := takeoutResponse{
+		Status:      t.Status,
+		CreatedTS:   t.CreationTimestamp,
+		CompletedTS: t.CompletionTimestamp,
+		Size:        t.FileSizeBytes,
+	}
+	if t.Status == types.TakeoutComplete {
+		res.DownloadPath = takeoutDownloadPath + t.DownloadToken
+	}
+	return res
+}
+
+// RequestTakeout implements POST /_matrix/media/unstable/takeout and
+// POST /_dendrite/admin/v1/users/{userID}/takeout, starting an export of
+// all of the user's data in the background.
+func RequestTakeout(req *http.Request, exporter *takeout.Exporter, userID string) util.JSONResponse {
+	t, err := exporter.Request(req.Context(), types.MatrixUserID(userID))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("exporter.Request failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusAccepted,
+		JSON: newTakeoutResponse(t),
+	}
+}
+
+// GetTakeout implements GET /_matrix/media/unstable/takeout and
+// GET /_dendrite/admin/v1/users/{userID}/takeout, returning how far the
+// latest export of the user's data has got.
+func GetTakeout(req *http.Request, db storage.Database, userID string) util.JSONResponse {
+	t, err := db.GetTakeout(req.Context(), types.MatrixUserID(userID))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetTakeout failed")
+		return jsonerror.InternalServerError()
+	}
+	if t == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user's data has not been exported"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: newTakeoutResponse(t),
+	}
+}
+
+// DownloadTakeout implements GET /_matrix/media/unstable/takeout/download/{token}.
+// The token is only given out to the user and to admins, so no access token is
+// needed, which lets the archive be downloaded in a browser.
+func DownloadTakeout(
+	w http.ResponseWriter, req *http.Request, db storage.Database,
+	exporter *takeout.Exporter, downloadToken string,
+) *util.JSONResponse {
+	notFound := &util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("No archive was found"),
+	}
+	t, err := db.GetTakeoutByToken(req.Context(), downloadToken)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetTakeoutByToken failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if t == nil || t.Status != types.TakeoutComplete {
+		return notFound
+	}
+	file, err := os.Open(exporter.ArchivePath(t.UserID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return notFound
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("os.Open failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	defer file.Close() // nolint: errcheck
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="takeout.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, req, "takeout.zip", time.Unix(0, int64(t.CompletionTimestamp)*int64(time.Millisecond)), file)
+	return nil
+}
+
+// localUserID checks that the user ID is for a user on this server, whose
+// data can be exported.
+func localUserID(cfg *config.MediaAPI, userID string) *util.JSONResponse {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Only the data of local users can be exported"),
+		}
+	}
+	return nil
+}
@@ -28,4 +28,12 @@ type Database interface {
 	StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error
 	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) ([]*types.ThumbnailMetadata, error)
+	GetMediaMetadataByUser(ctx context.Context, userID types.MatrixUserID, mediaOrigin gomatrixserverlib.ServerName) ([]*types.MediaMetadata, error)
+	StoreTakeout(ctx context.Context, takeout *types.Takeout) error
+	GetTakeout(ctx context.Context, userID types.MatrixUserID) (*types.Takeout, error)
+	GetTakeoutByToken(ctx context.Context, downloadToken string) (*types.Takeout, error)
+	GetPendingTakeouts(ctx context.Context) ([]*types.Takeout, error)
+	QuarantineMedia(ctx context.Context, quarantine *types.Quarantine) error
+	UnquarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	GetQuarantine(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.Quarantine, error)
 }
@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -63,10 +64,15 @@ const selectMediaByHashSQL = `
 SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
 `
 
+const selectMediaByUserSQL = `
+SELECT media_id, content_type, file_size_bytes, creation_ts, upload_name, base64hash FROM mediaapi_media_repository WHERE user_id = $1 AND media_origin = $2 ORDER BY creation_ts ASC
+`
+
 type mediaStatements struct {
 	insertMediaStmt       *sql.Stmt
 	selectMediaStmt       *sql.Stmt
 	selectMediaByHashStmt *sql.Stmt
+	selectMediaByUserStmt *sql.Stmt
 }
 
 func (s *mediaStatements) prepare(db *sql.DB) (err error) {
@@ -79,6 +85,7 @@ func (s *mediaStatements) prepare(db *sql.DB) (err error) {
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.selectMediaByUserStmt, selectMediaByUserSQL},
 	}.prepare(db)
 }
 
@@ -139,3 +146,32 @@ func (s *mediaStatements) selectMediaByHash(
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) selectMediaByUser(
+	ctx context.Context, userID types.MatrixUserID, mediaOrigin gomatrixserverlib.ServerName,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectMediaByUserStmt.QueryContext(ctx, userID, mediaOrigin)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMediaByUser: rows.close() failed")
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		mediaMetadata := types.MediaMetadata{
+			Origin: mediaOrigin,
+			UserID: userID,
+		}
+		if err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
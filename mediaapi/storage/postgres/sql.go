@@ -20,8 +20,10 @@ import (
 )
 
 type statements struct {
-	media     mediaStatements
-	thumbnail thumbnailStatements
+	media      mediaStatements
+	thumbnail  thumbnailStatements
+	takeout    takeoutStatements
+	quarantine quarantineStatements
 }
 
 func (s *statements) prepare(db *sql.DB) (err error) {
@@ -31,6 +33,12 @@ func (s *statements) prepare(db *sql.DB) (err error) {
 	if err = s.thumbnail.prepare(db); err != nil {
 		return
 	}
+	if err = s.takeout.prepare(db); err != nil {
+		return
+	}
+	if err = s.quarantine.prepare(db); err != nil {
+		return
+	}
 
 	return
 }
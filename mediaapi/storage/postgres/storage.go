@@ -119,3 +119,61 @@ func (d *Database) GetThumbnails(
 	}
 	return thumbnails, err
 }
+
+// GetMediaMetadataByUser returns metadata about all media uploaded to this server by the user,
+// oldest first.
+func (d *Database) GetMediaMetadataByUser(
+	ctx context.Context, userID types.MatrixUserID, mediaOrigin gomatrixserverlib.ServerName,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.media.selectMediaByUser(ctx, userID, mediaOrigin)
+}
+
+// StoreTakeout inserts or replaces the export of the user's data.
+func (d *Database) StoreTakeout(ctx context.Context, takeout *types.Takeout) error {
+	return d.statements.takeout.upsertTakeout(ctx, takeout)
+}
+
+// GetTakeout returns the latest export of the user's data.
+// Returns nil if the user's data has never been exported.
+func (d *Database) GetTakeout(ctx context.Context, userID types.MatrixUserID) (*types.Takeout, error) {
+	takeout, err := d.statements.takeout.selectTakeout(ctx, userID)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return takeout, err
+}
+
+// GetTakeoutByToken returns the export which can be downloaded with the token.
+// Returns nil if there is no such export.
+func (d *Database) GetTakeoutByToken(ctx context.Context, downloadToken string) (*types.Takeout, error) {
+	takeout, err := d.statements.takeout.selectTakeoutByToken(ctx, downloadToken)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return takeout, err
+}
+
+// GetPendingTakeouts returns the exports which haven't been completed yet.
+func (d *Database) GetPendingTakeouts(ctx context.Context) ([]*types.Takeout, error) {
+	return d.statements.takeout.selectTakeoutsByStatus(ctx, types.TakeoutPending)
+}
+
+// QuarantineMedia blocks the media from being served, whether it is stored on this server or not.
+func (d *Database) QuarantineMedia(ctx context.Context, quarantine *types.Quarantine) error {
+	return d.statements.quarantine.upsertQuarantine(ctx, quarantine)
+}
+
+// UnquarantineMedia allows the media to be served again.
+func (d *Database) UnquarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error {
+	return d.statements.quarantine.deleteQuarantine(ctx, mediaID, mediaOrigin)
+}
+
+// GetQuarantine returns the quarantine of the media.
+// Returns nil if the media isn't quarantined.
+func (d *Database) GetQuarantine(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.Quarantine, error) {
+	quarantine, err := d.statements.quarantine.selectQuarantine(ctx, mediaID, mediaOrigin)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return quarantine, err
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const quarantineSchema = `
+-- The quarantined media table holds the media which admins have blocked from
+-- being served by this server, whether it was uploaded here or not.
+CREATE TABLE IF NOT EXISTS mediaapi_quarantined_media (
+    -- The id used to refer to the media.
+    media_id TEXT NOT NULL,
+    -- The origin of the media as requested by the client. Should be a homeserver domain.
+    media_origin TEXT NOT NULL,
+    -- The admin who quarantined the media.
+    quarantined_by TEXT NOT NULL,
+    -- When the media was quarantined in UNIX epoch ms.
+    quarantined_ts INTEGER NOT NULL,
+    PRIMARY KEY (media_id, media_origin)
+);
+`
+
+const upsertQuarantineSQL = `
+INSERT INTO mediaapi_quarantined_media (media_id, media_origin, quarantined_by, quarantined_ts)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (media_id, media_origin) DO UPDATE SET quarantined_by = $3, quarantined_ts = $4
+`
+
+const deleteQuarantineSQL = `
+DELETE FROM mediaapi_quarantined_media WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectQuarantineSQL = `
+SELECT quarantined_by, quarantined_ts FROM mediaapi_quarantined_media WHERE media_id = $1 AND media_origin = $2
+`
+
+type quarantineStatements struct {
+	db                   *sql.DB
+	writer               sqlutil.Writer
+	upsertQuarantineStmt *sql.Stmt
+	deleteQuarantineStmt *sql.Stmt
+	selectQuarantineStmt *sql.Stmt
+}
+
+func (s *quarantineStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
+	s.db = db
+	s.writer = writer
+
+	_, err = db.Exec(quarantineSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertQuarantineStmt, upsertQuarantineSQL},
+		{&s.deleteQuarantineStmt, deleteQuarantineSQL},
+		{&s.selectQuarantineStmt, selectQuarantineSQL},
+	}.prepare(db)
+}
+
+func (s *quarantineStatements) upsertQuarantine(
+	ctx context.Context, quarantine *types.Quarantine,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.upsertQuarantineStmt)
+		_, err := stmt.ExecContext(
+			ctx, quarantine.MediaID, quarantine.Origin,
+			quarantine.QuarantinedBy, quarantine.QuarantinedTimestamp,
+		)
+		return err
+	})
+}
+
+func (s *quarantineStatements) deleteQuarantine(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.deleteQuarantineStmt)
+		_, err := stmt.ExecContext(ctx, mediaID, mediaOrigin)
+		return err
+	})
+}
+
+func (s *quarantineStatements) selectQuarantine(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.Quarantine, error) {
+	quarantine := types.Quarantine{
+		MediaID: mediaID,
+		Origin:  mediaOrigin,
+	}
+	err := s.selectQuarantineStmt.QueryRowContext(ctx, mediaID, mediaOrigin).Scan(
+		&quarantine.QuarantinedBy, &quarantine.QuarantinedTimestamp,
+	)
+	return &quarantine, err
+}
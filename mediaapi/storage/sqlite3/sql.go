@@ -22,8 +22,10 @@ import (
 )
 
 type statements struct {
-	media     mediaStatements
-	thumbnail thumbnailStatements
+	media      mediaStatements
+	thumbnail  thumbnailStatements
+	takeout    takeoutStatements
+	quarantine quarantineStatements
 }
 
 func (s *statements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -33,6 +35,12 @@ func (s *statements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
 	if err = s.thumbnail.prepare(db, writer); err != nil {
 		return
 	}
+	if err = s.takeout.prepare(db, writer); err != nil {
+		return
+	}
+	if err = s.quarantine.prepare(db, writer); err != nil {
+		return
+	}
 
 	return
 }
@@ -0,0 +1,144 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const takeoutSchema = `
+-- The takeouts table holds the status of the latest export of each user's data,
+-- the archive itself is stored separately in the media directory.
+CREATE TABLE IF NOT EXISTS mediaapi_takeouts (
+    -- The user whose data is exported. Should be a Matrix user ID.
+    user_id TEXT NOT NULL PRIMARY KEY,
+    -- Whether the export is pending, complete or failed.
+    status TEXT NOT NULL,
+    -- The secret token which the archive can be downloaded with.
+    download_token TEXT NOT NULL,
+    -- When the export was requested in UNIX epoch ms.
+    creation_ts INTEGER NOT NULL,
+    -- When the export was completed in UNIX epoch ms, or 0 if it is pending.
+    completion_ts INTEGER NOT NULL DEFAULT 0,
+    -- Size of the archive in bytes.
+    file_size_bytes INTEGER NOT NULL DEFAULT 0
+);
+`
+
+const upsertTakeoutSQL = `
+INSERT INTO mediaapi_takeouts (user_id, status, download_token, creation_ts, completion_ts, file_size_bytes)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (user_id) DO UPDATE SET status = $2, download_token = $3, creation_ts = $4, completion_ts = $5, file_size_bytes = $6
+`
+
+const selectTakeoutSQL = `
+SELECT user_id, status, download_token, creation_ts, completion_ts, file_size_bytes FROM mediaapi_takeouts WHERE user_id = $1
+`
+
+const selectTakeoutByTokenSQL = `
+SELECT user_id, status, download_token, creation_ts, completion_ts, file_size_bytes FROM mediaapi_takeouts WHERE download_token = $1
+`
+
+const selectTakeoutsByStatusSQL = `
+SELECT user_id, status, download_token, creation_ts, completion_ts, file_size_bytes FROM mediaapi_takeouts WHERE status = $1
+`
+
+type takeoutStatements struct {
+	db                       *sql.DB
+	writer                   sqlutil.Writer
+	upsertTakeoutStmt        *sql.Stmt
+	selectTakeoutStmt        *sql.Stmt
+	selectTakeoutByTokenStmt *sql.Stmt
+	selectTakeoutsStmt       *sql.Stmt
+}
+
+func (s *takeoutStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
+	s.db = db
+	s.writer = writer
+
+	_, err = db.Exec(takeoutSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertTakeoutStmt, upsertTakeoutSQL},
+		{&s.selectTakeoutStmt, selectTakeoutSQL},
+		{&s.selectTakeoutByTokenStmt, selectTakeoutByTokenSQL},
+		{&s.selectTakeoutsStmt, selectTakeoutsByStatusSQL},
+	}.prepare(db)
+}
+
+func (s *takeoutStatements) upsertTakeout(
+	ctx context.Context, takeout *types.Takeout,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.upsertTakeoutStmt)
+		_, err := stmt.ExecContext(
+			ctx, takeout.UserID, takeout.Status, takeout.DownloadToken,
+			takeout.CreationTimestamp, takeout.CompletionTimestamp, takeout.FileSizeBytes,
+		)
+		return err
+	})
+}
+
+func (s *takeoutStatements) selectTakeout(
+	ctx context.Context, userID types.MatrixUserID,
+) (*types.Takeout, error) {
+	return scanTakeout(s.selectTakeoutStmt.QueryRowContext(ctx, userID))
+}
+
+func (s *takeoutStatements) selectTakeoutByToken(
+	ctx context.Context, downloadToken string,
+) (*types.Takeout, error) {
+	return scanTakeout(s.selectTakeoutByTokenStmt.QueryRowContext(ctx, downloadToken))
+}
+
+func (s *takeoutStatements) selectTakeoutsByStatus(
+	ctx context.Context, status types.TakeoutStatus,
+) ([]*types.Takeout, error) {
+	rows, err := s.selectTakeoutsStmt.QueryContext(ctx, status)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectTakeoutsByStatus: rows.close() failed")
+	var takeouts []*types.Takeout
+	for rows.Next() {
+		takeout, err := scanTakeout(rows)
+		if err != nil {
+			return nil, err
+		}
+		takeouts = append(takeouts, takeout)
+	}
+	return takeouts, rows.Err()
+}
+
+func scanTakeout(row interface{ Scan(...interface{}) error }) (*types.Takeout, error) {
+	var takeout types.Takeout
+	err := row.Scan(
+		&takeout.UserID,
+		&takeout.Status,
+		&takeout.DownloadToken,
+		&takeout.CreationTimestamp,
+		&takeout.CompletionTimestamp,
+		&takeout.FileSizeBytes,
+	)
+	return &takeout, err
+}
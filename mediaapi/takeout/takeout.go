@@ -0,0 +1,387 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package takeout
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// roomEventsPageSize is how many events in a room are gone through at a
+// time when looking for the events sent by the user.
+const roomEventsPageSize = 1000
+
+// Exporter generates archives of everything which the server stores about
+// users, in the background, so that they can download them.
+type Exporter struct {
+	cfg     *config.MediaAPI
+	db      storage.Database
+	userAPI userapi.UserInternalAPI
+	rsAPI   roomserverAPI.RoomserverInternalAPI
+	// wake is sent on when there are new pending exports.
+	wake chan struct{}
+}
+
+// NewExporter creates a new exporter. Call Start() to begin generating the
+// archives.
+func NewExporter(
+	cfg *config.MediaAPI, db storage.Database,
+	userAPI userapi.UserInternalAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+) *Exporter {
+	return &Exporter{
+		cfg:     cfg,
+		db:      db,
+		userAPI: userAPI,
+		rsAPI:   rsAPI,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start generates the archives of the pending exports one at a time,
+// including those which were pending when the server was last stopped.
+func (e *Exporter) Start() {
+	go func() {
+		for {
+			e.exportPending(context.Background())
+			<-e.wake
+		}
+	}()
+}
+
+// Request starts exporting the user's data, unless an export is already
+// pending, and returns the export. Any earlier archive of the user's data
+// is replaced once the new one has been generated.
+func (e *Exporter) Request(ctx context.Context, userID types.MatrixUserID) (*types.Takeout, error) {
+	takeout, err := e.db.GetTakeout(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("e.db.GetTakeout: %w", err)
+	}
+	if takeout != nil && takeout.Status == types.TakeoutPending {
+		return takeout, nil
+	}
+	tokenBytes := make([]byte, 32)
+	if _, err = rand.Read(tokenBytes); err != nil {
+		return nil, fmt.Errorf("rand.Read: %w", err)
+	}
+	takeout = &types.Takeout{
+		UserID:            userID,
+		Status:            types.TakeoutPending,
+		DownloadToken:     hex.EncodeToString(tokenBytes),
+		CreationTimestamp: types.UnixMs(time.Now().UnixNano() / 1000000),
+	}
+	if err = e.db.StoreTakeout(ctx, takeout); err != nil {
+		return nil, fmt.Errorf("e.db.StoreTakeout: %w", err)
+	}
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+	return takeout, nil
+}
+
+// ArchivePath returns where the archive of the user's data is stored.
+func (e *Exporter) ArchivePath(userID types.MatrixUserID) string {
+	h := sha256.Sum256([]byte(userID))
+	return filepath.Join(string(e.cfg.AbsBasePath), "takeout", hex.EncodeToString(h[:])+".zip")
+}
+
+func (e *Exporter) exportPending(ctx context.Context) {
+	takeouts, err := e.db.GetPendingTakeouts(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get pending exports of user data")
+		return
+	}
+	for _, takeout := range takeouts {
+		logger := logrus.WithField("user_id", takeout.UserID)
+		size, err := e.export(ctx, takeout.UserID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to export user data")
+			takeout.Status = types.TakeoutFailed
+		} else {
+			logger.WithField("size", size).Info("Exported user data")
+			takeout.Status = types.TakeoutComplete
+			takeout.FileSizeBytes = size
+		}
+		takeout.CompletionTimestamp = types.UnixMs(time.Now().UnixNano() / 1000000)
+		if err = e.db.StoreTakeout(ctx, takeout); err != nil {
+			logger.WithError(err).Error("Failed to store export of user data")
+		}
+	}
+}
+
+// export writes the archive of the user's data, returning its size. The
+// archive is written to a temporary file first, so that a complete earlier
+// archive can still be downloaded in the meantime.
+func (e *Exporter) export(ctx context.Context, userID types.MatrixUserID) (types.FileSizeBytes, error) {
+	path := e.ArchivePath(userID)
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return 0, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, fmt.Errorf("os.Create: %w", err)
+	}
+	defer os.Remove(path + ".tmp") // nolint: errcheck
+	defer file.Close()             // nolint: errcheck
+
+	archive := zip.NewWriter(file)
+	if err = e.writeArchive(ctx, archive, userID); err != nil {
+		return 0, err
+	}
+	if err = archive.Close(); err != nil {
+		return 0, fmt.Errorf("archive.Close: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("file.Stat: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		return 0, fmt.Errorf("file.Close: %w", err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return 0, fmt.Errorf("os.Rename: %w", err)
+	}
+	return types.FileSizeBytes(info.Size()), nil
+}
+
+type profile struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type accountData struct {
+	Global map[string]json.RawMessage            `json:"global"`
+	Rooms  map[string]map[string]json.RawMessage `json:"rooms"`
+}
+
+// device leaves out the access token, which is a secret.
+type device struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	LastSeenTS  int64  `json:"last_seen_ts,omitempty"`
+	LastSeenIP  string `json:"last_seen_ip,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+}
+
+type media struct {
+	ContentURI  string `json:"content_uri"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	CreatedTS   int64  `json:"created_ts"`
+	UploadName  string `json:"upload_name,omitempty"`
+	// The path of the file in the archive, if it could be included.
+	Path string `json:"path,omitempty"`
+}
+
+// manifest lists the files which couldn't be included in the archive.
+type manifest struct {
+	Skipped []skippedFile `json:"skipped"`
+}
+
+type skippedFile struct {
+	ContentURI string `json:"content_uri"`
+	Reason     string `json:"reason"`
+}
+
+type roomEvents struct {
+	RoomID string                          `json:"room_id"`
+	Events []gomatrixserverlib.ClientEvent `json:"events"`
+}
+
+// writeArchive writes the user's profile, account data, devices and media
+// uploads, along with the events which they sent in the rooms they are
+// joined to. Media files which can't be read are left out and listed in the
+// manifest instead.
+func (e *Exporter) writeArchive(ctx context.Context, archive *zip.Writer, userID types.MatrixUserID) error {
+	var profileRes userapi.QueryProfileResponse
+	if err := e.userAPI.QueryProfile(ctx, &userapi.QueryProfileRequest{UserID: string(userID)}, &profileRes); err != nil {
+		return fmt.Errorf("e.userAPI.QueryProfile: %w", err)
+	}
+	if err := writeJSON(archive, "profile.json", profile{
+		UserID:      string(userID),
+		DisplayName: profileRes.DisplayName,
+		AvatarURL:   profileRes.AvatarURL,
+	}); err != nil {
+		return err
+	}
+
+	var accountDataRes userapi.QueryAccountDataResponse
+	if err := e.userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{UserID: string(userID)}, &accountDataRes); err != nil {
+		return fmt.Errorf("e.userAPI.QueryAccountData: %w", err)
+	}
+	if err := writeJSON(archive, "account_data.json", accountData{
+		Global: accountDataRes.GlobalAccountData,
+		Rooms:  accountDataRes.RoomAccountData,
+	}); err != nil {
+		return err
+	}
+
+	var devicesRes userapi.QueryDevicesResponse
+	if err := e.userAPI.QueryDevices(ctx, &userapi.QueryDevicesRequest{UserID: string(userID)}, &devicesRes); err != nil {
+		return fmt.Errorf("e.userAPI.QueryDevices: %w", err)
+	}
+	devices := make([]device, 0, len(devicesRes.Devices))
+	for _, dev := range devicesRes.Devices {
+		devices = append(devices, device{
+			DeviceID:    dev.ID,
+			DisplayName: dev.DisplayName,
+			LastSeenTS:  dev.LastSeenTS,
+			LastSeenIP:  dev.LastSeenIP,
+			UserAgent:   dev.UserAgent,
+		})
+	}
+	if err := writeJSON(archive, "devices.json", devices); err != nil {
+		return err
+	}
+
+	skipped, err := e.writeMedia(ctx, archive, userID)
+	if err != nil {
+		return err
+	}
+	if err = e.writeRooms(ctx, archive, userID); err != nil {
+		return err
+	}
+	return writeJSON(archive, "manifest.json", manifest{Skipped: skipped})
+}
+
+func (e *Exporter) writeMedia(ctx context.Context, archive *zip.Writer, userID types.MatrixUserID) ([]skippedFile, error) {
+	metadata, err := e.db.GetMediaMetadataByUser(ctx, userID, e.cfg.Matrix.ServerName)
+	if err != nil {
+		return nil, fmt.Errorf("e.db.GetMediaMetadataByUser: %w", err)
+	}
+	skipped := []skippedFile{}
+	uploads := make([]media, 0, len(metadata))
+	for _, m := range metadata {
+		upload := media{
+			ContentURI:  fmt.Sprintf("mxc://%s/%s", m.Origin, m.MediaID),
+			ContentType: string(m.ContentType),
+			Size:        int64(m.FileSizeBytes),
+			CreatedTS:   int64(m.CreationTimestamp),
+			UploadName:  string(m.UploadName),
+		}
+		path := entryName("media/", string(m.MediaID))
+		if err = copyMediaFile(archive, path, m.Base64Hash, e.cfg.AbsBasePath); err != nil {
+			logrus.WithError(err).WithField("content_uri", upload.ContentURI).Warn("Failed to add media file to export of user data")
+			skipped = append(skipped, skippedFile{
+				ContentURI: upload.ContentURI,
+				Reason:     "The file couldn't be read",
+			})
+		} else {
+			upload.Path = path
+		}
+		uploads = append(uploads, upload)
+	}
+	if err = writeJSON(archive, "media.json", uploads); err != nil {
+		return nil, err
+	}
+	return skipped, nil
+}
+
+func copyMediaFile(archive *zip.Writer, name string, base64Hash types.Base64Hash, absBasePath config.Path) error {
+	path, err := fileutils.GetPathFromBase64Hash(base64Hash, absBasePath)
+	if err != nil {
+		return fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	w, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("archive.Create: %w", err)
+	}
+	if _, err = io.Copy(w, file); err != nil {
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+	return nil
+}
+
+func (e *Exporter) writeRooms(ctx context.Context, archive *zip.Writer, userID types.MatrixUserID) error {
+	var roomsRes roomserverAPI.QueryRoomsForUserResponse
+	if err := e.rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         string(userID),
+		WantMembership: gomatrixserverlib.Join,
+	}, &roomsRes); err != nil {
+		return fmt.Errorf("e.rsAPI.QueryRoomsForUser: %w", err)
+	}
+	for _, roomID := range roomsRes.RoomIDs {
+		room := roomEvents{
+			RoomID: roomID,
+			Events: []gomatrixserverlib.ClientEvent{},
+		}
+		var from int64
+		for {
+			var res roomserverAPI.QueryUserRoomEventsResponse
+			if err := e.rsAPI.QueryUserRoomEvents(ctx, &roomserverAPI.QueryUserRoomEventsRequest{
+				RoomID: roomID,
+				UserID: string(userID),
+				From:   from,
+				Limit:  roomEventsPageSize,
+			}, &res); err != nil {
+				return fmt.Errorf("e.rsAPI.QueryUserRoomEvents: %w", err)
+			}
+			room.Events = append(room.Events, gomatrixserverlib.HeaderedToClientEvents(res.Events, gomatrixserverlib.FormatAll)...)
+			if res.Next == 0 {
+				break
+			}
+			from = res.Next
+		}
+		if err := writeJSON(archive, entryName("rooms/", roomID)+".json", room); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryName returns the name of an entry in the archive for the ID of a room
+// or media file. IDs can come from other servers, so they are hashed rather
+// than used as they are, so that they can't contain slashes or "..".
+func entryName(dir, id string) string {
+	h := sha256.Sum256([]byte(id))
+	return dir + hex.EncodeToString(h[:])
+}
+
+func writeJSON(archive *zip.Writer, name string, v interface{}) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("archive.Create: %w", err)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(v); err != nil {
+		return fmt.Errorf("json.Encode: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package takeout
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type mockUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (m *mockUserAPI) QueryProfile(ctx context.Context, req *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
+	res.UserExists = true
+	res.DisplayName = "Alice"
+	return nil
+}
+
+func (m *mockUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	res.GlobalAccountData = map[string]json.RawMessage{"org.example.test": json.RawMessage(`{"a":"b"}`)}
+	return nil
+}
+
+func (m *mockUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
+	res.UserExists = true
+	res.Devices = []userapi.Device{{ID: "DEVICE", UserID: req.UserID, AccessToken: "secret"}}
+	return nil
+}
+
+const testRoomID = "!../../room:localhost"
+
+type mockRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	events []*gomatrixserverlib.HeaderedEvent
+}
+
+func (m *mockRoomserverAPI) QueryRoomsForUser(ctx context.Context, req *roomserverAPI.QueryRoomsForUserRequest, res *roomserverAPI.QueryRoomsForUserResponse) error {
+	// Room IDs can come from other servers, so they mustn't be trusted to
+	// make safe paths in the archive.
+	res.RoomIDs = []string{testRoomID}
+	return nil
+}
+
+// QueryUserRoomEvents returns one event at a time, to check that the
+// exporter goes through every page.
+func (m *mockRoomserverAPI) QueryUserRoomEvents(ctx context.Context, req *roomserverAPI.QueryUserRoomEventsRequest, res *roomserverAPI.QueryUserRoomEventsResponse) error {
+	res.Events = m.events[req.From : req.From+1]
+	if int(req.From)+1 < len(m.events) {
+		res.Next = req.From + 1
+	}
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	basePath := config.Path(t.TempDir())
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{ServerName: "localhost"},
+		AbsBasePath: basePath,
+	}
+	db, err := storage.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(string(basePath), "media.db")),
+	})
+	if err != nil {
+		t.Fatalf("failed to open media DB: %s", err)
+	}
+
+	// The user uploaded one file.
+	mediaPath, err := fileutils.GetPathFromBase64Hash("abcdef", basePath)
+	if err != nil {
+		t.Fatalf("GetPathFromBase64Hash failed: %s", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(mediaPath), 0770); err != nil {
+		t.Fatalf("MkdirAll failed: %s", err)
+	}
+	if err = ioutil.WriteFile(mediaPath, []byte("hello"), 0660); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if err = db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+		MediaID:       "media",
+		Origin:        "localhost",
+		ContentType:   "text/plain",
+		FileSizeBytes: 5,
+		Base64Hash:    "abcdef",
+		UserID:        "@alice:localhost",
+	}); err != nil {
+		t.Fatalf("StoreMediaMetadata failed: %s", err)
+	}
+	// The file of another upload has gone missing, which shouldn't stop the
+	// rest being exported.
+	if err = db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+		MediaID:       "missing",
+		Origin:        "localhost",
+		ContentType:   "text/plain",
+		FileSizeBytes: 5,
+		Base64Hash:    "ghijkl",
+		UserID:        "@alice:localhost",
+	}); err != nil {
+		t.Fatalf("StoreMediaMetadata failed: %s", err)
+	}
+
+	rsAPI := &mockRoomserverAPI{}
+	for _, event := range []string{
+		`{"content":{"body":"hello"},"depth":1,"origin_server_ts":1,"prev_events":[],"auth_events":[],"room_id":"!../../room:localhost","sender":"@alice:localhost","type":"m.room.message"}`,
+		`{"content":{"body":"hi"},"depth":2,"origin_server_ts":2,"prev_events":[],"auth_events":[],"room_id":"!../../room:localhost","sender":"@alice:localhost","type":"m.room.message"}`,
+	} {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(event), false, gomatrixserverlib.RoomVersionV5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsAPI.events = append(rsAPI.events, ev.Headered(gomatrixserverlib.RoomVersionV5))
+	}
+
+	exporter := NewExporter(cfg, db, &mockUserAPI{}, rsAPI)
+	takeout, err := exporter.Request(ctx, "@alice:localhost")
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	if takeout.Status != types.TakeoutPending || takeout.DownloadToken == "" {
+		t.Fatalf("got %+v, want a pending export with a download token", takeout)
+	}
+	// Asking again while it is pending doesn't start another export.
+	again, err := exporter.Request(ctx, "@alice:localhost")
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	if again.DownloadToken != takeout.DownloadToken {
+		t.Errorf("got download token %q, want %q", again.DownloadToken, takeout.DownloadToken)
+	}
+
+	exporter.exportPending(ctx)
+	takeout, err = db.GetTakeoutByToken(ctx, takeout.DownloadToken)
+	if err != nil {
+		t.Fatalf("GetTakeoutByToken failed: %s", err)
+	}
+	if takeout == nil || takeout.Status != types.TakeoutComplete || takeout.FileSizeBytes == 0 {
+		t.Fatalf("got %+v, want a complete export", takeout)
+	}
+
+	archive, err := zip.OpenReader(exporter.ArchivePath("@alice:localhost"))
+	if err != nil {
+		t.Fatalf("failed to open archive: %s", err)
+	}
+	defer archive.Close() // nolint: errcheck
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		if strings.Contains(f.Name, "..") {
+			t.Errorf("got archive entry %q, want no entries with ..", f.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %s", f.Name, err)
+		}
+		if files[f.Name], err = ioutil.ReadAll(r); err != nil {
+			t.Fatalf("failed to read %s: %s", f.Name, err)
+		}
+		_ = r.Close()
+	}
+	for _, name := range []string{"profile.json", "account_data.json", "devices.json", "media.json", "manifest.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("archive is missing %s", name)
+		}
+	}
+	var uploads []media
+	if err = json.Unmarshal(files["media.json"], &uploads); err != nil {
+		t.Fatalf("failed to unmarshal media: %s", err)
+	}
+	paths := map[string]string{}
+	for _, upload := range uploads {
+		paths[upload.ContentURI] = upload.Path
+	}
+	if got := string(files[paths["mxc://localhost/media"]]); got != "hello" {
+		t.Errorf("got media file %q, want %q", got, "hello")
+	}
+	if path, ok := paths["mxc://localhost/missing"]; !ok || path != "" {
+		t.Errorf("got path %q for the missing media file, want it listed without a path", path)
+	}
+	var man manifest
+	if err = json.Unmarshal(files["manifest.json"], &man); err != nil {
+		t.Fatalf("failed to unmarshal manifest: %s", err)
+	}
+	if len(man.Skipped) != 1 || man.Skipped[0].ContentURI != "mxc://localhost/missing" {
+		t.Errorf("got skipped files %+v, want only the missing media file", man.Skipped)
+	}
+	var devices []map[string]interface{}
+	if err = json.Unmarshal(files["devices.json"], &devices); err != nil {
+		t.Fatalf("failed to unmarshal devices: %s", err)
+	}
+	if len(devices) != 1 || devices[0]["device_id"] != "DEVICE" || devices[0]["access_token"] != nil {
+		t.Errorf("got devices %v, want one device without its access token", devices)
+	}
+	var room roomEvents
+	if err = json.Unmarshal(files[entryName("rooms/", testRoomID)+".json"], &room); err != nil {
+		t.Fatalf("failed to unmarshal room: %s", err)
+	}
+	if room.RoomID != testRoomID || len(room.Events) != 2 {
+		t.Errorf("got room %q with %d events, want %q with 2", room.RoomID, len(room.Events), testRoomID)
+	}
+}
@@ -60,6 +60,38 @@ type MediaMetadata struct {
 	UserID            MatrixUserID
 }
 
+// TakeoutStatus is how far an export of a user's data has got
+type TakeoutStatus string
+
+const (
+	// TakeoutPending is the status of an export which is still being generated
+	TakeoutPending TakeoutStatus = "pending"
+	// TakeoutComplete is the status of an export which can be downloaded
+	TakeoutComplete TakeoutStatus = "complete"
+	// TakeoutFailed is the status of an export which couldn't be generated
+	TakeoutFailed TakeoutStatus = "failed"
+)
+
+// Takeout is an export of a user's data as an archive, which they can download
+type Takeout struct {
+	UserID MatrixUserID
+	Status TakeoutStatus
+	// The secret token which the archive can be downloaded with
+	DownloadToken       string
+	CreationTimestamp   UnixMs
+	CompletionTimestamp UnixMs
+	FileSizeBytes       FileSizeBytes
+}
+
+// Quarantine records that an admin has blocked some media from being served
+type Quarantine struct {
+	MediaID MediaID
+	Origin  gomatrixserverlib.ServerName
+	// The admin who quarantined the media
+	QuarantinedBy        string
+	QuarantinedTimestamp UnixMs
+}
+
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
 type RemoteRequestResult struct {
 	// Condition used for the requester to signal the result to all other routines waiting on this condition
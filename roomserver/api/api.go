@@ -111,6 +111,13 @@ type RoomserverInternalAPI interface {
 		response *QueryMembershipsForRoomResponse,
 	) error
 
+	// Query the number of users who are joined to a room
+	QueryJoinedMemberCount(
+		ctx context.Context,
+		request *QueryJoinedMemberCountRequest,
+		response *QueryJoinedMemberCountResponse,
+	) error
+
 	// Query if we think we're still in a room.
 	QueryServerJoinedToRoom(
 		ctx context.Context,
@@ -163,6 +170,10 @@ type RoomserverInternalAPI interface {
 	QueryKnownUsers(ctx context.Context, req *QueryKnownUsersRequest, res *QueryKnownUsersResponse) error
 	// QueryServerBannedFromRoom returns whether a server is banned from a room by server ACLs.
 	QueryServerBannedFromRoom(ctx context.Context, req *QueryServerBannedFromRoomRequest, res *QueryServerBannedFromRoomResponse) error
+	// QueryRoomStatistics returns counts of the rooms known to the roomserver.
+	QueryRoomStatistics(ctx context.Context, req *QueryRoomStatisticsRequest, res *QueryRoomStatisticsResponse) error
+	// QueryTransactionEventID returns the ID of the event sent by a client with the given transaction ID, if any.
+	QueryTransactionEventID(ctx context.Context, req *QueryTransactionEventIDRequest, res *QueryTransactionEventIDResponse) error
 
 	// Query a given amount (or less) of events prior to a given set of events.
 	PerformBackfill(
@@ -174,6 +185,19 @@ type RoomserverInternalAPI interface {
 	// PerformForget forgets a rooms history for a specific user
 	PerformForget(ctx context.Context, req *PerformForgetRequest, resp *PerformForgetResponse) error
 
+	// PerformReportEvent stores a report of an event made by a user, for server admins to review.
+	PerformReportEvent(ctx context.Context, req *PerformReportEventRequest, res *PerformReportEventResponse) error
+	// PerformResolveEventReport marks an event report as resolved.
+	PerformResolveEventReport(ctx context.Context, req *PerformResolveEventReportRequest, res *PerformResolveEventReportResponse) error
+	// PerformAdminPurgeRoom deletes a room and all of its events from the server.
+	PerformAdminPurgeRoom(ctx context.Context, req *PerformAdminPurgeRoomRequest, res *PerformAdminPurgeRoomResponse) error
+	// QueryEventReports returns a page of event reports, newest first.
+	QueryEventReports(ctx context.Context, req *QueryEventReportsRequest, res *QueryEventReportsResponse) error
+	// QueryEventReport returns a single event report along with the reported event.
+	QueryEventReport(ctx context.Context, req *QueryEventReportRequest, res *QueryEventReportResponse) error
+	// QueryUserRoomEvents goes through a page of the history of a room, returning the events sent by a user.
+	QueryUserRoomEvents(ctx context.Context, req *QueryUserRoomEventsRequest, res *QueryUserRoomEventsResponse) error
+
 	// Asks for the default room version as preferred by the server.
 	QueryRoomVersionCapabilities(
 		ctx context.Context,
@@ -169,6 +169,16 @@ func (t *RoomserverInternalAPITrace) QueryMembershipsForRoom(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryJoinedMemberCount(
+	ctx context.Context,
+	req *QueryJoinedMemberCountRequest,
+	res *QueryJoinedMemberCountResponse,
+) error {
+	err := t.Impl.QueryJoinedMemberCount(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryJoinedMemberCount req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryServerJoinedToRoom(
 	ctx context.Context,
 	req *QueryServerJoinedToRoomRequest,
@@ -340,6 +350,83 @@ func (t *RoomserverInternalAPITrace) QueryServerBannedFromRoom(ctx context.Conte
 	return err
 }
 
+// QueryRoomStatistics returns counts of the rooms known to the roomserver.
+func (t *RoomserverInternalAPITrace) QueryRoomStatistics(ctx context.Context, req *QueryRoomStatisticsRequest, res *QueryRoomStatisticsResponse) error {
+	err := t.Impl.QueryRoomStatistics(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomStatistics req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QueryTransactionEventID(
+	ctx context.Context,
+	req *QueryTransactionEventIDRequest,
+	res *QueryTransactionEventIDResponse,
+) error {
+	err := t.Impl.QueryTransactionEventID(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryTransactionEventID req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) PerformReportEvent(
+	ctx context.Context,
+	req *PerformReportEventRequest,
+	res *PerformReportEventResponse,
+) error {
+	err := t.Impl.PerformReportEvent(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformReportEvent req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) PerformResolveEventReport(
+	ctx context.Context,
+	req *PerformResolveEventReportRequest,
+	res *PerformResolveEventReportResponse,
+) error {
+	err := t.Impl.PerformResolveEventReport(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformResolveEventReport req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) PerformAdminPurgeRoom(
+	ctx context.Context,
+	req *PerformAdminPurgeRoomRequest,
+	res *PerformAdminPurgeRoomResponse,
+) error {
+	err := t.Impl.PerformAdminPurgeRoom(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformAdminPurgeRoom req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QueryEventReports(
+	ctx context.Context,
+	req *QueryEventReportsRequest,
+	res *QueryEventReportsResponse,
+) error {
+	err := t.Impl.QueryEventReports(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventReports req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QueryEventReport(
+	ctx context.Context,
+	req *QueryEventReportRequest,
+	res *QueryEventReportResponse,
+) error {
+	err := t.Impl.QueryEventReport(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventReport req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QueryUserRoomEvents(
+	ctx context.Context,
+	req *QueryUserRoomEventsRequest,
+	res *QueryUserRoomEventsResponse,
+) error {
+	err := t.Impl.QueryUserRoomEvents(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryUserRoomEvents req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryAuthChain(
 	ctx context.Context,
 	request *QueryAuthChainRequest,
@@ -201,3 +201,40 @@ type PerformForgetRequest struct {
 }
 
 type PerformForgetResponse struct{}
+
+// PerformReportEventRequest is a request to PerformReportEvent
+type PerformReportEventRequest struct {
+	RoomID     string `json:"room_id"`
+	EventID    string `json:"event_id"`
+	ReporterID string `json:"reporter_id"`
+	Reason     string `json:"reason"`
+	// The score from -100 (most offensive) to 0, if one was given.
+	Score *int64 `json:"score,omitempty"`
+}
+
+type PerformReportEventResponse struct {
+	// The ID of the newly stored report.
+	ReportID int64 `json:"report_id"`
+}
+
+// PerformResolveEventReportRequest is a request to PerformResolveEventReport
+type PerformResolveEventReportRequest struct {
+	ReportID int64 `json:"report_id"`
+	// The user ID of the admin who resolved the report.
+	ResolvedBy string `json:"resolved_by"`
+}
+
+type PerformResolveEventReportResponse struct {
+	// False if the report doesn't exist or had already been resolved.
+	Resolved bool `json:"resolved"`
+}
+
+// PerformAdminPurgeRoomRequest is a request to PerformAdminPurgeRoom
+type PerformAdminPurgeRoomRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+type PerformAdminPurgeRoomResponse struct {
+	// False if the room doesn't exist.
+	Purged bool `json:"purged"`
+}
@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -155,6 +156,9 @@ type QueryMembershipsForRoomRequest struct {
 	// user is allowed to see the memberships. If not specified then all
 	// room memberships will be returned.
 	Sender string `json:"sender"`
+	// If true, only returns the membership events of local users. Only
+	// used when no sender is specified.
+	LocalOnly bool `json:"local_only"`
 }
 
 // QueryMembershipsForRoomResponse is a response to QueryMembershipsForRoom
@@ -168,6 +172,20 @@ type QueryMembershipsForRoomResponse struct {
 	IsRoomForgotten bool `json:"is_room_forgotten"`
 }
 
+// QueryJoinedMemberCountRequest is a request to QueryJoinedMemberCount
+type QueryJoinedMemberCountRequest struct {
+	// ID of the room to count the joined members of
+	RoomID string `json:"room_id"`
+}
+
+// QueryJoinedMemberCountResponse is a response to QueryJoinedMemberCount
+type QueryJoinedMemberCountResponse struct {
+	// True if the room exists on the server
+	RoomExists bool `json:"room_exists"`
+	// The number of users who are joined to the room
+	Count int `json:"count"`
+}
+
 // QueryServerJoinedToRoomRequest is a request to QueryServerJoinedToRoom
 type QueryServerJoinedToRoomRequest struct {
 	// Server name of the server to find. If not specified, we will
@@ -360,6 +378,80 @@ type QueryServerBannedFromRoomResponse struct {
 	Banned bool `json:"banned"`
 }
 
+type QueryRoomStatisticsRequest struct {
+}
+
+type QueryRoomStatisticsResponse struct {
+	// The number of rooms that the roomserver knows about.
+	TotalRooms int64 `json:"total_rooms"`
+	// The number of rooms that at least one local user is joined to.
+	LocalJoinedRooms int64 `json:"local_joined_rooms"`
+}
+
+// QueryTransactionEventIDRequest is a request to QueryTransactionEventID
+type QueryTransactionEventIDRequest struct {
+	// The transaction ID and session ID that the event was sent with.
+	TransactionID TransactionID `json:"transaction_id"`
+	// The user ID of the sender.
+	UserID string `json:"user_id"`
+}
+
+type QueryTransactionEventIDResponse struct {
+	// The ID of the event sent with the transaction ID, or empty if there
+	// was no such event.
+	EventID string `json:"event_id"`
+}
+
+// QueryEventReportsRequest is a request to QueryEventReports
+type QueryEventReportsRequest struct {
+	// Only return reports for this room, if given.
+	RoomID string `json:"room_id,omitempty"`
+	// Only return resolved or unresolved reports, if given.
+	Resolved *bool `json:"resolved,omitempty"`
+	// The number of reports to skip, for pagination.
+	From int64 `json:"from"`
+	// The maximum number of reports to return.
+	Limit int `json:"limit"`
+}
+
+type QueryEventReportsResponse struct {
+	// The reports, newest first.
+	Reports []types.EventReport `json:"reports"`
+	// The total number of reports matching the filters.
+	Total int64 `json:"total"`
+}
+
+// QueryEventReportRequest is a request to QueryEventReport
+type QueryEventReportRequest struct {
+	ReportID int64 `json:"report_id"`
+}
+
+type QueryEventReportResponse struct {
+	// The report, or nil if there is no report with the given ID.
+	Report *types.EventReport `json:"report,omitempty"`
+	// The reported event, if we have it.
+	Event *gomatrixserverlib.HeaderedEvent `json:"event,omitempty"`
+}
+
+// QueryUserRoomEventsRequest is a request to QueryUserRoomEvents
+type QueryUserRoomEventsRequest struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	// Where to carry on from, as given in the last response, or 0 to start
+	// from the beginning of the room.
+	From int64 `json:"from"`
+	// The maximum number of events in the room to go through. Fewer events
+	// than this are returned, as only those sent by the user are included.
+	Limit int `json:"limit"`
+}
+
+type QueryUserRoomEventsResponse struct {
+	// The events sent by the user, oldest first.
+	Events []*gomatrixserverlib.HeaderedEvent `json:"events"`
+	// Where to carry on from, or 0 if the end of the room has been reached.
+	Next int64 `json:"next"`
+}
+
 // MarshalJSON stringifies the room ID and StateKeyTuple keys so they can be sent over the wire in HTTP API mode.
 func (r *QueryBulkStateContentResponse) MarshalJSON() ([]byte, error) {
 	se := make(map[string]string)
@@ -12,6 +12,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/internal/perform"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/policy"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -32,12 +33,15 @@ type RoomserverInternalAPI struct {
 	*perform.Publisher
 	*perform.Backfiller
 	*perform.Forgetter
+	*perform.Reporter
+	*perform.Admin
 	DB                     storage.Database
 	Cfg                    *config.RoomServer
 	Cache                  caching.RoomServerCaches
 	ServerName             gomatrixserverlib.ServerName
 	KeyRing                gomatrixserverlib.JSONVerifier
 	ServerACLs             *acls.ServerACLs
+	PolicyLists            *policy.PolicyLists
 	fsAPI                  fsAPI.FederationInternalAPI
 	asAPI                  asAPI.AppServiceQueryAPI
 	JetStream              nats.JetStreamContext
@@ -72,6 +76,10 @@ func NewRoomserverAPI(
 		},
 		// perform-er structs get initialised when we have a federation sender to use
 	}
+	if cfg.PolicyLists.Enabled {
+		a.PolicyLists = policy.NewPolicyLists(a.Queryer, cfg.PolicyLists.Rooms)
+		a.Queryer.PolicyLists = a.PolicyLists
+	}
 	return a
 }
 
@@ -92,22 +100,25 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.FederationInternalA
 		FSAPI:                fsAPI,
 		KeyRing:              keyRing,
 		ACLs:                 r.ServerACLs,
+		PolicyLists:          r.PolicyLists,
 		Queryer:              r.Queryer,
 	}
 	r.Inviter = &perform.Inviter{
-		DB:      r.DB,
-		Cfg:     r.Cfg,
-		FSAPI:   r.fsAPI,
-		Inputer: r.Inputer,
+		DB:          r.DB,
+		Cfg:         r.Cfg,
+		FSAPI:       r.fsAPI,
+		Inputer:     r.Inputer,
+		PolicyLists: r.PolicyLists,
 	}
 	r.Joiner = &perform.Joiner{
-		ServerName: r.Cfg.Matrix.ServerName,
-		Cfg:        r.Cfg,
-		DB:         r.DB,
-		FSAPI:      r.fsAPI,
-		RSAPI:      r,
-		Inputer:    r.Inputer,
-		Queryer:    r.Queryer,
+		ServerName:  r.Cfg.Matrix.ServerName,
+		Cfg:         r.Cfg,
+		DB:          r.DB,
+		FSAPI:       r.fsAPI,
+		RSAPI:       r,
+		Inputer:     r.Inputer,
+		Queryer:     r.Queryer,
+		PolicyLists: r.PolicyLists,
 	}
 	r.Peeker = &perform.Peeker{
 		ServerName: r.Cfg.Matrix.ServerName,
@@ -149,6 +160,13 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.FederationInternalA
 	r.Forgetter = &perform.Forgetter{
 		DB: r.DB,
 	}
+	r.Reporter = &perform.Reporter{
+		DB: r.DB,
+	}
+	r.Admin = &perform.Admin{
+		DB:      r.DB,
+		Inputer: r.Inputer,
+	}
 
 	if err := r.Inputer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start roomserver input API")
@@ -220,7 +220,7 @@ func loadAuthEvents(
 			eventNIDs = append(eventNIDs, eventNID)
 		}
 	}
-	if result.events, err = db.Events(ctx, eventNIDs); err != nil {
+	if result.events, err = db.StateEvents(ctx, eventNIDs); err != nil {
 		return
 	}
 	return
@@ -29,6 +29,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/policy"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -66,6 +67,7 @@ type Inputer struct {
 	FSAPI                fedapi.FederationInternalAPI
 	KeyRing              gomatrixserverlib.JSONVerifier
 	ACLs                 *acls.ServerACLs
+	PolicyLists          *policy.PolicyLists
 	InputRoomEventTopic  string
 	OutputRoomEventTopic string
 	workers              sync.Map // room ID -> *phony.Inbox
@@ -302,6 +304,9 @@ func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) er
 				ev := update.NewRoomEvent.Event.Unwrap()
 				defer r.ACLs.OnServerACLUpdate(ev)
 			}
+			if r.PolicyLists.IsPolicyRoom(roomID) && update.NewRoomEvent.Event.StateKey() != nil {
+				defer r.PolicyLists.OnPolicyRuleUpdate(update.NewRoomEvent.Event.Unwrap())
+			}
 		}
 		logger.Tracef("Producing to topic '%s'", r.OutputRoomEventTopic)
 		if _, err := r.JetStream.PublishMsg(msg); err != nil {
@@ -128,6 +128,20 @@ func (r *Inputer) processRoomEvent(
 		}
 	}
 
+	// If a client sent this event with a transaction ID that we've already
+	// seen then it is a retry of an earlier request, so don't send it again.
+	if input.Kind == api.KindNew && input.TransactionID != nil {
+		tdID := input.TransactionID
+		eventID, err := updater.GetTransactionEventID(tdID.TransactionID, tdID.SessionID, event.Sender())
+		if err != nil {
+			return rollbackTransaction, fmt.Errorf("updater.GetTransactionEventID: %w", err)
+		}
+		if eventID != "" {
+			logger.WithField("original_event_id", eventID).Debug("Already processed transaction; ignoring")
+			return rollbackTransaction, nil
+		}
+	}
+
 	missingRes := &api.QueryMissingAuthPrevEventsResponse{}
 	serverRes := &fedapi.QueryJoinedHostServerNamesInRoomResponse{}
 	if event.Type() != gomatrixserverlib.MRoomCreate || !event.StateKeyEquals("") {
@@ -322,6 +336,11 @@ func (r *Inputer) processRoomEvent(
 
 	switch input.Kind {
 	case api.KindNew:
+		if tdID := input.TransactionID; tdID != nil {
+			if err = updater.StoreTransaction(tdID.TransactionID, tdID.SessionID, event.Sender(), event.EventID()); err != nil {
+				return rollbackTransaction, fmt.Errorf("updater.StoreTransaction: %w", err)
+			}
+		}
 		if err = r.updateLatestEvents(
 			ctx,                 // context
 			updater,             // room updater
@@ -0,0 +1,60 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/sirupsen/logrus"
+)
+
+type Admin struct {
+	DB      storage.Database
+	Inputer *input.Inputer
+}
+
+// PerformAdminPurgeRoom implements api.RoomserverInternalAPI
+func (r *Admin) PerformAdminPurgeRoom(
+	ctx context.Context,
+	req *api.PerformAdminPurgeRoomRequest,
+	res *api.PerformAdminPurgeRoomResponse,
+) error {
+	purged, err := r.DB.PurgeRoom(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.PurgeRoom: %w", err)
+	}
+	if !purged {
+		return nil
+	}
+	logrus.WithField("room_id", req.RoomID).Warn("Room purged by a server admin")
+
+	// Tell the other components to forget about the room too.
+	if err = r.Inputer.WriteOutputEvents(req.RoomID, []api.OutputEvent{
+		{
+			Type: api.OutputTypePurgeRoom,
+			PurgeRoom: &api.OutputPurgeRoom{
+				RoomID: req.RoomID,
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("r.Inputer.WriteOutputEvents: %w", err)
+	}
+	res.Purged = true
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/policy"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -36,6 +37,17 @@ type Inviter struct {
 	Cfg     *config.RoomServer
 	FSAPI   federationAPI.FederationInternalAPI
 	Inputer *input.Inputer
+	// PolicyLists is nil if policy lists aren't enabled.
+	PolicyLists *policy.PolicyLists
+}
+
+// isInviteBlockedByPolicy returns whether the inviter or the room is banned by
+// one of the policy lists, along with the matching rule.
+func (r *Inviter) isInviteBlockedByPolicy(inviter, roomID string) (*policy.Rule, bool) {
+	if rule, ok := r.PolicyLists.IsUserBanned(inviter); ok {
+		return rule, true
+	}
+	return r.PolicyLists.IsRoomBanned(roomID)
 }
 
 func (r *Inviter) PerformInvite(
@@ -132,6 +144,15 @@ func (r *Inviter) PerformInvite(
 		return nil, nil
 	}
 
+	if rule, blocked := r.isInviteBlockedByPolicy(event.Sender(), roomID); blocked {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  rule.Message("Invite blocked by a moderation policy"),
+		}
+		logger.Debugf("invite blocked by moderation policy")
+		return nil, nil
+	}
+
 	if !isOriginLocal {
 		// The invite originated over federation. Process the membership
 		// update, which will notify the sync API etc about the incoming
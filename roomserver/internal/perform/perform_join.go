@@ -28,6 +28,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/policy"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -43,6 +44,8 @@ type Joiner struct {
 
 	Inputer *input.Inputer
 	Queryer *query.Queryer
+	// PolicyLists is nil if policy lists aren't enabled.
+	PolicyLists *policy.PolicyLists
 }
 
 // PerformJoin handles joining matrix rooms, including over federation by talking to the federationapi.
@@ -182,6 +185,19 @@ func (r *Joiner) performJoinRoomByID(
 		}
 	}
 
+	// Local users aren't allowed to join rooms which have been banned by
+	// one of the policy lists.
+	rule, blocked := r.PolicyLists.IsRoomBanned(req.RoomIDOrAlias)
+	if !blocked && domain != r.Cfg.Matrix.ServerName {
+		rule, blocked = r.PolicyLists.IsServerBanned(domain)
+	}
+	if blocked {
+		return "", "", &rsAPI.PerformError{
+			Code: rsAPI.PerformErrorNotAllowed,
+			Msg:  rule.Message("This room has been blocked by a moderation policy"),
+		}
+	}
+
 	// If the server name in the room ID isn't ours then it's a
 	// possible candidate for finding the room via federation. Add
 	// it to the list of servers to try.
@@ -0,0 +1,65 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type Reporter struct {
+	DB storage.Database
+}
+
+// PerformReportEvent implements api.RoomserverInternalAPI
+func (r *Reporter) PerformReportEvent(
+	ctx context.Context,
+	req *api.PerformReportEventRequest,
+	res *api.PerformReportEventResponse,
+) error {
+	reportID, err := r.DB.InsertReportedEvent(ctx, &types.EventReport{
+		RoomID:     req.RoomID,
+		EventID:    req.EventID,
+		ReporterID: req.ReporterID,
+		Reason:     req.Reason,
+		Score:      req.Score,
+		ReceivedTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		return fmt.Errorf("r.DB.InsertReportedEvent: %w", err)
+	}
+	res.ReportID = reportID
+	return nil
+}
+
+// PerformResolveEventReport implements api.RoomserverInternalAPI
+func (r *Reporter) PerformResolveEventReport(
+	ctx context.Context,
+	req *api.PerformResolveEventReportRequest,
+	res *api.PerformResolveEventReportResponse,
+) error {
+	resolved, err := r.DB.ResolveReportedEvent(ctx, req.ReportID, req.ResolvedBy)
+	if err != nil {
+		return fmt.Errorf("r.DB.ResolveReportedEvent: %w", err)
+	}
+	res.Resolved = resolved
+	return nil
+}
@@ -18,12 +18,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/policy"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -38,6 +40,8 @@ type Queryer struct {
 	Cache      caching.RoomServerCaches
 	ServerName gomatrixserverlib.ServerName
 	ServerACLs *acls.ServerACLs
+	// PolicyLists is nil if policy lists aren't enabled.
+	PolicyLists *policy.PolicyLists
 }
 
 // QueryLatestEventsAndState implements api.RoomserverInternalAPI
@@ -253,7 +257,7 @@ func (r *Queryer) QueryMembershipsForRoom(
 	if request.Sender == "" {
 		var events []types.Event
 		var eventNIDs []types.EventNID
-		eventNIDs, err = r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, request.JoinedOnly, false)
+		eventNIDs, err = r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, request.JoinedOnly, request.LocalOnly)
 		if err != nil {
 			return fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
 		}
@@ -315,6 +319,27 @@ func (r *Queryer) QueryMembershipsForRoom(
 	return nil
 }
 
+// QueryJoinedMemberCount implements api.RoomserverInternalAPI
+func (r *Queryer) QueryJoinedMemberCount(
+	ctx context.Context,
+	request *api.QueryJoinedMemberCountRequest,
+	response *api.QueryJoinedMemberCountResponse,
+) error {
+	info, err := r.DB.RoomInfo(ctx, request.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	response.RoomExists = true
+	response.Count, err = r.DB.GetJoinedMemberCount(ctx, info.RoomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetJoinedMemberCount: %w", err)
+	}
+	return nil
+}
+
 // QueryServerJoinedToRoom implements api.RoomserverInternalAPI
 func (r *Queryer) QueryServerJoinedToRoom(
 	ctx context.Context,
@@ -742,6 +767,96 @@ func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryS
 		return errors.New("no server ACL tracking")
 	}
 	res.Banned = r.ServerACLs.IsServerBannedFromRoom(req.ServerName, req.RoomID)
+	if !res.Banned {
+		// Servers banned by a policy list are treated as if they were
+		// denied by the ACLs of every room.
+		_, res.Banned = r.PolicyLists.IsServerBanned(req.ServerName)
+	}
+	return nil
+}
+
+func (r *Queryer) QueryRoomStatistics(ctx context.Context, req *api.QueryRoomStatisticsRequest, res *api.QueryRoomStatisticsResponse) error {
+	total, localJoined, err := r.DB.GetRoomCounts(ctx)
+	if err != nil {
+		return err
+	}
+	res.TotalRooms = total
+	res.LocalJoinedRooms = localJoined
+	return nil
+}
+
+// QueryTransactionEventID implements api.RoomserverInternalAPI
+func (r *Queryer) QueryTransactionEventID(ctx context.Context, req *api.QueryTransactionEventIDRequest, res *api.QueryTransactionEventIDResponse) error {
+	eventID, err := r.DB.GetTransactionEventID(ctx, req.TransactionID.TransactionID, req.TransactionID.SessionID, req.UserID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetTransactionEventID: %w", err)
+	}
+	res.EventID = eventID
+	return nil
+}
+
+// QueryEventReports implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventReports(ctx context.Context, req *api.QueryEventReportsRequest, res *api.QueryEventReportsResponse) error {
+	reports, total, err := r.DB.GetReportedEvents(ctx, req.RoomID, req.Resolved, req.From, req.Limit)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetReportedEvents: %w", err)
+	}
+	res.Reports = reports
+	res.Total = total
+	return nil
+}
+
+// QueryEventReport implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventReport(ctx context.Context, req *api.QueryEventReportRequest, res *api.QueryEventReportResponse) error {
+	report, err := r.DB.GetReportedEvent(ctx, req.ReportID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetReportedEvent: %w", err)
+	}
+	if report == nil {
+		return nil
+	}
+	res.Report = report
+	events, err := r.DB.EventsFromIDs(ctx, []string{report.EventID})
+	if err != nil {
+		return fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	for _, event := range events {
+		res.Event = event.Headered(event.Version())
+	}
+	return nil
+}
+
+// QueryUserRoomEvents implements api.RoomserverInternalAPI
+func (r *Queryer) QueryUserRoomEvents(ctx context.Context, req *api.QueryUserRoomEventsRequest, res *api.QueryUserRoomEventsResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	eventNIDs, err := r.DB.RoomEventNIDs(ctx, info.RoomNID, types.EventNID(req.From), req.Limit)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomEventNIDs: %w", err)
+	}
+	if len(eventNIDs) == 0 {
+		return nil
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.Events: %w", err)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].EventNID < events[j].EventNID
+	})
+	for _, event := range events {
+		if event.Sender() == req.UserID {
+			res.Events = append(res.Events, event.Headered(info.RoomVersion))
+		}
+	}
+	if len(eventNIDs) == req.Limit {
+		res.Next = int64(eventNIDs[len(eventNIDs)-1])
+	}
 	return nil
 }
 
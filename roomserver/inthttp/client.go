@@ -27,15 +27,18 @@ const (
 	RoomserverInputRoomEventsPath = "/roomserver/inputRoomEvents"
 
 	// Perform operations
-	RoomserverPerformInvitePath      = "/roomserver/performInvite"
-	RoomserverPerformPeekPath        = "/roomserver/performPeek"
-	RoomserverPerformUnpeekPath      = "/roomserver/performUnpeek"
-	RoomserverPerformJoinPath        = "/roomserver/performJoin"
-	RoomserverPerformLeavePath       = "/roomserver/performLeave"
-	RoomserverPerformBackfillPath    = "/roomserver/performBackfill"
-	RoomserverPerformPublishPath     = "/roomserver/performPublish"
-	RoomserverPerformInboundPeekPath = "/roomserver/performInboundPeek"
-	RoomserverPerformForgetPath      = "/roomserver/performForget"
+	RoomserverPerformInvitePath             = "/roomserver/performInvite"
+	RoomserverPerformPeekPath               = "/roomserver/performPeek"
+	RoomserverPerformUnpeekPath             = "/roomserver/performUnpeek"
+	RoomserverPerformJoinPath               = "/roomserver/performJoin"
+	RoomserverPerformLeavePath              = "/roomserver/performLeave"
+	RoomserverPerformBackfillPath           = "/roomserver/performBackfill"
+	RoomserverPerformPublishPath            = "/roomserver/performPublish"
+	RoomserverPerformInboundPeekPath        = "/roomserver/performInboundPeek"
+	RoomserverPerformForgetPath             = "/roomserver/performForget"
+	RoomserverPerformReportEventPath        = "/roomserver/performReportEvent"
+	RoomserverPerformResolveEventReportPath = "/roomserver/performResolveEventReport"
+	RoomserverPerformAdminPurgeRoomPath     = "/roomserver/performAdminPurgeRoom"
 
 	// Query operations
 	RoomserverQueryLatestEventsAndStatePath    = "/roomserver/queryLatestEventsAndState"
@@ -44,6 +47,7 @@ const (
 	RoomserverQueryEventsByIDPath              = "/roomserver/queryEventsByID"
 	RoomserverQueryMembershipForUserPath       = "/roomserver/queryMembershipForUser"
 	RoomserverQueryMembershipsForRoomPath      = "/roomserver/queryMembershipsForRoom"
+	RoomserverQueryJoinedMemberCountPath       = "/roomserver/queryJoinedMemberCount"
 	RoomserverQueryServerJoinedToRoomPath      = "/roomserver/queryServerJoinedToRoomPath"
 	RoomserverQueryServerAllowedToSeeEventPath = "/roomserver/queryServerAllowedToSeeEvent"
 	RoomserverQueryMissingEventsPath           = "/roomserver/queryMissingEvents"
@@ -57,7 +61,12 @@ const (
 	RoomserverQuerySharedUsersPath             = "/roomserver/querySharedUsers"
 	RoomserverQueryKnownUsersPath              = "/roomserver/queryKnownUsers"
 	RoomserverQueryServerBannedFromRoomPath    = "/roomserver/queryServerBannedFromRoom"
+	RoomserverQueryRoomStatisticsPath          = "/roomserver/queryRoomStatistics"
+	RoomserverQueryTransactionEventIDPath      = "/roomserver/queryTransactionEventID"
 	RoomserverQueryAuthChainPath               = "/roomserver/queryAuthChain"
+	RoomserverQueryEventReportsPath            = "/roomserver/queryEventReports"
+	RoomserverQueryEventReportPath             = "/roomserver/queryEventReport"
+	RoomserverQueryUserRoomEventsPath          = "/roomserver/queryUserRoomEvents"
 )
 
 type httpRoomserverInternalAPI struct {
@@ -366,6 +375,19 @@ func (h *httpRoomserverInternalAPI) QueryMembershipsForRoom(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryJoinedMemberCount implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryJoinedMemberCount(
+	ctx context.Context,
+	request *api.QueryJoinedMemberCountRequest,
+	response *api.QueryJoinedMemberCountResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryJoinedMemberCount")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryJoinedMemberCountPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMembershipsForRoom implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryServerJoinedToRoom(
 	ctx context.Context,
@@ -542,6 +564,26 @@ func (h *httpRoomserverInternalAPI) QueryServerBannedFromRoom(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
 
+func (h *httpRoomserverInternalAPI) QueryRoomStatistics(
+	ctx context.Context, req *api.QueryRoomStatisticsRequest, res *api.QueryRoomStatisticsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomStatistics")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomStatisticsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryTransactionEventID(
+	ctx context.Context, req *api.QueryTransactionEventIDRequest, res *api.QueryTransactionEventIDResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryTransactionEventID")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryTransactionEventIDPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
 func (h *httpRoomserverInternalAPI) PerformForget(ctx context.Context, req *api.PerformForgetRequest, res *api.PerformForgetResponse) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformForget")
 	defer span.Finish()
@@ -550,3 +592,63 @@ func (h *httpRoomserverInternalAPI) PerformForget(ctx context.Context, req *api.
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 
 }
+
+func (h *httpRoomserverInternalAPI) PerformReportEvent(
+	ctx context.Context, req *api.PerformReportEventRequest, res *api.PerformReportEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformReportEvent")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformReportEventPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) PerformResolveEventReport(
+	ctx context.Context, req *api.PerformResolveEventReportRequest, res *api.PerformResolveEventReportResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformResolveEventReport")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformResolveEventReportPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) PerformAdminPurgeRoom(
+	ctx context.Context, req *api.PerformAdminPurgeRoomRequest, res *api.PerformAdminPurgeRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAdminPurgeRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformAdminPurgeRoomPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventReports(
+	ctx context.Context, req *api.QueryEventReportsRequest, res *api.QueryEventReportsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventReports")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventReportsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventReport(
+	ctx context.Context, req *api.QueryEventReportRequest, res *api.QueryEventReportResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventReport")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventReportPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryUserRoomEvents(
+	ctx context.Context, req *api.QueryUserRoomEventsRequest, res *api.QueryUserRoomEventsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryUserRoomEvents")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryUserRoomEventsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
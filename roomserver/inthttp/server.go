@@ -205,6 +205,20 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(
+		RoomserverQueryJoinedMemberCountPath,
+		httputil.MakeInternalAPI("queryJoinedMemberCount", func(req *http.Request) util.JSONResponse {
+			var request api.QueryJoinedMemberCountRequest
+			var response api.QueryJoinedMemberCountResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryJoinedMemberCount(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(
 		RoomserverQueryServerJoinedToRoomPath,
 		httputil.MakeInternalAPI("queryServerJoinedToRoom", func(req *http.Request) util.JSONResponse {
@@ -465,6 +479,32 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverQueryRoomStatisticsPath,
+		httputil.MakeInternalAPI("queryRoomStatistics", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRoomStatisticsRequest{}
+			response := api.QueryRoomStatisticsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRoomStatistics(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryTransactionEventIDPath,
+		httputil.MakeInternalAPI("queryTransactionEventID", func(req *http.Request) util.JSONResponse {
+			request := api.QueryTransactionEventIDRequest{}
+			response := api.QueryTransactionEventIDResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryTransactionEventID(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(RoomserverQueryAuthChainPath,
 		httputil.MakeInternalAPI("queryAuthChain", func(req *http.Request) util.JSONResponse {
 			request := api.QueryAuthChainRequest{}
@@ -478,4 +518,82 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverPerformReportEventPath,
+		httputil.MakeInternalAPI("performReportEvent", func(req *http.Request) util.JSONResponse {
+			request := api.PerformReportEventRequest{}
+			response := api.PerformReportEventResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformReportEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformResolveEventReportPath,
+		httputil.MakeInternalAPI("performResolveEventReport", func(req *http.Request) util.JSONResponse {
+			request := api.PerformResolveEventReportRequest{}
+			response := api.PerformResolveEventReportResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformResolveEventReport(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverPerformAdminPurgeRoomPath,
+		httputil.MakeInternalAPI("performAdminPurgeRoom", func(req *http.Request) util.JSONResponse {
+			request := api.PerformAdminPurgeRoomRequest{}
+			response := api.PerformAdminPurgeRoomResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformAdminPurgeRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventReportsPath,
+		httputil.MakeInternalAPI("queryEventReports", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventReportsRequest{}
+			response := api.QueryEventReportsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventReports(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventReportPath,
+		httputil.MakeInternalAPI("queryEventReport", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventReportRequest{}
+			response := api.QueryEventReportResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventReport(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryUserRoomEventsPath,
+		httputil.MakeInternalAPI("queryUserRoomEvents", func(req *http.Request) util.JSONResponse {
+			request := api.QueryUserRoomEventsRequest{}
+			response := api.QueryUserRoomEventsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryUserRoomEvents(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
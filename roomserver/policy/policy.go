@@ -0,0 +1,229 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy tracks the rules in moderation policy rooms, as described
+// in MSC2313, so that they can be enforced by the roomserver.
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// The kinds of entities which policy rules can apply to.
+const (
+	KindUser   = "user"
+	KindServer = "server"
+	KindRoom   = "room"
+)
+
+// ruleEventTypes maps the state event types of policy rules to the kind of
+// entity they apply to. The older m.room.rule.* and org.matrix.mjolnir.rule.*
+// types are still used by some policy rooms.
+var ruleEventTypes = map[string]string{
+	"m.policy.rule.user":             KindUser,
+	"m.policy.rule.server":           KindServer,
+	"m.policy.rule.room":             KindRoom,
+	"m.room.rule.user":               KindUser,
+	"m.room.rule.server":             KindServer,
+	"m.room.rule.room":               KindRoom,
+	"org.matrix.mjolnir.rule.user":   KindUser,
+	"org.matrix.mjolnir.rule.server": KindServer,
+	"org.matrix.mjolnir.rule.room":   KindRoom,
+}
+
+// banRecommendations are the recommendations which mean that the entity
+// should be banned. Rules with any other recommendation are ignored.
+var banRecommendations = map[string]bool{
+	"m.ban":                  true,
+	"org.matrix.mjolnir.ban": true,
+}
+
+// StateQuerier is used to load the current state of the policy rooms.
+type StateQuerier interface {
+	QueryLatestEventsAndState(ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse) error
+}
+
+// Rule is a policy rule content, as described in MSC2313.
+type Rule struct {
+	Entity         string `json:"entity"`
+	Recommendation string `json:"recommendation"`
+	Reason         string `json:"reason"`
+}
+
+// Message returns msg followed by the reason for the rule, if there is one.
+func (r *Rule) Message(msg string) string {
+	if r.Reason == "" {
+		return msg
+	}
+	return msg + ": " + r.Reason
+}
+
+type rule struct {
+	Rule
+	regex *regexp.Regexp
+}
+
+// ruleKey identifies a rule by the state event which set it.
+type ruleKey struct {
+	roomID    string
+	eventType string
+	stateKey  string
+}
+
+// PolicyLists holds the rules from the policy rooms in memory. A nil
+// *PolicyLists is valid and has no rules, so that callers don't need to check
+// whether policy lists are enabled.
+type PolicyLists struct {
+	rooms      map[string]struct{}          // policy room IDs
+	rules      map[string]map[ruleKey]*rule // kind -> rules
+	rulesMutex sync.RWMutex                 // protects the above
+}
+
+// NewPolicyLists loads the rules from the given policy rooms.
+func NewPolicyLists(querier StateQuerier, roomIDs []string) *PolicyLists {
+	ctx := context.TODO()
+	p := &PolicyLists{
+		rooms: make(map[string]struct{}, len(roomIDs)),
+		rules: map[string]map[ruleKey]*rule{
+			KindUser:   {},
+			KindServer: {},
+			KindRoom:   {},
+		},
+	}
+	for _, roomID := range roomIDs {
+		p.rooms[roomID] = struct{}{}
+		var res api.QueryLatestEventsAndStateResponse
+		if err := querier.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+			RoomID: roomID,
+		}, &res); err != nil {
+			logrus.WithError(err).Errorf("Failed to get state for policy room %q", roomID)
+			continue
+		}
+		if !res.RoomExists {
+			logrus.Warnf("Policy room %q is not known to this server, its rules will not be enforced until it is joined", roomID)
+			continue
+		}
+		for _, ev := range res.StateEvents {
+			p.OnPolicyRuleUpdate(ev.Event)
+		}
+	}
+	return p
+}
+
+// IsPolicyRoom returns whether the given room is one of the policy rooms.
+func (p *PolicyLists) IsPolicyRoom(roomID string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.rooms[roomID]
+	return ok
+}
+
+// OnPolicyRuleUpdate updates the rules from a new state event. Events which
+// aren't policy rules in one of the policy rooms are ignored. A rule event
+// without a ban recommendation, for example one with empty content, removes
+// any rule previously set by the same type and state key.
+func (p *PolicyLists) OnPolicyRuleUpdate(ev *gomatrixserverlib.Event) {
+	if !p.IsPolicyRoom(ev.RoomID()) || ev.StateKey() == nil {
+		return
+	}
+	kind, ok := ruleEventTypes[ev.Type()]
+	if !ok {
+		return
+	}
+	key := ruleKey{ev.RoomID(), ev.Type(), *ev.StateKey()}
+
+	var newRule *rule
+	var content Rule
+	if err := json.Unmarshal(ev.Content(), &content); err == nil && content.Entity != "" && banRecommendations[content.Recommendation] {
+		regex, err := compileGlob(content.Entity)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to compile policy rule entity %q", content.Entity)
+		} else {
+			newRule = &rule{content, regex}
+		}
+	}
+
+	p.rulesMutex.Lock()
+	defer p.rulesMutex.Unlock()
+	if newRule == nil {
+		delete(p.rules[kind], key)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"kind":   kind,
+		"entity": content.Entity,
+		"reason": content.Reason,
+	}).Debugf("Updating policy rule from room %q", ev.RoomID())
+	p.rules[kind][key] = newRule
+}
+
+// Match returns the first rule of the given kind which matches the entity.
+func (p *PolicyLists) Match(kind, entity string) (*Rule, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.rulesMutex.RLock()
+	defer p.rulesMutex.RUnlock()
+	for _, r := range p.rules[kind] {
+		if r.regex.MatchString(entity) {
+			return &r.Rule, true
+		}
+	}
+	return nil, false
+}
+
+// IsServerBanned returns the matching rule if the server is banned.
+func (p *PolicyLists) IsServerBanned(serverName gomatrixserverlib.ServerName) (*Rule, bool) {
+	// Server rules apply to the hostname only, in the same way as server ACLs.
+	if serverNameOnly, _, err := net.SplitHostPort(string(serverName)); err == nil {
+		serverName = gomatrixserverlib.ServerName(serverNameOnly)
+	}
+	return p.Match(KindServer, string(serverName))
+}
+
+// IsUserBanned returns the matching rule if the user, or the server that
+// they belong to, is banned.
+func (p *PolicyLists) IsUserBanned(userID string) (*Rule, bool) {
+	if r, ok := p.Match(KindUser, userID); ok {
+		return r, true
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil {
+		return p.IsServerBanned(domain)
+	}
+	return nil, false
+}
+
+// IsRoomBanned returns the matching rule if the room is banned.
+func (p *PolicyLists) IsRoomBanned(roomID string) (*Rule, bool) {
+	return p.Match(KindRoom, roomID)
+}
+
+// compileGlob turns a policy rule entity into a regular expression. Only *
+// (zero or more characters) and ? (exactly one character) are wildcards.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	escaped := regexp.QuoteMeta(glob)
+	escaped = strings.Replace(escaped, "\\?", ".", -1)
+	escaped = strings.Replace(escaped, "\\*", ".*", -1)
+	return regexp.Compile("^" + escaped + "$")
+}
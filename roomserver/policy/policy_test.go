@@ -0,0 +1,149 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const policyRoomID = "!policy:test.com"
+
+var eventCount int
+
+func mustCreateRuleEvent(t *testing.T, roomID, evType, stateKey string, content interface{}) *gomatrixserverlib.Event {
+	t.Helper()
+	eventCount++
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		t.Fatalf("failed to marshal content: %s", err)
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+		`{"event_id":"$%d:test.com","room_id":%q,"type":%q,"state_key":%q,"sender":"@mod:test.com","content":%s}`,
+		eventCount, roomID, evType, stateKey, contentJSON,
+	)), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev
+}
+
+type fakeStateQuerier struct {
+	events []*gomatrixserverlib.Event
+}
+
+func (q *fakeStateQuerier) QueryLatestEventsAndState(
+	ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse,
+) error {
+	if req.RoomID != policyRoomID {
+		return nil
+	}
+	res.RoomExists = true
+	for _, ev := range q.events {
+		res.StateEvents = append(res.StateEvents, ev.Headered(gomatrixserverlib.RoomVersionV1))
+	}
+	return nil
+}
+
+func TestPolicyListsLoadRulesFromState(t *testing.T) {
+	querier := &fakeStateQuerier{
+		events: []*gomatrixserverlib.Event{
+			mustCreateRuleEvent(t, policyRoomID, "m.policy.rule.user", "rule1", Rule{
+				Entity: "@spammer:*", Recommendation: "m.ban", Reason: "spam",
+			}),
+			mustCreateRuleEvent(t, policyRoomID, "m.room.rule.server", "rule2", Rule{
+				Entity: "evil.com", Recommendation: "m.ban",
+			}),
+			mustCreateRuleEvent(t, policyRoomID, "org.matrix.mjolnir.rule.room", "rule3", Rule{
+				Entity: "!bad:*", Recommendation: "org.matrix.mjolnir.ban",
+			}),
+			mustCreateRuleEvent(t, policyRoomID, "m.policy.rule.user", "rule4", Rule{
+				Entity: "@someone:test.com", Recommendation: "m.something_else",
+			}),
+			mustCreateRuleEvent(t, policyRoomID, "m.room.name", "", map[string]string{
+				"name": "Policy room",
+			}),
+		},
+	}
+	p := NewPolicyLists(querier, []string{policyRoomID, "!unknown:test.com"})
+
+	if rule, ok := p.IsUserBanned("@spammer:somewhere.com"); !ok || rule.Reason != "spam" {
+		t.Fatalf("Expected @spammer:somewhere.com to be banned for spam")
+	}
+	if _, ok := p.IsUserBanned("@alice:evil.com"); !ok {
+		t.Fatalf("Expected @alice:evil.com to be banned because of their server")
+	}
+	if _, ok := p.IsUserBanned("@someone:test.com"); ok {
+		t.Fatalf("Expected @someone:test.com to be allowed as the rule isn't a ban")
+	}
+	if _, ok := p.IsServerBanned("evil.com:8448"); !ok {
+		t.Fatalf("Expected evil.com:8448 to be banned")
+	}
+	if _, ok := p.IsServerBanned("notevil.com"); ok {
+		t.Fatalf("Expected notevil.com to be allowed")
+	}
+	if _, ok := p.IsRoomBanned("!bad:test.com"); !ok {
+		t.Fatalf("Expected !bad:test.com to be banned")
+	}
+	if _, ok := p.IsRoomBanned("!good:test.com"); ok {
+		t.Fatalf("Expected !good:test.com to be allowed")
+	}
+}
+
+func TestPolicyListsUpdateRules(t *testing.T) {
+	p := NewPolicyLists(&fakeStateQuerier{}, []string{policyRoomID})
+
+	// Rules from rooms which aren't policy rooms are ignored.
+	p.OnPolicyRuleUpdate(mustCreateRuleEvent(t, "!other:test.com", "m.policy.rule.user", "rule", Rule{
+		Entity: "@bob:test.com", Recommendation: "m.ban",
+	}))
+	if _, ok := p.IsUserBanned("@bob:test.com"); ok {
+		t.Fatalf("Expected rule from a room which isn't a policy room to be ignored")
+	}
+
+	p.OnPolicyRuleUpdate(mustCreateRuleEvent(t, policyRoomID, "m.policy.rule.user", "rule", Rule{
+		Entity: "@bob:test.com", Recommendation: "m.ban",
+	}))
+	if _, ok := p.IsUserBanned("@bob:test.com"); !ok {
+		t.Fatalf("Expected @bob:test.com to be banned after the rule was added")
+	}
+
+	// Replacing the rule with empty content removes it.
+	p.OnPolicyRuleUpdate(mustCreateRuleEvent(t, policyRoomID, "m.policy.rule.user", "rule", struct{}{}))
+	if _, ok := p.IsUserBanned("@bob:test.com"); ok {
+		t.Fatalf("Expected @bob:test.com to be allowed after the rule was removed")
+	}
+}
+
+func TestNilPolicyListsAllowEverything(t *testing.T) {
+	var p *PolicyLists
+	if p.IsPolicyRoom(policyRoomID) {
+		t.Fatalf("Expected nil policy lists to have no policy rooms")
+	}
+	if _, ok := p.IsUserBanned("@bob:test.com"); ok {
+		t.Fatalf("Expected nil policy lists to allow all users")
+	}
+	if _, ok := p.IsServerBanned("test.com"); ok {
+		t.Fatalf("Expected nil policy lists to allow all servers")
+	}
+	if _, ok := p.IsRoomBanned("!room:test.com"); ok {
+		t.Fatalf("Expected nil policy lists to allow all rooms")
+	}
+}
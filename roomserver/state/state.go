@@ -39,19 +39,18 @@ type StateResolutionStorage interface {
 	StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error)
 	AddState(ctx context.Context, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry) (types.StateSnapshotNID, error)
 	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+	StateEvents(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
 }
 
 type StateResolution struct {
 	db       StateResolutionStorage
 	roomInfo *types.RoomInfo
-	events   map[types.EventNID]*gomatrixserverlib.Event
 }
 
 func NewStateResolution(db StateResolutionStorage, roomInfo *types.RoomInfo) StateResolution {
 	return StateResolution{
 		db:       db,
 		roomInfo: roomInfo,
-		events:   make(map[types.EventNID]*gomatrixserverlib.Event),
 	}
 }
 
@@ -954,29 +953,22 @@ func (v *StateResolution) loadStateEvents(
 	ctx context.Context, entries []types.StateEntry,
 ) ([]*gomatrixserverlib.Event, map[string]types.StateEntry, error) {
 	result := make([]*gomatrixserverlib.Event, 0, len(entries))
-	eventEntries := make([]types.StateEntry, 0, len(entries))
 	eventNIDs := make([]types.EventNID, 0, len(entries))
 	for _, entry := range entries {
-		if e, ok := v.events[entry.EventNID]; ok {
-			result = append(result, e)
-		} else {
-			eventEntries = append(eventEntries, entry)
-			eventNIDs = append(eventNIDs, entry.EventNID)
-		}
+		eventNIDs = append(eventNIDs, entry.EventNID)
 	}
-	events, err := v.db.Events(ctx, eventNIDs)
+	events, err := v.db.StateEvents(ctx, eventNIDs)
 	if err != nil {
 		return nil, nil, err
 	}
 	eventIDMap := map[string]types.StateEntry{}
-	for _, entry := range eventEntries {
+	for _, entry := range entries {
 		event, ok := eventMap(events).lookup(entry.EventNID)
 		if !ok {
 			panic(fmt.Errorf("corrupt DB: Missing event numeric ID %d", entry.EventNID))
 		}
 		result = append(result, event.Event)
 		eventIDMap[event.Event.EventID()] = entry
-		v.events[entry.EventNID] = event.Event
 	}
 	return result, eventIDMap, nil
 }
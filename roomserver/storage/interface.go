@@ -64,6 +64,10 @@ type Database interface {
 	// Look up the Events for a list of numeric event IDs.
 	// Returns a sorted list of events.
 	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+	// Look up the Events for a list of numeric event IDs, for resolving and
+	// authing state only, as they may be cached from before a redaction.
+	// Returns a sorted list of events.
+	StateEvents(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
 	// Look up snapshot NID for an event ID string
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
 	// Stores a matrix room event in the database. Returns the room NID, the state snapshot and the redacted event ID if any, or an error.
@@ -148,6 +152,8 @@ type Database interface {
 	GetBulkStateContent(ctx context.Context, roomIDs []string, tuples []gomatrixserverlib.StateKeyTuple, allowWildcards bool) ([]tables.StrippedEvent, error)
 	// JoinedUsersSetInRooms returns all joined users in the rooms given, along with the count of how many times they appear.
 	JoinedUsersSetInRooms(ctx context.Context, roomIDs []string) (map[string]int, error)
+	// GetJoinedMemberCount returns the number of users who are joined to the room.
+	GetJoinedMemberCount(ctx context.Context, roomNID types.RoomNID) (int, error)
 	// GetLocalServerInRoom returns true if we think we're in a given room or false otherwise.
 	GetLocalServerInRoom(ctx context.Context, roomNID types.RoomNID) (bool, error)
 	// GetServerInRoom returns true if we think a server is in a given room or false otherwise.
@@ -156,6 +162,27 @@ type Database interface {
 	GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error)
 	// GetKnownRooms returns a list of all rooms we know about.
 	GetKnownRooms(ctx context.Context) ([]string, error)
+	// GetRoomCounts returns the number of rooms we know about and the number of those
+	// rooms that at least one local user is joined to.
+	GetRoomCounts(ctx context.Context) (total, localJoined int64, err error)
 	// ForgetRoom sets a flag in the membership table, that the user wishes to forget a specific room
 	ForgetRoom(ctx context.Context, userID, roomID string, forget bool) error
+	// GetTransactionEventID returns the ID of the event sent with the given transaction ID,
+	// or an empty string if there is no such transaction.
+	GetTransactionEventID(ctx context.Context, transactionID string, sessionID int64, userID string) (string, error)
+	// PurgeRoom deletes the room and everything which is stored about it. Returns false if the room doesn't exist.
+	PurgeRoom(ctx context.Context, roomID string) (bool, error)
+	// InsertReportedEvent stores a report of an event made by a user, returning the ID of the new report.
+	InsertReportedEvent(ctx context.Context, report *types.EventReport) (int64, error)
+	// GetReportedEvents returns a page of event reports, newest first, and the total number of reports
+	// matching the filters. An empty room ID matches all rooms, and a nil resolved matches all reports.
+	GetReportedEvents(ctx context.Context, roomID string, resolved *bool, from int64, limit int) ([]types.EventReport, int64, error)
+	// GetReportedEvent returns the event report with the given ID, or nil if there is no such report.
+	GetReportedEvent(ctx context.Context, reportID int64) (*types.EventReport, error)
+	// ResolveReportedEvent marks an event report as resolved by the given user. Returns false if
+	// the report doesn't exist or was already resolved.
+	ResolveReportedEvent(ctx context.Context, reportID int64, resolvedBy string) (bool, error)
+	// RoomEventNIDs returns up to limit event NIDs in the room after the given event NID, oldest
+	// first, for going through the whole history of a room.
+	RoomEventNIDs(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
 }
@@ -142,6 +142,16 @@ const selectServerInRoomSQL = "" +
 	" JOIN roomserver_event_state_keys ON roomserver_membership.target_nid = roomserver_event_state_keys.event_state_key_nid" +
 	" WHERE membership_nid = $1 AND room_nid = $2 AND event_state_key LIKE '%:' || $3 LIMIT 1"
 
+// selectLocalJoinedRoomCountSQL counts the rooms that at least one local user
+// is joined to, using the target_local column of the membership table.
+const selectLocalJoinedRoomCountSQL = "" +
+	"SELECT COUNT(DISTINCT room_nid) FROM roomserver_membership WHERE target_local = true AND membership_nid = $1"
+
+// selectJoinedMemberCountSQL counts the users who are joined to a room,
+// without loading their membership events.
+const selectJoinedMemberCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_membership WHERE room_nid = $1 AND membership_nid = $2"
+
 type membershipStatements struct {
 	insertMembershipStmt                            *sql.Stmt
 	selectMembershipForUpdateStmt                   *sql.Stmt
@@ -157,6 +167,8 @@ type membershipStatements struct {
 	updateMembershipForgetRoomStmt                  *sql.Stmt
 	selectLocalServerInRoomStmt                     *sql.Stmt
 	selectServerInRoomStmt                          *sql.Stmt
+	selectLocalJoinedRoomCountStmt                  *sql.Stmt
+	selectJoinedMemberCountStmt                     *sql.Stmt
 }
 
 func createMembershipTable(db *sql.DB) error {
@@ -182,6 +194,8 @@ func prepareMembershipTable(db *sql.DB) (tables.Membership, error) {
 		{&s.updateMembershipForgetRoomStmt, updateMembershipForgetRoom},
 		{&s.selectLocalServerInRoomStmt, selectLocalServerInRoomSQL},
 		{&s.selectServerInRoomStmt, selectServerInRoomSQL},
+		{&s.selectLocalJoinedRoomCountStmt, selectLocalJoinedRoomCountSQL},
+		{&s.selectJoinedMemberCountStmt, selectJoinedMemberCountSQL},
 	}.Prepare(db)
 }
 
@@ -392,3 +406,19 @@ func (s *membershipStatements) SelectServerInRoom(
 	}
 	return roomNID == nid, nil
 }
+
+func (s *membershipStatements) SelectLocalJoinedRoomCount(
+	ctx context.Context, txn *sql.Tx,
+) (count int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectLocalJoinedRoomCountStmt)
+	err = stmt.QueryRowContext(ctx, tables.MembershipStateJoin).Scan(&count)
+	return
+}
+
+func (s *membershipStatements) SelectJoinedMemberCount(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (count int, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectJoinedMemberCountStmt)
+	err = stmt.QueryRowContext(ctx, roomNID, tables.MembershipStateJoin).Scan(&count)
+	return
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The statements are run in this order, so that the events of the room can
+// still be found while deleting the rows which refer to them. State blocks
+// only contain the events of a single room, so the ones which the snapshots
+// of the room refer to can't be used by other rooms.
+const purgeEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid = ANY(" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1)"
+
+const purgePreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE event_nids && ARRAY(" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1)"
+
+const purgeRedactionsSQL = "" +
+	"DELETE FROM roomserver_redactions WHERE redaction_event_id = ANY(" +
+	"SELECT event_id FROM roomserver_events WHERE room_nid = $1)"
+
+const purgeTransactionsSQL = "" +
+	"DELETE FROM roomserver_transactions WHERE event_id = ANY(" +
+	"SELECT event_id FROM roomserver_events WHERE room_nid = $1)"
+
+const purgeEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE room_nid = $1"
+
+const purgeStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid = ANY(" +
+	"SELECT DISTINCT UNNEST(state_block_nids) FROM roomserver_state_snapshots WHERE room_nid = $1)"
+
+const purgeStateSnapshotsSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeInvitesSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
+const purgeMembershipsSQL = "" +
+	"DELETE FROM roomserver_membership WHERE room_nid = $1"
+
+const purgeRoomSQL = "" +
+	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
+
+const purgeRoomAliasesSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
+
+const purgePublishedSQL = "" +
+	"DELETE FROM roomserver_published WHERE room_id = $1"
+
+const purgeReportedEventsSQL = "" +
+	"DELETE FROM roomserver_reported_events WHERE room_id = $1"
+
+type purgeStatements struct {
+	purgeEventJSONStmt      *sql.Stmt
+	purgePreviousEventsStmt *sql.Stmt
+	purgeRedactionsStmt     *sql.Stmt
+	purgeTransactionsStmt   *sql.Stmt
+	purgeEventsStmt         *sql.Stmt
+	purgeStateBlocksStmt    *sql.Stmt
+	purgeStateSnapshotsStmt *sql.Stmt
+	purgeInvitesStmt        *sql.Stmt
+	purgeMembershipsStmt    *sql.Stmt
+	purgeRoomStmt           *sql.Stmt
+	purgeRoomAliasesStmt    *sql.Stmt
+	purgePublishedStmt      *sql.Stmt
+	purgeReportedEventsStmt *sql.Stmt
+}
+
+func preparePurgeStatements(db *sql.DB) (tables.Purge, error) {
+	s := &purgeStatements{}
+	return s, sqlutil.StatementList{
+		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
+		{&s.purgePreviousEventsStmt, purgePreviousEventsSQL},
+		{&s.purgeRedactionsStmt, purgeRedactionsSQL},
+		{&s.purgeTransactionsStmt, purgeTransactionsSQL},
+		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.purgeStateBlocksStmt, purgeStateBlocksSQL},
+		{&s.purgeStateSnapshotsStmt, purgeStateSnapshotsSQL},
+		{&s.purgeInvitesStmt, purgeInvitesSQL},
+		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.purgeRoomStmt, purgeRoomSQL},
+		{&s.purgeRoomAliasesStmt, purgeRoomAliasesSQL},
+		{&s.purgePublishedStmt, purgePublishedSQL},
+		{&s.purgeReportedEventsStmt, purgeReportedEventsSQL},
+	}.Prepare(db)
+}
+
+func (s *purgeStatements) PurgeRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string,
+) error {
+	for _, stmt := range []*sql.Stmt{
+		s.purgeEventJSONStmt, s.purgePreviousEventsStmt, s.purgeRedactionsStmt,
+		s.purgeTransactionsStmt, s.purgeEventsStmt, s.purgeStateBlocksStmt,
+		s.purgeStateSnapshotsStmt, s.purgeInvitesStmt, s.purgeMembershipsStmt,
+		s.purgeRoomStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomNID); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range []*sql.Stmt{
+		s.purgeRoomAliasesStmt, s.purgePublishedStmt, s.purgeReportedEventsStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
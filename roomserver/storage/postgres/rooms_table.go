@@ -76,6 +76,9 @@ const selectRoomInfoSQL = "" +
 const selectRoomIDsSQL = "" +
 	"SELECT room_id FROM roomserver_rooms WHERE array_length(latest_event_nids, 1) > 0"
 
+const selectRoomCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_rooms WHERE array_length(latest_event_nids, 1) > 0"
+
 const bulkSelectRoomIDsSQL = "" +
 	"SELECT room_id FROM roomserver_rooms WHERE room_nid = ANY($1)"
 
@@ -91,6 +94,7 @@ type roomStatements struct {
 	selectRoomVersionsForRoomNIDsStmt  *sql.Stmt
 	selectRoomInfoStmt                 *sql.Stmt
 	selectRoomIDsStmt                  *sql.Stmt
+	selectRoomCountStmt                *sql.Stmt
 	bulkSelectRoomIDsStmt              *sql.Stmt
 	bulkSelectRoomNIDsStmt             *sql.Stmt
 }
@@ -112,6 +116,7 @@ func prepareRoomsTable(db *sql.DB) (tables.Rooms, error) {
 		{&s.selectRoomVersionsForRoomNIDsStmt, selectRoomVersionsForRoomNIDsSQL},
 		{&s.selectRoomInfoStmt, selectRoomInfoSQL},
 		{&s.selectRoomIDsStmt, selectRoomIDsSQL},
+		{&s.selectRoomCountStmt, selectRoomCountSQL},
 		{&s.bulkSelectRoomIDsStmt, bulkSelectRoomIDsSQL},
 		{&s.bulkSelectRoomNIDsStmt, bulkSelectRoomNIDsSQL},
 	}.Prepare(db)
@@ -144,6 +149,12 @@ func (s *roomStatements) InsertRoomNID(
 	return types.RoomNID(roomNID), err
 }
 
+func (s *roomStatements) SelectRoomCount(ctx context.Context, txn *sql.Tx) (count int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomCountStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&count)
+	return
+}
+
 func (s *roomStatements) SelectRoomInfo(ctx context.Context, txn *sql.Tx, roomID string) (*types.RoomInfo, error) {
 	var info types.RoomInfo
 	var latestNIDs pq.Int64Array
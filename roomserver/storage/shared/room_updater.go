@@ -115,6 +115,12 @@ func (u *RoomUpdater) Events(
 	return u.d.events(ctx, u.txn, eventNIDs)
 }
 
+func (u *RoomUpdater) StateEvents(
+	ctx context.Context, eventNIDs []types.EventNID,
+) ([]types.Event, error) {
+	return u.d.stateEvents(ctx, u.txn, eventNIDs)
+}
+
 func (u *RoomUpdater) SnapshotNIDFromEventID(
 	ctx context.Context, eventID string,
 ) (types.StateSnapshotNID, error) {
@@ -257,6 +263,20 @@ func (u *RoomUpdater) MarkEventAsSent(eventNID types.EventNID) error {
 	})
 }
 
+// GetTransactionEventID returns the ID of the event sent with the given
+// transaction ID, or an empty string if there is no such transaction.
+func (u *RoomUpdater) GetTransactionEventID(transactionID string, sessionID int64, userID string) (string, error) {
+	return u.d.TransactionsTable.SelectTransactionEventID(u.ctx, u.txn, transactionID, sessionID, userID)
+}
+
+// StoreTransaction stores the ID of the event sent with the given transaction
+// ID, so that the transaction can be recognised if it is retried.
+func (u *RoomUpdater) StoreTransaction(transactionID string, sessionID int64, userID, eventID string) error {
+	return u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
+		return u.d.TransactionsTable.InsertTransaction(u.ctx, txn, transactionID, sessionID, userID, eventID)
+	})
+}
+
 func (u *RoomUpdater) MembershipUpdater(targetUserNID types.EventStateKeyNID, targetLocal bool) (*MembershipUpdater, error) {
 	return u.d.membershipUpdaterTxn(u.ctx, u.txn, u.roomInfo.RoomNID, targetUserNID, targetLocal)
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -42,6 +43,9 @@ type Database struct {
 	MembershipTable     tables.Membership
 	PublishedTable      tables.Published
 	RedactionsTable     tables.Redactions
+	ReportedEventsTable tables.ReportedEvents
+	TransactionsTable   tables.Transactions
+	Purge               tables.Purge
 	GetRoomUpdaterFn    func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
 }
 
@@ -440,6 +444,45 @@ func (d *Database) Events(
 	return d.events(ctx, nil, eventNIDs)
 }
 
+// StateEvents looks up the events for a list of numeric event IDs, keeping
+// them in a cache which is shared between state resolutions. Cached events
+// aren't updated if they are redacted later, which is fine for resolving and
+// authing state as redaction keeps every key which that looks at, but means
+// that this mustn't be used for anything else.
+func (d *Database) StateEvents(
+	ctx context.Context, eventNIDs []types.EventNID,
+) ([]types.Event, error) {
+	return d.stateEvents(ctx, nil, eventNIDs)
+}
+
+func (d *Database) stateEvents(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) ([]types.Event, error) {
+	results := make([]types.Event, 0, len(eventNIDs))
+	missing := make([]types.EventNID, 0, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		if event, ok := d.Cache.GetRoomServerStateEvent(eventNID); ok {
+			results = append(results, types.Event{EventNID: eventNID, Event: event})
+		} else {
+			missing = append(missing, eventNID)
+		}
+	}
+	if len(missing) > 0 {
+		events, err := d.events(ctx, txn, missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			d.Cache.StoreRoomServerStateEvent(event.EventNID, event.Event)
+		}
+		results = append(results, events...)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].EventNID < results[j].EventNID
+	})
+	return results, nil
+}
+
 func (d *Database) events(
 	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
 ) ([]types.Event, error) {
@@ -612,6 +655,11 @@ func (d *Database) storeEvent(
 		if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
 			return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
 		}
+		if event.StateKey() != nil {
+			// SQLite reuses the numeric IDs of events whose transactions were
+			// rolled back, so replace anything cached under this one.
+			d.Cache.StoreRoomServerStateEvent(eventNID, event)
+		}
 		if !isRejected { // ignore rejected redaction events
 			redactionEvent, redactedEventID, err = d.handleRedactions(ctx, txn, eventNID, event)
 			if err != nil {
@@ -770,8 +818,9 @@ func extractRoomVersionFromCreateEvent(event *gomatrixserverlib.Event) (
 // "servers should not apply or send redactions to clients until both the redaction event and original event have been seen, and are valid."
 // https://matrix.org/docs/spec/rooms/v3#authorization-rules-for-events
 // These cases are:
-//  - This is a redaction event, redact the event it references if we know about it.
-//  - This is a normal event which may have been previously redacted.
+//   - This is a redaction event, redact the event it references if we know about it.
+//   - This is a normal event which may have been previously redacted.
+//
 // In the first case, check if we have the referenced event then apply the redaction, else store it
 // in the redactions table with validated=FALSE. In the second case, check if there is a redaction for it:
 // if there is then apply the redactions and set validated=TRUE.
@@ -1128,6 +1177,11 @@ func (d *Database) JoinedUsersSetInRooms(ctx context.Context, roomIDs []string)
 	return result, nil
 }
 
+// GetJoinedMemberCount returns the number of users who are joined to the room.
+func (d *Database) GetJoinedMemberCount(ctx context.Context, roomNID types.RoomNID) (int, error) {
+	return d.MembershipTable.SelectJoinedMemberCount(ctx, nil, roomNID)
+}
+
 // GetLocalServerInRoom returns true if we think we're in a given room or false otherwise.
 func (d *Database) GetLocalServerInRoom(ctx context.Context, roomNID types.RoomNID) (bool, error) {
 	return d.MembershipTable.SelectLocalServerInRoom(ctx, nil, roomNID)
@@ -1152,6 +1206,16 @@ func (d *Database) GetKnownRooms(ctx context.Context) ([]string, error) {
 	return d.RoomsTable.SelectRoomIDs(ctx, nil)
 }
 
+// GetRoomCounts returns the number of rooms we know about and the number of those
+// rooms that at least one local user is joined to.
+func (d *Database) GetRoomCounts(ctx context.Context) (total, localJoined int64, err error) {
+	if total, err = d.RoomsTable.SelectRoomCount(ctx, nil); err != nil {
+		return
+	}
+	localJoined, err = d.MembershipTable.SelectLocalJoinedRoomCount(ctx, nil)
+	return
+}
+
 // ForgetRoom sets a users room to forgotten
 func (d *Database) ForgetRoom(ctx context.Context, userID, roomID string, forget bool) error {
 	roomNIDs, err := d.RoomsTable.BulkSelectRoomNIDs(ctx, nil, []string{roomID})
@@ -1171,6 +1235,75 @@ func (d *Database) ForgetRoom(ctx context.Context, userID, roomID string, forget
 	})
 }
 
+// GetTransactionEventID returns the ID of the event sent with the given
+// transaction ID, or an empty string if there is no such transaction.
+func (d *Database) GetTransactionEventID(
+	ctx context.Context, transactionID string, sessionID int64, userID string,
+) (string, error) {
+	return d.TransactionsTable.SelectTransactionEventID(ctx, nil, transactionID, sessionID, userID)
+}
+
+// PurgeRoom deletes the room and everything which is stored about it. Returns
+// false if the room doesn't exist.
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) (purged bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		// Look the room up in the database rather than the cache, so that a room
+		// which has already been purged isn't found again.
+		roomInfo, err := d.RoomsTable.SelectRoomInfo(ctx, txn, roomID)
+		if err != nil {
+			return fmt.Errorf("d.RoomsTable.SelectRoomInfo: %w", err)
+		}
+		if roomInfo == nil {
+			return nil
+		}
+		if err = d.Purge.PurgeRoom(ctx, txn, roomInfo.RoomNID, roomID); err != nil {
+			return fmt.Errorf("d.Purge.PurgeRoom: %w", err)
+		}
+		purged = true
+		return nil
+	})
+	if purged {
+		d.Cache.InvalidateRoomInfo(roomID)
+	}
+	return
+}
+
+// InsertReportedEvent stores a report of an event made by a user, returning
+// the ID of the new report.
+func (d *Database) InsertReportedEvent(ctx context.Context, report *types.EventReport) (reportID int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		reportID, err = d.ReportedEventsTable.InsertReportedEvent(ctx, txn, report)
+		return err
+	})
+	return
+}
+
+// GetReportedEvents returns a page of event reports, newest first, along with
+// the total number of reports matching the filters.
+func (d *Database) GetReportedEvents(
+	ctx context.Context, roomID string, resolved *bool, from int64, limit int,
+) ([]types.EventReport, int64, error) {
+	return d.ReportedEventsTable.SelectReportedEvents(ctx, nil, roomID, resolved, from, limit)
+}
+
+// GetReportedEvent returns the event report with the given ID, or nil if there
+// is no such report.
+func (d *Database) GetReportedEvent(ctx context.Context, reportID int64) (*types.EventReport, error) {
+	return d.ReportedEventsTable.SelectReportedEvent(ctx, nil, reportID)
+}
+
+// ResolveReportedEvent marks an event report as resolved. Returns false if the
+// report doesn't exist or was already resolved.
+func (d *Database) ResolveReportedEvent(ctx context.Context, reportID int64, resolvedBy string) (resolved bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		resolved, err = d.ReportedEventsTable.UpdateReportedEventResolved(
+			ctx, txn, reportID, gomatrixserverlib.AsTimestamp(time.Now()), resolvedBy,
+		)
+		return err
+	})
+	return
+}
+
 // FIXME TODO: Remove all this - horrible dupe with roomserver/state. Can't use the original impl because of circular loops
 // it should live in this package!
 
@@ -1232,3 +1365,11 @@ func (s stateEntryByStateKeySorter) Less(i, j int) bool {
 	return s[i].StateKeyTuple.LessThan(s[j].StateKeyTuple)
 }
 func (s stateEntryByStateKeySorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// RoomEventNIDs returns up to limit event NIDs in the room after the given
+// event NID, oldest first.
+func (d *Database) RoomEventNIDs(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectRoomEventNIDs(ctx, nil, roomNID, afterEventNID, limit)
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestSelectRoomEventNIDs(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	if err = createEventsTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	tab, err := prepareEventsTable(db)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+
+	// Room 1 has four events, one of which was rejected, and room 2 has one.
+	var want []types.EventNID
+	for i, roomNID := range []types.RoomNID{1, 2, 1, 1, 1} {
+		rejected := i == 3
+		eventNID, _, err := tab.InsertEvent(ctx, nil, roomNID, 1, 0, fmt.Sprintf("$event%d", i), []byte{byte(i)}, nil, int64(i), rejected)
+		if err != nil {
+			t.Fatalf("failed to insert event: %s", err)
+		}
+		if roomNID == 1 && !rejected {
+			want = append(want, eventNID)
+		}
+	}
+
+	got, err := tab.SelectRoomEventNIDs(ctx, nil, 1, 0, 2)
+	if err != nil {
+		t.Fatalf("failed to select events: %s", err)
+	}
+	if !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("got %v, want %v", got, want[:2])
+	}
+	got, err = tab.SelectRoomEventNIDs(ctx, nil, 1, got[1], 2)
+	if err != nil {
+		t.Fatalf("failed to select events: %s", err)
+	}
+	if !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("got %v, want %v", got, want[2:])
+	}
+}
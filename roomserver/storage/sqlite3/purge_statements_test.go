@@ -0,0 +1,134 @@
+package sqlite3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestPurgeRoom(t *testing.T) {
+	ctx := context.Background()
+	cache, err := caching.NewInMemoryLRUCache(&config.Cache{}, false)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	// The state blocks are deleted with statements prepared during the purge,
+	// which don't see the tables of an in-memory database.
+	dir, err := ioutil.TempDir("", "purge")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	db, err := Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "roomserver.db")),
+	}, cache)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	events := map[string][]string{
+		"!purged:test": {
+			`{"event_id":"$create1:test","room_id":"!purged:test","type":"m.room.create","state_key":"","sender":"@alice:test","content":{"creator":"@alice:test"}}`,
+			`{"event_id":"$message1:test","room_id":"!purged:test","type":"m.room.message","sender":"@alice:test","content":{"body":"hello"},"prev_events":[["$create1:test",{}]]}`,
+		},
+		"!kept:test": {
+			`{"event_id":"$create2:test","room_id":"!kept:test","type":"m.room.create","state_key":"","sender":"@alice:test","content":{"creator":"@alice:test"}}`,
+		},
+	}
+	for roomID, roomEvents := range events {
+		var roomNID types.RoomNID
+		var state []types.StateEntry
+		for _, eventJSON := range roomEvents {
+			ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+			if err != nil {
+				t.Fatalf("failed to create event: %s", err)
+			}
+			var stateAtEvent types.StateAtEvent
+			if _, roomNID, stateAtEvent, _, _, err = db.StoreEvent(ctx, ev, nil, false); err != nil {
+				t.Fatalf("failed to store event: %s", err)
+			}
+			if ev.StateKey() != nil {
+				state = append(state, stateAtEvent.StateEntry)
+			}
+		}
+		if _, err = db.AddState(ctx, roomNID, nil, state); err != nil {
+			t.Fatalf("failed to add state: %s", err)
+		}
+		if err = db.SetRoomAlias(ctx, "#"+roomID[1:], roomID, "@alice:test"); err != nil {
+			t.Fatalf("failed to set alias: %s", err)
+		}
+	}
+
+	purged, err := db.PurgeRoom(ctx, "!purged:test")
+	if err != nil {
+		t.Fatalf("failed to purge room: %s", err)
+	}
+	if !purged {
+		t.Fatalf("expected the room to be purged")
+	}
+	if purged, err = db.PurgeRoom(ctx, "!unknown:test"); err != nil || purged {
+		t.Fatalf("expected an unknown room not to be purged (err %v)", err)
+	}
+
+	tests := []struct {
+		roomID   string
+		eventIDs []string
+		exists   bool
+	}{
+		{"!purged:test", []string{"$create1:test", "$message1:test"}, false},
+		{"!kept:test", []string{"$create2:test"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.roomID, func(t *testing.T) {
+			info, err := db.RoomInfo(ctx, tt.roomID)
+			if err != nil {
+				t.Fatalf("failed to get room info: %s", err)
+			}
+			if got := info != nil; got != tt.exists {
+				t.Errorf("room exists: got %v, want %v", got, tt.exists)
+			}
+			nids, err := db.EventNIDs(ctx, tt.eventIDs)
+			if err != nil {
+				t.Fatalf("failed to get event NIDs: %s", err)
+			}
+			want := 0
+			if tt.exists {
+				want = len(tt.eventIDs)
+			}
+			if len(nids) != want {
+				t.Errorf("events: got %v, want %v", len(nids), want)
+			}
+			roomID, err := db.GetRoomIDForAlias(ctx, "#"+tt.roomID[1:])
+			if err != nil {
+				t.Fatalf("failed to get alias: %s", err)
+			}
+			if got := roomID != ""; got != tt.exists {
+				t.Errorf("alias exists: got %v, want %v", got, tt.exists)
+			}
+		})
+	}
+
+	// Only the kept room's state should be left.
+	for table, want := range map[string]int{
+		"roomserver_state_snapshots": 1,
+		"roomserver_state_block":     1,
+		"roomserver_event_json":      1,
+		"roomserver_previous_events": 0,
+	} {
+		var got int
+		if err = db.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&got); err != nil {
+			t.Fatalf("failed to count rows of %s: %s", table, err)
+		}
+		if got != want {
+			t.Errorf("%s: got %v rows, want %v", table, got, want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const reportedEventsSchema = `
+-- Stores reports of events made by users, for server admins to review
+CREATE TABLE IF NOT EXISTS roomserver_reported_events (
+    -- The ID of the report
+    report_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- The room ID of the room containing the reported event
+    room_id TEXT NOT NULL,
+    -- The event ID of the reported event
+    event_id TEXT NOT NULL,
+    -- The user ID of the user who made the report
+    reporter_id TEXT NOT NULL,
+    -- The reason given by the user, if any
+    reason TEXT NOT NULL DEFAULT '',
+    -- The score given by the user from -100 (most offensive) to 0, if any
+    score BIGINT,
+    -- When the report was received
+    received_ts BIGINT NOT NULL,
+    -- When the report was resolved by an admin, or 0 if it hasn't been yet
+    resolved_ts BIGINT NOT NULL DEFAULT 0,
+    -- Who resolved the report
+    resolved_by TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS roomserver_reported_events_room_id_idx ON roomserver_reported_events (room_id);
+`
+
+const insertReportedEventSQL = "" +
+	"INSERT INTO roomserver_reported_events (room_id, event_id, reporter_id, reason, score, received_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectReportedEventColumns = "" +
+	"report_id, room_id, event_id, reporter_id, reason, score, received_ts, resolved_ts, resolved_by"
+
+const selectReportedEventSQL = "" +
+	"SELECT " + selectReportedEventColumns + " FROM roomserver_reported_events WHERE report_id = $1"
+
+const updateReportedEventResolvedSQL = "" +
+	"UPDATE roomserver_reported_events SET resolved_ts = $1, resolved_by = $2" +
+	" WHERE report_id = $3 AND resolved_ts = 0"
+
+type reportedEventsStatements struct {
+	db                              *sql.DB
+	insertReportedEventStmt         *sql.Stmt
+	selectReportedEventStmt         *sql.Stmt
+	updateReportedEventResolvedStmt *sql.Stmt
+}
+
+func createReportedEventsTable(db *sql.DB) error {
+	_, err := db.Exec(reportedEventsSchema)
+	return err
+}
+
+func prepareReportedEventsTable(db *sql.DB) (tables.ReportedEvents, error) {
+	s := &reportedEventsStatements{
+		db: db,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertReportedEventStmt, insertReportedEventSQL},
+		{&s.selectReportedEventStmt, selectReportedEventSQL},
+		{&s.updateReportedEventResolvedStmt, updateReportedEventResolvedSQL},
+	}.Prepare(db)
+}
+
+func (s *reportedEventsStatements) InsertReportedEvent(
+	ctx context.Context, txn *sql.Tx, report *types.EventReport,
+) (reportID int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.insertReportedEventStmt)
+	res, err := stmt.ExecContext(
+		ctx, report.RoomID, report.EventID, report.ReporterID, report.Reason, report.Score, report.ReceivedTS,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *reportedEventsStatements) SelectReportedEvents(
+	ctx context.Context, txn *sql.Tx, roomID string, resolved *bool, from int64, limit int,
+) ([]types.EventReport, int64, error) {
+	// The filters are optional, so the query is built up from the ones which
+	// were given.
+	var conditions []string
+	var params []interface{}
+	if roomID != "" {
+		params = append(params, roomID)
+		conditions = append(conditions, fmt.Sprintf("room_id = $%d", len(params)))
+	}
+	if resolved != nil {
+		if *resolved {
+			conditions = append(conditions, "resolved_ts != 0")
+		} else {
+			conditions = append(conditions, "resolved_ts = 0")
+		}
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	countStmt, err := s.db.PrepareContext(ctx, "SELECT COUNT(*) FROM roomserver_reported_events"+where)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, countStmt, "SelectReportedEvents: countStmt.close() failed")
+	var total int64
+	if err = sqlutil.TxStmt(txn, countStmt).QueryRowContext(ctx, params...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	selectStmt, err := s.db.PrepareContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM roomserver_reported_events%s ORDER BY report_id DESC LIMIT $%d OFFSET $%d",
+		selectReportedEventColumns, where, len(params)+1, len(params)+2,
+	))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, selectStmt, "SelectReportedEvents: selectStmt.close() failed")
+	rows, err := sqlutil.TxStmt(txn, selectStmt).QueryContext(ctx, append(params, limit, from)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectReportedEvents: rows.close() failed")
+
+	reports := []types.EventReport{}
+	for rows.Next() {
+		report, err := scanReportedEvent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		reports = append(reports, *report)
+	}
+	return reports, total, rows.Err()
+}
+
+func (s *reportedEventsStatements) SelectReportedEvent(
+	ctx context.Context, txn *sql.Tx, reportID int64,
+) (*types.EventReport, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectReportedEventStmt)
+	report, err := scanReportedEvent(stmt.QueryRowContext(ctx, reportID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return report, err
+}
+
+func (s *reportedEventsStatements) UpdateReportedEventResolved(
+	ctx context.Context, txn *sql.Tx, reportID int64, resolvedTS gomatrixserverlib.Timestamp, resolvedBy string,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.updateReportedEventResolvedStmt)
+	res, err := stmt.ExecContext(ctx, resolvedTS, resolvedBy, reportID)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func scanReportedEvent(row interface{ Scan(...interface{}) error }) (*types.EventReport, error) {
+	var report types.EventReport
+	var score sql.NullInt64
+	if err := row.Scan(
+		&report.ID, &report.RoomID, &report.EventID, &report.ReporterID, &report.Reason,
+		&score, &report.ReceivedTS, &report.ResolvedTS, &report.ResolvedBy,
+	); err != nil {
+		return nil, err
+	}
+	if score.Valid {
+		report.Score = &score.Int64
+	}
+	return &report, nil
+}
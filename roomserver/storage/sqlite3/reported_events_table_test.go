@@ -0,0 +1,111 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestReportedEventsTable(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	if err = createReportedEventsTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	tab, err := prepareReportedEventsTable(db)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+
+	score := int64(-100)
+	reports := []types.EventReport{
+		{RoomID: "!a:test", EventID: "$1", ReporterID: "@alice:test", Reason: "spam", Score: &score, ReceivedTS: 1},
+		{RoomID: "!b:test", EventID: "$2", ReporterID: "@alice:test", ReceivedTS: 2},
+		{RoomID: "!a:test", EventID: "$3", ReporterID: "@bob:test", Reason: "abuse", ReceivedTS: 3},
+	}
+	for i := range reports {
+		if reports[i].ID, err = tab.InsertReportedEvent(ctx, nil, &reports[i]); err != nil {
+			t.Fatalf("failed to insert report: %s", err)
+		}
+	}
+
+	got, err := tab.SelectReportedEvent(ctx, nil, reports[0].ID)
+	if err != nil {
+		t.Fatalf("failed to select report: %s", err)
+	}
+	if got == nil || got.EventID != "$1" || got.Reason != "spam" || got.Score == nil || *got.Score != score {
+		t.Fatalf("unexpected report: %+v", got)
+	}
+	if got, err = tab.SelectReportedEvent(ctx, nil, 1000); err != nil || got != nil {
+		t.Fatalf("expected no report, got %+v (err %v)", got, err)
+	}
+
+	resolved, err := tab.UpdateReportedEventResolved(ctx, nil, reports[2].ID, 4, "@admin:test")
+	if err != nil || !resolved {
+		t.Fatalf("expected the report to be resolved (err %v)", err)
+	}
+	if resolved, err = tab.UpdateReportedEventResolved(ctx, nil, reports[2].ID, 5, "@admin:test"); err != nil || resolved {
+		t.Fatalf("expected the report to only be resolved once (err %v)", err)
+	}
+
+	no, yes := false, true
+	tests := []struct {
+		name      string
+		roomID    string
+		resolved  *bool
+		from      int64
+		limit     int
+		wantIDs   []int64
+		wantTotal int64
+	}{
+		{"all", "", nil, 0, 10, []int64{reports[2].ID, reports[1].ID, reports[0].ID}, 3},
+		{"paginated", "", nil, 1, 1, []int64{reports[1].ID}, 3},
+		{"room", "!a:test", nil, 0, 10, []int64{reports[2].ID, reports[0].ID}, 2},
+		{"unresolved", "", &no, 0, 10, []int64{reports[1].ID, reports[0].ID}, 2},
+		{"resolved in room", "!a:test", &yes, 0, 10, []int64{reports[2].ID}, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, total, err := tab.SelectReportedEvents(ctx, nil, tc.roomID, tc.resolved, tc.from, tc.limit)
+			if err != nil {
+				t.Fatalf("failed to select reports: %s", err)
+			}
+			if total != tc.wantTotal {
+				t.Errorf("got total %d, want %d", total, tc.wantTotal)
+			}
+			if len(got) != len(tc.wantIDs) {
+				t.Fatalf("got %d reports, want %d", len(got), len(tc.wantIDs))
+			}
+			for i := range got {
+				if got[i].ID != tc.wantIDs[i] {
+					t.Errorf("report %d: got ID %d, want %d", i, got[i].ID, tc.wantIDs[i])
+				}
+			}
+		})
+	}
+}
@@ -67,6 +67,9 @@ const selectRoomInfoSQL = "" +
 const selectRoomIDsSQL = "" +
 	"SELECT room_id FROM roomserver_rooms WHERE latest_event_nids != '[]'"
 
+const selectRoomCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_rooms WHERE latest_event_nids != '[]'"
+
 const bulkSelectRoomIDsSQL = "" +
 	"SELECT room_id FROM roomserver_rooms WHERE room_nid IN ($1)"
 
@@ -81,8 +84,9 @@ type roomStatements struct {
 	selectLatestEventNIDsForUpdateStmt *sql.Stmt
 	updateLatestEventNIDsStmt          *sql.Stmt
 	//selectRoomVersionForRoomNIDStmt    *sql.Stmt
-	selectRoomInfoStmt *sql.Stmt
-	selectRoomIDsStmt  *sql.Stmt
+	selectRoomInfoStmt  *sql.Stmt
+	selectRoomIDsStmt   *sql.Stmt
+	selectRoomCountStmt *sql.Stmt
 }
 
 func createRoomsTable(db *sql.DB) error {
@@ -104,6 +108,7 @@ func prepareRoomsTable(db *sql.DB) (tables.Rooms, error) {
 		//{&s.selectRoomVersionForRoomNIDsStmt, selectRoomVersionForRoomNIDsSQL},
 		{&s.selectRoomInfoStmt, selectRoomInfoSQL},
 		{&s.selectRoomIDsStmt, selectRoomIDsSQL},
+		{&s.selectRoomCountStmt, selectRoomCountSQL},
 	}.Prepare(db)
 }
 
@@ -125,6 +130,12 @@ func (s *roomStatements) SelectRoomIDs(ctx context.Context, txn *sql.Tx) ([]stri
 	return roomIDs, nil
 }
 
+func (s *roomStatements) SelectRoomCount(ctx context.Context, txn *sql.Tx) (count int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomCountStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&count)
+	return
+}
+
 func (s *roomStatements) SelectRoomInfo(ctx context.Context, txn *sql.Tx, roomID string) (*types.RoomInfo, error) {
 	var info types.RoomInfo
 	var latestNIDsJSON string
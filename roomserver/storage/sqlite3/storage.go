@@ -114,6 +114,12 @@ func (d *Database) create(db *sql.DB) error {
 	if err := createRedactionsTable(db); err != nil {
 		return err
 	}
+	if err := createReportedEventsTable(db); err != nil {
+		return err
+	}
+	if err := createTransactionsTable(db); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -171,6 +177,18 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
+	reportedEvents, err := prepareReportedEventsTable(db)
+	if err != nil {
+		return err
+	}
+	transactions, err := prepareTransactionsTable(db)
+	if err != nil {
+		return err
+	}
+	purge, err := preparePurgeStatements(db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  db,
 		Cache:               cache,
@@ -188,6 +206,9 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		MembershipTable:     membership,
 		PublishedTable:      published,
 		RedactionsTable:     redactions,
+		ReportedEventsTable: reportedEvents,
+		TransactionsTable:   transactions,
+		Purge:               purge,
 		GetRoomUpdaterFn:    d.GetRoomUpdater,
 	}
 	return nil
@@ -0,0 +1,87 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+const transactionsSchema = `
+-- Stores the event IDs of events sent by clients with a transaction ID, so
+-- that retried requests return the original event rather than a duplicate.
+CREATE TABLE IF NOT EXISTS roomserver_transactions (
+    -- The transaction ID given by the client
+    transaction_id TEXT NOT NULL,
+    -- The session ID of the device that sent the event
+    session_id BIGINT NOT NULL,
+    -- The user ID of the sender
+    user_id TEXT NOT NULL,
+    -- The ID of the event that was sent
+    event_id TEXT NOT NULL,
+    PRIMARY KEY (transaction_id, session_id, user_id)
+);
+`
+
+const insertTransactionSQL = "" +
+	"INSERT OR IGNORE INTO roomserver_transactions (transaction_id, session_id, user_id, event_id)" +
+	" VALUES ($1, $2, $3, $4)"
+
+const selectTransactionEventIDSQL = "" +
+	"SELECT event_id FROM roomserver_transactions" +
+	" WHERE transaction_id = $1 AND session_id = $2 AND user_id = $3"
+
+type transactionStatements struct {
+	insertTransactionStmt        *sql.Stmt
+	selectTransactionEventIDStmt *sql.Stmt
+}
+
+func createTransactionsTable(db *sql.DB) error {
+	_, err := db.Exec(transactionsSchema)
+	return err
+}
+
+func prepareTransactionsTable(db *sql.DB) (tables.Transactions, error) {
+	s := &transactionStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertTransactionStmt, insertTransactionSQL},
+		{&s.selectTransactionEventIDStmt, selectTransactionEventIDSQL},
+	}.Prepare(db)
+}
+
+func (s *transactionStatements) InsertTransaction(
+	ctx context.Context, txn *sql.Tx,
+	transactionID string, sessionID int64, userID, eventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertTransactionStmt)
+	_, err := stmt.ExecContext(ctx, transactionID, sessionID, userID, eventID)
+	return err
+}
+
+func (s *transactionStatements) SelectTransactionEventID(
+	ctx context.Context, txn *sql.Tx,
+	transactionID string, sessionID int64, userID string,
+) (eventID string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectTransactionEventIDStmt)
+	err = stmt.QueryRowContext(ctx, transactionID, sessionID, userID).Scan(&eventID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestTransactionsTable(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	if err = createTransactionsTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	tab, err := prepareTransactionsTable(db)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+
+	eventID, err := tab.SelectTransactionEventID(ctx, nil, "txn1", 1, "@alice:test")
+	if err != nil {
+		t.Fatalf("failed to select transaction: %s", err)
+	}
+	if eventID != "" {
+		t.Fatalf("got event ID %q for unknown transaction, want none", eventID)
+	}
+
+	if err = tab.InsertTransaction(ctx, nil, "txn1", 1, "@alice:test", "$1"); err != nil {
+		t.Fatalf("failed to insert transaction: %s", err)
+	}
+	// Storing the same transaction again keeps the original event ID.
+	if err = tab.InsertTransaction(ctx, nil, "txn1", 1, "@alice:test", "$2"); err != nil {
+		t.Fatalf("failed to insert duplicate transaction: %s", err)
+	}
+
+	tests := []struct {
+		txnID     string
+		sessionID int64
+		userID    string
+		want      string
+	}{
+		{"txn1", 1, "@alice:test", "$1"},
+		{"txn1", 2, "@alice:test", ""},
+		{"txn1", 1, "@bob:test", ""},
+		{"txn2", 1, "@alice:test", ""},
+	}
+	for _, tc := range tests {
+		eventID, err = tab.SelectTransactionEventID(ctx, nil, tc.txnID, tc.sessionID, tc.userID)
+		if err != nil {
+			t.Fatalf("failed to select transaction: %s", err)
+		}
+		if eventID != tc.want {
+			t.Errorf("got event ID %q for %s/%d/%s, want %q", eventID, tc.txnID, tc.sessionID, tc.userID, tc.want)
+		}
+	}
+}
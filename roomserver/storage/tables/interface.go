@@ -61,6 +61,9 @@ type Events interface {
 	BulkSelectEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventNID, error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
+	// SelectRoomEventNIDs returns up to limit event NIDs in the room after the given event NID,
+	// oldest first. Rejected events are left out.
+	SelectRoomEventNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
 }
 
 type Rooms interface {
@@ -72,6 +75,7 @@ type Rooms interface {
 	SelectRoomVersionsForRoomNIDs(ctx context.Context, txn *sql.Tx, roomNID []types.RoomNID) (map[types.RoomNID]gomatrixserverlib.RoomVersion, error)
 	SelectRoomInfo(ctx context.Context, txn *sql.Tx, roomID string) (*types.RoomInfo, error)
 	SelectRoomIDs(ctx context.Context, txn *sql.Tx) ([]string, error)
+	SelectRoomCount(ctx context.Context, txn *sql.Tx) (int64, error)
 	BulkSelectRoomIDs(ctx context.Context, txn *sql.Tx, roomNIDs []types.RoomNID) ([]string, error)
 	BulkSelectRoomNIDs(ctx context.Context, txn *sql.Tx, roomIDs []string) ([]types.RoomNID, error)
 }
@@ -133,6 +137,10 @@ type Membership interface {
 	UpdateForgetMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, forget bool) error
 	SelectLocalServerInRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (bool, error)
 	SelectServerInRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, serverName gomatrixserverlib.ServerName) (bool, error)
+	// SelectLocalJoinedRoomCount returns the number of rooms that at least one local user is joined to.
+	SelectLocalJoinedRoomCount(ctx context.Context, txn *sql.Tx) (int64, error)
+	// SelectJoinedMemberCount returns the number of users who are joined to the room.
+	SelectJoinedMemberCount(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (int, error)
 }
 
 type Published interface {
@@ -141,6 +149,35 @@ type Published interface {
 	SelectAllPublishedRooms(ctx context.Context, txn *sql.Tx, published bool) ([]string, error)
 }
 
+type Transactions interface {
+	// InsertTransaction stores the ID of the event sent with the given transaction ID. It does
+	// nothing if the transaction ID has already been stored.
+	InsertTransaction(ctx context.Context, txn *sql.Tx, transactionID string, sessionID int64, userID, eventID string) error
+	// SelectTransactionEventID returns the ID of the event sent with the given transaction ID,
+	// or an empty string if there is no such transaction.
+	SelectTransactionEventID(ctx context.Context, txn *sql.Tx, transactionID string, sessionID int64, userID string) (string, error)
+}
+
+type ReportedEvents interface {
+	// InsertReportedEvent stores a new report and returns its ID.
+	InsertReportedEvent(ctx context.Context, txn *sql.Tx, report *types.EventReport) (int64, error)
+	// SelectReportedEvents returns up to limit reports, newest first, skipping the first from reports,
+	// along with the total number of matching reports. If roomID is not empty then only reports for
+	// that room are returned. If resolved is not nil then only resolved or unresolved reports are returned.
+	SelectReportedEvents(ctx context.Context, txn *sql.Tx, roomID string, resolved *bool, from int64, limit int) ([]types.EventReport, int64, error)
+	// SelectReportedEvent returns the report with the given ID, or nil if there is no such report.
+	SelectReportedEvent(ctx context.Context, txn *sql.Tx, reportID int64) (*types.EventReport, error)
+	// UpdateReportedEventResolved marks the report as resolved. Returns false if there is no such
+	// report or if it was already resolved.
+	UpdateReportedEventResolved(ctx context.Context, txn *sql.Tx, reportID int64, resolvedTS gomatrixserverlib.Timestamp, resolvedBy string) (bool, error)
+}
+
+type Purge interface {
+	// PurgeRoom deletes the room and everything which is stored about it, such as its
+	// events, state, memberships, aliases and event reports.
+	PurgeRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string) error
+}
+
 type RedactionInfo struct {
 	// whether this redaction is validated (we have both events)
 	Validated bool
@@ -170,7 +207,9 @@ type StrippedEvent struct {
 }
 
 // ExtractContentValue from the given state event. For example, given an m.room.name event with:
-//    content: { name: "Foo" }
+//
+//	content: { name: "Foo" }
+//
 // this returns "Foo".
 func ExtractContentValue(ev *gomatrixserverlib.HeaderedEvent) string {
 	content := ev.Content()
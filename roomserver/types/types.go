@@ -222,3 +222,18 @@ type RoomInfo struct {
 	StateSnapshotNID StateSnapshotNID
 	IsStub           bool
 }
+
+// EventReport is a report of an event made by a user, e.g. because the event
+// is abusive or spam, which is waiting to be reviewed by a server admin.
+type EventReport struct {
+	ID         int64                       `json:"id"`
+	RoomID     string                      `json:"room_id"`
+	EventID    string                      `json:"event_id"`
+	ReporterID string                      `json:"user_id"`
+	Reason     string                      `json:"reason"`
+	Score      *int64                      `json:"score,omitempty"`
+	ReceivedTS gomatrixserverlib.Timestamp `json:"received_ts"`
+	// ResolvedTS is zero if the report hasn't been resolved yet.
+	ResolvedTS gomatrixserverlib.Timestamp `json:"resolved_ts,omitempty"`
+	ResolvedBy string                      `json:"resolved_by,omitempty"`
+}
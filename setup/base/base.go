@@ -23,13 +23,18 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	sentryhttp "github.com/getsentry/sentry-go/http"
 	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/dnscache"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/internal/sdnotify"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/atomic"
@@ -69,18 +74,20 @@ type BaseDendrite struct {
 	*process.ProcessContext
 	componentName          string
 	tracerCloser           io.Closer
+	systemdReady           *sync.Once
 	PublicClientAPIMux     *mux.Router
 	PublicFederationAPIMux *mux.Router
 	PublicKeyAPIMux        *mux.Router
 	PublicMediaAPIMux      *mux.Router
 	PublicWellKnownAPIMux  *mux.Router
+	PublicStaticMux        *mux.Router
 	InternalAPIMux         *mux.Router
 	SynapseAdminMux        *mux.Router
+	DendriteAdminMux       *mux.Router
 	UseHTTPAPIs            bool
 	apiHttpClient          *http.Client
 	Cfg                    *config.Dendrite
 	Caches                 *caching.Caches
-	DNSCache               *gomatrixserverlib.DNSCache
 }
 
 const NoListener = ""
@@ -132,34 +139,29 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 
 	if cfg.Global.Sentry.Enabled {
 		logrus.Info("Setting up Sentry for debugging...")
-		err = sentry.Init(sentry.ClientOptions{
-			Dsn:              cfg.Global.Sentry.DSN,
-			Environment:      cfg.Global.Sentry.Environment,
-			Debug:            true,
-			ServerName:       string(cfg.Global.ServerName),
-			Release:          "dendrite@" + internal.VersionString(),
-			AttachStacktrace: true,
-		})
-		if err != nil {
+		if err = internal.SetupSentry(&cfg.Global, componentName); err != nil {
 			logrus.WithError(err).Panic("failed to start Sentry")
 		}
 	}
 
-	cache, err := caching.NewInMemoryLRUCache(cacheMetrics)
+	cache, err := caching.NewInMemoryLRUCache(&cfg.Global.Cache, cacheMetrics)
 	if err != nil {
 		logrus.WithError(err).Warnf("Failed to create cache")
 	}
 
-	var dnsCache *gomatrixserverlib.DNSCache
 	if cfg.Global.DNSCache.Enabled {
-		dnsCache = gomatrixserverlib.NewDNSCache(
+		// This must happen before any HTTP clients are created, so that
+		// they pick up the caching resolver.
+		dnscache.New(
 			cfg.Global.DNSCache.CacheSize,
 			cfg.Global.DNSCache.CacheLifetime,
-		)
+			cfg.Global.DNSCache.NegativeCacheLifetime,
+		).Install(cacheMetrics)
 		logrus.Infof(
-			"DNS cache enabled (size %d, lifetime %s)",
+			"DNS cache enabled (size %d, maximum lifetime %s, negative lifetime %s)",
 			cfg.Global.DNSCache.CacheSize,
 			cfg.Global.DNSCache.CacheLifetime,
+			cfg.Global.DNSCache.NegativeCacheLifetime,
 		)
 	}
 
@@ -192,21 +194,29 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 	// are not inadvertently reading paths without cleaning, else this could introduce a
 	// directory traversal attack e.g /../../../etc/passwd
 
+	// The admin API should respond with Matrix-style JSON errors for unknown endpoints,
+	// so that tooling built against it can rely on a consistent error format.
+	dendriteAdminMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.DendriteAdminPathPrefix).Subrouter().UseEncodedPath()
+	dendriteAdminMux.NotFoundHandler = httputil.NotFoundHandler()
+	dendriteAdminMux.MethodNotAllowedHandler = httputil.MethodNotAllowedHandler()
+
 	return &BaseDendrite{
 		ProcessContext:         process.NewProcessContext(),
 		componentName:          componentName,
+		systemdReady:           &sync.Once{},
 		UseHTTPAPIs:            useHTTPAPIs,
 		tracerCloser:           closer,
 		Cfg:                    cfg,
 		Caches:                 cache,
-		DNSCache:               dnsCache,
 		PublicClientAPIMux:     mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicClientPathPrefix).Subrouter().UseEncodedPath(),
 		PublicFederationAPIMux: mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicFederationPathPrefix).Subrouter().UseEncodedPath(),
 		PublicKeyAPIMux:        mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicKeyPathPrefix).Subrouter().UseEncodedPath(),
 		PublicMediaAPIMux:      mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicMediaPathPrefix).Subrouter().UseEncodedPath(),
 		PublicWellKnownAPIMux:  mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicWellKnownPrefix).Subrouter().UseEncodedPath(),
+		PublicStaticMux:        mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicStaticPath).Subrouter().UseEncodedPath(),
 		InternalAPIMux:         mux.NewRouter().SkipClean(true).PathPrefix(httputil.InternalPathPrefix).Subrouter().UseEncodedPath(),
 		SynapseAdminMux:        mux.NewRouter().SkipClean(true).PathPrefix("/_synapse/").Subrouter().UseEncodedPath(),
+		DendriteAdminMux:       dendriteAdminMux,
 		apiHttpClient:          &apiClient,
 	}
 }
@@ -274,7 +284,11 @@ func (b *BaseDendrite) KeyServerHTTPClient() keyserverAPI.KeyInternalAPI {
 // CreateAccountsDB creates a new instance of the accounts database. Should only
 // be called once per component.
 func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
-	db, err := accounts.NewDatabase(&b.Cfg.UserAPI.AccountDatabase, b.Cfg.Global.ServerName, b.Cfg.UserAPI.BCryptCost, b.Cfg.UserAPI.OpenIDTokenLifetimeMS)
+	defaultPushRules, err := pushrules.NewDefaultRuleOverrides(b.Cfg.UserAPI.DefaultPushRules)
+	if err != nil {
+		logrus.WithError(err).Panicf("invalid user_api.default_push_rules")
+	}
+	db, err := accounts.NewDatabase(&b.Cfg.UserAPI.AccountDatabase, b.Cfg.Global.ServerName, passwordhash.NewHasher(&b.Cfg.UserAPI), b.Cfg.UserAPI.OpenIDTokenLifetimeMS, defaultPushRules)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to accounts db")
 	}
@@ -293,9 +307,6 @@ func (b *BaseDendrite) CreateClient() *gomatrixserverlib.Client {
 	opts := []gomatrixserverlib.ClientOption{
 		gomatrixserverlib.WithSkipVerify(b.Cfg.FederationAPI.DisableTLSValidation),
 	}
-	if b.Cfg.Global.DNSCache.Enabled {
-		opts = append(opts, gomatrixserverlib.WithDNSCache(b.DNSCache))
-	}
 	client := gomatrixserverlib.NewClient(opts...)
 	client.SetUserAgent(fmt.Sprintf("Dendrite/%s", internal.VersionString()))
 	return client
@@ -314,9 +325,6 @@ func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationCli
 		gomatrixserverlib.WithTimeout(time.Minute * 5),
 		gomatrixserverlib.WithSkipVerify(b.Cfg.FederationAPI.DisableTLSValidation),
 	}
-	if b.Cfg.Global.DNSCache.Enabled {
-		opts = append(opts, gomatrixserverlib.WithDNSCache(b.DNSCache))
-	}
 	client := gomatrixserverlib.NewFederationClient(
 		b.Cfg.Global.ServerName, b.Cfg.Global.KeyID,
 		b.Cfg.Global.PrivateKey, opts...,
@@ -325,6 +333,18 @@ func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationCli
 	return client
 }
 
+// withSentry wraps a listener's handler so that each request gets its own
+// Sentry hub, if Sentry is enabled. Handlers use the hub to tag events with
+// the route and user, and to report panics.
+func (b *BaseDendrite) withSentry(h http.Handler) http.Handler {
+	if !b.Cfg.Global.Sentry.Enabled {
+		return h
+	}
+	return sentryhttp.New(sentryhttp.Options{
+		Repanic: true,
+	}).Handle(h)
+}
+
 // SetupAndServeHTTP sets up the HTTP server to serve endpoints registered on
 // ApiMux under /api/ and adds a prometheus handler under /metrics.
 func (b *BaseDendrite) SetupAndServeHTTP(
@@ -340,7 +360,7 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 	externalServ := &http.Server{
 		Addr:         string(externalAddr),
 		WriteTimeout: HTTPServerTimeout,
-		Handler:      externalRouter,
+		Handler:      httputil.WithAccessLogging("external", b.withSentry(externalRouter)),
 	}
 	internalServ := externalServ
 
@@ -355,7 +375,7 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 		internalRouter = mux.NewRouter().SkipClean(true).UseEncodedPath()
 		internalServ = &http.Server{
 			Addr:    string(internalAddr),
-			Handler: h2c.NewHandler(internalRouter, internalH2S),
+			Handler: h2c.NewHandler(httputil.WithAccessLogging("internal", b.withSentry(internalRouter)), internalH2S),
 		}
 	}
 
@@ -363,31 +383,21 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 	if b.Cfg.Global.Metrics.Enabled {
 		internalRouter.Handle("/metrics", httputil.WrapHandlerInBasicAuth(promhttp.Handler(), b.Cfg.Global.Metrics.BasicAuth))
 	}
-
-	var clientHandler http.Handler
-	clientHandler = b.PublicClientAPIMux
-	if b.Cfg.Global.Sentry.Enabled {
-		sentryHandler := sentryhttp.New(sentryhttp.Options{
-			Repanic: true,
-		})
-		clientHandler = sentryHandler.Handle(b.PublicClientAPIMux)
-	}
-	var federationHandler http.Handler
-	federationHandler = b.PublicFederationAPIMux
-	if b.Cfg.Global.Sentry.Enabled {
-		sentryHandler := sentryhttp.New(sentryhttp.Options{
-			Repanic: true,
-		})
-		federationHandler = sentryHandler.Handle(b.PublicFederationAPIMux)
+	if b.Cfg.Global.Debug.Enabled {
+		logrus.Warnf("Exposing runtime debug endpoints under %s", httputil.DebugPathPrefix)
+		internalRouter.PathPrefix(httputil.DebugPathPrefix).Handler(httputil.WrapHandlerInBasicAuth(httputil.DebugHandler(), b.Cfg.Global.Debug.BasicAuth))
 	}
-	externalRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(clientHandler)
+
+	externalRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(b.PublicClientAPIMux)
 	if !b.Cfg.Global.DisableFederation {
 		externalRouter.PathPrefix(httputil.PublicKeyPathPrefix).Handler(b.PublicKeyAPIMux)
-		externalRouter.PathPrefix(httputil.PublicFederationPathPrefix).Handler(federationHandler)
+		externalRouter.PathPrefix(httputil.PublicFederationPathPrefix).Handler(b.PublicFederationAPIMux)
 	}
 	externalRouter.PathPrefix("/_synapse/").Handler(b.SynapseAdminMux)
+	externalRouter.PathPrefix(httputil.DendriteAdminPathPrefix).Handler(b.DendriteAdminMux)
 	externalRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(b.PublicMediaAPIMux)
 	externalRouter.PathPrefix(httputil.PublicWellKnownPrefix).Handler(b.PublicWellKnownAPIMux)
+	externalRouter.PathPrefix(httputil.PublicStaticPath).Handler(b.PublicStaticMux)
 
 	if internalAddr != NoListener && internalAddr != externalAddr {
 		go func() {
@@ -445,6 +455,16 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 		}()
 	}
 
+	// Everything has been set up by the time that the listeners are started,
+	// so let systemd know that we're ready. This only happens once, even if
+	// there are multiple listeners.
+	b.systemdReady.Do(func() {
+		if _, err := sdnotify.Notify(sdnotify.StateReady); err != nil {
+			logrus.WithError(err).Warn("Failed to notify systemd of readiness")
+		}
+		go sdnotify.Watchdog(b.ProcessContext.Context())
+	})
+
 	<-b.ProcessContext.WaitForShutdown()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -462,6 +482,9 @@ func (b *BaseDendrite) WaitForShutdown() {
 	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
 
 	logrus.Warnf("Shutdown signal received")
+	if _, err := sdnotify.Notify(sdnotify.StateStopping); err != nil {
+		logrus.WithError(err).Warn("Failed to notify systemd of shutdown")
+	}
 
 	b.ProcessContext.ShutdownDendrite()
 	b.ProcessContext.WaitForComponentsToFinish()
@@ -110,6 +110,9 @@ type Derived struct {
 	ExclusiveApplicationServicesAliasRegexp *regexp.Regexp
 	// Note: An Exclusive Regex for room ID isn't necessary as we aren't blocking
 	// servers from creating RoomIDs in exclusive application service namespaces
+
+	// The passwords from the password policy's denylist file, in lower case
+	PasswordDenylist map[string]struct{}
 }
 
 type InternalAPIOptions struct {
@@ -270,9 +273,6 @@ func (config *Dendrite) Derive() error {
 
 	config.Derived.Registration.Params = make(map[string]interface{})
 
-	// TODO: Add email auth type
-	// TODO: Add MSISDN auth type
-
 	if config.ClientAPI.RecaptchaEnabled {
 		config.Derived.Registration.Params[authtypes.LoginTypeRecaptcha] = map[string]string{"public_key": config.ClientAPI.RecaptchaPublicKey}
 		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
@@ -282,11 +282,65 @@ func (config *Dendrite) Derive() error {
 			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
 	}
 
+	// Users can also register with an email address which we validate, as
+	// well as the captcha if that is required.
+	if config.ClientAPI.Email.Enabled {
+		stages := []authtypes.LoginType{authtypes.LoginTypeEmail}
+		if config.ClientAPI.RecaptchaEnabled {
+			stages = append([]authtypes.LoginType{authtypes.LoginTypeRecaptcha}, stages...)
+		}
+		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
+			authtypes.Flow{Stages: stages})
+	}
+
+	// Likewise with a phone number which the identity server validates.
+	if config.ClientAPI.MSISDN.Enabled {
+		stages := []authtypes.LoginType{authtypes.LoginTypeMSISDN}
+		if config.ClientAPI.RecaptchaEnabled {
+			stages = append([]authtypes.LoginType{authtypes.LoginTypeRecaptcha}, stages...)
+		}
+		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
+			authtypes.Flow{Stages: stages})
+	}
+
+	// If registration requires a token then every flow starts with it.
+	if config.ClientAPI.RegistrationRequiresToken {
+		for i := range config.Derived.Registration.Flows {
+			flow := &config.Derived.Registration.Flows[i]
+			flow.Stages = append([]authtypes.LoginType{authtypes.LoginTypeRegistrationToken}, flow.Stages...)
+		}
+	}
+
+	// New users have to agree to the privacy policy at the end of every flow
+	// if the server asks for consent.
+	if config.ClientAPI.Consent.Enabled && config.ClientAPI.Consent.RequireAtRegistration {
+		consent := &config.ClientAPI.Consent
+		config.Derived.Registration.Params[authtypes.LoginTypeTerms] = map[string]interface{}{
+			"policies": map[string]interface{}{
+				"privacy_policy": map[string]interface{}{
+					"version": consent.Version,
+					"en": map[string]string{
+						"name": consent.PolicyName,
+						"url":  ConsentPolicyURL(config.Global.WellKnownClientName, consent.Version),
+					},
+				},
+			},
+		}
+		for i := range config.Derived.Registration.Flows {
+			flow := &config.Derived.Registration.Flows[i]
+			flow.Stages = append(flow.Stages, authtypes.LoginTypeTerms)
+		}
+	}
+
 	// Load application service configuration files
 	if err := loadAppServices(&config.AppServiceAPI, &config.Derived); err != nil {
 		return err
 	}
 
+	if err := loadPasswordDenylist(&config.ClientAPI.PasswordPolicy, &config.Derived); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -444,6 +498,34 @@ func (config *Dendrite) check(_ bool) error { // monolithic
 	return nil
 }
 
+// JSONCompatible converts the maps decoded from the YAML config, which have
+// interface{} keys, into maps with string keys so that they can be encoded as
+// JSON.
+func JSONCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = JSONCompatible(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = JSONCompatible(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = JSONCompatible(e)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
 // absPath returns the absolute path for a given relative or absolute path.
 func absPath(dir string, path Path) string {
 	if filepath.IsAbs(string(path)) {
@@ -2,6 +2,11 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -18,10 +23,15 @@ type ClientAPI struct {
 	// If set, allows registration by anyone who also has the shared
 	// secret, even if registration is otherwise disabled.
 	RegistrationSharedSecret string `yaml:"registration_shared_secret"`
+	// If set, new users must use a registration token created through the
+	// admin API to register (MSC3231).
+	RegistrationRequiresToken bool `yaml:"registration_requires_token"`
 
 	// Boolean stating whether catpcha registration is enabled
 	// and required
 	RecaptchaEnabled bool `yaml:"enable_registration_captcha"`
+	// Which captcha service to use, either "recaptcha" or "hcaptcha"
+	CaptchaProvider string `yaml:"captcha_provider"`
 	// This Home Server's ReCAPTCHA public key.
 	RecaptchaPublicKey string `yaml:"recaptcha_public_key"`
 	// This Home Server's ReCAPTCHA private key.
@@ -29,18 +39,56 @@ type ClientAPI struct {
 	// Secret used to bypass the captcha registration entirely
 	RecaptchaBypassSecret string `yaml:"recaptcha_bypass_secret"`
 	// HTTP API endpoint used to verify whether the captcha response
-	// was successful
+	// was successful. Defaults to the endpoint of the captcha provider.
 	RecaptchaSiteVerifyAPI string `yaml:"recaptcha_siteverify_api"`
 
+	// The origins of web clients which open the login and registration
+	// fallback pages, e.g. "https://app.element.io". The pages only send the
+	// new access token to these and to the homeserver's own origin.
+	FallbackClientOrigins []string `yaml:"fallback_client_origins"`
+
 	// TURN options
 	TURN TURN `yaml:"turn"`
 
+	// Options for sending emails to validate email addresses
+	Email Email `yaml:"email"`
+
+	// Options for validating phone numbers
+	MSISDN MSISDN `yaml:"msisdn"`
+
+	// Options for logging in with single sign-on
+	SSO SSO `yaml:"sso"`
+
+	// Options for asking users to agree to the server's privacy policy
+	Consent Consent `yaml:"consent"`
+
+	// Options for the custom fields which users can add to their profiles
+	ProfileFields ProfileFields `yaml:"profile_fields"`
+
+	// External services which are asked whether passwords are right before
+	// the account database, e.g. to check them against an LDAP directory
+	PasswordProviders []PasswordProvider `yaml:"password_providers"`
+
+	// The rules which new passwords must follow
+	PasswordPolicy PasswordPolicy `yaml:"password_policy"`
+
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// Extra capabilities to advertise in /capabilities, e.g. for MSCs. The
+	// keys are capability names and the values are their contents.
+	ExtraCapabilities map[string]interface{} `yaml:"extra_capabilities"`
+
 	MSCs *MSCs `yaml:"mscs"`
 }
 
+// The captcha services which can be used for registration. hCaptcha is a
+// drop-in replacement for reCAPTCHA, so both use the m.login.recaptcha stage.
+const (
+	CaptchaProviderRecaptcha = "recaptcha"
+	CaptchaProviderHCaptcha  = "hcaptcha"
+)
+
 func (c *ClientAPI) Defaults(generate bool) {
 	c.InternalAPI.Listen = "http://localhost:7771"
 	c.InternalAPI.Connect = "http://localhost:7771"
@@ -49,9 +97,16 @@ func (c *ClientAPI) Defaults(generate bool) {
 	c.RecaptchaPublicKey = ""
 	c.RecaptchaPrivateKey = ""
 	c.RecaptchaEnabled = false
+	c.CaptchaProvider = CaptchaProviderRecaptcha
 	c.RecaptchaBypassSecret = ""
 	c.RecaptchaSiteVerifyAPI = ""
 	c.RegistrationDisabled = false
+	c.RegistrationRequiresToken = false
+	c.FallbackClientOrigins = []string{}
+	c.Email.Defaults()
+	c.Consent.Defaults()
+	c.ProfileFields.Defaults()
+	c.PasswordPolicy.Defaults()
 	c.RateLimiting.Defaults()
 }
 
@@ -64,10 +119,50 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.RecaptchaEnabled {
 		checkNotEmpty(configErrs, "client_api.recaptcha_public_key", string(c.RecaptchaPublicKey))
 		checkNotEmpty(configErrs, "client_api.recaptcha_private_key", string(c.RecaptchaPrivateKey))
-		checkNotEmpty(configErrs, "client_api.recaptcha_siteverify_api", string(c.RecaptchaSiteVerifyAPI))
+		switch c.CaptchaProvider {
+		case CaptchaProviderRecaptcha, CaptchaProviderHCaptcha:
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q, must be %q or %q", "client_api.captcha_provider", c.CaptchaProvider, CaptchaProviderRecaptcha, CaptchaProviderHCaptcha))
+		}
+	}
+	for i, origin := range c.FallbackClientOrigins {
+		key := fmt.Sprintf("client_api.fallback_client_origins[%d]", i)
+		checkURL(configErrs, key, origin)
+		// postMessage only accepts bare origins as the target.
+		if u, err := url.Parse(origin); err == nil && (u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil) {
+			configErrs.Add(fmt.Sprintf("config key %q should be an origin like https://example.com, without a path", key))
+		}
 	}
 	c.TURN.Verify(configErrs)
+	c.Email.Verify(configErrs)
+	if c.Email.Enabled {
+		// The links in the emails point at the client API.
+		checkNotEmpty(configErrs, "global.well_known_client_name", c.Matrix.WellKnownClientName)
+	}
+	c.MSISDN.Verify(configErrs, c.Matrix.TrustedIDServers)
+	c.SSO.Verify(configErrs)
+	c.Consent.Verify(configErrs)
+	if c.Consent.Enabled {
+		// The policy documents are served by the client API.
+		checkNotEmpty(configErrs, "global.well_known_client_name", c.Matrix.WellKnownClientName)
+	}
+	c.ProfileFields.Verify(configErrs)
+	if c.SSO.Enabled && c.SSO.CallbackURL == "" {
+		// The callback URL defaults to one on the client API.
+		checkNotEmpty(configErrs, "global.well_known_client_name", c.Matrix.WellKnownClientName)
+	}
+	for i := range c.PasswordProviders {
+		c.PasswordProviders[i].Verify(configErrs, fmt.Sprintf("client_api.password_providers[%d]", i))
+	}
+	c.PasswordPolicy.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	for name := range c.ExtraCapabilities {
+		// The m. namespace is reserved for capabilities in the spec, which
+		// we advertise ourselves.
+		if name == "" || strings.HasPrefix(name, "m.") {
+			configErrs.Add(fmt.Sprintf("invalid capability name %q for config key %q", name, "client_api.extra_capabilities"))
+		}
+	}
 }
 
 type TURN struct {
@@ -96,19 +191,419 @@ func (c *TURN) Verify(configErrs *ConfigErrors) {
 			configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "client_api.turn.turn_user_lifetime", value))
 		}
 	}
+	if len(c.URIs) == 0 {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.turn.turn_user_lifetime", c.UserLifetime)
+	if c.SharedSecret == "" && (c.Username == "" || c.Password == "") {
+		configErrs.Add(fmt.Sprintf(
+			"config key %q requires either %q or both %q and %q to be set",
+			"client_api.turn.turn_uris", "client_api.turn.turn_shared_secret",
+			"client_api.turn.turn_username", "client_api.turn.turn_password",
+		))
+	}
+}
+
+// PasswordPolicy is the rules which the passwords that users choose when they
+// register or change their password must follow. Passwords which are set by
+// admins only need to be long enough for the spec.
+type PasswordPolicy struct {
+	// The minimum number of characters in a password.
+	MinLength int `yaml:"min_length"`
+	// Whether passwords need at least one of each kind of character.
+	RequireDigit     bool `yaml:"require_digit"`
+	RequireSymbol    bool `yaml:"require_symbol"`
+	RequireLowercase bool `yaml:"require_lowercase"`
+	RequireUppercase bool `yaml:"require_uppercase"`
+	// Whether to refuse the most commonly used passwords, from a list which
+	// is built in.
+	DenyCommonPasswords bool `yaml:"deny_common_passwords"`
+	// An optional file of more passwords to refuse, one per line. Passwords
+	// are compared without regard to case.
+	DenylistPath Path `yaml:"denylist_path"`
+}
+
+func (c *PasswordPolicy) Defaults() {
+	c.MinLength = 8
+}
+
+func (c *PasswordPolicy) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "client_api.password_policy.min_length", int64(c.MinLength))
+}
+
+// loadPasswordDenylist reads the passwords which the password policy refuses
+// from the denylist file, if there is one.
+func loadPasswordDenylist(c *PasswordPolicy, derived *Derived) error {
+	if c.DenylistPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(string(c.DenylistPath))
+	if err != nil {
+		return fmt.Errorf("failed to read the password denylist: %w", err)
+	}
+	derived.PasswordDenylist = map[string]struct{}{}
+	for _, password := range strings.Split(string(data), "\n") {
+		if password = strings.TrimSpace(password); password != "" {
+			derived.PasswordDenylist[strings.ToLower(password)] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// Email configures the sending of emails with tokens which validate that a
+// user owns an email address, for registration, password resets and adding
+// email addresses to accounts. If it isn't enabled then the validation is
+// left to the identity server that the client asks for.
+type Email struct {
+	// Whether to send validation emails ourselves
+	Enabled bool `yaml:"enabled"`
+	// The SMTP server to send emails through, as host:port
+	SMTPServer string `yaml:"smtp_server"`
+	// The credentials for the SMTP server, if it needs them
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// The address which emails are sent from
+	From string `yaml:"from"`
+	// How long the token in an email can be used for
+	TokenLifetime time.Duration `yaml:"token_lifetime"`
+	// A directory with templates to use instead of the builtin ones. Any
+	// of registration.txt, password_reset.txt and add_threepid.txt which
+	// are there replace the builtin template for that email.
+	TemplatesPath string `yaml:"templates_path"`
+}
+
+// MaxEmailTokenLifetime is the longest that the token in an email can be used
+// for, since the validation sessions are forgotten after this.
+const MaxEmailTokenLifetime = 24 * time.Hour
+
+func (c *Email) Defaults() {
+	c.TokenLifetime = time.Hour
+}
+
+func (c *Email) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.email.smtp_server", c.SMTPServer)
+	if c.SMTPServer != "" {
+		if _, _, err := net.SplitHostPort(c.SMTPServer); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid host:port for config key %q: %s", "client_api.email.smtp_server", c.SMTPServer))
+		}
+	}
+	checkNotEmpty(configErrs, "client_api.email.from", c.From)
+	if c.TokenLifetime <= 0 || c.TokenLifetime > MaxEmailTokenLifetime {
+		configErrs.Add(fmt.Sprintf("config key %q must be positive and at most %s", "client_api.email.token_lifetime", MaxEmailTokenLifetime))
+	}
+}
+
+// Consent configures asking users to agree to the server's privacy policy.
+// The version of the policy which each user has agreed to is recorded, and
+// users are asked again when the version changes.
+type Consent struct {
+	// Whether users are asked to agree to the policy
+	Enabled bool `yaml:"enabled"`
+	// The current version of the policy
+	Version string `yaml:"version"`
+	// The name of the policy which clients show to users
+	PolicyName string `yaml:"policy_name"`
+	// A directory with the policy documents, which are Go html/templates
+	// named after the version of the policy, e.g. "1.0.html"
+	TemplatesPath string `yaml:"templates_path"`
+	// The secret which the links that users agree to the policy through are
+	// signed with, so that they can't agree on behalf of other users
+	FormSecret string `yaml:"form_secret"`
+	// Whether new users have to agree to the policy to register, with the
+	// m.login.terms stage
+	RequireAtRegistration bool `yaml:"require_at_registration"`
+	// Whether users who haven't agreed to the current version of the policy
+	// can't send messages until they do
+	BlockEventsUntilConsent bool `yaml:"block_events_until_consent"`
+}
+
+// ConsentPath is the path of the client API endpoint which serves the policy
+// documents, and which users agree to the policy through.
+const ConsentPath = "/_matrix/client/unstable/consent"
+
+// ConsentPolicyURL returns the URL of the document for the version of the
+// policy, under the base URL of the client API.
+func ConsentPolicyURL(baseURL, version string) string {
+	return strings.TrimSuffix(baseURL, "/") + ConsentPath + "?" + url.Values{"v": {version}}.Encode()
+}
+
+func (c *Consent) Defaults() {
+	c.PolicyName = "Privacy Policy"
+}
+
+func (c *Consent) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.consent.version", c.Version)
+	checkNotEmpty(configErrs, "client_api.consent.policy_name", c.PolicyName)
+	checkNotEmpty(configErrs, "client_api.consent.templates_path", c.TemplatesPath)
+	checkNotEmpty(configErrs, "client_api.consent.form_secret", c.FormSecret)
+}
+
+// ProfileFields configures the custom fields which users can add to their
+// profiles besides their display name and avatar URL, as in MSC4133.
+type ProfileFields struct {
+	// The largest that all of the custom fields of a user's profile can be
+	// together, in bytes of JSON
+	MaxSize int `yaml:"max_size"`
+	// The custom fields which are also copied into the membership events of
+	// users when they change, like their display names and avatar URLs are
+	MembershipFields []string `yaml:"membership_fields"`
+}
+
+func (c *ProfileFields) Defaults() {
+	c.MaxSize = 64 * 1024
+}
+
+func (c *ProfileFields) Verify(configErrs *ConfigErrors) {
+	if c.MaxSize <= 0 {
+		configErrs.Add(fmt.Sprintf("config key %q must be positive", "client_api.profile_fields.max_size"))
+	}
+	for _, name := range c.MembershipFields {
+		switch name {
+		case "", "membership", "displayname", "avatar_url":
+			// These would overwrite the keys which membership events
+			// already have.
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "client_api.profile_fields.membership_fields", name))
+		}
+	}
+}
+
+// The ways which password providers can be asked whether passwords are right.
+const (
+	PasswordProviderTypeHTTP = "http"
+	PasswordProviderTypeExec = "exec"
+)
+
+// PasswordProvider is an external service which checks the passwords of
+// users who log in. It is either sent the user ID and password in a POST
+// request to a URL, or given them on the standard input of a command.
+type PasswordProvider struct {
+	// Either "http" or "exec"
+	Type string `yaml:"type"`
+	// The URL which http providers are sent the user ID and password at
+	URL string `yaml:"url"`
+	// The command and arguments which exec providers are run with
+	Command []string `yaml:"command"`
+	// How long to wait for the provider to answer before checking the
+	// password against the account database instead, 10 seconds by default
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *PasswordProvider) Verify(configErrs *ConfigErrors, key string) {
+	switch c.Type {
+	case PasswordProviderTypeHTTP:
+		checkURL(configErrs, key+".url", c.URL)
+	case PasswordProviderTypeExec:
+		if len(c.Command) == 0 || c.Command[0] == "" {
+			configErrs.Add(fmt.Sprintf("missing config key %q", key+".command"))
+		}
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q, must be %q or %q", key+".type", c.Type, PasswordProviderTypeHTTP, PasswordProviderTypeExec))
+	}
+	if c.Timeout < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".timeout", c.Timeout))
+	}
+}
+
+// MSISDN configures the validation of phone numbers for registration. We
+// can't send text messages ourselves, so the identity server sends them and
+// we ask it whether the user submitted the token.
+type MSISDN struct {
+	// Whether users can register with a phone number
+	Enabled bool `yaml:"enabled"`
+	// The identity server which sends the text messages, which must be one
+	// of global.trusted_third_party_id_servers
+	IdentityServer string `yaml:"identity_server"`
+}
+
+func (c *MSISDN) Verify(configErrs *ConfigErrors, trustedIDServers []string) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.msisdn.identity_server", c.IdentityServer)
+	if c.IdentityServer == "" {
+		return
+	}
+	for _, server := range trustedIDServers {
+		if server == c.IdentityServer {
+			return
+		}
+	}
+	configErrs.Add(fmt.Sprintf(
+		"config key %q must be one of %q", "client_api.msisdn.identity_server",
+		"global.trusted_third_party_id_servers",
+	))
+}
+
+type SSO struct {
+	// Whether users can log in with single sign-on
+	Enabled bool `yaml:"enabled"`
+	// The URL that identity providers send users back to after they log in,
+	// which must be the /login/sso/callback endpoint of the client API.
+	// Defaults to one under global.well_known_client_name.
+	CallbackURL string `yaml:"callback_url"`
+	// The identity providers which users can log in with. The first one is
+	// used by clients which don't let the user choose.
+	Providers []IdentityProvider `yaml:"providers"`
+}
+
+// The protocols which identity providers can use.
+const (
+	IdentityProviderTypeOIDC = "oidc"
+	IdentityProviderTypeSAML = "saml"
+	IdentityProviderTypeCAS  = "cas"
+)
+
+// IdentityProvider is an OpenID Connect, SAML 2.0 or CAS identity provider
+// which users can log in with.
+type IdentityProvider struct {
+	// A unique ID for the provider, which is given to clients
+	ID string `yaml:"id"`
+	// The protocol which the provider uses, either "oidc", "saml" or "cas".
+	// Defaults to "oidc".
+	Type string `yaml:"type"`
+	// The name of the provider which clients show to users
+	Name string `yaml:"name"`
+	// An optional mxc:// URI of an icon for the provider
+	Icon string `yaml:"icon"`
+	// An optional brand, e.g. "github", which clients may style the
+	// provider with
+	Brand string `yaml:"brand"`
+	// OpenID Connect only: the URL of the provider's discovery document,
+	// usually ending with /.well-known/openid-configuration
+	DiscoveryURL string `yaml:"discovery_url"`
+	// OpenID Connect only: the client credentials which the provider issued
+	// for Dendrite
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// OpenID Connect only: the scopes to ask for. Defaults to openid, profile
+	// and email.
+	Scopes []string `yaml:"scopes"`
+	// SAML only: the URL of the identity provider's metadata
+	MetadataURL string `yaml:"metadata_url"`
+	// SAML only: the RSA key and certificate, in PEM format, which Dendrite
+	// signs its requests with and which assertions can be encrypted to
+	PrivateKeyPath  Path `yaml:"private_key_path"`
+	CertificatePath Path `yaml:"certificate_path"`
+	// SAML only: the entity ID of Dendrite as a service provider. Defaults
+	// to the URL of its metadata, which is served at
+	// /login/sso/saml/metadata/{id} next to the callback.
+	EntityID string `yaml:"entity_id"`
+	// CAS only: the URL of the CAS server, under which its /login and
+	// /p3/serviceValidate endpoints are, e.g. https://cas.example.com/cas
+	ServerURL string `yaml:"server_url"`
+	// Which claims or attributes about the user are used for their new
+	// account
+	AttributeMapping SSOAttributeMapping `yaml:"attribute_mapping"`
+}
+
+// SSOAttributeMapping says which claims or SAML attributes about a user who
+// logs in with single sign-on for the first time are used to create their
+// account. SAML attributes are matched by either their name or their
+// friendly name.
+type SSOAttributeMapping struct {
+	// SAML and CAS only: the attribute which identifies the user and never
+	// changes. For SAML this defaults to the subject of the assertion, which
+	// is then requested in the persistent format, and for CAS to the
+	// username.
+	Subject string `yaml:"subject"`
+	// The claim or attribute which the localpart of the user ID is made
+	// from. Characters which can't be in user IDs are escaped. Defaults to
+	// preferred_username for OpenID Connect, uid for SAML and the username
+	// for CAS.
+	Localpart string `yaml:"localpart"`
+	// The claim or attribute which the display name is set from. Defaults to
+	// name for OpenID Connect and displayName for SAML and CAS.
+	DisplayName string `yaml:"display_name"`
+}
+
+// LoginTokenLifetime is how long the m.login.token tokens which are issued
+// after single sign-on can be used for.
+const LoginTokenLifetime = 2 * time.Minute
+
+// identityProviderIDRegexp matches the IDs which the spec allows identity
+// providers to have.
+var identityProviderIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,255}$`)
+
+func (c *SSO) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if len(c.Providers) == 0 {
+		configErrs.Add(fmt.Sprintf("config key %q must contain at least one provider", "client_api.sso.providers"))
+	}
+	ids := map[string]bool{}
+	for i, p := range c.Providers {
+		key := fmt.Sprintf("client_api.sso.providers[%d]", i)
+		checkNotEmpty(configErrs, key+".id", p.ID)
+		checkNotEmpty(configErrs, key+".name", p.Name)
+		switch p.Type {
+		case "", IdentityProviderTypeOIDC:
+			checkNotEmpty(configErrs, key+".discovery_url", p.DiscoveryURL)
+			checkNotEmpty(configErrs, key+".client_id", p.ClientID)
+		case IdentityProviderTypeSAML:
+			checkNotEmpty(configErrs, key+".metadata_url", p.MetadataURL)
+			checkNotEmpty(configErrs, key+".private_key_path", string(p.PrivateKeyPath))
+			checkNotEmpty(configErrs, key+".certificate_path", string(p.CertificatePath))
+		case IdentityProviderTypeCAS:
+			checkNotEmpty(configErrs, key+".server_url", p.ServerURL)
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q, must be %q, %q or %q", key+".type", p.Type, IdentityProviderTypeOIDC, IdentityProviderTypeSAML, IdentityProviderTypeCAS))
+		}
+		if p.ID != "" && !identityProviderIDRegexp.MatchString(p.ID) {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q, must only contain A-Z, a-z, 0-9, '.', '_', '~' and '-'", key+".id", p.ID))
+		}
+		if ids[p.ID] {
+			configErrs.Add(fmt.Sprintf("duplicate value for config key %q: %q", key+".id", p.ID))
+		}
+		ids[p.ID] = true
+	}
 }
 
 type RateLimiting struct {
 	// Is rate limiting enabled or disabled?
-	Enabled bool `yaml:"enabled"`
+	Enabled bool `yaml:"enabled" json:"enabled"`
 
 	// How many "slots" a user can occupy sending requests to a rate-limited
-	// endpoint before we apply rate-limiting
-	Threshold int64 `yaml:"threshold"`
+	// endpoint before we apply rate-limiting. This is effectively the size
+	// of the burst that a user can send before being limited.
+	Threshold int64 `yaml:"threshold" json:"threshold"`
 
 	// The cooloff period in milliseconds after a request before the "slot"
 	// is freed again
-	CooloffMS int64 `yaml:"cooloff_ms"`
+	CooloffMS int64 `yaml:"cooloff_ms" json:"cooloff_ms"`
+
+	// A list of user IDs which are never rate limited, e.g. for bots or bridges
+	ExemptUserIDs []string `yaml:"exempt_user_ids" json:"exempt_user_ids"`
+
+	// A list of IP addresses or CIDR ranges which are never rate limited
+	ExemptIPAddresses []string `yaml:"exempt_ip_addresses" json:"exempt_ip_addresses"`
+
+	// A list of IP addresses or CIDR ranges of the reverse proxies in front
+	// of Dendrite. The X-Forwarded-For header is only used to find the
+	// address of the client on requests which come from one of these.
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies"`
+
+	// Overrides for specific groups of endpoints. Any value which is not set
+	// for a group is inherited from the threshold and cooloff above.
+	Login      RateLimitingGroup `yaml:"login" json:"login"`
+	Messaging  RateLimitingGroup `yaml:"messaging" json:"messaging"`
+	Media      RateLimitingGroup `yaml:"media" json:"media"`
+	Federation RateLimitingGroup `yaml:"federation" json:"federation"`
+}
+
+// RateLimitingGroup overrides the rate limiting settings for a group of endpoints.
+type RateLimitingGroup struct {
+	// How many "slots" a caller can occupy in this group before being limited
+	Threshold int64 `yaml:"threshold" json:"threshold"`
+
+	// The cooloff period in milliseconds before a "slot" in this group is freed
+	CooloffMS int64 `yaml:"cooloff_ms" json:"cooloff_ms"`
 }
 
 func (r *RateLimiting) Verify(configErrs *ConfigErrors) {
@@ -116,10 +611,58 @@ func (r *RateLimiting) Verify(configErrs *ConfigErrors) {
 		checkPositive(configErrs, "client_api.rate_limiting.threshold", r.Threshold)
 		checkPositive(configErrs, "client_api.rate_limiting.cooloff_ms", r.CooloffMS)
 	}
+	for _, addr := range r.ExemptIPAddresses {
+		if _, err := ParseIPOrCIDR(addr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid IP address or CIDR range for config key %q: %s", "client_api.rate_limiting.exempt_ip_addresses", addr))
+		}
+	}
+	for _, addr := range r.TrustedProxies {
+		if _, err := ParseIPOrCIDR(addr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid IP address or CIDR range for config key %q: %s", "client_api.rate_limiting.trusted_proxies", addr))
+		}
+	}
+	r.Login.Verify(configErrs, "client_api.rate_limiting.login")
+	r.Messaging.Verify(configErrs, "client_api.rate_limiting.messaging")
+	r.Media.Verify(configErrs, "client_api.rate_limiting.media")
+	r.Federation.Verify(configErrs, "client_api.rate_limiting.federation")
 }
 
 func (r *RateLimiting) Defaults() {
 	r.Enabled = true
 	r.Threshold = 5
 	r.CooloffMS = 500
+	r.ExemptUserIDs = []string{}
+	r.ExemptIPAddresses = []string{}
+	r.TrustedProxies = []string{}
+	// Federating servers send transactions one after another, so allow them
+	// considerably more headroom than a single client.
+	r.Federation.Threshold = 50
+	r.Federation.CooloffMS = 100
+}
+
+func (r *RateLimitingGroup) Verify(configErrs *ConfigErrors, key string) {
+	if r.Threshold < 0 {
+		configErrs.Add(fmt.Sprintf("config key %q must not be negative", key+".threshold"))
+	}
+	if r.CooloffMS < 0 {
+		configErrs.Add(fmt.Sprintf("config key %q must not be negative", key+".cooloff_ms"))
+	}
+}
+
+// ParseIPOrCIDR parses either a single IP address or a CIDR range. A single
+// address is returned as a range containing only that address.
+func ParseIPOrCIDR(addr string) (*net.IPNet, error) {
+	if !strings.Contains(addr, "/") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", addr)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(addr)
+	return ipNet, err
 }
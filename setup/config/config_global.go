@@ -1,10 +1,12 @@
 package config
 
 import (
+	"fmt"
 	"math/rand"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -37,6 +39,16 @@ type Global struct {
 	// The server name to delegate server-server communications to, with optional port
 	WellKnownServerName string `yaml:"well_known_server_name"`
 
+	// The base URL to delegate client-server communications to, served as m.homeserver
+	// at /.well-known/matrix/client. If empty, /.well-known/matrix/client is not served.
+	WellKnownClientName string `yaml:"well_known_client_name"`
+
+	// The base URL of the identity server to advertise at /.well-known/matrix/client.
+	WellKnownIdentityServer string `yaml:"well_known_identity_server"`
+
+	// The URL of the sliding sync proxy to advertise at /.well-known/matrix/client.
+	WellKnownSlidingSyncProxy string `yaml:"well_known_sliding_sync_proxy"`
+
 	// Disables federation. Dendrite will not be able to make any outbound HTTP requests
 	// to other servers and the federation API will not be exposed.
 	DisableFederation bool `yaml:"disable_federation"`
@@ -52,11 +64,23 @@ type Global struct {
 	// Metrics configuration
 	Metrics Metrics `yaml:"metrics"`
 
+	// Runtime debugging endpoints configuration
+	Debug Debug `yaml:"debug"`
+
 	// Sentry configuration
 	Sentry Sentry `yaml:"sentry"`
 
 	// DNS caching options for all outbound HTTP requests
 	DNSCache DNSCacheOptions `yaml:"dns_cache"`
+
+	// In-memory cache sizes
+	Cache Cache `yaml:"cache"`
+
+	// Admin API configuration
+	AdminAPI AdminAPI `yaml:"admin_api"`
+
+	// Anonymous usage statistics reporting
+	ReportStats ReportStats `yaml:"report_stats"`
 }
 
 func (c *Global) Defaults(generate bool) {
@@ -70,18 +94,35 @@ func (c *Global) Defaults(generate bool) {
 
 	c.JetStream.Defaults(generate)
 	c.Metrics.Defaults(generate)
+	c.Debug.Defaults(generate)
 	c.DNSCache.Defaults()
+	c.Cache.Defaults()
 	c.Sentry.Defaults()
+	c.AdminAPI.Defaults()
+	c.ReportStats.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkNotEmpty(configErrs, "global.server_name", string(c.ServerName))
 	checkNotEmpty(configErrs, "global.private_key", string(c.PrivateKeyPath))
+	if c.WellKnownClientName != "" {
+		checkURL(configErrs, "global.well_known_client_name", c.WellKnownClientName)
+	}
+	if c.WellKnownIdentityServer != "" {
+		checkURL(configErrs, "global.well_known_identity_server", c.WellKnownIdentityServer)
+	}
+	if c.WellKnownSlidingSyncProxy != "" {
+		checkURL(configErrs, "global.well_known_sliding_sync_proxy", c.WellKnownSlidingSyncProxy)
+	}
 
 	c.JetStream.Verify(configErrs, isMonolith)
 	c.Metrics.Verify(configErrs, isMonolith)
+	c.Debug.Verify(configErrs, isMonolith)
 	c.Sentry.Verify(configErrs, isMonolith)
 	c.DNSCache.Verify(configErrs, isMonolith)
+	c.Cache.Verify(configErrs, isMonolith)
+	c.AdminAPI.Verify(configErrs, isMonolith)
+	c.ReportStats.Verify(configErrs, isMonolith)
 }
 
 type OldVerifyKeys struct {
@@ -123,6 +164,31 @@ func (c *Metrics) Defaults(generate bool) {
 func (c *Metrics) Verify(configErrs *ConfigErrors, isMonolith bool) {
 }
 
+// The configuration for the runtime debugging endpoints, which expose pprof
+// profiles, GC statistics and goroutine dumps on the internal HTTP listener.
+type Debug struct {
+	// Whether or not the debug endpoints are enabled
+	Enabled bool `yaml:"enabled"`
+	// Use BasicAuth for Authorization
+	BasicAuth struct {
+		// Authorization via Static Username & Password
+		// Hardcoded Username and Password
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basic_auth"`
+}
+
+func (c *Debug) Defaults(generate bool) {
+	c.Enabled = false
+	if generate {
+		c.BasicAuth.Username = "debug"
+		c.BasicAuth.Password = "debug"
+	}
+}
+
+func (c *Debug) Verify(configErrs *ConfigErrors, isMonolith bool) {
+}
+
 // The configuration to use for Sentry error reporting
 type Sentry struct {
 	Enabled bool `yaml:"enabled"`
@@ -132,13 +198,63 @@ type Sentry struct {
 	// The environment e.g "production"
 	// See https://docs.sentry.io/platforms/go/configuration/environments/
 	Environment string `yaml:"environment"`
+	// The minimum level of log lines to send to Sentry e.g "error". Panics are
+	// always sent. Leave empty to only send panics and explicitly reported errors.
+	LogLevel string `yaml:"log_level"`
 }
 
 func (c *Sentry) Defaults() {
 	c.Enabled = false
+	c.LogLevel = "error"
 }
 
 func (c *Sentry) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "global.sentry.dsn", c.DSN)
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid log level for config key %q: %s", "global.sentry.log_level", c.LogLevel))
+		}
+	}
+}
+
+// The configuration to use for in-memory caches
+type Cache struct {
+	// The maximum number of entries to hold in each named cache, e.g.
+	// "room_versions". Caches which aren't listed use their default sizes.
+	MaxEntries map[string]int `yaml:"max_entries"`
+}
+
+func (c *Cache) Defaults() {
+	c.MaxEntries = map[string]int{}
+}
+
+func (c *Cache) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	for name, maxEntries := range c.MaxEntries {
+		if maxEntries <= 0 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "global.cache.max_entries."+name, maxEntries))
+		}
+	}
+}
+
+// The configuration to use for the Dendrite admin API at /_dendrite/admin
+type AdminAPI struct {
+	// A static access token which grants access to the admin API, in addition
+	// to the access tokens of admin accounts. Useful for scripts and tooling
+	// which don't have an account of their own. Leave empty to disable.
+	Token string `yaml:"token"`
+}
+
+func (c *AdminAPI) Defaults() {
+	c.Token = ""
+}
+
+func (c *AdminAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.Token != "" && len(c.Token) < 16 {
+		configErrs.Add("global.admin_api.token must be at least 16 characters long if set")
+	}
 }
 
 type DatabaseOptions struct {
@@ -176,22 +292,48 @@ func (c DatabaseOptions) ConnMaxLifetime() time.Duration {
 	return time.Duration(c.ConnMaxLifetimeSeconds) * time.Second
 }
 
+// ReportStats configures the periodic reporting of anonymous usage statistics,
+// such as the number of users and rooms, to a statistics endpoint.
+type ReportStats struct {
+	// Whether or not usage statistics should be reported. Off by default.
+	Enabled bool `yaml:"enabled"`
+	// The URL that the usage statistics are POSTed to.
+	Endpoint string `yaml:"endpoint"`
+}
+
+func (c *ReportStats) Defaults() {
+	c.Enabled = false
+	c.Endpoint = "https://matrix.org/report-usage-stats/push"
+}
+
+func (c *ReportStats) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.Enabled {
+		checkURL(configErrs, "global.report_stats.endpoint", c.Endpoint)
+	}
+}
+
 type DNSCacheOptions struct {
 	// Whether the DNS cache is enabled or not
 	Enabled bool `yaml:"enabled"`
 	// How many entries to store in the DNS cache at a given time
 	CacheSize int `yaml:"cache_size"`
-	// How long a cache entry should be considered valid for
+	// The longest that a cache entry should be considered valid for. Entries
+	// with a shorter TTL are only cached for as long as the TTL allows.
 	CacheLifetime time.Duration `yaml:"cache_lifetime"`
+	// The longest that a negative answer, e.g. a name which doesn't exist,
+	// should be cached for.
+	NegativeCacheLifetime time.Duration `yaml:"negative_cache_lifetime"`
 }
 
 func (c *DNSCacheOptions) Defaults() {
 	c.Enabled = false
 	c.CacheSize = 256
 	c.CacheLifetime = time.Minute * 5
+	c.NegativeCacheLifetime = time.Minute
 }
 
 func (c *DNSCacheOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkPositive(configErrs, "cache_size", int64(c.CacheSize))
 	checkPositive(configErrs, "cache_lifetime", int64(c.CacheLifetime))
+	checkPositive(configErrs, "negative_cache_lifetime", int64(c.NegativeCacheLifetime))
 }
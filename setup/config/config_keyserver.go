@@ -1,17 +1,68 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type KeyServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// The most one-time keys that each device can have stored. Uploads which
+	// would go over this are rejected. 0 means that there is no limit.
+	MaxOneTimeKeysPerDevice int `yaml:"max_one_time_keys_per_device"`
+
+	// How the device lists of remote users are fetched when they go stale.
+	DeviceListUpdater DeviceListUpdater `yaml:"device_list_updater"`
+
+	// How long to keep the keys of deleted devices and the history of key changes.
+	Cleanup KeyCleanup `yaml:"cleanup"`
+}
+
+// KeyCleanup configures the periodic deletion of keys which aren't needed any
+// more, which stops the key server database from growing forever.
+type KeyCleanup struct {
+	// How often to clean up. 0 turns the cleanup off.
+	Interval time.Duration `yaml:"interval"`
+	// How long to keep the device keys and one-time keys of deleted devices.
+	// 0 keeps them forever.
+	DeletedDeviceRetention time.Duration `yaml:"deleted_device_retention"`
+	// How long to keep the history of which users' keys have changed. Clients
+	// which haven't synced for longer than this may miss changes to device
+	// lists. 0 keeps the history forever.
+	KeyChangeRetention time.Duration `yaml:"key_change_retention"`
+}
+
+// DeviceListUpdater configures the fetching of the device lists of remote
+// users, which happens when we miss an update to them.
+type DeviceListUpdater struct {
+	// The number of workers fetching device lists. Each remote server is
+	// handled by one worker, so this is the most servers that are asked for
+	// device lists at once.
+	Workers int `yaml:"workers"`
+	// How long to wait before asking a server again after it fails. The nth
+	// failure in a row waits for the nth interval, and the last interval is
+	// used after that and for blacklisted servers. Servers which ask us to
+	// wait for longer are left alone for as long as they ask.
+	Backoff []time.Duration `yaml:"backoff"`
+	// How often to retry all of the device lists which are still stale, for
+	// example after a server came back up. 0 turns this off, in which case
+	// they are only retried when their servers are backed off from and on
+	// startup.
+	StaleRetryInterval time.Duration `yaml:"stale_retry_interval"`
 }
 
 func (c *KeyServer) Defaults(generate bool) {
 	c.InternalAPI.Listen = "http://localhost:7779"
 	c.InternalAPI.Connect = "http://localhost:7779"
 	c.Database.Defaults(10)
+	c.MaxOneTimeKeysPerDevice = 1000
+	c.DeviceListUpdater.Defaults()
+	c.Cleanup.Defaults()
 	if generate {
 		c.Database.ConnectionString = "file:keyserver.db"
 	}
@@ -21,4 +72,52 @@ func (c *KeyServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "key_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "key_server.internal_api.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "key_server.database.connection_string", string(c.Database.ConnectionString))
+	if c.MaxOneTimeKeysPerDevice < 0 {
+		configErrs.Add("config key \"key_server.max_one_time_keys_per_device\" must not be negative")
+	}
+	c.DeviceListUpdater.Verify(configErrs, isMonolith)
+	c.Cleanup.Verify(configErrs, isMonolith)
+}
+
+func (c *DeviceListUpdater) Defaults() {
+	c.Workers = 8
+	c.Backoff = []time.Duration{
+		2 * time.Second, 30 * time.Second, 5 * time.Minute, time.Hour, 8 * time.Hour,
+	}
+	c.StaleRetryInterval = time.Hour
+}
+
+func (c *DeviceListUpdater) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.Workers < 1 {
+		configErrs.Add("config key \"key_server.device_list_updater.workers\" must be at least 1")
+	}
+	if len(c.Backoff) == 0 {
+		configErrs.Add("config key \"key_server.device_list_updater.backoff\" must have at least one interval")
+	}
+	for i, interval := range c.Backoff {
+		if interval <= 0 {
+			configErrs.Add(fmt.Sprintf("config key \"key_server.device_list_updater.backoff\" has an invalid interval %s at position %d", interval, i))
+		}
+	}
+	if c.StaleRetryInterval < 0 {
+		configErrs.Add("config key \"key_server.device_list_updater.stale_retry_interval\" must not be negative")
+	}
+}
+
+func (c *KeyCleanup) Defaults() {
+	c.Interval = 24 * time.Hour
+	c.DeletedDeviceRetention = 30 * 24 * time.Hour
+	c.KeyChangeRetention = 90 * 24 * time.Hour
+}
+
+func (c *KeyCleanup) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.Interval < 0 {
+		configErrs.Add("config key \"key_server.cleanup.interval\" must not be negative")
+	}
+	if c.DeletedDeviceRetention < 0 {
+		configErrs.Add("config key \"key_server.cleanup.deleted_device_retention\" must not be negative")
+	}
+	if c.KeyChangeRetention < 0 {
+		configErrs.Add("config key \"key_server.cleanup.key_change_retention\" must not be negative")
+	}
 }
@@ -1,15 +1,32 @@
 package config
 
+import "fmt"
+
+// supportedMSCs are the MSCs which can be enabled in the config.
+var supportedMSCs = map[string]bool{
+	"msc2444": true,
+	"msc2697": true,
+	"msc2753": true,
+	"msc2836": true,
+	"msc2946": true,
+}
+
 type MSCs struct {
 	Matrix *Global `yaml:"-"`
 
 	// The MSCs to enable. Supported MSCs include:
 	// 'msc2444': Peeking over federation - https://github.com/matrix-org/matrix-doc/pull/2444
+	// 'msc2697': Dehydrated devices - https://github.com/matrix-org/matrix-doc/pull/2697
 	// 'msc2753': Peeking via /sync - https://github.com/matrix-org/matrix-doc/pull/2753
 	// 'msc2836': Threading - https://github.com/matrix-org/matrix-doc/pull/2836
 	// 'msc2946': Spaces Summary - https://github.com/matrix-org/matrix-doc/pull/2946
 	MSCs []string `yaml:"mscs"`
 
+	// Unstable features to advertise in /versions in addition to those of
+	// the enabled MSCs, or to stop advertising if set to false. This is
+	// useful when a feature is implemented by something in front of Dendrite.
+	UnstableFeatures map[string]bool `yaml:"unstable_features"`
+
 	Database DatabaseOptions `yaml:"database"`
 }
 
@@ -30,6 +47,33 @@ func (c *MSCs) Enabled(msc string) bool {
 	return false
 }
 
+// AdvertisedUnstableFeatures returns the unstable features to advertise in
+// /versions. The builtin features are always advertised unless the config
+// turns them off, followed by a feature for each of the enabled MSCs.
+func (c *MSCs) AdvertisedUnstableFeatures(builtin map[string]bool) map[string]bool {
+	features := make(map[string]bool, len(builtin)+len(c.MSCs)+len(c.UnstableFeatures))
+	for feature, enabled := range builtin {
+		features[feature] = enabled
+	}
+	for _, msc := range c.MSCs {
+		features["org.matrix."+msc] = true
+	}
+	for feature, enabled := range c.UnstableFeatures {
+		features[feature] = enabled
+	}
+	return features
+}
+
 func (c *MSCs) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkNotEmpty(configErrs, "mscs.database.connection_string", string(c.Database.ConnectionString))
+	for _, msc := range c.MSCs {
+		if !supportedMSCs[msc] {
+			configErrs.Add(fmt.Sprintf("unsupported MSC %q for config key %q", msc, "mscs.mscs"))
+		}
+	}
+	for feature := range c.UnstableFeatures {
+		if feature == "" {
+			configErrs.Add(fmt.Sprintf("invalid empty feature name for config key %q", "mscs.unstable_features"))
+		}
+	}
 }
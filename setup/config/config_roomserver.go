@@ -1,11 +1,27 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+)
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// Moderation policy lists (MSC2313) to enforce on this server.
+	PolicyLists PolicyLists `yaml:"policy_lists"`
+}
+
+type PolicyLists struct {
+	// Whether to enforce the rules in the policy rooms.
+	Enabled bool `yaml:"enabled"`
+	// The room IDs of the policy rooms to enforce. The server must already be
+	// joined to these rooms.
+	Rooms []string `yaml:"rooms"`
 }
 
 func (c *RoomServer) Defaults(generate bool) {
@@ -21,4 +37,11 @@ func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "room_server.internal_ap.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
+	if c.PolicyLists.Enabled {
+		for _, roomID := range c.PolicyLists.Rooms {
+			if !strings.HasPrefix(roomID, "!") {
+				configErrs.Add(fmt.Sprintf("invalid room ID %q for config key %q", roomID, "room_server.policy_lists.rooms"))
+			}
+		}
+	}
 }
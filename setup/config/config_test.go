@@ -16,11 +16,13 @@ package config
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestLoadConfigRelative(t *testing.T) {
-	_, err := loadConfig("/my/config/dir", []byte(testConfig),
+	cfg, err := loadConfig("/my/config/dir", []byte(testConfig),
 		mockReadFile{
 			"/my/config/dir/matrix_key.pem": testKey,
 			"/my/config/dir/tls_cert.pem":   testCert,
@@ -28,7 +30,14 @@ func TestLoadConfigRelative(t *testing.T) {
 		false,
 	)
 	if err != nil {
-		t.Error("failed to load config:", err)
+		t.Fatal("failed to load config:", err)
+	}
+	updater := cfg.KeyServer.DeviceListUpdater
+	if updater.Workers != 4 || updater.StaleRetryInterval != 30*time.Minute {
+		t.Errorf("got device list updater config %+v want 4 workers and a stale retry interval of 30m", updater)
+	}
+	if want := []time.Duration{5 * time.Second, time.Minute, time.Hour}; !reflect.DeepEqual(updater.Backoff, want) {
+		t.Errorf("got backoff %v want %v", updater.Backoff, want)
 	}
 }
 
@@ -132,6 +141,10 @@ key_server:
     max_open_conns: 100
     max_idle_conns: 2
     conn_max_lifetime: -1
+  device_list_updater:
+    workers: 4
+    backoff: [5s, 1m, 1h]
+    stale_retry_interval: 30m
 media_api:
   internal_api:
     listen: http://localhost:7774
@@ -245,6 +258,40 @@ func TestReadKey(t *testing.T) {
 	}
 }
 
+func TestMSCsAdvertisedUnstableFeatures(t *testing.T) {
+	c := MSCs{
+		MSCs: []string{"msc2836"},
+		UnstableFeatures: map[string]bool{
+			"org.example.feature":          true,
+			"org.matrix.e2e_cross_signing": false,
+		},
+	}
+	features := c.AdvertisedUnstableFeatures(map[string]bool{
+		"org.matrix.e2e_cross_signing": true,
+	})
+	want := map[string]bool{
+		"org.matrix.e2e_cross_signing": false,
+		"org.matrix.msc2836":           true,
+		"org.example.feature":          true,
+	}
+	if len(features) != len(want) {
+		t.Fatalf("got features %v want %v", features, want)
+	}
+	for feature, enabled := range want {
+		if got, ok := features[feature]; !ok || got != enabled {
+			t.Errorf("got %q = %v want %v", feature, got, enabled)
+		}
+	}
+
+	var configErrs ConfigErrors
+	c = MSCs{MSCs: []string{"msc2836", "msc1234"}}
+	c.Database.ConnectionString = "file:mscs.db"
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 1 {
+		t.Errorf("got config errors %v want one for the unsupported MSC", configErrs)
+	}
+}
+
 const testKeyID = "ed25519:c8NsuQ"
 
 const testKey = `
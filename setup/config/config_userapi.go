@@ -1,6 +1,13 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -10,15 +17,410 @@ type UserAPI struct {
 	// The cost when hashing passwords.
 	BCryptCost int `yaml:"bcrypt_cost"`
 
+	// The algorithm to hash new passwords with. Passwords which were hashed
+	// with a different algorithm or cost are rehashed when users log in.
+	PasswordHashing PasswordHashingAlgorithm `yaml:"password_hashing"`
+
+	// The parameters for hashing passwords with argon2id.
+	Argon2id Argon2id `yaml:"argon2id"`
+
 	// The length of time an OpenID token is condidered valid in milliseconds
 	OpenIDTokenLifetimeMS int64 `yaml:"openid_token_lifetime_ms"`
 
+	// How long the access tokens of clients which ask for a refresh token are
+	// valid for, after which the client has to refresh them. Refresh tokens
+	// aren't given out if this is 0, and access tokens which are issued
+	// without a refresh token never expire.
+	RefreshableAccessTokenLifetime time.Duration `yaml:"refreshable_access_token_lifetime"`
+
+	// When devices which haven't been used for a while are logged out.
+	SessionExpiry SessionExpiry `yaml:"session_expiry"`
+
+	// Slows down guessing passwords by making clients wait after failed
+	// logins.
+	LoginThrottle LoginThrottle `yaml:"login_throttle"`
+
 	// The Account database stores the login details and account information
 	// for local users. It is accessed by the UserAPI.
 	AccountDatabase DatabaseOptions `yaml:"account_database"`
 	// The Device database stores session information for the devices of logged
 	// in local users. It is accessed by the UserAPI.
 	DeviceDatabase DatabaseOptions `yaml:"device_database"`
+
+	// Email notifications for the users who have set up an email pusher.
+	EmailNotifications EmailNotifications `yaml:"email_notifications"`
+
+	// WebPush for the users who have set up a WebPush pusher in their browser.
+	WebPush WebPush `yaml:"web_push"`
+
+	// Restrictions on the push gateways that users can set up pushers for.
+	PushGateways PushGateways `yaml:"push_gateways"`
+
+	// A limit on the number of users who can be active in a month.
+	MonthlyActiveUsers MonthlyActiveUsers `yaml:"monthly_active_users"`
+
+	// When accounts expire unless their users renew them.
+	AccountValidity AccountValidity `yaml:"account_validity"`
+
+	// Which users can be found in the user directory.
+	UserDirectory UserDirectory `yaml:"user_directory"`
+
+	// Changes to the server-default push rules, which new accounts are given.
+	// Added rules are also given to existing accounts, but changes to the
+	// built-in rules are not, as those accounts already have them.
+	DefaultPushRules []DefaultPushRule `yaml:"default_push_rules"`
+}
+
+// MonthlyActiveUsers limits how many users can use the server within a month,
+// counting the users who have logged in, registered or synced in the last 30
+// days.
+type MonthlyActiveUsers struct {
+	// The most users who can be active within a month. Once it is reached,
+	// users who haven't been active in the last month can't log in, and new
+	// users can't register, until some of the active users become inactive.
+	// There is no limit if this is 0.
+	Limit int64 `yaml:"limit"`
+	// The contact for the server admins, e.g. a "mailto:" URI, which users
+	// who are refused because of the limit are told about.
+	AdminContact string `yaml:"admin_contact"`
+}
+
+func (c *MonthlyActiveUsers) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.Limit < 0 {
+		configErrs.Add("config key \"user_api.monthly_active_users.limit\" must not be negative")
+	}
+	if c.Limit > 0 {
+		checkNotEmpty(configErrs, "user_api.monthly_active_users.admin_contact", c.AdminContact)
+	}
+}
+
+// AccountValidity makes accounts expire a while after they are registered,
+// unless they are renewed by following a link which their users are emailed
+// before then. The users of expired accounts get M_RESOURCE_LIMIT_EXCEEDED
+// errors until their account is renewed.
+type AccountValidity struct {
+	// How long accounts are valid for after they are registered or renewed.
+	// Accounts never expire if this is 0.
+	Period time.Duration `yaml:"period"`
+	// How long before an account expires to email the renewal link to its
+	// user.
+	RenewAt time.Duration `yaml:"renew_at"`
+	// The contact for the server admins, e.g. a "mailto:" URI, which the
+	// users of expired accounts are told about.
+	AdminContact string `yaml:"admin_contact"`
+	// The address that the renewal emails are sent from.
+	From string `yaml:"from"`
+	// The SMTP server that the renewal emails are sent through.
+	SMTP SMTP `yaml:"smtp"`
+	// An optional Go text/template to use for the renewal emails instead of
+	// the built-in one.
+	TemplatePath Path `yaml:"template_path"`
+}
+
+func (c *AccountValidity) Defaults() {
+	c.RenewAt = time.Hour * 24 * 7
+}
+
+func (c *AccountValidity) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.Period < 0 {
+		configErrs.Add("config key \"user_api.account_validity.period\" must not be negative")
+	}
+	if c.Period <= 0 {
+		return
+	}
+	if c.RenewAt < 0 || c.RenewAt >= c.Period {
+		configErrs.Add("config key \"user_api.account_validity.renew_at\" must not be negative, and must be less than the period")
+	}
+	checkNotEmpty(configErrs, "user_api.account_validity.admin_contact", c.AdminContact)
+	checkNotEmpty(configErrs, "user_api.account_validity.from", c.From)
+	checkNotEmpty(configErrs, "user_api.account_validity.smtp.host", c.SMTP.Host)
+}
+
+// SessionExpiry logs out the devices which haven't been used for a while,
+// going by when they last synced.
+type SessionExpiry struct {
+	// How long a device can go unused before it is soft-logged-out, so that
+	// the user has to log in with it again. Devices never expire if this is 0.
+	IdleLifetime time.Duration `yaml:"idle_lifetime"`
+	// How long soft-logged-out devices are kept for before they are deleted,
+	// along with their keys.
+	Retention time.Duration `yaml:"retention"`
+}
+
+func (c *SessionExpiry) Defaults() {
+	c.Retention = time.Hour * 24 * 7
+}
+
+func (c *SessionExpiry) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.IdleLifetime < 0 {
+		configErrs.Add("config key \"user_api.session_expiry.idle_lifetime\" must not be negative")
+	}
+	if c.Retention < 0 {
+		configErrs.Add("config key \"user_api.session_expiry.retention\" must not be negative")
+	}
+}
+
+// LoginThrottle makes clients wait before they can try to log in again after
+// failed password logins, counting the failures for each account and for
+// each IP address separately.
+type LoginThrottle struct {
+	Enabled bool `yaml:"enabled"`
+	// The limits on failed logins to an account, from any IP address.
+	Account LoginThrottleLimits `yaml:"per_account"`
+	// The limits on failed logins from an IP address, to any account.
+	IP LoginThrottleLimits `yaml:"per_ip"`
+}
+
+// LoginThrottleLimits is how many failed logins are allowed before clients
+// have to wait, and for how long.
+type LoginThrottleLimits struct {
+	// How many logins can fail before clients have to wait before trying
+	// again. The wait doubles with each failure after that.
+	DelayAfter int `yaml:"delay_after"`
+	// How long clients have to wait after the first failure which is delayed.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	// How many logins can fail before no more logins are allowed until the
+	// lockout duration has passed since the last failure.
+	LockoutAfter int `yaml:"lockout_after"`
+	// How long logins are locked out for, which is also how long failures
+	// are remembered for.
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+}
+
+func (c *LoginThrottle) Defaults() {
+	c.Enabled = true
+	c.Account = LoginThrottleLimits{
+		DelayAfter:      3,
+		BaseDelay:       time.Second,
+		LockoutAfter:    10,
+		LockoutDuration: time.Minute * 15,
+	}
+	// IP addresses can be shared by many users, so they get more tries.
+	c.IP = LoginThrottleLimits{
+		DelayAfter:      10,
+		BaseDelay:       time.Second,
+		LockoutAfter:    50,
+		LockoutDuration: time.Minute * 15,
+	}
+}
+
+func (c *LoginThrottle) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if !c.Enabled {
+		return
+	}
+	c.Account.Verify(configErrs, "user_api.login_throttle.per_account")
+	c.IP.Verify(configErrs, "user_api.login_throttle.per_ip")
+}
+
+func (c *LoginThrottleLimits) Verify(configErrs *ConfigErrors, key string) {
+	checkPositive(configErrs, key+".delay_after", int64(c.DelayAfter))
+	checkPositive(configErrs, key+".base_delay", int64(c.BaseDelay))
+	checkPositive(configErrs, key+".lockout_duration", int64(c.LockoutDuration))
+	if c.LockoutAfter < c.DelayAfter {
+		configErrs.Add(fmt.Sprintf("config key %q must not be less than %q", key+".lockout_after", key+".delay_after"))
+	}
+}
+
+// UserDirectory configures which users the user directory search finds.
+// Users who share a room with the user who is searching are always found.
+type UserDirectory struct {
+	// Whether to find all local users, even those who don't share a room
+	// with the user who is searching.
+	SearchAllLocalUsers bool `yaml:"search_all_local_users"`
+	// Whether to find remote users who share a room with the user who is
+	// searching.
+	IncludeRemoteUsers bool `yaml:"include_remote_users"`
+}
+
+func (c *UserDirectory) Defaults() {
+	c.SearchAllLocalUsers = true
+	c.IncludeRemoteUsers = true
+}
+
+// PasswordHashingAlgorithm is an algorithm which passwords can be hashed with.
+type PasswordHashingAlgorithm string
+
+const (
+	PasswordHashingBCrypt   PasswordHashingAlgorithm = "bcrypt"
+	PasswordHashingArgon2id PasswordHashingAlgorithm = "argon2id"
+)
+
+// Argon2id are the parameters for hashing passwords with argon2id. Passwords
+// take longer to hash, and need more memory to do so, the higher they are.
+type Argon2id struct {
+	// The number of passes over the memory.
+	Time uint32 `yaml:"time"`
+	// The amount of memory to use in KiB.
+	Memory uint32 `yaml:"memory"`
+	// The number of threads to use.
+	Threads uint8 `yaml:"threads"`
+}
+
+func (c *Argon2id) Defaults() {
+	// The parameters which are recommended by RFC 9106 for when memory is
+	// constrained.
+	c.Time = 3
+	c.Memory = 64 * 1024
+	c.Threads = 4
+}
+
+func (c *Argon2id) Verify(configErrs *ConfigErrors) {
+	if c.Time == 0 {
+		configErrs.Add(fmt.Sprintf("config key %q must be at least 1", "user_api.argon2id.time"))
+	}
+	if c.Threads == 0 {
+		configErrs.Add(fmt.Sprintf("config key %q must be at least 1", "user_api.argon2id.threads"))
+	}
+	if c.Memory < 8*uint32(c.Threads) {
+		configErrs.Add(fmt.Sprintf("config key %q must be at least 8 KiB per thread", "user_api.argon2id.memory"))
+	}
+}
+
+// DefaultPushRule changes or adds a server-default push rule. An entry with
+// the rule ID of a built-in default rule only changes the fields which it
+// sets, any other entry adds a default rule after the built-in ones of the
+// same kind. The actions and conditions are written as in the push rules
+// API.
+type DefaultPushRule struct {
+	// The kind of the rule: "override", "content" or "underride".
+	Kind string `yaml:"kind"`
+	// The ID of the rule, which must start with a ".".
+	RuleID     string        `yaml:"rule_id"`
+	Enabled    *bool         `yaml:"enabled"`
+	Actions    []interface{} `yaml:"actions"`
+	Conditions []interface{} `yaml:"conditions"`
+	// The body pattern of content rules.
+	Pattern string `yaml:"pattern"`
+}
+
+func (c *DefaultPushRule) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	switch c.Kind {
+	case "override", "content", "underride":
+	default:
+		configErrs.Add(fmt.Sprintf("invalid kind %q of push rule %q for config key %q", c.Kind, c.RuleID, "user_api.default_push_rules"))
+	}
+	if !strings.HasPrefix(c.RuleID, ".") {
+		configErrs.Add(fmt.Sprintf("invalid push rule ID %q for config key %q, server-default rule IDs start with \".\"", c.RuleID, "user_api.default_push_rules"))
+	}
+}
+
+// PushGateways restricts the URLs that users can set up HTTP pushers with,
+// since the server makes requests to them.
+type PushGateways struct {
+	// The URL schemes which push gateways may use.
+	AllowedSchemes []string `yaml:"allowed_schemes"`
+	// The hosts which push gateways may be at. An entry starting with "*."
+	// also allows any subdomain. Any host is allowed when this is empty.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// Whether to refuse push gateways, and WebPush endpoints, at loopback,
+	// link-local and private network addresses.
+	DenyPrivateIPs bool `yaml:"deny_private_ips"`
+}
+
+func (c *PushGateways) Defaults() {
+	c.AllowedSchemes = []string{"https", "http"}
+	c.DenyPrivateIPs = true
+}
+
+func (c *PushGateways) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if len(c.AllowedSchemes) == 0 {
+		configErrs.Add("config key \"user_api.push_gateways.allowed_schemes\" must not be empty")
+	}
+	for _, scheme := range c.AllowedSchemes {
+		if scheme != "https" && scheme != "http" {
+			configErrs.Add(fmt.Sprintf("invalid scheme %q for config key %q", scheme, "user_api.push_gateways.allowed_schemes"))
+		}
+	}
+	for _, host := range c.AllowedHosts {
+		if strings.TrimPrefix(host, "*.") == "" {
+			configErrs.Add(fmt.Sprintf("invalid host %q for config key %q", host, "user_api.push_gateways.allowed_hosts"))
+		}
+	}
+}
+
+// WebPush configures the sending of notifications straight to the push
+// services of browsers, without going through a push gateway.
+type WebPush struct {
+	// The VAPID private key that the notifications are signed with, as an
+	// unpadded base64url encoded P-256 scalar. WebPush pushers can still be
+	// set up without it, but are ignored.
+	VAPIDPrivateKey string `yaml:"vapid_private_key"`
+	// The contact for the operator of the server, given to the push services
+	// as a "mailto:" or "https:" URI.
+	Subject string `yaml:"subject"`
+	// How long the push services should keep trying to deliver a
+	// notification to a browser which is offline.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// Enabled returns whether WebPush pushers can be used.
+func (c *WebPush) Enabled() bool {
+	return c.VAPIDPrivateKey != ""
+}
+
+func (c *WebPush) Defaults() {
+	c.TTL = 24 * time.Hour
+}
+
+func (c *WebPush) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if !c.Enabled() {
+		return
+	}
+	if key, err := base64.RawURLEncoding.DecodeString(c.VAPIDPrivateKey); err != nil || len(key) != 32 {
+		configErrs.Add("config key \"user_api.web_push.vapid_private_key\" must be an unpadded base64url encoded 32 byte key")
+	}
+	checkNotEmpty(configErrs, "user_api.web_push.subject", c.Subject)
+	if c.Subject != "" && !strings.HasPrefix(c.Subject, "mailto:") && !strings.HasPrefix(c.Subject, "https:") {
+		configErrs.Add("config key \"user_api.web_push.subject\" must be a mailto: or https: URI")
+	}
+	if c.TTL < 0 {
+		configErrs.Add("config key \"user_api.web_push.ttl\" must not be negative")
+	}
+}
+
+// EmailNotifications configures the sending of emails to users with email
+// pushers about the notifications that they haven't read.
+type EmailNotifications struct {
+	// Whether or not notification emails are sent. Off by default, in which
+	// case email pushers can still be set up but are ignored.
+	Enabled bool `yaml:"enabled"`
+	// The address that the notification emails are sent from.
+	From string `yaml:"from"`
+	// The SMTP server that the notification emails are sent through.
+	SMTP SMTP `yaml:"smtp"`
+	// How long to wait after a user is first notified before sending them an
+	// email, so that further notifications are sent in the same email. The
+	// notifications which the user reads in the meantime are left out.
+	QuietPeriod time.Duration `yaml:"quiet_period"`
+	// An optional Go text/template to use for the notification emails
+	// instead of the built-in one.
+	TemplatePath Path `yaml:"template_path"`
+}
+
+// SMTP is the address and credentials of an SMTP server. STARTTLS is used
+// when the server supports it.
+type SMTP struct {
+	// The host and port of the SMTP server, e.g. "smtp.example.com:587".
+	Host string `yaml:"host"`
+	// The username and password to authenticate with, if the server needs them.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (c *EmailNotifications) Defaults() {
+	c.Enabled = false
+	c.QuietPeriod = 10 * time.Minute
+}
+
+func (c *EmailNotifications) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "user_api.email_notifications.from", c.From)
+	checkNotEmpty(configErrs, "user_api.email_notifications.smtp.host", c.SMTP.Host)
+	if c.QuietPeriod < 0 {
+		configErrs.Add("config key \"user_api.email_notifications.quiet_period\" must not be negative")
+	}
 }
 
 const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
@@ -33,7 +435,17 @@ func (c *UserAPI) Defaults(generate bool) {
 		c.DeviceDatabase.ConnectionString = "file:userapi_devices.db"
 	}
 	c.BCryptCost = bcrypt.DefaultCost
+	c.PasswordHashing = PasswordHashingBCrypt
+	c.Argon2id.Defaults()
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
+	c.RefreshableAccessTokenLifetime = 5 * time.Minute
+	c.SessionExpiry.Defaults()
+	c.LoginThrottle.Defaults()
+	c.AccountValidity.Defaults()
+	c.EmailNotifications.Defaults()
+	c.WebPush.Defaults()
+	c.PushGateways.Defaults()
+	c.UserDirectory.Defaults()
 }
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -42,4 +454,37 @@ func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	checkNotEmpty(configErrs, "user_api.device_database.connection_string", string(c.DeviceDatabase.ConnectionString))
 	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	if c.RefreshableAccessTokenLifetime < 0 {
+		configErrs.Add("config key \"user_api.refreshable_access_token_lifetime\" must not be negative")
+	}
+	if c.BCryptCost < bcrypt.MinCost || c.BCryptCost > bcrypt.MaxCost {
+		configErrs.Add(fmt.Sprintf("config key %q must be between %d and %d", "user_api.bcrypt_cost", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	switch c.PasswordHashing {
+	case PasswordHashingBCrypt:
+	case PasswordHashingArgon2id:
+		c.Argon2id.Verify(configErrs)
+	default:
+		configErrs.Add(fmt.Sprintf("unknown password hashing algorithm %q for config key %q", c.PasswordHashing, "user_api.password_hashing"))
+	}
+	c.EmailNotifications.Verify(configErrs, isMonolith)
+	c.WebPush.Verify(configErrs, isMonolith)
+	c.PushGateways.Verify(configErrs, isMonolith)
+	c.MonthlyActiveUsers.Verify(configErrs, isMonolith)
+	c.SessionExpiry.Verify(configErrs, isMonolith)
+	c.LoginThrottle.Verify(configErrs, isMonolith)
+	c.AccountValidity.Verify(configErrs, isMonolith)
+	if c.AccountValidity.Period > 0 {
+		// The renewal links in the emails point at the client API.
+		checkNotEmpty(configErrs, "global.well_known_client_name", c.Matrix.WellKnownClientName)
+	}
+	ruleIDs := make(map[string]bool, len(c.DefaultPushRules))
+	for i := range c.DefaultPushRules {
+		rule := &c.DefaultPushRules[i]
+		rule.Verify(configErrs, isMonolith)
+		if ruleIDs[rule.RuleID] {
+			configErrs.Add(fmt.Sprintf("duplicate push rule ID %q for config key %q", rule.RuleID, "user_api.default_push_rules"))
+		}
+		ruleIDs[rule.RuleID] = true
+	}
 }
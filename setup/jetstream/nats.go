@@ -90,5 +90,23 @@ func setupNATS(cfg *config.JetStream, nc *natsclient.Conn) natsclient.JetStreamC
 		}
 	}
 
+	for _, kv := range keyValues { // key-value buckets are defined in streams.go
+		name := cfg.TopicFor(kv.Bucket)
+		_, err := s.KeyValue(name)
+		if err != nil && err != natsclient.ErrBucketNotFound {
+			logrus.WithError(err).Fatal("Unable to get key-value bucket")
+		}
+		if err == natsclient.ErrBucketNotFound {
+			namespaced := *kv
+			namespaced.Bucket = name
+			if cfg.InMemory {
+				namespaced.Storage = natsclient.MemoryStorage
+			}
+			if _, err = s.CreateKeyValue(&namespaced); err != nil {
+				logrus.WithError(err).WithField("bucket", name).Fatal("Unable to add key-value bucket")
+			}
+		}
+	}
+
 	return s
 }
@@ -3,6 +3,7 @@ package jetstream
 import (
 	"time"
 
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/nats-io/nats.go"
 )
 
@@ -19,6 +20,19 @@ var (
 	OutputTypingEvent       = "OutputTypingEvent"
 	OutputClientData        = "OutputClientData"
 	OutputReceiptEvent      = "OutputReceiptEvent"
+	OutputRateLimitsUpdate  = "OutputRateLimitsUpdate"
+	OutputNotificationData  = "OutputNotificationData"
+	OutputDeletedDevices    = "OutputDeletedDevices"
+)
+
+// Key-value buckets, used for state which has to be shared between multiple
+// instances of a component.
+var (
+	ClientAPISessions           = "ClientAPISessions"
+	ClientAPINonces             = "ClientAPINonces"
+	ClientAPIValidationSessions = "ClientAPIValidationSessions"
+	ClientAPILoginTokens        = "ClientAPILoginTokens"
+	ClientAPITransactions       = "ClientAPITransactions"
 )
 
 var streams = []*nats.StreamConfig{
@@ -58,4 +72,48 @@ var streams = []*nats.StreamConfig{
 		Retention: nats.InterestPolicy,
 		Storage:   nats.FileStorage,
 	},
+	{
+		Name:      OutputRateLimitsUpdate,
+		Retention: nats.InterestPolicy,
+		Storage:   nats.MemoryStorage,
+		MaxAge:    time.Second * 60,
+	},
+	{
+		Name:      OutputNotificationData,
+		Retention: nats.InterestPolicy,
+		Storage:   nats.FileStorage,
+	},
+	{
+		Name:      OutputDeletedDevices,
+		Retention: nats.InterestPolicy,
+		Storage:   nats.FileStorage,
+	},
+}
+
+var keyValues = []*nats.KeyValueConfig{
+	{
+		Bucket:  ClientAPISessions,
+		Storage: nats.FileStorage,
+		TTL:     time.Hour,
+	},
+	{
+		Bucket:  ClientAPINonces,
+		Storage: nats.MemoryStorage,
+		TTL:     time.Minute * 5,
+	},
+	{
+		Bucket:  ClientAPIValidationSessions,
+		Storage: nats.FileStorage,
+		TTL:     config.MaxEmailTokenLifetime,
+	},
+	{
+		Bucket:  ClientAPILoginTokens,
+		Storage: nats.MemoryStorage,
+		TTL:     config.LoginTokenLifetime,
+	},
+	{
+		Bucket:  ClientAPITransactions,
+		Storage: nats.MemoryStorage,
+		TTL:     time.Minute * 30, // transactions.DefaultCleanupPeriod
+	},
 }
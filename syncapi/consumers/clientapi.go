@@ -17,6 +17,7 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/matrix-org/dendrite/internal/eventutil"
@@ -26,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
 )
@@ -39,6 +41,7 @@ type OutputClientDataConsumer struct {
 	db        storage.Database
 	stream    types.StreamProvider
 	notifier  *notifier.Notifier
+	userAPI   userapi.UserInternalAPI
 }
 
 // NewOutputClientDataConsumer creates a new OutputClientData consumer. Call Start() to begin consuming from room servers.
@@ -49,6 +52,7 @@ func NewOutputClientDataConsumer(
 	store storage.Database,
 	notifier *notifier.Notifier,
 	stream types.StreamProvider,
+	userAPI userapi.UserInternalAPI,
 ) *OutputClientDataConsumer {
 	return &OutputClientDataConsumer{
 		ctx:       process.Context(),
@@ -58,6 +62,7 @@ func NewOutputClientDataConsumer(
 		db:        store,
 		notifier:  notifier,
 		stream:    stream,
+		userAPI:   userAPI,
 	}
 }
 
@@ -88,6 +93,13 @@ func (s *OutputClientDataConsumer) onMessage(ctx context.Context, msg *nats.Msg)
 		"room_id": output.RoomID,
 	}).Debug("Received data from client API server")
 
+	if output.Type == ignoredUserListType && output.RoomID == "" {
+		if err := s.updateIgnores(ctx, userID); err != nil {
+			log.WithField("user_id", userID).WithError(err).Error("could not update ignored users")
+			sentry.CaptureException(err)
+		}
+	}
+
 	streamPos, err := s.db.UpsertAccountData(
 		s.ctx, userID, output.RoomID, output.Type,
 	)
@@ -105,3 +117,26 @@ func (s *OutputClientDataConsumer) onMessage(ctx context.Context, msg *nats.Msg)
 
 	return true
 }
+
+// ignoredUserListType is the type of the account data which lists the users
+// whose events and invites a user doesn't want.
+const ignoredUserListType = "m.ignored_user_list"
+
+// updateIgnores stores the users which the user now ignores, going by their
+// account data in the user API.
+func (s *OutputClientDataConsumer) updateIgnores(ctx context.Context, userID string) error {
+	var res userapi.QueryAccountDataResponse
+	if err := s.userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: ignoredUserListType,
+	}, &res); err != nil {
+		return fmt.Errorf("s.userAPI.QueryAccountData: %w", err)
+	}
+	var ignores types.IgnoredUsers
+	if data, ok := res.GlobalAccountData[ignoredUserListType]; ok {
+		if err := json.Unmarshal(data, &ignores); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	return s.db.UpdateIgnoresForUser(ctx, userID, &ignores)
+}
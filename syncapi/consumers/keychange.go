@@ -89,7 +89,7 @@ func (s *OutputKeyChangeEventConsumer) onMessage(ctx context.Context, msg *nats.
 		logrus.WithError(err).Errorf("failed to read device message from key change topic")
 		return true
 	}
-	if m.DeviceKeys == nil && m.OutputCrossSigningKeyUpdate == nil {
+	if m.DeviceKeys == nil && m.OutputCrossSigningKeyUpdate == nil && m.OneTimeKeysCount == nil {
 		// This probably shouldn't happen but stops us from panicking if we come
 		// across an update that doesn't satisfy either types.
 		return true
@@ -97,6 +97,8 @@ func (s *OutputKeyChangeEventConsumer) onMessage(ctx context.Context, msg *nats.
 	switch m.Type {
 	case api.TypeCrossSigningUpdate:
 		return s.onCrossSigningMessage(m, m.DeviceChangeID)
+	case api.TypeOneTimeKeysCountUpdate:
+		return s.onOneTimeKeysCountMessage(m)
 	case api.TypeDeviceKeyUpdate:
 		fallthrough
 	default:
@@ -154,3 +156,13 @@ func (s *OutputKeyChangeEventConsumer) onCrossSigningMessage(m api.DeviceMessage
 
 	return true
 }
+
+// onOneTimeKeysCountMessage wakes up the syncs of the device whose one-time
+// keys were uploaded or claimed, so that it learns about the new counts.
+func (s *OutputKeyChangeEventConsumer) onOneTimeKeysCountMessage(m api.DeviceMessage) bool {
+	if m.OneTimeKeysCount == nil {
+		return true
+	}
+	s.notifier.OnNewOneTimeKeysCount(m.OneTimeKeysCount.UserID, m.OneTimeKeysCount.DeviceID)
+	return true
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputNotificationDataConsumer consumes the unread notification counts
+// that are produced by the user API server.
+type OutputNotificationDataConsumer struct {
+	ctx       context.Context
+	jetstream nats.JetStreamContext
+	durable   string
+	topic     string
+	db        storage.Database
+	stream    types.StreamProvider
+	notifier  *notifier.Notifier
+}
+
+// NewOutputNotificationDataConsumer creates a new OutputNotificationDataConsumer.
+// Call Start() to begin consuming from the user API server.
+func NewOutputNotificationDataConsumer(
+	process *process.ProcessContext,
+	cfg *config.SyncAPI,
+	js nats.JetStreamContext,
+	store storage.Database,
+	notifier *notifier.Notifier,
+	stream types.StreamProvider,
+) *OutputNotificationDataConsumer {
+	return &OutputNotificationDataConsumer{
+		ctx:       process.Context(),
+		jetstream: js,
+		topic:     cfg.Matrix.JetStream.TopicFor(jetstream.OutputNotificationData),
+		durable:   cfg.Matrix.JetStream.Durable("SyncAPINotificationDataConsumer"),
+		db:        store,
+		notifier:  notifier,
+		stream:    stream,
+	}
+}
+
+// Start consuming from the user API server
+func (s *OutputNotificationDataConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+func (s *OutputNotificationDataConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	userID := msg.Header.Get(jetstream.UserID)
+	var data eventutil.NotificationData
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("user API notification data log: message parse failure")
+		sentry.CaptureException(err)
+		return true
+	}
+
+	streamPos, err := s.db.UpsertRoomUnreadNotificationCounts(s.ctx, userID, &data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user_id": userID,
+			"room_id": data.RoomID,
+		}).WithError(err).Errorf("could not store unread notification counts")
+		sentry.CaptureException(err)
+		return true
+	}
+
+	s.stream.Advance(streamPos)
+	s.notifier.OnNewNotificationData(userID, types.StreamingToken{NotificationDataPosition: streamPos})
+
+	return true
+}
+
+// OutputDeletedDevicesConsumer consumes the devices which were deleted by
+// the user API server, and drops the to-device messages waiting for them.
+type OutputDeletedDevicesConsumer struct {
+	ctx       context.Context
+	jetstream nats.JetStreamContext
+	durable   string
+	topic     string
+	db        storage.Database
+}
+
+// NewOutputDeletedDevicesConsumer creates a new OutputDeletedDevicesConsumer.
+// Call Start() to begin consuming from the user API server.
+func NewOutputDeletedDevicesConsumer(
+	process *process.ProcessContext,
+	cfg *config.SyncAPI,
+	js nats.JetStreamContext,
+	store storage.Database,
+) *OutputDeletedDevicesConsumer {
+	return &OutputDeletedDevicesConsumer{
+		ctx:       process.Context(),
+		jetstream: js,
+		topic:     cfg.Matrix.JetStream.TopicFor(jetstream.OutputDeletedDevices),
+		durable:   cfg.Matrix.JetStream.Durable("SyncAPIDeletedDevicesConsumer"),
+		db:        store,
+	}
+}
+
+// Start consuming from the user API server
+func (s *OutputDeletedDevicesConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+func (s *OutputDeletedDevicesConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	userID := msg.Header.Get(jetstream.UserID)
+	var data eventutil.DeletedDevicesData
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("user API deleted devices log: message parse failure")
+		sentry.CaptureException(err)
+		return true
+	}
+
+	// Drop everything up to the latest send-to-device message, since none
+	// of it can be delivered to the devices any more.
+	maxPos, err := s.db.MaxStreamPositionForSendToDeviceMessages(s.ctx)
+	if err != nil {
+		log.WithError(err).Errorf("could not get the latest send-to-device position")
+		sentry.CaptureException(err)
+		return false
+	}
+	for _, deviceID := range data.DeviceIDs {
+		if err = s.db.CleanSendToDeviceUpdates(s.ctx, userID, deviceID, maxPos+1); err != nil {
+			log.WithFields(log.Fields{
+				"user_id":   userID,
+				"device_id": deviceID,
+			}).WithError(err).Errorf("could not delete send-to-device messages")
+			sentry.CaptureException(err)
+			return false
+		}
+	}
+
+	return true
+}
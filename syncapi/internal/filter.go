@@ -0,0 +1,133 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// IsRoomIncluded returns true if the room isn't excluded by the rooms and
+// not_rooms of a filter. Rooms which are in both are excluded.
+func IsRoomIncluded(roomID string, rooms, notRooms []string) bool {
+	if matchesAny(roomID, notRooms, false) {
+		return false
+	}
+	return rooms == nil || matchesAny(roomID, rooms, false)
+}
+
+// FilterClientEvents returns the events which match the event filter. Like
+// Synapse, only the limits of timeline filters are applied.
+func FilterClientEvents(events []gomatrixserverlib.ClientEvent, filter *gomatrixserverlib.EventFilter) []gomatrixserverlib.ClientEvent {
+	filtered := make([]gomatrixserverlib.ClientEvent, 0, len(events))
+	for _, ev := range events {
+		if !matchesEvent(ev.Type, ev.Sender, filter.Types, filter.NotTypes, filter.Senders, filter.NotSenders) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
+
+// FilterRoomClientEvents returns the events in the room which match the room
+// event filter. There are none if the room is excluded.
+func FilterRoomClientEvents(roomID string, events []gomatrixserverlib.ClientEvent, filter *gomatrixserverlib.RoomEventFilter) []gomatrixserverlib.ClientEvent {
+	if !IsRoomIncluded(roomID, filter.Rooms, filter.NotRooms) {
+		return []gomatrixserverlib.ClientEvent{}
+	}
+	filtered := make([]gomatrixserverlib.ClientEvent, 0, len(events))
+	for _, ev := range events {
+		if !matchesEvent(ev.Type, ev.Sender, filter.Types, filter.NotTypes, filter.Senders, filter.NotSenders) {
+			continue
+		}
+		if !matchesContainsURL(ev.Content, filter.ContainsURL) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
+
+// FilterRoomEvents returns the events which match the room event filter,
+// ignoring its limit, which callers fetch the events with.
+func FilterRoomEvents(events []*gomatrixserverlib.HeaderedEvent, filter *gomatrixserverlib.RoomEventFilter) []*gomatrixserverlib.HeaderedEvent {
+	filtered := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if !IsRoomIncluded(ev.RoomID(), filter.Rooms, filter.NotRooms) {
+			continue
+		}
+		if !matchesEvent(ev.Type(), ev.Sender(), filter.Types, filter.NotTypes, filter.Senders, filter.NotSenders) {
+			continue
+		}
+		if !matchesContainsURL(ev.Content(), filter.ContainsURL) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
+
+// matchesEvent returns true if an event with the type and sender isn't
+// excluded by the types, not_types, senders and not_senders of a filter.
+func matchesEvent(eventType, sender string, types, notTypes, senders, notSenders []string) bool {
+	if matchesAny(eventType, notTypes, true) || matchesAny(sender, notSenders, false) {
+		return false
+	}
+	if types != nil && !matchesAny(eventType, types, true) {
+		return false
+	}
+	return senders == nil || matchesAny(sender, senders, false)
+}
+
+// matchesContainsURL returns true if the content has a URL when the filter
+// wants events with one, or doesn't when it wants events without one.
+func matchesContainsURL(content []byte, containsURL *bool) bool {
+	if containsURL == nil {
+		return true
+	}
+	return gjson.GetBytes(content, "url").Exists() == *containsURL
+}
+
+// matchesAny returns true if the value is one of the patterns. Event types
+// can be matched with '*' wildcards, which match any sequence of characters.
+func matchesAny(value string, patterns []string, wildcards bool) bool {
+	for _, pattern := range patterns {
+		if pattern == value || (wildcards && matchesWildcard(value, pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesWildcard(value, pattern string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return value == pattern
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestIsRoomIncluded(t *testing.T) {
+	tsts := []struct {
+		Name     string
+		Rooms    []string
+		NotRooms []string
+		Want     bool
+	}{
+		{"noFilter", nil, nil, true},
+		{"included", []string{"!a:localhost"}, nil, true},
+		{"notIncluded", []string{"!b:localhost"}, nil, false},
+		{"excluded", nil, []string{"!a:localhost"}, false},
+		{"includedAndExcluded", []string{"!a:localhost"}, []string{"!a:localhost"}, false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if got := IsRoomIncluded("!a:localhost", tst.Rooms, tst.NotRooms); got != tst.Want {
+				t.Errorf("got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestFilterRoomClientEvents(t *testing.T) {
+	events := []gomatrixserverlib.ClientEvent{
+		{Type: "m.room.message", Sender: "@alice:localhost", Content: gomatrixserverlib.RawJSON(`{"body":"hi"}`)},
+		{Type: "m.room.message", Sender: "@bob:localhost", Content: gomatrixserverlib.RawJSON(`{"url":"mxc://localhost/a"}`)},
+		{Type: "m.reaction", Sender: "@alice:localhost", Content: gomatrixserverlib.RawJSON(`{}`)},
+		{Type: "org.example.event", Sender: "@bob:localhost", Content: gomatrixserverlib.RawJSON(`{}`)},
+	}
+	yes := true
+	tsts := []struct {
+		Name   string
+		Filter gomatrixserverlib.RoomEventFilter
+		Want   []int
+	}{
+		{"noFilter", gomatrixserverlib.RoomEventFilter{}, []int{0, 1, 2, 3}},
+		{"types", gomatrixserverlib.RoomEventFilter{Types: []string{"m.room.message"}}, []int{0, 1}},
+		{"wildcard", gomatrixserverlib.RoomEventFilter{Types: []string{"m.*"}}, []int{0, 1, 2}},
+		{"notTypes", gomatrixserverlib.RoomEventFilter{NotTypes: []string{"m.*"}}, []int{3}},
+		{"senders", gomatrixserverlib.RoomEventFilter{Senders: []string{"@bob:localhost"}}, []int{1, 3}},
+		{"notSenders", gomatrixserverlib.RoomEventFilter{NotSenders: []string{"@bob:localhost"}}, []int{0, 2}},
+		{"containsURL", gomatrixserverlib.RoomEventFilter{ContainsURL: &yes}, []int{1}},
+		{"otherRoom", gomatrixserverlib.RoomEventFilter{Rooms: []string{"!b:localhost"}}, nil},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			got := FilterRoomClientEvents("!a:localhost", events, &tst.Filter)
+			if len(got) != len(tst.Want) {
+				t.Fatalf("got %d events, want %d", len(got), len(tst.Want))
+			}
+			for i, want := range tst.Want {
+				if got[i].Type != events[want].Type || got[i].Sender != events[want].Sender {
+					t.Errorf("got event %+v, want %+v", got[i], events[want])
+				}
+			}
+		})
+	}
+}
+
+func TestMatchesWildcard(t *testing.T) {
+	tsts := []struct {
+		Value   string
+		Pattern string
+		Want    bool
+	}{
+		{"m.room.message", "m.room.message", true},
+		{"m.room.message", "*", true},
+		{"m.room.message", "m.*", true},
+		{"m.room.message", "*.message", true},
+		{"m.room.message", "m.*.message", true},
+		{"m.room.message", "m.*.member", false},
+		{"m.a", "m.a*a", false},
+	}
+	for _, tst := range tsts {
+		if got := matchesWildcard(tst.Value, tst.Pattern); got != tst.Want {
+			t.Errorf("got %v, want %v for %q matching %q", got, tst.Want, tst.Value, tst.Pattern)
+		}
+	}
+}
@@ -34,10 +34,16 @@ func (k *mockKeyAPI) PerformUploadDeviceKeys(ctx context.Context, req *keyapi.Pe
 }
 func (k *mockKeyAPI) PerformUploadDeviceSignatures(ctx context.Context, req *keyapi.PerformUploadDeviceSignaturesRequest, res *keyapi.PerformUploadDeviceSignaturesResponse) {
 }
+func (k *mockKeyAPI) PerformDeviceListResync(ctx context.Context, req *keyapi.PerformDeviceListResyncRequest, res *keyapi.PerformDeviceListResyncResponse) {
+}
 func (k *mockKeyAPI) QueryKeys(ctx context.Context, req *keyapi.QueryKeysRequest, res *keyapi.QueryKeysResponse) {
 }
 func (k *mockKeyAPI) QueryKeyChanges(ctx context.Context, req *keyapi.QueryKeyChangesRequest, res *keyapi.QueryKeyChangesResponse) {
 }
+func (k *mockKeyAPI) QueryBulkDeviceKeys(ctx context.Context, req *keyapi.QueryBulkDeviceKeysRequest, res *keyapi.QueryBulkDeviceKeysResponse) {
+}
+func (k *mockKeyAPI) QueryLatestKeyChange(ctx context.Context, req *keyapi.QueryLatestKeyChangeRequest, res *keyapi.QueryLatestKeyChangeResponse) {
+}
 func (k *mockKeyAPI) QueryOneTimeKeys(ctx context.Context, req *keyapi.QueryOneTimeKeysRequest, res *keyapi.QueryOneTimeKeysResponse) {
 
 }
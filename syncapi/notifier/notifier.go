@@ -134,6 +134,18 @@ func (n *Notifier) OnNewAccountData(
 	n.wakeupUsers([]string{userID}, nil, posUpdate)
 }
 
+// OnNewNotificationData wakes up the user whose unread notification counts
+// have changed.
+func (n *Notifier) OnNewNotificationData(
+	userID string, posUpdate types.StreamingToken,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.currPos.ApplyUpdates(posUpdate)
+	n.wakeupUsers([]string{userID}, nil, n.currPos)
+}
+
 func (n *Notifier) OnNewPeek(
 	roomID, userID, deviceID string,
 	posUpdate types.StreamingToken,
@@ -207,6 +219,15 @@ func (n *Notifier) OnNewKeyChange(
 	n.wakeupUsers([]string{wakeUserID}, nil, n.currPos)
 }
 
+// OnNewOneTimeKeysCount wakes up the device, whose one-time key counts have
+// changed. No stream position changes, as the counts are sent in every sync.
+func (n *Notifier) OnNewOneTimeKeysCount(userID, deviceID string) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.wakeupUserDevice(userID, []string{deviceID}, n.currPos)
+}
+
 func (n *Notifier) OnNewInvite(
 	posUpdate types.StreamingToken, wakeUserID string,
 ) {
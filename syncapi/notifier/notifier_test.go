@@ -269,6 +269,30 @@ func TestMultipleRequestWakeup(t *testing.T) {
 }
 
 // Test that you stop getting woken up when you leave a room.
+// Test that a device is woken up when its one-time key counts change, without
+// any change to the stream positions.
+func TestOneTimeKeysCountWakeup(t *testing.T) {
+	n := NewNotifier(syncPositionAfter)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionAfter))
+		if err != nil {
+			t.Errorf("TestOneTimeKeysCountWakeup error: %s", err)
+		}
+		mustEqualPositions(t, pos, syncPositionAfter)
+		wg.Done()
+	}()
+
+	stream := lockedFetchUserStream(n, bob, bobDev)
+	waitForBlocking(stream, 1)
+
+	n.OnNewOneTimeKeysCount(bob, bobDev)
+
+	wg.Wait()
+}
+
 func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	// listen as bob. Make bob leave room. Make alice send event to room.
 	// Make sure alice gets woken up only and not bob as well.
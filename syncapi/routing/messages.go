@@ -16,6 +16,8 @@ package routing
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
@@ -24,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -44,6 +47,8 @@ type messagesReq struct {
 	to               *types.TopologyToken
 	fromStream       *types.StreamingToken
 	device           *userapi.Device
+	ignoredUsers     *types.IgnoredUsers
+	filter           *gomatrixserverlib.RoomEventFilter
 	wasToProvided    bool
 	limit            int
 	backwardOrdering bool
@@ -155,7 +160,17 @@ func OnIncomingMessagesRequest(
 			}
 		}
 	}
-	// TODO: Implement filtering (#587)
+	// Events can be filtered by their types and senders, and whether they
+	// contain a URL.
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	if filterQuery := req.URL.Query().Get("filter"); filterQuery != "" {
+		if err = json.Unmarshal([]byte(filterQuery), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("filter could not be parsed: " + err.Error()),
+			}
+		}
+	}
 
 	// Check the room ID's format.
 	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
@@ -165,6 +180,13 @@ func OnIncomingMessagesRequest(
 		}
 	}
 
+	// Events from users who the user ignores aren't returned.
+	ignoredUsers, err := db.IgnoresForUser(req.Context(), device.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		util.GetLogger(req.Context()).WithError(err).Error("db.IgnoresForUser failed")
+		return jsonerror.InternalServerError()
+	}
+
 	mReq := messagesReq{
 		ctx:              req.Context(),
 		db:               db,
@@ -179,6 +201,8 @@ func OnIncomingMessagesRequest(
 		limit:            limit,
 		backwardOrdering: backwardOrdering,
 		device:           device,
+		ignoredUsers:     ignoredUsers,
+		filter:           &filter,
 	}
 
 	clientEvents, start, end, err := mReq.retrieveEvents()
@@ -234,7 +258,7 @@ func (r *messagesReq) retrieveEvents() (
 	clientEvents []gomatrixserverlib.ClientEvent, start,
 	end types.TopologyToken, err error,
 ) {
-	eventFilter := gomatrixserverlib.DefaultRoomEventFilter()
+	eventFilter := *r.filter
 	eventFilter.Limit = r.limit
 
 	// Retrieve the events from the local database.
@@ -295,23 +319,37 @@ func (r *messagesReq) retrieveEvents() (
 		}
 		events = reversed(events)
 	}
-	events = r.filterHistoryVisible(events)
+	events = filterHistoryVisible(r.ctx, r.rsAPI, r.device.UserID, events, r.backwardOrdering)
+	events = r.ignoredUsers.FilterEvents(events)
 	if len(events) == 0 {
 		return []gomatrixserverlib.ClientEvent{}, *r.from, *r.to, nil
 	}
+	// Events in the topological range aren't filtered when they are fetched,
+	// so the chunk can have fewer events than the limit, or none. Clients
+	// can still paginate past them with the end token.
+	events = internal.FilterRoomEvents(events, r.filter)
 
 	// Convert all of the events into client events.
 	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
 	return clientEvents, start, end, err
 }
 
-func (r *messagesReq) filterHistoryVisible(events []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
+// filterHistoryVisible removes the events which the user isn't allowed to see. The events
+// must be from a single room, ordered newest first if backwardOrdering is set or oldest
+// first otherwise.
+func filterHistoryVisible(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, userID string,
+	events []*gomatrixserverlib.HeaderedEvent, backwardOrdering bool,
+) []*gomatrixserverlib.HeaderedEvent {
+	if len(events) == 0 {
+		return events
+	}
 	// TODO FIXME: We don't fully implement history visibility yet. To avoid leaking events which the
 	// user shouldn't see, we check the recent events and remove any prior to the join event of the user
 	// which is equiv to history_visibility: joined
 	joinEventIndex := -1
 	for i, ev := range events {
-		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(r.device.UserID) {
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(userID) {
 			membership, _ := ev.Membership()
 			if membership == "join" {
 				joinEventIndex = i
@@ -323,7 +361,7 @@ func (r *messagesReq) filterHistoryVisible(events []*gomatrixserverlib.HeaderedE
 	var result []*gomatrixserverlib.HeaderedEvent
 	var eventsToCheck []*gomatrixserverlib.HeaderedEvent
 	if joinEventIndex != -1 {
-		if r.backwardOrdering {
+		if backwardOrdering {
 			result = events[:joinEventIndex+1]
 			eventsToCheck = append(eventsToCheck, result[0])
 		} else {
@@ -339,11 +377,11 @@ func (r *messagesReq) filterHistoryVisible(events []*gomatrixserverlib.HeaderedE
 	wasJoined := true
 	for _, ev := range eventsToCheck {
 		var queryRes api.QueryStateAfterEventsResponse
-		err := r.rsAPI.QueryStateAfterEvents(r.ctx, &api.QueryStateAfterEventsRequest{
+		err := rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
 			RoomID:       ev.RoomID(),
 			PrevEventIDs: ev.PrevEventIDs(),
 			StateToFetch: []gomatrixserverlib.StateKeyTuple{
-				{EventType: gomatrixserverlib.MRoomMember, StateKey: r.device.UserID},
+				{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
 				{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
 			},
 		}, &queryRes)
@@ -382,7 +420,7 @@ func (r *messagesReq) filterHistoryVisible(events []*gomatrixserverlib.HeaderedE
 		}
 	}
 	if !wasJoined {
-		util.GetLogger(r.ctx).WithField("num_events", len(events)).Warnf("%s was not joined to room during these events, omitting them", r.device.UserID)
+		util.GetLogger(ctx).WithField("num_events", len(events)).Warnf("%s was not joined to room during these events, omitting them", userID)
 		return []*gomatrixserverlib.HeaderedEvent{}
 	}
 	return result
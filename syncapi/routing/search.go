@@ -0,0 +1,458 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// defaultSearchLimit is how many results are returned at once if the
+	// filter doesn't say otherwise.
+	defaultSearchLimit = 10
+	// maxSearchLimit is the most results that are returned at once, since
+	// each result can come with context and profiles to look up.
+	maxSearchLimit = 50
+	// defaultSearchContextLimit is how many events before and after each
+	// result are returned, if context is requested without a limit.
+	defaultSearchContextLimit = 5
+	// maxSearchContextLimit is the most events before or after each result
+	// which are returned.
+	maxSearchContextLimit = 20
+)
+
+// searchKeys are the content keys which can be searched. They are also the
+// default if the request doesn't ask for specific keys.
+var searchKeys = []string{"content.body", "content.name", "content.topic"}
+
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *searchRoomEventsCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type searchRoomEventsCriteria struct {
+	SearchTerm   string                             `json:"search_term"`
+	Keys         []string                           `json:"keys"`
+	Filter       *gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy      string                             `json:"order_by"`
+	EventContext *searchEventContext                `json:"event_context"`
+	IncludeState bool                               `json:"include_state"`
+	Groupings    struct {
+		GroupBy []struct {
+			Key string `json:"key"`
+		} `json:"group_by"`
+	} `json:"groupings"`
+}
+
+type searchEventContext struct {
+	BeforeLimit    *int `json:"before_limit"`
+	AfterLimit     *int `json:"after_limit"`
+	IncludeProfile bool `json:"include_profile"`
+}
+
+type searchResponse struct {
+	SearchCategories struct {
+		RoomEvents *searchRoomEventsResponse `json:"room_events,omitempty"`
+	} `json:"search_categories"`
+}
+
+type searchRoomEventsResponse struct {
+	Count      int                                        `json:"count"`
+	Highlights []string                                   `json:"highlights"`
+	Results    []searchResult                             `json:"results"`
+	State      map[string][]gomatrixserverlib.ClientEvent `json:"state,omitempty"`
+	Groups     map[string]map[string]*searchGroup         `json:"groups,omitempty"`
+	NextBatch  *string                                    `json:"next_batch,omitempty"`
+}
+
+type searchResult struct {
+	Rank    float64                       `json:"rank"`
+	Result  gomatrixserverlib.ClientEvent `json:"result"`
+	Context *searchResultContext          `json:"context,omitempty"`
+}
+
+type searchResultContext struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	ProfileInfo  map[string]*searchProfile       `json:"profile_info,omitempty"`
+}
+
+type searchProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type searchGroup struct {
+	Results   []string `json:"results"`
+	Order     int      `json:"order"`
+	NextBatch *string  `json:"next_batch,omitempty"`
+}
+
+// Search implements POST /search
+func Search(
+	req *http.Request, device *userapi.Device, syncDB storage.Database, rsAPI api.RoomserverInternalAPI, nextBatch string,
+) util.JSONResponse {
+	defer req.Body.Close() // nolint:errcheck
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read. " + err.Error()),
+		}
+	}
+	var r searchRequest
+	if err = json.Unmarshal(body, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	var res searchResponse
+	if criteria := r.SearchCategories.RoomEvents; criteria != nil {
+		roomEvents, errRes := searchRoomEvents(req.Context(), device, syncDB, rsAPI, criteria, nextBatch)
+		if errRes != nil {
+			return *errRes
+		}
+		res.SearchCategories.RoomEvents = roomEvents
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// nolint:gocyclo
+func searchRoomEvents(
+	ctx context.Context, device *userapi.Device, syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	criteria *searchRoomEventsCriteria, nextBatch string,
+) (*searchRoomEventsResponse, *util.JSONResponse) {
+	badRequest := func(msg string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(msg),
+		}
+	}
+	internalError := jsonerror.InternalServerError()
+	logger := util.GetLogger(ctx)
+
+	if strings.TrimSpace(criteria.SearchTerm) == "" {
+		return nil, badRequest("search_term must not be empty")
+	}
+	keys := criteria.Keys
+	if len(keys) == 0 {
+		keys = searchKeys
+	}
+	for _, key := range keys {
+		if !searchKeyAllowed(key) {
+			return nil, badRequest(fmt.Sprintf("Unsupported key %q, must be one of %s", key, strings.Join(searchKeys, ", ")))
+		}
+	}
+	orderByRank := true
+	switch criteria.OrderBy {
+	case "", "rank":
+	case "recent":
+		orderByRank = false
+	default:
+		return nil, badRequest("order_by must be one of rank, recent")
+	}
+	groupBy := make([]string, 0, len(criteria.Groupings.GroupBy))
+	for _, group := range criteria.Groupings.GroupBy {
+		if group.Key != "room_id" && group.Key != "sender" {
+			return nil, badRequest("group_by key must be one of room_id, sender")
+		}
+		groupBy = append(groupBy, group.Key)
+	}
+	filter := gomatrixserverlib.RoomEventFilter{Limit: defaultSearchLimit}
+	if criteria.Filter != nil {
+		filter = *criteria.Filter
+		if filter.Limit <= 0 {
+			filter.Limit = defaultSearchLimit
+		}
+	}
+	if filter.Limit > maxSearchLimit {
+		filter.Limit = maxSearchLimit
+	}
+	from := 0
+	if nextBatch != "" {
+		var err error
+		if from, err = strconv.Atoi(nextBatch); err != nil || from < 0 {
+			return nil, badRequest("Invalid next_batch")
+		}
+	}
+
+	// Only search rooms that the user is currently joined to, narrowed down
+	// by the filter.
+	joinedRooms, err := syncDB.RoomIDsWithMembership(ctx, device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		logger.WithError(err).Error("syncDB.RoomIDsWithMembership failed")
+		return nil, &internalError
+	}
+	roomIDs := filterRoomIDs(joinedRooms, filter.Rooms, filter.NotRooms)
+
+	res := &searchRoomEventsResponse{
+		Highlights: searchHighlights(criteria.SearchTerm),
+		Results:    []searchResult{},
+	}
+	if len(roomIDs) == 0 {
+		return res, nil
+	}
+	matches, total, err := syncDB.SearchEvents(ctx, criteria.SearchTerm, roomIDs, keys, &filter, orderByRank, from, filter.Limit)
+	if err != nil {
+		logger.WithError(err).Error("syncDB.SearchEvents failed")
+		return nil, &internalError
+	}
+	res.Count = total
+	if next := from + len(matches); next < total {
+		token := strconv.Itoa(next)
+		res.NextBatch = &token
+	}
+
+	eventIDs := make([]string, 0, len(matches))
+	for _, match := range matches {
+		eventIDs = append(eventIDs, match.EventID)
+	}
+	events, err := syncDB.Events(ctx, eventIDs)
+	if err != nil {
+		logger.WithError(err).Error("syncDB.Events failed")
+		return nil, &internalError
+	}
+	eventsByID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(events))
+	for _, event := range events {
+		eventsByID[event.EventID()] = event
+	}
+
+	resultRooms := map[string]struct{}{}
+	for _, match := range matches {
+		event, ok := eventsByID[match.EventID]
+		if !ok {
+			continue
+		}
+		// Results are only returned if the user could see them in the room's
+		// history, e.g. not if they were sent before the user joined.
+		if len(filterHistoryVisible(ctx, rsAPI, device.UserID, []*gomatrixserverlib.HeaderedEvent{event}, false)) == 0 {
+			continue
+		}
+		result := searchResult{
+			Rank:   match.Rank,
+			Result: gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll),
+		}
+		if criteria.EventContext != nil {
+			if result.Context, err = searchContext(ctx, device, syncDB, rsAPI, event, match.StreamPosition, &filter, criteria.EventContext); err != nil {
+				logger.WithError(err).Error("failed to get search result context")
+				return nil, &internalError
+			}
+		}
+		res.Results = append(res.Results, result)
+		resultRooms[event.RoomID()] = struct{}{}
+
+		for _, key := range groupBy {
+			value := event.RoomID()
+			if key == "sender" {
+				value = event.Sender()
+			}
+			if res.Groups == nil {
+				res.Groups = map[string]map[string]*searchGroup{}
+			}
+			if res.Groups[key] == nil {
+				res.Groups[key] = map[string]*searchGroup{}
+			}
+			group, ok := res.Groups[key][value]
+			if !ok {
+				group = &searchGroup{Order: len(res.Groups[key]) + 1, NextBatch: res.NextBatch}
+				res.Groups[key][value] = group
+			}
+			group.Results = append(group.Results, event.EventID())
+		}
+	}
+
+	if criteria.IncludeState {
+		res.State = make(map[string][]gomatrixserverlib.ClientEvent, len(resultRooms))
+		stateFilter := gomatrixserverlib.DefaultStateFilter()
+		for roomID := range resultRooms {
+			state, err := syncDB.CurrentState(ctx, roomID, &stateFilter, nil)
+			if err != nil {
+				logger.WithError(err).Error("syncDB.CurrentState failed")
+				return nil, &internalError
+			}
+			res.State[roomID] = gomatrixserverlib.HeaderedToClientEvents(state, gomatrixserverlib.FormatAll)
+		}
+	}
+	return res, nil
+}
+
+// searchContext returns the events either side of a search result, along with
+// pagination tokens which can be given to /messages to get more. Events which
+// the user can't see in the room's history are left out.
+func searchContext(
+	ctx context.Context, device *userapi.Device, syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
+	filter *gomatrixserverlib.RoomEventFilter, eventContext *searchEventContext,
+) (*searchResultContext, error) {
+	contextLimit := func(limit *int) int {
+		switch {
+		case limit == nil:
+			return defaultSearchContextLimit
+		case *limit < 0:
+			return 0
+		case *limit > maxSearchContextLimit:
+			return maxSearchContextLimit
+		}
+		return *limit
+	}
+	res := &searchResultContext{
+		EventsBefore: []gomatrixserverlib.ClientEvent{},
+		EventsAfter:  []gomatrixserverlib.ClientEvent{},
+	}
+	start, end := pos-1, pos
+
+	contextFilter := *filter
+	if contextFilter.Limit = contextLimit(eventContext.BeforeLimit); contextFilter.Limit > 0 {
+		before, err := syncDB.GetEventsInStreamingRange(
+			ctx, &types.StreamingToken{PDUPosition: pos - 1}, &types.StreamingToken{}, event.RoomID(), &contextFilter, true,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("syncDB.GetEventsInStreamingRange: %w", err)
+		}
+		if len(before) > 0 {
+			start = before[len(before)-1].StreamPosition - 1
+		}
+		// The result itself is visible, so it is checked as the newest event
+		// rather than the first event before it, which may be the user's join.
+		visible := filterHistoryVisible(
+			ctx, rsAPI, device.UserID,
+			append([]*gomatrixserverlib.HeaderedEvent{event}, syncDB.StreamEventsToEvents(device, before)...), true,
+		)
+		if len(visible) > 0 {
+			visible = visible[1:]
+		}
+		res.EventsBefore = gomatrixserverlib.HeaderedToClientEvents(visible, gomatrixserverlib.FormatAll)
+	}
+	if contextFilter.Limit = contextLimit(eventContext.AfterLimit); contextFilter.Limit > 0 {
+		latest, err := syncDB.MaxStreamPositionForPDUs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("syncDB.MaxStreamPositionForPDUs: %w", err)
+		}
+		after, err := syncDB.GetEventsInStreamingRange(
+			ctx, &types.StreamingToken{PDUPosition: pos}, &types.StreamingToken{PDUPosition: latest}, event.RoomID(), &contextFilter, false,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("syncDB.GetEventsInStreamingRange: %w", err)
+		}
+		if len(after) > 0 {
+			end = after[len(after)-1].StreamPosition
+		}
+		visible := filterHistoryVisible(ctx, rsAPI, device.UserID, syncDB.StreamEventsToEvents(device, after), false)
+		res.EventsAfter = gomatrixserverlib.HeaderedToClientEvents(visible, gomatrixserverlib.FormatAll)
+	}
+	res.Start = types.StreamingToken{PDUPosition: start}.String()
+	res.End = types.StreamingToken{PDUPosition: end}.String()
+
+	if eventContext.IncludeProfile {
+		res.ProfileInfo = map[string]*searchProfile{}
+		senders := []string{event.Sender()}
+		for _, ev := range append(res.EventsBefore, res.EventsAfter...) {
+			senders = append(senders, ev.Sender)
+		}
+		for _, sender := range senders {
+			if _, ok := res.ProfileInfo[sender]; ok {
+				continue
+			}
+			memberEvent, err := syncDB.GetStateEvent(ctx, event.RoomID(), gomatrixserverlib.MRoomMember, sender)
+			if err != nil {
+				return nil, fmt.Errorf("syncDB.GetStateEvent: %w", err)
+			}
+			profile := &searchProfile{}
+			if memberEvent != nil {
+				var content gomatrixserverlib.MemberContent
+				if err = json.Unmarshal(memberEvent.Content(), &content); err == nil {
+					profile.DisplayName = content.DisplayName
+					profile.AvatarURL = content.AvatarURL
+				}
+			}
+			res.ProfileInfo[sender] = profile
+		}
+	}
+	return res, nil
+}
+
+func searchKeyAllowed(key string) bool {
+	for _, allowed := range searchKeys {
+		if key == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRoomIDs returns the room IDs which are in the given list of rooms, if
+// there is one, and not in the list of rooms to exclude.
+func filterRoomIDs(roomIDs, rooms, notRooms []string) []string {
+	include := make(map[string]struct{}, len(rooms))
+	for _, roomID := range rooms {
+		include[roomID] = struct{}{}
+	}
+	exclude := make(map[string]struct{}, len(notRooms))
+	for _, roomID := range notRooms {
+		exclude[roomID] = struct{}{}
+	}
+	filtered := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if _, ok := include[roomID]; len(rooms) > 0 && !ok {
+			continue
+		}
+		if _, ok := exclude[roomID]; ok {
+			continue
+		}
+		filtered = append(filtered, roomID)
+	}
+	return filtered
+}
+
+// searchHighlights returns the words which clients should highlight in the
+// results, which are the lowercased words of the search term.
+func searchHighlights(searchTerm string) []string {
+	words := strings.FieldsFunc(strings.ToLower(searchTerm), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	highlights := make([]string, 0, len(words))
+	seen := make(map[string]struct{}, len(words))
+	for _, word := range words {
+		if _, ok := seen[word]; ok {
+			continue
+		}
+		seen[word] = struct{}{}
+		highlights = append(highlights, word)
+	}
+	return highlights
+}
@@ -0,0 +1,198 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const searchTestRoomID = "!room:test"
+
+// searchTestRoom returns the events of a room in which alice says something
+// before bob joins, and again after.
+func searchTestRoom(t *testing.T, historyVisibility string) []*gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	var events []*gomatrixserverlib.HeaderedEvent
+	add := func(eventID, evType, stateKey, sender, content string) {
+		prevEvents := "[]"
+		if len(events) > 0 {
+			prevEvents = fmt.Sprintf(`[[%q,{}]]`, events[len(events)-1].EventID())
+		}
+		stateKeyJSON := ""
+		if evType != "m.room.message" {
+			stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, stateKey)
+		}
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+			`{"event_id":%q,"room_id":%q,"type":%q,%s"sender":%q,"content":%s,"prev_events":%s,"depth":%d}`,
+			eventID, searchTestRoomID, evType, stateKeyJSON, sender, content, prevEvents, len(events)+1,
+		)), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		events = append(events, ev.Headered(gomatrixserverlib.RoomVersionV1))
+	}
+	add("$create:test", "m.room.create", "", "@alice:test", `{"creator":"@alice:test"}`)
+	add("$alice:test", "m.room.member", "@alice:test", "@alice:test", `{"membership":"join"}`)
+	add("$visibility:test", "m.room.history_visibility", "", "@alice:test", fmt.Sprintf(`{"history_visibility":%q}`, historyVisibility))
+	add("$early:test", "m.room.message", "", "@alice:test", `{"body":"secret plans"}`)
+	add("$bob:test", "m.room.member", "@bob:test", "@bob:test", `{"membership":"join"}`)
+	add("$late:test", "m.room.message", "", "@alice:test", `{"body":"more secret plans"}`)
+	return events
+}
+
+type searchTestDatabase struct {
+	storage.Database
+	events []*gomatrixserverlib.HeaderedEvent
+}
+
+func (d *searchTestDatabase) RoomIDsWithMembership(ctx context.Context, userID string, membership string) ([]string, error) {
+	return []string{searchTestRoomID}, nil
+}
+
+// SearchEvents matches the two messages, most recent first.
+func (d *searchTestDatabase) SearchEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string, filter *gomatrixserverlib.RoomEventFilter,
+	orderByRank bool, from, limit int,
+) ([]types.SearchResult, int, error) {
+	return []types.SearchResult{
+		{EventID: "$late:test", StreamPosition: 6, Rank: 1},
+		{EventID: "$early:test", StreamPosition: 4, Rank: 1},
+	}, 2, nil
+}
+
+func (d *searchTestDatabase) Events(ctx context.Context, eventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	var events []*gomatrixserverlib.HeaderedEvent
+	for _, ev := range d.events {
+		for _, eventID := range eventIDs {
+			if ev.EventID() == eventID {
+				events = append(events, ev)
+			}
+		}
+	}
+	return events, nil
+}
+
+// GetEventsInStreamingRange only supports the backwards requests made for the
+// context before a result. The stream position of each event is its index + 1.
+func (d *searchTestDatabase) GetEventsInStreamingRange(
+	ctx context.Context, from, to *types.StreamingToken, roomID string,
+	eventFilter *gomatrixserverlib.RoomEventFilter, backwardOrdering bool,
+) ([]types.StreamEvent, error) {
+	var events []types.StreamEvent
+	for i := int(from.PDUPosition) - 1; i >= 0 && len(events) < eventFilter.Limit; i-- {
+		events = append(events, types.StreamEvent{HeaderedEvent: d.events[i], StreamPosition: types.StreamPosition(i + 1)})
+	}
+	return events, nil
+}
+
+func (d *searchTestDatabase) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []*gomatrixserverlib.HeaderedEvent {
+	out := make([]*gomatrixserverlib.HeaderedEvent, len(in))
+	for i := range in {
+		out[i] = in[i].HeaderedEvent
+	}
+	return out
+}
+
+type searchTestRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	events []*gomatrixserverlib.HeaderedEvent
+}
+
+// QueryStateAfterEvents returns the requested state after the first of the
+// previous events.
+func (r *searchTestRoomserverAPI) QueryStateAfterEvents(
+	ctx context.Context, req *api.QueryStateAfterEventsRequest, res *api.QueryStateAfterEventsResponse,
+) error {
+	if len(req.PrevEventIDs) == 0 {
+		return fmt.Errorf("no previous events")
+	}
+	state := map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range r.events {
+		if ev.StateKey() != nil {
+			state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+		}
+		if ev.EventID() == req.PrevEventIDs[0] {
+			break
+		}
+	}
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	for _, tuple := range req.StateToFetch {
+		if ev, ok := state[tuple]; ok {
+			res.StateEvents = append(res.StateEvents, ev)
+		}
+	}
+	return nil
+}
+
+func TestSearchHistoryVisibility(t *testing.T) {
+	tests := []struct {
+		name              string
+		userID            string
+		historyVisibility string
+		wantResults       []string
+		wantBefore        []string
+	}{
+		{
+			name:              "events before joining are hidden",
+			userID:            "@bob:test",
+			historyVisibility: "joined",
+			wantResults:       []string{"$late:test"},
+			wantBefore:        []string{"$bob:test"},
+		},
+		{
+			name:              "events before joining are shared",
+			userID:            "@bob:test",
+			historyVisibility: "shared",
+			wantResults:       []string{"$late:test", "$early:test"},
+			wantBefore:        []string{"$bob:test", "$early:test", "$visibility:test", "$alice:test", "$create:test"},
+		},
+		{
+			name:              "events after joining are visible",
+			userID:            "@alice:test",
+			historyVisibility: "joined",
+			wantResults:       []string{"$late:test", "$early:test"},
+			wantBefore:        []string{"$bob:test", "$early:test", "$visibility:test", "$alice:test"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := searchTestRoom(t, tt.historyVisibility)
+			req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(
+				`{"search_categories":{"room_events":{"search_term":"secret","order_by":"recent","event_context":{"before_limit":10,"after_limit":0}}}}`,
+			))
+			res := Search(
+				req, &userapi.Device{UserID: tt.userID},
+				&searchTestDatabase{events: events}, &searchTestRoomserverAPI{events: events}, "",
+			)
+			if res.Code != http.StatusOK {
+				t.Fatalf("got code %v, want %v: %+v", res.Code, http.StatusOK, res.JSON)
+			}
+			results := res.JSON.(searchResponse).SearchCategories.RoomEvents.Results
+			var gotResults []string
+			for _, result := range results {
+				gotResults = append(gotResults, result.Result.EventID)
+			}
+			if !reflect.DeepEqual(gotResults, tt.wantResults) {
+				t.Fatalf("got results %v, want %v", gotResults, tt.wantResults)
+			}
+			var gotBefore []string
+			for _, ev := range results[0].Context.EventsBefore {
+				gotBefore = append(gotBefore, ev.EventID)
+			}
+			if !reflect.DeepEqual(gotBefore, tt.wantBefore) {
+				t.Errorf("got events before %v, want %v", gotBefore, tt.wantBefore)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+const purgeEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
+
+const purgeTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
+
+const purgeCurrentRoomStateSQL = "" +
+	"DELETE FROM syncapi_current_room_state WHERE room_id = $1"
+
+const purgeInvitesSQL = "" +
+	"DELETE FROM syncapi_invite_events WHERE room_id = $1"
+
+const purgeMembershipsSQL = "" +
+	"DELETE FROM syncapi_memberships WHERE room_id = $1"
+
+const purgePeeksSQL = "" +
+	"DELETE FROM syncapi_peeks WHERE room_id = $1"
+
+const purgeReceiptsSQL = "" +
+	"DELETE FROM syncapi_receipts WHERE room_id = $1"
+
+const purgeBackwardExtremitiesSQL = "" +
+	"DELETE FROM syncapi_backward_extremities WHERE room_id = $1"
+
+const purgeNotificationDataSQL = "" +
+	"DELETE FROM syncapi_notification_data WHERE room_id = $1"
+
+const purgeSearchEventsSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE room_id = $1"
+
+type purgeStatements struct {
+	purgeEventsStmt              *sql.Stmt
+	purgeTopologyStmt            *sql.Stmt
+	purgeCurrentRoomStateStmt    *sql.Stmt
+	purgeInvitesStmt             *sql.Stmt
+	purgeMembershipsStmt         *sql.Stmt
+	purgePeeksStmt               *sql.Stmt
+	purgeReceiptsStmt            *sql.Stmt
+	purgeBackwardExtremitiesStmt *sql.Stmt
+	purgeNotificationDataStmt    *sql.Stmt
+	purgeSearchEventsStmt        *sql.Stmt
+}
+
+func NewPostgresPurgeStatements(db *sql.DB) (tables.Purge, error) {
+	s := &purgeStatements{}
+	return s, sqlutil.StatementList{
+		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.purgeTopologyStmt, purgeTopologySQL},
+		{&s.purgeCurrentRoomStateStmt, purgeCurrentRoomStateSQL},
+		{&s.purgeInvitesStmt, purgeInvitesSQL},
+		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.purgePeeksStmt, purgePeeksSQL},
+		{&s.purgeReceiptsStmt, purgeReceiptsSQL},
+		{&s.purgeBackwardExtremitiesStmt, purgeBackwardExtremitiesSQL},
+		{&s.purgeNotificationDataStmt, purgeNotificationDataSQL},
+		{&s.purgeSearchEventsStmt, purgeSearchEventsSQL},
+	}.Prepare(db)
+}
+
+func (s *purgeStatements) PurgeRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	for _, stmt := range []*sql.Stmt{
+		s.purgeEventsStmt,
+		s.purgeTopologyStmt,
+		s.purgeCurrentRoomStateStmt,
+		s.purgeInvitesStmt,
+		s.purgeMembershipsStmt,
+		s.purgePeeksStmt,
+		s.purgeReceiptsStmt,
+		s.purgeBackwardExtremitiesStmt,
+		s.purgeNotificationDataStmt,
+		s.purgeSearchEventsStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
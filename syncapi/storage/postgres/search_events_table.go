@@ -0,0 +1,160 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const searchEventsSchema = `
+-- Stores the searchable text of room events, for the /search API.
+CREATE TABLE IF NOT EXISTS syncapi_search_events (
+	-- The event ID of the indexed event
+	event_id TEXT NOT NULL PRIMARY KEY,
+	-- The stream position of the event
+	stream_pos BIGINT NOT NULL,
+	-- The room ID of the event
+	room_id TEXT NOT NULL,
+	-- The sender of the event
+	sender TEXT NOT NULL,
+	-- The type of the event
+	type TEXT NOT NULL,
+	-- The content key which was indexed, e.g. 'content.body'
+	key TEXT NOT NULL,
+	-- The text which was indexed
+	value TEXT NOT NULL,
+	-- The full-text search vector of the text
+	vector TSVECTOR NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_vector_idx ON syncapi_search_events USING GIN (vector);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_room_id_idx ON syncapi_search_events (room_id, stream_pos);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search_events (event_id, stream_pos, room_id, sender, type, key, value, vector)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, to_tsvector('english', $7))" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE event_id = $1"
+
+const searchEventsFilterSQL = "" +
+	" FROM syncapi_search_events" +
+	" WHERE vector @@ plainto_tsquery('english', $1)" +
+	" AND room_id = ANY($2) AND key = ANY($3)" +
+	" AND ( $4::text[] IS NULL OR     sender  = ANY($4)  )" +
+	" AND ( $5::text[] IS NULL OR NOT(sender  = ANY($5)) )" +
+	" AND ( $6::text[] IS NULL OR     type LIKE ANY($6)  )" +
+	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )"
+
+const countSearchEventsSQL = "" +
+	"SELECT COUNT(*)" + searchEventsFilterSQL
+
+const selectSearchEventsByRankSQL = "" +
+	"SELECT event_id, stream_pos, ts_rank(vector, plainto_tsquery('english', $1)) AS rank" +
+	searchEventsFilterSQL +
+	" ORDER BY rank DESC, stream_pos DESC LIMIT $8 OFFSET $9"
+
+const selectSearchEventsByRecentSQL = "" +
+	"SELECT event_id, stream_pos, ts_rank(vector, plainto_tsquery('english', $1)) AS rank" +
+	searchEventsFilterSQL +
+	" ORDER BY stream_pos DESC LIMIT $8 OFFSET $9"
+
+type searchEventsStatements struct {
+	insertSearchEventStmt          *sql.Stmt
+	deleteSearchEventStmt          *sql.Stmt
+	countSearchEventsStmt          *sql.Stmt
+	selectSearchEventsByRankStmt   *sql.Stmt
+	selectSearchEventsByRecentStmt *sql.Stmt
+}
+
+func NewPostgresSearchEventsTable(db *sql.DB) (tables.SearchEvents, error) {
+	s := &searchEventsStatements{}
+	_, err := db.Exec(searchEventsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertSearchEventStmt, insertSearchEventSQL},
+		{&s.deleteSearchEventStmt, deleteSearchEventSQL},
+		{&s.countSearchEventsStmt, countSearchEventsSQL},
+		{&s.selectSearchEventsByRankStmt, selectSearchEventsByRankSQL},
+		{&s.selectSearchEventsByRecentStmt, selectSearchEventsByRecentSQL},
+	}.Prepare(db)
+}
+
+func (s *searchEventsStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent,
+	pos types.StreamPosition, key, value string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertSearchEventStmt).ExecContext(
+		ctx, event.EventID(), pos, event.RoomID(), event.Sender(), event.Type(), key, value,
+	)
+	return err
+}
+
+func (s *searchEventsStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchEventsStatements) SearchEvents(
+	ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string,
+	filter *gomatrixserverlib.RoomEventFilter, orderByRank bool, from, limit int,
+) ([]types.SearchResult, int, error) {
+	params := []interface{}{
+		searchTerm,
+		pq.StringArray(roomIDs),
+		pq.StringArray(keys),
+		pq.StringArray(filter.Senders),
+		pq.StringArray(filter.NotSenders),
+		pq.StringArray(filterConvertTypeWildcardToSQL(filter.Types)),
+		pq.StringArray(filterConvertTypeWildcardToSQL(filter.NotTypes)),
+	}
+	var total int
+	if err := sqlutil.TxStmt(txn, s.countSearchEventsStmt).QueryRowContext(ctx, params...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	stmt := s.selectSearchEventsByRecentStmt
+	if orderByRank {
+		stmt = s.selectSearchEventsByRankStmt
+	}
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(ctx, append(params, limit, from)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SearchEvents: rows.close() failed")
+
+	results := []types.SearchResult{}
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.StreamPosition, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, total, rows.Err()
+}
@@ -90,6 +90,22 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 	if err != nil {
 		return nil, err
 	}
+	searchEvents, err := NewPostgresSearchEventsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	ignores, err := NewPostgresIgnoresTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	purge, err := NewPostgresPurgeStatements(d.db)
+	if err != nil {
+		return nil, err
+	}
+	notificationData, err := NewPostgresNotificationDataTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
 	deltas.LoadRemoveSendToDeviceSentColumn(m)
@@ -110,6 +126,10 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
 		Memberships:         memberships,
+		Search:              searchEvents,
+		NotificationData:    notificationData,
+		Ignores:             ignores,
+		Purge:               purge,
 	}
 	return &d, nil
 }
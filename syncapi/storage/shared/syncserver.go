@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -30,6 +31,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // Database is a temporary struct until we have made syncserver.go the same for both pq/sqlite
@@ -48,6 +50,10 @@ type Database struct {
 	Filter              tables.Filter
 	Receipts            tables.Receipts
 	Memberships         tables.Memberships
+	Search              tables.SearchEvents
+	NotificationData    tables.NotificationData
+	Ignores             tables.Ignores
+	Purge               tables.Purge
 }
 
 func (d *Database) readOnlySnapshot(ctx context.Context) (*sql.Tx, error) {
@@ -78,6 +84,14 @@ func (d *Database) MaxStreamPositionForReceipts(ctx context.Context) (types.Stre
 	return types.StreamPosition(id), nil
 }
 
+func (d *Database) MaxStreamPositionForNotificationData(ctx context.Context) (types.StreamPosition, error) {
+	id, err := d.NotificationData.SelectMaxID(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("d.NotificationData.SelectMaxID: %w", err)
+	}
+	return types.StreamPosition(id), nil
+}
+
 func (d *Database) MaxStreamPositionForInvites(ctx context.Context) (types.StreamPosition, error) {
 	id, err := d.Invites.SelectMaxInviteID(ctx, nil)
 	if err != nil {
@@ -367,6 +381,18 @@ func (d *Database) PurgeRoomState(
 	})
 }
 
+// PurgeRoom deletes everything which the sync API stores about the room.
+func (d *Database) PurgeRoom(
+	ctx context.Context, roomID string,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.Purge.PurgeRoom(ctx, txn, roomID); err != nil {
+			return fmt.Errorf("d.Purge.PurgeRoom: %w", err)
+		}
+		return nil
+	})
+}
+
 func (d *Database) WriteEvent(
 	ctx context.Context,
 	ev *gomatrixserverlib.HeaderedEvent,
@@ -392,6 +418,12 @@ func (d *Database) WriteEvent(
 			return fmt.Errorf("d.handleBackwardExtremities: %w", err)
 		}
 
+		if key, value, ok := searchableText(ev); ok {
+			if err = d.Search.InsertSearchEvent(ctx, txn, ev, pos, key, value); err != nil {
+				return fmt.Errorf("d.Search.InsertSearchEvent: %w", err)
+			}
+		}
+
 		if len(addStateEvents) == 0 && len(removeStateEventIDs) == 0 {
 			// Nothing to do, the event may have just been a message event.
 			return nil
@@ -510,6 +542,19 @@ func (d *Database) GetFilter(
 	return d.Filter.SelectFilter(ctx, localpart, filterID)
 }
 
+// IgnoresForUser returns the users which the user ignores, or sql.ErrNoRows
+// if they have never ignored anyone.
+func (d *Database) IgnoresForUser(ctx context.Context, userID string) (*types.IgnoredUsers, error) {
+	return d.Ignores.SelectIgnores(ctx, nil, userID)
+}
+
+// UpdateIgnoresForUser replaces the users which the user ignores.
+func (d *Database) UpdateIgnoresForUser(ctx context.Context, userID string, ignores *types.IgnoredUsers) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Ignores.UpsertIgnores(ctx, txn, userID, ignores)
+	})
+}
+
 func (d *Database) PutFilter(
 	ctx context.Context, localpart string, filter *gomatrixserverlib.Filter,
 ) (string, error) {
@@ -540,11 +585,49 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 
 	newEvent := ev.Headered(redactedBecause.RoomVersion)
 	err = d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
-		return d.OutputEvents.UpdateEventJSON(ctx, newEvent)
+		if err = d.OutputEvents.UpdateEventJSON(ctx, newEvent); err != nil {
+			return err
+		}
+		// The redacted content must no longer be searchable.
+		return d.Search.DeleteSearchEvent(ctx, txn, redactedEventID)
 	})
 	return err
 }
 
+// searchableKeys maps the types of the events which are indexed for the
+// /search API to the content key that is indexed.
+var searchableKeys = map[string]string{
+	"m.room.message": "content.body",
+	"m.room.name":    "content.name",
+	"m.room.topic":   "content.topic",
+}
+
+// searchableText returns the content key and text of the event which should be
+// indexed for the /search API, or false if the event isn't searchable.
+func searchableText(ev *gomatrixserverlib.HeaderedEvent) (key, value string, ok bool) {
+	key, ok = searchableKeys[ev.Type()]
+	if !ok {
+		return "", "", false
+	}
+	if ev.Type() != "m.room.message" && !ev.StateKeyEquals("") {
+		return "", "", false
+	}
+	result := gjson.GetBytes(ev.Content(), strings.TrimPrefix(key, "content."))
+	if result.Type != gjson.String || result.Str == "" {
+		return "", "", false
+	}
+	return key, result.Str, true
+}
+
+// SearchEvents returns a page of the events in the given rooms which match
+// the search term, along with the total number of matching events.
+func (d *Database) SearchEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	filter *gomatrixserverlib.RoomEventFilter, orderByRank bool, from, limit int,
+) ([]types.SearchResult, int, error) {
+	return d.Search.SearchEvents(ctx, nil, searchTerm, roomIDs, keys, filter, orderByRank, from, limit)
+}
+
 // Retrieve the backward topology position, i.e. the position of the
 // oldest event in the room's topology.
 func (d *Database) GetBackwardTopologyPos(
@@ -951,6 +1034,18 @@ func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId
 	return
 }
 
+func (d *Database) UpsertRoomUnreadNotificationCounts(ctx context.Context, userID string, data *eventutil.NotificationData) (pos types.StreamPosition, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, txn, userID, data)
+		return err
+	})
+	return
+}
+
+func (d *Database) GetUserUnreadNotificationCounts(ctx context.Context, userID string, from, to types.StreamPosition) (map[string]*eventutil.NotificationData, error) {
+	return d.NotificationData.SelectUserUnreadCounts(ctx, nil, userID, from, to)
+}
+
 func (d *Database) GetRoomReceipts(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) ([]eduAPI.OutputReceiptEvent, error) {
 	_, receipts, err := d.Receipts.SelectRoomReceiptsAfter(ctx, roomIDs, streamPos)
 	return receipts, err
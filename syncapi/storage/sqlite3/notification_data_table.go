@@ -0,0 +1,135 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const notificationDataSchema = `
+-- Stores the unread notification counts of users in rooms, as calculated by
+-- the user API from their push rules
+CREATE TABLE IF NOT EXISTS syncapi_notification_data (
+	-- The stream position of the last change to the counts
+	id BIGINT,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	notification_count BIGINT NOT NULL DEFAULT 0,
+	highlight_count BIGINT NOT NULL DEFAULT 0,
+	-- The counts of the threads with unread notifications, as a JSON object
+	-- keyed by the event IDs of their root events
+	thread_counts TEXT NOT NULL DEFAULT '{}',
+	CONSTRAINT syncapi_notification_data_unique UNIQUE (user_id, room_id)
+);
+`
+
+const upsertRoomUnreadNotificationCountsSQL = "" +
+	"INSERT INTO syncapi_notification_data" +
+	" (id, user_id, room_id, notification_count, highlight_count, thread_counts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (user_id, room_id)" +
+	" DO UPDATE SET id = $7, notification_count = $8, highlight_count = $9, thread_counts = $10"
+
+const selectUserUnreadNotificationCountsSQL = "" +
+	"SELECT id, room_id, notification_count, highlight_count, thread_counts" +
+	" FROM syncapi_notification_data" +
+	" WHERE user_id = $1 AND id > $2 AND id <= $3"
+
+const selectMaxNotificationIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_notification_data"
+
+type notificationDataStatements struct {
+	streamIDStatements     *streamIDStatements
+	upsertRoomUnreadCounts *sql.Stmt
+	selectUserUnreadCounts *sql.Stmt
+	selectMaxID            *sql.Stmt
+}
+
+func NewSqliteNotificationDataTable(db *sql.DB, streamID *streamIDStatements) (tables.NotificationData, error) {
+	_, err := db.Exec(notificationDataSchema)
+	if err != nil {
+		return nil, err
+	}
+	r := &notificationDataStatements{
+		streamIDStatements: streamID,
+	}
+	if r.upsertRoomUnreadCounts, err = db.Prepare(upsertRoomUnreadNotificationCountsSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertRoomUnreadCounts statement: %w", err)
+	}
+	if r.selectUserUnreadCounts, err = db.Prepare(selectUserUnreadNotificationCountsSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectUserUnreadCounts statement: %w", err)
+	}
+	if r.selectMaxID, err = db.Prepare(selectMaxNotificationIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxID statement: %w", err)
+	}
+	return r, nil
+}
+
+func (r *notificationDataStatements) UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID string, data *eventutil.NotificationData) (pos types.StreamPosition, err error) {
+	threadCounts, err := json.Marshal(data.UnreadThreadCounts)
+	if err != nil {
+		return
+	}
+	pos, err = r.streamIDStatements.nextNotificationDataID(ctx, txn)
+	if err != nil {
+		return
+	}
+	_, err = sqlutil.TxStmt(txn, r.upsertRoomUnreadCounts).ExecContext(
+		ctx, pos, userID, data.RoomID, data.UnreadNotificationCount, data.UnreadHighlightCount, string(threadCounts),
+		pos, data.UnreadNotificationCount, data.UnreadHighlightCount, string(threadCounts),
+	)
+	return
+}
+
+func (r *notificationDataStatements) SelectUserUnreadCounts(ctx context.Context, txn *sql.Tx, userID string, fromExcl, toIncl types.StreamPosition) (map[string]*eventutil.NotificationData, error) {
+	rows, err := sqlutil.TxStmt(txn, r.selectUserUnreadCounts).QueryContext(ctx, userID, fromExcl, toIncl)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUserUnreadCounts: rows.close() failed")
+
+	roomCounts := map[string]*eventutil.NotificationData{}
+	for rows.Next() {
+		var id types.StreamPosition
+		var threadCounts []byte
+		data := &eventutil.NotificationData{}
+		if err = rows.Scan(&id, &data.RoomID, &data.UnreadNotificationCount, &data.UnreadHighlightCount, &threadCounts); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(threadCounts, &data.UnreadThreadCounts); err != nil {
+			return nil, err
+		}
+		roomCounts[data.RoomID] = data
+	}
+	return roomCounts, rows.Err()
+}
+
+func (r *notificationDataStatements) SelectMaxID(ctx context.Context, txn *sql.Tx) (id int64, err error) {
+	var nullableID sql.NullInt64
+	err = sqlutil.TxStmt(txn, r.selectMaxID).QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func TestNotificationDataTable(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	var streamID streamIDStatements
+	if err = streamID.prepare(db); err != nil {
+		t.Fatalf("failed to create stream ID table: %s", err)
+	}
+	tab, err := NewSqliteNotificationDataTable(db, &streamID)
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+
+	upsert := func(userID, roomID string, notifications, highlights int) types.StreamPosition {
+		pos, err := tab.UpsertRoomUnreadCounts(ctx, nil, userID, &eventutil.NotificationData{
+			RoomID:                  roomID,
+			UnreadNotificationCount: notifications,
+			UnreadHighlightCount:    highlights,
+		})
+		if err != nil {
+			t.Fatalf("failed to upsert counts: %s", err)
+		}
+		return pos
+	}
+	pos1 := upsert("@alice:test", "!room1:test", 2, 1)
+	pos2 := upsert("@alice:test", "!room2:test", 5, 0)
+	upsert("@bob:test", "!room1:test", 1, 0)
+	if pos2 <= pos1 {
+		t.Fatalf("stream position didn't increase: %d then %d", pos1, pos2)
+	}
+
+	counts, err := tab.SelectUserUnreadCounts(ctx, nil, "@alice:test", 0, pos2)
+	if err != nil {
+		t.Fatalf("failed to select counts: %s", err)
+	}
+	if len(counts) != 2 || counts["!room1:test"].UnreadNotificationCount != 2 || counts["!room1:test"].UnreadHighlightCount != 1 {
+		t.Fatalf("unexpected counts %+v", counts)
+	}
+
+	// The counts of the room's threads are stored along with those of the room.
+	threadPos, err := tab.UpsertRoomUnreadCounts(ctx, nil, "@alice:test", &eventutil.NotificationData{
+		RoomID:                  "!room2:test",
+		UnreadNotificationCount: 5,
+		UnreadThreadCounts: map[string]*eventutil.ThreadNotificationData{
+			"$root:test": {UnreadNotificationCount: 3, UnreadHighlightCount: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to upsert counts: %s", err)
+	}
+	counts, err = tab.SelectUserUnreadCounts(ctx, nil, "@alice:test", pos2, threadPos)
+	if err != nil {
+		t.Fatalf("failed to select counts: %s", err)
+	}
+	thread := counts["!room2:test"].UnreadThreadCounts["$root:test"]
+	if len(counts) != 1 || thread == nil || thread.UnreadNotificationCount != 3 || thread.UnreadHighlightCount != 1 {
+		t.Fatalf("unexpected thread counts %+v", counts["!room2:test"])
+	}
+	pos2 = threadPos
+
+	// Resetting the counts moves the room to a new stream position, so that
+	// only it is returned by an incremental sync.
+	pos3 := upsert("@alice:test", "!room1:test", 0, 0)
+	counts, err = tab.SelectUserUnreadCounts(ctx, nil, "@alice:test", pos2, pos3)
+	if err != nil {
+		t.Fatalf("failed to select counts: %s", err)
+	}
+	if len(counts) != 1 || counts["!room1:test"].UnreadNotificationCount != 0 {
+		t.Fatalf("unexpected counts after reset %+v", counts)
+	}
+
+	maxID, err := tab.SelectMaxID(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to select max ID: %s", err)
+	}
+	if types.StreamPosition(maxID) != pos3 {
+		t.Fatalf("got max ID %d want %d", maxID, pos3)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The searchable text lives in an FTS4 virtual table, with the rest of the
+// details about the event in a normal table sharing the same row IDs.
+const searchEventsSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_search_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id TEXT NOT NULL UNIQUE,
+	stream_pos BIGINT NOT NULL,
+	room_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	type TEXT NOT NULL,
+	key TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_room_id_idx ON syncapi_search_events (room_id, stream_pos);
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_search_events_fts USING fts4(value, tokenize=unicode61);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT OR IGNORE INTO syncapi_search_events (event_id, stream_pos, room_id, sender, type, key)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const insertSearchEventTextSQL = "" +
+	"INSERT INTO syncapi_search_events_fts (docid, value) VALUES ($1, $2)"
+
+const deleteSearchEventTextSQL = "" +
+	"DELETE FROM syncapi_search_events_fts WHERE docid IN (SELECT id FROM syncapi_search_events WHERE event_id = $1)"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE event_id = $1"
+
+type searchEventsStatements struct {
+	db                        *sql.DB
+	insertSearchEventStmt     *sql.Stmt
+	insertSearchEventTextStmt *sql.Stmt
+	deleteSearchEventTextStmt *sql.Stmt
+	deleteSearchEventStmt     *sql.Stmt
+}
+
+func NewSqliteSearchEventsTable(db *sql.DB) (tables.SearchEvents, error) {
+	s := &searchEventsStatements{
+		db: db,
+	}
+	_, err := db.Exec(searchEventsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertSearchEventStmt, insertSearchEventSQL},
+		{&s.insertSearchEventTextStmt, insertSearchEventTextSQL},
+		{&s.deleteSearchEventTextStmt, deleteSearchEventTextSQL},
+		{&s.deleteSearchEventStmt, deleteSearchEventSQL},
+	}.Prepare(db)
+}
+
+func (s *searchEventsStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent,
+	pos types.StreamPosition, key, value string,
+) error {
+	res, err := sqlutil.TxStmt(txn, s.insertSearchEventStmt).ExecContext(
+		ctx, event.EventID(), pos, event.RoomID(), event.Sender(), event.Type(), key,
+	)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil || count == 0 {
+		// The event has already been indexed.
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertSearchEventTextStmt).ExecContext(ctx, id, value)
+	return err
+}
+
+func (s *searchEventsStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	if _, err := sqlutil.TxStmt(txn, s.deleteSearchEventTextStmt).ExecContext(ctx, eventID); err != nil {
+		return err
+	}
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+// SearchEvents implements tables.SearchEvents. FTS4 has no built-in ranking
+// function, so results are always ordered most recent first and have a rank
+// of zero.
+func (s *searchEventsStatements) SearchEvents(
+	ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string,
+	filter *gomatrixserverlib.RoomEventFilter, orderByRank bool, from, limit int,
+) ([]types.SearchResult, int, error) {
+	match := ftsMatchExpression(searchTerm)
+	if match == "" || len(roomIDs) == 0 || len(keys) == 0 {
+		return []types.SearchResult{}, 0, nil
+	}
+	params := []interface{}{match}
+	query := "" +
+		" FROM syncapi_search_events e JOIN syncapi_search_events_fts f ON f.docid = e.id" +
+		" WHERE f.value MATCH $1"
+	addIn := func(clause string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		query += " AND " + clause + " " + sqlutil.QueryVariadicOffset(len(values), len(params))
+		for _, v := range values {
+			params = append(params, v)
+		}
+	}
+	addIn("e.room_id IN", roomIDs)
+	addIn("e.key IN", keys)
+	addIn("e.sender IN", filter.Senders)
+	addIn("e.sender NOT IN", filter.NotSenders)
+	addIn("e.type IN", filter.Types)
+	addIn("e.type NOT IN", filter.NotTypes)
+
+	countStmt, err := s.db.PrepareContext(ctx, "SELECT COUNT(*)"+query)
+	if err != nil {
+		return nil, 0, fmt.Errorf("s.db.Prepare: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, countStmt, "SearchEvents: countStmt.close() failed")
+	var total int
+	if err = sqlutil.TxStmt(txn, countStmt).QueryRowContext(ctx, params...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query = fmt.Sprintf(
+		"SELECT e.event_id, e.stream_pos%s ORDER BY e.stream_pos DESC LIMIT $%d OFFSET $%d",
+		query, len(params)+1, len(params)+2,
+	)
+	selectStmt, err := s.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, 0, fmt.Errorf("s.db.Prepare: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, selectStmt, "SearchEvents: selectStmt.close() failed")
+	rows, err := sqlutil.TxStmt(txn, selectStmt).QueryContext(ctx, append(params, limit, from)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SearchEvents: rows.close() failed")
+
+	results := []types.SearchResult{}
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.StreamPosition); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, total, rows.Err()
+}
+
+// ftsMatchExpression turns a search term into an FTS MATCH expression which
+// matches rows containing all of the words in the term. Each word is quoted so
+// that the FTS query syntax can't be used.
+func ftsMatchExpression(searchTerm string) string {
+	words := strings.FieldsFunc(searchTerm, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i := range words {
+		words[i] = `"` + words[i] + `"`
+	}
+	return strings.Join(words, " ")
+}
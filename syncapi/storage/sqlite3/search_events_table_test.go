@@ -0,0 +1,132 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateSearchEvent(t *testing.T, roomID, sender, body string) *gomatrixserverlib.HeaderedEvent {
+	b := gomatrixserverlib.EventBuilder{
+		RoomID:  roomID,
+		Sender:  sender,
+		Type:    "m.room.message",
+		Content: []byte(fmt.Sprintf(`{"msgtype":"m.text","body":%q}`, body)),
+		Depth:   1,
+	}
+	_, key, _ := ed25519.GenerateKey(nil)
+	ev, err := b.Build(time.Now(), "test", "ed25519:test", key, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV4)
+}
+
+func TestSearchEventsTable(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	tab, err := NewSqliteSearchEventsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+
+	bodies := []string{"Hello world", "hello there, world!", "Goodbye world", "Something else"}
+	events := []*gomatrixserverlib.HeaderedEvent{
+		mustCreateSearchEvent(t, "!a:test", "@alice:test", bodies[0]),
+		mustCreateSearchEvent(t, "!a:test", "@bob:test", bodies[1]),
+		mustCreateSearchEvent(t, "!b:test", "@alice:test", bodies[2]),
+		mustCreateSearchEvent(t, "!a:test", "@alice:test", bodies[3]),
+	}
+	for i, ev := range events {
+		if err = tab.InsertSearchEvent(ctx, nil, ev, types.StreamPosition(i+1), "content.body", bodies[i]); err != nil {
+			t.Fatalf("failed to index event: %s", err)
+		}
+	}
+	// Indexing the same event again shouldn't create a duplicate result.
+	if err = tab.InsertSearchEvent(ctx, nil, events[0], 1, "content.body", "Hello world"); err != nil {
+		t.Fatalf("failed to index event again: %s", err)
+	}
+
+	rooms := []string{"!a:test", "!b:test"}
+	keys := []string{"content.body"}
+	tests := []struct {
+		name       string
+		searchTerm string
+		roomIDs    []string
+		filter     gomatrixserverlib.RoomEventFilter
+		from       int
+		limit      int
+		wantEvents []int
+		wantTotal  int
+	}{
+		{"single word", "world", rooms, gomatrixserverlib.RoomEventFilter{}, 0, 10, []int{2, 1, 0}, 3},
+		{"all words must match", "hello world", rooms, gomatrixserverlib.RoomEventFilter{}, 0, 10, []int{1, 0}, 2},
+		{"case and punctuation are ignored", "HELLO, \"world*\"", []string{"!a:test"}, gomatrixserverlib.RoomEventFilter{}, 0, 10, []int{1, 0}, 2},
+		{"rooms", "world", []string{"!b:test"}, gomatrixserverlib.RoomEventFilter{}, 0, 10, []int{2}, 1},
+		{"senders", "world", rooms, gomatrixserverlib.RoomEventFilter{Senders: []string{"@alice:test"}}, 0, 10, []int{2, 0}, 2},
+		{"not senders", "world", rooms, gomatrixserverlib.RoomEventFilter{NotSenders: []string{"@alice:test"}}, 0, 10, []int{1}, 1},
+		{"paginated", "world", rooms, gomatrixserverlib.RoomEventFilter{}, 1, 1, []int{1}, 3},
+		{"no match", "nothing", rooms, gomatrixserverlib.RoomEventFilter{}, 0, 10, nil, 0},
+		{"no words", "!!!", rooms, gomatrixserverlib.RoomEventFilter{}, 0, 10, nil, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			results, total, err := tab.SearchEvents(ctx, nil, tc.searchTerm, tc.roomIDs, keys, &tc.filter, true, tc.from, tc.limit)
+			if err != nil {
+				t.Fatalf("failed to search: %s", err)
+			}
+			if total != tc.wantTotal {
+				t.Errorf("got total %d, want %d", total, tc.wantTotal)
+			}
+			if len(results) != len(tc.wantEvents) {
+				t.Fatalf("got %d results, want %d", len(results), len(tc.wantEvents))
+			}
+			for i, want := range tc.wantEvents {
+				if results[i].EventID != events[want].EventID() {
+					t.Errorf("result %d: got %s, want event %d", i, results[i].EventID, want)
+				}
+			}
+		})
+	}
+
+	// Redacted events should no longer be found.
+	if err = tab.DeleteSearchEvent(ctx, nil, events[1].EventID()); err != nil {
+		t.Fatalf("failed to delete event: %s", err)
+	}
+	results, total, err := tab.SearchEvents(ctx, nil, "hello", rooms, keys, &gomatrixserverlib.RoomEventFilter{}, true, 0, 10)
+	if err != nil {
+		t.Fatalf("failed to search: %s", err)
+	}
+	if total != 1 || len(results) != 1 || results[0].EventID != events[0].EventID() {
+		t.Fatalf("expected only the first event to match after deletion, got %+v", results)
+	}
+}
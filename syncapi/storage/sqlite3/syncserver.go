@@ -100,6 +100,22 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 	if err != nil {
 		return err
 	}
+	searchEvents, err := NewSqliteSearchEventsTable(d.db)
+	if err != nil {
+		return err
+	}
+	ignores, err := NewSqliteIgnoresTable(d.db)
+	if err != nil {
+		return err
+	}
+	purge, err := NewSqlitePurgeStatements(d.db)
+	if err != nil {
+		return err
+	}
+	notificationData, err := NewSqliteNotificationDataTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
 	deltas.LoadRemoveSendToDeviceSentColumn(m)
@@ -120,6 +136,10 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
 		Memberships:         memberships,
+		Search:              searchEvents,
+		NotificationData:    notificationData,
+		Ignores:             ignores,
+		Purge:               purge,
 	}
 	return nil
 }
@@ -19,6 +19,7 @@ import (
 	"database/sql"
 
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -167,3 +168,46 @@ type Memberships interface {
 	UpsertMembership(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, streamPos, topologicalPos types.StreamPosition) error
 	SelectMembership(ctx context.Context, txn *sql.Tx, roomID, userID, memberships []string) (eventID string, streamPos, topologyPos types.StreamPosition, err error)
 }
+
+// SearchEvents is a full-text index over the searchable parts of room events,
+// i.e. the message body, room name and room topic.
+type SearchEvents interface {
+	// InsertSearchEvent indexes the value of the given content key of an event.
+	// Indexing an event which is already indexed does nothing.
+	InsertSearchEvent(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition, key, value string) error
+	// DeleteSearchEvent removes an event from the index, e.g. when it is redacted.
+	DeleteSearchEvent(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SearchEvents returns a page of the events in the given rooms which match the
+	// search term in one of the given content keys, along with the total number of
+	// matching events. Results are ordered by rank if orderByRank is true, otherwise
+	// most recent first.
+	SearchEvents(
+		ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string,
+		filter *gomatrixserverlib.RoomEventFilter, orderByRank bool, from, limit int,
+	) ([]types.SearchResult, int, error)
+}
+
+// NotificationData stores the unread notification counts of users in rooms.
+// Every change to the counts of a room is given a new stream position.
+type NotificationData interface {
+	// UpsertRoomUnreadCounts replaces the counts of the room of the data,
+	// including those of its threads.
+	UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID string, data *eventutil.NotificationData) (types.StreamPosition, error)
+	// SelectUserUnreadCounts returns the counts of the user's rooms which
+	// changed in the given range, keyed by room ID.
+	SelectUserUnreadCounts(ctx context.Context, txn *sql.Tx, userID string, fromExcl, toIncl types.StreamPosition) (map[string]*eventutil.NotificationData, error)
+	SelectMaxID(ctx context.Context, txn *sql.Tx) (int64, error)
+}
+
+// Ignores stores the users which each user ignores.
+type Ignores interface {
+	// SelectIgnores returns the users which the user ignores, or
+	// sql.ErrNoRows if they have never ignored anyone.
+	SelectIgnores(ctx context.Context, txn *sql.Tx, userID string) (*types.IgnoredUsers, error)
+	UpsertIgnores(ctx context.Context, txn *sql.Tx, userID string, ignores *types.IgnoredUsers) error
+}
+
+// Purge deletes everything which is stored about a room.
+type Purge interface {
+	PurgeRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+}
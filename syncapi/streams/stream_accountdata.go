@@ -72,7 +72,9 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 		From: from,
 		To:   to,
 	}
-	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
+	// The filters in the request are applied to the response afterwards, as
+	// global and room account data have different ones.
+	accountDataFilter := gomatrixserverlib.DefaultEventFilter()
 
 	dataTypes, err := p.DB.GetAccountDataInRange(
 		ctx, req.Device.UserID, r, &accountDataFilter,
@@ -7,6 +7,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/sirupsen/logrus"
 )
 
 type DeviceListStreamProvider struct {
@@ -15,10 +16,29 @@ type DeviceListStreamProvider struct {
 	keyAPI keyapi.KeyInternalAPI
 }
 
+// Setup resumes the stream from the latest key change in the key server, so
+// that syncs after a restart don't go back to the start of the stream before
+// the next key change.
+func (p *DeviceListStreamProvider) Setup() {
+	p.StreamProvider.Setup()
+
+	var res keyapi.QueryLatestKeyChangeResponse
+	p.keyAPI.QueryLatestKeyChange(context.Background(), &keyapi.QueryLatestKeyChangeRequest{}, &res)
+	if res.Error != nil {
+		logrus.WithError(res.Error).Error("Failed to get the latest key change from the key server")
+		return
+	}
+	p.latest = types.StreamPosition(res.Offset)
+}
+
 func (p *DeviceListStreamProvider) CompleteSync(
 	ctx context.Context,
 	req *types.SyncRequest,
 ) types.StreamPosition {
+	err := internal.DeviceOTKCounts(req.Context, p.keyAPI, req.Device.UserID, req.Device.ID, req.Response)
+	if err != nil {
+		req.Log.WithError(err).Error("internal.DeviceOTKCounts failed")
+	}
 	return p.LatestPosition(ctx)
 }
 
@@ -35,7 +55,7 @@ func (p *DeviceListStreamProvider) IncrementalSync(
 	}
 	err = internal.DeviceOTKCounts(req.Context, p.keyAPI, req.Device.UserID, req.Device.ID, req.Response)
 	if err != nil {
-		req.Log.WithError(err).Error("internal.DeviceListCatchup failed")
+		req.Log.WithError(err).Error("internal.DeviceOTKCounts failed")
 		return from
 	}
 
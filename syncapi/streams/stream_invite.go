@@ -54,6 +54,10 @@ func (p *InviteStreamProvider) IncrementalSync(
 	}
 
 	for roomID, inviteEvent := range invites {
+		// Invites from ignored users are dropped.
+		if req.IgnoredUsers.IsIgnored(inviteEvent.Sender()) {
+			continue
+		}
 		ir := types.NewInviteResponse(inviteEvent)
 		req.Response.Rooms.Invite[roomID] = *ir
 	}
@@ -0,0 +1,70 @@
+package streams
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type NotificationDataStreamProvider struct {
+	StreamProvider
+}
+
+func (p *NotificationDataStreamProvider) Setup() {
+	p.StreamProvider.Setup()
+
+	id, err := p.DB.MaxStreamPositionForNotificationData(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	p.latest = id
+}
+
+func (p *NotificationDataStreamProvider) CompleteSync(
+	ctx context.Context,
+	req *types.SyncRequest,
+) types.StreamPosition {
+	return p.IncrementalSync(ctx, req, 0, p.LatestPosition(ctx))
+}
+
+func (p *NotificationDataStreamProvider) IncrementalSync(
+	ctx context.Context,
+	req *types.SyncRequest,
+	from, to types.StreamPosition,
+) types.StreamPosition {
+	counts, err := p.DB.GetUserUnreadNotificationCounts(ctx, req.Device.UserID, from, to)
+	if err != nil {
+		req.Log.WithError(err).Error("p.DB.GetUserUnreadNotificationCounts failed")
+		return from
+	}
+
+	// Add the counts to the rooms which are already in the response, or to
+	// an otherwise empty response for the joined rooms that aren't there yet.
+	for roomID, count := range counts {
+		if req.Rooms[roomID] != gomatrixserverlib.Join {
+			continue
+		}
+		jr, ok := req.Response.Rooms.Join[roomID]
+		if !ok {
+			jr = *types.NewJoinResponse()
+		}
+		jr.UnreadNotifications = &types.UnreadNotifications{
+			HighlightCount:    count.UnreadHighlightCount,
+			NotificationCount: count.UnreadNotificationCount,
+		}
+		jr.UnreadThreadNotifications = nil
+		if len(count.UnreadThreadCounts) > 0 {
+			jr.UnreadThreadNotifications = make(map[string]*types.UnreadNotifications, len(count.UnreadThreadCounts))
+		}
+		for threadID, threadCount := range count.UnreadThreadCounts {
+			jr.UnreadThreadNotifications[threadID] = &types.UnreadNotifications{
+				HighlightCount:    threadCount.UnreadHighlightCount,
+				NotificationCount: threadCount.UnreadNotificationCount,
+			}
+		}
+		req.Response.Rooms.Join[roomID] = jr
+	}
+
+	return to
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// applyFilter removes the rooms and events which the filter excludes from
+// the response. The timeline and state were already filtered when they were
+// fetched, except for which rooms they are in.
+func applyFilter(res *types.Response, filter *gomatrixserverlib.Filter) {
+	res.AccountData.Events = internal.FilterClientEvents(res.AccountData.Events, &filter.AccountData)
+	res.Presence.Events = internal.FilterClientEvents(res.Presence.Events, &filter.Presence)
+
+	roomFilter := &filter.Room
+	for roomID := range res.Rooms.Invite {
+		if !internal.IsRoomIncluded(roomID, roomFilter.Rooms, roomFilter.NotRooms) {
+			delete(res.Rooms.Invite, roomID)
+		}
+	}
+	for _, rooms := range []map[string]types.JoinResponse{res.Rooms.Join, res.Rooms.Peek} {
+		for roomID, jr := range rooms {
+			if !internal.IsRoomIncluded(roomID, roomFilter.Rooms, roomFilter.NotRooms) {
+				delete(rooms, roomID)
+				continue
+			}
+			if !internal.IsRoomIncluded(roomID, roomFilter.Timeline.Rooms, roomFilter.Timeline.NotRooms) {
+				jr.Timeline.Events = []gomatrixserverlib.ClientEvent{}
+			}
+			if !internal.IsRoomIncluded(roomID, roomFilter.State.Rooms, roomFilter.State.NotRooms) {
+				jr.State.Events = []gomatrixserverlib.ClientEvent{}
+			}
+			jr.Ephemeral.Events = internal.FilterRoomClientEvents(roomID, jr.Ephemeral.Events, &roomFilter.Ephemeral)
+			jr.AccountData.Events = internal.FilterRoomClientEvents(roomID, jr.AccountData.Events, &roomFilter.AccountData)
+			rooms[roomID] = jr
+		}
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		if !internal.IsRoomIncluded(roomID, roomFilter.Rooms, roomFilter.NotRooms) {
+			delete(res.Rooms.Leave, roomID)
+			continue
+		}
+		if !internal.IsRoomIncluded(roomID, roomFilter.Timeline.Rooms, roomFilter.Timeline.NotRooms) {
+			lr.Timeline.Events = []gomatrixserverlib.ClientEvent{}
+		}
+		if !internal.IsRoomIncluded(roomID, roomFilter.State.Rooms, roomFilter.State.NotRooms) {
+			lr.State.Events = []gomatrixserverlib.ClientEvent{}
+		}
+		res.Rooms.Leave[roomID] = lr
+	}
+}
+
+// withEventFields returns the response with only the fields of its events
+// which are in the event_fields of the filter, e.g. "content.body". The
+// response is turned into generic JSON values for that, so it's only done
+// when a filter asks for it.
+func withEventFields(res *types.Response, eventFields []string) (interface{}, error) {
+	raw, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	var generic map[string]interface{}
+	// Numbers are kept as they are, instead of becoming float64s.
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err = decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	paths := make([][]string, 0, len(eventFields))
+	for _, field := range eventFields {
+		paths = append(paths, splitEventField(field))
+	}
+	selectEventFields(generic, "account_data", paths)
+	selectEventFields(generic, "presence", paths)
+	rooms, _ := generic["rooms"].(map[string]interface{})
+	for _, membership := range []string{"join", "peek", "leave"} {
+		byRoom, _ := rooms[membership].(map[string]interface{})
+		for _, room := range byRoom {
+			room, _ := room.(map[string]interface{})
+			for _, section := range []string{"state", "timeline", "ephemeral", "account_data"} {
+				selectEventFields(room, section, paths)
+			}
+		}
+	}
+	return generic, nil
+}
+
+// selectEventFields replaces each of the events in the section of the
+// response with only the fields at the paths.
+func selectEventFields(parent map[string]interface{}, section string, paths [][]string) {
+	s, _ := parent[section].(map[string]interface{})
+	events, _ := s["events"].([]interface{})
+	for i, event := range events {
+		from, ok := event.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		to := make(map[string]interface{}, len(paths))
+		for _, path := range paths {
+			copyEventField(from, to, path)
+		}
+		events[i] = to
+	}
+}
+
+func copyEventField(from, to map[string]interface{}, path []string) {
+	value, ok := from[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		to[path[0]] = value
+		return
+	}
+	fromChild, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	toChild, ok := to[path[0]].(map[string]interface{})
+	if !ok {
+		toChild = map[string]interface{}{}
+		to[path[0]] = toChild
+	}
+	copyEventField(fromChild, toChild, path[1:])
+}
+
+// splitEventField splits the field into the keys of its path, which are
+// separated by dots. Literal dots and backslashes are escaped with a
+// backslash.
+func splitEventField(field string) []string {
+	var keys []string
+	var key strings.Builder
+	for i := 0; i < len(field); i++ {
+		switch {
+		case field[i] == '\\' && i+1 < len(field):
+			i++
+			key.WriteByte(field[i])
+		case field[i] == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(field[i])
+		}
+	}
+	return append(keys, key.String())
+}
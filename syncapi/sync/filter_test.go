@@ -0,0 +1,101 @@
+package sync
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestApplyFilter(t *testing.T) {
+	res := types.NewResponse()
+	res.AccountData.Events = []gomatrixserverlib.ClientEvent{{Type: "m.push_rules"}, {Type: "m.direct"}}
+	for _, roomID := range []string{"!a:localhost", "!b:localhost"} {
+		jr := types.NewJoinResponse()
+		jr.Timeline.Events = []gomatrixserverlib.ClientEvent{{Type: "m.room.message"}}
+		jr.Ephemeral.Events = []gomatrixserverlib.ClientEvent{{Type: "m.typing"}, {Type: "m.receipt"}}
+		res.Rooms.Join[roomID] = *jr
+	}
+
+	filter := gomatrixserverlib.DefaultFilter()
+	filter.AccountData.Types = []string{"m.direct"}
+	filter.Room.NotRooms = []string{"!b:localhost"}
+	filter.Room.Ephemeral.NotTypes = []string{"m.typing"}
+	applyFilter(res, &filter)
+
+	if len(res.AccountData.Events) != 1 || res.AccountData.Events[0].Type != "m.direct" {
+		t.Errorf("got account data %+v, want only m.direct", res.AccountData.Events)
+	}
+	if _, ok := res.Rooms.Join["!b:localhost"]; ok {
+		t.Errorf("got room !b:localhost, want it to be excluded")
+	}
+	jr := res.Rooms.Join["!a:localhost"]
+	if len(jr.Timeline.Events) != 1 {
+		t.Errorf("got %d timeline events, want 1", len(jr.Timeline.Events))
+	}
+	if len(jr.Ephemeral.Events) != 1 || jr.Ephemeral.Events[0].Type != "m.receipt" {
+		t.Errorf("got ephemeral events %+v, want only m.receipt", jr.Ephemeral.Events)
+	}
+}
+
+func TestWithEventFields(t *testing.T) {
+	res := types.NewResponse()
+	jr := types.NewJoinResponse()
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{{
+		Type:           "m.room.message",
+		Sender:         "@alice:localhost",
+		EventID:        "$event",
+		OriginServerTS: 1646900000000,
+		Content:        gomatrixserverlib.RawJSON(`{"body":"hi","msgtype":"m.text","org.example.key":1}`),
+	}}
+	res.Rooms.Join["!a:localhost"] = *jr
+
+	filtered, err := withEventFields(res, []string{"type", "origin_server_ts", "content.body", `content.org\.example\.key`})
+	if err != nil {
+		t.Fatalf("withEventFields failed: %s", err)
+	}
+	raw, err := json.Marshal(filtered)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	var got struct {
+		Rooms struct {
+			Join map[string]struct {
+				Timeline struct {
+					Events []map[string]interface{} `json:"events"`
+				} `json:"timeline"`
+			} `json:"join"`
+		} `json:"rooms"`
+	}
+	if err = json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	events := got.Rooms.Join["!a:localhost"].Timeline.Events
+	want := []map[string]interface{}{{
+		"type":             "m.room.message",
+		"origin_server_ts": float64(1646900000000),
+		"content": map[string]interface{}{
+			"body":            "hi",
+			"org.example.key": float64(1),
+		},
+	}}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got %v, want %v", events, want)
+	}
+}
+
+func TestSplitEventField(t *testing.T) {
+	tsts := map[string][]string{
+		"type":                    {"type"},
+		"content.body":            {"content", "body"},
+		`content.m\.relates_to`:   {"content", "m.relates_to"},
+		`content.back\\slash.key`: {"content", `back\slash`, "key"},
+	}
+	for field, want := range tsts {
+		if got := splitEventField(field); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q for %q", got, want, field)
+		}
+	}
+}
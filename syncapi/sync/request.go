@@ -15,6 +15,7 @@
 package sync
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -44,7 +45,6 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 			return nil, err
 		}
 	}
-	// TODO: read from stored filters too
 	filter := gomatrixserverlib.DefaultFilter()
 	filterQuery := req.URL.Query().Get("filter")
 	if filterQuery != "" {
@@ -69,6 +69,11 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		}
 	}
 
+	ignoredUsers, err := syncDB.IgnoresForUser(req.Context(), device.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("syncDB.IgnoresForUser: %w", err)
+	}
+
 	logger := util.GetLogger(req.Context()).WithFields(logrus.Fields{
 		"user_id":   device.UserID,
 		"device_id": device.ID,
@@ -87,6 +92,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		Timeout:       timeout,                 //
 		Rooms:         make(map[string]string), // Populated by the PDU stream
 		WantFullState: wantFullState,           //
+		IgnoredUsers:  ignoredUsers,            //
 	}, nil
 }
 
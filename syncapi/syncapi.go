@@ -82,7 +82,7 @@ func AddPublicRoutes(
 	}
 
 	clientConsumer := consumers.NewOutputClientDataConsumer(
-		process, cfg, js, syncDB, notifier, streams.AccountDataStreamProvider,
+		process, cfg, js, syncDB, notifier, streams.AccountDataStreamProvider, userAPI,
 	)
 	if err = clientConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start client data consumer")
@@ -109,5 +109,19 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start receipts consumer")
 	}
 
+	notificationDataConsumer := consumers.NewOutputNotificationDataConsumer(
+		process, cfg, js, syncDB, notifier, streams.NotificationDataStreamProvider,
+	)
+	if err = notificationDataConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start notification data consumer")
+	}
+
+	deletedDevicesConsumer := consumers.NewOutputDeletedDevicesConsumer(
+		process, cfg, js, syncDB,
+	)
+	if err = deletedDevicesConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start deleted devices consumer")
+	}
+
 	routing.Setup(router, requestPool, syncDB, userAPI, federation, rsAPI, cfg)
 }
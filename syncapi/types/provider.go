@@ -18,6 +18,8 @@ type SyncRequest struct {
 	Since         StreamingToken
 	Timeout       time.Duration
 	WantFullState bool
+	// The users that the syncing user has ignored, if any.
+	IgnoredUsers *IgnoredUsers
 
 	// Updated by the PDU stream.
 	Rooms map[string]string
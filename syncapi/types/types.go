@@ -95,13 +95,14 @@ const (
 )
 
 type StreamingToken struct {
-	PDUPosition          StreamPosition
-	TypingPosition       StreamPosition
-	ReceiptPosition      StreamPosition
-	SendToDevicePosition StreamPosition
-	InvitePosition       StreamPosition
-	AccountDataPosition  StreamPosition
-	DeviceListPosition   StreamPosition
+	PDUPosition              StreamPosition
+	TypingPosition           StreamPosition
+	ReceiptPosition          StreamPosition
+	SendToDevicePosition     StreamPosition
+	InvitePosition           StreamPosition
+	AccountDataPosition      StreamPosition
+	DeviceListPosition       StreamPosition
+	NotificationDataPosition StreamPosition
 }
 
 // This will be used as a fallback by json.Marshal.
@@ -117,10 +118,11 @@ func (s *StreamingToken) UnmarshalText(text []byte) (err error) {
 
 func (t StreamingToken) String() string {
 	posStr := fmt.Sprintf(
-		"s%d_%d_%d_%d_%d_%d_%d",
+		"s%d_%d_%d_%d_%d_%d_%d_%d",
 		t.PDUPosition, t.TypingPosition,
 		t.ReceiptPosition, t.SendToDevicePosition,
 		t.InvitePosition, t.AccountDataPosition, t.DeviceListPosition,
+		t.NotificationDataPosition,
 	)
 	return posStr
 }
@@ -142,12 +144,14 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 		return true
 	case t.DeviceListPosition > other.DeviceListPosition:
 		return true
+	case t.NotificationDataPosition > other.NotificationDataPosition:
+		return true
 	}
 	return false
 }
 
 func (t *StreamingToken) IsEmpty() bool {
-	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition+t.AccountDataPosition+t.DeviceListPosition == 0
+	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition+t.AccountDataPosition+t.DeviceListPosition+t.NotificationDataPosition == 0
 }
 
 // WithUpdates returns a copy of the StreamingToken with updates applied from another StreamingToken.
@@ -185,6 +189,9 @@ func (t *StreamingToken) ApplyUpdates(other StreamingToken) {
 	if other.DeviceListPosition > t.DeviceListPosition {
 		t.DeviceListPosition = other.DeviceListPosition
 	}
+	if other.NotificationDataPosition > t.NotificationDataPosition {
+		t.NotificationDataPosition = other.NotificationDataPosition
+	}
 }
 
 type TopologyToken struct {
@@ -277,9 +284,9 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 	// s478_0_0_0_0_13.dl-0-2 but we have now removed partitioned stream positions
 	tok = strings.Split(tok, ".")[0]
 	parts := strings.Split(tok[1:], "_")
-	var positions [7]StreamPosition
+	var positions [8]StreamPosition
 	for i, p := range parts {
-		if i > len(positions) {
+		if i >= len(positions) {
 			break
 		}
 		var pos int
@@ -291,13 +298,14 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 		positions[i] = StreamPosition(pos)
 	}
 	token = StreamingToken{
-		PDUPosition:          positions[0],
-		TypingPosition:       positions[1],
-		ReceiptPosition:      positions[2],
-		SendToDevicePosition: positions[3],
-		InvitePosition:       positions[4],
-		AccountDataPosition:  positions[5],
-		DeviceListPosition:   positions[6],
+		PDUPosition:              positions[0],
+		TypingPosition:           positions[1],
+		ReceiptPosition:          positions[2],
+		SendToDevicePosition:     positions[3],
+		InvitePosition:           positions[4],
+		AccountDataPosition:      positions[5],
+		DeviceListPosition:       positions[6],
+		NotificationDataPosition: positions[7],
 	}
 	return token, nil
 }
@@ -383,6 +391,20 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
+	UnreadNotifications *UnreadNotifications `json:"unread_notifications,omitempty"`
+	// The counts of the threads with unread notifications, by the event ID
+	// of their root event, as of MSC3773. They are sent along with the
+	// counts of the room, which include them, and threads which aren't
+	// there have no unread notifications.
+	UnreadThreadNotifications map[string]*UnreadNotifications `json:"unread_thread_notifications,omitempty"`
+}
+
+// UnreadNotifications contains the unread notification counts of a joined
+// room or thread. It is only included in a /sync response when the counts
+// have changed.
+type UnreadNotifications struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -462,3 +484,42 @@ type Peek struct {
 	New     bool
 	Deleted bool
 }
+
+// SearchResult is an event which matched a full-text search.
+type SearchResult struct {
+	EventID        string
+	StreamPosition StreamPosition
+	// How well the event matched the search term. Higher is better.
+	Rank float64
+}
+
+// IgnoredUsers is the content of the m.ignored_user_list account data of a
+// user, which lists the users whose events and invites they don't want.
+type IgnoredUsers struct {
+	List map[string]interface{} `json:"ignored_users"`
+}
+
+// IsIgnored returns whether the user with the ID is ignored.
+func (i *IgnoredUsers) IsIgnored(userID string) bool {
+	if i == nil {
+		return false
+	}
+	_, ok := i.List[userID]
+	return ok
+}
+
+// FilterEvents removes the events which were sent by ignored users. State
+// events are kept, as clients need them to know the state of the room.
+func (i *IgnoredUsers) FilterEvents(events []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
+	if i == nil || len(i.List) == 0 {
+		return events
+	}
+	filtered := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if ev.StateKey() == nil && i.IsIgnored(ev.Sender()) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
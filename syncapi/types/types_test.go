@@ -9,10 +9,10 @@ import (
 
 func TestSyncTokens(t *testing.T) {
 	shouldPass := map[string]string{
-		"s4_0_0_0_0_0_0": StreamingToken{4, 0, 0, 0, 0, 0, 0}.String(),
-		"s3_1_0_0_0_0_2": StreamingToken{3, 1, 0, 0, 0, 0, 2}.String(),
-		"s3_1_2_3_5_0_0": StreamingToken{3, 1, 2, 3, 5, 0, 0}.String(),
-		"t3_1":           TopologyToken{3, 1}.String(),
+		"s4_0_0_0_0_0_0_0": StreamingToken{4, 0, 0, 0, 0, 0, 0, 0}.String(),
+		"s3_1_0_0_0_0_2_0": StreamingToken{3, 1, 0, 0, 0, 0, 2, 0}.String(),
+		"s3_1_2_3_5_0_0_7": StreamingToken{3, 1, 2, 3, 5, 0, 0, 7}.String(),
+		"t3_1":             TopologyToken{3, 1}.String(),
 	}
 
 	for a, b := range shouldPass {
@@ -21,6 +21,13 @@ func TestSyncTokens(t *testing.T) {
 		}
 	}
 
+	// Tokens from before the notification data position was added are still valid.
+	if tok, err := NewStreamTokenFromString("s3_1_2_3_5_0_0"); err != nil {
+		t.Errorf("NewStreamTokenFromString of a 7-part token failed: %s", err)
+	} else if tok != (StreamingToken{3, 1, 2, 3, 5, 0, 0, 0}) {
+		t.Errorf("NewStreamTokenFromString of a 7-part token returned %v", tok)
+	}
+
 	shouldFail := []string{
 		"",
 		"s_",
@@ -63,3 +70,29 @@ func TestNewInviteResponse(t *testing.T) {
 		t.Fatalf("Invite response didn't contain correct info")
 	}
 }
+
+func TestIgnoredUsersFilterEvents(t *testing.T) {
+	var events []*gomatrixserverlib.HeaderedEvent
+	for _, event := range []string{
+		`{"content":{"body":"hello"},"depth":1,"origin_server_ts":1,"prev_events":[],"auth_events":[],"room_id":"!room:localhost","sender":"@bob:localhost","type":"m.room.message"}`,
+		`{"content":{"membership":"join"},"depth":2,"origin_server_ts":2,"prev_events":[],"auth_events":[],"room_id":"!room:localhost","sender":"@bob:localhost","state_key":"@bob:localhost","type":"m.room.member"}`,
+		`{"content":{"body":"hi"},"depth":3,"origin_server_ts":3,"prev_events":[],"auth_events":[],"room_id":"!room:localhost","sender":"@charlie:localhost","type":"m.room.message"}`,
+	} {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(event), false, gomatrixserverlib.RoomVersionV5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev.Headered(gomatrixserverlib.RoomVersionV5))
+	}
+
+	var noIgnores *IgnoredUsers
+	if got := noIgnores.FilterEvents(events); len(got) != len(events) {
+		t.Errorf("got %d events, want %d", len(got), len(events))
+	}
+	// Bob's message is removed, but not his membership event.
+	ignores := &IgnoredUsers{List: map[string]interface{}{"@bob:localhost": struct{}{}}}
+	got := ignores.FilterEvents(events)
+	if len(got) != 2 || got[0] != events[1] || got[1] != events[2] {
+		t.Errorf("got %v, want %v", got, events[1:])
+	}
+}
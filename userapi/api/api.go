@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -29,6 +30,9 @@ type UserInternalAPI interface {
 	PerformPasswordUpdate(ctx context.Context, req *PerformPasswordUpdateRequest, res *PerformPasswordUpdateResponse) error
 	PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error
 	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
+	PerformDeviceDehydration(ctx context.Context, req *PerformDeviceDehydrationRequest, res *PerformDeviceDehydrationResponse) error
+	PerformDeviceRehydration(ctx context.Context, req *PerformDeviceRehydrationRequest, res *PerformDeviceRehydrationResponse) error
+	PerformTokenRefresh(ctx context.Context, req *PerformTokenRefreshRequest, res *PerformTokenRefreshResponse) error
 	PerformLastSeenUpdate(ctx context.Context, req *PerformLastSeenUpdateRequest, res *PerformLastSeenUpdateResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
@@ -38,10 +42,24 @@ type UserInternalAPI interface {
 	QueryProfile(ctx context.Context, req *QueryProfileRequest, res *QueryProfileResponse) error
 	QueryAccessToken(ctx context.Context, req *QueryAccessTokenRequest, res *QueryAccessTokenResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
+	QueryDeviceConnections(ctx context.Context, req *QueryDeviceConnectionsRequest, res *QueryDeviceConnectionsResponse) error
+	QueryDehydratedDevice(ctx context.Context, req *QueryDehydratedDeviceRequest, res *QueryDehydratedDeviceResponse) error
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
 	QueryDeviceInfos(ctx context.Context, req *QueryDeviceInfosRequest, res *QueryDeviceInfosResponse) error
 	QuerySearchProfiles(ctx context.Context, req *QuerySearchProfilesRequest, res *QuerySearchProfilesResponse) error
+	QuerySearchUserDirectory(ctx context.Context, req *QuerySearchUserDirectoryRequest, res *QuerySearchUserDirectoryResponse) error
 	QueryOpenIDToken(ctx context.Context, req *QueryOpenIDTokenRequest, res *QueryOpenIDTokenResponse) error
+	QueryAccountByLocalpart(ctx context.Context, req *QueryAccountByLocalpartRequest, res *QueryAccountByLocalpartResponse) error
+	PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *PerformPusherSetResponse) error
+	PerformPusherDeletion(ctx context.Context, req *PerformPusherDeletionRequest, res *PerformPusherDeletionResponse) error
+	QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error
+	QueryAllPushers(ctx context.Context, req *QueryAllPushersRequest, res *QueryAllPushersResponse) error
+	PerformPushersDeletion(ctx context.Context, req *PerformPushersDeletionRequest, res *PerformPushersDeletionResponse) error
+	QueryNotifications(ctx context.Context, req *QueryNotificationsRequest, res *QueryNotificationsResponse) error
+	QueryMonthlyActiveUsers(ctx context.Context, req *QueryMonthlyActiveUsersRequest, res *QueryMonthlyActiveUsersResponse) error
+	PerformLoginAttempt(ctx context.Context, req *PerformLoginAttemptRequest, res *PerformLoginAttemptResponse) error
+	PerformLoginResult(ctx context.Context, req *PerformLoginResultRequest, res *PerformLoginResultResponse) error
+	PerformAccountRenewal(ctx context.Context, req *PerformAccountRenewalRequest, res *PerformAccountRenewalResponse) error
 }
 
 type PerformKeyBackupRequest struct {
@@ -51,6 +69,10 @@ type PerformKeyBackupRequest struct {
 	Algorithm    string
 	DeleteBackup bool // if true will delete the backup based on 'Version'.
 
+	DeleteKeys       bool   // if true will delete the keys of the backup based on 'Version'.
+	KeysForRoomID    string // optional string to only delete keys which belong to this room
+	KeysForSessionID string // optional string to only delete keys which belong to this (room, session)
+
 	// The keys to upload, if any. If blank, creates/updates/deletes key version metadata only.
 	Keys struct {
 		Rooms map[string]struct {
@@ -96,8 +118,8 @@ type PerformKeyBackupResponse struct {
 	Exists  bool   // set to true if the Version exists
 	Version string // the newly created version
 
-	KeyCount int64  // only set if Keys were given in the request
-	KeyETag  string // only set if Keys were given in the request
+	KeyCount int64  // only set if Keys were given in the request or DeleteKeys was set
+	KeyETag  string // only set if Keys were given in the request or DeleteKeys was set
 }
 
 type QueryKeyBackupRequest struct {
@@ -152,11 +174,74 @@ type PerformDeviceDeletionRequest struct {
 	// so that a password change doesn't cause that client to be logged
 	// out. Only specify when DeviceIDs is empty.
 	ExceptDeviceID string
+	// Whether to also delete the dehydrated device of the user, which is
+	// otherwise kept when DeviceIDs is empty.
+	IncludeDehydratedDevice bool
 }
 
 type PerformDeviceDeletionResponse struct {
 }
 
+// PerformDeviceDehydrationRequest is the request for PerformDeviceDehydration
+type PerformDeviceDehydrationRequest struct {
+	UserID string
+	// The opaque data the client needs to rehydrate the device.
+	DeviceData json.RawMessage
+	// optional: if nil no display name will be associated with this device.
+	DeviceDisplayName *string
+}
+
+// PerformDeviceDehydrationResponse is the response for PerformDeviceDehydration
+type PerformDeviceDehydrationResponse struct {
+	Device *Device
+}
+
+// PerformDeviceRehydrationRequest is the request for PerformDeviceRehydration
+type PerformDeviceRehydrationRequest struct {
+	// The device which claims the dehydrated device. It is replaced by the
+	// dehydrated device, which takes over its access token.
+	Device *Device
+	// The ID of the dehydrated device to claim.
+	DeviceID string
+}
+
+// PerformDeviceRehydrationResponse is the response for PerformDeviceRehydration
+type PerformDeviceRehydrationResponse struct {
+	// false if DeviceID isn't the dehydrated device of the user, e.g. because
+	// it has been claimed or replaced in the meantime.
+	Claimed bool
+}
+
+// PerformTokenRefreshRequest is the request for PerformTokenRefresh
+type PerformTokenRefreshRequest struct {
+	// The refresh token which the client was given along with its access
+	// token. It can only be used once.
+	RefreshToken string
+	// The new access token of the device.
+	AccessToken string
+}
+
+// PerformTokenRefreshResponse is the response for PerformTokenRefresh
+type PerformTokenRefreshResponse struct {
+	// The device, with its new access token, or nil if the refresh token is
+	// unknown or has already been used.
+	Device *Device
+	// The refresh token to use the next time that the access token expires.
+	RefreshToken string
+}
+
+// QueryDehydratedDeviceRequest is the request for QueryDehydratedDevice
+type QueryDehydratedDeviceRequest struct {
+	UserID string
+}
+
+// QueryDehydratedDeviceResponse is the response for QueryDehydratedDevice
+type QueryDehydratedDeviceResponse struct {
+	Exists     bool
+	DeviceID   string
+	DeviceData json.RawMessage
+}
+
 // QueryDeviceInfosRequest is the request to QueryDeviceInfos
 type QueryDeviceInfosRequest struct {
 	DeviceIDs []string
@@ -182,6 +267,21 @@ type QueryAccessTokenRequest struct {
 type QueryAccessTokenResponse struct {
 	Device *Device
 	Err    string // e.g ErrorForbidden
+	// SoftLogout is true if there is no device because the access token has
+	// expired, in which case the client can get a new one with its refresh
+	// token.
+	SoftLogout bool
+	// Locked is true if the device belongs to an account which has been
+	// locked by a server admin. The device is still given, as locked users
+	// can log out.
+	Locked bool
+	// Expired is true if the device belongs to an account which has expired
+	// and has to be renewed. The device is still given, as the users of
+	// expired accounts can log out.
+	Expired bool
+	// The contact for the server admins, which the users of expired accounts
+	// are told about.
+	AdminContact string
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -208,6 +308,18 @@ type QueryDevicesResponse struct {
 	Devices    []Device
 }
 
+// QueryDeviceConnectionsRequest is the request for QueryDeviceConnections
+type QueryDeviceConnectionsRequest struct {
+	UserID string
+}
+
+// QueryDeviceConnectionsResponse is the response for QueryDeviceConnections
+type QueryDeviceConnectionsResponse struct {
+	// The IP addresses and user agents which each of the user's devices have
+	// connected with, keyed by device ID, with the most recent first.
+	Connections map[string][]DeviceConnection
+}
+
 // QueryProfileRequest is the request for QueryProfile
 type QueryProfileRequest struct {
 	// The user ID to query
@@ -238,9 +350,27 @@ type QuerySearchProfilesResponse struct {
 	Profiles []authtypes.Profile
 }
 
+// QuerySearchUserDirectoryRequest is the request for QuerySearchUserDirectory
+type QuerySearchUserDirectoryRequest struct {
+	// The user who is searching
+	UserID string
+	// The search string to match
+	SearchString string
+	// How many results to return
+	Limit int
+}
+
+// QuerySearchUserDirectoryResponse is the response for QuerySearchUserDirectoryRequest
+type QuerySearchUserDirectoryResponse struct {
+	// The users matching the search
+	Results []authtypes.FullyQualifiedProfile
+	// Whether there were more users matching the search than the limit
+	Limited bool
+}
+
 // PerformAccountCreationRequest is the request for PerformAccountCreation
 type PerformAccountCreationRequest struct {
-	AccountType AccountType // Required: whether this is a guest or user account
+	AccountType AccountType // Required: whether this is a guest, user or admin account
 	Localpart   string      // Required: The localpart for this account. Ignored if account type is guest.
 
 	AppServiceID string // optional: the application service ID (not user ID) creating this account, if any.
@@ -271,12 +401,79 @@ type PerformLastSeenUpdateRequest struct {
 	UserID     string
 	DeviceID   string
 	RemoteAddr string
+	UserAgent  string
 }
 
 // PerformLastSeenUpdateResponse is the response for PerformLastSeenUpdate.
 type PerformLastSeenUpdateResponse struct {
 }
 
+// QueryMonthlyActiveUsersRequest is the request for QueryMonthlyActiveUsers
+type QueryMonthlyActiveUsersRequest struct {
+	// The user who wants to log in or register, if any, who is only refused
+	// if they aren't already one of the monthly active users.
+	UserID string
+}
+
+// QueryMonthlyActiveUsersResponse is the response for QueryMonthlyActiveUsers
+type QueryMonthlyActiveUsersResponse struct {
+	// The number of users who have been active in the last 30 days.
+	Count int64
+	// The configured limit on the count, or 0 if there is no limit.
+	Limit int64
+	// Whether the limit has been reached, so that the user can't become
+	// active.
+	LimitExceeded bool
+	// Who users who are refused should contact.
+	AdminContact string
+}
+
+// PerformLoginAttemptRequest is the request for PerformLoginAttempt
+type PerformLoginAttemptRequest struct {
+	// The account which the client wants to log in to.
+	Localpart string
+	// The IP address which the client is logging in from.
+	RemoteAddr string
+}
+
+// PerformLoginAttemptResponse is the response for PerformLoginAttempt
+type PerformLoginAttemptResponse struct {
+	// How long the client has to wait before it can try to log in, in
+	// milliseconds, or 0 if it can try now. The attempt is only counted
+	// if the client can try now.
+	RetryAfterMS int64
+}
+
+// PerformLoginResultRequest is the request for PerformLoginResult
+type PerformLoginResultRequest struct {
+	Localpart  string
+	RemoteAddr string
+	// Whether the password was right.
+	Success bool
+}
+
+// PerformLoginResultResponse is the response for PerformLoginResult
+type PerformLoginResultResponse struct {
+}
+
+// PerformAccountRenewalRequest is the request for PerformAccountRenewal.
+// Either the token from a renewal email or the localpart of the account is
+// given.
+type PerformAccountRenewalRequest struct {
+	Token     string
+	Localpart string
+	// When the account expires after being renewed, or 0 for one validity
+	// period from now.
+	ExpirationTS gomatrixserverlib.Timestamp
+}
+
+// PerformAccountRenewalResponse is the response for PerformAccountRenewal
+type PerformAccountRenewalResponse struct {
+	// The account which was renewed, or empty if the token is unknown.
+	UserID       string
+	ExpirationTS gomatrixserverlib.Timestamp
+}
+
 // PerformDeviceCreationRequest is the request for PerformDeviceCreation
 type PerformDeviceCreationRequest struct {
 	Localpart   string
@@ -294,17 +491,25 @@ type PerformDeviceCreationRequest struct {
 	// update for this account. Generally the only reason to do this is if the account
 	// is an appservice account.
 	NoDeviceListUpdate bool
+	// Refreshable determines whether the device is given a refresh token, in
+	// which case its access token expires. It is ignored if refresh tokens
+	// are disabled.
+	Refreshable bool
 }
 
 // PerformDeviceCreationResponse is the response for PerformDeviceCreation
 type PerformDeviceCreationResponse struct {
 	DeviceCreated bool
 	Device        *Device
+	// The refresh token of the device, if it was given one.
+	RefreshToken string
 }
 
 // PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
 type PerformAccountDeactivationRequest struct {
 	Localpart string
+	// Whether the user asked for their data to be erased
+	Erase bool
 }
 
 // PerformAccountDeactivationResponse is the response for PerformAccountDeactivation
@@ -333,6 +538,135 @@ type QueryOpenIDTokenResponse struct {
 	ExpiresAtMS int64
 }
 
+// QueryAccountByLocalpartRequest is the request for QueryAccountByLocalpart
+type QueryAccountByLocalpartRequest struct {
+	Localpart string
+}
+
+// QueryAccountByLocalpartResponse is the response for QueryAccountByLocalpart
+type QueryAccountByLocalpartResponse struct {
+	// Nil if no account exists with the given localpart.
+	Account *Account
+}
+
+// PerformPusherSetRequest is the request for PerformPusherSet
+type PerformPusherSetRequest struct {
+	Pusher    // Pusher.Kind being empty deletes the pusher
+	Localpart string
+	// If false, other pushers with the same app ID and pushkey are removed,
+	// including those belonging to other users.
+	Append bool `json:"append"`
+}
+
+// PerformPusherSetResponse is the response for PerformPusherSet
+type PerformPusherSetResponse struct {
+	// Set if the pusher can't be set up, in which case nothing was changed.
+	// It is returned here rather than as an error so that it survives being
+	// sent over the internal HTTP API.
+	Error *ErrorInvalidPusher `json:"error,omitempty"`
+}
+
+// PerformPusherDeletionRequest is the request for PerformPusherDeletion
+type PerformPusherDeletionRequest struct {
+	Localpart string
+	AppID     string
+	PushKey   string
+}
+
+// PerformPusherDeletionResponse is the response for PerformPusherDeletion
+type PerformPusherDeletionResponse struct {
+}
+
+// QueryPushersRequest is the request for QueryPushers
+type QueryPushersRequest struct {
+	Localpart string
+}
+
+// QueryPushersResponse is the response for QueryPushers
+type QueryPushersResponse struct {
+	Pushers []Pusher `json:"pushers"`
+}
+
+// PusherFilter selects pushers across all users. Fields which are empty
+// match every pusher.
+type PusherFilter struct {
+	Localpart string `json:"localpart,omitempty"`
+	AppID     string `json:"app_id,omitempty"`
+	PushKey   string `json:"pushkey,omitempty"`
+	// The push gateway URL, which only HTTP pushers have.
+	URL string `json:"url,omitempty"`
+}
+
+// IsEmpty returns true if the filter matches every pusher.
+func (f *PusherFilter) IsEmpty() bool {
+	return f.Localpart == "" && f.AppID == "" && f.PushKey == "" && f.URL == ""
+}
+
+// QueryAllPushersRequest is the request for QueryAllPushers
+type QueryAllPushersRequest struct {
+	PusherFilter
+}
+
+// QueryAllPushersResponse is the response for QueryAllPushers
+type QueryAllPushersResponse struct {
+	Pushers []UserPusher `json:"pushers"`
+}
+
+// PerformPushersDeletionRequest is the request for PerformPushersDeletion.
+// The filter mustn't be empty, so that all pushers can't be removed by
+// accident.
+type PerformPushersDeletionRequest struct {
+	PusherFilter
+}
+
+// PerformPushersDeletionResponse is the response for PerformPushersDeletion
+type PerformPushersDeletionResponse struct {
+	// The pushers which were removed.
+	Pushers []UserPusher `json:"pushers"`
+}
+
+// QueryNotificationsRequest is the request for QueryNotifications
+type QueryNotificationsRequest struct {
+	Localpart string `json:"localpart"` // Required.
+	From      string `json:"from,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	Only      string `json:"only,omitempty"` // Only "highlight" is supported.
+}
+
+// QueryNotificationsResponse is the response for QueryNotifications
+type QueryNotificationsResponse struct {
+	NextToken     string          `json:"next_token,omitempty"`
+	Notifications []*Notification `json:"notifications"` // Required.
+}
+
+// Notification is an event which a user was notified about by their push rules.
+type Notification struct {
+	Actions    []*pushrules.Action           `json:"actions"`
+	Event      gomatrixserverlib.ClientEvent `json:"event"`
+	ProfileTag string                        `json:"profile_tag,omitempty"`
+	Read       bool                          `json:"read"`
+	RoomID     string                        `json:"room_id"`
+	TS         gomatrixserverlib.Timestamp   `json:"ts"`
+}
+
+// NotificationCounts are the numbers of unread notifications of a user, and
+// how many of those are highlights.
+type NotificationCounts struct {
+	Total     int64
+	Highlight int64
+}
+
+// QueuedPush is a request which is waiting to be sent to a push gateway.
+type QueuedPush struct {
+	ID            int64
+	Localpart     string
+	Kind          PusherKind
+	URL           string
+	Request       []byte
+	Attempts      int
+	NextAttemptTS gomatrixserverlib.Timestamp
+}
+
 // Device represents a client's device (mobile, web, etc)
 type Device struct {
 	ID     string
@@ -351,6 +685,18 @@ type Device struct {
 	// If the device is for an appservice user,
 	// this is the appservice ID.
 	AppserviceID string
+	// When the access token expires, in milliseconds since the epoch, or 0
+	// if it never does. Only access tokens which come with a refresh token
+	// expire.
+	AccessTokenExpiresTS int64
+}
+
+// DeviceConnection is an IP address and user agent which a device has
+// connected with.
+type DeviceConnection struct {
+	IP         string
+	UserAgent  string
+	LastSeenTS int64
 }
 
 // Account represents a Matrix account on this home server.
@@ -359,10 +705,79 @@ type Account struct {
 	Localpart    string
 	ServerName   gomatrixserverlib.ServerName
 	AppServiceID string
-	// TODO: Other flags like IsAdmin, IsGuest
+	AccountType  AccountType
 	// TODO: Associations (e.g. with application services)
 }
 
+// Pusher represents a push notification subscriber
+type Pusher struct {
+	// The session ID of the device which registered the pusher, which is
+	// used to remove the pusher if the device is logged out.
+	SessionID         int64                       `json:"session_id,omitempty"`
+	PushKey           string                      `json:"pushkey"`
+	PushKeyTS         gomatrixserverlib.Timestamp `json:"pushkey_ts,omitempty"`
+	Kind              PusherKind                  `json:"kind"`
+	AppID             string                      `json:"app_id"`
+	AppDisplayName    string                      `json:"app_display_name"`
+	DeviceDisplayName string                      `json:"device_display_name"`
+	ProfileTag        string                      `json:"profile_tag"`
+	Language          string                      `json:"lang"`
+	Data              map[string]interface{}      `json:"data"`
+}
+
+// UserPusher is a pusher along with the localpart of the user who
+// registered it.
+type UserPusher struct {
+	Localpart string `json:"localpart"`
+	Pusher
+}
+
+// URL returns the push gateway URL of the pusher, if it has one.
+func (p *Pusher) URL() string {
+	url, _ := p.Data["url"].(string)
+	return url
+}
+
+// PusherKind is the kind of a pusher
+type PusherKind string
+
+const (
+	// HTTPKind pushers send notifications to a push gateway over HTTP
+	HTTPKind PusherKind = "http"
+	// EmailKind pushers send emails about unread notifications to one of
+	// the user's email addresses, which is the pushkey
+	EmailKind PusherKind = "email"
+	// WebPushKind pushers send notifications straight to the push service
+	// of a browser, whose subscription is in the pusher data
+	WebPushKind PusherKind = "webpush"
+)
+
+// EmailPusherAppID is the app ID that email pushers must use.
+const EmailPusherAppID = "m.email"
+
+// RegistrationToken is a token which allows one or more people to register
+// when registration requires a token (MSC3231).
+type RegistrationToken struct {
+	Token string `json:"token"`
+	// UsesAllowed is the number of registrations that the token can be used
+	// for, or nil if the number of uses is unlimited.
+	UsesAllowed *int32 `json:"uses_allowed"`
+	// Completed is the number of registrations that have used the token.
+	Completed int32 `json:"completed"`
+	// ExpiryTime is when the token stops being valid, or nil if it never
+	// expires.
+	ExpiryTime *gomatrixserverlib.Timestamp `json:"expiry_time"`
+}
+
+// Valid returns true if the token can still be used to register at the
+// given time.
+func (t *RegistrationToken) Valid(now gomatrixserverlib.Timestamp) bool {
+	if t.UsesAllowed != nil && t.Completed >= *t.UsesAllowed {
+		return false
+	}
+	return t.ExpiryTime == nil || now < *t.ExpiryTime
+}
+
 // OpenIDToken represents an OpenID token
 type OpenIDToken struct {
 	Token       string
@@ -390,6 +805,16 @@ func (e *ErrorForbidden) Error() string {
 	return "Forbidden: " + e.Message
 }
 
+// ErrorInvalidPusher is an error indicating that a pusher can't be set up, as
+// its data isn't valid or isn't allowed by the config.
+type ErrorInvalidPusher struct {
+	Message string
+}
+
+func (e *ErrorInvalidPusher) Error() string {
+	return "Invalid pusher: " + e.Message
+}
+
 // ErrorConflict is an error indicating that there was a conflict which resulted in the request being aborted.
 type ErrorConflict struct {
 	Message string
@@ -415,4 +840,7 @@ const (
 	AccountTypeUser AccountType = 1
 	// AccountTypeGuest indicates this is a guest account
 	AccountTypeGuest AccountType = 2
+	// AccountTypeAdmin indicates this is an admin account, which is
+	// allowed to use the Dendrite admin APIs
+	AccountTypeAdmin AccountType = 3
 )
@@ -54,6 +54,21 @@ func (t *UserInternalAPITrace) PerformDeviceDeletion(ctx context.Context, req *P
 	util.GetLogger(ctx).Infof("PerformDeviceDeletion req=%+v res=%+v", js(req), js(res))
 	return err
 }
+func (t *UserInternalAPITrace) PerformDeviceDehydration(ctx context.Context, req *PerformDeviceDehydrationRequest, res *PerformDeviceDehydrationResponse) error {
+	err := t.Impl.PerformDeviceDehydration(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformDeviceDehydration req=%+v res=%+v", js(req), js(res))
+	return err
+}
+func (t *UserInternalAPITrace) PerformDeviceRehydration(ctx context.Context, req *PerformDeviceRehydrationRequest, res *PerformDeviceRehydrationResponse) error {
+	err := t.Impl.PerformDeviceRehydration(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformDeviceRehydration req=%+v res=%+v", js(req), js(res))
+	return err
+}
+func (t *UserInternalAPITrace) PerformTokenRefresh(ctx context.Context, req *PerformTokenRefreshRequest, res *PerformTokenRefreshResponse) error {
+	err := t.Impl.PerformTokenRefresh(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformTokenRefresh req=%+v res=%+v", js(req), js(res))
+	return err
+}
 func (t *UserInternalAPITrace) PerformLastSeenUpdate(ctx context.Context, req *PerformLastSeenUpdateRequest, res *PerformLastSeenUpdateResponse) error {
 	err := t.Impl.PerformLastSeenUpdate(ctx, req, res)
 	util.GetLogger(ctx).Infof("PerformLastSeenUpdate req=%+v res=%+v", js(req), js(res))
@@ -98,6 +113,11 @@ func (t *UserInternalAPITrace) QueryDevices(ctx context.Context, req *QueryDevic
 	util.GetLogger(ctx).Infof("QueryDevices req=%+v res=%+v", js(req), js(res))
 	return err
 }
+func (t *UserInternalAPITrace) QueryDehydratedDevice(ctx context.Context, req *QueryDehydratedDeviceRequest, res *QueryDehydratedDeviceResponse) error {
+	err := t.Impl.QueryDehydratedDevice(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryDehydratedDevice req=%+v res=%+v", js(req), js(res))
+	return err
+}
 func (t *UserInternalAPITrace) QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error {
 	err := t.Impl.QueryAccountData(ctx, req, res)
 	util.GetLogger(ctx).Infof("QueryAccountData req=%+v res=%+v", js(req), js(res))
@@ -113,11 +133,83 @@ func (t *UserInternalAPITrace) QuerySearchProfiles(ctx context.Context, req *Que
 	util.GetLogger(ctx).Infof("QuerySearchProfiles req=%+v res=%+v", js(req), js(res))
 	return err
 }
+func (t *UserInternalAPITrace) QueryDeviceConnections(ctx context.Context, req *QueryDeviceConnectionsRequest, res *QueryDeviceConnectionsResponse) error {
+	err := t.Impl.QueryDeviceConnections(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryDeviceConnections req=%+v res=%+v", js(req), js(res))
+	return err
+}
+func (t *UserInternalAPITrace) QuerySearchUserDirectory(ctx context.Context, req *QuerySearchUserDirectoryRequest, res *QuerySearchUserDirectoryResponse) error {
+	err := t.Impl.QuerySearchUserDirectory(ctx, req, res)
+	util.GetLogger(ctx).Infof("QuerySearchUserDirectory req=%+v res=%+v", js(req), js(res))
+	return err
+}
 func (t *UserInternalAPITrace) QueryOpenIDToken(ctx context.Context, req *QueryOpenIDTokenRequest, res *QueryOpenIDTokenResponse) error {
 	err := t.Impl.QueryOpenIDToken(ctx, req, res)
 	util.GetLogger(ctx).Infof("QueryOpenIDToken req=%+v res=%+v", js(req), js(res))
 	return err
 }
+func (t *UserInternalAPITrace) QueryAccountByLocalpart(ctx context.Context, req *QueryAccountByLocalpartRequest, res *QueryAccountByLocalpartResponse) error {
+	err := t.Impl.QueryAccountByLocalpart(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryAccountByLocalpart req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *PerformPusherSetResponse) error {
+	err := t.Impl.PerformPusherSet(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformPusherSet req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) PerformPusherDeletion(ctx context.Context, req *PerformPusherDeletionRequest, res *PerformPusherDeletionResponse) error {
+	err := t.Impl.PerformPusherDeletion(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformPusherDeletion req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error {
+	err := t.Impl.QueryPushers(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryPushers req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) QueryAllPushers(ctx context.Context, req *QueryAllPushersRequest, res *QueryAllPushersResponse) error {
+	err := t.Impl.QueryAllPushers(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryAllPushers req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) PerformPushersDeletion(ctx context.Context, req *PerformPushersDeletionRequest, res *PerformPushersDeletionResponse) error {
+	err := t.Impl.PerformPushersDeletion(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformPushersDeletion req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) QueryMonthlyActiveUsers(ctx context.Context, req *QueryMonthlyActiveUsersRequest, res *QueryMonthlyActiveUsersResponse) error {
+	err := t.Impl.QueryMonthlyActiveUsers(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryMonthlyActiveUsers req=%+v res=%+v", js(req), js(res))
+	return err
+}
+func (t *UserInternalAPITrace) PerformLoginAttempt(ctx context.Context, req *PerformLoginAttemptRequest, res *PerformLoginAttemptResponse) error {
+	err := t.Impl.PerformLoginAttempt(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformLoginAttempt req=%+v res=%+v", js(req), js(res))
+	return err
+}
+func (t *UserInternalAPITrace) PerformLoginResult(ctx context.Context, req *PerformLoginResultRequest, res *PerformLoginResultResponse) error {
+	err := t.Impl.PerformLoginResult(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformLoginResult req=%+v res=%+v", js(req), js(res))
+	return err
+}
+func (t *UserInternalAPITrace) PerformAccountRenewal(ctx context.Context, req *PerformAccountRenewalRequest, res *PerformAccountRenewalResponse) error {
+	err := t.Impl.PerformAccountRenewal(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformAccountRenewal req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) QueryNotifications(ctx context.Context, req *QueryNotificationsRequest, res *QueryNotificationsResponse) error {
+	err := t.Impl.QueryNotifications(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryNotifications req=%+v res=%+v", js(req), js(res))
+	return err
+}
 
 func js(thing interface{}) string {
 	b, err := json.Marshal(thing)
@@ -0,0 +1,86 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputClientDataConsumer consumes the account data changes that originated
+// in the client API server, and invalidates the cached push rules of users
+// whose push rules have changed.
+type OutputClientDataConsumer struct {
+	ctx        context.Context
+	jetstream  nats.JetStreamContext
+	durable    string
+	topic      string
+	pushRules  *PushRulesCache
+	serverName gomatrixserverlib.ServerName
+}
+
+// NewOutputClientDataConsumer creates a new OutputClientDataConsumer. Call
+// Start() to begin consuming from the client API server.
+func NewOutputClientDataConsumer(
+	process *process.ProcessContext,
+	cfg *config.UserAPI,
+	js nats.JetStreamContext,
+	pushRules *PushRulesCache,
+) *OutputClientDataConsumer {
+	return &OutputClientDataConsumer{
+		ctx:        process.Context(),
+		jetstream:  js,
+		topic:      cfg.Matrix.JetStream.TopicFor(jetstream.OutputClientData),
+		durable:    cfg.Matrix.JetStream.Durable("UserAPIClientAPIConsumer"),
+		pushRules:  pushRules,
+		serverName: cfg.Matrix.ServerName,
+	}
+}
+
+// Start consuming from the client API server
+func (s *OutputClientDataConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+func (s *OutputClientDataConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	var output eventutil.AccountData
+	if err := json.Unmarshal(msg.Data, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server output log: message parse failure")
+		return true
+	}
+	if output.RoomID != "" || output.Type != pushRulesAccountDataType {
+		return true
+	}
+	userID := msg.Header.Get(jetstream.UserID)
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != s.serverName {
+		return true
+	}
+	log.WithField("user_id", userID).Debug("Push rules changed, invalidating the cached rules")
+	s.pushRules.Invalidate(localpart)
+	return true
+}
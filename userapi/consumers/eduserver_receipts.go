@@ -0,0 +1,104 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	eduapi "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/producers"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputReceiptEventConsumer consumes read receipts that originated in the
+// EDU server and marks the notifications that they cover as read.
+type OutputReceiptEventConsumer struct {
+	ctx          context.Context
+	jetstream    nats.JetStreamContext
+	durable      string
+	topic        string
+	db           accounts.Database
+	syncProducer *producers.SyncAPI
+	serverName   gomatrixserverlib.ServerName
+}
+
+// NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputReceiptEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.UserAPI,
+	js nats.JetStreamContext,
+	store accounts.Database,
+	syncProducer *producers.SyncAPI,
+) *OutputReceiptEventConsumer {
+	return &OutputReceiptEventConsumer{
+		ctx:          process.Context(),
+		jetstream:    js,
+		topic:        cfg.Matrix.JetStream.TopicFor(jetstream.OutputReceiptEvent),
+		durable:      cfg.Matrix.JetStream.Durable("UserAPIEDUServerReceiptConsumer"),
+		db:           store,
+		syncProducer: syncProducer,
+		serverName:   cfg.Matrix.ServerName,
+	}
+}
+
+// Start consuming from EDU api
+func (s *OutputReceiptEventConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	var output eduapi.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Data, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return true
+	}
+	if output.Type != "m.read" {
+		return true
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('@', output.UserID)
+	if err != nil || domain != s.serverName {
+		return true
+	}
+
+	logger := log.WithFields(log.Fields{
+		"user_id":  output.UserID,
+		"room_id":  output.RoomID,
+		"event_id": output.EventID,
+	})
+	updated, err := s.db.SetNotificationsRead(s.ctx, localpart, output.RoomID, output.EventID, output.Timestamp)
+	if err != nil {
+		logger.WithError(err).Error("userapi EDU consumer: failed to mark notifications as read")
+		return true
+	}
+	if !updated {
+		return true
+	}
+	if err = s.syncProducer.SendNotificationData(s.ctx, localpart, output.RoomID); err != nil {
+		logger.WithError(err).Error("userapi EDU consumer: failed to send notification data")
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+// pushRulesAccountDataType is the global account data type that the push
+// rules are stored in.
+const pushRulesAccountDataType = "m.push_rules"
+
+// PushRulesCache keeps the push rules of the users who were recently the
+// recipients of events in memory, so that the rules of every member of a
+// large room aren't loaded from the database for every event. Entries are
+// invalidated by the OutputClientDataConsumer when the rules change.
+//
+// The cached rule sets are shared, so they must not be modified.
+type PushRulesCache struct {
+	db    accounts.Database
+	cache *lru.Cache // localpart -> *pushrules.AccountRuleSets
+
+	// generation is incremented by every invalidation, so that rules which
+	// were loaded before an invalidation aren't added to the cache after
+	// it, which would keep the old rules forever.
+	generation      uint64
+	generationMutex sync.Mutex
+}
+
+// NewPushRulesCache returns a cache which holds the push rules of up to size
+// users.
+func NewPushRulesCache(db accounts.Database, size int) (*PushRulesCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &PushRulesCache{
+		db:    db,
+		cache: cache,
+	}, nil
+}
+
+// Get returns the user's push rules from their account data, or the default
+// push rules if they have none.
+func (c *PushRulesCache) Get(ctx context.Context, localpart string) (*pushrules.AccountRuleSets, error) {
+	if ruleSets, ok := c.cache.Get(localpart); ok {
+		return ruleSets.(*pushrules.AccountRuleSets), nil
+	}
+
+	c.generationMutex.Lock()
+	generation := c.generation
+	c.generationMutex.Unlock()
+
+	ruleSets, err := c.load(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+
+	c.generationMutex.Lock()
+	defer c.generationMutex.Unlock()
+	if c.generation == generation {
+		c.cache.Add(localpart, ruleSets)
+	}
+	return ruleSets, nil
+}
+
+// Invalidate removes the user's push rules from the cache, so that they are
+// loaded from the database again the next time that they are needed.
+func (c *PushRulesCache) Invalidate(localpart string) {
+	c.generationMutex.Lock()
+	defer c.generationMutex.Unlock()
+	c.generation++
+	c.cache.Remove(localpart)
+}
+
+func (c *PushRulesCache) load(ctx context.Context, localpart string) (*pushrules.AccountRuleSets, error) {
+	data, err := c.db.GetAccountDataByType(ctx, localpart, "", pushRulesAccountDataType)
+	if err != nil {
+		return nil, fmt.Errorf("c.db.GetAccountDataByType: %w", err)
+	}
+	if data == nil {
+		return c.db.DefaultPushRules(localpart), nil
+	}
+	var ruleSets pushrules.AccountRuleSets
+	if err = json.Unmarshal(data, &ruleSets); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	ruleSets.AddMissingDefaults(c.db.DefaultPushRules(localpart))
+	return &ruleSets, nil
+}
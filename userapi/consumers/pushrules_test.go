@@ -0,0 +1,63 @@
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func mustSavePushRules(t *testing.T, db accounts.Database, localpart string, ruleSets *pushrules.AccountRuleSets) {
+	t.Helper()
+	data, err := json.Marshal(ruleSets)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	if err = db.SaveAccountData(context.Background(), localpart, "", pushRulesAccountDataType, data); err != nil {
+		t.Fatalf("SaveAccountData failed: %v", err)
+	}
+}
+
+func TestPushRulesCache(t *testing.T) {
+	ctx := context.Background()
+	db, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "example.com", &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	cache, err := NewPushRulesCache(db, 10)
+	if err != nil {
+		t.Fatalf("NewPushRulesCache failed: %v", err)
+	}
+
+	// Users without stored rules get the default rules.
+	got, err := cache.Get(ctx, "alice")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if len(got.Global.Override) == 0 || got.Global.Override[0].RuleID != pushrules.MRuleMaster {
+		t.Errorf("Get: got %+v, want the default rules", got.Global)
+	}
+
+	// The rules are cached until they are invalidated.
+	mustSavePushRules(t, db, "alice", &pushrules.AccountRuleSets{
+		Global: pushrules.RuleSet{Room: []*pushrules.Rule{{RuleID: "!room:example.com", Enabled: true}}},
+	})
+	if got2, err := cache.Get(ctx, "alice"); err != nil || got2 != got {
+		t.Errorf("Get: got %p (err %v), want the cached rules %p", got2, err, got)
+	}
+	cache.Invalidate("alice")
+	got, err = cache.Get(ctx, "alice")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if len(got.Global.Room) != 1 || got.Global.Room[0].RuleID != "!room:example.com" {
+		t.Errorf("Get: got %+v, want the stored rules", got.Global)
+	}
+}
@@ -0,0 +1,550 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/email"
+	"github.com/matrix-org/dendrite/userapi/producers"
+	"github.com/matrix-org/dendrite/userapi/pushqueue"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// OutputRoomEventConsumer consumes events that originated in the room server
+// and sends push notifications for them to the users' pushers.
+type OutputRoomEventConsumer struct {
+	ctx          context.Context
+	cfg          *config.UserAPI
+	rsAPI        rsapi.RoomserverInternalAPI
+	jetstream    nats.JetStreamContext
+	durable      string
+	topic        string
+	db           accounts.Database
+	pushQueue    *pushqueue.Queue
+	pushRules    *PushRulesCache
+	syncProducer *producers.SyncAPI
+	emailer      *email.Notifier
+	serverName   gomatrixserverlib.ServerName
+}
+
+// NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
+func NewOutputRoomEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.UserAPI,
+	js nats.JetStreamContext,
+	store accounts.Database,
+	pushQueue *pushqueue.Queue,
+	pushRules *PushRulesCache,
+	rsAPI rsapi.RoomserverInternalAPI,
+	syncProducer *producers.SyncAPI,
+	emailer *email.Notifier,
+) *OutputRoomEventConsumer {
+	return &OutputRoomEventConsumer{
+		ctx:          process.Context(),
+		cfg:          cfg,
+		jetstream:    js,
+		topic:        cfg.Matrix.JetStream.TopicFor(jetstream.OutputRoomEvent),
+		durable:      cfg.Matrix.JetStream.Durable("UserAPIRoomServerConsumer"),
+		db:           store,
+		pushQueue:    pushQueue,
+		pushRules:    pushRules,
+		rsAPI:        rsAPI,
+		syncProducer: syncProducer,
+		emailer:      emailer,
+		serverName:   cfg.Matrix.ServerName,
+	}
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+// onMessage is called when the user API receives a new event from the room
+// server output log.
+func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	var output rsapi.OutputEvent
+	if err := json.Unmarshal(msg.Data, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return true
+	}
+	if output.Type != rsapi.OutputTypeNewRoomEvent || output.NewRoomEvent.RewritesState {
+		return true
+	}
+
+	event := output.NewRoomEvent.Event
+	if err := s.processMessage(s.ctx, event); err != nil {
+		log.WithFields(log.Fields{
+			"event_id": event.EventID(),
+			"room_id":  event.RoomID(),
+		}).WithError(err).Errorf("userapi consumer: process room event failure")
+	}
+	return true
+}
+
+// processMessage sends a notification for the event to the pushers of each
+// of the local users in the room whose push rules say that they should be
+// notified about it. Invites are evaluated for the invitee too, who isn't
+// joined yet.
+func (s *OutputRoomEventConsumer) processMessage(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error {
+	var res rsapi.QueryMembershipsForRoomResponse
+	if err := s.rsAPI.QueryMembershipsForRoom(ctx, &rsapi.QueryMembershipsForRoomRequest{
+		RoomID:     event.RoomID(),
+		JoinedOnly: true,
+		LocalOnly:  true,
+	}, &res); err != nil {
+		return fmt.Errorf("s.rsAPI.QueryMembershipsForRoom: %w", err)
+	}
+	room := &roomState{
+		ctx:        ctx,
+		rsAPI:      s.rsAPI,
+		roomID:     event.RoomID(),
+		joinEvents: res.JoinEvents,
+	}
+
+	var recipients []string
+	for _, ev := range res.JoinEvents {
+		if ev.StateKey == nil || *ev.StateKey == event.Sender() {
+			continue
+		}
+		recipients = append(recipients, *ev.StateKey)
+	}
+	if event.Type() == gomatrixserverlib.MRoomMember && event.StateKey() != nil && *event.StateKey() != event.Sender() {
+		if membership, err := event.Membership(); err == nil && membership == gomatrixserverlib.Invite {
+			recipients = append(recipients, *event.StateKey())
+		}
+	}
+
+	var notification *pushgateway.Notification
+	for _, userID := range recipients {
+		localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != s.serverName {
+			continue
+		}
+
+		ruleSets, err := s.pushRules.Get(ctx, localpart)
+		if err != nil {
+			return fmt.Errorf("s.pushRules.Get: %w", err)
+		}
+		actions, err := s.evaluatePushRules(event.Event, userID, room, &ruleSets.Global)
+		if err != nil {
+			return fmt.Errorf("s.evaluatePushRules: %w", err)
+		}
+		kind, tweaks, err := pushrules.ActionsToTweaks(actions)
+		if err != nil {
+			return fmt.Errorf("pushrules.ActionsToTweaks: %w", err)
+		}
+		notify := kind == pushrules.NotifyAction || kind == pushrules.CoalesceAction
+		if !notify && len(ruleSets.Device) == 0 {
+			continue
+		}
+
+		// The notification is stored for /notifications whether or not
+		// the user has any pushers. This follows the global rules, as it
+		// isn't for any particular device.
+		ts := gomatrixserverlib.AsTimestamp(time.Now())
+		if notify {
+			if err = s.db.InsertNotification(ctx, localpart, threadID(event.Event), isHighlight(tweaks), &api.Notification{
+				Actions: actions,
+				Event:   gomatrixserverlib.ToClientEvent(event.Event, gomatrixserverlib.FormatAll),
+				RoomID:  event.RoomID(),
+				TS:      ts,
+			}); err != nil {
+				return fmt.Errorf("s.db.InsertNotification: %w", err)
+			}
+			if err = s.syncProducer.SendNotificationData(ctx, localpart, event.RoomID()); err != nil {
+				return fmt.Errorf("s.syncProducer.SendNotificationData: %w", err)
+			}
+		}
+
+		pushers, err := s.db.GetPushers(ctx, localpart)
+		if err != nil {
+			return fmt.Errorf("s.db.GetPushers: %w", err)
+		}
+		// Pushers with a profile tag that has device rules get the
+		// notifications that those rules ask for, the others follow the
+		// global rules.
+		for profileTag, pushers := range pushersByProfileTag(pushers) {
+			profileNotify, profileTweaks := notify, tweaks
+			if ruleSet := ruleSets.ProfileRuleSet(profileTag); ruleSet != nil {
+				profileActions, err := s.evaluatePushRules(event.Event, userID, room, ruleSet)
+				if err != nil {
+					return fmt.Errorf("s.evaluatePushRules: %w", err)
+				}
+				profileKind, t, err := pushrules.ActionsToTweaks(profileActions)
+				if err != nil {
+					return fmt.Errorf("pushrules.ActionsToTweaks: %w", err)
+				}
+				profileNotify = profileKind == pushrules.NotifyAction || profileKind == pushrules.CoalesceAction
+				profileTweaks = t
+			}
+			if !profileNotify {
+				continue
+			}
+			if err = s.push(ctx, event, userID, localpart, ts, pushers, profileTweaks, &notification); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// push sends the notification for the event to the given pushers of the
+// user. The parts of the notification which are the same for every user are
+// only looked up once, and kept in notification.
+func (s *OutputRoomEventConsumer) push(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent, userID, localpart string, ts gomatrixserverlib.Timestamp,
+	pushers []api.Pusher, tweaks map[string]interface{}, notification **pushgateway.Notification,
+) error {
+	var err error
+	for _, pusher := range pushers {
+		if pusher.Kind == api.EmailKind {
+			s.emailer.Schedule(localpart, pusher.PushKey, ts)
+		}
+	}
+	byKind := map[api.PusherKind]map[string][]*pushgateway.Device{
+		api.HTTPKind:    devicesByURL(pushers),
+		api.WebPushKind: devicesByEndpoint(pushers),
+	}
+	if len(byKind[api.HTTPKind]) == 0 && len(byKind[api.WebPushKind]) == 0 {
+		return nil
+	}
+	if *notification == nil {
+		if *notification, err = s.notification(ctx, event); err != nil {
+			return err
+		}
+	}
+	// Each user gets their own requests, as the counts, the tweaks and
+	// whether they are the target of the event differ between users.
+	unread, err := s.db.GetNotificationCount(ctx, localpart)
+	if err != nil {
+		return fmt.Errorf("s.db.GetNotificationCount: %w", err)
+	}
+	counts := &pushgateway.Counts{Unread: int(unread)}
+	deviceTweaks := pushTweaks(tweaks)
+	for kind, byURL := range byKind {
+		for url, devices := range byURL {
+			for _, device := range devices {
+				device.Tweaks = deviceTweaks
+			}
+			for format, devices := range devicesByFormat(devices) {
+				n := (*notification).Format(format)
+				n.Counts = counts
+				n.Devices = devices
+				if format != pushgateway.EventIDOnlyFormat {
+					n.UserIsTarget = event.StateKey() != nil && *event.StateKey() == userID
+				}
+				if err = s.pushQueue.Send(ctx, localpart, kind, url, &pushgateway.NotifyRequest{Notification: n}); err != nil {
+					return fmt.Errorf("s.pushQueue.Send: %w", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// evaluatePushRules returns the actions of the first rule of the rule set
+// which matches the event, or nil if none of them match.
+func (s *OutputRoomEventConsumer) evaluatePushRules(event *gomatrixserverlib.Event, userID string, room *roomState, ruleSet *pushrules.RuleSet) ([]*pushrules.Action, error) {
+	ec := &ruleSetEvalContext{
+		userID: userID,
+		room:   room,
+	}
+	eval := pushrules.NewRuleSetEvaluator(ec, ruleSet)
+	rule, err := eval.MatchEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, nil
+	}
+	log.WithFields(log.Fields{
+		"event_id": event.EventID(),
+		"user_id":  userID,
+		"rule_id":  rule.RuleID,
+	}).Tracef("Matched a push rule")
+	return rule.Actions, nil
+}
+
+// threadID returns the event ID of the root of the thread which the event
+// is in, or "" if it isn't in a thread. Threads are still commonly sent with
+// the unstable relation type of MSC3440.
+func threadID(event *gomatrixserverlib.Event) string {
+	relation := gjson.GetBytes(event.Content(), `m\.relates_to`)
+	switch relation.Get("rel_type").Str {
+	case "m.thread", "io.element.thread":
+		return relation.Get("event_id").Str
+	default:
+		return ""
+	}
+}
+
+// isHighlight returns whether the tweaks ask for the event to be
+// highlighted. A highlight tweak without a value means true.
+func isHighlight(tweaks map[string]interface{}) bool {
+	v, ok := tweaks[string(pushrules.HighlightTweak)]
+	if !ok {
+		return false
+	}
+	b, isBool := v.(bool)
+	return v == nil || (isBool && b)
+}
+
+// pushTweaks returns the tweaks to send to the push gateway. The highlight
+// tweak is sent as a boolean, and left out when it is false, since a
+// highlight tweak without a value means true.
+func pushTweaks(tweaks map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(tweaks))
+	for k, v := range tweaks {
+		if k != string(pushrules.HighlightTweak) {
+			res[k] = v
+		}
+	}
+	if isHighlight(tweaks) {
+		res[string(pushrules.HighlightTweak)] = true
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// ruleSetEvalContext gives the push rule evaluator the information about
+// the user and room that some conditions need.
+type ruleSetEvalContext struct {
+	userID string
+	room   *roomState
+}
+
+func (rse *ruleSetEvalContext) UserDisplayName() (string, error) {
+	return rse.room.displayName(rse.userID), nil
+}
+
+func (rse *ruleSetEvalContext) RoomMemberCount() (int, error) {
+	return rse.room.memberCount()
+}
+
+func (rse *ruleSetEvalContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	powerLevels, err := rse.room.powerLevels()
+	if err != nil {
+		return false, err
+	}
+	return powerLevels.UserLevel(userID) >= powerLevels.NotificationLevel(levelKey), nil
+}
+
+// roomState holds the state of the room of an event which the push rules of
+// every recipient may need. The state is only looked up when a rule needs
+// it, and then once for all of the recipients.
+type roomState struct {
+	ctx    context.Context
+	rsAPI  rsapi.RoomserverInternalAPI
+	roomID string
+
+	joinEvents        []gomatrixserverlib.ClientEvent // of the local users only
+	displayNames      map[string]string               // user ID -> display name, from joinEvents
+	joinedCount       *int
+	powerLevelContent *gomatrixserverlib.PowerLevelContent
+}
+
+// memberCount returns the number of users, local or not, who are joined to
+// the room.
+func (r *roomState) memberCount() (int, error) {
+	if r.joinedCount != nil {
+		return *r.joinedCount, nil
+	}
+	var res rsapi.QueryJoinedMemberCountResponse
+	if err := r.rsAPI.QueryJoinedMemberCount(r.ctx, &rsapi.QueryJoinedMemberCountRequest{
+		RoomID: r.roomID,
+	}, &res); err != nil {
+		return 0, fmt.Errorf("r.rsAPI.QueryJoinedMemberCount: %w", err)
+	}
+	r.joinedCount = &res.Count
+	return res.Count, nil
+}
+
+// displayName returns the display name that the user has in the room, or ""
+// if they aren't joined or don't have one.
+func (r *roomState) displayName(userID string) string {
+	if r.displayNames == nil {
+		r.displayNames = make(map[string]string, len(r.joinEvents))
+		for _, ev := range r.joinEvents {
+			var content struct {
+				DisplayName string `json:"displayname"`
+			}
+			if ev.StateKey != nil && json.Unmarshal(ev.Content, &content) == nil {
+				r.displayNames[*ev.StateKey] = content.DisplayName
+			}
+		}
+	}
+	return r.displayNames[userID]
+}
+
+// powerLevels returns the current power levels of the room. A room without
+// a power levels event has the default power levels.
+func (r *roomState) powerLevels() (*gomatrixserverlib.PowerLevelContent, error) {
+	if r.powerLevelContent != nil {
+		return r.powerLevelContent, nil
+	}
+	tuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}
+	var res rsapi.QueryCurrentStateResponse
+	if err := r.rsAPI.QueryCurrentState(r.ctx, &rsapi.QueryCurrentStateRequest{
+		RoomID:      r.roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{tuple},
+	}, &res); err != nil {
+		return nil, fmt.Errorf("r.rsAPI.QueryCurrentState: %w", err)
+	}
+	var content gomatrixserverlib.PowerLevelContent
+	if ev, ok := res.StateEvents[tuple]; ok {
+		var err error
+		if content, err = gomatrixserverlib.NewPowerLevelContentFromEvent(ev.Event); err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromEvent: %w", err)
+		}
+	} else {
+		content.Defaults()
+	}
+	r.powerLevelContent = &content
+	return r.powerLevelContent, nil
+}
+
+// notification builds the parts of the notification which are the same for
+// every pusher.
+func (s *OutputRoomEventConsumer) notification(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) (*pushgateway.Notification, error) {
+	nameTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomName, StateKey: ""}
+	aliasTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}
+	senderTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: event.Sender()}
+	var res rsapi.QueryCurrentStateResponse
+	if err := s.rsAPI.QueryCurrentState(ctx, &rsapi.QueryCurrentStateRequest{
+		RoomID:      event.RoomID(),
+		StateTuples: []gomatrixserverlib.StateKeyTuple{nameTuple, aliasTuple, senderTuple},
+	}, &res); err != nil {
+		return nil, fmt.Errorf("s.rsAPI.QueryCurrentState: %w", err)
+	}
+
+	n := &pushgateway.Notification{
+		Content: event.Content(),
+		EventID: event.EventID(),
+		Prio:    pushgateway.HighPrio,
+		RoomID:  event.RoomID(),
+		Sender:  event.Sender(),
+		Type:    event.Type(),
+	}
+	var content struct {
+		Name        string `json:"name"`
+		Alias       string `json:"alias"`
+		DisplayName string `json:"displayname"`
+	}
+	if ev, ok := res.StateEvents[nameTuple]; ok && json.Unmarshal(ev.Content(), &content) == nil {
+		n.RoomName = content.Name
+	}
+	if ev, ok := res.StateEvents[aliasTuple]; ok && json.Unmarshal(ev.Content(), &content) == nil {
+		n.RoomAlias = content.Alias
+	}
+	if ev, ok := res.StateEvents[senderTuple]; ok && json.Unmarshal(ev.Content(), &content) == nil {
+		n.SenderDisplayName = content.DisplayName
+	}
+	return n, nil
+}
+
+// pushersByProfileTag groups the pushers by their profile tag, which picks
+// the device rules that apply to them.
+func pushersByProfileTag(pushers []api.Pusher) map[string][]api.Pusher {
+	byProfileTag := map[string][]api.Pusher{}
+	for _, pusher := range pushers {
+		byProfileTag[pusher.ProfileTag] = append(byProfileTag[pusher.ProfileTag], pusher)
+	}
+	return byProfileTag
+}
+
+// devicesByURL groups the HTTP pushers by the URL of their push gateway, so
+// that each gateway receives one request for all of its devices.
+func devicesByURL(pushers []api.Pusher) map[string][]*pushgateway.Device {
+	devices := map[string][]*pushgateway.Device{}
+	for _, pusher := range pushers {
+		if pusher.Kind != api.HTTPKind {
+			continue
+		}
+		url, ok := pusher.Data["url"].(string)
+		if !ok || url == "" {
+			continue
+		}
+		// The URL is only for the homeserver, the gateway gets the rest.
+		data := make(map[string]interface{}, len(pusher.Data))
+		for k, v := range pusher.Data {
+			if k != "url" {
+				data[k] = v
+			}
+		}
+		devices[url] = append(devices[url], &pushgateway.Device{
+			AppID:     pusher.AppID,
+			Data:      data,
+			PushKey:   pusher.PushKey,
+			PushKeyTS: pusher.PushKeyTS,
+		})
+	}
+	return devices
+}
+
+// devicesByEndpoint groups the WebPush pushers by the endpoint of their
+// subscription. The data is kept whole, as it is only used by the homeserver
+// to encrypt the notifications.
+func devicesByEndpoint(pushers []api.Pusher) map[string][]*pushgateway.Device {
+	devices := map[string][]*pushgateway.Device{}
+	for _, pusher := range pushers {
+		if pusher.Kind != api.WebPushKind {
+			continue
+		}
+		endpoint, ok := pusher.Data["endpoint"].(string)
+		if !ok || endpoint == "" {
+			continue
+		}
+		devices[endpoint] = append(devices[endpoint], &pushgateway.Device{
+			AppID:     pusher.AppID,
+			Data:      pusher.Data,
+			PushKey:   pusher.PushKey,
+			PushKeyTS: pusher.PushKeyTS,
+		})
+	}
+	return devices
+}
+
+// devicesByFormat groups the devices by the format of notification that
+// they asked for in their pusher data.
+func devicesByFormat(devices []*pushgateway.Device) map[string][]*pushgateway.Device {
+	byFormat := map[string][]*pushgateway.Device{}
+	for _, device := range devices {
+		format, _ := device.Data["format"].(string)
+		byFormat[format] = append(byFormat[format], device)
+	}
+	return byFormat
+}
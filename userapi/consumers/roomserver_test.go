@@ -0,0 +1,291 @@
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestDevicesByURL(t *testing.T) {
+	pushers := []api.Pusher{
+		{Kind: api.HTTPKind, AppID: "app1", PushKey: "key1", Data: map[string]interface{}{"url": "https://a/_matrix/push/v1/notify", "format": "event_id_only"}},
+		{Kind: api.HTTPKind, AppID: "app2", PushKey: "key2", Data: map[string]interface{}{"url": "https://a/_matrix/push/v1/notify"}},
+		{Kind: api.HTTPKind, AppID: "app3", PushKey: "key3", Data: map[string]interface{}{"url": "https://b/_matrix/push/v1/notify"}},
+		{Kind: "email", AppID: "m.email", PushKey: "alice@example.com", Data: map[string]interface{}{}},
+		{Kind: api.HTTPKind, AppID: "app4", PushKey: "key4", Data: map[string]interface{}{}},
+	}
+	devices := devicesByURL(pushers)
+	if len(devices) != 2 {
+		t.Fatalf("got %d URLs want 2", len(devices))
+	}
+	a := devices["https://a/_matrix/push/v1/notify"]
+	if len(a) != 2 || a[0].PushKey != "key1" || a[1].PushKey != "key2" {
+		t.Fatalf("got unexpected devices for gateway a: %+v", a)
+	}
+	// The URL is only used by the homeserver and isn't sent to the gateway.
+	if want := map[string]interface{}{"format": "event_id_only"}; !reflect.DeepEqual(a[0].Data, want) {
+		t.Errorf("got data %+v want %+v", a[0].Data, want)
+	}
+	if b := devices["https://b/_matrix/push/v1/notify"]; len(b) != 1 || b[0].AppID != "app3" {
+		t.Fatalf("got unexpected devices for gateway b: %+v", b)
+	}
+}
+
+func TestIsHighlight(t *testing.T) {
+	tsts := []struct {
+		Name   string
+		Tweaks map[string]interface{}
+		Want   bool
+	}{
+		{"noTweaks", map[string]interface{}{}, false},
+		{"otherTweak", map[string]interface{}{"sound": "default"}, false},
+		{"highlightWithoutValue", map[string]interface{}{"highlight": nil}, true},
+		{"highlightTrue", map[string]interface{}{"highlight": true}, true},
+		{"highlightFalse", map[string]interface{}{"highlight": false}, false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if got := isHighlight(tst.Tweaks); got != tst.Want {
+				t.Errorf("isHighlight: got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestThreadID(t *testing.T) {
+	tsts := []struct {
+		Name    string
+		Content string
+		Want    string
+	}{
+		{"noRelation", `{"body":"hello"}`, ""},
+		{"thread", `{"m.relates_to":{"rel_type":"m.thread","event_id":"$root:example.com"}}`, "$root:example.com"},
+		{"unstableThread", `{"m.relates_to":{"rel_type":"io.element.thread","event_id":"$root:example.com"}}`, "$root:example.com"},
+		{"reply", `{"m.relates_to":{"m.in_reply_to":{"event_id":"$other:example.com"}}}`, ""},
+		{"annotation", `{"m.relates_to":{"rel_type":"m.annotation","event_id":"$other:example.com","key":"x"}}`, ""},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"event_id":"$ev:example.com","room_id":"!room:example.com","sender":"@alice:example.com","type":"m.room.message","content":`+tst.Content+`}`), false, gomatrixserverlib.RoomVersionV7)
+			if err != nil {
+				t.Fatalf("NewEventFromTrustedJSON failed: %v", err)
+			}
+			if got := threadID(ev); got != tst.Want {
+				t.Errorf("threadID: got %q, want %q", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestDevicesByFormat(t *testing.T) {
+	devices := devicesByURL([]api.Pusher{
+		{Kind: api.HTTPKind, AppID: "app1", PushKey: "key1", Data: map[string]interface{}{"url": "https://a/_matrix/push/v1/notify", "format": "event_id_only"}},
+		{Kind: api.HTTPKind, AppID: "app2", PushKey: "key2", Data: map[string]interface{}{"url": "https://a/_matrix/push/v1/notify"}},
+	})["https://a/_matrix/push/v1/notify"]
+	byFormat := devicesByFormat(devices)
+	if len(byFormat) != 2 {
+		t.Fatalf("got %d formats want 2", len(byFormat))
+	}
+	if d := byFormat[pushgateway.EventIDOnlyFormat]; len(d) != 1 || d[0].PushKey != "key1" {
+		t.Fatalf("got unexpected event_id_only devices: %+v", d)
+	}
+	if d := byFormat[""]; len(d) != 1 || d[0].PushKey != "key2" {
+		t.Fatalf("got unexpected devices without a format: %+v", d)
+	}
+
+	// Only the IDs, counts and priority of the event are sent in the
+	// event_id_only format.
+	n := &pushgateway.Notification{
+		Content:           []byte(`{"body":"secret"}`),
+		Counts:            &pushgateway.Counts{Unread: 1},
+		EventID:           "$event:example.com",
+		Prio:              pushgateway.HighPrio,
+		RoomID:            "!room:example.com",
+		RoomName:          "Secret room",
+		Sender:            "@bob:example.com",
+		SenderDisplayName: "Bob",
+		Type:              "m.room.message",
+	}
+	got, err := json.Marshal(n.Format(pushgateway.EventIDOnlyFormat))
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	if want := `{"counts":{"unread":1},"devices":null,"event_id":"$event:example.com","prio":"high","room_id":"!room:example.com"}`; string(got) != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+	if full := n.Format(""); !reflect.DeepEqual(&full, n) {
+		t.Errorf("got %+v want the full notification", full)
+	}
+
+	// Encrypted events are always sent in the event_id_only format.
+	n.Type = pushgateway.EncryptedEventType
+	n.Content = []byte(`{"algorithm":"m.megolm.v1.aes-sha2","ciphertext":"AwgAEn..."}`)
+	if got, err = json.Marshal(n.Format("")); err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	if want := `{"counts":{"unread":1},"devices":null,"event_id":"$event:example.com","prio":"high","room_id":"!room:example.com"}`; string(got) != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+}
+
+func TestPushTweaks(t *testing.T) {
+	tsts := []struct {
+		Name   string
+		Tweaks map[string]interface{}
+		Want   map[string]interface{}
+	}{
+		{"noTweaks", map[string]interface{}{}, nil},
+		{"highlightFalse", map[string]interface{}{"highlight": false}, nil},
+		{"highlightWithoutValue", map[string]interface{}{"highlight": nil}, map[string]interface{}{"highlight": true}},
+		{"soundAndHighlight", map[string]interface{}{"sound": "default", "highlight": true}, map[string]interface{}{"sound": "default", "highlight": true}},
+		{"sound", map[string]interface{}{"sound": "ring"}, map[string]interface{}{"sound": "ring"}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			if got := pushTweaks(tst.Tweaks); !reflect.DeepEqual(got, tst.Want) {
+				t.Errorf("pushTweaks: got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestDevicesByEndpoint(t *testing.T) {
+	data := map[string]interface{}{"endpoint": "https://push.example.com/abc", "auth": "secret", "p256dh": "key"}
+	pushers := []api.Pusher{
+		{Kind: api.WebPushKind, AppID: "web", PushKey: "key1", Data: data},
+		{Kind: api.HTTPKind, AppID: "app", PushKey: "key2", Data: map[string]interface{}{"url": "https://a/_matrix/push/v1/notify"}},
+		{Kind: api.WebPushKind, AppID: "web", PushKey: "key3", Data: map[string]interface{}{}},
+	}
+	devices := devicesByEndpoint(pushers)
+	if len(devices) != 1 {
+		t.Fatalf("got %d endpoints want 1", len(devices))
+	}
+	// The subscription is needed to encrypt the notification, so it is kept.
+	d := devices["https://push.example.com/abc"]
+	if len(d) != 1 || d[0].PushKey != "key1" || !reflect.DeepEqual(d[0].Data, data) {
+		t.Fatalf("got unexpected devices: %+v", d)
+	}
+}
+
+// fakeStateQuerier answers current state and member count queries with the
+// given state and count, and counts the queries.
+type fakeStateQuerier struct {
+	rsapi.RoomserverInternalAPI
+	state       map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent
+	memberCount int
+	queries     int
+}
+
+func (q *fakeStateQuerier) QueryJoinedMemberCount(ctx context.Context, req *rsapi.QueryJoinedMemberCountRequest, res *rsapi.QueryJoinedMemberCountResponse) error {
+	q.queries++
+	res.RoomExists = true
+	res.Count = q.memberCount
+	return nil
+}
+
+func (q *fakeStateQuerier) QueryCurrentState(ctx context.Context, req *rsapi.QueryCurrentStateRequest, res *rsapi.QueryCurrentStateResponse) error {
+	q.queries++
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, tuple := range req.StateTuples {
+		if ev, ok := q.state[tuple]; ok {
+			res.StateEvents[tuple] = ev
+		}
+	}
+	return nil
+}
+
+func TestRuleSetEvalContextHasPowerLevel(t *testing.T) {
+	powerLevels, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"event_id":"$pl:example.com","room_id":"!room:example.com","sender":"@alice:example.com","type":"m.room.power_levels","state_key":"","content":{"users":{"@alice:example.com":100,"@bob:example.com":50},"notifications":{"room":60}}}`), false, gomatrixserverlib.RoomVersionV7)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON failed: %v", err)
+	}
+	tuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}
+
+	tsts := []struct {
+		Name   string
+		State  map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent
+		UserID string
+		Want   bool
+	}{
+		{"enough", map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{tuple: powerLevels.Headered(gomatrixserverlib.RoomVersionV7)}, "@alice:example.com", true},
+		{"tooLow", map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{tuple: powerLevels.Headered(gomatrixserverlib.RoomVersionV7)}, "@bob:example.com", false},
+		{"defaultTooLow", nil, "@alice:example.com", false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			querier := &fakeStateQuerier{state: tst.State}
+			rse := &ruleSetEvalContext{
+				room: &roomState{ctx: context.Background(), rsAPI: querier, roomID: "!room:example.com"},
+			}
+			for i := 0; i < 2; i++ {
+				got, err := rse.HasPowerLevel(tst.UserID, "room")
+				if err != nil {
+					t.Fatalf("HasPowerLevel failed: %v", err)
+				}
+				if got != tst.Want {
+					t.Errorf("HasPowerLevel: got %v, want %v", got, tst.Want)
+				}
+			}
+			if querier.queries != 1 {
+				t.Errorf("got %d state queries, want 1", querier.queries)
+			}
+		})
+	}
+}
+
+func TestRuleSetEvalContextUserDisplayName(t *testing.T) {
+	alice, bob := "@alice:example.com", "@bob:example.com"
+	room := &roomState{
+		joinEvents: []gomatrixserverlib.ClientEvent{
+			{StateKey: &alice, Content: gomatrixserverlib.RawJSON(`{"membership":"join","displayname":"Alice in the room"}`)},
+			{StateKey: &bob, Content: gomatrixserverlib.RawJSON(`{"membership":"join"}`)},
+		},
+	}
+
+	tsts := []struct {
+		Name   string
+		UserID string
+		Want   string
+	}{
+		{"displayName", alice, "Alice in the room"},
+		{"noDisplayName", bob, ""},
+		{"notJoined", "@carol:example.com", ""},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			rse := &ruleSetEvalContext{userID: tst.UserID, room: room}
+			got, err := rse.UserDisplayName()
+			if err != nil {
+				t.Fatalf("UserDisplayName failed: %v", err)
+			}
+			if got != tst.Want {
+				t.Errorf("UserDisplayName: got %q, want %q", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestRuleSetEvalContextRoomMemberCount(t *testing.T) {
+	querier := &fakeStateQuerier{memberCount: 42}
+	rse := &ruleSetEvalContext{
+		room: &roomState{ctx: context.Background(), rsAPI: querier, roomID: "!room:example.com"},
+	}
+	for i := 0; i < 2; i++ {
+		got, err := rse.RoomMemberCount()
+		if err != nil {
+			t.Fatalf("RoomMemberCount failed: %v", err)
+		}
+		if got != 42 {
+			t.Errorf("RoomMemberCount: got %d, want 42", got)
+		}
+	}
+	if querier.queries != 1 {
+		t.Errorf("got %d member count queries, want 1", querier.queries)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputUserDirectoryConsumer consumes events that originated in the room
+// server and keeps track of the users who are joined to each room, and their
+// profiles in it, for the user directory.
+type OutputUserDirectoryConsumer struct {
+	ctx       context.Context
+	jetstream nats.JetStreamContext
+	durable   string
+	topic     string
+	db        accounts.Database
+}
+
+// NewOutputUserDirectoryConsumer creates a new OutputUserDirectoryConsumer.
+// Call Start() to begin consuming from room servers.
+func NewOutputUserDirectoryConsumer(
+	process *process.ProcessContext,
+	cfg *config.UserAPI,
+	js nats.JetStreamContext,
+	store accounts.Database,
+) *OutputUserDirectoryConsumer {
+	return &OutputUserDirectoryConsumer{
+		ctx:       process.Context(),
+		jetstream: js,
+		topic:     cfg.Matrix.JetStream.TopicFor(jetstream.OutputRoomEvent),
+		durable:   cfg.Matrix.JetStream.Durable("UserAPIUserDirectoryConsumer"),
+		db:        store,
+	}
+}
+
+// Start consuming from room servers
+func (s *OutputUserDirectoryConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+func (s *OutputUserDirectoryConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	var output rsapi.OutputEvent
+	if err := json.Unmarshal(msg.Data, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return true
+	}
+	if output.Type != rsapi.OutputTypeNewRoomEvent {
+		return true
+	}
+	event := output.NewRoomEvent.Event
+	joined, left := userDirectoryChanges(output.NewRoomEvent.AddsState())
+	if !output.NewRoomEvent.RewritesState && len(joined) == 0 && len(left) == 0 {
+		return true
+	}
+	if err := s.db.UpdateUserDirectory(s.ctx, event.RoomID(), output.NewRoomEvent.RewritesState, joined, left); err != nil {
+		log.WithFields(log.Fields{
+			"event_id": event.EventID(),
+			"room_id":  event.RoomID(),
+		}).WithError(err).Errorf("userapi consumer: failed to update the user directory")
+		return false
+	}
+	return true
+}
+
+// userDirectoryChanges returns the profiles of the users who are joined to
+// the room, and the users who aren't any more, according to the membership
+// events which were added to the room state.
+func userDirectoryChanges(addsState []*gomatrixserverlib.HeaderedEvent) (joined []authtypes.FullyQualifiedProfile, left []string) {
+	for _, ev := range addsState {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		var content gomatrixserverlib.MemberContent
+		if err := json.Unmarshal(ev.Content(), &content); err != nil {
+			log.WithField("event_id", ev.EventID()).WithError(err).Warn("userapi consumer: invalid membership event")
+			continue
+		}
+		if content.Membership != gomatrixserverlib.Join {
+			left = append(left, *ev.StateKey())
+			continue
+		}
+		joined = append(joined, authtypes.FullyQualifiedProfile{
+			UserID:      *ev.StateKey(),
+			DisplayName: content.DisplayName,
+			AvatarURL:   content.AvatarURL,
+		})
+	}
+	return joined, left
+}
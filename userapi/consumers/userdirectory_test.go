@@ -0,0 +1,39 @@
+package consumers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestUserDirectoryChanges(t *testing.T) {
+	var addsState []*gomatrixserverlib.HeaderedEvent
+	for _, js := range []string{
+		`{"event_id":"$create:example.com","room_id":"!room:example.com","sender":"@alice:example.com","type":"m.room.create","state_key":"","content":{"creator":"@alice:example.com"}}`,
+		`{"event_id":"$alice:example.com","room_id":"!room:example.com","sender":"@alice:example.com","type":"m.room.member","state_key":"@alice:example.com","content":{"membership":"join","displayname":"Alice","avatar_url":"mxc://example.com/alice"}}`,
+		`{"event_id":"$bob:remote.com","room_id":"!room:example.com","sender":"@bob:remote.com","type":"m.room.member","state_key":"@bob:remote.com","content":{"membership":"join"}}`,
+		`{"event_id":"$charlie:example.com","room_id":"!room:example.com","sender":"@alice:example.com","type":"m.room.member","state_key":"@charlie:example.com","content":{"membership":"invite","displayname":"Charlie"}}`,
+		`{"event_id":"$dave:example.com","room_id":"!room:example.com","sender":"@dave:example.com","type":"m.room.member","state_key":"@dave:example.com","content":{"membership":"leave"}}`,
+	} {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(js), false, gomatrixserverlib.RoomVersionV7)
+		if err != nil {
+			t.Fatalf("NewEventFromTrustedJSON failed: %v", err)
+		}
+		addsState = append(addsState, ev.Headered(gomatrixserverlib.RoomVersionV7))
+	}
+
+	joined, left := userDirectoryChanges(addsState)
+	wantJoined := []authtypes.FullyQualifiedProfile{
+		{UserID: "@alice:example.com", DisplayName: "Alice", AvatarURL: "mxc://example.com/alice"},
+		{UserID: "@bob:remote.com"},
+	}
+	if !reflect.DeepEqual(joined, wantJoined) {
+		t.Errorf("got joined %+v, want %+v", joined, wantJoined)
+	}
+	// Invited users haven't joined yet, so can't be found.
+	if wantLeft := []string{"@charlie:example.com", "@dave:example.com"}; !reflect.DeepEqual(left, wantLeft) {
+		t.Errorf("got left %v, want %v", left, wantLeft)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"encoding/json"
+	"time"
+
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTemplate is used for the emails when the config doesn't give one.
+const defaultTemplate = `{{define "subject"}}{{.Count}} unread notification{{if ne .Count 1}}s{{end}} for {{.UserID}}{{end -}}
+Hi {{.UserID}},
+
+You have {{.Count}} unread notification{{if ne .Count 1}}s{{end}}:
+{{range .Rooms}}
+{{.Name}}
+{{- range .Notifications}}
+  [{{.TS.Format "2006-01-02 15:04"}}] {{.Sender}}: {{.Body}}
+{{- end}}
+{{end}}
+You are receiving this email because you set up email notifications on
+{{.ServerName}}. Reading the messages stops them from being included in
+further emails.
+`
+
+// Digest is the data that the email template is executed with.
+type Digest struct {
+	UserID     string
+	ServerName string
+	// The number of notifications in all of the rooms.
+	Count int
+	// The rooms with notifications, in the order that they were first
+	// notified in.
+	Rooms []*DigestRoom
+}
+
+// DigestRoom is a room with notifications in a Digest.
+type DigestRoom struct {
+	RoomID string
+	// The room name, canonical alias or ID, in that order of preference.
+	Name string
+	// The notifications, oldest first.
+	Notifications []*DigestNotification
+}
+
+// DigestNotification is a notification in a DigestRoom.
+type DigestNotification struct {
+	EventID string
+	// The display name of the sender in the room, or their user ID.
+	Sender string
+	// A plain text description of the event.
+	Body string
+	TS   time.Time
+}
+
+// digest groups the notifications, which must be newest first, by room and
+// looks up the names to show for the rooms and senders.
+func (n *Notifier) digest(userID string, notifications []*api.Notification) *Digest {
+	digest := &Digest{
+		UserID:     userID,
+		ServerName: string(n.serverName),
+		Count:      len(notifications),
+	}
+	rooms := map[string]*DigestRoom{}
+	senders := map[string]map[string]struct{}{}
+	for i := len(notifications) - 1; i >= 0; i-- {
+		ev := &notifications[i].Event
+		room, ok := rooms[notifications[i].RoomID]
+		if !ok {
+			room = &DigestRoom{RoomID: notifications[i].RoomID, Name: notifications[i].RoomID}
+			rooms[room.RoomID] = room
+			senders[room.RoomID] = map[string]struct{}{}
+			digest.Rooms = append(digest.Rooms, room)
+		}
+		senders[room.RoomID][ev.Sender] = struct{}{}
+		room.Notifications = append(room.Notifications, &DigestNotification{
+			EventID: ev.EventID,
+			Sender:  ev.Sender,
+			Body:    eventBody(ev),
+			TS:      ev.OriginServerTS.Time(),
+		})
+	}
+	for _, room := range digest.Rooms {
+		n.fillNames(room, senders[room.RoomID])
+	}
+	return digest
+}
+
+// fillNames replaces the room ID and the sender IDs with their names, as far
+// as the current state of the room has them.
+func (n *Notifier) fillNames(room *DigestRoom, senders map[string]struct{}) {
+	nameTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomName, StateKey: ""}
+	aliasTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}
+	tuples := []gomatrixserverlib.StateKeyTuple{nameTuple, aliasTuple}
+	for sender := range senders {
+		tuples = append(tuples, gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: sender})
+	}
+	var res rsapi.QueryCurrentStateResponse
+	if err := n.rsAPI.QueryCurrentState(n.ctx, &rsapi.QueryCurrentStateRequest{
+		RoomID:      room.RoomID,
+		StateTuples: tuples,
+	}, &res); err != nil {
+		logrus.WithError(err).WithField("room_id", room.RoomID).Warn("Failed to query the names for a notification email")
+		return
+	}
+
+	var content struct {
+		Name        string `json:"name"`
+		Alias       string `json:"alias"`
+		DisplayName string `json:"displayname"`
+	}
+	if ev, ok := res.StateEvents[aliasTuple]; ok && json.Unmarshal(ev.Content(), &content) == nil && content.Alias != "" {
+		room.Name = content.Alias
+	}
+	if ev, ok := res.StateEvents[nameTuple]; ok && json.Unmarshal(ev.Content(), &content) == nil && content.Name != "" {
+		room.Name = content.Name
+	}
+	displayNames := map[string]string{}
+	for tuple, ev := range res.StateEvents {
+		content.DisplayName = ""
+		if tuple.EventType == gomatrixserverlib.MRoomMember && json.Unmarshal(ev.Content(), &content) == nil && content.DisplayName != "" {
+			displayNames[tuple.StateKey] = content.DisplayName
+		}
+	}
+	for _, notification := range room.Notifications {
+		if name, ok := displayNames[notification.Sender]; ok {
+			notification.Sender = name
+		}
+	}
+}
+
+// eventBody returns a plain text description of the event for the email.
+func eventBody(ev *gomatrixserverlib.ClientEvent) string {
+	var content struct {
+		Body       string `json:"body"`
+		Membership string `json:"membership"`
+	}
+	_ = json.Unmarshal(ev.Content, &content)
+	switch {
+	case ev.Type == "m.room.encrypted":
+		return "(encrypted message)"
+	case content.Body != "":
+		return content.Body
+	case ev.Type == gomatrixserverlib.MRoomMember && content.Membership == gomatrixserverlib.Invite:
+		return "(invited you to the room)"
+	default:
+		return "(sent an event of type " + ev.Type + ")"
+	}
+}
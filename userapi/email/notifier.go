@@ -0,0 +1,217 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package email sends emails to the users who have set up an email pusher
+// about the notifications that they haven't read yet, and to the users whose
+// accounts are about to expire about renewing them.
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// maxDigestNotifications is the most notifications included in one email.
+const maxDigestNotifications = 50
+
+// StateQuerier is used to look up the names of the rooms and senders of the
+// notifications in the emails.
+type StateQuerier interface {
+	QueryCurrentState(ctx context.Context, req *rsapi.QueryCurrentStateRequest, res *rsapi.QueryCurrentStateResponse) error
+}
+
+// Sender sends an email message, which includes the headers, to the
+// recipients.
+type Sender interface {
+	SendMail(from string, to []string, msg []byte) error
+}
+
+// NewSMTPSender returns a Sender which sends emails through an SMTP server.
+func NewSMTPSender(cfg *config.SMTP) Sender {
+	return &smtpSender{cfg}
+}
+
+type smtpSender struct {
+	cfg *config.SMTP
+}
+
+func (s *smtpSender) SendMail(from string, to []string, msg []byte) error {
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		host, _, err := net.SplitHostPort(s.cfg.Host)
+		if err != nil {
+			host = s.cfg.Host
+		}
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, host)
+	}
+	return smtp.SendMail(s.cfg.Host, auth, from, to, msg)
+}
+
+// Notifier sends the emails. Notifications for the same address during the
+// quiet period are batched into a single email. A nil *Notifier is valid and
+// never sends anything, so that callers don't need to check whether email
+// notifications are enabled.
+type Notifier struct {
+	ctx          context.Context
+	cfg          *config.EmailNotifications
+	serverName   gomatrixserverlib.ServerName
+	db           accounts.Database
+	rsAPI        StateQuerier
+	sender       Sender
+	from         *mail.Address
+	tmpl         *template.Template
+	pending      map[pendingEmail]struct{} // emails waiting for the quiet period to end
+	pendingMutex sync.Mutex                // protects pending
+}
+
+type pendingEmail struct {
+	localpart string
+	address   string
+}
+
+// NewNotifier creates a Notifier, loading the email template from the config
+// if there is one.
+func NewNotifier(
+	process *process.ProcessContext, cfg *config.UserAPI, db accounts.Database,
+	rsAPI StateQuerier, sender Sender,
+) (*Notifier, error) {
+	from, err := mail.ParseAddress(cfg.EmailNotifications.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+	tmpl := template.New("email")
+	if cfg.EmailNotifications.TemplatePath != "" {
+		tmpl, err = template.ParseFiles(string(cfg.EmailNotifications.TemplatePath))
+	} else {
+		tmpl, err = tmpl.Parse(defaultTemplate)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email template: %w", err)
+	}
+	return &Notifier{
+		ctx:        process.Context(),
+		cfg:        &cfg.EmailNotifications,
+		serverName: cfg.Matrix.ServerName,
+		db:         db,
+		rsAPI:      rsAPI,
+		sender:     sender,
+		from:       from,
+		tmpl:       tmpl,
+		pending:    map[pendingEmail]struct{}{},
+	}, nil
+}
+
+// Schedule sends an email to the address at the end of the quiet period
+// about the user's notifications since the given time, if they still
+// haven't read them by then. If an email is already scheduled for the
+// address then the notifications are included in that instead.
+func (n *Notifier) Schedule(localpart, address string, since gomatrixserverlib.Timestamp) {
+	if n == nil {
+		return
+	}
+	key := pendingEmail{localpart, address}
+	n.pendingMutex.Lock()
+	defer n.pendingMutex.Unlock()
+	if _, ok := n.pending[key]; ok {
+		return
+	}
+	n.pending[key] = struct{}{}
+	time.AfterFunc(n.cfg.QuietPeriod, func() {
+		n.pendingMutex.Lock()
+		delete(n.pending, key)
+		n.pendingMutex.Unlock()
+		if err := n.send(localpart, address, since); err != nil {
+			logrus.WithError(err).WithField("localpart", localpart).Error("Failed to send notification email")
+		}
+	})
+}
+
+func (n *Notifier) send(localpart, address string, since gomatrixserverlib.Timestamp) error {
+	if n.ctx.Err() != nil {
+		return nil
+	}
+	notifications, _, err := n.db.GetNotifications(n.ctx, localpart, math.MaxInt64, maxDigestNotifications, false)
+	if err != nil {
+		return fmt.Errorf("n.db.GetNotifications: %w", err)
+	}
+	var unread []*api.Notification
+	for _, notification := range notifications {
+		if !notification.Read && notification.TS >= since {
+			unread = append(unread, notification)
+		}
+	}
+	if len(unread) == 0 {
+		return nil
+	}
+	msg, err := n.message(address, n.digest(userutil.MakeUserID(localpart, n.serverName), unread))
+	if err != nil {
+		return err
+	}
+	return n.sender.SendMail(n.from.Address, []string{address}, msg)
+}
+
+// message renders the email for the digest, including the headers. The
+// template may define a "subject" template for the subject line, and the rest
+// of it is the plain text body.
+func (n *Notifier) message(address string, digest *Digest) ([]byte, error) {
+	subject := fmt.Sprintf("You have %d unread notifications", digest.Count)
+	return renderMessage(n.from, address, n.tmpl, subject, digest)
+}
+
+// renderMessage renders an email from the template, including the headers.
+// The subject line is used unless the template defines a "subject" template.
+func renderMessage(from *mail.Address, address string, tmpl *template.Template, subject string, data interface{}) ([]byte, error) {
+	if t := tmpl.Lookup("subject"); t != nil {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to execute subject template: %w", err)
+		}
+		subject = strings.TrimSpace(buf.String())
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("failed to execute email template: %w", err)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", address)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.Replace(strings.TrimSpace(body.String()), "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type sentMail struct {
+	from string
+	to   []string
+	msg  string
+}
+
+type fakeSender chan sentMail
+
+func (s fakeSender) SendMail(from string, to []string, msg []byte) error {
+	s <- sentMail{from, to, string(msg)}
+	return nil
+}
+
+type fakeStateQuerier struct{}
+
+func (q *fakeStateQuerier) QueryCurrentState(ctx context.Context, req *rsapi.QueryCurrentStateRequest, res *rsapi.QueryCurrentStateResponse) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, tuple := range req.StateTuples {
+		var content string
+		switch {
+		case tuple.EventType == gomatrixserverlib.MRoomName && req.RoomID == "!named:example.com":
+			content = `{"name":"Named room"}`
+		case tuple.EventType == gomatrixserverlib.MRoomMember && tuple.StateKey == "@bob:example.com":
+			content = `{"membership":"join","displayname":"Bob"}`
+		default:
+			continue
+		}
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+			`{"event_id":"$state:example.com","room_id":%q,"type":%q,"state_key":%q,"sender":"@bob:example.com","content":%s}`,
+			req.RoomID, tuple.EventType, tuple.StateKey, content,
+		)), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			return err
+		}
+		res.StateEvents[tuple] = ev.Headered(gomatrixserverlib.RoomVersionV1)
+	}
+	return nil
+}
+
+func mustMakeNotifier(t *testing.T) (*Notifier, accounts.Database, fakeSender) {
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "example.com", &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	cfg := &config.UserAPI{Matrix: &config.Global{ServerName: "example.com"}}
+	cfg.EmailNotifications = config.EmailNotifications{
+		Enabled: true,
+		From:    "Dendrite <noreply@example.com>",
+	}
+	sender := make(fakeSender, 1)
+	n, err := NewNotifier(process.NewProcessContext(), cfg, accountDB, &fakeStateQuerier{}, sender)
+	if err != nil {
+		t.Fatalf("failed to create notifier: %s", err)
+	}
+	return n, accountDB, sender
+}
+
+func mustInsertNotification(t *testing.T, db accounts.Database, roomID, eventID, body string, ts gomatrixserverlib.Timestamp) {
+	if err := db.InsertNotification(context.TODO(), "alice", "", false, &api.Notification{
+		RoomID: roomID,
+		Event: gomatrixserverlib.ClientEvent{
+			EventID: eventID,
+			Sender:  "@bob:example.com",
+			Type:    "m.room.message",
+			Content: gomatrixserverlib.RawJSON(fmt.Sprintf(`{"msgtype":"m.text","body":%q}`, body)),
+		},
+		TS: ts,
+	}); err != nil {
+		t.Fatalf("failed to insert notification: %s", err)
+	}
+}
+
+func TestNotifierSendsDigest(t *testing.T) {
+	n, db, sender := mustMakeNotifier(t)
+	mustInsertNotification(t, db, "!named:example.com", "$old:example.com", "already emailed", 1000)
+	mustInsertNotification(t, db, "!named:example.com", "$1:example.com", "first", 2000)
+	mustInsertNotification(t, db, "!other:example.com", "$2:example.com", "second", 3000)
+	mustInsertNotification(t, db, "!named:example.com", "$3:example.com", "third", 4000)
+
+	n.Schedule("alice", "alice@example.com", 2000)
+	var mail sentMail
+	select {
+	case mail = <-sender:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no email was sent")
+	}
+	if mail.from != "noreply@example.com" || len(mail.to) != 1 || mail.to[0] != "alice@example.com" {
+		t.Fatalf("got email from %q to %v", mail.from, mail.to)
+	}
+	for _, want := range []string{
+		"Subject: 3 unread notifications for @alice:example.com\r\n",
+		"Named room\r\n",
+		"Bob: first\r\n",
+		"Bob: third\r\n",
+		"!other:example.com\r\n",
+		"Bob: second\r\n",
+	} {
+		if !strings.Contains(mail.msg, want) {
+			t.Errorf("email doesn't contain %q:\n%s", want, mail.msg)
+		}
+	}
+	if strings.Contains(mail.msg, "already emailed") {
+		t.Errorf("email contains a notification from before it was scheduled:\n%s", mail.msg)
+	}
+	if strings.Index(mail.msg, "first") > strings.Index(mail.msg, "third") {
+		t.Errorf("notifications aren't oldest first:\n%s", mail.msg)
+	}
+}
+
+func TestNotifierSkipsReadNotifications(t *testing.T) {
+	n, db, sender := mustMakeNotifier(t)
+	mustInsertNotification(t, db, "!named:example.com", "$1:example.com", "first", 2000)
+	if _, err := db.SetNotificationsRead(context.TODO(), "alice", "!named:example.com", "$1:example.com", 0); err != nil {
+		t.Fatalf("failed to mark notifications as read: %s", err)
+	}
+	if err := n.send("alice", "alice@example.com", 2000); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	select {
+	case mail := <-sender:
+		t.Fatalf("got an email about read notifications:\n%s", mail.msg)
+	default:
+	}
+}
+
+func TestNilNotifierIgnoresSchedule(t *testing.T) {
+	var n *Notifier
+	n.Schedule("alice", "alice@example.com", 0)
+}
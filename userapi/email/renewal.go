@@ -0,0 +1,110 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// RenewalPath is the path of the client API endpoint which the links in
+// renewal emails point at.
+const RenewalPath = "/_matrix/client/unstable/account_validity/renew"
+
+// defaultRenewalTemplate is used for the renewal emails when the config
+// doesn't give one.
+const defaultRenewalTemplate = `{{define "subject"}}Renew your account on {{.ServerName}}{{end -}}
+Hi {{.UserID}},
+
+Your account on {{.ServerName}} expires on {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}.
+To keep using it, renew it by following this link:
+
+{{.Link}}
+
+Once it has expired, you can't use your account until it is renewed.
+`
+
+// Renewal is the data that the renewal email template is executed with.
+type Renewal struct {
+	UserID     string
+	ServerName string
+	// When the account expires unless it is renewed.
+	ExpiresAt time.Time
+	// The link which renews the account.
+	Link string
+}
+
+// RenewalMailer emails renewal links to the users whose accounts are about
+// to expire.
+type RenewalMailer struct {
+	serverName gomatrixserverlib.ServerName
+	renewURL   string
+	sender     Sender
+	from       *mail.Address
+	tmpl       *template.Template
+}
+
+// NewRenewalMailer creates a RenewalMailer, loading the email template from
+// the config if there is one.
+func NewRenewalMailer(cfg *config.UserAPI, sender Sender) (*RenewalMailer, error) {
+	from, err := mail.ParseAddress(cfg.AccountValidity.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+	tmpl := template.New("renewal")
+	if cfg.AccountValidity.TemplatePath != "" {
+		tmpl, err = template.ParseFiles(string(cfg.AccountValidity.TemplatePath))
+	} else {
+		tmpl, err = tmpl.Parse(defaultRenewalTemplate)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse renewal email template: %w", err)
+	}
+	return &RenewalMailer{
+		serverName: cfg.Matrix.ServerName,
+		renewURL:   strings.TrimSuffix(cfg.Matrix.WellKnownClientName, "/") + RenewalPath,
+		sender:     sender,
+		from:       from,
+		tmpl:       tmpl,
+	}, nil
+}
+
+// Send emails the renewal link with the token to each of the addresses.
+func (m *RenewalMailer) Send(addresses []string, localpart, token string, expiresAt time.Time) error {
+	renewal := &Renewal{
+		UserID:     userutil.MakeUserID(localpart, m.serverName),
+		ServerName: string(m.serverName),
+		ExpiresAt:  expiresAt,
+		Link:       m.renewURL + "?" + url.Values{"token": {token}}.Encode(),
+	}
+	for _, address := range addresses {
+		msg, err := renderMessage(m.from, address, m.tmpl, "Renew your account", renewal)
+		if err != nil {
+			return err
+		}
+		if err = m.sender.SendMail(m.from.Address, []string{address}, msg); err != nil {
+			return fmt.Errorf("m.sender.SendMail: %w", err)
+		}
+	}
+	return nil
+}
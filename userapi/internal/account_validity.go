@@ -0,0 +1,144 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/email"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// accountValidityInterval is how often the accounts which are about to
+// expire are looked for.
+const accountValidityInterval = time.Hour
+
+// renewalTokenByteLength is the length of the tokens in renewal links, which
+// must not be guessable.
+const renewalTokenByteLength = 32
+
+// accountExpired returns whether the account of the user has expired, in
+// which case it has to be renewed before it can be used again.
+func (a *UserInternalAPI) accountExpired(ctx context.Context, localpart string, now time.Time) (bool, error) {
+	if a.Config.AccountValidity.Period <= 0 {
+		return false, nil
+	}
+	expirationTS, err := a.AccountDB.GetAccountExpiry(ctx, localpart)
+	if err != nil {
+		return false, err
+	}
+	return expirationTS != 0 && gomatrixserverlib.AsTimestamp(now) >= expirationTS, nil
+}
+
+// PerformAccountRenewal renews the account which the renewal token was
+// emailed for, or the account with the localpart, so that it expires at the
+// given time or one validity period from now.
+func (a *UserInternalAPI) PerformAccountRenewal(ctx context.Context, req *api.PerformAccountRenewalRequest, res *api.PerformAccountRenewalResponse) error {
+	localpart := req.Localpart
+	if req.Token != "" {
+		var err error
+		if localpart, err = a.AccountDB.GetLocalpartForRenewalToken(ctx, req.Token); err != nil {
+			return err
+		}
+		if localpart == "" {
+			return nil
+		}
+	}
+	expirationTS := req.ExpirationTS
+	if expirationTS == 0 {
+		expirationTS = gomatrixserverlib.AsTimestamp(time.Now().Add(a.Config.AccountValidity.Period))
+	}
+	if err := a.AccountDB.SetAccountExpiry(ctx, localpart, expirationTS); err != nil {
+		return err
+	}
+	res.UserID = userutil.MakeUserID(localpart, a.ServerName)
+	res.ExpirationTS = expirationTS
+	return nil
+}
+
+// AccountValidity gives the accounts which don't expire yet an expiry time,
+// and emails renewal links to the users whose accounts are about to expire.
+type AccountValidity struct {
+	Cfg       *config.AccountValidity
+	AccountDB accounts.Database
+	Mailer    *email.RenewalMailer
+}
+
+// Start looks for the accounts which are about to expire on a fixed
+// interval. It does not return, so should be run in a goroutine.
+func (v *AccountValidity) Start() {
+	for {
+		if err := v.sendRenewalEmails(context.Background(), time.Now()); err != nil {
+			logrus.WithError(err).Error("Failed to send account renewal emails")
+		}
+		time.Sleep(accountValidityInterval)
+	}
+}
+
+func (v *AccountValidity) sendRenewalEmails(ctx context.Context, now time.Time) error {
+	// The accounts which were registered before account validity was turned
+	// on expire one validity period from when it was.
+	count, err := v.AccountDB.SetMissingAccountExpiries(ctx, gomatrixserverlib.AsTimestamp(now.Add(v.Cfg.Period)))
+	if err != nil {
+		return fmt.Errorf("v.AccountDB.SetMissingAccountExpiries: %w", err)
+	}
+	if count > 0 {
+		logrus.WithField("accounts", count).Info("Set the expiry time of existing accounts")
+	}
+	expiring, err := v.AccountDB.GetAccountsExpiringBefore(ctx, gomatrixserverlib.AsTimestamp(now.Add(v.Cfg.RenewAt)))
+	if err != nil {
+		return fmt.Errorf("v.AccountDB.GetAccountsExpiringBefore: %w", err)
+	}
+	for localpart, expirationTS := range expiring {
+		threepids, err := v.AccountDB.GetThreePIDsForLocalpart(ctx, localpart)
+		if err != nil {
+			return fmt.Errorf("v.AccountDB.GetThreePIDsForLocalpart: %w", err)
+		}
+		var addresses []string
+		for _, threepid := range threepids {
+			if threepid.Medium == "email" {
+				addresses = append(addresses, threepid.Address)
+			}
+		}
+		if len(addresses) == 0 {
+			// The account can only be renewed by a server admin.
+			continue
+		}
+		b := make([]byte, renewalTokenByteLength)
+		if _, err = rand.Read(b); err != nil {
+			return err
+		}
+		token := base64.RawURLEncoding.EncodeToString(b)
+		// The token is stored first so that the link works as soon as the
+		// email arrives. If sending fails the user isn't emailed again until
+		// the account is renewed, rather than every time this runs.
+		if err = v.AccountDB.SetAccountRenewalToken(ctx, localpart, token); err != nil {
+			return fmt.Errorf("v.AccountDB.SetAccountRenewalToken: %w", err)
+		}
+		if err = v.Mailer.Send(addresses, localpart, token, expirationTS.Time()); err != nil {
+			logrus.WithError(err).WithField("localpart", localpart).Error("Failed to send account renewal email")
+		}
+	}
+	return nil
+}
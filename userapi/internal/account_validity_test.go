@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/email"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type renewalSender struct {
+	to  []string
+	msg string
+}
+
+func (s *renewalSender) SendMail(from string, to []string, msg []byte) error {
+	s.to = append(s.to, to...)
+	s.msg = string(msg)
+	return nil
+}
+
+func TestAccountValidity(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(t.TempDir(), "accounts.db")),
+	}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	cfg := &config.UserAPI{
+		Matrix: &config.Global{
+			ServerName:          serverName,
+			WellKnownClientName: "https://matrix.example.com",
+		},
+	}
+	a := &UserInternalAPI{
+		AccountDB:  accountDB,
+		DeviceDB:   deviceDB,
+		ServerName: serverName,
+		KeyAPI:     &deactivationKeyAPI{},
+		Config:     cfg,
+	}
+
+	// Bob registered before account validity was turned on.
+	for _, localpart := range []string{"bob", "alice"} {
+		if err = a.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+			Localpart:   localpart,
+			AccountType: api.AccountTypeUser,
+		}, &api.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("PerformAccountCreation failed: %s", err)
+		}
+		cfg.AccountValidity = config.AccountValidity{
+			Period:       time.Hour * 24 * 30,
+			RenewAt:      time.Hour * 24 * 7,
+			AdminContact: "mailto:admin@example.com",
+			From:         "Dendrite <noreply@example.com>",
+		}
+		if err = a.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart:   localpart,
+			AccessToken: localpart + "_token",
+		}, &api.PerformDeviceCreationResponse{}); err != nil {
+			t.Fatalf("PerformDeviceCreation failed: %s", err)
+		}
+		if err = accountDB.SaveThreePIDAssociation(ctx, localpart+"@example.com", localpart, "email"); err != nil {
+			t.Fatalf("SaveThreePIDAssociation failed: %s", err)
+		}
+	}
+	expiry, err := accountDB.GetAccountExpiry(ctx, "bob")
+	if err != nil {
+		t.Fatalf("GetAccountExpiry failed: %s", err)
+	}
+	if expiry != 0 {
+		t.Fatalf("got expiry %d for bob, want none yet", expiry)
+	}
+	expiry, err = accountDB.GetAccountExpiry(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetAccountExpiry failed: %s", err)
+	}
+	if want := time.Now().Add(cfg.AccountValidity.Period); expiry.Time().After(want) || expiry.Time().Before(want.Add(-time.Minute)) {
+		t.Fatalf("got alice's account expiring at %s, want %s", expiry.Time(), want)
+	}
+
+	sender := &renewalSender{}
+	mailer, err := email.NewRenewalMailer(cfg, sender)
+	if err != nil {
+		t.Fatalf("NewRenewalMailer failed: %s", err)
+	}
+	v := &AccountValidity{
+		Cfg:       &cfg.AccountValidity,
+		AccountDB: accountDB,
+		Mailer:    mailer,
+	}
+	if err = v.sendRenewalEmails(ctx, time.Now()); err != nil {
+		t.Fatalf("sendRenewalEmails failed: %s", err)
+	}
+	if len(sender.to) != 0 {
+		t.Fatalf("got renewal emails sent to %v, want none yet", sender.to)
+	}
+	if expiry, err = accountDB.GetAccountExpiry(ctx, "bob"); err != nil || expiry == 0 {
+		t.Fatalf("got expiry %d for bob (err %v), want one", expiry, err)
+	}
+
+	// A week before the accounts expire, their users are emailed.
+	soon := time.Now().Add(cfg.AccountValidity.Period - cfg.AccountValidity.RenewAt + time.Hour)
+	if err = v.sendRenewalEmails(ctx, soon); err != nil {
+		t.Fatalf("sendRenewalEmails failed: %s", err)
+	}
+	if len(sender.to) != 2 {
+		t.Fatalf("got renewal emails sent to %v, want alice and bob", sender.to)
+	}
+	// They aren't emailed again until they renew.
+	sender.to = nil
+	if err = v.sendRenewalEmails(ctx, soon); err != nil {
+		t.Fatalf("sendRenewalEmails failed: %s", err)
+	}
+	if len(sender.to) != 0 {
+		t.Fatalf("got renewal emails sent to %v again, want none", sender.to)
+	}
+
+	// Expired accounts can't be used until they are renewed.
+	if err = accountDB.SetAccountExpiry(ctx, "alice", gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Minute))); err != nil {
+		t.Fatalf("SetAccountExpiry failed: %s", err)
+	}
+	var res api.QueryAccessTokenResponse
+	if err = a.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "alice_token"}, &res); err != nil {
+		t.Fatalf("QueryAccessToken failed: %s", err)
+	}
+	if !res.Expired || res.Device == nil || res.AdminContact != cfg.AccountValidity.AdminContact {
+		t.Fatalf("got %+v, want the device of an expired account", res)
+	}
+	if err = v.sendRenewalEmails(ctx, time.Now()); err != nil {
+		t.Fatalf("sendRenewalEmails failed: %s", err)
+	}
+	match := regexp.MustCompile(`https://matrix.example.com/_matrix/client/unstable/account_validity/renew\?token=(\S+)`).FindStringSubmatch(sender.msg)
+	if sender.to[0] != "alice@example.com" || match == nil {
+		t.Fatalf("got email %q to %v, want a renewal link for alice", sender.msg, sender.to)
+	}
+
+	var renewRes api.PerformAccountRenewalResponse
+	if err = a.PerformAccountRenewal(ctx, &api.PerformAccountRenewalRequest{Token: match[1]}, &renewRes); err != nil {
+		t.Fatalf("PerformAccountRenewal failed: %s", err)
+	}
+	if want := "@alice:" + string(serverName); renewRes.UserID != want {
+		t.Errorf("got renewed user %q, want %q", renewRes.UserID, want)
+	}
+	res = api.QueryAccessTokenResponse{}
+	if err = a.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "alice_token"}, &res); err != nil {
+		t.Fatalf("QueryAccessToken failed: %s", err)
+	}
+	if res.Expired || res.Device == nil {
+		t.Fatalf("got %+v, want the device of a renewed account", res)
+	}
+	// The link only works once.
+	renewRes = api.PerformAccountRenewalResponse{}
+	if err = a.PerformAccountRenewal(ctx, &api.PerformAccountRenewalRequest{Token: match[1]}, &renewRes); err != nil {
+		t.Fatalf("PerformAccountRenewal failed: %s", err)
+	}
+	if renewRes.UserID != "" {
+		t.Errorf("got renewed user %q with a used token, want none", renewRes.UserID)
+	}
+}
@@ -16,17 +16,28 @@ package internal
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/producers"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -34,6 +45,16 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// pushRulesAccountDataType is the global account data type that the push
+// rules are stored in.
+const pushRulesAccountDataType = "m.push_rules"
+
+// openIDTokenByteLength is the number of random bytes in an OpenID token.
+const openIDTokenByteLength = 32
+
+// refreshTokenByteLength is the number of random bytes in a refresh token.
+const refreshTokenByteLength = 32
+
 type UserInternalAPI struct {
 	AccountDB  accounts.Database
 	DeviceDB   devices.Database
@@ -41,6 +62,17 @@ type UserInternalAPI struct {
 	// AppServices is the list of all registered AS
 	AppServices []config.ApplicationService
 	KeyAPI      keyapi.KeyInternalAPI
+	RSAPI       rsapi.RoomserverInternalAPI
+	Config      *config.UserAPI
+	// PushGatewayClient is used to discover the UnifiedPush gateways of
+	// new HTTP pushers.
+	PushGatewayClient *http.Client
+	// SyncProducer tells the sync API server about deleted devices. It is
+	// nil if there is no sync API server to tell.
+	SyncProducer *producers.SyncAPI
+	// LoginThrottle makes clients wait after failed logins. It is nil if
+	// logins aren't throttled.
+	LoginThrottle *LoginThrottle
 }
 
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
@@ -67,7 +99,7 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 		res.Account = acc
 		return nil
 	}
-	acc, err := a.AccountDB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID)
+	acc, err := a.AccountDB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID, req.AccountType)
 	if err != nil {
 		if errors.Is(err, sqlutil.ErrUserExists) { // This account already exists
 			switch req.OnConflict {
@@ -86,6 +118,7 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 			Localpart:    req.Localpart,
 			ServerName:   a.ServerName,
 			UserID:       fmt.Sprintf("@%s:%s", req.Localpart, a.ServerName),
+			AccountType:  req.AccountType,
 		}
 		return nil
 	}
@@ -94,6 +127,14 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 		return err
 	}
 
+	// Application service users don't expire.
+	if a.Config.AccountValidity.Period > 0 && req.AppServiceID == "" {
+		expirationTS := gomatrixserverlib.AsTimestamp(time.Now().Add(a.Config.AccountValidity.Period))
+		if err = a.AccountDB.SetAccountExpiry(ctx, req.Localpart, expirationTS); err != nil {
+			return err
+		}
+	}
+
 	res.AccountCreated = true
 	res.Account = acc
 	return nil
@@ -113,12 +154,24 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 		"device_id":    req.DeviceID,
 		"display_name": req.DeviceDisplayName,
 	}).Info("PerformDeviceCreation")
-	dev, err := a.DeviceDB.CreateDevice(ctx, req.Localpart, req.DeviceID, req.AccessToken, req.DeviceDisplayName, req.IPAddr, req.UserAgent)
+	var refreshToken string
+	var expiresTS int64
+	if req.Refreshable {
+		var err error
+		if refreshToken, expiresTS, err = a.newRefreshToken(); err != nil {
+			return err
+		}
+	}
+	dev, err := a.DeviceDB.CreateDevice(ctx, req.Localpart, req.DeviceID, req.AccessToken, refreshToken, expiresTS, req.DeviceDisplayName, req.IPAddr, req.UserAgent)
 	if err != nil {
 		return err
 	}
+	if err = a.markMonthlyActive(ctx, req.Localpart); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to mark the user as monthly active")
+	}
 	res.DeviceCreated = true
 	res.Device = dev
+	res.RefreshToken = refreshToken
 	if req.NoDeviceListUpdate {
 		return nil
 	}
@@ -126,6 +179,45 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID})
 }
 
+// newRefreshToken returns a new refresh token and when the access token
+// which is issued with it expires, or no refresh token if they are disabled.
+func (a *UserInternalAPI) newRefreshToken() (string, int64, error) {
+	if a.Config.RefreshableAccessTokenLifetime <= 0 {
+		return "", 0, nil
+	}
+	b := make([]byte, refreshTokenByteLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", 0, err
+	}
+	expires := time.Now().Add(a.Config.RefreshableAccessTokenLifetime)
+	return base64.RawURLEncoding.EncodeToString(b), int64(gomatrixserverlib.AsTimestamp(expires)), nil
+}
+
+// PerformTokenRefresh gives the device with the refresh token the new access
+// token, along with a new refresh token, unless refresh tokens have been
+// disabled since it was issued, in which case the new access token doesn't
+// expire.
+func (a *UserInternalAPI) PerformTokenRefresh(ctx context.Context, req *api.PerformTokenRefreshRequest, res *api.PerformTokenRefreshResponse) error {
+	refreshToken, expiresTS, err := a.newRefreshToken()
+	if err != nil {
+		return err
+	}
+	dev, err := a.DeviceDB.RefreshDeviceTokens(ctx, req.RefreshToken, req.AccessToken, refreshToken, expiresTS)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if sessionExpired(&a.Config.SessionExpiry, dev, time.Now()) {
+		// Refreshing doesn't keep idle devices logged in, otherwise the
+		// new access token would be soft-logged-out straight away.
+		return nil
+	}
+	res.Device = dev
+	res.RefreshToken = refreshToken
+	return nil
+}
+
 func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
 	util.GetLogger(ctx).WithField("user_id", req.UserID).WithField("devices", req.DeviceIDs).Info("PerformDeviceDeletion")
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
@@ -142,17 +234,43 @@ func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.Pe
 		for _, d := range devices {
 			deletedDeviceIDs = append(deletedDeviceIDs, d.ID)
 		}
+		if err == nil && req.IncludeDehydratedDevice {
+			var dehydratedDeviceID string
+			dehydratedDeviceID, _, err = a.DeviceDB.GetDehydratedDevice(ctx, local)
+			if err == nil {
+				err = a.DeviceDB.RemoveDevice(ctx, dehydratedDeviceID, local)
+				deletedDeviceIDs = append(deletedDeviceIDs, dehydratedDeviceID)
+			} else if err == sql.ErrNoRows {
+				err = nil
+			}
+		}
 	} else {
 		err = a.DeviceDB.RemoveDevices(ctx, local, req.DeviceIDs)
 	}
 	if err != nil {
 		return err
 	}
-	// Ask the keyserver to delete device keys and signatures for those devices
+	if len(deletedDeviceIDs) == 0 {
+		return nil
+	}
+	if err = a.deleteDeviceKeys(ctx, req.UserID, deletedDeviceIDs); err != nil {
+		return err
+	}
+	if a.SyncProducer != nil {
+		if err = a.SyncProducer.SendDeletedDevices(req.UserID, deletedDeviceIDs); err != nil {
+			return fmt.Errorf("a.SyncProducer.SendDeletedDevices: %w", err)
+		}
+	}
+	// create empty device keys and upload them to delete what was once there and trigger device list changes
+	return a.deviceListUpdate(req.UserID, deletedDeviceIDs)
+}
+
+// deleteDeviceKeys asks the keyserver to delete device keys and signatures for those devices
+func (a *UserInternalAPI) deleteDeviceKeys(ctx context.Context, userID string, deviceIDs []string) error {
 	deleteReq := &keyapi.PerformDeleteKeysRequest{
-		UserID: req.UserID,
+		UserID: userID,
 	}
-	for _, keyID := range req.DeviceIDs {
+	for _, keyID := range deviceIDs {
 		deleteReq.KeyIDs = append(deleteReq.KeyIDs, gomatrixserverlib.KeyID(keyID))
 	}
 	deleteRes := &keyapi.PerformDeleteKeysResponse{}
@@ -160,8 +278,73 @@ func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.Pe
 	if err := deleteRes.Error; err != nil {
 		return fmt.Errorf("a.KeyAPI.PerformDeleteKeys: %w", err)
 	}
-	// create empty device keys and upload them to delete what was once there and trigger device list changes
-	return a.deviceListUpdate(req.UserID, deletedDeviceIDs)
+	return nil
+}
+
+// PerformDeviceDehydration stores a dehydrated device for the user (MSC2697),
+// which receives to-device messages until the user claims it from a new
+// session. It replaces the previous dehydrated device of the user.
+func (a *UserInternalAPI) PerformDeviceDehydration(ctx context.Context, req *api.PerformDeviceDehydrationRequest, res *api.PerformDeviceDehydrationResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot PerformDeviceDehydration of remote users: got %s want %s", domain, a.ServerName)
+	}
+	dev, replacedDeviceID, err := a.DeviceDB.StoreDehydratedDevice(ctx, local, req.DeviceDisplayName, req.DeviceData)
+	if err != nil {
+		return err
+	}
+	res.Device = dev
+	deviceIDs := []string{dev.ID}
+	if replacedDeviceID != "" {
+		if err = a.deleteDeviceKeys(ctx, req.UserID, []string{replacedDeviceID}); err != nil {
+			return err
+		}
+		deviceIDs = append(deviceIDs, replacedDeviceID)
+	}
+	return a.deviceListUpdate(req.UserID, deviceIDs)
+}
+
+// PerformDeviceRehydration replaces the device of the request with the
+// dehydrated device of the user, which takes over its access token.
+func (a *UserInternalAPI) PerformDeviceRehydration(ctx context.Context, req *api.PerformDeviceRehydrationRequest, res *api.PerformDeviceRehydrationResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.Device.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot PerformDeviceRehydration of remote users: got %s want %s", domain, a.ServerName)
+	}
+	res.Claimed, err = a.DeviceDB.ClaimDehydratedDevice(ctx, local, req.DeviceID, req.Device.ID, req.Device.AccessToken)
+	if err != nil || !res.Claimed {
+		return err
+	}
+	// The device which claimed the dehydrated device no longer exists.
+	if err = a.deleteDeviceKeys(ctx, req.Device.UserID, []string{req.Device.ID}); err != nil {
+		return err
+	}
+	return a.deviceListUpdate(req.Device.UserID, []string{req.Device.ID})
+}
+
+// QueryDehydratedDevice returns the dehydrated device of the user, if any.
+func (a *UserInternalAPI) QueryDehydratedDevice(ctx context.Context, req *api.QueryDehydratedDeviceRequest, res *api.QueryDehydratedDeviceResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot QueryDehydratedDevice of remote users: got %s want %s", domain, a.ServerName)
+	}
+	res.DeviceID, res.DeviceData, err = a.DeviceDB.GetDehydratedDevice(ctx, local)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res.Exists = true
+	return nil
 }
 
 func (a *UserInternalAPI) deviceListUpdate(userID string, deviceIDs []string) error {
@@ -197,9 +380,12 @@ func (a *UserInternalAPI) PerformLastSeenUpdate(
 	if err != nil {
 		return fmt.Errorf("gomatrixserverlib.SplitID: %w", err)
 	}
-	if err := a.DeviceDB.UpdateDeviceLastSeen(ctx, localpart, req.DeviceID, req.RemoteAddr); err != nil {
+	if err := a.DeviceDB.UpdateDeviceLastSeen(ctx, localpart, req.DeviceID, req.RemoteAddr, req.UserAgent); err != nil {
 		return fmt.Errorf("a.DeviceDB.UpdateDeviceLastSeen: %w", err)
 	}
+	if err := a.markMonthlyActive(ctx, localpart); err != nil {
+		return fmt.Errorf("a.markMonthlyActive: %w", err)
+	}
 	return nil
 }
 
@@ -284,6 +470,46 @@ func (a *UserInternalAPI) QuerySearchProfiles(ctx context.Context, req *api.Quer
 	return nil
 }
 
+// QuerySearchUserDirectory finds the users who share a room with the user,
+// and all of the local users if the server is set up to let them be found,
+// whose user ID or display name matches the search string.
+func (a *UserInternalAPI) QuerySearchUserDirectory(ctx context.Context, req *api.QuerySearchUserDirectoryRequest, res *api.QuerySearchUserDirectoryResponse) error {
+	// One more user than the limit is looked for, to tell whether the
+	// results are limited.
+	seen := map[string]bool{}
+	add := func(profile authtypes.FullyQualifiedProfile) {
+		if !seen[profile.UserID] {
+			seen[profile.UserID] = true
+			res.Results = append(res.Results, profile)
+		}
+	}
+	if a.Config.UserDirectory.SearchAllLocalUsers {
+		profiles, err := a.AccountDB.SearchProfiles(ctx, req.SearchString, req.Limit+1)
+		if err != nil {
+			return fmt.Errorf("a.AccountDB.SearchProfiles: %w", err)
+		}
+		for _, profile := range profiles {
+			add(authtypes.FullyQualifiedProfile{
+				UserID:      userutil.MakeUserID(profile.Localpart, a.ServerName),
+				DisplayName: profile.DisplayName,
+				AvatarURL:   profile.AvatarURL,
+			})
+		}
+	}
+	profiles, err := a.AccountDB.SearchUserDirectory(ctx, req.UserID, req.SearchString, a.Config.UserDirectory.IncludeRemoteUsers, req.Limit+1)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.SearchUserDirectory: %w", err)
+	}
+	for _, profile := range profiles {
+		add(profile)
+	}
+	if len(res.Results) > req.Limit {
+		res.Results = res.Results[:req.Limit]
+		res.Limited = true
+	}
+	return nil
+}
+
 func (a *UserInternalAPI) QueryDeviceInfos(ctx context.Context, req *api.QueryDeviceInfosRequest, res *api.QueryDeviceInfosResponse) error {
 	devices, err := a.DeviceDB.GetDevicesByID(ctx, req.DeviceIDs)
 	if err != nil {
@@ -321,6 +547,18 @@ func (a *UserInternalAPI) QueryDevices(ctx context.Context, req *api.QueryDevice
 	return nil
 }
 
+func (a *UserInternalAPI) QueryDeviceConnections(ctx context.Context, req *api.QueryDeviceConnectionsRequest, res *api.QueryDeviceConnectionsResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot query devices of remote users: got %s want %s", domain, a.ServerName)
+	}
+	res.Connections, err = a.DeviceDB.GetDeviceConnections(ctx, local)
+	return err
+}
+
 func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
@@ -335,6 +573,11 @@ func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAc
 		if err != nil {
 			return err
 		}
+		if req.RoomID == "" && req.DataType == pushRulesAccountDataType {
+			if data, err = a.withDefaultPushRules(local, data); err != nil {
+				return err
+			}
+		}
 		res.RoomAccountData = make(map[string]map[string]json.RawMessage)
 		res.GlobalAccountData = make(map[string]json.RawMessage)
 		if data != nil {
@@ -358,6 +601,24 @@ func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAc
 	return nil
 }
 
+// withDefaultPushRules returns the user's push rules with the server-default
+// rules which they don't have added, or the default rules if the user has
+// no push rules stored.
+func (a *UserInternalAPI) withDefaultPushRules(localpart string, data json.RawMessage) (json.RawMessage, error) {
+	defaults := a.AccountDB.DefaultPushRules(localpart)
+	if data == nil {
+		return json.Marshal(defaults)
+	}
+	var ruleSets pushrules.AccountRuleSets
+	if err := json.Unmarshal(data, &ruleSets); err != nil {
+		return nil, err
+	}
+	if !ruleSets.AddMissingDefaults(defaults) {
+		return data, nil
+	}
+	return json.Marshal(&ruleSets)
+}
+
 func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAccessTokenRequest, res *api.QueryAccessTokenResponse) error {
 	if req.AppServiceUserID != "" {
 		appServiceDevice, err := a.queryAppServiceToken(ctx, req.AccessToken, req.AppServiceUserID)
@@ -375,6 +636,31 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		}
 		return err
 	}
+	if device.AccessTokenExpiresTS != 0 && gomatrixserverlib.AsTimestamp(time.Now()) >= gomatrixserverlib.Timestamp(device.AccessTokenExpiresTS) {
+		// The device is still there, but the client has to refresh its
+		// access token to use it.
+		res.SoftLogout = true
+		return nil
+	}
+	if sessionExpired(&a.Config.SessionExpiry, device, time.Now()) {
+		// The user has to log in with the device again to keep using it.
+		res.SoftLogout = true
+		return nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return err
+	}
+	res.Locked, err = a.AccountDB.IsAccountLocked(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	if res.Expired, err = a.accountExpired(ctx, localpart, time.Now()); err != nil {
+		return err
+	}
+	if res.Expired {
+		res.AdminContact = a.Config.AccountValidity.AdminContact
+	}
 	res.Device = device
 	return nil
 }
@@ -427,15 +713,98 @@ func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appSe
 }
 
 // PerformAccountDeactivation deactivates the user's account, removing all ability for the user to login again.
+// Their devices, 3PIDs and pushers are removed, their pending invites are rejected and they leave all of their
+// rooms. If they asked to be erased then their profile is cleared too.
 func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *api.PerformAccountDeactivationRequest, res *api.PerformAccountDeactivationResponse) error {
-	err := a.AccountDB.DeactivateAccount(ctx, req.Localpart)
-	res.AccountDeactivated = err == nil
-	return err
+	if err := a.AccountDB.DeactivateAccount(ctx, req.Localpart); err != nil {
+		return err
+	}
+	res.AccountDeactivated = true
+	userID := userutil.MakeUserID(req.Localpart, a.ServerName)
+
+	if err := a.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
+		UserID:                  userID,
+		IncludeDehydratedDevice: true,
+	}, &api.PerformDeviceDeletionResponse{}); err != nil {
+		return fmt.Errorf("a.PerformDeviceDeletion: %w", err)
+	}
+
+	threepids, err := a.AccountDB.GetThreePIDsForLocalpart(ctx, req.Localpart)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetThreePIDsForLocalpart: %w", err)
+	}
+	for _, threepid := range threepids {
+		if err = a.AccountDB.RemoveThreePIDAssociation(ctx, threepid.Address, threepid.Medium); err != nil {
+			return fmt.Errorf("a.AccountDB.RemoveThreePIDAssociation: %w", err)
+		}
+	}
+	// Stop single sign-on users from logging in to the account.
+	if err = a.AccountDB.RemoveSSOIdentities(ctx, req.Localpart); err != nil {
+		return fmt.Errorf("a.AccountDB.RemoveSSOIdentities: %w", err)
+	}
+
+	pushers, err := a.AccountDB.GetPushers(ctx, req.Localpart)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetPushers: %w", err)
+	}
+	for _, pusher := range pushers {
+		if err = a.AccountDB.RemovePusher(ctx, pusher.AppID, pusher.PushKey, req.Localpart); err != nil {
+			return fmt.Errorf("a.AccountDB.RemovePusher: %w", err)
+		}
+	}
+
+	if req.Erase {
+		if err = a.AccountDB.MarkUserErased(ctx, req.Localpart); err != nil {
+			return fmt.Errorf("a.AccountDB.MarkUserErased: %w", err)
+		}
+		if err = a.AccountDB.SetDisplayName(ctx, req.Localpart, ""); err != nil {
+			return fmt.Errorf("a.AccountDB.SetDisplayName: %w", err)
+		}
+		if err = a.AccountDB.SetAvatarURL(ctx, req.Localpart, ""); err != nil {
+			return fmt.Errorf("a.AccountDB.SetAvatarURL: %w", err)
+		}
+		if err = a.AccountDB.RemoveProfileFields(ctx, req.Localpart); err != nil {
+			return fmt.Errorf("a.AccountDB.RemoveProfileFields: %w", err)
+		}
+	}
+
+	return a.leaveAllRooms(ctx, userID)
+}
+
+// leaveAllRooms rejects the user's pending invites and leaves the rooms that
+// they are joined to. Failing to leave one room doesn't stop us from leaving
+// the others, as the account is already deactivated by now.
+func (a *UserInternalAPI) leaveAllRooms(ctx context.Context, userID string) error {
+	logger := util.GetLogger(ctx).WithField("user_id", userID)
+	for _, membership := range []string{gomatrixserverlib.Invite, gomatrixserverlib.Join} {
+		var roomsRes rsapi.QueryRoomsForUserResponse
+		if err := a.RSAPI.QueryRoomsForUser(ctx, &rsapi.QueryRoomsForUserRequest{
+			UserID:         userID,
+			WantMembership: membership,
+		}, &roomsRes); err != nil {
+			return fmt.Errorf("a.RSAPI.QueryRoomsForUser: %w", err)
+		}
+		for _, roomID := range roomsRes.RoomIDs {
+			if err := a.RSAPI.PerformLeave(ctx, &rsapi.PerformLeaveRequest{
+				RoomID: roomID,
+				UserID: userID,
+			}, &rsapi.PerformLeaveResponse{}); err != nil {
+				logger.WithError(err).WithField("room_id", roomID).Warn("Failed to leave room of deactivated account")
+			}
+		}
+	}
+	return nil
 }
 
 // PerformOpenIDTokenCreation creates a new token that a relying party uses to authenticate a user
 func (a *UserInternalAPI) PerformOpenIDTokenCreation(ctx context.Context, req *api.PerformOpenIDTokenCreationRequest, res *api.PerformOpenIDTokenCreationResponse) error {
-	token := util.RandomString(24)
+	// The token is all that other servers need to find out who the user is,
+	// so it must not be guessable.
+	b := make([]byte, openIDTokenByteLength)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
 
 	exp, err := a.AccountDB.CreateOpenIDToken(ctx, token, req.UserID)
 
@@ -451,7 +820,10 @@ func (a *UserInternalAPI) PerformOpenIDTokenCreation(ctx context.Context, req *a
 // QueryOpenIDToken validates that the OpenID token was issued for the user, the replying party uses this for validation
 func (a *UserInternalAPI) QueryOpenIDToken(ctx context.Context, req *api.QueryOpenIDTokenRequest, res *api.QueryOpenIDTokenResponse) error {
 	openIDTokenAttrs, err := a.AccountDB.GetOpenIDTokenAttributes(ctx, req.Token)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		// The token is unknown, which the response says by having no Sub.
+		return nil
+	} else if err != nil {
 		return err
 	}
 
@@ -461,6 +833,19 @@ func (a *UserInternalAPI) QueryOpenIDToken(ctx context.Context, req *api.QueryOp
 	return nil
 }
 
+// QueryAccountByLocalpart returns the local account with the given localpart, if it exists.
+func (a *UserInternalAPI) QueryAccountByLocalpart(ctx context.Context, req *api.QueryAccountByLocalpartRequest, res *api.QueryAccountByLocalpartResponse) error {
+	acc, err := a.AccountDB.GetAccountByLocalpart(ctx, req.Localpart)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	res.Account = acc
+	return nil
+}
+
 func (a *UserInternalAPI) PerformKeyBackup(ctx context.Context, req *api.PerformKeyBackupRequest, res *api.PerformKeyBackupResponse) error {
 	// Delete metadata
 	if req.DeleteBackup {
@@ -483,6 +868,14 @@ func (a *UserInternalAPI) PerformKeyBackup(ctx context.Context, req *api.Perform
 		}
 		return nil
 	}
+	// Delete keys
+	if req.DeleteKeys {
+		a.deleteBackupKeys(ctx, req, res)
+		if res.Error != "" {
+			return fmt.Errorf(res.Error)
+		}
+		return nil
+	}
 	// Create metadata
 	if req.Version == "" {
 		version, err := a.AccountDB.CreateKeyBackup(ctx, req.UserID, req.Algorithm, req.AuthData)
@@ -556,6 +949,36 @@ func (a *UserInternalAPI) uploadBackupKeys(ctx context.Context, req *api.Perform
 	res.KeyETag = etag
 }
 
+func (a *UserInternalAPI) deleteBackupKeys(ctx context.Context, req *api.PerformKeyBackupRequest, res *api.PerformKeyBackupResponse) {
+	if req.Version == "" {
+		res.BadInput = true
+		res.Error = "must specify a version to delete keys from"
+		return
+	}
+	// unlike uploads, keys can be deleted from any version which still exists
+	version, _, _, _, deleted, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, req.Version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return
+		}
+		res.Error = fmt.Sprintf("failed to query version: %s", err)
+		return
+	}
+	if deleted {
+		return
+	}
+	res.Exists = true
+	res.Version = version
+
+	count, etag, err := a.AccountDB.DeleteBackupKeys(ctx, version, req.UserID, req.KeysForRoomID, req.KeysForSessionID)
+	if err != nil {
+		res.Error = fmt.Sprintf("failed to delete keys: %s", err)
+		return
+	}
+	res.KeyCount = count
+	res.KeyETag = etag
+}
+
 func (a *UserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyBackupRequest, res *api.QueryKeyBackupResponse) {
 	version, algorithm, authData, etag, deleted, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, req.Version)
 	res.Version = version
@@ -587,3 +1010,133 @@ func (a *UserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyB
 	}
 	res.Keys = result
 }
+
+// PerformPusherSet creates, replaces or deletes a pusher for the user. The
+// URLs of HTTP pushers must be allowed by the config, and are rewritten to
+// the Matrix gateway of UnifiedPush distributors. Pushers which aren't allowed
+// are reported in res.Error.
+func (a *UserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *api.PerformPusherSetResponse) error {
+	if req.Pusher.Kind == "" {
+		return a.AccountDB.RemovePusher(ctx, req.Pusher.AppID, req.Pusher.PushKey, req.Localpart)
+	}
+	if req.Pusher.Kind == api.HTTPKind {
+		gatewayURL, _ := req.Pusher.Data["url"].(string)
+		if err := pushgateway.CheckURL(ctx, &a.Config.PushGateways, gatewayURL); err != nil {
+			res.Error = &api.ErrorInvalidPusher{Message: "data.url " + err.Error()}
+			return nil
+		}
+		gatewayURL, err := pushgateway.DiscoverGateway(ctx, a.PushGatewayClient, gatewayURL)
+		if err != nil {
+			res.Error = &api.ErrorInvalidPusher{Message: "data.url must be a push gateway"}
+			return nil
+		}
+		req.Pusher.Data["url"] = gatewayURL
+	}
+	if !req.Append {
+		if err := a.AccountDB.RemovePushers(ctx, req.Pusher.AppID, req.Pusher.PushKey); err != nil {
+			return err
+		}
+	}
+	if req.Pusher.PushKeyTS == 0 {
+		req.Pusher.PushKeyTS = gomatrixserverlib.AsTimestamp(time.Now())
+	}
+	return a.AccountDB.UpsertPusher(ctx, req.Pusher, req.Localpart)
+}
+
+// PerformPusherDeletion removes a pusher of the user.
+func (a *UserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *api.PerformPusherDeletionResponse) error {
+	return a.AccountDB.RemovePusher(ctx, req.AppID, req.PushKey, req.Localpart)
+}
+
+// QueryPushers returns the pushers registered by the user.
+func (a *UserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	pushers, err := a.AccountDB.GetPushers(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	res.Pushers = pushers
+	return nil
+}
+
+// QueryAllPushers returns the pushers of all users which match the filter.
+func (a *UserInternalAPI) QueryAllPushers(ctx context.Context, req *api.QueryAllPushersRequest, res *api.QueryAllPushersResponse) error {
+	pushers, err := a.allPushers(ctx, &req.PusherFilter)
+	if err != nil {
+		return err
+	}
+	res.Pushers = pushers
+	return nil
+}
+
+// PerformPushersDeletion removes the pushers of all users which match the
+// filter, for example those of a push gateway which can't be trusted any more.
+func (a *UserInternalAPI) PerformPushersDeletion(ctx context.Context, req *api.PerformPushersDeletionRequest, res *api.PerformPushersDeletionResponse) error {
+	if req.IsEmpty() {
+		return errors.New("PerformPushersDeletion: refusing to remove the pushers of all users")
+	}
+	pushers, err := a.allPushers(ctx, &req.PusherFilter)
+	if err != nil {
+		return err
+	}
+	res.Pushers = []api.UserPusher{}
+	for _, pusher := range pushers {
+		if err = a.AccountDB.RemovePusher(ctx, pusher.AppID, pusher.PushKey, pusher.Localpart); err != nil {
+			return err
+		}
+		res.Pushers = append(res.Pushers, pusher)
+	}
+	return nil
+}
+
+// allPushers returns the pushers which match the filter. The database can't
+// filter on the URL, as it is part of the pusher data.
+func (a *UserInternalAPI) allPushers(ctx context.Context, filter *api.PusherFilter) ([]api.UserPusher, error) {
+	pushers, err := a.AccountDB.GetAllPushers(ctx, *filter)
+	if err != nil || filter.URL == "" {
+		return pushers, err
+	}
+	matching := []api.UserPusher{}
+	for _, pusher := range pushers {
+		if pusher.URL() == filter.URL {
+			matching = append(matching, pusher)
+		}
+	}
+	return matching, nil
+}
+
+// QueryNotifications returns a page of the user's notifications, newest first.
+func (a *UserInternalAPI) QueryNotifications(ctx context.Context, req *api.QueryNotificationsRequest, res *api.QueryNotificationsResponse) error {
+	if req.Limit <= 0 {
+		req.Limit = 50
+	} else if req.Limit > 1000 {
+		req.Limit = 1000
+	}
+
+	var fromID int64 = math.MaxInt64
+	var err error
+	if req.From != "" {
+		fromID, err = strconv.ParseInt(req.From, 10, 64)
+		if err != nil {
+			return fmt.Errorf("QueryNotifications: parsing 'from': %w", err)
+		}
+	}
+	var filter bool
+	switch req.Only {
+	case "":
+	case "highlight":
+		filter = true
+	default:
+		return fmt.Errorf("QueryNotifications: unsupported 'only' filter: %q", req.Only)
+	}
+
+	notifs, lastID, err := a.AccountDB.GetNotifications(ctx, req.Localpart, fromID, req.Limit, filter)
+	if err != nil {
+		return err
+	}
+	res.Notifications = notifs
+	if len(notifs) == req.Limit {
+		// There might be more notifications to fetch.
+		res.NextToken = strconv.FormatInt(lastID, 10)
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type deactivationRoomserverAPI struct {
+	rsapi.RoomserverInternalAPI
+	rooms map[string][]string // membership -> room IDs
+	left  []string
+}
+
+func (r *deactivationRoomserverAPI) QueryRoomsForUser(ctx context.Context, req *rsapi.QueryRoomsForUserRequest, res *rsapi.QueryRoomsForUserResponse) error {
+	res.RoomIDs = r.rooms[req.WantMembership]
+	return nil
+}
+
+func (r *deactivationRoomserverAPI) PerformLeave(ctx context.Context, req *rsapi.PerformLeaveRequest, res *rsapi.PerformLeaveResponse) error {
+	r.left = append(r.left, req.RoomID)
+	return nil
+}
+
+type deactivationKeyAPI struct {
+	keyapi.KeyInternalAPI
+	deletedKeyIDs []gomatrixserverlib.KeyID
+}
+
+func (k *deactivationKeyAPI) PerformDeleteKeys(ctx context.Context, req *keyapi.PerformDeleteKeysRequest, res *keyapi.PerformDeleteKeysResponse) {
+	k.deletedKeyIDs = append(k.deletedKeyIDs, req.KeyIDs...)
+}
+
+func (k *deactivationKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) {
+}
+
+func TestPerformAccountDeactivation(t *testing.T) {
+	tsts := []struct {
+		Name  string
+		Erase bool
+	}{
+		{"deactivate", false},
+		{"erase", true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			ctx := context.Background()
+			accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+				ConnectionString: "file::memory:",
+			}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+			if err != nil {
+				t.Fatalf("failed to create account DB: %s", err)
+			}
+			deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+				ConnectionString:   "file::memory:",
+				MaxOpenConnections: 1,
+				MaxIdleConnections: 1,
+			}, serverName)
+			if err != nil {
+				t.Fatalf("failed to create device DB: %s", err)
+			}
+			if _, err = accountDB.CreateAccount(ctx, "alice", "foobar", "", api.AccountTypeUser); err != nil {
+				t.Fatalf("failed to make account: %s", err)
+			}
+			if err = accountDB.SetDisplayName(ctx, "alice", "Alice"); err != nil {
+				t.Fatalf("failed to set display name: %s", err)
+			}
+			if _, err = deviceDB.CreateDevice(ctx, "alice", nil, "alice_token", "", 0, nil, "127.0.0.1", ""); err != nil {
+				t.Fatalf("failed to make device: %s", err)
+			}
+			if err = accountDB.SaveThreePIDAssociation(ctx, "alice@example.com", "alice", "email"); err != nil {
+				t.Fatalf("failed to save 3PID: %s", err)
+			}
+			if err = accountDB.SaveSSOIdentity(ctx, "idp", "alice-subject", "alice"); err != nil {
+				t.Fatalf("failed to save SSO identity: %s", err)
+			}
+			if err = accountDB.UpsertPusher(ctx, api.Pusher{
+				PushKey: "pushkey", Kind: api.HTTPKind, AppID: "app",
+				Data: map[string]interface{}{"url": "https://push.example.com/_matrix/push/v1/notify"},
+			}, "alice"); err != nil {
+				t.Fatalf("failed to make pusher: %s", err)
+			}
+
+			rsAPI := &deactivationRoomserverAPI{rooms: map[string][]string{
+				gomatrixserverlib.Join:   {"!joined:example.com"},
+				gomatrixserverlib.Invite: {"!invited:example.com"},
+			}}
+			userAPI := &UserInternalAPI{
+				AccountDB:  accountDB,
+				DeviceDB:   deviceDB,
+				ServerName: serverName,
+				KeyAPI:     &deactivationKeyAPI{},
+				RSAPI:      rsAPI,
+			}
+			var res api.PerformAccountDeactivationResponse
+			if err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+				Localpart: "alice",
+				Erase:     tst.Erase,
+			}, &res); err != nil {
+				t.Fatalf("PerformAccountDeactivation failed: %s", err)
+			}
+			if !res.AccountDeactivated {
+				t.Errorf("got AccountDeactivated false, want true")
+			}
+
+			if _, err = accountDB.GetAccountByPassword(ctx, "alice", "foobar"); err == nil {
+				t.Errorf("GetAccountByPassword: got nil, want an error for a deactivated account")
+			}
+			if devs, _ := deviceDB.GetDevicesByLocalpart(ctx, "alice"); len(devs) != 0 {
+				t.Errorf("got %d devices, want none", len(devs))
+			}
+			if threepids, _ := accountDB.GetThreePIDsForLocalpart(ctx, "alice"); len(threepids) != 0 {
+				t.Errorf("got 3PIDs %v, want none", threepids)
+			}
+			if localpart, _ := accountDB.GetLocalpartForSSOIdentity(ctx, "idp", "alice-subject"); localpart != "" {
+				t.Errorf("got SSO identity for %q, want none", localpart)
+			}
+			if pushers, _ := accountDB.GetPushers(ctx, "alice"); len(pushers) != 0 {
+				t.Errorf("got %d pushers, want none", len(pushers))
+			}
+			sort.Strings(rsAPI.left)
+			if want := []string{"!invited:example.com", "!joined:example.com"}; !reflect.DeepEqual(rsAPI.left, want) {
+				t.Errorf("left rooms %v, want %v", rsAPI.left, want)
+			}
+
+			erased, err := accountDB.IsUserErased(ctx, "alice")
+			if err != nil {
+				t.Fatalf("IsUserErased failed: %s", err)
+			}
+			profile, err := accountDB.GetProfileByLocalpart(ctx, "alice")
+			if err != nil {
+				t.Fatalf("GetProfileByLocalpart failed: %s", err)
+			}
+			wantDisplayName := "Alice"
+			if tst.Erase {
+				wantDisplayName = ""
+			}
+			if erased != tst.Erase || profile.DisplayName != wantDisplayName {
+				t.Errorf("got erased=%v display name %q, want erased=%v display name %q", erased, profile.DisplayName, tst.Erase, wantDisplayName)
+			}
+		})
+	}
+}
+
+func TestPerformTokenRefresh(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	a := &UserInternalAPI{
+		AccountDB:  accountDB,
+		DeviceDB:   deviceDB,
+		ServerName: serverName,
+		KeyAPI:     &deactivationKeyAPI{},
+		Config:     &config.UserAPI{RefreshableAccessTokenLifetime: time.Hour},
+	}
+
+	var createRes api.PerformDeviceCreationResponse
+	if err = a.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:   "alice",
+		AccessToken: "alice_token",
+		Refreshable: true,
+	}, &createRes); err != nil {
+		t.Fatalf("PerformDeviceCreation failed: %s", err)
+	}
+	if createRes.RefreshToken == "" || createRes.Device.AccessTokenExpiresTS == 0 {
+		t.Fatalf("got refresh token %q expiring at %d, want a refresh token and an expiry", createRes.RefreshToken, createRes.Device.AccessTokenExpiresTS)
+	}
+
+	var refreshRes api.PerformTokenRefreshResponse
+	if err = a.PerformTokenRefresh(ctx, &api.PerformTokenRefreshRequest{
+		RefreshToken: createRes.RefreshToken,
+		AccessToken:  "new_token",
+	}, &refreshRes); err != nil {
+		t.Fatalf("PerformTokenRefresh failed: %s", err)
+	}
+	if refreshRes.Device == nil || refreshRes.Device.ID != createRes.Device.ID || refreshRes.RefreshToken == "" || refreshRes.RefreshToken == createRes.RefreshToken {
+		t.Fatalf("got %+v, want the device with a new refresh token", refreshRes)
+	}
+	refreshToken := refreshRes.RefreshToken
+
+	// Refresh tokens can only be used once.
+	var usedRes api.PerformTokenRefreshResponse
+	if err = a.PerformTokenRefresh(ctx, &api.PerformTokenRefreshRequest{
+		RefreshToken: createRes.RefreshToken,
+		AccessToken:  "newer_token",
+	}, &usedRes); err != nil || usedRes.Device != nil {
+		t.Errorf("PerformTokenRefresh with a used refresh token: got %+v, %v, want no device", usedRes, err)
+	}
+
+	var queryRes api.QueryAccessTokenResponse
+	if err = a.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "new_token"}, &queryRes); err != nil {
+		t.Fatalf("QueryAccessToken failed: %s", err)
+	}
+	if queryRes.Device == nil || queryRes.SoftLogout {
+		t.Errorf("got %+v for the refreshed access token, want the device", queryRes)
+	}
+
+	// Access tokens which have expired soft logout the client.
+	a.Config.RefreshableAccessTokenLifetime = time.Nanosecond
+	refreshRes = api.PerformTokenRefreshResponse{}
+	if err = a.PerformTokenRefresh(ctx, &api.PerformTokenRefreshRequest{
+		RefreshToken: refreshToken,
+		AccessToken:  "expired_token",
+	}, &refreshRes); err != nil {
+		t.Fatalf("PerformTokenRefresh failed: %s", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	queryRes = api.QueryAccessTokenResponse{}
+	if err = a.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "expired_token"}, &queryRes); err != nil {
+		t.Fatalf("QueryAccessToken failed: %s", err)
+	}
+	if queryRes.Device != nil || !queryRes.SoftLogout {
+		t.Errorf("got %+v for an expired access token, want a soft logout", queryRes)
+	}
+
+	// Access tokens which are refreshed once refresh tokens are disabled
+	// don't expire.
+	a.Config.RefreshableAccessTokenLifetime = 0
+	refreshToken = refreshRes.RefreshToken
+	refreshRes = api.PerformTokenRefreshResponse{}
+	if err = a.PerformTokenRefresh(ctx, &api.PerformTokenRefreshRequest{
+		RefreshToken: refreshToken,
+		AccessToken:  "final_token",
+	}, &refreshRes); err != nil {
+		t.Fatalf("PerformTokenRefresh failed: %s", err)
+	}
+	if refreshRes.Device == nil || refreshRes.Device.AccessTokenExpiresTS != 0 || refreshRes.RefreshToken != "" {
+		t.Errorf("got %+v, want an access token which doesn't expire", refreshRes)
+	}
+}
+
+func TestQueryDeviceConnections(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	userAPI := &UserInternalAPI{
+		AccountDB:  accountDB,
+		DeviceDB:   deviceDB,
+		ServerName: serverName,
+		KeyAPI:     &deactivationKeyAPI{},
+		Config:     &config.UserAPI{},
+	}
+	var devRes api.PerformDeviceCreationResponse
+	if err = userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:   "alice",
+		AccessToken: "alice_token",
+	}, &devRes); err != nil {
+		t.Fatalf("PerformDeviceCreation failed: %s", err)
+	}
+	for _, conn := range []api.DeviceConnection{
+		{IP: "10.0.0.1", UserAgent: "Element"},
+		{IP: "10.0.0.2", UserAgent: "Element"},
+		{IP: "10.0.0.1", UserAgent: "Element"},
+	} {
+		if err = userAPI.PerformLastSeenUpdate(ctx, &api.PerformLastSeenUpdateRequest{
+			UserID:     devRes.Device.UserID,
+			DeviceID:   devRes.Device.ID,
+			RemoteAddr: conn.IP,
+			UserAgent:  conn.UserAgent,
+		}, &api.PerformLastSeenUpdateResponse{}); err != nil {
+			t.Fatalf("PerformLastSeenUpdate failed: %s", err)
+		}
+	}
+	connections := func() []api.DeviceConnection {
+		var res api.QueryDeviceConnectionsResponse
+		if err = userAPI.QueryDeviceConnections(ctx, &api.QueryDeviceConnectionsRequest{
+			UserID: devRes.Device.UserID,
+		}, &res); err != nil {
+			t.Fatalf("QueryDeviceConnections failed: %s", err)
+		}
+		return res.Connections[devRes.Device.ID]
+	}
+	got := connections()
+	ips := map[string]bool{}
+	for _, conn := range got {
+		ips[conn.IP] = conn.UserAgent == "Element" && conn.LastSeenTS > 0
+	}
+	if len(got) != 2 || !ips["10.0.0.1"] || !ips["10.0.0.2"] {
+		t.Errorf("got connections %+v, want one for each IP address", got)
+	}
+
+	if err = userAPI.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
+		UserID: devRes.Device.UserID,
+	}, &api.PerformDeviceDeletionResponse{}); err != nil {
+		t.Fatalf("PerformDeviceDeletion failed: %s", err)
+	}
+	if got = connections(); len(got) != 0 {
+		t.Errorf("got connections %+v for a removed device, want none", got)
+	}
+}
+
+func TestQuerySearchUserDirectory(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	for _, localpart := range []string{"alice", "bob", "erin"} {
+		if _, err = accountDB.CreateAccount(ctx, localpart, "", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+	}
+	if err = accountDB.UpdateUserDirectory(ctx, "!room1:example.com", false, []authtypes.FullyQualifiedProfile{
+		{UserID: "@alice:example.com", DisplayName: "Alice"},
+		{UserID: "@bob:example.com", DisplayName: "Bob"},
+		{UserID: "@carol:remote.com", DisplayName: "Caroline", AvatarURL: "mxc://remote.com/carol"},
+		{UserID: "@frank:remote.com", DisplayName: "Frank"},
+	}, nil); err != nil {
+		t.Fatalf("UpdateUserDirectory failed: %s", err)
+	}
+	if err = accountDB.UpdateUserDirectory(ctx, "!room2:example.com", false, []authtypes.FullyQualifiedProfile{
+		{UserID: "@erin:example.com", DisplayName: "Erin"},
+		{UserID: "@dave:remote.com", DisplayName: "Dave"},
+	}, nil); err != nil {
+		t.Fatalf("UpdateUserDirectory failed: %s", err)
+	}
+	// Frank left the room that Alice is in.
+	if err = accountDB.UpdateUserDirectory(ctx, "!room1:example.com", false, nil, []string{"@frank:remote.com"}); err != nil {
+		t.Fatalf("UpdateUserDirectory failed: %s", err)
+	}
+
+	tsts := []struct {
+		Name          string
+		UserDirectory config.UserDirectory
+		SearchString  string
+		Limit         int
+		WantUserIDs   []string
+		WantLimited   bool
+	}{
+		{"remoteUser", config.UserDirectory{IncludeRemoteUsers: true}, "CAROL", 10, []string{"@carol:remote.com"}, false},
+		{"remoteUserByDisplayName", config.UserDirectory{IncludeRemoteUsers: true}, "line", 10, []string{"@carol:remote.com"}, false},
+		{"remoteUsersExcluded", config.UserDirectory{}, "carol", 10, nil, false},
+		{"remoteUserLeft", config.UserDirectory{IncludeRemoteUsers: true}, "frank", 10, nil, false},
+		{"noSharedRoom", config.UserDirectory{IncludeRemoteUsers: true}, "dave", 10, nil, false},
+		{"allLocalUsers", config.UserDirectory{SearchAllLocalUsers: true}, "erin", 10, []string{"@erin:example.com"}, false},
+		{"localUserInSharedRoom", config.UserDirectory{}, "bob", 10, []string{"@bob:example.com"}, false},
+		{"localUserWithoutSharedRoom", config.UserDirectory{}, "erin", 10, nil, false},
+		{"limited", config.UserDirectory{SearchAllLocalUsers: true, IncludeRemoteUsers: true}, "", 3, []string{"@alice:example.com", "@bob:example.com", "@erin:example.com"}, true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			a := &UserInternalAPI{
+				AccountDB:  accountDB,
+				ServerName: serverName,
+				Config:     &config.UserAPI{UserDirectory: tst.UserDirectory},
+			}
+			var res api.QuerySearchUserDirectoryResponse
+			if err := a.QuerySearchUserDirectory(ctx, &api.QuerySearchUserDirectoryRequest{
+				UserID:       "@alice:example.com",
+				SearchString: tst.SearchString,
+				Limit:        tst.Limit,
+			}, &res); err != nil {
+				t.Fatalf("QuerySearchUserDirectory failed: %s", err)
+			}
+			var userIDs []string
+			for _, profile := range res.Results {
+				userIDs = append(userIDs, profile.UserID)
+			}
+			if !reflect.DeepEqual(userIDs, tst.WantUserIDs) || res.Limited != tst.WantLimited {
+				t.Errorf("got %v (limited %v), want %v (limited %v)", userIDs, res.Limited, tst.WantUserIDs, tst.WantLimited)
+			}
+		})
+	}
+}
+
+func TestPerformDeviceDeletionDeletesKeys(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	keyAPI := &deactivationKeyAPI{}
+	userAPI := &UserInternalAPI{
+		AccountDB:  accountDB,
+		DeviceDB:   deviceDB,
+		ServerName: serverName,
+		KeyAPI:     keyAPI,
+		Config:     &config.UserAPI{},
+	}
+	for _, deviceID := range []string{"A", "B", "C"} {
+		deviceID := deviceID
+		if err = userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart:   "alice",
+			DeviceID:    &deviceID,
+			AccessToken: "alice_token_" + deviceID,
+		}, &api.PerformDeviceCreationResponse{}); err != nil {
+			t.Fatalf("PerformDeviceCreation failed: %s", err)
+		}
+	}
+
+	// The keys of every deleted device go, even when the devices to delete
+	// aren't listed.
+	if err = userAPI.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
+		UserID:         "@alice:" + string(serverName),
+		ExceptDeviceID: "B",
+	}, &api.PerformDeviceDeletionResponse{}); err != nil {
+		t.Fatalf("PerformDeviceDeletion failed: %s", err)
+	}
+	sort.Slice(keyAPI.deletedKeyIDs, func(i, j int) bool { return keyAPI.deletedKeyIDs[i] < keyAPI.deletedKeyIDs[j] })
+	if want := []gomatrixserverlib.KeyID{"A", "C"}; !reflect.DeepEqual(keyAPI.deletedKeyIDs, want) {
+		t.Errorf("got keys of %v deleted, want %v", keyAPI.deletedKeyIDs, want)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// loginThrottleSweepInterval is how often the failures which are too old to
+// matter any more are forgotten.
+const loginThrottleSweepInterval = time.Minute
+
+func init() {
+	prometheus.MustRegister(failedLogins, throttledLogins, loginLockouts)
+}
+
+var (
+	failedLogins = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "userapi",
+			Name:      "failed_logins_total",
+			Help:      "The number of password logins which failed",
+		},
+	)
+	throttledLogins = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "userapi",
+			Name:      "throttled_logins_total",
+			Help:      "The number of password logins which were refused because of earlier failures",
+		},
+		[]string{"by"},
+	)
+	loginLockouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "userapi",
+			Name:      "login_lockouts_total",
+			Help:      "The number of times that an account or IP address was locked out of logging in",
+		},
+		[]string{"by"},
+	)
+)
+
+// loginFailures is how many logins have failed in a row for an account or IP
+// address, and when the last one did.
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+// retryAfter returns how long a client has to wait before it can try to log
+// in again at the given time.
+func (f *loginFailures) retryAfter(limits *config.LoginThrottleLimits, now time.Time) time.Duration {
+	var wait time.Duration
+	switch {
+	case f.count >= limits.LockoutAfter:
+		wait = limits.LockoutDuration
+	case f.count >= limits.DelayAfter:
+		wait = limits.BaseDelay
+		for i := limits.DelayAfter; i < f.count && wait < limits.LockoutDuration; i++ {
+			wait *= 2
+		}
+		if wait > limits.LockoutDuration {
+			wait = limits.LockoutDuration
+		}
+	}
+	if wait -= now.Sub(f.last); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// LoginThrottle counts the failed password logins to each account and from
+// each IP address, and works out how long clients have to wait before they
+// can try again.
+type LoginThrottle struct {
+	cfg       *config.LoginThrottle
+	mu        sync.Mutex
+	accounts  map[string]*loginFailures // localpart -> failures
+	ips       map[string]*loginFailures // IP address -> failures
+	lastSwept time.Time
+}
+
+// NewLoginThrottle returns a LoginThrottle with the limits in the config.
+func NewLoginThrottle(cfg *config.LoginThrottle) *LoginThrottle {
+	return &LoginThrottle{
+		cfg:      cfg,
+		accounts: make(map[string]*loginFailures),
+		ips:      make(map[string]*loginFailures),
+	}
+}
+
+// attempt works out how long the client has to wait before it can try to log
+// in to the account from the IP address. If it can try now, the attempt is
+// counted as a failure straight away, so that concurrent attempts can't all
+// get through before any of them fail, until result says otherwise.
+func (l *LoginThrottle) attempt(localpart, ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSwept) >= loginThrottleSweepInterval {
+		l.sweep(now)
+	}
+	var accountWait, ipWait time.Duration
+	if f, ok := l.accounts[localpart]; ok {
+		accountWait = f.retryAfter(&l.cfg.Account, now)
+	}
+	if f, ok := l.ips[ip]; ok && ip != "" {
+		ipWait = f.retryAfter(&l.cfg.IP, now)
+	}
+	switch {
+	case ipWait > accountWait:
+		throttledLogins.WithLabelValues("ip").Inc()
+		return ipWait
+	case accountWait > 0:
+		throttledLogins.WithLabelValues("account").Inc()
+		return accountWait
+	}
+	addFailure(l.accounts, localpart, &l.cfg.Account, "account", now)
+	if ip != "" {
+		addFailure(l.ips, ip, &l.cfg.IP, "ip", now)
+	}
+	return 0
+}
+
+// result records whether an attempt which was let through succeeded. Logging
+// in successfully forgets the failures of the account, but only takes back
+// the failure counted for the attempt from the IP address, so that an
+// attacker can't reset them with their own account.
+func (l *LoginThrottle) result(localpart, ip string, success bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !success {
+		failedLogins.Inc()
+		return
+	}
+	delete(l.accounts, localpart)
+	if f, ok := l.ips[ip]; ok && f.count > 0 {
+		f.count--
+	}
+}
+
+// sweep forgets the failures which were long enough ago that they no longer
+// make clients wait.
+func (l *LoginThrottle) sweep(now time.Time) {
+	for localpart, f := range l.accounts {
+		if now.Sub(f.last) >= l.cfg.Account.LockoutDuration {
+			delete(l.accounts, localpart)
+		}
+	}
+	for ip, f := range l.ips {
+		if now.Sub(f.last) >= l.cfg.IP.LockoutDuration {
+			delete(l.ips, ip)
+		}
+	}
+	l.lastSwept = now
+}
+
+func addFailure(failures map[string]*loginFailures, key string, limits *config.LoginThrottleLimits, by string, now time.Time) {
+	f, ok := failures[key]
+	if !ok || now.Sub(f.last) >= limits.LockoutDuration {
+		f = &loginFailures{}
+		failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count == limits.LockoutAfter {
+		loginLockouts.WithLabelValues(by).Inc()
+	}
+}
+
+// PerformLoginAttempt says how long the client has to wait before it can try
+// to log in to the account, because of earlier failed logins. If it doesn't
+// have to wait, the attempt is counted until PerformLoginResult is called.
+func (a *UserInternalAPI) PerformLoginAttempt(ctx context.Context, req *api.PerformLoginAttemptRequest, res *api.PerformLoginAttemptResponse) error {
+	if a.LoginThrottle == nil {
+		return nil
+	}
+	wait := a.LoginThrottle.attempt(req.Localpart, req.RemoteAddr, time.Now())
+	// Round up, so that clients aren't told to try again before they can.
+	res.RetryAfterMS = int64((wait + time.Millisecond - 1) / time.Millisecond)
+	return nil
+}
+
+// PerformLoginResult records whether a password login to the account
+// succeeded, so that clients have to wait longer after each failure.
+func (a *UserInternalAPI) PerformLoginResult(ctx context.Context, req *api.PerformLoginResultRequest, res *api.PerformLoginResultResponse) error {
+	if a.LoginThrottle == nil {
+		return nil
+	}
+	a.LoginThrottle.result(req.Localpart, req.RemoteAddr, req.Success)
+	return nil
+}
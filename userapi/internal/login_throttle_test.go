@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	cfg := &config.LoginThrottle{
+		Enabled: true,
+		Account: config.LoginThrottleLimits{
+			DelayAfter:      2,
+			BaseDelay:       time.Second,
+			LockoutAfter:    5,
+			LockoutDuration: time.Minute,
+		},
+		IP: config.LoginThrottleLimits{
+			DelayAfter:      3,
+			BaseDelay:       time.Second,
+			LockoutAfter:    10,
+			LockoutDuration: 10 * time.Minute,
+		},
+	}
+	l := NewLoginThrottle(cfg)
+	now := time.Now()
+	fail := func(localpart, ip string, at time.Time) {
+		if got := l.attempt(localpart, ip, at); got != 0 {
+			t.Fatalf("got wait %s for %s from %s, want none", got, localpart, ip)
+		}
+		l.result(localpart, ip, false)
+	}
+
+	// Clients have to wait after the first failures, twice as long after
+	// each one, until the account is locked out. Attempts which have to
+	// wait aren't counted.
+	at := now
+	fail("alice", "10.0.0.1", at)
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, time.Minute} {
+		fail("alice", "10.0.0.1", at)
+		if got := l.attempt("alice", "10.0.0.2", at); got != want {
+			t.Errorf("after %d failures: got wait %s, want %s", i+2, got, want)
+		}
+		if want < time.Minute {
+			at = at.Add(want)
+		}
+	}
+	if got := l.attempt("alice", "10.0.0.2", at.Add(40*time.Second)); got != 20*time.Second {
+		t.Errorf("got wait %s during the lockout, want 20s", got)
+	}
+
+	// The failures from the IP address count against other accounts too.
+	if got := l.attempt("bob", "10.0.0.1", at); got != 4*time.Second {
+		t.Errorf("got wait %s for another account from the same IP address, want 4s", got)
+	}
+
+	// Logging in forgets the failures of the account, but not those of the
+	// IP address.
+	at = at.Add(time.Minute)
+	if got := l.attempt("alice", "10.0.0.1", at); got != 0 {
+		t.Errorf("got wait %s after the lockout, want none", got)
+	}
+	l.result("alice", "10.0.0.1", true)
+	if n := l.accounts["alice"]; n != nil {
+		t.Errorf("got failures %+v after logging in, want none", n)
+	}
+	if got := l.attempt("bob", "10.0.0.1", at); got != 4*time.Second {
+		t.Errorf("got wait %s from the IP address after logging in, want 4s", got)
+	}
+
+	// Attempts count as failures until their results are known, so that
+	// clients can't get around the throttle by making lots at once.
+	fail("carol", "10.0.0.4", now)
+	if got := l.attempt("carol", "10.0.0.4", now); got != 0 {
+		t.Errorf("got wait %s for the second attempt, want none", got)
+	}
+	if got := l.attempt("carol", "10.0.0.4", now); got != time.Second {
+		t.Errorf("got wait %s while the second attempt is pending, want 1s", got)
+	}
+
+	// Old failures are forgotten.
+	fail("dave", "10.0.0.5", at.Add(10*time.Minute))
+	if len(l.accounts) != 1 || len(l.ips) != 1 {
+		t.Errorf("got failures for %d accounts and %d IP addresses, want only those of dave", len(l.accounts), len(l.ips))
+	}
+}
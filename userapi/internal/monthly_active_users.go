@@ -0,0 +1,125 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// monthlyActiveUserWindow is how recently users must have been active to
+	// be counted as monthly active users. This matches Synapse.
+	monthlyActiveUserWindow = time.Hour * 24 * 30
+	// monthlyActiveUsersInterval is how often the metric is updated and the
+	// users who are no longer active are removed.
+	monthlyActiveUsersInterval = time.Minute * 5
+)
+
+func init() {
+	prometheus.MustRegister(monthlyActiveUsers)
+}
+
+var monthlyActiveUsers = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "userapi",
+		Name:      "monthly_active_users",
+		Help:      "The number of users who have been active in the last 30 days",
+	},
+)
+
+// monthlyActiveSince returns the time that users must have been active since
+// to be monthly active users at the given time.
+func monthlyActiveSince(now time.Time) gomatrixserverlib.Timestamp {
+	return gomatrixserverlib.AsTimestamp(now.Add(-monthlyActiveUserWindow))
+}
+
+// MonthlyActiveUserStats keeps the monthly active users metric up to date, and
+// forgets the users who haven't been active for a month.
+type MonthlyActiveUserStats struct {
+	AccountDB accounts.Database
+}
+
+// Start updates the metric on a fixed interval. It does not return, so should
+// be run in a goroutine.
+func (m *MonthlyActiveUserStats) Start() {
+	for {
+		if err := m.update(context.Background(), time.Now()); err != nil {
+			logrus.WithError(err).Error("Failed to update the monthly active users")
+		}
+		time.Sleep(monthlyActiveUsersInterval)
+	}
+}
+
+func (m *MonthlyActiveUserStats) update(ctx context.Context, now time.Time) error {
+	since := monthlyActiveSince(now)
+	if err := m.AccountDB.RemoveInactiveUsers(ctx, since); err != nil {
+		return fmt.Errorf("m.AccountDB.RemoveInactiveUsers: %w", err)
+	}
+	count, err := m.AccountDB.CountMonthlyActiveUsers(ctx, since)
+	if err != nil {
+		return fmt.Errorf("m.AccountDB.CountMonthlyActiveUsers: %w", err)
+	}
+	monthlyActiveUsers.Set(float64(count))
+	return nil
+}
+
+// markMonthlyActive records that the user is active now.
+func (a *UserInternalAPI) markMonthlyActive(ctx context.Context, localpart string) error {
+	return a.AccountDB.UpsertMonthlyActiveUser(ctx, localpart, gomatrixserverlib.AsTimestamp(time.Now()))
+}
+
+// QueryMonthlyActiveUsers counts the monthly active users, and says whether
+// the configured limit on them stops the user in the request from logging in
+// or registering. Users who are already active aren't stopped by it.
+func (a *UserInternalAPI) QueryMonthlyActiveUsers(ctx context.Context, req *api.QueryMonthlyActiveUsersRequest, res *api.QueryMonthlyActiveUsersResponse) error {
+	since := monthlyActiveSince(time.Now())
+	count, err := a.AccountDB.CountMonthlyActiveUsers(ctx, since)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.CountMonthlyActiveUsers: %w", err)
+	}
+	res.Count = count
+	res.Limit = a.Config.MonthlyActiveUsers.Limit
+	res.AdminContact = a.Config.MonthlyActiveUsers.AdminContact
+	if res.Limit == 0 || count < res.Limit {
+		return nil
+	}
+	if req.UserID != "" {
+		localpart, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+		if err != nil {
+			return err
+		}
+		if domain != a.ServerName {
+			return fmt.Errorf("cannot QueryMonthlyActiveUsers of remote users: got %s want %s", domain, a.ServerName)
+		}
+		active, err := a.AccountDB.IsMonthlyActiveUser(ctx, localpart, since)
+		if err != nil {
+			return fmt.Errorf("a.AccountDB.IsMonthlyActiveUser: %w", err)
+		}
+		if active {
+			return nil
+		}
+	}
+	res.LimitExceeded = true
+	return nil
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMonthlyActiveUsers(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	a := &UserInternalAPI{
+		AccountDB:  accountDB,
+		DeviceDB:   deviceDB,
+		ServerName: serverName,
+		KeyAPI:     &deactivationKeyAPI{},
+		Config: &config.UserAPI{
+			MonthlyActiveUsers: config.MonthlyActiveUsers{
+				Limit:        2,
+				AdminContact: "mailto:admin@example.com",
+			},
+		},
+	}
+
+	// Alice was last active more than a month ago, Bob logs in and Carol
+	// syncs.
+	lastActive := gomatrixserverlib.AsTimestamp(time.Now().Add(-monthlyActiveUserWindow - time.Hour))
+	if err = accountDB.UpsertMonthlyActiveUser(ctx, "alice", lastActive); err != nil {
+		t.Fatalf("UpsertMonthlyActiveUser failed: %s", err)
+	}
+	if err = a.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:          "bob",
+		AccessToken:        "bob_token",
+		NoDeviceListUpdate: true,
+	}, &api.PerformDeviceCreationResponse{}); err != nil {
+		t.Fatalf("PerformDeviceCreation failed: %s", err)
+	}
+	if err = a.PerformLastSeenUpdate(ctx, &api.PerformLastSeenUpdateRequest{
+		UserID:   "@carol:" + string(serverName),
+		DeviceID: "CAROLDEVICE",
+	}, &api.PerformLastSeenUpdateResponse{}); err != nil {
+		t.Fatalf("PerformLastSeenUpdate failed: %s", err)
+	}
+
+	tsts := []struct {
+		Name              string
+		UserID            string
+		WantLimitExceeded bool
+	}{
+		{"newUser", "", true},
+		{"activeUser", "@bob:" + string(serverName), false},
+		{"inactiveUser", "@alice:" + string(serverName), true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			var res api.QueryMonthlyActiveUsersResponse
+			if err := a.QueryMonthlyActiveUsers(ctx, &api.QueryMonthlyActiveUsersRequest{UserID: tst.UserID}, &res); err != nil {
+				t.Fatalf("QueryMonthlyActiveUsers failed: %s", err)
+			}
+			want := api.QueryMonthlyActiveUsersResponse{
+				Count:         2,
+				Limit:         2,
+				LimitExceeded: tst.WantLimitExceeded,
+				AdminContact:  "mailto:admin@example.com",
+			}
+			if res != want {
+				t.Errorf("got %+v, want %+v", res, want)
+			}
+		})
+	}
+
+	// Without a limit nobody is refused.
+	a.Config.MonthlyActiveUsers.Limit = 0
+	var res api.QueryMonthlyActiveUsersResponse
+	if err = a.QueryMonthlyActiveUsers(ctx, &api.QueryMonthlyActiveUsersRequest{}, &res); err != nil {
+		t.Fatalf("QueryMonthlyActiveUsers failed: %s", err)
+	}
+	if res.LimitExceeded {
+		t.Errorf("got %+v without a limit, want the limit not to be exceeded", res)
+	}
+
+	stats := &MonthlyActiveUserStats{AccountDB: accountDB}
+	if err = stats.update(ctx, time.Now()); err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	if got := testutil.ToFloat64(monthlyActiveUsers); got != 2 {
+		t.Errorf("got %v monthly active users in the metric, want 2", got)
+	}
+	if active, err := accountDB.IsMonthlyActiveUser(ctx, "alice", 0); err != nil || active {
+		t.Errorf("IsMonthlyActiveUser: got %v, %v, want the inactive user to be removed", active, err)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// phoneHomeInitialDelay is how long to wait after startup before sending the
+	// first report, so that short-lived test instances don't report anything.
+	phoneHomeInitialDelay = time.Minute * 5
+	// phoneHomeInterval is how often reports are sent after the first one. This
+	// matches the interval used by Synapse.
+	phoneHomeInterval = time.Hour * 3
+)
+
+// phoneHomeReport is the body of a usage statistics report. The field names
+// follow the ones used by Synapse so that the same endpoint can consume both.
+type phoneHomeReport struct {
+	Homeserver           gomatrixserverlib.ServerName `json:"homeserver"`
+	Timestamp            int64                        `json:"timestamp"`
+	UptimeSeconds        int64                        `json:"uptime_seconds"`
+	Version              string                       `json:"version"`
+	GoVersion            string                       `json:"go_version"`
+	GoOS                 string                       `json:"go_os"`
+	GoArch               string                       `json:"go_arch"`
+	DatabaseEngine       string                       `json:"database_engine"`
+	FederationDisabled   bool                         `json:"federation_disabled"`
+	TotalUsers           int64                        `json:"total_users"`
+	TotalNonBridgedUsers int64                        `json:"total_nonbridged_users"`
+	DailyActiveUsers     int64                        `json:"daily_active_users"`
+	MonthlyActiveUsers   int64                        `json:"monthly_active_users"`
+	TotalRoomCount       int64                        `json:"total_room_count"`
+	LocalJoinedRoomCount int64                        `json:"local_joined_room_count"`
+}
+
+// PhoneHomeStats periodically reports anonymous usage statistics to the
+// endpoint configured in global.report_stats.
+type PhoneHomeStats struct {
+	Cfg       *config.UserAPI
+	AccountDB accounts.Database
+	DeviceDB  devices.Database
+	RSAPI     rsapi.RoomserverInternalAPI
+	Client    *http.Client
+	StartTime time.Time
+}
+
+// Start sends the first report after a short delay and then continues to
+// send reports on a fixed interval. It does not return, so should be run
+// in a goroutine.
+func (p *PhoneHomeStats) Start() {
+	time.Sleep(phoneHomeInitialDelay)
+	p.collectAndSend()
+	ticker := time.NewTicker(phoneHomeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.collectAndSend()
+	}
+}
+
+func (p *PhoneHomeStats) collectAndSend() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	logger := logrus.WithField("endpoint", p.Cfg.Matrix.ReportStats.Endpoint)
+	report, err := p.collect(ctx)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to collect usage statistics")
+		return
+	}
+	if err = p.send(ctx, report); err != nil {
+		logger.WithError(err).Warn("Failed to send usage statistics")
+		return
+	}
+	logger.Info("Sent usage statistics")
+}
+
+func (p *PhoneHomeStats) collect(ctx context.Context) (*phoneHomeReport, error) {
+	now := time.Now()
+	report := &phoneHomeReport{
+		Homeserver:         p.Cfg.Matrix.ServerName,
+		Timestamp:          now.Unix(),
+		UptimeSeconds:      int64(now.Sub(p.StartTime).Seconds()),
+		Version:            internal.VersionString(),
+		GoVersion:          runtime.Version(),
+		GoOS:               runtime.GOOS,
+		GoArch:             runtime.GOARCH,
+		DatabaseEngine:     "postgres",
+		FederationDisabled: p.Cfg.Matrix.DisableFederation,
+	}
+	if p.Cfg.AccountDatabase.ConnectionString.IsSQLite() {
+		report.DatabaseEngine = "sqlite"
+	}
+
+	var err error
+	if report.TotalUsers, report.TotalNonBridgedUsers, err = p.AccountDB.CountAccounts(ctx); err != nil {
+		return nil, fmt.Errorf("p.AccountDB.CountAccounts: %w", err)
+	}
+	nowMS := now.UnixNano() / int64(time.Millisecond)
+	dayMS := int64(24 * time.Hour / time.Millisecond)
+	if report.DailyActiveUsers, err = p.DeviceDB.CountActiveUsers(ctx, nowMS-dayMS); err != nil {
+		return nil, fmt.Errorf("p.DeviceDB.CountActiveUsers: %w", err)
+	}
+	if report.MonthlyActiveUsers, err = p.DeviceDB.CountActiveUsers(ctx, nowMS-30*dayMS); err != nil {
+		return nil, fmt.Errorf("p.DeviceDB.CountActiveUsers: %w", err)
+	}
+
+	var roomRes rsapi.QueryRoomStatisticsResponse
+	if err = p.RSAPI.QueryRoomStatistics(ctx, &rsapi.QueryRoomStatisticsRequest{}, &roomRes); err != nil {
+		return nil, fmt.Errorf("p.RSAPI.QueryRoomStatistics: %w", err)
+	}
+	report.TotalRoomCount = roomRes.TotalRooms
+	report.LocalJoinedRoomCount = roomRes.LocalJoinedRooms
+
+	return report, nil
+}
+
+func (p *PhoneHomeStats) send(ctx context.Context, report *phoneHomeReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Cfg.Matrix.ReportStats.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Dendrite/"+internal.VersionString())
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("p.Client.Do: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, res.Body, "PhoneHomeStats: res.Body.Close() failed")
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const serverName = gomatrixserverlib.ServerName("example.com")
+
+type statsRoomserverAPI struct {
+	rsapi.RoomserverInternalAPI
+}
+
+func (r *statsRoomserverAPI) QueryRoomStatistics(ctx context.Context, req *rsapi.QueryRoomStatisticsRequest, res *rsapi.QueryRoomStatisticsResponse) error {
+	res.TotalRooms = 5
+	res.LocalJoinedRooms = 3
+	return nil
+}
+
+func TestPhoneHomeStats(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+
+	if _, err = accountDB.CreateAccount(ctx, "alice", "foobar", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(ctx, "bridge", "", "irc", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	if _, err = accountDB.CreateGuestAccount(ctx); err != nil {
+		t.Fatalf("failed to make guest account: %s", err)
+	}
+	if _, err = deviceDB.CreateDevice(ctx, "alice", nil, "alice_token", "", 0, nil, "127.0.0.1", ""); err != nil {
+		t.Fatalf("failed to make device: %s", err)
+	}
+
+	var got phoneHomeReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			t.Errorf("expected POST, got %s", req.Method)
+		}
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode report: %s", err)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &config.UserAPI{
+		AccountDatabase: config.DatabaseOptions{
+			ConnectionString: "file::memory:",
+		},
+		Matrix: &config.Global{
+			ServerName: serverName,
+			ReportStats: config.ReportStats{
+				Enabled:  true,
+				Endpoint: srv.URL,
+			},
+		},
+	}
+	p := &PhoneHomeStats{
+		Cfg:       cfg,
+		AccountDB: accountDB,
+		DeviceDB:  deviceDB,
+		RSAPI:     &statsRoomserverAPI{},
+		Client:    srv.Client(),
+		StartTime: time.Now(),
+	}
+	report, err := p.collect(ctx)
+	if err != nil {
+		t.Fatalf("failed to collect stats: %s", err)
+	}
+	if err = p.send(ctx, report); err != nil {
+		t.Fatalf("failed to send stats: %s", err)
+	}
+
+	want := phoneHomeReport{
+		Homeserver:           serverName,
+		DatabaseEngine:       "sqlite",
+		TotalUsers:           2,
+		TotalNonBridgedUsers: 1,
+		DailyActiveUsers:     1,
+		MonthlyActiveUsers:   1,
+		TotalRoomCount:       5,
+		LocalJoinedRoomCount: 3,
+	}
+	if got.Homeserver != want.Homeserver || got.DatabaseEngine != want.DatabaseEngine ||
+		got.TotalUsers != want.TotalUsers || got.TotalNonBridgedUsers != want.TotalNonBridgedUsers ||
+		got.DailyActiveUsers != want.DailyActiveUsers || got.MonthlyActiveUsers != want.MonthlyActiveUsers ||
+		got.TotalRoomCount != want.TotalRoomCount || got.LocalJoinedRoomCount != want.LocalJoinedRoomCount {
+		t.Fatalf("unexpected report: got %+v want %+v", got, want)
+	}
+}
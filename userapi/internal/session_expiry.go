@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionExpiryInterval is how often the devices which have been
+// soft-logged-out for longer than the retention period are deleted.
+const sessionExpiryInterval = time.Hour
+
+// sessionExpired returns whether the device has gone unused for longer than
+// the configured idle lifetime, so that it is soft-logged-out.
+func sessionExpired(cfg *config.SessionExpiry, device *api.Device, now time.Time) bool {
+	if cfg.IdleLifetime <= 0 {
+		return false
+	}
+	return device.LastSeenTS < int64(gomatrixserverlib.AsTimestamp(now.Add(-cfg.IdleLifetime)))
+}
+
+// SessionExpiry deletes the devices which have been soft-logged-out for
+// longer than the retention period, along with their keys.
+type SessionExpiry struct {
+	Cfg     *config.SessionExpiry
+	UserAPI *UserInternalAPI
+}
+
+// Start deletes the expired devices on a fixed interval. It does not return,
+// so should be run in a goroutine.
+func (s *SessionExpiry) Start() {
+	for {
+		if err := s.deleteExpiredDevices(context.Background(), time.Now()); err != nil {
+			logrus.WithError(err).Error("Failed to delete expired devices")
+		}
+		time.Sleep(sessionExpiryInterval)
+	}
+}
+
+func (s *SessionExpiry) deleteExpiredDevices(ctx context.Context, now time.Time) error {
+	before := gomatrixserverlib.AsTimestamp(now.Add(-s.Cfg.IdleLifetime - s.Cfg.Retention))
+	devices, err := s.UserAPI.DeviceDB.GetDevicesLastSeenBefore(ctx, int64(before))
+	if err != nil {
+		return fmt.Errorf("s.UserAPI.DeviceDB.GetDevicesLastSeenBefore: %w", err)
+	}
+	deviceIDs := make(map[string][]string) // user ID -> device IDs
+	for _, dev := range devices {
+		deviceIDs[dev.UserID] = append(deviceIDs[dev.UserID], dev.ID)
+	}
+	for userID, ids := range deviceIDs {
+		// Deleting them like this also deletes their keys, and tells the
+		// users' other devices that they are gone.
+		if err = s.UserAPI.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
+			UserID:    userID,
+			DeviceIDs: ids,
+		}, &api.PerformDeviceDeletionResponse{}); err != nil {
+			return fmt.Errorf("s.UserAPI.PerformDeviceDeletion: %w", err)
+		}
+	}
+	if len(devices) > 0 {
+		logrus.WithField("devices", len(devices)).Info("Deleted expired devices")
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSessionExpiry(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	// Deleting devices by ID doesn't work with an in-memory database.
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(t.TempDir(), "devices.db")),
+	}, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	keyAPI := &deactivationKeyAPI{}
+	a := &UserInternalAPI{
+		AccountDB:  accountDB,
+		DeviceDB:   deviceDB,
+		ServerName: serverName,
+		KeyAPI:     keyAPI,
+		Config: &config.UserAPI{
+			SessionExpiry: config.SessionExpiry{
+				IdleLifetime: time.Hour,
+				Retention:    time.Hour,
+			},
+		},
+	}
+	for _, localpart := range []string{"alice", "bob"} {
+		if err = a.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart:   localpart,
+			AccessToken: localpart + "_token",
+		}, &api.PerformDeviceCreationResponse{}); err != nil {
+			t.Fatalf("PerformDeviceCreation failed: %s", err)
+		}
+	}
+	// Dehydrated devices aren't used until they are claimed, so they don't
+	// expire.
+	var dehydrateRes api.PerformDeviceDehydrationResponse
+	if err = a.PerformDeviceDehydration(ctx, &api.PerformDeviceDehydrationRequest{
+		UserID:     "@alice:" + string(serverName),
+		DeviceData: []byte(`{"algorithm": "m.dehydration.v1.olm"}`),
+	}, &dehydrateRes); err != nil {
+		t.Fatalf("PerformDeviceDehydration failed: %s", err)
+	}
+
+	var res api.QueryAccessTokenResponse
+	if err = a.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "alice_token"}, &res); err != nil {
+		t.Fatalf("QueryAccessToken failed: %s", err)
+	}
+	if res.Device == nil || res.SoftLogout {
+		t.Fatalf("got device %+v with soft logout %v, want the device", res.Device, res.SoftLogout)
+	}
+	now := time.Now()
+	if sessionExpired(&a.Config.SessionExpiry, res.Device, now.Add(time.Minute*30)) {
+		t.Errorf("got the session expired after 30 minutes, want it to last an hour")
+	}
+	if !sessionExpired(&a.Config.SessionExpiry, res.Device, now.Add(time.Minute*90)) {
+		t.Errorf("got the session not expired after 90 minutes, want it expired")
+	}
+
+	t.Run("softLogout", func(t *testing.T) {
+		a.Config.SessionExpiry.IdleLifetime = time.Millisecond
+		defer func() { a.Config.SessionExpiry.IdleLifetime = time.Hour }()
+		time.Sleep(time.Millisecond * 5)
+		var res api.QueryAccessTokenResponse
+		if err := a.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "bob_token"}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		if res.Device != nil || !res.SoftLogout {
+			t.Errorf("got device %+v with soft logout %v, want soft logout", res.Device, res.SoftLogout)
+		}
+	})
+
+	// The devices are kept for the retention period after they expire.
+	expiry := &SessionExpiry{Cfg: &a.Config.SessionExpiry, UserAPI: a}
+	if err = expiry.deleteExpiredDevices(ctx, now.Add(time.Minute*90)); err != nil {
+		t.Fatalf("deleteExpiredDevices failed: %s", err)
+	}
+	if len(keyAPI.deletedKeyIDs) != 0 {
+		t.Errorf("got keys of %v deleted, want none", keyAPI.deletedKeyIDs)
+	}
+	if err = expiry.deleteExpiredDevices(ctx, now.Add(time.Minute*150)); err != nil {
+		t.Fatalf("deleteExpiredDevices failed: %s", err)
+	}
+	for _, token := range []string{"alice_token", "bob_token"} {
+		if _, err = deviceDB.GetDeviceByAccessToken(ctx, token); err == nil {
+			t.Errorf("GetDeviceByAccessToken(%q): got the device, want it deleted", token)
+		}
+	}
+	if len(keyAPI.deletedKeyIDs) != 2 {
+		t.Errorf("got keys of %v deleted, want those of both devices", keyAPI.deletedKeyIDs)
+	}
+	for _, keyID := range keyAPI.deletedKeyIDs {
+		if keyID == gomatrixserverlib.KeyID(dehydrateRes.Device.ID) {
+			t.Errorf("got the keys of the dehydrated device deleted, want them kept")
+		}
+	}
+	deviceID, _, err := deviceDB.GetDehydratedDevice(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetDehydratedDevice failed: %s", err)
+	}
+	if deviceID != dehydrateRes.Device.ID {
+		t.Errorf("got dehydrated device %q, want %q", deviceID, dehydrateRes.Device.ID)
+	}
+}
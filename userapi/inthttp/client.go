@@ -32,20 +32,37 @@ const (
 	PerformAccountCreationPath     = "/userapi/performAccountCreation"
 	PerformPasswordUpdatePath      = "/userapi/performPasswordUpdate"
 	PerformDeviceDeletionPath      = "/userapi/performDeviceDeletion"
+	PerformDeviceDehydrationPath   = "/userapi/performDeviceDehydration"
+	PerformDeviceRehydrationPath   = "/userapi/performDeviceRehydration"
+	PerformTokenRefreshPath        = "/userapi/performTokenRefresh"
 	PerformLastSeenUpdatePath      = "/userapi/performLastSeenUpdate"
 	PerformDeviceUpdatePath        = "/userapi/performDeviceUpdate"
 	PerformAccountDeactivationPath = "/userapi/performAccountDeactivation"
 	PerformOpenIDTokenCreationPath = "/userapi/performOpenIDTokenCreation"
 	PerformKeyBackupPath           = "/userapi/performKeyBackup"
 
-	QueryKeyBackupPath      = "/userapi/queryKeyBackup"
-	QueryProfilePath        = "/userapi/queryProfile"
-	QueryAccessTokenPath    = "/userapi/queryAccessToken"
-	QueryDevicesPath        = "/userapi/queryDevices"
-	QueryAccountDataPath    = "/userapi/queryAccountData"
-	QueryDeviceInfosPath    = "/userapi/queryDeviceInfos"
-	QuerySearchProfilesPath = "/userapi/querySearchProfiles"
-	QueryOpenIDTokenPath    = "/userapi/queryOpenIDToken"
+	QueryKeyBackupPath           = "/userapi/queryKeyBackup"
+	QueryProfilePath             = "/userapi/queryProfile"
+	QueryAccessTokenPath         = "/userapi/queryAccessToken"
+	QueryDevicesPath             = "/userapi/queryDevices"
+	QueryDehydratedDevicePath    = "/userapi/queryDehydratedDevice"
+	QueryAccountDataPath         = "/userapi/queryAccountData"
+	QueryDeviceInfosPath         = "/userapi/queryDeviceInfos"
+	QuerySearchProfilesPath      = "/userapi/querySearchProfiles"
+	QueryOpenIDTokenPath         = "/userapi/queryOpenIDToken"
+	QueryAccountByLocalpartPath  = "/userapi/queryAccountByLocalpart"
+	PerformPusherSetPath         = "/userapi/performPusherSet"
+	PerformPusherDeletionPath    = "/userapi/performPusherDeletion"
+	QueryPushersPath             = "/userapi/queryPushers"
+	QueryAllPushersPath          = "/userapi/queryAllPushers"
+	PerformPushersDeletionPath   = "/userapi/performPushersDeletion"
+	QueryNotificationsPath       = "/userapi/queryNotifications"
+	QueryMonthlyActiveUsersPath  = "/userapi/queryMonthlyActiveUsers"
+	QuerySearchUserDirectoryPath = "/userapi/querySearchUserDirectory"
+	QueryDeviceConnectionsPath   = "/userapi/queryDeviceConnections"
+	PerformLoginAttemptPath      = "/userapi/performLoginAttempt"
+	PerformLoginResultPath       = "/userapi/performLoginResult"
+	PerformAccountRenewalPath    = "/userapi/performAccountRenewal"
 )
 
 // NewUserAPIClient creates a UserInternalAPI implemented by talking to a HTTP POST API.
@@ -124,6 +141,42 @@ func (h *httpUserInternalAPI) PerformDeviceDeletion(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpUserInternalAPI) PerformDeviceDehydration(
+	ctx context.Context,
+	request *api.PerformDeviceDehydrationRequest,
+	response *api.PerformDeviceDehydrationResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeviceDehydration")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformDeviceDehydrationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpUserInternalAPI) PerformDeviceRehydration(
+	ctx context.Context,
+	request *api.PerformDeviceRehydrationRequest,
+	response *api.PerformDeviceRehydrationResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeviceRehydration")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformDeviceRehydrationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpUserInternalAPI) PerformTokenRefresh(
+	ctx context.Context,
+	request *api.PerformTokenRefreshRequest,
+	response *api.PerformTokenRefreshResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformTokenRefresh")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformTokenRefreshPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpUserInternalAPI) PerformLastSeenUpdate(
 	ctx context.Context,
 	req *api.PerformLastSeenUpdateRequest,
@@ -204,6 +257,14 @@ func (h *httpUserInternalAPI) QueryDevices(ctx context.Context, req *api.QueryDe
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
 
+func (h *httpUserInternalAPI) QueryDehydratedDevice(ctx context.Context, req *api.QueryDehydratedDeviceRequest, res *api.QueryDehydratedDeviceResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDehydratedDevice")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryDehydratedDevicePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
 func (h *httpUserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAccountData")
 	defer span.Finish()
@@ -220,6 +281,14 @@ func (h *httpUserInternalAPI) QuerySearchProfiles(ctx context.Context, req *api.
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
 
+func (h *httpUserInternalAPI) QuerySearchUserDirectory(ctx context.Context, req *api.QuerySearchUserDirectoryRequest, res *api.QuerySearchUserDirectoryResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QuerySearchUserDirectory")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QuerySearchUserDirectoryPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
 func (h *httpUserInternalAPI) QueryOpenIDToken(ctx context.Context, req *api.QueryOpenIDTokenRequest, res *api.QueryOpenIDTokenResponse) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryOpenIDToken")
 	defer span.Finish()
@@ -249,3 +318,99 @@ func (h *httpUserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.Query
 		res.Error = err.Error()
 	}
 }
+
+func (h *httpUserInternalAPI) QueryAccountByLocalpart(ctx context.Context, req *api.QueryAccountByLocalpartRequest, res *api.QueryAccountByLocalpartResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAccountByLocalpart")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryAccountByLocalpartPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *api.PerformPusherSetResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPusherSet")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPusherSetPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *api.PerformPusherDeletionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPusherDeletion")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPusherDeletionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPushers")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryPushersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryAllPushers(ctx context.Context, req *api.QueryAllPushersRequest, res *api.QueryAllPushersResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAllPushers")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryAllPushersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPushersDeletion(ctx context.Context, req *api.PerformPushersDeletionRequest, res *api.PerformPushersDeletionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPushersDeletion")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPushersDeletionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryNotifications(ctx context.Context, req *api.QueryNotificationsRequest, res *api.QueryNotificationsResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryNotifications")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryNotificationsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryMonthlyActiveUsers(ctx context.Context, req *api.QueryMonthlyActiveUsersRequest, res *api.QueryMonthlyActiveUsersResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryMonthlyActiveUsers")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryMonthlyActiveUsersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryDeviceConnections(ctx context.Context, req *api.QueryDeviceConnectionsRequest, res *api.QueryDeviceConnectionsResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDeviceConnections")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryDeviceConnectionsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformLoginAttempt(ctx context.Context, req *api.PerformLoginAttemptRequest, res *api.PerformLoginAttemptResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformLoginAttempt")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformLoginAttemptPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformLoginResult(ctx context.Context, req *api.PerformLoginResultRequest, res *api.PerformLoginResultResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformLoginResult")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformLoginResultPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformAccountRenewal(ctx context.Context, req *api.PerformAccountRenewalRequest, res *api.PerformAccountRenewalResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAccountRenewal")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformAccountRenewalPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
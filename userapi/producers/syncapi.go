@@ -0,0 +1,123 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// SyncAPI produces messages for the sync API server to consume
+type SyncAPI struct {
+	db                  accounts.Database
+	jetstream           nats.JetStreamContext
+	topic               string
+	deletedDevicesTopic string
+	serverName          gomatrixserverlib.ServerName
+}
+
+// NewSyncAPI creates a new SyncAPI producer
+func NewSyncAPI(
+	db accounts.Database, js nats.JetStreamContext, topic, deletedDevicesTopic string,
+	serverName gomatrixserverlib.ServerName,
+) *SyncAPI {
+	return &SyncAPI{
+		db:                  db,
+		jetstream:           js,
+		topic:               topic,
+		deletedDevicesTopic: deletedDevicesTopic,
+		serverName:          serverName,
+	}
+}
+
+// SendNotificationData sends the current unread notification counts of the
+// user in the room, and in its threads, to the sync API server
+func (p *SyncAPI) SendNotificationData(ctx context.Context, localpart, roomID string) error {
+	total, highlight, err := p.db.GetRoomNotificationCounts(ctx, localpart, roomID)
+	if err != nil {
+		return err
+	}
+	counts, err := p.db.GetRoomThreadNotificationCounts(ctx, localpart, roomID)
+	if err != nil {
+		return err
+	}
+	threadCounts := make(map[string]*eventutil.ThreadNotificationData, len(counts))
+	for threadID, c := range counts {
+		threadCounts[threadID] = &eventutil.ThreadNotificationData{
+			UnreadHighlightCount:    int(c.Highlight),
+			UnreadNotificationCount: int(c.Total),
+		}
+	}
+	userID := userutil.MakeUserID(localpart, p.serverName)
+
+	m := &nats.Msg{
+		Subject: p.topic,
+		Header:  nats.Header{},
+	}
+	m.Header.Set(jetstream.UserID, userID)
+	m.Data, err = json.Marshal(eventutil.NotificationData{
+		RoomID:                  roomID,
+		UnreadHighlightCount:    int(highlight),
+		UnreadNotificationCount: int(total),
+		UnreadThreadCounts:      threadCounts,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":            userID,
+		"room_id":            roomID,
+		"notification_count": total,
+		"highlight_count":    highlight,
+		"thread_count":       len(threadCounts),
+	}).Tracef("Producing to topic '%s'", p.topic)
+
+	_, err = p.jetstream.PublishMsg(m)
+	return err
+}
+
+// SendDeletedDevices tells the sync API server that the devices of the user
+// were deleted, so that the to-device messages waiting for them are dropped
+func (p *SyncAPI) SendDeletedDevices(userID string, deviceIDs []string) error {
+	m := &nats.Msg{
+		Subject: p.deletedDevicesTopic,
+		Header:  nats.Header{},
+	}
+	m.Header.Set(jetstream.UserID, userID)
+	var err error
+	m.Data, err = json.Marshal(eventutil.DeletedDevicesData{
+		DeviceIDs: deviceIDs,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":    userID,
+		"device_ids": deviceIDs,
+	}).Tracef("Producing to topic '%s'", p.deletedDevicesTopic)
+
+	_, err = p.jetstream.PublishMsg(m)
+	return err
+}
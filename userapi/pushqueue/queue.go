@@ -0,0 +1,261 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushqueue delivers notifications to push gateways. Requests are
+// stored in the database until they have been sent, so that they survive
+// restarts and temporary outages of the push gateways.
+package pushqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxAttempts is how many times a request is sent before giving up on it.
+const maxAttempts = 16
+
+// maxBatchSize is how many due requests are loaded from the queue at once.
+const maxBatchSize = 100
+
+// retryDelay is the delay before the first retry, which doubles after each
+// attempt up to maxRetryDelay.
+var (
+	retryDelay    = time.Second
+	maxRetryDelay = time.Hour
+)
+
+// Queue sends queued requests to the push gateways. The requests for each user
+// and push gateway are sent in order, and a request which fails temporarily
+// holds up the ones behind it until it has been retried.
+type Queue struct {
+	ctx     context.Context
+	db      accounts.Database
+	clients map[api.PusherKind]pushgateway.Client
+	userAPI api.UserInternalAPI
+	wake    chan struct{}
+}
+
+// NewQueue creates a new Queue, which sends the requests for each kind of
+// pusher with the given client. Call Start() to begin sending requests.
+func NewQueue(
+	process *process.ProcessContext,
+	db accounts.Database,
+	clients map[api.PusherKind]pushgateway.Client,
+	userAPI api.UserInternalAPI,
+) *Queue {
+	return &Queue{
+		ctx:     process.Context(),
+		db:      db,
+		clients: clients,
+		userAPI: userAPI,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start sends the requests which are already queued, and those which are
+// queued later, until the process is shut down.
+func (q *Queue) Start() {
+	go q.run()
+}
+
+// Send adds the request for the user's pushers of the given kind at the URL
+// to the queue. Requests for kinds of pusher which have no client, because
+// they aren't enabled, are dropped.
+func (q *Queue) Send(ctx context.Context, localpart string, kind api.PusherKind, url string, req *pushgateway.NotifyRequest) error {
+	if _, ok := q.clients[kind]; !ok {
+		return nil
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err = q.db.QueuePush(ctx, localpart, kind, url, data); err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *Queue) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		q.sendDue()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		ts, ok, err := q.db.GetNextQueuedPushTS(q.ctx)
+		switch {
+		case err != nil:
+			log.WithError(err).Error("Failed to get the next queued push")
+			timer.Reset(retryDelay)
+		case ok:
+			timer.Reset(time.Until(ts.Time()))
+		}
+	}
+}
+
+// queueKey identifies the requests which are sent in order.
+type queueKey struct {
+	localpart string
+	url       string
+}
+
+// sendDue sends the requests which are due, in order for each user and push
+// gateway, and the requests for different ones concurrently.
+func (q *Queue) sendDue() {
+	for {
+		pushes, err := q.db.GetDueQueuedPushes(q.ctx, gomatrixserverlib.AsTimestamp(time.Now()), maxBatchSize)
+		if err != nil {
+			log.WithError(err).Error("Failed to get queued pushes")
+			return
+		}
+		byKey := map[queueKey][]*api.QueuedPush{}
+		for _, push := range pushes {
+			key := queueKey{push.Localpart, push.URL}
+			byKey[key] = append(byKey[key], push)
+		}
+		var wg sync.WaitGroup
+		for _, pushes := range byKey {
+			wg.Add(1)
+			go func(pushes []*api.QueuedPush) {
+				defer wg.Done()
+				for _, push := range pushes {
+					if !q.send(push) {
+						return
+					}
+				}
+			}(pushes)
+		}
+		wg.Wait()
+		if len(pushes) < maxBatchSize {
+			return
+		}
+	}
+}
+
+// send sends the queued request, and returns false if it failed and should be
+// retried later.
+func (q *Queue) send(push *api.QueuedPush) bool {
+	logger := log.WithFields(log.Fields{
+		"localpart": push.Localpart,
+		"kind":      push.Kind,
+		"url":       push.URL,
+		"attempts":  push.Attempts,
+	})
+	client, ok := q.clients[push.Kind]
+	if !ok {
+		logger.Warn("Dropping queued push for a kind of pusher which isn't enabled")
+		q.remove(push)
+		return true
+	}
+	var req pushgateway.NotifyRequest
+	if err := json.Unmarshal(push.Request, &req); err != nil {
+		logger.WithError(err).Error("Failed to unmarshal queued push")
+		q.remove(push)
+		return true
+	}
+	logger = logger.WithField("event_id", req.Notification.EventID)
+
+	var res pushgateway.NotifyResponse
+	err := client.Notify(q.ctx, push.URL, &req, &res)
+	var statusErr pushgateway.StatusError
+	switch {
+	case err == nil:
+		if len(res.Rejected) > 0 {
+			logger.Warnf("Push gateway rejected pushkeys %v", res.Rejected)
+			q.removeRejectedPushers(push.Localpart, req.Notification.Devices, res.Rejected)
+		}
+	case errors.As(err, &statusErr) && !statusErr.Temporary():
+		logger.WithError(err).Error("Push gateway refused notification")
+	case errors.Is(err, pushgateway.ErrPrivateAddress):
+		logger.WithError(err).Error("Not sending notification to a private address")
+	case push.Attempts+1 >= maxAttempts:
+		logger.WithError(err).Errorf("Failed to send notification after %d attempts", push.Attempts+1)
+	default:
+		delay := backoff(push.Attempts)
+		logger.WithError(err).Warnf("Failed to send notification, retrying in %s", delay)
+		nextAttempt := gomatrixserverlib.AsTimestamp(time.Now().Add(delay))
+		if err = q.db.RescheduleQueuedPush(q.ctx, push.ID, push.Attempts+1, nextAttempt); err != nil {
+			logger.WithError(err).Error("Failed to reschedule queued push")
+		}
+		return false
+	}
+	q.remove(push)
+	return true
+}
+
+func (q *Queue) remove(push *api.QueuedPush) {
+	if err := q.db.RemoveQueuedPush(q.ctx, push.ID); err != nil {
+		log.WithError(err).WithField("localpart", push.Localpart).Error("Failed to remove queued push")
+	}
+}
+
+// removeRejectedPushers deletes the pushers for the devices whose pushkeys
+// were rejected by the push gateway, so that they aren't notified again.
+func (q *Queue) removeRejectedPushers(localpart string, devices []*pushgateway.Device, rejected []string) {
+	for _, pushKey := range rejected {
+		for _, device := range devices {
+			if device.PushKey != pushKey {
+				continue
+			}
+			err := q.userAPI.PerformPusherDeletion(q.ctx, &api.PerformPusherDeletionRequest{
+				Localpart: localpart,
+				AppID:     device.AppID,
+				PushKey:   device.PushKey,
+			}, &api.PerformPusherDeletionResponse{})
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"localpart": localpart,
+					"app_id":    device.AppID,
+				}).Error("Failed to remove rejected pusher")
+			}
+		}
+	}
+}
+
+// backoff returns the delay before retrying a request which has failed the
+// given number of times before.
+func backoff(attempts int) time.Duration {
+	delay := retryDelay
+	for i := 0; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushqueue
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakePushGateway returns the queued errors in turn, and then succeeds.
+type fakePushGateway struct {
+	errs     []error
+	rejected []string
+	sent     []string
+}
+
+func (c *fakePushGateway) Notify(ctx context.Context, url string, req *pushgateway.NotifyRequest, res *pushgateway.NotifyResponse) error {
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return err
+	}
+	c.sent = append(c.sent, req.Notification.EventID)
+	res.Rejected = c.rejected
+	return nil
+}
+
+type pusherDeletionRecorder struct {
+	api.UserInternalAPI
+	deleted []api.PerformPusherDeletionRequest
+}
+
+func (a *pusherDeletionRecorder) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *api.PerformPusherDeletionResponse) error {
+	a.deleted = append(a.deleted, *req)
+	return nil
+}
+
+func mustMakeQueue(t *testing.T, client *fakePushGateway) (*Queue, accounts.Database, *pusherDeletionRecorder) {
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "example.com", &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	userAPI := &pusherDeletionRecorder{}
+	clients := map[api.PusherKind]pushgateway.Client{api.HTTPKind: client}
+	return NewQueue(process.NewProcessContext(), accountDB, clients, userAPI), accountDB, userAPI
+}
+
+func mustSend(t *testing.T, q *Queue, eventID string, devices ...*pushgateway.Device) {
+	if err := q.Send(context.TODO(), "alice", api.HTTPKind, "http://push.example.com", &pushgateway.NotifyRequest{
+		Notification: pushgateway.Notification{EventID: eventID, Devices: devices},
+	}); err != nil {
+		t.Fatalf("failed to queue push: %s", err)
+	}
+}
+
+func mustHaveQueued(t *testing.T, db accounts.Database, want bool) {
+	if _, ok, err := db.GetNextQueuedPushTS(context.TODO()); err != nil {
+		t.Fatalf("failed to get next queued push: %s", err)
+	} else if ok != want {
+		t.Fatalf("got queued pushes %v want %v", ok, want)
+	}
+}
+
+func TestQueueRetriesInOrder(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 10 * time.Millisecond
+	client := &fakePushGateway{errs: []error{pushgateway.StatusError{Code: http.StatusServiceUnavailable}}}
+	q, db, _ := mustMakeQueue(t, client)
+	mustSend(t, q, "$first:example.com")
+	mustSend(t, q, "$second:example.com")
+
+	// The first push fails temporarily, which holds up the second one.
+	q.sendDue()
+	if len(client.sent) != 0 {
+		t.Fatalf("got sent %v want nothing sent before the retry", client.sent)
+	}
+	pushes, err := db.GetDueQueuedPushes(context.TODO(), 1<<62, 10)
+	if err != nil {
+		t.Fatalf("failed to get queued pushes: %s", err)
+	}
+	if len(pushes) != 2 || pushes[0].Attempts != 1 {
+		t.Fatalf("got queued pushes %+v want the first to have failed once", pushes)
+	}
+
+	time.Sleep(retryDelay)
+	q.sendDue()
+	if want := []string{"$first:example.com", "$second:example.com"}; !reflect.DeepEqual(client.sent, want) {
+		t.Fatalf("got sent %v want %v", client.sent, want)
+	}
+	mustHaveQueued(t, db, false)
+}
+
+func TestQueueDropsRefusedPushes(t *testing.T) {
+	client := &fakePushGateway{errs: []error{pushgateway.StatusError{Code: http.StatusBadRequest}}}
+	q, db, _ := mustMakeQueue(t, client)
+	mustSend(t, q, "$event:example.com")
+	q.sendDue()
+	if len(client.sent) != 0 {
+		t.Fatalf("got sent %v want nothing sent", client.sent)
+	}
+	mustHaveQueued(t, db, false)
+}
+
+func TestQueueRemovesRejectedPushers(t *testing.T) {
+	client := &fakePushGateway{rejected: []string{"key2"}}
+	q, _, userAPI := mustMakeQueue(t, client)
+	mustSend(t, q, "$event:example.com",
+		&pushgateway.Device{AppID: "app1", PushKey: "key1"},
+		&pushgateway.Device{AppID: "app2", PushKey: "key2"},
+	)
+	q.sendDue()
+	want := []api.PerformPusherDeletionRequest{{Localpart: "alice", AppID: "app2", PushKey: "key2"}}
+	if !reflect.DeepEqual(userAPI.deleted, want) {
+		t.Errorf("got deleted pushers %+v want %+v", userAPI.deleted, want)
+	}
+}
+
+func TestQueueDropsDisabledKinds(t *testing.T) {
+	q, db, _ := mustMakeQueue(t, &fakePushGateway{})
+	if err := q.Send(context.TODO(), "alice", api.WebPushKind, "https://push.example.com/abc", &pushgateway.NotifyRequest{}); err != nil {
+		t.Fatalf("failed to queue push: %s", err)
+	}
+	mustHaveQueued(t, db, false)
+}
+
+func TestBackoff(t *testing.T) {
+	if got := backoff(0); got != time.Second {
+		t.Errorf("got %s want 1s for the first retry", got)
+	}
+	if got := backoff(3); got != 8*time.Second {
+		t.Errorf("got %s want 8s for the fourth retry", got)
+	}
+	if got := backoff(maxAttempts); got != maxRetryDelay {
+		t.Errorf("got %s want it to be capped at %s", got, maxRetryDelay)
+	}
+}
@@ -20,7 +20,9 @@ import (
 	"errors"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
@@ -32,7 +34,7 @@ type Database interface {
 	// CreateAccount makes a new account with the given login name and password, and creates an empty profile
 	// for this account. If no password is supplied, the account will be a passwordless account. If the
 	// account already exists, it will return nil, ErrUserExists.
-	CreateAccount(ctx context.Context, localpart, plaintextPassword, appserviceID string) (*api.Account, error)
+	CreateAccount(ctx context.Context, localpart, plaintextPassword, appserviceID string, accountType api.AccountType) (*api.Account, error)
 	CreateGuestAccount(ctx context.Context) (*api.Account, error)
 	SaveAccountData(ctx context.Context, localpart, roomID, dataType string, content json.RawMessage) error
 	GetAccountData(ctx context.Context, localpart string) (global map[string]json.RawMessage, rooms map[string]map[string]json.RawMessage, err error)
@@ -41,6 +43,9 @@ type Database interface {
 	// If no account data could be found, returns nil
 	// Returns an error if there was an issue with the retrieval
 	GetAccountDataByType(ctx context.Context, localpart, roomID, dataType string) (data json.RawMessage, err error)
+	// DefaultPushRules returns the push rules that new accounts are given,
+	// which are also used for accounts without push rules stored.
+	DefaultPushRules(localpart string) *pushrules.AccountRuleSets
 	GetNewNumericLocalpart(ctx context.Context) (int64, error)
 	SaveThreePIDAssociation(ctx context.Context, threepid, localpart, medium string) (err error)
 	RemoveThreePIDAssociation(ctx context.Context, threepid string, medium string) (err error)
@@ -48,8 +53,58 @@ type Database interface {
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string) (threepids []authtypes.ThreePID, err error)
 	CheckAccountAvailability(ctx context.Context, localpart string) (bool, error)
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
+	IsAccountDeactivated(ctx context.Context, localpart string) (bool, error)
+	// CountAccounts returns the number of non-guest accounts, along with the number
+	// of those accounts which do not belong to an application service.
+	CountAccounts(ctx context.Context) (total, nonBridged int64, err error)
 	SearchProfiles(ctx context.Context, searchString string, limit int) ([]authtypes.Profile, error)
 	DeactivateAccount(ctx context.Context, localpart string) (err error)
+	// MarkUserErased records that the user asked for their data to be erased
+	// when deactivating their account.
+	MarkUserErased(ctx context.Context, localpart string) error
+	IsUserErased(ctx context.Context, localpart string) (bool, error)
+	// SetShadowBanned shadow-bans the user, or lifts their shadow-ban. The
+	// events and invites which shadow-banned users send are dropped.
+	SetShadowBanned(ctx context.Context, localpart string, shadowBanned bool) error
+	IsShadowBanned(ctx context.Context, localpart string) (bool, error)
+	// SetAccountLocked locks or unlocks the account of the user. Unlike
+	// deactivated accounts, locked accounts keep their devices and rooms.
+	SetAccountLocked(ctx context.Context, localpart string, locked bool) error
+	IsAccountLocked(ctx context.Context, localpart string) (bool, error)
+	// Account validity. Accounts expire at the expiry time unless they are
+	// renewed with the token in the renewal email which is sent beforehand.
+	SetAccountExpiry(ctx context.Context, localpart string, expirationTS gomatrixserverlib.Timestamp) error
+	SetMissingAccountExpiries(ctx context.Context, expirationTS gomatrixserverlib.Timestamp) (int64, error)
+	GetAccountExpiry(ctx context.Context, localpart string) (gomatrixserverlib.Timestamp, error)
+	GetAccountsExpiringBefore(ctx context.Context, beforeTS gomatrixserverlib.Timestamp) (map[string]gomatrixserverlib.Timestamp, error)
+	SetAccountRenewalToken(ctx context.Context, localpart, token string) error
+	GetLocalpartForRenewalToken(ctx context.Context, token string) (string, error)
+	// Consent to the privacy policy
+	SetConsentVersion(ctx context.Context, localpart, version string) error
+	GetConsentVersion(ctx context.Context, localpart string) (string, error)
+	// Custom profile fields (MSC4133), besides the display name and avatar URL
+	GetProfileFields(ctx context.Context, localpart string) (map[string]json.RawMessage, error)
+	SetProfileField(ctx context.Context, localpart, name string, value json.RawMessage) error
+	RemoveProfileField(ctx context.Context, localpart, name string) error
+	RemoveProfileFields(ctx context.Context, localpart string) error
+	// Registration tokens (MSC3231)
+	InsertRegistrationToken(ctx context.Context, token api.RegistrationToken) (bool, error)
+	GetRegistrationToken(ctx context.Context, token string) (*api.RegistrationToken, error)
+	GetRegistrationTokens(ctx context.Context) ([]api.RegistrationToken, error)
+	RemoveRegistrationToken(ctx context.Context, token string) (bool, error)
+	UseRegistrationToken(ctx context.Context, token string) (bool, error)
+	// Single sign-on
+	SaveSSOIdentity(ctx context.Context, providerID, subject, localpart string) error
+	GetLocalpartForSSOIdentity(ctx context.Context, providerID, subject string) (string, error)
+	RemoveSSOIdentities(ctx context.Context, localpart string) error
+	// Monthly active users
+	UpsertMonthlyActiveUser(ctx context.Context, localpart string, activeTS gomatrixserverlib.Timestamp) error
+	IsMonthlyActiveUser(ctx context.Context, localpart string, sinceTS gomatrixserverlib.Timestamp) (bool, error)
+	CountMonthlyActiveUsers(ctx context.Context, sinceTS gomatrixserverlib.Timestamp) (int64, error)
+	RemoveInactiveUsers(ctx context.Context, sinceTS gomatrixserverlib.Timestamp) error
+	// User directory
+	UpdateUserDirectory(ctx context.Context, roomID string, rewrite bool, joined []authtypes.FullyQualifiedProfile, left []string) error
+	SearchUserDirectory(ctx context.Context, userID, searchString string, includeRemote bool, limit int) ([]authtypes.FullyQualifiedProfile, error)
 	CreateOpenIDToken(ctx context.Context, token, localpart string) (exp int64, err error)
 	GetOpenIDTokenAttributes(ctx context.Context, token string) (*api.OpenIDTokenAttributes, error)
 
@@ -61,6 +116,30 @@ type Database interface {
 	UpsertBackupKeys(ctx context.Context, version, userID string, uploads []api.InternalKeyBackupSession) (count int64, etag string, err error)
 	GetBackupKeys(ctx context.Context, version, userID, filterRoomID, filterSessionID string) (result map[string]map[string]api.KeyBackupSession, err error)
 	CountBackupKeys(ctx context.Context, version, userID string) (count int64, err error)
+	DeleteBackupKeys(ctx context.Context, version, userID, filterRoomID, filterSessionID string) (count int64, etag string, err error)
+
+	// Pushers
+	UpsertPusher(ctx context.Context, pusher api.Pusher, localpart string) error
+	GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error)
+	// GetAllPushers ignores the URL of the filter.
+	GetAllPushers(ctx context.Context, filter api.PusherFilter) ([]api.UserPusher, error)
+	RemovePusher(ctx context.Context, appID, pushKey, localpart string) error
+	RemovePushers(ctx context.Context, appID, pushKey string) error
+
+	// Notifications
+	InsertNotification(ctx context.Context, localpart, threadID string, highlight bool, n *api.Notification) error
+	GetNotifications(ctx context.Context, localpart string, beforeID int64, limit int, onlyHighlight bool) ([]*api.Notification, int64, error)
+	SetNotificationsRead(ctx context.Context, localpart, roomID, eventID string, ts gomatrixserverlib.Timestamp) (bool, error)
+	GetRoomNotificationCounts(ctx context.Context, localpart, roomID string) (total int64, highlight int64, err error)
+	GetRoomThreadNotificationCounts(ctx context.Context, localpart, roomID string) (map[string]*api.NotificationCounts, error)
+	GetNotificationCount(ctx context.Context, localpart string) (int64, error)
+
+	// Push queue
+	QueuePush(ctx context.Context, localpart string, kind api.PusherKind, url string, request []byte) (int64, error)
+	GetDueQueuedPushes(ctx context.Context, ts gomatrixserverlib.Timestamp, limit int) ([]*api.QueuedPush, error)
+	GetNextQueuedPushTS(ctx context.Context) (gomatrixserverlib.Timestamp, bool, error)
+	RescheduleQueuedPush(ctx context.Context, id int64, attempts int, nextAttemptTS gomatrixserverlib.Timestamp) error
+	RemoveQueuedPush(ctx context.Context, id int64) error
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
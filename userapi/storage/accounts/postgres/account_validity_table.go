@@ -0,0 +1,164 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const accountValiditySchema = `
+-- Stores when the accounts of local users expire, unless they are renewed.
+CREATE TABLE IF NOT EXISTS account_validity (
+	-- The Matrix user ID localpart of the user
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- When the account expires, as a unix timestamp (ms resolution)
+	expiration_ts BIGINT NOT NULL,
+	-- The token in the renewal link which was emailed to the user, or NULL
+	-- if no renewal email has been sent since the account was last renewed
+	renewal_token TEXT UNIQUE
+);
+CREATE INDEX IF NOT EXISTS account_validity_expiration_ts_idx ON account_validity(expiration_ts);
+`
+
+const upsertAccountValiditySQL = "" +
+	"INSERT INTO account_validity (localpart, expiration_ts) VALUES ($1, $2)" +
+	" ON CONFLICT (localpart) DO UPDATE SET expiration_ts = $2, renewal_token = NULL"
+
+// Application service users and guests don't expire.
+const insertMissingAccountValiditySQL = "" +
+	"INSERT INTO account_validity (localpart, expiration_ts)" +
+	" SELECT localpart, $1 FROM account_accounts" +
+	" WHERE is_deactivated = FALSE AND account_type <> $2 AND (appservice_id IS NULL OR appservice_id = '')" +
+	" AND localpart NOT IN (SELECT localpart FROM account_validity)"
+
+const selectAccountValiditySQL = "" +
+	"SELECT expiration_ts FROM account_validity WHERE localpart = $1"
+
+const selectLocalpartByRenewalTokenSQL = "" +
+	"SELECT localpart FROM account_validity WHERE renewal_token = $1"
+
+const selectAccountsExpiringSQL = "" +
+	"SELECT localpart, expiration_ts FROM account_validity" +
+	" WHERE expiration_ts < $1 AND renewal_token IS NULL" +
+	" AND localpart IN (SELECT localpart FROM account_accounts WHERE is_deactivated = FALSE)"
+
+const updateRenewalTokenSQL = "" +
+	"UPDATE account_validity SET renewal_token = $1 WHERE localpart = $2"
+
+type accountValidityStatements struct {
+	upsertAccountValidityStmt         *sql.Stmt
+	insertMissingAccountValidityStmt  *sql.Stmt
+	selectAccountValidityStmt         *sql.Stmt
+	selectLocalpartByRenewalTokenStmt *sql.Stmt
+	selectAccountsExpiringStmt        *sql.Stmt
+	updateRenewalTokenStmt            *sql.Stmt
+}
+
+func (s *accountValidityStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(accountValiditySchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.upsertAccountValidityStmt, upsertAccountValiditySQL},
+		{&s.insertMissingAccountValidityStmt, insertMissingAccountValiditySQL},
+		{&s.selectAccountValidityStmt, selectAccountValiditySQL},
+		{&s.selectLocalpartByRenewalTokenStmt, selectLocalpartByRenewalTokenSQL},
+		{&s.selectAccountsExpiringStmt, selectAccountsExpiringSQL},
+		{&s.updateRenewalTokenStmt, updateRenewalTokenSQL},
+	}.Prepare(db)
+}
+
+// upsertAccountValidity sets when the account expires, forgetting any
+// renewal email which has been sent.
+func (s *accountValidityStatements) upsertAccountValidity(
+	ctx context.Context, txn *sql.Tx, localpart string, expirationTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertAccountValidityStmt).ExecContext(ctx, localpart, expirationTS)
+	return err
+}
+
+// insertMissingAccountValidity sets when the accounts which don't have an
+// expiry time yet expire, returning how many there were.
+func (s *accountValidityStatements) insertMissingAccountValidity(
+	ctx context.Context, txn *sql.Tx, expirationTS gomatrixserverlib.Timestamp,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.insertMissingAccountValidityStmt).ExecContext(ctx, expirationTS, api.AccountTypeGuest)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// selectAccountValidity returns when the account expires, or 0 if it has no
+// expiry time.
+func (s *accountValidityStatements) selectAccountValidity(
+	ctx context.Context, localpart string,
+) (expirationTS gomatrixserverlib.Timestamp, err error) {
+	err = s.selectAccountValidityStmt.QueryRowContext(ctx, localpart).Scan(&expirationTS)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
+
+// selectLocalpartByRenewalToken returns the user who was emailed the renewal
+// token, or an empty string if the token is unknown.
+func (s *accountValidityStatements) selectLocalpartByRenewalToken(
+	ctx context.Context, token string,
+) (localpart string, err error) {
+	err = s.selectLocalpartByRenewalTokenStmt.QueryRowContext(ctx, token).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
+// selectAccountsExpiring returns when the accounts which expire before the
+// time expire, leaving out those whose users have been sent a renewal email.
+func (s *accountValidityStatements) selectAccountsExpiring(
+	ctx context.Context, beforeTS gomatrixserverlib.Timestamp,
+) (map[string]gomatrixserverlib.Timestamp, error) {
+	rows, err := s.selectAccountsExpiringStmt.QueryContext(ctx, beforeTS)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAccountsExpiring: rows.close() failed")
+	accounts := make(map[string]gomatrixserverlib.Timestamp)
+	for rows.Next() {
+		var localpart string
+		var expirationTS gomatrixserverlib.Timestamp
+		if err = rows.Scan(&localpart, &expirationTS); err != nil {
+			return nil, err
+		}
+		accounts[localpart] = expirationTS
+	}
+	return accounts, rows.Err()
+}
+
+// updateRenewalToken records the token in the renewal link which was
+// emailed to the user.
+func (s *accountValidityStatements) updateRenewalToken(
+	ctx context.Context, txn *sql.Tx, localpart, token string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateRenewalTokenStmt).ExecContext(ctx, token, localpart)
+	return err
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const consentSchema = `
+-- Stores the version of the privacy policy which each local user has agreed
+-- to most recently.
+CREATE TABLE IF NOT EXISTS account_consent (
+	-- The Matrix user ID localpart of the user
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- The version of the policy which the user agreed to
+	policy_version TEXT NOT NULL,
+	-- When the user agreed to it, as a unix timestamp (ms resolution)
+	consent_ts BIGINT NOT NULL
+);
+`
+
+const upsertConsentSQL = "" +
+	"INSERT INTO account_consent (localpart, policy_version, consent_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (localpart) DO UPDATE SET policy_version = $2, consent_ts = $3"
+
+const selectConsentSQL = "" +
+	"SELECT policy_version FROM account_consent WHERE localpart = $1"
+
+type consentStatements struct {
+	upsertConsentStmt *sql.Stmt
+	selectConsentStmt *sql.Stmt
+}
+
+func (s *consentStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(consentSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.upsertConsentStmt, upsertConsentSQL},
+		{&s.selectConsentStmt, selectConsentSQL},
+	}.Prepare(db)
+}
+
+// upsertConsent records that the user agreed to the version of the policy.
+func (s *consentStatements) upsertConsent(
+	ctx context.Context, txn *sql.Tx, localpart, version string, consentTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertConsentStmt).ExecContext(ctx, localpart, version, consentTS)
+	return err
+}
+
+// selectConsent returns the version of the policy which the user agreed to
+// most recently, or an empty string if they haven't agreed to any.
+func (s *consentStatements) selectConsent(
+	ctx context.Context, localpart string,
+) (version string, err error) {
+	err = s.selectConsentStmt.QueryRowContext(ctx, localpart).Scan(&version)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
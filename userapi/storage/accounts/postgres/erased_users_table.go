@@ -0,0 +1,78 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const erasedUsersSchema = `
+-- Stores the users who asked for their data to be erased when they
+-- deactivated their accounts.
+CREATE TABLE IF NOT EXISTS account_erased_users (
+	-- The Matrix user ID localpart of the erased user
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- When the user was erased, as a unix timestamp (ms resolution)
+	erased_ts BIGINT NOT NULL
+);
+`
+
+const insertErasedUserSQL = "" +
+	"INSERT INTO account_erased_users (localpart, erased_ts) VALUES ($1, $2)" +
+	" ON CONFLICT (localpart) DO NOTHING"
+
+const selectErasedUserSQL = "" +
+	"SELECT 1 FROM account_erased_users WHERE localpart = $1"
+
+type erasedUsersStatements struct {
+	insertErasedUserStmt *sql.Stmt
+	selectErasedUserStmt *sql.Stmt
+}
+
+func (s *erasedUsersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(erasedUsersSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertErasedUserStmt, insertErasedUserSQL},
+		{&s.selectErasedUserStmt, selectErasedUserSQL},
+	}.Prepare(db)
+}
+
+// insertErasedUser marks the user as erased. Users who are already erased
+// keep the time that they were first erased.
+func (s *erasedUsersStatements) insertErasedUser(
+	ctx context.Context, txn *sql.Tx, localpart string, erasedTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertErasedUserStmt).ExecContext(ctx, localpart, erasedTS)
+	return err
+}
+
+// selectErasedUser returns true if the user has been erased.
+func (s *erasedUsersStatements) selectErasedUser(
+	ctx context.Context, localpart string,
+) (bool, error) {
+	var exists int
+	err := s.selectErasedUserStmt.QueryRowContext(ctx, localpart).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
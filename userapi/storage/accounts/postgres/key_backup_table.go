@@ -63,6 +63,15 @@ const selectKeysByRoomIDAndSessionIDSQL = "" +
 	"SELECT room_id, session_id, first_message_index, forwarded_count, is_verified, session_data FROM account_e2e_room_keys " +
 	"WHERE user_id = $1 AND version = $2 AND room_id = $3 AND session_id = $4"
 
+const deleteKeysSQL = "" +
+	"DELETE FROM account_e2e_room_keys WHERE user_id = $1 AND version = $2"
+
+const deleteKeysByRoomIDSQL = "" +
+	"DELETE FROM account_e2e_room_keys WHERE user_id = $1 AND version = $2 AND room_id = $3"
+
+const deleteKeysByRoomIDAndSessionIDSQL = "" +
+	"DELETE FROM account_e2e_room_keys WHERE user_id = $1 AND version = $2 AND room_id = $3 AND session_id = $4"
+
 type keyBackupStatements struct {
 	insertBackupKeyStmt                *sql.Stmt
 	updateBackupKeyStmt                *sql.Stmt
@@ -70,6 +79,9 @@ type keyBackupStatements struct {
 	selectKeysStmt                     *sql.Stmt
 	selectKeysByRoomIDStmt             *sql.Stmt
 	selectKeysByRoomIDAndSessionIDStmt *sql.Stmt
+	deleteKeysStmt                     *sql.Stmt
+	deleteKeysByRoomIDStmt             *sql.Stmt
+	deleteKeysByRoomIDAndSessionIDStmt *sql.Stmt
 }
 
 func (s *keyBackupStatements) prepare(db *sql.DB) (err error) {
@@ -84,6 +96,9 @@ func (s *keyBackupStatements) prepare(db *sql.DB) (err error) {
 		{&s.selectKeysStmt, selectKeysSQL},
 		{&s.selectKeysByRoomIDStmt, selectKeysByRoomIDSQL},
 		{&s.selectKeysByRoomIDAndSessionIDStmt, selectKeysByRoomIDAndSessionIDSQL},
+		{&s.deleteKeysStmt, deleteKeysSQL},
+		{&s.deleteKeysByRoomIDStmt, deleteKeysByRoomIDSQL},
+		{&s.deleteKeysByRoomIDAndSessionIDStmt, deleteKeysByRoomIDAndSessionIDSQL},
 	}.Prepare(db)
 }
 
@@ -142,6 +157,27 @@ func (s *keyBackupStatements) selectKeysByRoomIDAndSessionID(
 	return unpackKeys(ctx, rows)
 }
 
+// deleteKeys deletes the keys of the backup version, or only those of the room
+// or (room, session) if given, and returns how many keys were deleted.
+func (s *keyBackupStatements) deleteKeys(
+	ctx context.Context, txn *sql.Tx, userID, version, roomID, sessionID string,
+) (int64, error) {
+	var res sql.Result
+	var err error
+	switch {
+	case sessionID != "":
+		res, err = txn.Stmt(s.deleteKeysByRoomIDAndSessionIDStmt).ExecContext(ctx, userID, version, roomID, sessionID)
+	case roomID != "":
+		res, err = txn.Stmt(s.deleteKeysByRoomIDStmt).ExecContext(ctx, userID, version, roomID)
+	default:
+		res, err = txn.Stmt(s.deleteKeysStmt).ExecContext(ctx, userID, version)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func unpackKeys(ctx context.Context, rows *sql.Rows) (map[string]map[string]api.KeyBackupSession, error) {
 	result := make(map[string]map[string]api.KeyBackupSession)
 	defer internal.CloseAndLogIfError(ctx, rows, "selectKeysStmt.Close failed")
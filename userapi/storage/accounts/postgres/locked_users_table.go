@@ -0,0 +1,91 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const lockedUsersSchema = `
+-- Stores the users who have been locked by a server admin. Locked
+-- users can't use their accounts, but their data is kept.
+CREATE TABLE IF NOT EXISTS account_locked_users (
+	-- The Matrix user ID localpart of the locked user
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- When the user was locked, as a unix timestamp (ms resolution)
+	locked_ts BIGINT NOT NULL
+);
+`
+
+const insertLockedUserSQL = "" +
+	"INSERT INTO account_locked_users (localpart, locked_ts) VALUES ($1, $2)" +
+	" ON CONFLICT (localpart) DO NOTHING"
+
+const deleteLockedUserSQL = "" +
+	"DELETE FROM account_locked_users WHERE localpart = $1"
+
+const selectLockedUserSQL = "" +
+	"SELECT 1 FROM account_locked_users WHERE localpart = $1"
+
+type lockedUsersStatements struct {
+	insertLockedUserStmt *sql.Stmt
+	deleteLockedUserStmt *sql.Stmt
+	selectLockedUserStmt *sql.Stmt
+}
+
+func (s *lockedUsersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(lockedUsersSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertLockedUserStmt, insertLockedUserSQL},
+		{&s.deleteLockedUserStmt, deleteLockedUserSQL},
+		{&s.selectLockedUserStmt, selectLockedUserSQL},
+	}.Prepare(db)
+}
+
+// insertLockedUser marks the user as locked. Users who are already locked
+// keep the time that they were first locked.
+func (s *lockedUsersStatements) insertLockedUser(
+	ctx context.Context, txn *sql.Tx, localpart string, lockedTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertLockedUserStmt).ExecContext(ctx, localpart, lockedTS)
+	return err
+}
+
+// deleteLockedUser unlocks the account of the user, if it is locked.
+func (s *lockedUsersStatements) deleteLockedUser(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteLockedUserStmt).ExecContext(ctx, localpart)
+	return err
+}
+
+// selectLockedUser returns true if the user is locked.
+func (s *lockedUsersStatements) selectLockedUser(
+	ctx context.Context, localpart string,
+) (bool, error) {
+	var exists int
+	err := s.selectLockedUserStmt.QueryRowContext(ctx, localpart).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const profileFieldsSchema = `
+-- Stores the custom fields of accounts profiles (MSC4133), besides the
+-- display name and avatar URL.
+CREATE TABLE IF NOT EXISTS account_profile_fields (
+	-- The Matrix user ID localpart for this account
+	localpart TEXT NOT NULL,
+	-- The name of the field
+	field_name TEXT NOT NULL,
+	-- The value of the field, as JSON
+	field_value TEXT NOT NULL,
+	PRIMARY KEY (localpart, field_name)
+);
+`
+
+const upsertProfileFieldSQL = "" +
+	"INSERT INTO account_profile_fields (localpart, field_name, field_value) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (localpart, field_name) DO UPDATE SET field_value = $3"
+
+const deleteProfileFieldSQL = "" +
+	"DELETE FROM account_profile_fields WHERE localpart = $1 AND field_name = $2"
+
+const deleteProfileFieldsSQL = "" +
+	"DELETE FROM account_profile_fields WHERE localpart = $1"
+
+const selectProfileFieldsSQL = "" +
+	"SELECT field_name, field_value FROM account_profile_fields WHERE localpart = $1"
+
+type profileFieldsStatements struct {
+	upsertProfileFieldStmt  *sql.Stmt
+	deleteProfileFieldStmt  *sql.Stmt
+	deleteProfileFieldsStmt *sql.Stmt
+	selectProfileFieldsStmt *sql.Stmt
+}
+
+func (s *profileFieldsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(profileFieldsSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.upsertProfileFieldStmt, upsertProfileFieldSQL},
+		{&s.deleteProfileFieldStmt, deleteProfileFieldSQL},
+		{&s.deleteProfileFieldsStmt, deleteProfileFieldsSQL},
+		{&s.selectProfileFieldsStmt, selectProfileFieldsSQL},
+	}.Prepare(db)
+}
+
+func (s *profileFieldsStatements) upsertProfileField(
+	ctx context.Context, txn *sql.Tx, localpart, name string, value json.RawMessage,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertProfileFieldStmt).ExecContext(ctx, localpart, name, string(value))
+	return err
+}
+
+func (s *profileFieldsStatements) deleteProfileField(
+	ctx context.Context, txn *sql.Tx, localpart, name string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteProfileFieldStmt).ExecContext(ctx, localpart, name)
+	return err
+}
+
+func (s *profileFieldsStatements) deleteProfileFields(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteProfileFieldsStmt).ExecContext(ctx, localpart)
+	return err
+}
+
+// selectProfileFields returns the custom fields of the user's profile, keyed
+// by their names.
+func (s *profileFieldsStatements) selectProfileFields(
+	ctx context.Context, localpart string,
+) (map[string]json.RawMessage, error) {
+	rows, err := s.selectProfileFieldsStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectProfileFields: rows.close() failed")
+	fields := map[string]json.RawMessage{}
+	for rows.Next() {
+		var name, value string
+		if err = rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		fields[name] = json.RawMessage(value)
+	}
+	return fields, rows.Err()
+}
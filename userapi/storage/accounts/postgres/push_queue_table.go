@@ -0,0 +1,152 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const pushQueueSchema = `
+-- Stores the notifications which are waiting to be sent to push gateways.
+CREATE TABLE IF NOT EXISTS account_push_queue (
+	id BIGSERIAL PRIMARY KEY,
+	-- The localpart of the user who is being notified
+	localpart TEXT NOT NULL,
+	-- The kind of pusher which the request is for, e.g. "http"
+	kind TEXT NOT NULL,
+	-- The URL of the push gateway, or the endpoint of a WebPush subscription
+	url TEXT NOT NULL,
+	-- The JSON request to send to the push gateway
+	request_json TEXT NOT NULL,
+	-- The number of failed attempts to send the request
+	attempts INTEGER NOT NULL,
+	-- When the request should next be sent, as a unix timestamp (ms resolution)
+	next_attempt_ts_ms BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS account_push_queue_next_attempt_ts_ms_idx ON account_push_queue(next_attempt_ts_ms);
+CREATE INDEX IF NOT EXISTS account_push_queue_localpart_url_idx ON account_push_queue(localpart, url, id);
+`
+
+const insertQueuedPushSQL = "" +
+	"INSERT INTO account_push_queue (localpart, kind, url, request_json, attempts, next_attempt_ts_ms)" +
+	" VALUES ($1, $2, $3, $4, 0, $5) RETURNING id"
+
+// Requests which are queued behind one that is waiting to be retried aren't
+// due until it has been sent, so that each user's push gateway receives them
+// in order.
+const selectQueuedPushesSQL = "" +
+	"SELECT id, localpart, kind, url, request_json, attempts, next_attempt_ts_ms FROM account_push_queue p" +
+	" WHERE next_attempt_ts_ms <= $1 AND NOT EXISTS (" +
+	"  SELECT 1 FROM account_push_queue q" +
+	"  WHERE q.localpart = p.localpart AND q.url = p.url AND q.id < p.id AND q.next_attempt_ts_ms > $1" +
+	" ) ORDER BY id ASC LIMIT $2"
+
+const selectNextQueuedPushTSSQL = "" +
+	"SELECT MIN(next_attempt_ts_ms) FROM account_push_queue p" +
+	" WHERE NOT EXISTS (" +
+	"  SELECT 1 FROM account_push_queue q" +
+	"  WHERE q.localpart = p.localpart AND q.url = p.url AND q.id < p.id" +
+	" )"
+
+const updateQueuedPushSQL = "" +
+	"UPDATE account_push_queue SET attempts = $1, next_attempt_ts_ms = $2 WHERE id = $3"
+
+const deleteQueuedPushSQL = "" +
+	"DELETE FROM account_push_queue WHERE id = $1"
+
+type pushQueueStatements struct {
+	insertQueuedPushStmt       *sql.Stmt
+	selectQueuedPushesStmt     *sql.Stmt
+	selectNextQueuedPushTSStmt *sql.Stmt
+	updateQueuedPushStmt       *sql.Stmt
+	deleteQueuedPushStmt       *sql.Stmt
+}
+
+func (s *pushQueueStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pushQueueSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertQueuedPushStmt, insertQueuedPushSQL},
+		{&s.selectQueuedPushesStmt, selectQueuedPushesSQL},
+		{&s.selectNextQueuedPushTSStmt, selectNextQueuedPushTSSQL},
+		{&s.updateQueuedPushStmt, updateQueuedPushSQL},
+		{&s.deleteQueuedPushStmt, deleteQueuedPushSQL},
+	}.Prepare(db)
+}
+
+func (s *pushQueueStatements) insertQueuedPush(
+	ctx context.Context, txn *sql.Tx, localpart string, kind api.PusherKind, url string, request []byte, ts gomatrixserverlib.Timestamp,
+) (id int64, err error) {
+	err = sqlutil.TxStmt(txn, s.insertQueuedPushStmt).QueryRowContext(ctx, localpart, kind, url, string(request), ts).Scan(&id)
+	return
+}
+
+// selectQueuedPushes returns up to limit of the queued pushes which are due to
+// be sent at the given time, oldest first.
+func (s *pushQueueStatements) selectQueuedPushes(
+	ctx context.Context, txn *sql.Tx, ts gomatrixserverlib.Timestamp, limit int,
+) ([]*api.QueuedPush, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectQueuedPushesStmt).QueryContext(ctx, ts, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQueuedPushes: rows.close() failed")
+
+	var pushes []*api.QueuedPush
+	for rows.Next() {
+		var push api.QueuedPush
+		var request string
+		if err = rows.Scan(&push.ID, &push.Localpart, &push.Kind, &push.URL, &request, &push.Attempts, &push.NextAttemptTS); err != nil {
+			return nil, err
+		}
+		push.Request = []byte(request)
+		pushes = append(pushes, &push)
+	}
+	return pushes, rows.Err()
+}
+
+// selectNextQueuedPushTS returns when the next queued push is due to be sent,
+// or false if the queue is empty.
+func (s *pushQueueStatements) selectNextQueuedPushTS(
+	ctx context.Context, txn *sql.Tx,
+) (gomatrixserverlib.Timestamp, bool, error) {
+	var ts sql.NullInt64
+	if err := sqlutil.TxStmt(txn, s.selectNextQueuedPushTSStmt).QueryRowContext(ctx).Scan(&ts); err != nil {
+		return 0, false, err
+	}
+	return gomatrixserverlib.Timestamp(ts.Int64), ts.Valid, nil
+}
+
+func (s *pushQueueStatements) updateQueuedPush(
+	ctx context.Context, txn *sql.Tx, id int64, attempts int, nextAttemptTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateQueuedPushStmt).ExecContext(ctx, attempts, nextAttemptTS, id)
+	return err
+}
+
+func (s *pushQueueStatements) deleteQueuedPush(
+	ctx context.Context, txn *sql.Tx, id int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteQueuedPushStmt).ExecContext(ctx, id)
+	return err
+}
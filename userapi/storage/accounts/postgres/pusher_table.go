@@ -0,0 +1,188 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const pushersSchema = `
+-- Stores the pushers registered by users, which push notifications are sent to.
+CREATE TABLE IF NOT EXISTS account_pushers (
+	id BIGSERIAL PRIMARY KEY,
+	-- The localpart of the user who registered the pusher
+	localpart TEXT NOT NULL,
+	-- The session ID of the device which registered the pusher
+	session_id BIGINT NOT NULL DEFAULT 0,
+	-- The pushkey, which identifies the pusher to the push gateway
+	pushkey TEXT NOT NULL,
+	-- When the pushkey was last updated, as a unix timestamp (ms resolution)
+	pushkey_ts_ms BIGINT NOT NULL DEFAULT 0,
+	-- The kind of pusher, e.g. "http"
+	kind TEXT NOT NULL,
+	-- The reverse-DNS style identifier of the application
+	app_id TEXT NOT NULL,
+	app_display_name TEXT NOT NULL,
+	device_display_name TEXT NOT NULL,
+	profile_tag TEXT NOT NULL,
+	-- The preferred language for notifications
+	lang TEXT NOT NULL,
+	-- The JSON data for the pusher, including the push gateway URL
+	data TEXT NOT NULL,
+	UNIQUE (app_id, pushkey, localpart)
+);
+CREATE INDEX IF NOT EXISTS account_pushers_localpart_idx ON account_pushers(localpart);
+CREATE INDEX IF NOT EXISTS account_pushers_app_id_pushkey_idx ON account_pushers(app_id, pushkey);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO account_pushers (localpart, session_id, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)" +
+	" ON CONFLICT (app_id, pushkey, localpart) DO UPDATE SET session_id = $2, pushkey_ts_ms = $4, kind = $5, app_display_name = $7, device_display_name = $8, profile_tag = $9, lang = $10, data = $11"
+
+const selectPushersSQL = "" +
+	"SELECT session_id, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data" +
+	" FROM account_pushers WHERE localpart = $1 ORDER BY id ASC"
+
+const selectAllPushersSQL = "" +
+	"SELECT localpart, session_id, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data" +
+	" FROM account_pushers WHERE ($1 = '' OR localpart = $1) AND ($2 = '' OR app_id = $2) AND ($3 = '' OR pushkey = $3)" +
+	" ORDER BY id ASC"
+
+const deletePusherSQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2 AND localpart = $3"
+
+const deletePushersByAppIDAndPushKeySQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2"
+
+type pushersStatements struct {
+	db                                 *sql.DB
+	upsertPusherStmt                   *sql.Stmt
+	selectPushersStmt                  *sql.Stmt
+	selectAllPushersStmt               *sql.Stmt
+	deletePusherStmt                   *sql.Stmt
+	deletePushersByAppIDAndPushKeyStmt *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+	_, err = db.Exec(pushersSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.upsertPusherStmt, upsertPusherSQL},
+		{&s.selectPushersStmt, selectPushersSQL},
+		{&s.selectAllPushersStmt, selectAllPushersSQL},
+		{&s.deletePusherStmt, deletePusherSQL},
+		{&s.deletePushersByAppIDAndPushKeyStmt, deletePushersByAppIDAndPushKeySQL},
+	}.Prepare(db)
+}
+
+// upsertPusher inserts a pusher, or replaces the pusher with the same app ID
+// and pushkey for the user.
+func (s *pushersStatements) upsertPusher(
+	ctx context.Context, txn *sql.Tx, localpart string, pusher *api.Pusher,
+) error {
+	data, err := json.Marshal(pusher.Data)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.upsertPusherStmt).ExecContext(
+		ctx, localpart, pusher.SessionID, pusher.PushKey, pusher.PushKeyTS, pusher.Kind,
+		pusher.AppID, pusher.AppDisplayName, pusher.DeviceDisplayName, pusher.ProfileTag,
+		pusher.Language, string(data),
+	)
+	return err
+}
+
+func (s *pushersStatements) selectPushers(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) ([]api.Pusher, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectPushersStmt).QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPushers: rows.close() failed")
+
+	pushers := []api.Pusher{}
+	for rows.Next() {
+		var pusher api.Pusher
+		var data string
+		if err = rows.Scan(
+			&pusher.SessionID, &pusher.PushKey, &pusher.PushKeyTS, &pusher.Kind,
+			&pusher.AppID, &pusher.AppDisplayName, &pusher.DeviceDisplayName,
+			&pusher.ProfileTag, &pusher.Language, &data,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(data), &pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
+
+// selectAllPushers returns the pushers of all users which match the
+// localpart, app ID and pushkey of the filter. The URL of the filter isn't
+// used, as it is part of the JSON data.
+func (s *pushersStatements) selectAllPushers(
+	ctx context.Context, txn *sql.Tx, filter *api.PusherFilter,
+) ([]api.UserPusher, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectAllPushersStmt).QueryContext(ctx, filter.Localpart, filter.AppID, filter.PushKey)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAllPushers: rows.close() failed")
+
+	pushers := []api.UserPusher{}
+	for rows.Next() {
+		var pusher api.UserPusher
+		var data string
+		if err = rows.Scan(
+			&pusher.Localpart, &pusher.SessionID, &pusher.PushKey, &pusher.PushKeyTS, &pusher.Kind,
+			&pusher.AppID, &pusher.AppDisplayName, &pusher.DeviceDisplayName,
+			&pusher.ProfileTag, &pusher.Language, &data,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(data), &pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
+
+func (s *pushersStatements) deletePusher(
+	ctx context.Context, txn *sql.Tx, appID, pushKey, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePusherStmt).ExecContext(ctx, appID, pushKey, localpart)
+	return err
+}
+
+func (s *pushersStatements) deletePushersByAppIDAndPushKey(
+	ctx context.Context, txn *sql.Tx, appID, pushKey string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePushersByAppIDAndPushKeyStmt).ExecContext(ctx, appID, pushKey)
+	return err
+}
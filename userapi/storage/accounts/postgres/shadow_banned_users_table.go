@@ -0,0 +1,91 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const shadowBannedUsersSchema = `
+-- Stores the users who have been shadow-banned by a server admin. The
+-- events and invites which they send are silently dropped.
+CREATE TABLE IF NOT EXISTS account_shadow_banned_users (
+	-- The Matrix user ID localpart of the shadow-banned user
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- When the user was shadow-banned, as a unix timestamp (ms resolution)
+	banned_ts BIGINT NOT NULL
+);
+`
+
+const insertShadowBannedUserSQL = "" +
+	"INSERT INTO account_shadow_banned_users (localpart, banned_ts) VALUES ($1, $2)" +
+	" ON CONFLICT (localpart) DO NOTHING"
+
+const deleteShadowBannedUserSQL = "" +
+	"DELETE FROM account_shadow_banned_users WHERE localpart = $1"
+
+const selectShadowBannedUserSQL = "" +
+	"SELECT 1 FROM account_shadow_banned_users WHERE localpart = $1"
+
+type shadowBannedUsersStatements struct {
+	insertShadowBannedUserStmt *sql.Stmt
+	deleteShadowBannedUserStmt *sql.Stmt
+	selectShadowBannedUserStmt *sql.Stmt
+}
+
+func (s *shadowBannedUsersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(shadowBannedUsersSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertShadowBannedUserStmt, insertShadowBannedUserSQL},
+		{&s.deleteShadowBannedUserStmt, deleteShadowBannedUserSQL},
+		{&s.selectShadowBannedUserStmt, selectShadowBannedUserSQL},
+	}.Prepare(db)
+}
+
+// insertShadowBannedUser marks the user as shadow-banned. Users who are
+// already shadow-banned keep the time that they were first banned.
+func (s *shadowBannedUsersStatements) insertShadowBannedUser(
+	ctx context.Context, txn *sql.Tx, localpart string, bannedTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertShadowBannedUserStmt).ExecContext(ctx, localpart, bannedTS)
+	return err
+}
+
+// deleteShadowBannedUser lifts the shadow-ban of the user, if any.
+func (s *shadowBannedUsersStatements) deleteShadowBannedUser(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteShadowBannedUserStmt).ExecContext(ctx, localpart)
+	return err
+}
+
+// selectShadowBannedUser returns true if the user is shadow-banned.
+func (s *shadowBannedUsersStatements) selectShadowBannedUser(
+	ctx context.Context, localpart string,
+) (bool, error) {
+	var exists int
+	err := s.selectShadowBannedUserStmt.QueryRowContext(ctx, localpart).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const monthlyActiveUsersSchema = `
+-- Stores when local users were last active, so that the users who have been
+-- active within the last month can be counted.
+CREATE TABLE IF NOT EXISTS account_monthly_active_users (
+	-- The Matrix user ID localpart of the user
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- When the user was last active, as a unix timestamp (ms resolution)
+	last_active_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS account_monthly_active_users_last_active_ts_idx ON account_monthly_active_users(last_active_ts);
+`
+
+const upsertMonthlyActiveUserSQL = "" +
+	"INSERT INTO account_monthly_active_users (localpart, last_active_ts) VALUES ($1, $2)" +
+	" ON CONFLICT (localpart) DO UPDATE SET last_active_ts = $2"
+
+const selectMonthlyActiveUserSQL = "" +
+	"SELECT 1 FROM account_monthly_active_users WHERE localpart = $1 AND last_active_ts >= $2"
+
+const selectMonthlyActiveUsersCountSQL = "" +
+	"SELECT COUNT(*) FROM account_monthly_active_users WHERE last_active_ts >= $1"
+
+const deleteInactiveUsersSQL = "" +
+	"DELETE FROM account_monthly_active_users WHERE last_active_ts < $1"
+
+type monthlyActiveUsersStatements struct {
+	upsertMonthlyActiveUserStmt       *sql.Stmt
+	selectMonthlyActiveUserStmt       *sql.Stmt
+	selectMonthlyActiveUsersCountStmt *sql.Stmt
+	deleteInactiveUsersStmt           *sql.Stmt
+}
+
+func (s *monthlyActiveUsersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(monthlyActiveUsersSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.upsertMonthlyActiveUserStmt, upsertMonthlyActiveUserSQL},
+		{&s.selectMonthlyActiveUserStmt, selectMonthlyActiveUserSQL},
+		{&s.selectMonthlyActiveUsersCountStmt, selectMonthlyActiveUsersCountSQL},
+		{&s.deleteInactiveUsersStmt, deleteInactiveUsersSQL},
+	}.Prepare(db)
+}
+
+// upsertMonthlyActiveUser records that the user was active at the time.
+func (s *monthlyActiveUsersStatements) upsertMonthlyActiveUser(
+	ctx context.Context, txn *sql.Tx, localpart string, activeTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertMonthlyActiveUserStmt).ExecContext(ctx, localpart, activeTS)
+	return err
+}
+
+// selectMonthlyActiveUser returns true if the user has been active since the
+// time.
+func (s *monthlyActiveUsersStatements) selectMonthlyActiveUser(
+	ctx context.Context, localpart string, sinceTS gomatrixserverlib.Timestamp,
+) (bool, error) {
+	var exists int
+	err := s.selectMonthlyActiveUserStmt.QueryRowContext(ctx, localpart, sinceTS).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// selectMonthlyActiveUsersCount returns the number of users who have been
+// active since the time.
+func (s *monthlyActiveUsersStatements) selectMonthlyActiveUsersCount(
+	ctx context.Context, sinceTS gomatrixserverlib.Timestamp,
+) (count int64, err error) {
+	err = s.selectMonthlyActiveUsersCountStmt.QueryRowContext(ctx, sinceTS).Scan(&count)
+	return
+}
+
+// deleteInactiveUsers forgets the users who haven't been active since the
+// time.
+func (s *monthlyActiveUsersStatements) deleteInactiveUsers(
+	ctx context.Context, txn *sql.Tx, sinceTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteInactiveUsersStmt).ExecContext(ctx, sinceTS)
+	return err
+}
@@ -0,0 +1,223 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const notificationsSchema = `
+-- Stores the events which a user was notified about by their push rules.
+CREATE TABLE IF NOT EXISTS account_notifications (
+	-- The ID of the notification, which is also used as the pagination token
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- The localpart of the user who was notified
+	localpart TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	-- The event ID of the root of the thread which the event is in, or ''
+	thread_id TEXT NOT NULL DEFAULT '',
+	-- When the notification was created, as a unix timestamp (ms resolution)
+	ts_ms BIGINT NOT NULL,
+	-- Whether the push rule asked for the event to be highlighted
+	highlight BOOLEAN NOT NULL,
+	-- The notification as returned by /notifications, without the read flag
+	notification_json TEXT NOT NULL,
+	-- Whether the user has read the event
+	read BOOLEAN NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS account_notifications_localpart_id_idx ON account_notifications(localpart, id);
+CREATE INDEX IF NOT EXISTS account_notifications_localpart_room_id_idx ON account_notifications(localpart, room_id);
+`
+
+const insertNotificationSQL = "" +
+	"INSERT INTO account_notifications (localpart, room_id, event_id, thread_id, ts_ms, highlight, notification_json)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)"
+
+const selectNotificationsSQL = "" +
+	"SELECT id, notification_json, read FROM account_notifications" +
+	" WHERE localpart = $1 AND id < $2 AND (NOT $3 OR highlight)" +
+	" ORDER BY id DESC LIMIT $4"
+
+const selectNotificationIDByEventIDSQL = "" +
+	"SELECT MAX(id) FROM account_notifications" +
+	" WHERE localpart = $1 AND room_id = $2 AND event_id = $3"
+
+const updateNotificationsReadUpToIDSQL = "" +
+	"UPDATE account_notifications SET read = 1" +
+	" WHERE localpart = $1 AND room_id = $2 AND id <= $3 AND NOT read"
+
+const updateNotificationsReadUpToTSSQL = "" +
+	"UPDATE account_notifications SET read = 1" +
+	" WHERE localpart = $1 AND room_id = $2 AND ts_ms <= $3 AND NOT read"
+
+const selectRoomNotificationCountsSQL = "" +
+	"SELECT COUNT(*), COALESCE(SUM(CASE WHEN highlight THEN 1 ELSE 0 END), 0)" +
+	" FROM account_notifications" +
+	" WHERE localpart = $1 AND room_id = $2 AND NOT read"
+
+const selectNotificationCountSQL = "" +
+	"SELECT COUNT(*) FROM account_notifications" +
+	" WHERE localpart = $1 AND NOT read"
+
+const selectRoomThreadNotificationCountsSQL = "" +
+	"SELECT thread_id, COUNT(*), COALESCE(SUM(CASE WHEN highlight THEN 1 ELSE 0 END), 0)" +
+	" FROM account_notifications" +
+	" WHERE localpart = $1 AND room_id = $2 AND thread_id <> '' AND NOT read" +
+	" GROUP BY thread_id"
+
+type notificationsStatements struct {
+	insertNotificationStmt            *sql.Stmt
+	selectNotificationsStmt           *sql.Stmt
+	selectNotificationIDByEventIDStmt *sql.Stmt
+	updateNotificationsReadUpToIDStmt *sql.Stmt
+	updateNotificationsReadUpToTSStmt *sql.Stmt
+	selectRoomNotificationCountsStmt  *sql.Stmt
+	selectRoomThreadCountsStmt        *sql.Stmt
+	selectNotificationCountStmt       *sql.Stmt
+}
+
+func (s *notificationsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(notificationsSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertNotificationStmt, insertNotificationSQL},
+		{&s.selectNotificationsStmt, selectNotificationsSQL},
+		{&s.selectNotificationIDByEventIDStmt, selectNotificationIDByEventIDSQL},
+		{&s.updateNotificationsReadUpToIDStmt, updateNotificationsReadUpToIDSQL},
+		{&s.updateNotificationsReadUpToTSStmt, updateNotificationsReadUpToTSSQL},
+		{&s.selectRoomNotificationCountsStmt, selectRoomNotificationCountsSQL},
+		{&s.selectRoomThreadCountsStmt, selectRoomThreadNotificationCountsSQL},
+		{&s.selectNotificationCountStmt, selectNotificationCountSQL},
+	}.Prepare(db)
+}
+
+func (s *notificationsStatements) insertNotification(
+	ctx context.Context, txn *sql.Tx, localpart, threadID string, highlight bool, n *api.Notification,
+) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertNotificationStmt).ExecContext(
+		ctx, localpart, n.RoomID, n.Event.EventID, threadID, n.TS, highlight, string(data),
+	)
+	return err
+}
+
+// selectNotifications returns the user's notifications before the given ID,
+// newest first, along with the ID of the last one returned.
+func (s *notificationsStatements) selectNotifications(
+	ctx context.Context, txn *sql.Tx, localpart string, beforeID int64, limit int, onlyHighlight bool,
+) ([]*api.Notification, int64, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectNotificationsStmt).QueryContext(ctx, localpart, beforeID, onlyHighlight, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectNotifications: rows.close() failed")
+
+	var lastID int64
+	notifications := []*api.Notification{}
+	for rows.Next() {
+		var data string
+		var read bool
+		if err = rows.Scan(&lastID, &data, &read); err != nil {
+			return nil, 0, err
+		}
+		var n api.Notification
+		if err = json.Unmarshal([]byte(data), &n); err != nil {
+			return nil, 0, err
+		}
+		n.Read = read
+		notifications = append(notifications, &n)
+	}
+	return notifications, lastID, rows.Err()
+}
+
+// updateNotificationsRead marks the user's notifications in the room as read
+// up to and including the one for the given event. If the user wasn't
+// notified about the event, then the notifications which were created at or
+// before the given timestamp are marked as read instead. Returns whether any
+// notifications were changed.
+func (s *notificationsStatements) updateNotificationsRead(
+	ctx context.Context, txn *sql.Tx, localpart, roomID, eventID string, ts gomatrixserverlib.Timestamp,
+) (bool, error) {
+	var id sql.NullInt64
+	err := sqlutil.TxStmt(txn, s.selectNotificationIDByEventIDStmt).QueryRowContext(ctx, localpart, roomID, eventID).Scan(&id)
+	if err != nil {
+		return false, err
+	}
+	var res sql.Result
+	if id.Valid {
+		res, err = sqlutil.TxStmt(txn, s.updateNotificationsReadUpToIDStmt).ExecContext(ctx, localpart, roomID, id.Int64)
+	} else {
+		res, err = sqlutil.TxStmt(txn, s.updateNotificationsReadUpToTSStmt).ExecContext(ctx, localpart, roomID, ts)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// selectRoomNotificationCounts returns the number of unread notifications,
+// and how many of those are highlights, for the user in the room.
+func (s *notificationsStatements) selectRoomNotificationCounts(
+	ctx context.Context, txn *sql.Tx, localpart, roomID string,
+) (total int64, highlight int64, err error) {
+	err = sqlutil.TxStmt(txn, s.selectRoomNotificationCountsStmt).QueryRowContext(ctx, localpart, roomID).Scan(&total, &highlight)
+	return
+}
+
+// selectNotificationCount returns the number of unread notifications for the
+// user in all rooms.
+func (s *notificationsStatements) selectNotificationCount(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) (count int64, err error) {
+	err = sqlutil.TxStmt(txn, s.selectNotificationCountStmt).QueryRowContext(ctx, localpart).Scan(&count)
+	return
+}
+
+// selectRoomThreadNotificationCounts returns the unread notification counts of
+// the user's threads in the room which have any, by their root event IDs.
+func (s *notificationsStatements) selectRoomThreadNotificationCounts(
+	ctx context.Context, txn *sql.Tx, localpart, roomID string,
+) (map[string]*api.NotificationCounts, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomThreadCountsStmt).QueryContext(ctx, localpart, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomThreadNotificationCounts: rows.close() failed")
+
+	counts := map[string]*api.NotificationCounts{}
+	for rows.Next() {
+		var threadID string
+		var c api.NotificationCounts
+		if err = rows.Scan(&threadID, &c.Total, &c.Highlight); err != nil {
+			return nil, err
+		}
+		counts[threadID] = &c
+	}
+	return counts, rows.Err()
+}
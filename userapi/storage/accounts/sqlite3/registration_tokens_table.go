@@ -0,0 +1,175 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const registrationTokensSchema = `
+-- Stores the tokens which can be used to register when registration
+-- requires a token (MSC3231).
+CREATE TABLE IF NOT EXISTS account_registration_tokens (
+	token TEXT NOT NULL PRIMARY KEY,
+	-- The number of registrations the token can be used for, or NULL if
+	-- the number of uses is unlimited
+	uses_allowed INTEGER,
+	-- The number of registrations which have used the token
+	completed INTEGER NOT NULL DEFAULT 0,
+	-- When the token expires, as a unix timestamp (ms resolution), or NULL
+	-- if it never expires
+	expiry_time BIGINT
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO account_registration_tokens (token, uses_allowed, expiry_time) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (token) DO NOTHING"
+
+const selectRegistrationTokenSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM account_registration_tokens WHERE token = $1"
+
+const selectRegistrationTokensSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM account_registration_tokens ORDER BY token"
+
+const deleteRegistrationTokenSQL = "" +
+	"DELETE FROM account_registration_tokens WHERE token = $1"
+
+const useRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET completed = completed + 1 WHERE token = $1" +
+	" AND (uses_allowed IS NULL OR completed < uses_allowed)" +
+	" AND (expiry_time IS NULL OR expiry_time > $2)"
+
+type registrationTokensStatements struct {
+	insertRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokensStmt *sql.Stmt
+	deleteRegistrationTokenStmt  *sql.Stmt
+	useRegistrationTokenStmt     *sql.Stmt
+}
+
+func (s *registrationTokensStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(registrationTokensSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertRegistrationTokenStmt, insertRegistrationTokenSQL},
+		{&s.selectRegistrationTokenStmt, selectRegistrationTokenSQL},
+		{&s.selectRegistrationTokensStmt, selectRegistrationTokensSQL},
+		{&s.deleteRegistrationTokenStmt, deleteRegistrationTokenSQL},
+		{&s.useRegistrationTokenStmt, useRegistrationTokenSQL},
+	}.Prepare(db)
+}
+
+// insertRegistrationToken creates the token, returning false if a token with
+// the same name already exists.
+func (s *registrationTokensStatements) insertRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token api.RegistrationToken,
+) (bool, error) {
+	var usesAllowed sql.NullInt32
+	if token.UsesAllowed != nil {
+		usesAllowed = sql.NullInt32{Int32: *token.UsesAllowed, Valid: true}
+	}
+	var expiryTime sql.NullInt64
+	if token.ExpiryTime != nil {
+		expiryTime = sql.NullInt64{Int64: int64(*token.ExpiryTime), Valid: true}
+	}
+	res, err := sqlutil.TxStmt(txn, s.insertRegistrationTokenStmt).ExecContext(ctx, token.Token, usesAllowed, expiryTime)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// selectRegistrationToken returns the token, or nil if it doesn't exist.
+func (s *registrationTokensStatements) selectRegistrationToken(
+	ctx context.Context, token string,
+) (*api.RegistrationToken, error) {
+	t, err := scanRegistrationToken(s.selectRegistrationTokenStmt.QueryRowContext(ctx, token))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (s *registrationTokensStatements) selectRegistrationTokens(
+	ctx context.Context,
+) ([]api.RegistrationToken, error) {
+	rows, err := s.selectRegistrationTokensStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRegistrationTokens: rows.close() failed")
+	tokens := []api.RegistrationToken{}
+	for rows.Next() {
+		t, err := scanRegistrationToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// deleteRegistrationToken deletes the token, returning false if it didn't
+// exist.
+func (s *registrationTokensStatements) deleteRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteRegistrationTokenStmt).ExecContext(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// useRegistrationToken counts a registration against the token, returning
+// false if the token doesn't exist, has been used up or has expired.
+func (s *registrationTokensStatements) useRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string, now gomatrixserverlib.Timestamp,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.useRegistrationTokenStmt).ExecContext(ctx, token, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func scanRegistrationToken(row interface{ Scan(...interface{}) error }) (*api.RegistrationToken, error) {
+	var t api.RegistrationToken
+	var usesAllowed sql.NullInt32
+	var expiryTime sql.NullInt64
+	if err := row.Scan(&t.Token, &usesAllowed, &t.Completed, &expiryTime); err != nil {
+		return nil, err
+	}
+	if usesAllowed.Valid {
+		t.UsesAllowed = &usesAllowed.Int32
+	}
+	if expiryTime.Valid {
+		ts := gomatrixserverlib.Timestamp(expiryTime.Int64)
+		t.ExpiryTime = &ts
+	}
+	return &t, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const ssoIdentitiesSchema = `
+-- Stores which accounts the users who log in with single sign-on have.
+CREATE TABLE IF NOT EXISTS account_sso_identities (
+	-- The ID of the identity provider in the config file
+	provider_id TEXT NOT NULL,
+	-- The ID of the user at the identity provider
+	subject TEXT NOT NULL,
+	-- The Matrix user ID localpart of the user's account
+	localpart TEXT NOT NULL,
+	PRIMARY KEY (provider_id, subject)
+);
+
+CREATE INDEX IF NOT EXISTS account_sso_identities_localpart_idx ON account_sso_identities(localpart);
+`
+
+const insertSSOIdentitySQL = "" +
+	"INSERT INTO account_sso_identities (provider_id, subject, localpart) VALUES ($1, $2, $3)"
+
+const selectLocalpartForSSOIdentitySQL = "" +
+	"SELECT localpart FROM account_sso_identities WHERE provider_id = $1 AND subject = $2"
+
+const deleteSSOIdentitiesForLocalpartSQL = "" +
+	"DELETE FROM account_sso_identities WHERE localpart = $1"
+
+type ssoIdentitiesStatements struct {
+	insertSSOIdentityStmt               *sql.Stmt
+	selectLocalpartForSSOIdentityStmt   *sql.Stmt
+	deleteSSOIdentitiesForLocalpartStmt *sql.Stmt
+}
+
+func (s *ssoIdentitiesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(ssoIdentitiesSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertSSOIdentityStmt, insertSSOIdentitySQL},
+		{&s.selectLocalpartForSSOIdentityStmt, selectLocalpartForSSOIdentitySQL},
+		{&s.deleteSSOIdentitiesForLocalpartStmt, deleteSSOIdentitiesForLocalpartSQL},
+	}.Prepare(db)
+}
+
+func (s *ssoIdentitiesStatements) insertSSOIdentity(
+	ctx context.Context, txn *sql.Tx, providerID, subject, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertSSOIdentityStmt).ExecContext(ctx, providerID, subject, localpart)
+	return err
+}
+
+// selectLocalpartForSSOIdentity returns the localpart of the account which
+// the user has, or an empty string if they don't have one.
+func (s *ssoIdentitiesStatements) selectLocalpartForSSOIdentity(
+	ctx context.Context, providerID, subject string,
+) (localpart string, err error) {
+	err = s.selectLocalpartForSSOIdentityStmt.QueryRowContext(ctx, providerID, subject).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
+func (s *ssoIdentitiesStatements) deleteSSOIdentitiesForLocalpart(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteSSOIdentitiesForLocalpartStmt).ExecContext(ctx, localpart)
+	return err
+}
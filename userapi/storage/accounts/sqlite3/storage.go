@@ -25,12 +25,14 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts/sqlite3/deltas"
 	"github.com/matrix-org/gomatrixserverlib"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/matrix-org/util"
 )
 
 // Database represents an account database
@@ -46,9 +48,23 @@ type Database struct {
 	openIDTokens          tokenStatements
 	keyBackupVersions     keyBackupVersionStatements
 	keyBackups            keyBackupStatements
+	pushers               pushersStatements
+	notifications         notificationsStatements
+	pushQueue             pushQueueStatements
+	erasedUsers           erasedUsersStatements
+	shadowBannedUsers     shadowBannedUsersStatements
+	lockedUsers           lockedUsersStatements
+	accountValidity       accountValidityStatements
+	consent               consentStatements
+	profileFields         profileFieldsStatements
+	registrationTokens    registrationTokensStatements
+	ssoIdentities         ssoIdentitiesStatements
+	monthlyActiveUsers    monthlyActiveUsersStatements
+	userDirectory         userDirectoryStatements
 	serverName            gomatrixserverlib.ServerName
-	bcryptCost            int
+	passwordHasher        *passwordhash.Hasher
 	openIDTokenLifetimeMS int64
+	defaultPushRules      *pushrules.DefaultRuleOverrides
 
 	accountsMu     sync.Mutex
 	profilesMu     sync.Mutex
@@ -57,7 +73,7 @@ type Database struct {
 }
 
 // NewDatabase creates a new accounts and profiles database
-func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName, bcryptCost int, openIDTokenLifetimeMS int64) (*Database, error) {
+func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName, passwordHasher *passwordhash.Hasher, openIDTokenLifetimeMS int64, defaultPushRules *pushrules.DefaultRuleOverrides) (*Database, error) {
 	db, err := sqlutil.Open(dbProperties)
 	if err != nil {
 		return nil, err
@@ -66,8 +82,9 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 		serverName:            serverName,
 		db:                    db,
 		writer:                sqlutil.NewExclusiveWriter(),
-		bcryptCost:            bcryptCost,
+		passwordHasher:        passwordHasher,
 		openIDTokenLifetimeMS: openIDTokenLifetimeMS,
+		defaultPushRules:      defaultPushRules,
 	}
 
 	// Create tables before executing migrations so we don't fail if the table is missing,
@@ -77,6 +94,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadIsActive(m)
+	deltas.LoadAddAccountType(m)
 	if err = m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -106,6 +124,45 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.keyBackups.prepare(db); err != nil {
 		return nil, err
 	}
+	if err = d.pushers.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.notifications.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.pushQueue.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.erasedUsers.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.shadowBannedUsers.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.lockedUsers.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.accountValidity.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.consent.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.profileFields.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.registrationTokens.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.ssoIdentities.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.monthlyActiveUsers.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.userDirectory.prepare(db, serverName); err != nil {
+		return nil, err
+	}
 
 	return d, nil
 }
@@ -119,9 +176,23 @@ func (d *Database) GetAccountByPassword(
 	if err != nil {
 		return nil, err
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintextPassword)); err != nil {
+	needsRehash, err := d.passwordHasher.Compare(hash, plaintextPassword)
+	if err != nil {
 		return nil, err
 	}
+	if needsRehash {
+		// The password was hashed with another algorithm or cost than new
+		// passwords are, which is changed now that we know the password. The
+		// login still succeeds if this fails.
+		if hash, err = d.passwordHasher.Hash(plaintextPassword); err == nil {
+			err = d.writer.Do(nil, nil, func(txn *sql.Tx) error {
+				return d.accounts.updatePassword(ctx, localpart, hash)
+			})
+		}
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Warn("Failed to rehash password")
+		}
+	}
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
 
@@ -191,7 +262,7 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", api.AccountTypeGuest)
 		return err
 	})
 	return acc, err
@@ -201,7 +272,7 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 // for this account. If no password is supplied, the account will be a passwordless account. If the
 // account already exists, it will return nil, ErrUserExists.
 func (d *Database) CreateAccount(
-	ctx context.Context, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, localpart, plaintextPassword, appserviceID string, accountType api.AccountType,
 ) (acc *api.Account, err error) {
 	// Create one account at a time else we can get 'database is locked'.
 	d.profilesMu.Lock()
@@ -211,7 +282,7 @@ func (d *Database) CreateAccount(
 	defer d.accountDatasMu.Unlock()
 	defer d.accountsMu.Unlock()
 	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID, accountType)
 		return err
 	})
 	return
@@ -220,7 +291,7 @@ func (d *Database) CreateAccount(
 // WARNING! This function assumes that the relevant mutexes have already
 // been taken out by the caller (e.g. CreateAccount or CreateGuestAccount).
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string, accountType api.AccountType,
 ) (*api.Account, error) {
 	var err error
 	var account *api.Account
@@ -232,26 +303,28 @@ func (d *Database) createAccount(
 			return nil, err
 		}
 	}
-	if account, err = d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID); err != nil {
+	if account, err = d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID, accountType); err != nil {
 		return nil, sqlutil.ErrUserExists
 	}
 	if err = d.profiles.insertProfile(ctx, txn, localpart); err != nil {
 		return nil, err
 	}
-	if err = d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", json.RawMessage(`{
-		"global": {
-			"content": [],
-			"override": [],
-			"room": [],
-			"sender": [],
-			"underride": []
-		}
-	}`)); err != nil {
+	pushRuleSets := d.DefaultPushRules(localpart)
+	prbs, err := json.Marshal(pushRuleSets)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", json.RawMessage(prbs)); err != nil {
 		return nil, err
 	}
 	return account, nil
 }
 
+// DefaultPushRules returns the push rules that new accounts are given.
+func (d *Database) DefaultPushRules(localpart string) *pushrules.AccountRuleSets {
+	return pushrules.DefaultAccountRuleSets(localpart, d.serverName, d.defaultPushRules)
+}
+
 // SaveAccountData saves new account data for a given user and a given room.
 // If the account data is not specific to a room, the room ID should be an empty string
 // If an account data already exists for a given set (user, room, data type), it will
@@ -298,8 +371,7 @@ func (d *Database) GetNewNumericLocalpart(
 }
 
 func (d *Database) hashPassword(plaintext string) (hash string, err error) {
-	hashBytes, err := bcrypt.GenerateFromPassword([]byte(plaintext), d.bcryptCost)
-	return string(hashBytes), err
+	return d.passwordHasher.Hash(plaintext)
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
@@ -385,6 +457,19 @@ func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
 
+// IsAccountDeactivated returns true if the account has been deactivated, or
+// sql.ErrNoRows if there is no such account.
+func (d *Database) IsAccountDeactivated(ctx context.Context, localpart string) (bool, error) {
+	return d.accounts.selectIsDeactivated(ctx, localpart)
+}
+
+// CountAccounts returns the number of non-guest accounts, along with the number
+// of those accounts which do not belong to an application service.
+func (d *Database) CountAccounts(ctx context.Context) (total, nonBridged int64, err error) {
+	total, appservice, err := d.accounts.selectAccountCounts(ctx)
+	return total, total - appservice, err
+}
+
 // SearchProfiles returns all profiles where the provided localpart or display name
 // match any part of the profiles in the database.
 func (d *Database) SearchProfiles(ctx context.Context, searchString string, limit int,
@@ -399,6 +484,260 @@ func (d *Database) DeactivateAccount(ctx context.Context, localpart string) (err
 	})
 }
 
+// MarkUserErased records that the user asked for their data to be erased.
+func (d *Database) MarkUserErased(ctx context.Context, localpart string) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.erasedUsers.insertErasedUser(ctx, txn, localpart, gomatrixserverlib.AsTimestamp(time.Now()))
+	})
+}
+
+// IsUserErased returns true if the user asked for their data to be erased.
+func (d *Database) IsUserErased(ctx context.Context, localpart string) (bool, error) {
+	return d.erasedUsers.selectErasedUser(ctx, localpart)
+}
+
+// SetShadowBanned shadow-bans the user, or lifts their shadow-ban.
+func (d *Database) SetShadowBanned(ctx context.Context, localpart string, shadowBanned bool) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if !shadowBanned {
+			return d.shadowBannedUsers.deleteShadowBannedUser(ctx, txn, localpart)
+		}
+		return d.shadowBannedUsers.insertShadowBannedUser(ctx, txn, localpart, gomatrixserverlib.AsTimestamp(time.Now()))
+	})
+}
+
+// IsShadowBanned returns true if the user is shadow-banned.
+func (d *Database) IsShadowBanned(ctx context.Context, localpart string) (bool, error) {
+	return d.shadowBannedUsers.selectShadowBannedUser(ctx, localpart)
+}
+
+// SetAccountLocked locks or unlocks the account of the user.
+func (d *Database) SetAccountLocked(ctx context.Context, localpart string, locked bool) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if !locked {
+			return d.lockedUsers.deleteLockedUser(ctx, txn, localpart)
+		}
+		return d.lockedUsers.insertLockedUser(ctx, txn, localpart, gomatrixserverlib.AsTimestamp(time.Now()))
+	})
+}
+
+// IsAccountLocked returns true if the account of the user is locked.
+func (d *Database) IsAccountLocked(ctx context.Context, localpart string) (bool, error) {
+	return d.lockedUsers.selectLockedUser(ctx, localpart)
+}
+
+// SetAccountExpiry sets when the account of the user expires, unless it is
+// renewed. A new renewal email is sent before then.
+func (d *Database) SetAccountExpiry(ctx context.Context, localpart string, expirationTS gomatrixserverlib.Timestamp) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.accountValidity.upsertAccountValidity(ctx, txn, localpart, expirationTS)
+	})
+}
+
+// SetMissingAccountExpiries sets when the accounts which don't have an expiry
+// time yet expire, returning how many there were.
+func (d *Database) SetMissingAccountExpiries(ctx context.Context, expirationTS gomatrixserverlib.Timestamp) (count int64, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		count, err = d.accountValidity.insertMissingAccountValidity(ctx, txn, expirationTS)
+		return err
+	})
+	return
+}
+
+// GetAccountExpiry returns when the account of the user expires, or 0 if it
+// doesn't.
+func (d *Database) GetAccountExpiry(ctx context.Context, localpart string) (gomatrixserverlib.Timestamp, error) {
+	return d.accountValidity.selectAccountValidity(ctx, localpart)
+}
+
+// GetAccountsExpiringBefore returns when the accounts which expire before the
+// time expire, by localpart, leaving out those which a renewal email has
+// already been sent for.
+func (d *Database) GetAccountsExpiringBefore(ctx context.Context, beforeTS gomatrixserverlib.Timestamp) (map[string]gomatrixserverlib.Timestamp, error) {
+	return d.accountValidity.selectAccountsExpiring(ctx, beforeTS)
+}
+
+// SetAccountRenewalToken records the token in the renewal link which was
+// emailed to the user.
+func (d *Database) SetAccountRenewalToken(ctx context.Context, localpart, token string) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.accountValidity.updateRenewalToken(ctx, txn, localpart, token)
+	})
+}
+
+// GetLocalpartForRenewalToken returns the user who was emailed the renewal
+// token, or an empty string if there is no such token.
+func (d *Database) GetLocalpartForRenewalToken(ctx context.Context, token string) (string, error) {
+	return d.accountValidity.selectLocalpartByRenewalToken(ctx, token)
+}
+
+// SetConsentVersion records that the user agreed to the version of the
+// privacy policy.
+func (d *Database) SetConsentVersion(ctx context.Context, localpart, version string) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.consent.upsertConsent(ctx, txn, localpart, version, gomatrixserverlib.AsTimestamp(time.Now()))
+	})
+}
+
+// GetConsentVersion returns the version of the privacy policy which the user
+// agreed to most recently, or an empty string if they haven't agreed to any.
+func (d *Database) GetConsentVersion(ctx context.Context, localpart string) (string, error) {
+	return d.consent.selectConsent(ctx, localpart)
+}
+
+// GetProfileFields returns the custom fields of the user's profile, keyed
+// by their names.
+func (d *Database) GetProfileFields(ctx context.Context, localpart string) (map[string]json.RawMessage, error) {
+	return d.profileFields.selectProfileFields(ctx, localpart)
+}
+
+// SetProfileField sets the custom field of the user's profile to the JSON
+// value, replacing any value that it already has.
+func (d *Database) SetProfileField(ctx context.Context, localpart, name string, value json.RawMessage) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.profileFields.upsertProfileField(ctx, txn, localpart, name, value)
+	})
+}
+
+// RemoveProfileField removes the custom field from the user's profile.
+func (d *Database) RemoveProfileField(ctx context.Context, localpart, name string) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.profileFields.deleteProfileField(ctx, txn, localpart, name)
+	})
+}
+
+// RemoveProfileFields removes all of the custom fields from the user's
+// profile.
+func (d *Database) RemoveProfileFields(ctx context.Context, localpart string) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.profileFields.deleteProfileFields(ctx, txn, localpart)
+	})
+}
+
+// InsertRegistrationToken creates the registration token, returning false if
+// a token with the same name already exists.
+func (d *Database) InsertRegistrationToken(ctx context.Context, token api.RegistrationToken) (created bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		created, err = d.registrationTokens.insertRegistrationToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+// RemoveRegistrationToken deletes the registration token, returning false if
+// it didn't exist.
+func (d *Database) RemoveRegistrationToken(ctx context.Context, token string) (removed bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		removed, err = d.registrationTokens.deleteRegistrationToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+// UseRegistrationToken counts a registration against the token, returning
+// false if the token can't be used.
+func (d *Database) UseRegistrationToken(ctx context.Context, token string) (used bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		used, err = d.registrationTokens.useRegistrationToken(ctx, txn, token, gomatrixserverlib.AsTimestamp(time.Now()))
+		return err
+	})
+	return
+}
+
+// GetRegistrationToken returns the registration token, or nil if it doesn't
+// exist.
+func (d *Database) GetRegistrationToken(ctx context.Context, token string) (*api.RegistrationToken, error) {
+	return d.registrationTokens.selectRegistrationToken(ctx, token)
+}
+
+// GetRegistrationTokens returns all of the registration tokens.
+func (d *Database) GetRegistrationTokens(ctx context.Context) ([]api.RegistrationToken, error) {
+	return d.registrationTokens.selectRegistrationTokens(ctx)
+}
+
+// SaveSSOIdentity records that the user who logs in with the identity
+// provider has the account with the given localpart.
+func (d *Database) SaveSSOIdentity(ctx context.Context, providerID, subject, localpart string) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.ssoIdentities.insertSSOIdentity(ctx, txn, providerID, subject, localpart)
+	})
+}
+
+// RemoveSSOIdentities forgets which single sign-on users have the account.
+func (d *Database) RemoveSSOIdentities(ctx context.Context, localpart string) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.ssoIdentities.deleteSSOIdentitiesForLocalpart(ctx, txn, localpart)
+	})
+}
+
+// GetLocalpartForSSOIdentity returns the localpart of the account which the
+// user who logs in with the identity provider has, or an empty string if they
+// don't have one.
+func (d *Database) GetLocalpartForSSOIdentity(ctx context.Context, providerID, subject string) (string, error) {
+	return d.ssoIdentities.selectLocalpartForSSOIdentity(ctx, providerID, subject)
+}
+
+// UpsertMonthlyActiveUser records that the user was active at the time.
+func (d *Database) UpsertMonthlyActiveUser(ctx context.Context, localpart string, activeTS gomatrixserverlib.Timestamp) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.monthlyActiveUsers.upsertMonthlyActiveUser(ctx, txn, localpart, activeTS)
+	})
+}
+
+// IsMonthlyActiveUser returns true if the user has been active since the time.
+func (d *Database) IsMonthlyActiveUser(ctx context.Context, localpart string, sinceTS gomatrixserverlib.Timestamp) (bool, error) {
+	return d.monthlyActiveUsers.selectMonthlyActiveUser(ctx, localpart, sinceTS)
+}
+
+// CountMonthlyActiveUsers returns the number of users who have been active
+// since the time.
+func (d *Database) CountMonthlyActiveUsers(ctx context.Context, sinceTS gomatrixserverlib.Timestamp) (int64, error) {
+	return d.monthlyActiveUsers.selectMonthlyActiveUsersCount(ctx, sinceTS)
+}
+
+// RemoveInactiveUsers forgets the users who haven't been active since the
+// time, so that they are no longer counted.
+func (d *Database) RemoveInactiveUsers(ctx context.Context, sinceTS gomatrixserverlib.Timestamp) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.monthlyActiveUsers.deleteInactiveUsers(ctx, txn, sinceTS)
+	})
+}
+
+// UpdateUserDirectory updates the users who are joined to the room in the
+// user directory. All of the users in the room are forgotten before the
+// changes are made if the room state was rewritten.
+func (d *Database) UpdateUserDirectory(
+	ctx context.Context, roomID string, rewrite bool, joined []authtypes.FullyQualifiedProfile, left []string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if rewrite {
+			if err := d.userDirectory.deleteUserDirectoryRoom(ctx, txn, roomID); err != nil {
+				return err
+			}
+		}
+		for i := range joined {
+			if err := d.userDirectory.upsertUserDirectoryMember(ctx, txn, roomID, &joined[i]); err != nil {
+				return err
+			}
+		}
+		for _, userID := range left {
+			if err := d.userDirectory.deleteUserDirectoryMember(ctx, txn, roomID, userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SearchUserDirectory returns the users who share a room with the user and
+// whose user ID or display name matches the search string. Remote users are
+// only included if includeRemote is true.
+func (d *Database) SearchUserDirectory(
+	ctx context.Context, userID, searchString string, includeRemote bool, limit int,
+) ([]authtypes.FullyQualifiedProfile, error) {
+	return d.userDirectory.selectUserDirectoryBySearch(ctx, userID, searchString, includeRemote, limit)
+}
+
 // CreateOpenIDToken persists a new token that was issued for OpenID Connect
 func (d *Database) CreateOpenIDToken(
 	ctx context.Context,
@@ -540,19 +879,11 @@ func (d *Database) UpsertBackupKeys(
 			return err
 		}
 		if changed {
-			// update the etag
-			var newETag string
-			if oldETag == "" {
-				newETag = "1"
-			} else {
-				oldETagInt, err := strconv.ParseInt(oldETag, 10, 64)
-				if err != nil {
-					return fmt.Errorf("failed to parse old etag: %s", err)
-				}
-				newETag = strconv.FormatInt(oldETagInt+1, 10)
+			etag, err = nextKeyBackupETag(oldETag)
+			if err != nil {
+				return err
 			}
-			etag = newETag
-			return d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, version, newETag)
+			return d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, version, etag)
 		} else {
 			etag = oldETag
 		}
@@ -561,3 +892,198 @@ func (d *Database) UpsertBackupKeys(
 	})
 	return
 }
+
+// DeleteBackupKeys deletes the keys of the backup version, or only those of
+// the room or (room, session) if given. It returns the number of keys left in
+// the backup and its etag, which changes if any keys were deleted.
+// nolint:nakedret
+func (d *Database) DeleteBackupKeys(
+	ctx context.Context, version, userID, filterRoomID, filterSessionID string,
+) (count int64, etag string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		_, _, _, oldETag, deleted, err := d.keyBackupVersions.selectKeyBackup(ctx, txn, userID, version)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			return fmt.Errorf("backup was deleted")
+		}
+		removed, err := d.keyBackups.deleteKeys(ctx, txn, userID, version, filterRoomID, filterSessionID)
+		if err != nil {
+			return fmt.Errorf("d.keyBackups.deleteKeys: %w", err)
+		}
+		count, err = d.keyBackups.countKeys(ctx, txn, userID, version)
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			etag = oldETag
+			return nil
+		}
+		etag, err = nextKeyBackupETag(oldETag)
+		if err != nil {
+			return err
+		}
+		return d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, version, etag)
+	})
+	return
+}
+
+// nextKeyBackupETag returns the etag of a backup after its keys have changed.
+func nextKeyBackupETag(oldETag string) (string, error) {
+	if oldETag == "" {
+		return "1", nil
+	}
+	oldETagInt, err := strconv.ParseInt(oldETag, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse old etag: %s", err)
+	}
+	return strconv.FormatInt(oldETagInt+1, 10), nil
+}
+
+// UpsertPusher creates the pusher, or replaces the existing pusher for the
+// user with the same app ID and pushkey.
+func (d *Database) UpsertPusher(
+	ctx context.Context, pusher api.Pusher, localpart string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushers.upsertPusher(ctx, txn, localpart, &pusher)
+	})
+}
+
+// GetPushers returns the pushers registered by the user.
+func (d *Database) GetPushers(
+	ctx context.Context, localpart string,
+) ([]api.Pusher, error) {
+	return d.pushers.selectPushers(ctx, nil, localpart)
+}
+
+// GetAllPushers returns the pushers of all users which match the localpart,
+// app ID and pushkey of the filter.
+func (d *Database) GetAllPushers(
+	ctx context.Context, filter api.PusherFilter,
+) ([]api.UserPusher, error) {
+	return d.pushers.selectAllPushers(ctx, nil, &filter)
+}
+
+// RemovePusher deletes the user's pusher with the given app ID and pushkey.
+func (d *Database) RemovePusher(
+	ctx context.Context, appID, pushKey, localpart string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushers.deletePusher(ctx, txn, appID, pushKey, localpart)
+	})
+}
+
+// RemovePushers deletes the pushers with the given app ID and pushkey for
+// all users.
+func (d *Database) RemovePushers(
+	ctx context.Context, appID, pushKey string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushers.deletePushersByAppIDAndPushKey(ctx, txn, appID, pushKey)
+	})
+}
+
+// InsertNotification stores a notification for the user. The thread ID is the
+// event ID of the root of the thread which the event is in, or "" if it isn't
+// in a thread.
+func (d *Database) InsertNotification(
+	ctx context.Context, localpart, threadID string, highlight bool, n *api.Notification,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.notifications.insertNotification(ctx, txn, localpart, threadID, highlight, n)
+	})
+}
+
+// GetNotifications returns up to limit of the user's notifications which are
+// older than the given ID, newest first, along with the ID of the oldest one
+// returned, which can be used to fetch the next page.
+func (d *Database) GetNotifications(
+	ctx context.Context, localpart string, beforeID int64, limit int, onlyHighlight bool,
+) ([]*api.Notification, int64, error) {
+	return d.notifications.selectNotifications(ctx, nil, localpart, beforeID, limit, onlyHighlight)
+}
+
+// SetNotificationsRead marks the user's notifications in the room as read up
+// to the given event, e.g. when they send a read receipt for it. Returns
+// whether any notifications were changed.
+func (d *Database) SetNotificationsRead(
+	ctx context.Context, localpart, roomID, eventID string, ts gomatrixserverlib.Timestamp,
+) (affected bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		affected, err = d.notifications.updateNotificationsRead(ctx, txn, localpart, roomID, eventID, ts)
+		return err
+	})
+	return
+}
+
+// GetRoomNotificationCounts returns the number of unread notifications, and how
+// many of those are highlights, for the user in the room.
+func (d *Database) GetRoomNotificationCounts(
+	ctx context.Context, localpart, roomID string,
+) (total int64, highlight int64, err error) {
+	return d.notifications.selectRoomNotificationCounts(ctx, nil, localpart, roomID)
+}
+
+// GetNotificationCount returns the number of unread notifications for the user
+// in all rooms, which push gateways show as the badge count.
+func (d *Database) GetNotificationCount(ctx context.Context, localpart string) (int64, error) {
+	return d.notifications.selectNotificationCount(ctx, nil, localpart)
+}
+
+// GetRoomThreadNotificationCounts returns the unread notification counts of
+// the user's threads in the room which have any, by their root event IDs.
+func (d *Database) GetRoomThreadNotificationCounts(
+	ctx context.Context, localpart, roomID string,
+) (map[string]*api.NotificationCounts, error) {
+	return d.notifications.selectRoomThreadNotificationCounts(ctx, nil, localpart, roomID)
+}
+
+// QueuePush adds a request for the pushers of the given kind at the URL to the
+// queue, to be sent as soon as possible.
+func (d *Database) QueuePush(
+	ctx context.Context, localpart string, kind api.PusherKind, url string, request []byte,
+) (id int64, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		id, err = d.pushQueue.insertQueuedPush(ctx, txn, localpart, kind, url, request, gomatrixserverlib.AsTimestamp(time.Now()))
+		return err
+	})
+	return
+}
+
+// GetDueQueuedPushes returns up to limit of the queued pushes which are due to
+// be sent at the given time, oldest first.
+func (d *Database) GetDueQueuedPushes(
+	ctx context.Context, ts gomatrixserverlib.Timestamp, limit int,
+) ([]*api.QueuedPush, error) {
+	return d.pushQueue.selectQueuedPushes(ctx, nil, ts, limit)
+}
+
+// GetNextQueuedPushTS returns when the next queued push is due to be sent, or
+// false if there are none.
+func (d *Database) GetNextQueuedPushTS(
+	ctx context.Context,
+) (gomatrixserverlib.Timestamp, bool, error) {
+	return d.pushQueue.selectNextQueuedPushTS(ctx, nil)
+}
+
+// RescheduleQueuedPush records a failed attempt to send the queued push, and
+// when it should next be attempted.
+func (d *Database) RescheduleQueuedPush(
+	ctx context.Context, id int64, attempts int, nextAttemptTS gomatrixserverlib.Timestamp,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushQueue.updateQueuedPush(ctx, txn, id, attempts, nextAttemptTS)
+	})
+}
+
+// RemoveQueuedPush removes the push from the queue once it has been sent, or
+// given up on.
+func (d *Database) RemoveQueuedPush(
+	ctx context.Context, id int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushQueue.deleteQueuedPush(ctx, txn, id)
+	})
+}
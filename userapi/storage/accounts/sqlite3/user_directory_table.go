@@ -0,0 +1,142 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const userDirectorySchema = `
+-- Stores the users who are joined to the rooms which the server is in, with
+-- their profiles in those rooms, so that users can find the people who they
+-- share rooms with in the user directory.
+CREATE TABLE IF NOT EXISTS account_user_directory (
+	-- The room that the user is joined to
+	room_id TEXT NOT NULL,
+	-- The Matrix user ID of the user
+	user_id TEXT NOT NULL,
+	-- The server name of the user ID
+	server_name TEXT NOT NULL,
+	-- The display name that the user has in the room
+	display_name TEXT NOT NULL,
+	-- The avatar URL that the user has in the room
+	avatar_url TEXT NOT NULL,
+	PRIMARY KEY (room_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS account_user_directory_user_id_idx ON account_user_directory(user_id);
+`
+
+const upsertUserDirectoryMemberSQL = "" +
+	"INSERT INTO account_user_directory (room_id, user_id, server_name, display_name, avatar_url) VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (room_id, user_id) DO UPDATE SET display_name = $4, avatar_url = $5"
+
+const deleteUserDirectoryMemberSQL = "" +
+	"DELETE FROM account_user_directory WHERE room_id = $1 AND user_id = $2"
+
+const deleteUserDirectoryRoomSQL = "" +
+	"DELETE FROM account_user_directory WHERE room_id = $1"
+
+// Users can have different profiles in each room, of which one is picked.
+const selectUserDirectoryBySearchSQL = "" +
+	"SELECT user_id, MAX(display_name), MAX(avatar_url) FROM account_user_directory" +
+	" WHERE room_id IN (SELECT room_id FROM account_user_directory WHERE user_id = $1)" +
+	" AND ($2 OR server_name = $3)" +
+	" AND (LOWER(user_id) LIKE $4 OR LOWER(display_name) LIKE $4)" +
+	" GROUP BY user_id ORDER BY user_id LIMIT $5"
+
+type userDirectoryStatements struct {
+	upsertUserDirectoryMemberStmt   *sql.Stmt
+	deleteUserDirectoryMemberStmt   *sql.Stmt
+	deleteUserDirectoryRoomStmt     *sql.Stmt
+	selectUserDirectoryBySearchStmt *sql.Stmt
+	serverName                      gomatrixserverlib.ServerName
+}
+
+func (s *userDirectoryStatements) prepare(db *sql.DB, serverName gomatrixserverlib.ServerName) (err error) {
+	s.serverName = serverName
+	_, err = db.Exec(userDirectorySchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.upsertUserDirectoryMemberStmt, upsertUserDirectoryMemberSQL},
+		{&s.deleteUserDirectoryMemberStmt, deleteUserDirectoryMemberSQL},
+		{&s.deleteUserDirectoryRoomStmt, deleteUserDirectoryRoomSQL},
+		{&s.selectUserDirectoryBySearchStmt, selectUserDirectoryBySearchSQL},
+	}.Prepare(db)
+}
+
+// upsertUserDirectoryMember records that the user is joined to the room with
+// the given profile.
+func (s *userDirectoryStatements) upsertUserDirectoryMember(
+	ctx context.Context, txn *sql.Tx, roomID string, profile *authtypes.FullyQualifiedProfile,
+) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', profile.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.upsertUserDirectoryMemberStmt).ExecContext(
+		ctx, roomID, profile.UserID, domain, profile.DisplayName, profile.AvatarURL,
+	)
+	return err
+}
+
+// deleteUserDirectoryMember records that the user isn't joined to the room.
+func (s *userDirectoryStatements) deleteUserDirectoryMember(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteUserDirectoryMemberStmt).ExecContext(ctx, roomID, userID)
+	return err
+}
+
+// deleteUserDirectoryRoom forgets about all of the users in the room.
+func (s *userDirectoryStatements) deleteUserDirectoryRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteUserDirectoryRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+// selectUserDirectoryBySearch returns the users who share a room with the
+// user and whose user ID or display name contains the search string.
+func (s *userDirectoryStatements) selectUserDirectoryBySearch(
+	ctx context.Context, userID, searchString string, includeRemote bool, limit int,
+) ([]authtypes.FullyQualifiedProfile, error) {
+	var profiles []authtypes.FullyQualifiedProfile
+	rows, err := s.selectUserDirectoryBySearchStmt.QueryContext(
+		ctx, userID, includeRemote, s.serverName, fmt.Sprintf("%%%s%%", strings.ToLower(searchString)), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectUserDirectoryBySearch: rows.close() failed")
+	for rows.Next() {
+		var profile authtypes.FullyQualifiedProfile
+		if err = rows.Scan(&profile.UserID, &profile.DisplayName, &profile.AvatarURL); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, rows.Err()
+}
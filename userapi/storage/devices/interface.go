@@ -16,6 +16,7 @@ package devices
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/userapi/api"
 )
@@ -30,12 +31,34 @@ type Database interface {
 	// and replaced with the given accessToken. If the given accessToken is already in use for another device,
 	// an error will be returned.
 	// If no device ID is given one is generated.
+	// If a refresh token is given then the access token expires at accessTokenExpiresTS.
 	// Returns the device on success.
-	CreateDevice(ctx context.Context, localpart string, deviceID *string, accessToken string, displayName *string, ipAddr, userAgent string) (dev *api.Device, returnErr error)
+	CreateDevice(ctx context.Context, localpart string, deviceID *string, accessToken, refreshToken string, accessTokenExpiresTS int64, displayName *string, ipAddr, userAgent string) (dev *api.Device, returnErr error)
+	// RefreshDeviceTokens replaces the access token and refresh token of the device with the given refresh token, so
+	// that the refresh token can't be used again. Returns the device, or sql.ErrNoRows if no device has the refresh token.
+	RefreshDeviceTokens(ctx context.Context, refreshToken, accessToken, newRefreshToken string, accessTokenExpiresTS int64) (*api.Device, error)
 	UpdateDevice(ctx context.Context, localpart, deviceID string, displayName *string) error
-	UpdateDeviceLastSeen(ctx context.Context, localpart, deviceID, ipAddr string) error
+	// UpdateDeviceLastSeen updates when the device was last seen, and from where.
+	UpdateDeviceLastSeen(ctx context.Context, localpart, deviceID, ipAddr, userAgent string) error
+	// GetDeviceConnections returns the IP addresses and user agents which each of the user's devices have connected
+	// with, keyed by device ID.
+	GetDeviceConnections(ctx context.Context, localpart string) (map[string][]api.DeviceConnection, error)
 	RemoveDevice(ctx context.Context, deviceID, localpart string) error
 	RemoveDevices(ctx context.Context, localpart string, devices []string) error
-	// RemoveAllDevices deleted all devices for this user. Returns the devices deleted.
+	// RemoveAllDevices deleted all devices for this user, except for their dehydrated device. Returns the devices deleted.
 	RemoveAllDevices(ctx context.Context, localpart, exceptDeviceID string) (devices []api.Device, err error)
+	// StoreDehydratedDevice creates a dehydrated device for the user, replacing their previous one. The device can't
+	// be used until it is claimed. Returns the device and the ID of the replaced device, if any.
+	StoreDehydratedDevice(ctx context.Context, localpart string, displayName *string, deviceData json.RawMessage) (dev *api.Device, replacedDeviceID string, err error)
+	// GetDehydratedDevice returns the dehydrated device of the user, or sql.ErrNoRows if they don't have one.
+	GetDehydratedDevice(ctx context.Context, localpart string) (deviceID string, deviceData json.RawMessage, err error)
+	// ClaimDehydratedDevice moves the access token of the user's current device to their dehydrated device with the
+	// given ID, and removes the current device. Returns false if the ID isn't that of their dehydrated device.
+	ClaimDehydratedDevice(ctx context.Context, localpart, deviceID, currentDeviceID, accessToken string) (claimed bool, err error)
+	// CountActiveUsers returns the number of distinct users who have used any
+	// of their devices since the given timestamp, in milliseconds.
+	CountActiveUsers(ctx context.Context, sinceTS int64) (int64, error)
+	// GetDevicesLastSeenBefore returns the devices, apart from dehydrated ones,
+	// which were last seen before the given timestamp, in milliseconds.
+	GetDevicesLastSeenBefore(ctx context.Context, beforeTS int64) ([]api.Device, error)
 }
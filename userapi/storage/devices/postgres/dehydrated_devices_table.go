@@ -0,0 +1,94 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const dehydratedDevicesSchema = `
+-- Stores the dehydrated device of each user (MSC2697). The device itself is
+-- in device_devices, with an access token which is never given out.
+CREATE TABLE IF NOT EXISTS device_dehydrated_devices (
+    -- The Matrix user ID localpart of the user. A user has at most one
+    -- dehydrated device.
+    localpart TEXT NOT NULL PRIMARY KEY,
+    -- The ID of the dehydrated device.
+    device_id TEXT NOT NULL,
+    -- The opaque data the client needs to rehydrate the device, as JSON.
+    device_data TEXT NOT NULL
+);
+`
+
+const upsertDehydratedDeviceSQL = "" +
+	"INSERT INTO device_dehydrated_devices (localpart, device_id, device_data) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (localpart) DO UPDATE SET device_id = $2, device_data = $3"
+
+const selectDehydratedDeviceSQL = "" +
+	"SELECT device_id, device_data FROM device_dehydrated_devices WHERE localpart = $1"
+
+const deleteDehydratedDeviceSQL = "" +
+	"DELETE FROM device_dehydrated_devices WHERE localpart = $1 AND device_id = $2"
+
+type dehydratedDevicesStatements struct {
+	upsertDehydratedDeviceStmt *sql.Stmt
+	selectDehydratedDeviceStmt *sql.Stmt
+	deleteDehydratedDeviceStmt *sql.Stmt
+}
+
+func (s *dehydratedDevicesStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(dehydratedDevicesSchema)
+	return err
+}
+
+func (s *dehydratedDevicesStatements) prepare(db *sql.DB) error {
+	return sqlutil.StatementList{
+		{&s.upsertDehydratedDeviceStmt, upsertDehydratedDeviceSQL},
+		{&s.selectDehydratedDeviceStmt, selectDehydratedDeviceSQL},
+		{&s.deleteDehydratedDeviceStmt, deleteDehydratedDeviceSQL},
+	}.Prepare(db)
+}
+
+func (s *dehydratedDevicesStatements) upsertDehydratedDevice(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID string, deviceData json.RawMessage,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertDehydratedDeviceStmt)
+	_, err := stmt.ExecContext(ctx, localpart, deviceID, string(deviceData))
+	return err
+}
+
+// selectDehydratedDevice returns the dehydrated device of the user, or
+// sql.ErrNoRows if they don't have one.
+func (s *dehydratedDevicesStatements) selectDehydratedDevice(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) (deviceID string, deviceData json.RawMessage, err error) {
+	var data string
+	stmt := sqlutil.TxStmt(txn, s.selectDehydratedDeviceStmt)
+	err = stmt.QueryRowContext(ctx, localpart).Scan(&deviceID, &data)
+	deviceData = json.RawMessage(data)
+	return
+}
+
+func (s *dehydratedDevicesStatements) deleteDehydratedDevice(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteDehydratedDeviceStmt)
+	_, err := stmt.ExecContext(ctx, localpart, deviceID)
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const connectionsSchema = `
+-- Stores the IP addresses and user agents which each device has connected
+-- with, for the whois admin API.
+CREATE TABLE IF NOT EXISTS device_connections (
+    -- The Matrix user ID localpart of the user who owns the device.
+    localpart TEXT NOT NULL,
+    -- The ID of the device.
+    device_id TEXT NOT NULL,
+    -- The IP address which the device connected from.
+    ip TEXT NOT NULL,
+    -- The user agent which the device connected with.
+    user_agent TEXT NOT NULL,
+    -- When the device last connected from the IP address with the user
+    -- agent, as a unix timestamp (ms resolution).
+    last_seen_ts BIGINT NOT NULL,
+    CONSTRAINT device_connections_unique UNIQUE (localpart, device_id, ip, user_agent)
+);
+`
+
+const upsertConnectionSQL = "" +
+	"INSERT INTO device_connections (localpart, device_id, ip, user_agent, last_seen_ts) VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (localpart, device_id, ip, user_agent) DO UPDATE SET last_seen_ts = $5"
+
+const selectConnectionsByLocalpartSQL = "" +
+	"SELECT device_id, ip, user_agent, last_seen_ts FROM device_connections WHERE localpart = $1" +
+	" ORDER BY last_seen_ts DESC"
+
+// Connections are kept until the devices are removed, which can happen in
+// many ways, so they are deleted once they don't belong to any device.
+const deleteStaleConnectionsSQL = "" +
+	"DELETE FROM device_connections WHERE localpart = $1" +
+	" AND device_id NOT IN (SELECT device_id FROM device_devices WHERE localpart = $1)"
+
+type connectionsStatements struct {
+	upsertConnectionStmt             *sql.Stmt
+	selectConnectionsByLocalpartStmt *sql.Stmt
+	deleteStaleConnectionsStmt       *sql.Stmt
+}
+
+func (s *connectionsStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(connectionsSchema)
+	return err
+}
+
+func (s *connectionsStatements) prepare(db *sql.DB) error {
+	return sqlutil.StatementList{
+		{&s.upsertConnectionStmt, upsertConnectionSQL},
+		{&s.selectConnectionsByLocalpartStmt, selectConnectionsByLocalpartSQL},
+		{&s.deleteStaleConnectionsStmt, deleteStaleConnectionsSQL},
+	}.Prepare(db)
+}
+
+func (s *connectionsStatements) upsertConnection(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID, ipAddr, userAgent string, lastSeenTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertConnectionStmt)
+	_, err := stmt.ExecContext(ctx, localpart, deviceID, ipAddr, userAgent, lastSeenTS)
+	return err
+}
+
+// selectConnectionsByLocalpart returns the connections of each of the user's
+// devices, keyed by device ID, with the most recent connections first.
+func (s *connectionsStatements) selectConnectionsByLocalpart(
+	ctx context.Context, localpart string,
+) (map[string][]api.DeviceConnection, error) {
+	rows, err := s.selectConnectionsByLocalpartStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectConnectionsByLocalpart: rows.close() failed")
+	connections := make(map[string][]api.DeviceConnection)
+	for rows.Next() {
+		var deviceID string
+		var conn api.DeviceConnection
+		if err = rows.Scan(&deviceID, &conn.IP, &conn.UserAgent, &conn.LastSeenTS); err != nil {
+			return nil, err
+		}
+		connections[deviceID] = append(connections[deviceID], conn)
+	}
+	return connections, rows.Err()
+}
+
+// deleteStaleConnections deletes the connections of the user's devices
+// which have been removed.
+func (s *connectionsStatements) deleteStaleConnections(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteStaleConnectionsStmt)
+	_, err := stmt.ExecContext(ctx, localpart)
+	return err
+}
@@ -43,20 +43,25 @@ CREATE TABLE IF NOT EXISTS device_devices (
     last_seen_ts BIGINT,
     ip TEXT,
     user_agent TEXT,
+    refresh_token TEXT UNIQUE,
+    access_token_expires_ts BIGINT NOT NULL DEFAULT 0,
 
 		UNIQUE (localpart, device_id)
 );
 `
 
 const insertDeviceSQL = "" +
-	"INSERT INTO device_devices (device_id, localpart, access_token, created_ts, display_name, session_id, last_seen_ts, ip, user_agent)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	"INSERT INTO device_devices (device_id, localpart, access_token, created_ts, display_name, session_id, last_seen_ts, ip, user_agent, refresh_token, access_token_expires_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"
 
 const selectDevicesCountSQL = "" +
 	"SELECT COUNT(access_token) FROM device_devices"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, access_token_expires_ts, COALESCE(last_seen_ts, created_ts) FROM device_devices WHERE access_token = $1"
+
+const selectDeviceRefreshTokenSQL = "" +
+	"SELECT refresh_token FROM device_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
@@ -80,7 +85,21 @@ const selectDevicesByIDSQL = "" +
 	"SELECT device_id, localpart, display_name FROM device_devices WHERE device_id IN ($1)"
 
 const updateDeviceLastSeen = "" +
-	"UPDATE device_devices SET last_seen_ts = $1, ip = $2 WHERE localpart = $3 AND device_id = $4"
+	"UPDATE device_devices SET last_seen_ts = $1, ip = $2, user_agent = $3 WHERE localpart = $4 AND device_id = $5"
+
+const updateDeviceTokensSQL = "" +
+	"UPDATE device_devices SET access_token = $1, refresh_token = $2, access_token_expires_ts = $3 WHERE localpart = $4 AND device_id = $5"
+
+const updateRefreshedTokensSQL = "" +
+	"UPDATE device_devices SET access_token = $1, refresh_token = $2, access_token_expires_ts = $3 WHERE refresh_token = $4"
+
+const selectActiveUserCountSQL = "" +
+	"SELECT COUNT(DISTINCT localpart) FROM device_devices WHERE last_seen_ts > $1"
+
+// Dehydrated devices aren't used until they are claimed, so they don't expire.
+const selectIdleDevicesSQL = "" +
+	"SELECT device_id, localpart FROM device_devices WHERE last_seen_ts < $1" +
+	" AND NOT EXISTS (SELECT 1 FROM device_dehydrated_devices d WHERE d.localpart = device_devices.localpart AND d.device_id = device_devices.device_id)"
 
 type devicesStatements struct {
 	db                           *sql.DB
@@ -88,11 +107,16 @@ type devicesStatements struct {
 	insertDeviceStmt             *sql.Stmt
 	selectDevicesCountStmt       *sql.Stmt
 	selectDeviceByTokenStmt      *sql.Stmt
+	selectDeviceRefreshTokenStmt *sql.Stmt
 	selectDeviceByIDStmt         *sql.Stmt
 	selectDevicesByIDStmt        *sql.Stmt
 	selectDevicesByLocalpartStmt *sql.Stmt
 	updateDeviceNameStmt         *sql.Stmt
 	updateDeviceLastSeenStmt     *sql.Stmt
+	selectActiveUserCountStmt    *sql.Stmt
+	selectIdleDevicesStmt        *sql.Stmt
+	updateDeviceTokensStmt       *sql.Stmt
+	updateRefreshedTokensStmt    *sql.Stmt
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	serverName                   gomatrixserverlib.ServerName
@@ -136,6 +160,21 @@ func (s *devicesStatements) prepare(db *sql.DB, writer sqlutil.Writer, server go
 	if s.updateDeviceLastSeenStmt, err = db.Prepare(updateDeviceLastSeen); err != nil {
 		return
 	}
+	if s.selectActiveUserCountStmt, err = db.Prepare(selectActiveUserCountSQL); err != nil {
+		return
+	}
+	if s.selectIdleDevicesStmt, err = db.Prepare(selectIdleDevicesSQL); err != nil {
+		return
+	}
+	if s.selectDeviceRefreshTokenStmt, err = db.Prepare(selectDeviceRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.updateDeviceTokensStmt, err = db.Prepare(updateDeviceTokensSQL); err != nil {
+		return
+	}
+	if s.updateRefreshedTokensStmt, err = db.Prepare(updateRefreshedTokensSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -144,8 +183,8 @@ func (s *devicesStatements) prepare(db *sql.DB, writer sqlutil.Writer, server go
 // Returns an error if the user already has a device with the given device ID.
 // Returns the device on success.
 func (s *devicesStatements) insertDevice(
-	ctx context.Context, txn *sql.Tx, id, localpart, accessToken string,
-	displayName *string, ipAddr, userAgent string,
+	ctx context.Context, txn *sql.Tx, id, localpart, accessToken, refreshToken string,
+	accessTokenExpiresTS int64, displayName *string, ipAddr, userAgent string,
 ) (*api.Device, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	var sessionID int64
@@ -155,7 +194,7 @@ func (s *devicesStatements) insertDevice(
 		return nil, err
 	}
 	sessionID++
-	if _, err := insertStmt.ExecContext(ctx, id, localpart, accessToken, createdTimeMS, displayName, sessionID, createdTimeMS, ipAddr, userAgent); err != nil {
+	if _, err := insertStmt.ExecContext(ctx, id, localpart, accessToken, createdTimeMS, displayName, sessionID, createdTimeMS, ipAddr, userAgent, nullableString(refreshToken), accessTokenExpiresTS); err != nil {
 		return nil, err
 	}
 	return &api.Device{
@@ -166,6 +205,8 @@ func (s *devicesStatements) insertDevice(
 		LastSeenTS:  createdTimeMS,
 		LastSeenIP:  ipAddr,
 		UserAgent:   userAgent,
+
+		AccessTokenExpiresTS: accessTokenExpiresTS,
 	}, nil
 }
 
@@ -212,12 +253,12 @@ func (s *devicesStatements) updateDeviceName(
 }
 
 func (s *devicesStatements) selectDeviceByToken(
-	ctx context.Context, accessToken string,
+	ctx context.Context, txn *sql.Tx, accessToken string,
 ) (*api.Device, error) {
 	var dev api.Device
 	var localpart string
-	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	stmt := sqlutil.TxStmt(txn, s.selectDeviceByTokenStmt)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.AccessTokenExpiresTS, &dev.LastSeenTS)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -225,6 +266,16 @@ func (s *devicesStatements) selectDeviceByToken(
 	return &dev, err
 }
 
+// selectDeviceRefreshToken returns the refresh token of the device with the
+// access token, or an empty string if it doesn't have one.
+func (s *devicesStatements) selectDeviceRefreshToken(
+	ctx context.Context, txn *sql.Tx, accessToken string,
+) (string, error) {
+	var refreshToken sql.NullString
+	err := sqlutil.TxStmt(txn, s.selectDeviceRefreshTokenStmt).QueryRowContext(ctx, accessToken).Scan(&refreshToken)
+	return refreshToken.String, err
+}
+
 // selectDeviceByID retrieves a device from the database with the given user
 // localpart and deviceID
 func (s *devicesStatements) selectDeviceByID(
@@ -314,9 +365,71 @@ func (s *devicesStatements) selectDevicesByID(ctx context.Context, deviceIDs []s
 	return devices, rows.Err()
 }
 
-func (s *devicesStatements) updateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart, deviceID, ipAddr string) error {
-	lastSeenTs := time.Now().UnixNano() / 1000000
+func (s *devicesStatements) updateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart, deviceID, ipAddr, userAgent string, lastSeenTS int64) error {
 	stmt := sqlutil.TxStmt(txn, s.updateDeviceLastSeenStmt)
-	_, err := stmt.ExecContext(ctx, lastSeenTs, ipAddr, localpart, deviceID)
+	_, err := stmt.ExecContext(ctx, lastSeenTS, ipAddr, userAgent, localpart, deviceID)
+	return err
+}
+
+// updateDeviceTokens replaces the access token of the device, along with
+// its refresh token and when the access token expires.
+func (s *devicesStatements) updateDeviceTokens(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID, accessToken, refreshToken string, accessTokenExpiresTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceTokensStmt)
+	_, err := stmt.ExecContext(ctx, accessToken, nullableString(refreshToken), accessTokenExpiresTS, localpart, deviceID)
 	return err
 }
+
+// updateRefreshedTokens replaces the access token and refresh token of the
+// device with the given refresh token. Returns sql.ErrNoRows if no device
+// has that refresh token.
+func (s *devicesStatements) updateRefreshedTokens(
+	ctx context.Context, txn *sql.Tx, refreshToken, accessToken, newRefreshToken string, accessTokenExpiresTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateRefreshedTokensStmt)
+	res, err := stmt.ExecContext(ctx, accessToken, nullableString(newRefreshToken), accessTokenExpiresTS, refreshToken)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// nullableString stores empty strings as NULL, so that unique columns can
+// be empty for more than one row.
+func nullableString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// selectActiveUserCount returns the number of distinct users who have used
+// any of their devices since the given timestamp.
+func (s *devicesStatements) selectActiveUserCount(ctx context.Context, sinceTS int64) (count int64, err error) {
+	err = s.selectActiveUserCountStmt.QueryRowContext(ctx, sinceTS).Scan(&count)
+	return
+}
+
+// selectIdleDevices returns the devices which were last seen before
+// the given timestamp, in milliseconds.
+func (s *devicesStatements) selectIdleDevices(ctx context.Context, beforeTS int64) ([]api.Device, error) {
+	rows, err := s.selectIdleDevicesStmt.QueryContext(ctx, beforeTS)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectIdleDevices: rows.close() failed")
+	var devices []api.Device
+	for rows.Next() {
+		var dev api.Device
+		var localpart string
+		if err = rows.Scan(&dev.ID, &localpart); err != nil {
+			return nil, err
+		}
+		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+		devices = append(devices, dev)
+	}
+	return devices, rows.Err()
+}
@@ -19,6 +19,8 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -30,11 +32,17 @@ import (
 // The length of generated device IDs
 var deviceIDByteLength = 6
 
+// The length of the access tokens of dehydrated devices, which are never
+// given out.
+var dehydratedTokenByteLength = 32
+
 // Database represents a device database.
 type Database struct {
-	db      *sql.DB
-	writer  sqlutil.Writer
-	devices devicesStatements
+	db                *sql.DB
+	writer            sqlutil.Writer
+	devices           devicesStatements
+	dehydratedDevices dehydratedDevicesStatements
+	connections       connectionsStatements
 }
 
 // NewDatabase creates a new device database
@@ -45,21 +53,36 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	}
 	writer := sqlutil.NewExclusiveWriter()
 	d := devicesStatements{}
+	dd := dehydratedDevicesStatements{}
+	c := connectionsStatements{}
 
 	// Create tables before executing migrations so we don't fail if the table is missing,
 	// and THEN prepare statements so we don't fail due to referencing new columns
 	if err = d.execSchema(db); err != nil {
 		return nil, err
 	}
+	if err = dd.execSchema(db); err != nil {
+		return nil, err
+	}
+	if err = c.execSchema(db); err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadLastSeenTSIP(m)
+	deltas.LoadRefreshTokens(m)
 	if err = m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
 	if err = d.prepare(db, writer, serverName); err != nil {
 		return nil, err
 	}
-	return &Database{db, writer, d}, nil
+	if err = dd.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = c.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, writer, d, dd, c}, nil
 }
 
 // GetDeviceByAccessToken returns the device matching the given access token.
@@ -67,7 +90,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 func (d *Database) GetDeviceByAccessToken(
 	ctx context.Context, token string,
 ) (*api.Device, error) {
-	return d.devices.selectDeviceByToken(ctx, token)
+	return d.devices.selectDeviceByToken(ctx, nil, token)
 }
 
 // GetDeviceByID returns the device matching the given ID.
@@ -94,10 +117,11 @@ func (d *Database) GetDevicesByID(ctx context.Context, deviceIDs []string) ([]ap
 // and replaced with the given accessToken. If the given accessToken is already in use for another device,
 // an error will be returned.
 // If no device ID is given one is generated.
+// If a refresh token is given then the access token expires at accessTokenExpiresTS.
 // Returns the device on success.
 func (d *Database) CreateDevice(
-	ctx context.Context, localpart string, deviceID *string, accessToken string,
-	displayName *string, ipAddr, userAgent string,
+	ctx context.Context, localpart string, deviceID *string, accessToken, refreshToken string,
+	accessTokenExpiresTS int64, displayName *string, ipAddr, userAgent string,
 ) (dev *api.Device, returnErr error) {
 	if deviceID != nil {
 		returnErr = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
@@ -107,7 +131,7 @@ func (d *Database) CreateDevice(
 				return err
 			}
 
-			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, displayName, ipAddr, userAgent)
+			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, refreshToken, accessTokenExpiresTS, displayName, ipAddr, userAgent)
 			return err
 		})
 	} else {
@@ -122,7 +146,7 @@ func (d *Database) CreateDevice(
 
 			returnErr = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
 				var err error
-				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, displayName, ipAddr, userAgent)
+				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, refreshToken, accessTokenExpiresTS, displayName, ipAddr, userAgent)
 				return err
 			})
 			if returnErr == nil {
@@ -136,7 +160,13 @@ func (d *Database) CreateDevice(
 // generateDeviceID creates a new device id. Returns an error if failed to generate
 // random bytes.
 func generateDeviceID() (string, error) {
-	b := make([]byte, deviceIDByteLength)
+	return generateRandomString(deviceIDByteLength)
+}
+
+// generateRandomString creates a random string from the given number of random
+// bytes. Returns an error if failed to generate random bytes.
+func generateRandomString(byteLength int) (string, error) {
+	b := make([]byte, byteLength)
 	_, err := rand.Read(b)
 	if err != nil {
 		return "", err
@@ -163,10 +193,13 @@ func (d *Database) RemoveDevice(
 	ctx context.Context, deviceID, localpart string,
 ) error {
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevice(ctx, txn, deviceID, localpart); err != sql.ErrNoRows {
+		if err := d.dehydratedDevices.deleteDehydratedDevice(ctx, txn, localpart, deviceID); err != nil {
 			return err
 		}
-		return nil
+		if err := d.devices.deleteDevice(ctx, txn, deviceID, localpart); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		return d.connections.deleteStaleConnections(ctx, txn, localpart)
 	})
 }
 
@@ -178,15 +211,21 @@ func (d *Database) RemoveDevices(
 	ctx context.Context, localpart string, devices []string,
 ) error {
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevices(ctx, txn, localpart, devices); err != sql.ErrNoRows {
+		for _, deviceID := range devices {
+			if err := d.dehydratedDevices.deleteDehydratedDevice(ctx, txn, localpart, deviceID); err != nil {
+				return err
+			}
+		}
+		if err := d.devices.deleteDevices(ctx, txn, localpart, devices); err != nil && err != sql.ErrNoRows {
 			return err
 		}
-		return nil
+		return d.connections.deleteStaleConnections(ctx, txn, localpart)
 	})
 }
 
 // RemoveAllDevices revokes devices by deleting the entry in the
-// database matching the given user ID localpart.
+// database matching the given user ID localpart. The dehydrated device of the
+// user is kept, so that it still receives to-device messages.
 // If something went wrong during the deletion, it will return the SQL error.
 func (d *Database) RemoveAllDevices(
 	ctx context.Context, localpart, exceptDeviceID string,
@@ -196,17 +235,178 @@ func (d *Database) RemoveAllDevices(
 		if err != nil {
 			return err
 		}
-		if err := d.devices.deleteDevicesByLocalpart(ctx, txn, localpart, exceptDeviceID); err != sql.ErrNoRows {
+		var dehydratedDeviceID string
+		dehydratedDeviceID, _, err = d.dehydratedDevices.selectDehydratedDevice(ctx, txn, localpart)
+		if err == sql.ErrNoRows {
+			if err = d.devices.deleteDevicesByLocalpart(ctx, txn, localpart, exceptDeviceID); err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			return d.connections.deleteStaleConnections(ctx, txn, localpart)
+		} else if err != nil {
+			return err
+		}
+		removed := make([]api.Device, 0, len(devices))
+		deviceIDs := make([]string, 0, len(devices))
+		for _, dev := range devices {
+			if dev.ID != dehydratedDeviceID {
+				removed = append(removed, dev)
+				deviceIDs = append(deviceIDs, dev.ID)
+			}
+		}
+		devices = removed
+		if len(deviceIDs) == 0 {
+			return nil
+		}
+		if err = d.devices.deleteDevices(ctx, txn, localpart, deviceIDs); err != nil && err != sql.ErrNoRows {
 			return err
 		}
+		return d.connections.deleteStaleConnections(ctx, txn, localpart)
+	})
+	return
+}
+
+// StoreDehydratedDevice creates a dehydrated device for the user, replacing
+// their previous one. The device gets an access token which is never given
+// out, so that it can only be used once it is claimed. Returns the device and
+// the ID of the replaced device, if any.
+func (d *Database) StoreDehydratedDevice(
+	ctx context.Context, localpart string, displayName *string, deviceData json.RawMessage,
+) (dev *api.Device, replacedDeviceID string, returnErr error) {
+	accessToken, returnErr := generateRandomString(dehydratedTokenByteLength)
+	if returnErr != nil {
+		return
+	}
+	// We generate device IDs in a loop in case its already taken.
+	// We cap this at going round 5 times to ensure we don't spin forever
+	var newDeviceID string
+	for i := 1; i <= 5; i++ {
+		newDeviceID, returnErr = generateDeviceID()
+		if returnErr != nil {
+			return
+		}
+		returnErr = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+			var err error
+			replacedDeviceID, _, err = d.dehydratedDevices.selectDehydratedDevice(ctx, txn, localpart)
+			switch err {
+			case nil:
+				if err = d.devices.deleteDevice(ctx, txn, replacedDeviceID, localpart); err != nil {
+					return err
+				}
+			case sql.ErrNoRows:
+				replacedDeviceID = ""
+			default:
+				return err
+			}
+			dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, "", 0, displayName, "", "")
+			if err != nil {
+				return err
+			}
+			return d.dehydratedDevices.upsertDehydratedDevice(ctx, txn, localpart, newDeviceID, deviceData)
+		})
+		if returnErr == nil {
+			dev.AccessToken = ""
+			return
+		}
+	}
+	return
+}
+
+// GetDehydratedDevice returns the ID and the data of the dehydrated device of
+// the user. Returns sql.ErrNoRows if the user has no dehydrated device.
+func (d *Database) GetDehydratedDevice(
+	ctx context.Context, localpart string,
+) (deviceID string, deviceData json.RawMessage, err error) {
+	return d.dehydratedDevices.selectDehydratedDevice(ctx, nil, localpart)
+}
+
+// ClaimDehydratedDevice makes the dehydrated device of the user with the given
+// ID use the access token of the user's current device, and removes the
+// current device. Returns false if the ID isn't that of the dehydrated device.
+func (d *Database) ClaimDehydratedDevice(
+	ctx context.Context, localpart, deviceID, currentDeviceID, accessToken string,
+) (claimed bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		dehydratedDeviceID, _, err := d.dehydratedDevices.selectDehydratedDevice(ctx, txn, localpart)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if dehydratedDeviceID != deviceID {
+			return nil
+		}
+		if err = d.dehydratedDevices.deleteDehydratedDevice(ctx, txn, localpart, deviceID); err != nil {
+			return err
+		}
+		// The dehydrated device takes over the refresh token too, so that
+		// the access token still has to be refreshed when it expires.
+		current, err := d.devices.selectDeviceByToken(ctx, txn, accessToken)
+		if err != nil {
+			return err
+		}
+		refreshToken, err := d.devices.selectDeviceRefreshToken(ctx, txn, accessToken)
+		if err != nil {
+			return err
+		}
+		// Remove the current device first, as access tokens are unique.
+		if err = d.devices.deleteDevice(ctx, txn, currentDeviceID, localpart); err != nil {
+			return err
+		}
+		if err = d.devices.updateDeviceTokens(ctx, txn, localpart, deviceID, accessToken, refreshToken, current.AccessTokenExpiresTS); err != nil {
+			return err
+		}
+		if err = d.connections.deleteStaleConnections(ctx, txn, localpart); err != nil {
+			return err
+		}
+		claimed = true
 		return nil
 	})
 	return
 }
 
-// UpdateDeviceLastSeen updates a the last seen timestamp and the ip address
-func (d *Database) UpdateDeviceLastSeen(ctx context.Context, localpart, deviceID, ipAddr string) error {
+// RefreshDeviceTokens replaces the access token and refresh token of the
+// device with the given refresh token, so that the refresh token can't be
+// used again. Returns the device with its new access token, or sql.ErrNoRows
+// if no device has the refresh token.
+func (d *Database) RefreshDeviceTokens(
+	ctx context.Context, refreshToken, accessToken, newRefreshToken string, accessTokenExpiresTS int64,
+) (dev *api.Device, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if err = d.devices.updateRefreshedTokens(ctx, txn, refreshToken, accessToken, newRefreshToken, accessTokenExpiresTS); err != nil {
+			return err
+		}
+		dev, err = d.devices.selectDeviceByToken(ctx, txn, accessToken)
+		return err
+	})
+	return
+}
+
+// UpdateDeviceLastSeen updates the last seen timestamp, the IP address and
+// the user agent of the device, and records the connection for whois.
+func (d *Database) UpdateDeviceLastSeen(ctx context.Context, localpart, deviceID, ipAddr, userAgent string) error {
+	lastSeenTS := time.Now().UnixNano() / 1000000
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		return d.devices.updateDeviceLastSeen(ctx, txn, localpart, deviceID, ipAddr)
+		if err := d.devices.updateDeviceLastSeen(ctx, txn, localpart, deviceID, ipAddr, userAgent, lastSeenTS); err != nil {
+			return err
+		}
+		return d.connections.upsertConnection(ctx, txn, localpart, deviceID, ipAddr, userAgent, lastSeenTS)
 	})
 }
+
+// GetDeviceConnections returns the IP addresses and user agents which each of
+// the user's devices have connected with, keyed by device ID.
+func (d *Database) GetDeviceConnections(ctx context.Context, localpart string) (map[string][]api.DeviceConnection, error) {
+	return d.connections.selectConnectionsByLocalpart(ctx, localpart)
+}
+
+// CountActiveUsers returns the number of distinct users who have used any
+// of their devices since the given timestamp, in milliseconds.
+func (d *Database) CountActiveUsers(ctx context.Context, sinceTS int64) (int64, error) {
+	return d.devices.selectActiveUserCount(ctx, sinceTS)
+}
+
+// GetDevicesLastSeenBefore returns the devices, apart from dehydrated ones,
+// which were last seen before the given timestamp, in milliseconds.
+func (d *Database) GetDevicesLastSeenBefore(ctx context.Context, beforeTS int64) ([]api.Device, error) {
+	return d.devices.selectIdleDevices(ctx, beforeTS)
+}
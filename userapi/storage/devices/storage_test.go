@@ -0,0 +1,142 @@
+package devices_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+)
+
+func mustMakeDatabase(t *testing.T) devices.Database {
+	db, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(t.TempDir(), "devices.db")),
+	}, "example.com")
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	return db
+}
+
+func TestDehydratedDevice(t *testing.T) {
+	ctx := context.TODO()
+	db := mustMakeDatabase(t)
+	current, err := db.CreateDevice(ctx, "alice", nil, "token", "", 0, nil, "", "")
+	if err != nil {
+		t.Fatalf("CreateDevice failed: %s", err)
+	}
+	if _, _, err = db.GetDehydratedDevice(ctx, "alice"); err != sql.ErrNoRows {
+		t.Fatalf("GetDehydratedDevice: got %v, want sql.ErrNoRows", err)
+	}
+
+	first, replaced, err := db.StoreDehydratedDevice(ctx, "alice", nil, json.RawMessage(`{"algorithm":"first"}`))
+	if err != nil {
+		t.Fatalf("StoreDehydratedDevice failed: %s", err)
+	}
+	if replaced != "" || first.AccessToken != "" {
+		t.Errorf("got replaced device %q and access token %q, want none", replaced, first.AccessToken)
+	}
+	dehydrated, replaced, err := db.StoreDehydratedDevice(ctx, "alice", nil, json.RawMessage(`{"algorithm":"second"}`))
+	if err != nil {
+		t.Fatalf("StoreDehydratedDevice failed: %s", err)
+	}
+	if replaced != first.ID {
+		t.Errorf("got replaced device %q, want %q", replaced, first.ID)
+	}
+	if _, err = db.GetDeviceByID(ctx, "alice", first.ID); err != sql.ErrNoRows {
+		t.Errorf("GetDeviceByID of the replaced device: got %v, want sql.ErrNoRows", err)
+	}
+	deviceID, deviceData, err := db.GetDehydratedDevice(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetDehydratedDevice failed: %s", err)
+	}
+	if deviceID != dehydrated.ID || string(deviceData) != `{"algorithm":"second"}` {
+		t.Errorf("got dehydrated device %q with %s, want %q", deviceID, deviceData, dehydrated.ID)
+	}
+
+	// Logging out of all sessions keeps the dehydrated device.
+	removed, err := db.RemoveAllDevices(ctx, "alice", "")
+	if err != nil {
+		t.Fatalf("RemoveAllDevices failed: %s", err)
+	}
+	if len(removed) != 1 || removed[0].ID != current.ID {
+		t.Errorf("got removed devices %+v, want only %q", removed, current.ID)
+	}
+	current, err = db.CreateDevice(ctx, "alice", nil, "token", "", 0, nil, "", "")
+	if err != nil {
+		t.Fatalf("CreateDevice failed: %s", err)
+	}
+
+	if claimed, err := db.ClaimDehydratedDevice(ctx, "alice", "other", current.ID, "token"); err != nil || claimed {
+		t.Errorf("ClaimDehydratedDevice of another device: got %v, %v, want false", claimed, err)
+	}
+	claimed, err := db.ClaimDehydratedDevice(ctx, "alice", dehydrated.ID, current.ID, "token")
+	if err != nil || !claimed {
+		t.Fatalf("ClaimDehydratedDevice: got %v, %v, want true", claimed, err)
+	}
+	dev, err := db.GetDeviceByAccessToken(ctx, "token")
+	if err != nil {
+		t.Fatalf("GetDeviceByAccessToken failed: %s", err)
+	}
+	if dev.ID != dehydrated.ID {
+		t.Errorf("got device %q for the access token, want the dehydrated device %q", dev.ID, dehydrated.ID)
+	}
+	if _, err = db.GetDeviceByID(ctx, "alice", current.ID); err != sql.ErrNoRows {
+		t.Errorf("GetDeviceByID of the claiming device: got %v, want sql.ErrNoRows", err)
+	}
+	if _, _, err = db.GetDehydratedDevice(ctx, "alice"); err != sql.ErrNoRows {
+		t.Errorf("GetDehydratedDevice after claiming: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestRefreshDeviceTokens(t *testing.T) {
+	ctx := context.TODO()
+	db := mustMakeDatabase(t)
+	deviceID := "ALICEDEVICE"
+	if _, err := db.CreateDevice(ctx, "alice", &deviceID, "token", "refresh", 1000, nil, "", ""); err != nil {
+		t.Fatalf("CreateDevice failed: %s", err)
+	}
+	// Devices without refresh tokens can be made alongside it.
+	if _, err := db.CreateDevice(ctx, "alice", nil, "other_token", "", 0, nil, "", ""); err != nil {
+		t.Fatalf("CreateDevice failed: %s", err)
+	}
+	if _, err := db.CreateDevice(ctx, "bob", nil, "bob_token", "", 0, nil, "", ""); err != nil {
+		t.Fatalf("CreateDevice failed: %s", err)
+	}
+	dev, err := db.GetDeviceByAccessToken(ctx, "token")
+	if err != nil {
+		t.Fatalf("GetDeviceByAccessToken failed: %s", err)
+	}
+	if dev.AccessTokenExpiresTS != 1000 {
+		t.Errorf("got access token expiry %d, want 1000", dev.AccessTokenExpiresTS)
+	}
+
+	dev, err = db.RefreshDeviceTokens(ctx, "refresh", "new_token", "new_refresh", 2000)
+	if err != nil {
+		t.Fatalf("RefreshDeviceTokens failed: %s", err)
+	}
+	if dev.ID != deviceID || dev.UserID != "@alice:example.com" || dev.AccessToken != "new_token" || dev.AccessTokenExpiresTS != 2000 {
+		t.Errorf("got device %+v, want %s with the new access token", dev, deviceID)
+	}
+	if _, err = db.GetDeviceByAccessToken(ctx, "token"); err != sql.ErrNoRows {
+		t.Errorf("GetDeviceByAccessToken of the old access token: got %v, want sql.ErrNoRows", err)
+	}
+	// Refresh tokens can only be used once.
+	if _, err = db.RefreshDeviceTokens(ctx, "refresh", "newer_token", "newer_refresh", 3000); err != sql.ErrNoRows {
+		t.Errorf("RefreshDeviceTokens with a used refresh token: got %v, want sql.ErrNoRows", err)
+	}
+	if _, err = db.RefreshDeviceTokens(ctx, "", "newer_token", "newer_refresh", 3000); err != sql.ErrNoRows {
+		t.Errorf("RefreshDeviceTokens without a refresh token: got %v, want sql.ErrNoRows", err)
+	}
+
+	// The refresh token goes away with the device.
+	if err = db.RemoveDevice(ctx, deviceID, "alice"); err != nil {
+		t.Fatalf("RemoveDevice failed: %s", err)
+	}
+	if _, err = db.RefreshDeviceTokens(ctx, "new_refresh", "newer_token", "newer_refresh", 3000); err != sql.ErrNoRows {
+		t.Errorf("RefreshDeviceTokens of a removed device: got %v, want sql.ErrNoRows", err)
+	}
+}
@@ -15,17 +15,32 @@
 package userapi
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/pushgateway"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/consumers"
+	"github.com/matrix-org/dendrite/userapi/email"
 	"github.com/matrix-org/dendrite/userapi/internal"
 	"github.com/matrix-org/dendrite/userapi/inthttp"
+	"github.com/matrix-org/dendrite/userapi/producers"
+	"github.com/matrix-org/dendrite/userapi/pushqueue"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/sirupsen/logrus"
 )
 
+// pushRulesCacheSize is the number of users whose push rules are kept in
+// memory for evaluating them against new events.
+const pushRulesCacheSize = 10000
+
 // AddInternalRoutes registers HTTP handlers for the internal API. Invokes functions
 // on the given input API.
 func AddInternalRoutes(router *mux.Router, intAPI api.UserInternalAPI) {
@@ -35,18 +50,131 @@ func AddInternalRoutes(router *mux.Router, intAPI api.UserInternalAPI) {
 // NewInternalAPI returns a concerete implementation of the internal API. Callers
 // can call functions directly on the returned API or via an HTTP interface using AddInternalRoutes.
 func NewInternalAPI(
-	accountDB accounts.Database, cfg *config.UserAPI, appServices []config.ApplicationService, keyAPI keyapi.KeyInternalAPI,
+	base *base.BaseDendrite, accountDB accounts.Database, cfg *config.UserAPI,
+	appServices []config.ApplicationService, keyAPI keyapi.KeyInternalAPI,
+	rsAPI rsapi.RoomserverInternalAPI,
 ) api.UserInternalAPI {
+	js := jetstream.Prepare(&cfg.Matrix.JetStream)
+
 	deviceDB, err := devices.NewDatabase(&cfg.DeviceDatabase, cfg.Matrix.ServerName)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to device db")
 	}
 
-	return &internal.UserInternalAPI{
+	syncProducer := producers.NewSyncAPI(
+		accountDB, js, cfg.Matrix.JetStream.TopicFor(jetstream.OutputNotificationData),
+		cfg.Matrix.JetStream.TopicFor(jetstream.OutputDeletedDevices),
+		cfg.Matrix.ServerName,
+	)
+
+	var emailer *email.Notifier
+	if cfg.EmailNotifications.Enabled {
+		emailer, err = email.NewNotifier(
+			base.ProcessContext, cfg, accountDB, rsAPI,
+			email.NewSMTPSender(&cfg.EmailNotifications.SMTP),
+		)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to set up email notifications")
+		}
+	}
+
+	userAPI := &internal.UserInternalAPI{
 		AccountDB:   accountDB,
 		DeviceDB:    deviceDB,
 		ServerName:  cfg.Matrix.ServerName,
 		AppServices: appServices,
 		KeyAPI:      keyAPI,
+		RSAPI:       rsAPI,
+		Config:      cfg,
+
+		PushGatewayClient: pushgateway.NewRestrictedHTTPClient(&cfg.PushGateways, 10*time.Second),
+		SyncProducer:      syncProducer,
+	}
+	if cfg.LoginThrottle.Enabled {
+		userAPI.LoginThrottle = internal.NewLoginThrottle(&cfg.LoginThrottle)
+	}
+
+	pushClients := map[api.PusherKind]pushgateway.Client{
+		api.HTTPKind: pushgateway.NewHTTPClient(&cfg.PushGateways),
+	}
+	if cfg.WebPush.Enabled() {
+		pushClients[api.WebPushKind], err = pushgateway.NewWebPushClient(&cfg.WebPush, &cfg.PushGateways)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to set up WebPush")
+		}
+	}
+	pushQueue := pushqueue.NewQueue(base.ProcessContext, accountDB, pushClients, userAPI)
+	pushQueue.Start()
+
+	pushRules, err := consumers.NewPushRulesCache(accountDB, pushRulesCacheSize)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to create the push rules cache")
+	}
+	clientConsumer := consumers.NewOutputClientDataConsumer(
+		base.ProcessContext, cfg, js, pushRules,
+	)
+	if err = clientConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start user API client API consumer")
 	}
+
+	rsConsumer := consumers.NewOutputRoomEventConsumer(
+		base.ProcessContext, cfg, js, accountDB, pushQueue, pushRules, rsAPI, syncProducer, emailer,
+	)
+	if err = rsConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start user API room server consumer")
+	}
+
+	userDirectoryConsumer := consumers.NewOutputUserDirectoryConsumer(
+		base.ProcessContext, cfg, js, accountDB,
+	)
+	if err = userDirectoryConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start user API user directory consumer")
+	}
+
+	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+		base.ProcessContext, cfg, js, accountDB, syncProducer,
+	)
+	if err = receiptConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start user API receipt consumer")
+	}
+
+	mauStats := &internal.MonthlyActiveUserStats{
+		AccountDB: accountDB,
+	}
+	go mauStats.Start()
+
+	if cfg.SessionExpiry.IdleLifetime > 0 {
+		sessionExpiry := &internal.SessionExpiry{
+			Cfg:     &cfg.SessionExpiry,
+			UserAPI: userAPI,
+		}
+		go sessionExpiry.Start()
+	}
+
+	if cfg.AccountValidity.Period > 0 {
+		mailer, err := email.NewRenewalMailer(cfg, email.NewSMTPSender(&cfg.AccountValidity.SMTP))
+		if err != nil {
+			logrus.WithError(err).Panic("failed to set up account renewal emails")
+		}
+		accountValidity := &internal.AccountValidity{
+			Cfg:       &cfg.AccountValidity,
+			AccountDB: accountDB,
+			Mailer:    mailer,
+		}
+		go accountValidity.Start()
+	}
+
+	if cfg.Matrix.ReportStats.Enabled {
+		stats := &internal.PhoneHomeStats{
+			Cfg:       cfg,
+			AccountDB: accountDB,
+			DeviceDB:  deviceDB,
+			RSAPI:     rsAPI,
+			Client:    &http.Client{Timeout: time.Second * 30},
+			StartTime: time.Now(),
+		}
+		go stats.Start()
+	}
+
+	return userAPI
 }
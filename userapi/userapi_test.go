@@ -2,14 +2,21 @@ package userapi_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/passwordhash"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/internal/test"
+	"github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -26,29 +33,30 @@ const (
 func MustMakeInternalAPI(t *testing.T) (api.UserInternalAPI, accounts.Database) {
 	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
 		ConnectionString: "file::memory:",
-	}, serverName, bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS)
+	}, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
 	if err != nil {
 		t.Fatalf("failed to create account DB: %s", err)
 	}
-	cfg := &config.UserAPI{
-		DeviceDatabase: config.DatabaseOptions{
-			ConnectionString:   "file::memory:",
-			MaxOpenConnections: 1,
-			MaxIdleConnections: 1,
-		},
-		Matrix: &config.Global{
-			ServerName: serverName,
-		},
+	cfg := &config.Dendrite{}
+	cfg.Defaults(true)
+	cfg.Global.ServerName = serverName
+	cfg.Global.JetStream.InMemory = true
+	cfg.Global.JetStream.StoragePath = config.Path(t.TempDir())
+	cfg.UserAPI.DeviceDatabase = config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
 	}
+	base := base.NewBaseDendrite(cfg, "Monolith", base.NoCacheMetrics)
 
-	return userapi.NewInternalAPI(accountDB, cfg, nil, nil), accountDB
+	return userapi.NewInternalAPI(base, accountDB, &cfg.UserAPI, nil, nil, nil), accountDB
 }
 
 func TestQueryProfile(t *testing.T) {
 	aliceAvatarURL := "mxc://example.com/alice"
 	aliceDisplayName := "Alice"
 	userAPI, accountDB := MustMakeInternalAPI(t)
-	_, err := accountDB.CreateAccount(context.TODO(), "alice", "foobar", "")
+	_, err := accountDB.CreateAccount(context.TODO(), "alice", "foobar", "", api.AccountTypeUser)
 	if err != nil {
 		t.Fatalf("failed to make account: %s", err)
 	}
@@ -119,3 +127,581 @@ func TestQueryProfile(t *testing.T) {
 		runCases(userAPI)
 	})
 }
+
+func TestQueryAccountByLocalpart(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	if _, err := accountDB.CreateAccount(context.TODO(), "alice", "foobar", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	if _, err := accountDB.CreateAccount(context.TODO(), "admin", "foobar", "", api.AccountTypeAdmin); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+
+	testCases := []struct {
+		localpart       string
+		wantExists      bool
+		wantAccountType api.AccountType
+	}{
+		{localpart: "alice", wantExists: true, wantAccountType: api.AccountTypeUser},
+		{localpart: "admin", wantExists: true, wantAccountType: api.AccountTypeAdmin},
+		{localpart: "bob", wantExists: false},
+	}
+
+	runCases := func(testAPI api.UserInternalAPI) {
+		for _, tc := range testCases {
+			var res api.QueryAccountByLocalpartResponse
+			if err := testAPI.QueryAccountByLocalpart(context.TODO(), &api.QueryAccountByLocalpartRequest{
+				Localpart: tc.localpart,
+			}, &res); err != nil {
+				t.Errorf("QueryAccountByLocalpart returned error: %s", err)
+				continue
+			}
+			if exists := res.Account != nil; exists != tc.wantExists {
+				t.Errorf("QueryAccountByLocalpart(%s) exists got %v want %v", tc.localpart, exists, tc.wantExists)
+				continue
+			}
+			if res.Account != nil && res.Account.AccountType != tc.wantAccountType {
+				t.Errorf("QueryAccountByLocalpart(%s) account type got %d want %d", tc.localpart, res.Account.AccountType, tc.wantAccountType)
+			}
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		runCases(userAPI)
+	})
+}
+
+func TestQueryNotifications(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	for i := 1; i <= 5; i++ {
+		if err := accountDB.InsertNotification(context.TODO(), "alice", "", i%2 == 0, &api.Notification{
+			RoomID: "!room:example.com",
+			Event: gomatrixserverlib.ClientEvent{
+				EventID: fmt.Sprintf("$event%d:example.com", i),
+				Content: gomatrixserverlib.RawJSON(`{}`),
+			},
+		}); err != nil {
+			t.Fatalf("failed to insert notification: %s", err)
+		}
+	}
+
+	eventIDs := func(res *api.QueryNotificationsResponse) []string {
+		var ids []string
+		for _, n := range res.Notifications {
+			ids = append(ids, n.Event.EventID)
+		}
+		return ids
+	}
+
+	// The notifications are returned newest first, a page at a time.
+	var res api.QueryNotificationsResponse
+	if err := userAPI.QueryNotifications(context.TODO(), &api.QueryNotificationsRequest{
+		Localpart: "alice", Limit: 3,
+	}, &res); err != nil {
+		t.Fatalf("QueryNotifications failed: %s", err)
+	}
+	if got, want := eventIDs(&res), []string{"$event5:example.com", "$event4:example.com", "$event3:example.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("first page got %v want %v", got, want)
+	}
+	if res.NextToken == "" {
+		t.Fatalf("first page has no next token")
+	}
+	from := res.NextToken
+	res = api.QueryNotificationsResponse{}
+	if err := userAPI.QueryNotifications(context.TODO(), &api.QueryNotificationsRequest{
+		Localpart: "alice", Limit: 3, From: from,
+	}, &res); err != nil {
+		t.Fatalf("QueryNotifications failed: %s", err)
+	}
+	if got, want := eventIDs(&res), []string{"$event2:example.com", "$event1:example.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("second page got %v want %v", got, want)
+	}
+	if res.NextToken != "" {
+		t.Fatalf("last page has next token %q", res.NextToken)
+	}
+
+	res = api.QueryNotificationsResponse{}
+	if err := userAPI.QueryNotifications(context.TODO(), &api.QueryNotificationsRequest{
+		Localpart: "alice", Only: "highlight",
+	}, &res); err != nil {
+		t.Fatalf("QueryNotifications failed: %s", err)
+	}
+	if got, want := eventIDs(&res), []string{"$event4:example.com", "$event2:example.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("highlights got %v want %v", got, want)
+	}
+
+	res = api.QueryNotificationsResponse{}
+	if err := userAPI.QueryNotifications(context.TODO(), &api.QueryNotificationsRequest{
+		Localpart: "bob",
+	}, &res); err != nil {
+		t.Fatalf("QueryNotifications failed: %s", err)
+	}
+	if len(res.Notifications) != 0 {
+		t.Fatalf("got %d notifications for a user without any", len(res.Notifications))
+	}
+}
+
+func TestNotificationsRead(t *testing.T) {
+	_, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	for i := 1; i <= 3; i++ {
+		// The later events are in a thread.
+		threadID := ""
+		if i > 1 {
+			threadID = "$root:example.com"
+		}
+		if err := accountDB.InsertNotification(ctx, "alice", threadID, i == 3, &api.Notification{
+			RoomID: "!room:example.com",
+			Event: gomatrixserverlib.ClientEvent{
+				EventID: fmt.Sprintf("$event%d:example.com", i),
+				Content: gomatrixserverlib.RawJSON(`{}`),
+			},
+			TS: gomatrixserverlib.Timestamp(i * 1000),
+		}); err != nil {
+			t.Fatalf("failed to insert notification: %s", err)
+		}
+	}
+	mustCount := func(wantTotal, wantHighlight int64) {
+		t.Helper()
+		total, highlight, err := accountDB.GetRoomNotificationCounts(ctx, "alice", "!room:example.com")
+		if err != nil {
+			t.Fatalf("GetRoomNotificationCounts failed: %s", err)
+		}
+		if total != wantTotal || highlight != wantHighlight {
+			t.Fatalf("got %d notifications and %d highlights, want %d and %d", total, highlight, wantTotal, wantHighlight)
+		}
+	}
+	// The other room's notification is part of the count sent to push
+	// gateways, but not of the room's counts.
+	if err := accountDB.InsertNotification(ctx, "alice", "", false, &api.Notification{
+		RoomID: "!other:example.com",
+		Event: gomatrixserverlib.ClientEvent{
+			EventID: "$event:example.com",
+			Content: gomatrixserverlib.RawJSON(`{}`),
+		},
+		TS: gomatrixserverlib.Timestamp(1000),
+	}); err != nil {
+		t.Fatalf("failed to insert notification: %s", err)
+	}
+	mustCountAll := func(want int64) {
+		t.Helper()
+		count, err := accountDB.GetNotificationCount(ctx, "alice")
+		if err != nil {
+			t.Fatalf("GetNotificationCount failed: %s", err)
+		}
+		if count != want {
+			t.Fatalf("got %d notifications in all rooms, want %d", count, want)
+		}
+	}
+	mustCountThread := func(wantTotal, wantHighlight int64) {
+		t.Helper()
+		counts, err := accountDB.GetRoomThreadNotificationCounts(ctx, "alice", "!room:example.com")
+		if err != nil {
+			t.Fatalf("GetRoomThreadNotificationCounts failed: %s", err)
+		}
+		if wantTotal == 0 {
+			if len(counts) != 0 {
+				t.Fatalf("got thread counts %+v, want none", counts)
+			}
+			return
+		}
+		c, ok := counts["$root:example.com"]
+		if len(counts) != 1 || !ok {
+			t.Fatalf("got thread counts %+v, want counts for $root:example.com only", counts)
+		}
+		if c.Total != wantTotal || c.Highlight != wantHighlight {
+			t.Fatalf("got %d thread notifications and %d highlights, want %d and %d", c.Total, c.Highlight, wantTotal, wantHighlight)
+		}
+	}
+	mustCount(3, 1)
+	mustCountThread(2, 1)
+	mustCountAll(4)
+
+	// A receipt for an event with a notification reads up to that notification.
+	if updated, err := accountDB.SetNotificationsRead(ctx, "alice", "!room:example.com", "$event2:example.com", 0); err != nil || !updated {
+		t.Fatalf("SetNotificationsRead returned %v, %v", updated, err)
+	}
+	mustCount(1, 1)
+	mustCountThread(1, 1)
+	mustCountAll(2)
+
+	// A receipt for any other event reads the notifications created before it.
+	if updated, err := accountDB.SetNotificationsRead(ctx, "alice", "!room:example.com", "$other:example.com", 2500); err != nil || updated {
+		t.Fatalf("SetNotificationsRead returned %v, %v", updated, err)
+	}
+	if updated, err := accountDB.SetNotificationsRead(ctx, "alice", "!room:example.com", "$other:example.com", 3000); err != nil || !updated {
+		t.Fatalf("SetNotificationsRead returned %v, %v", updated, err)
+	}
+	mustCount(0, 0)
+	mustCountThread(0, 0)
+	mustCountAll(1)
+}
+
+func TestPerformPusherSetChecksURL(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+
+	runCases := func(t *testing.T, testAPI api.UserInternalAPI) {
+		pusher := api.Pusher{
+			Kind:    api.HTTPKind,
+			AppID:   "com.example.app",
+			PushKey: "key",
+			Data:    map[string]interface{}{"url": "http://127.0.0.1:5000/_matrix/push/v1/notify"},
+		}
+		var res api.PerformPusherSetResponse
+		if err := testAPI.PerformPusherSet(ctx, &api.PerformPusherSetRequest{Localpart: "alice", Pusher: pusher}, &res); err != nil {
+			t.Fatalf("PerformPusherSet failed: %s", err)
+		}
+		if res.Error == nil || !strings.HasPrefix(res.Error.Message, "data.url") {
+			t.Fatalf("got error %+v want a push gateway at a private address to be refused", res.Error)
+		}
+		pushers, err := accountDB.GetPushers(ctx, "alice")
+		if err != nil {
+			t.Fatalf("failed to get pushers: %s", err)
+		}
+		if len(pushers) != 0 {
+			t.Fatalf("got pushers %+v want none", pushers)
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(t, httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		runCases(t, userAPI)
+	})
+}
+
+func TestPerformPushersDeletion(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	for _, p := range []struct {
+		Localpart string
+		AppID     string
+		URL       string
+	}{
+		{"alice", "com.example.app", "https://push.example.com/_matrix/push/v1/notify"},
+		{"bob", "com.example.app", "https://evil.example.com/_matrix/push/v1/notify"},
+		{"bob", "com.example.other", "https://push.example.com/_matrix/push/v1/notify"},
+	} {
+		pusher := api.Pusher{
+			Kind:    api.HTTPKind,
+			AppID:   p.AppID,
+			PushKey: "key",
+			Data:    map[string]interface{}{"url": p.URL},
+		}
+		if err := accountDB.UpsertPusher(ctx, pusher, p.Localpart); err != nil {
+			t.Fatalf("failed to add pusher: %s", err)
+		}
+	}
+
+	tsts := []struct {
+		Name   string
+		Filter api.PusherFilter
+		Want   []string
+	}{
+		{"all", api.PusherFilter{}, []string{"alice/com.example.app", "bob/com.example.app", "bob/com.example.other"}},
+		{"localpart", api.PusherFilter{Localpart: "bob"}, []string{"bob/com.example.app", "bob/com.example.other"}},
+		{"appID", api.PusherFilter{AppID: "com.example.app"}, []string{"alice/com.example.app", "bob/com.example.app"}},
+		{"url", api.PusherFilter{URL: "https://push.example.com/_matrix/push/v1/notify"}, []string{"alice/com.example.app", "bob/com.example.other"}},
+		{"none", api.PusherFilter{Localpart: "alice", AppID: "com.example.other"}, nil},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			var res api.QueryAllPushersResponse
+			if err := userAPI.QueryAllPushers(ctx, &api.QueryAllPushersRequest{PusherFilter: tst.Filter}, &res); err != nil {
+				t.Fatalf("QueryAllPushers failed: %s", err)
+			}
+			var got []string
+			for _, pusher := range res.Pushers {
+				got = append(got, pusher.Localpart+"/"+pusher.AppID)
+			}
+			if !reflect.DeepEqual(got, tst.Want) {
+				t.Errorf("got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+
+	err := userAPI.PerformPushersDeletion(ctx, &api.PerformPushersDeletionRequest{}, &api.PerformPushersDeletionResponse{})
+	if err == nil {
+		t.Fatalf("got no error, want removing all pushers to be refused")
+	}
+	var res api.PerformPushersDeletionResponse
+	if err = userAPI.PerformPushersDeletion(ctx, &api.PerformPushersDeletionRequest{
+		PusherFilter: api.PusherFilter{URL: "https://evil.example.com/_matrix/push/v1/notify"},
+	}, &res); err != nil {
+		t.Fatalf("PerformPushersDeletion failed: %s", err)
+	}
+	if len(res.Pushers) != 1 || res.Pushers[0].Localpart != "bob" || res.Pushers[0].AppID != "com.example.app" {
+		t.Fatalf("got removed pushers %+v, want bob's com.example.app pusher", res.Pushers)
+	}
+	pushers, err := accountDB.GetPushers(ctx, "bob")
+	if err != nil {
+		t.Fatalf("failed to get pushers: %s", err)
+	}
+	if len(pushers) != 1 || pushers[0].AppID != "com.example.other" {
+		t.Fatalf("got pushers %+v, want only com.example.other", pushers)
+	}
+}
+
+func TestQueryAccountDataDefaultPushRules(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	var res api.QueryAccountDataResponse
+	if err := userAPI.QueryAccountData(context.TODO(), &api.QueryAccountDataRequest{
+		UserID:   "@alice:" + string(serverName),
+		DataType: "m.push_rules",
+	}, &res); err != nil {
+		t.Fatalf("QueryAccountData failed: %s", err)
+	}
+	var ruleSets pushrules.AccountRuleSets
+	if err := json.Unmarshal(res.GlobalAccountData["m.push_rules"], &ruleSets); err != nil {
+		t.Fatalf("got push rules %s, want the default push rules: %s", res.GlobalAccountData["m.push_rules"], err)
+	}
+	if len(ruleSets.Global.Override) == 0 || ruleSets.Global.Override[0].RuleID != pushrules.MRuleMaster {
+		t.Errorf("got push rules %+v, want the default push rules", ruleSets.Global)
+	}
+
+	// Stored push rules get the default rules which they don't have.
+	if err := accountDB.SaveAccountData(context.TODO(), "alice", "", "m.push_rules", json.RawMessage(
+		`{"global":{"override":[{"rule_id":".m.rule.master","default":true,"enabled":true,"actions":["dont_notify"]}]}}`,
+	)); err != nil {
+		t.Fatalf("failed to save push rules: %s", err)
+	}
+	if err := userAPI.QueryAccountData(context.TODO(), &api.QueryAccountDataRequest{
+		UserID:   "@alice:" + string(serverName),
+		DataType: "m.push_rules",
+	}, &res); err != nil {
+		t.Fatalf("QueryAccountData failed: %s", err)
+	}
+	ruleSets = pushrules.AccountRuleSets{}
+	if err := json.Unmarshal(res.GlobalAccountData["m.push_rules"], &ruleSets); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	override := ruleSets.Global.Override
+	if len(override) < 2 || !override[0].Enabled || override[1].RuleID != pushrules.MRuleSuppressNotices {
+		t.Errorf("got override rules %+v, want the enabled master rule followed by the other defaults", override)
+	}
+	if len(ruleSets.Global.Underride) == 0 {
+		t.Errorf("got no underride rules, want the default underride rules")
+	}
+}
+
+func TestPerformKeyBackupDeleteKeys(t *testing.T) {
+	userAPI, _ := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	userID := "@alice:example.com"
+	var createRes api.PerformKeyBackupResponse
+	if err := userAPI.PerformKeyBackup(ctx, &api.PerformKeyBackupRequest{
+		UserID:    userID,
+		Algorithm: "m.megolm_backup.v1.curve25519-aes-sha2",
+		AuthData:  json.RawMessage(`{}`),
+	}, &createRes); err != nil {
+		t.Fatalf("failed to create backup: %s", err)
+	}
+	uploadReq := &api.PerformKeyBackupRequest{UserID: userID, Version: createRes.Version}
+	uploadReq.Keys.Rooms = map[string]struct {
+		Sessions map[string]api.KeyBackupSession `json:"sessions"`
+	}{}
+	for _, roomID := range []string{"!a:example.com", "!b:example.com"} {
+		sessions := map[string]api.KeyBackupSession{}
+		for _, sessionID := range []string{"s1", "s2"} {
+			sessions[sessionID] = api.KeyBackupSession{SessionData: json.RawMessage(`{}`)}
+		}
+		uploadReq.Keys.Rooms[roomID] = struct {
+			Sessions map[string]api.KeyBackupSession `json:"sessions"`
+		}{Sessions: sessions}
+	}
+	var uploadRes api.PerformKeyBackupResponse
+	if err := userAPI.PerformKeyBackup(ctx, uploadReq, &uploadRes); err != nil {
+		t.Fatalf("failed to upload keys: %s", err)
+	}
+
+	etag := uploadRes.KeyETag
+	tsts := []struct {
+		Name       string
+		RoomID     string
+		SessionID  string
+		WantCount  int64
+		WantChange bool
+	}{
+		{"session", "!a:example.com", "s1", 3, true},
+		{"missingSession", "!a:example.com", "s1", 3, false},
+		{"room", "!b:example.com", "", 1, true},
+		{"all", "", "", 0, true},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			var res api.PerformKeyBackupResponse
+			if err := userAPI.PerformKeyBackup(ctx, &api.PerformKeyBackupRequest{
+				UserID:           userID,
+				Version:          createRes.Version,
+				DeleteKeys:       true,
+				KeysForRoomID:    tst.RoomID,
+				KeysForSessionID: tst.SessionID,
+			}, &res); err != nil {
+				t.Fatalf("PerformKeyBackup failed: %s", err)
+			}
+			if !res.Exists || res.KeyCount != tst.WantCount {
+				t.Errorf("got exists=%v count=%d, want exists=true count=%d", res.Exists, res.KeyCount, tst.WantCount)
+			}
+			if changed := res.KeyETag != etag; changed != tst.WantChange {
+				t.Errorf("got etag %q after %q, want changed=%v", res.KeyETag, etag, tst.WantChange)
+			}
+			etag = res.KeyETag
+		})
+	}
+
+	var res api.PerformKeyBackupResponse
+	if err := userAPI.PerformKeyBackup(ctx, &api.PerformKeyBackupRequest{
+		UserID:     userID,
+		Version:    "100",
+		DeleteKeys: true,
+	}, &res); err != nil {
+		t.Fatalf("PerformKeyBackup failed: %s", err)
+	}
+	if res.Exists {
+		t.Errorf("got exists=true, want deleting keys from an unknown version to fail")
+	}
+}
+
+func TestOpenIDToken(t *testing.T) {
+	userAPI, _ := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	userID := "@alice:example.com"
+
+	var createRes api.PerformOpenIDTokenCreationResponse
+	if err := userAPI.PerformOpenIDTokenCreation(ctx, &api.PerformOpenIDTokenCreationRequest{UserID: userID}, &createRes); err != nil {
+		t.Fatalf("PerformOpenIDTokenCreation failed: %s", err)
+	}
+	var otherRes api.PerformOpenIDTokenCreationResponse
+	if err := userAPI.PerformOpenIDTokenCreation(ctx, &api.PerformOpenIDTokenCreationRequest{UserID: userID}, &otherRes); err != nil {
+		t.Fatalf("PerformOpenIDTokenCreation failed: %s", err)
+	}
+	if createRes.Token.Token == "" || createRes.Token.Token == otherRes.Token.Token {
+		t.Fatalf("got tokens %q and %q, want two different tokens", createRes.Token.Token, otherRes.Token.Token)
+	}
+
+	var queryRes api.QueryOpenIDTokenResponse
+	if err := userAPI.QueryOpenIDToken(ctx, &api.QueryOpenIDTokenRequest{Token: createRes.Token.Token}, &queryRes); err != nil {
+		t.Fatalf("QueryOpenIDToken failed: %s", err)
+	}
+	if queryRes.Sub != userID || queryRes.ExpiresAtMS != createRes.Token.ExpiresAtMS {
+		t.Errorf("got sub %q expiring at %d, want %q expiring at %d", queryRes.Sub, queryRes.ExpiresAtMS, userID, createRes.Token.ExpiresAtMS)
+	}
+
+	var unknownRes api.QueryOpenIDTokenResponse
+	if err := userAPI.QueryOpenIDToken(ctx, &api.QueryOpenIDTokenRequest{Token: "unknown"}, &unknownRes); err != nil {
+		t.Fatalf("QueryOpenIDToken failed for an unknown token: %s", err)
+	}
+	if unknownRes.Sub != "" {
+		t.Errorf("got sub %q for an unknown token, want none", unknownRes.Sub)
+	}
+}
+
+func TestGetAccountByPasswordRehashes(t *testing.T) {
+	ctx := context.TODO()
+	dbOptions := &config.DatabaseOptions{
+		ConnectionString:   config.DataSource("file:" + filepath.Join(t.TempDir(), "accounts.db")),
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}
+	bcryptDB, err := accounts.NewDatabase(dbOptions, serverName, &passwordhash.Hasher{BCryptCost: bcrypt.MinCost}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	if _, err = bcryptDB.CreateAccount(ctx, "alice", "password", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	argon2idDB, err := accounts.NewDatabase(dbOptions, serverName, &passwordhash.Hasher{
+		Algorithm: config.PasswordHashingArgon2id,
+		Argon2id:  config.Argon2id{Time: 1, Memory: 64, Threads: 1},
+	}, config.DefaultOpenIDTokenLifetimeMS, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	db, err := sqlutil.Open(dbOptions)
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	passwordHash := func() string {
+		var hash string
+		if err := db.QueryRow("SELECT password_hash FROM account_accounts WHERE localpart = 'alice'").Scan(&hash); err != nil {
+			t.Fatalf("failed to select password hash: %s", err)
+		}
+		return hash
+	}
+
+	if _, err = argon2idDB.GetAccountByPassword(ctx, "alice", "wrong"); err == nil {
+		t.Fatalf("GetAccountByPassword succeeded with the wrong password")
+	}
+	if hash := passwordHash(); !strings.HasPrefix(hash, "$2a$") {
+		t.Fatalf("got hash %q after a failed login, want the bcrypt hash", hash)
+	}
+	if _, err = argon2idDB.GetAccountByPassword(ctx, "alice", "password"); err != nil {
+		t.Fatalf("GetAccountByPassword failed: %s", err)
+	}
+	if hash := passwordHash(); !strings.HasPrefix(hash, "$argon2id$") {
+		t.Fatalf("got hash %q after logging in, want an argon2id hash", hash)
+	}
+	// Both algorithms can check the password once it has been rehashed.
+	if _, err = argon2idDB.GetAccountByPassword(ctx, "alice", "password"); err != nil {
+		t.Errorf("GetAccountByPassword failed after rehashing: %s", err)
+	}
+	if _, err = bcryptDB.GetAccountByPassword(ctx, "alice", "password"); err != nil {
+		t.Errorf("GetAccountByPassword failed with bcrypt after rehashing: %s", err)
+	}
+}
+
+func TestQueryAccessTokenLockedAccount(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	if _, err := accountDB.CreateAccount(ctx, "alice", "foobar", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	var devRes api.PerformDeviceCreationResponse
+	if err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:          "alice",
+		AccessToken:        "alice_token",
+		NoDeviceListUpdate: true,
+	}, &devRes); err != nil {
+		t.Fatalf("PerformDeviceCreation failed: %s", err)
+	}
+
+	for _, locked := range []bool{false, true, false} {
+		if err := accountDB.SetAccountLocked(ctx, "alice", locked); err != nil {
+			t.Fatalf("SetAccountLocked failed: %s", err)
+		}
+		var res api.QueryAccessTokenResponse
+		if err := userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{
+			AccessToken: "alice_token",
+		}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		// Locked users keep their devices.
+		if res.Device == nil || res.Device.ID != devRes.Device.ID {
+			t.Errorf("got device %+v, want %+v", res.Device, devRes.Device)
+		}
+		if res.Locked != locked {
+			t.Errorf("got locked %v, want %v", res.Locked, locked)
+		}
+	}
+}